@@ -26,7 +26,8 @@ export async function POST(req: Request, ctx: { params: { id: string }}) {
   const id = ctx.params.id;
   const body = await req.text();
   const upstream = `${CONSOLE_SERVICE_URL}/api/v1/console/users/${id}/tokens`;
-  const res = await fetch(upstream, { method: 'POST', headers: { Authorization: `Bearer ${token}`, 'Content-Type':'application/json' }, body });
+  const idem = req.headers.get('X-Idempotency-Key') || crypto.randomUUID();
+  const res = await fetch(upstream, { method: 'POST', headers: { Authorization: `Bearer ${token}`, 'Content-Type':'application/json', 'X-Idempotency-Key': idem }, body });
   const payload = await res.json().catch(()=>({}));
   return new Response(JSON.stringify(payload), { status: res.status, headers: { 'Content-Type': 'application/json' } });
 }
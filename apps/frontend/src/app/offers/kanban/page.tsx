@@ -369,7 +369,8 @@ export default function OfferKanbanPage() {
               if (ln.startsWith('event:')) type = ln.slice(6).trim();
               else if (ln.startsWith('data:')) data += ln.slice(5).trim();
             }
-            if (type === 'new') {
+            // 'update' re-sends a notification that absorbed repeats (e.g. further workflow steps)
+            if (type === 'new' || type === 'update') {
               try {
                 const j = JSON.parse(data || '{}');
                 const t = (j.type || '').toString();
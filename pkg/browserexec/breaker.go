@@ -0,0 +1,61 @@
+package browserexec
+
+import (
+    "sync"
+    "time"
+)
+
+// breaker is a concurrency-safe consecutive-failure breaker: it opens after threshold failures,
+// lets a single probe through after cooldown (half-open) and closes again on success.
+type breaker struct {
+    mu        sync.Mutex
+    threshold int
+    cooldown  time.Duration
+    fails     int
+    open      bool
+    probing   bool
+    openedAt  time.Time
+    now       func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+    if cooldown <= 0 { cooldown = 10 * time.Second }
+    return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+func (b *breaker) allow() bool {
+    if b == nil { return true }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.open { return true }
+    if b.probing || b.now().Sub(b.openedAt) < b.cooldown { return false }
+    b.probing = true
+    return true
+}
+
+// release ends an attempt without an outcome (the caller cancelled it): the state is kept and a
+// half-open probe slot is freed for the next call.
+func (b *breaker) release() {
+    if b == nil { return }
+    b.mu.Lock()
+    b.probing = false
+    b.mu.Unlock()
+}
+
+func (b *breaker) record(success bool) {
+    if b == nil { return }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.probing = false
+    if success {
+        b.fails = 0
+        if b.open { b.open = false; metricCircuitOpen.Set(0) }
+        return
+    }
+    b.fails++
+    if b.open || b.fails >= b.threshold {
+        b.open = true
+        b.openedAt = b.now()
+        metricCircuitOpen.Set(1)
+    }
+}
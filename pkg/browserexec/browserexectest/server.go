@@ -0,0 +1,182 @@
+// Package browserexectest provides an in-process fake of the browser-exec service for tests.
+//
+//  srv := browserexectest.NewServer()
+//  defer srv.Close()
+//  srv.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(503, "OVERLOADED", "busy"))
+//  srv.Handle(browserexec.EndpointPageSignals, func(c browserexectest.Call) browserexectest.Response {
+//      return browserexectest.OK(browserexec.PageSignals{Status: 200, Title: "Shop"})
+//  })
+//  cli := srv.Client()
+//
+// Every endpoint has a default answer so unscripted calls succeed offline.
+package browserexectest
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+)
+
+// Response is one scripted answer. Body is JSON-encoded; Delay is applied before writing
+// (the request context is honoured, so client deadlines fire as they would in production).
+type Response struct {
+    Status int
+    Body   any
+    Header map[string]string
+    Delay  time.Duration
+}
+
+// OK answers 200 with body.
+func OK(body any) Response { return Response{Status: http.StatusOK, Body: body} }
+
+// Fail answers status with browser-exec's error envelope.
+func Fail(status int, code, message string) Response {
+    return Response{Status: status, Body: map[string]any{"error": map[string]string{"code": code, "message": message}}}
+}
+
+// Call is a recorded request.
+type Call struct {
+    Endpoint string
+    Body     json.RawMessage
+    Header   http.Header
+}
+
+// Decode unmarshals the recorded body, e.g. into browserexec.ResolveOfferRequest.
+func (c Call) Decode(v any) error { return json.Unmarshal(c.Body, v) }
+
+// Server is a scriptable fake. Per endpoint, queued responses (Enqueue) are served first,
+// then the handler (Handle), then the built-in default.
+type Server struct {
+    *httptest.Server
+    // Token, when set, is required as Bearer token or X-Service-Token (401 otherwise).
+    Token string
+
+    mu       sync.Mutex
+    queues   map[string][]Response
+    handlers map[string]func(Call) Response
+    calls    []Call
+}
+
+// NewServer starts the fake on a loopback port.
+func NewServer() *Server {
+    s := &Server{queues: map[string][]Response{}, handlers: map[string]func(Call) Response{}}
+    s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+    return s
+}
+
+// Client returns a browserexec.Client pointed at the fake (token included when set).
+func (s *Server) Client(opts ...browserexec.Option) *browserexec.Client {
+    pre := []browserexec.Option{browserexec.WithToken(s.Token)}
+    return browserexec.New(s.URL, append(pre, opts...)...)
+}
+
+// Enqueue appends one-shot responses for endpoint, served in order.
+func (s *Server) Enqueue(endpoint string, rs ...Response) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    s.queues[endpoint] = append(s.queues[endpoint], rs...)
+}
+
+// Handle installs a handler for endpoint used once its queue is empty.
+func (s *Server) Handle(endpoint string, fn func(Call) Response) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    s.handlers[endpoint] = fn
+}
+
+// Calls returns the recorded requests for endpoint ("" for all).
+func (s *Server) Calls(endpoint string) []Call {
+    s.mu.Lock(); defer s.mu.Unlock()
+    out := make([]Call, 0, len(s.calls))
+    for _, c := range s.calls { if endpoint == "" || c.Endpoint == endpoint { out = append(out, c) } }
+    return out
+}
+
+// Reset drops scripts, handlers and recorded calls.
+func (s *Server) Reset() {
+    s.mu.Lock(); defer s.mu.Unlock()
+    s.queues = map[string][]Response{}
+    s.handlers = map[string]func(Call) Response{}
+    s.calls = nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+    const prefix = "/api/v1/browser/"
+    if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, prefix) {
+        write(w, Fail(http.StatusNotFound, "NOT_FOUND", "unknown endpoint")); return
+    }
+    if s.Token != "" {
+        hdr := r.Header.Get("X-Service-Token")
+        if hdr == "" { hdr = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") }
+        if hdr != s.Token { write(w, Fail(http.StatusUnauthorized, "UNAUTHORIZED", "internal token required")); return }
+    }
+    body, _ := io.ReadAll(r.Body)
+    c := Call{Endpoint: strings.TrimPrefix(r.URL.Path, prefix), Body: body, Header: r.Header.Clone()}
+
+    s.mu.Lock()
+    s.calls = append(s.calls, c)
+    var resp Response
+    if q := s.queues[c.Endpoint]; len(q) > 0 {
+        resp, s.queues[c.Endpoint] = q[0], q[1:]
+    } else if fn := s.handlers[c.Endpoint]; fn != nil {
+        s.mu.Unlock()
+        resp = fn(c)
+        s.mu.Lock()
+    } else {
+        resp = defaultResponse(c)
+    }
+    s.mu.Unlock()
+
+    if resp.Delay > 0 {
+        select {
+        case <-time.After(resp.Delay):
+        case <-r.Context().Done():
+            return
+        }
+    }
+    write(w, resp)
+}
+
+func write(w http.ResponseWriter, resp Response) {
+    for k, v := range resp.Header { w.Header().Set(k, v) }
+    w.Header().Set("Content-Type", "application/json")
+    if resp.Status == 0 { resp.Status = http.StatusOK }
+    w.WriteHeader(resp.Status)
+    if resp.Body != nil { _ = json.NewEncoder(w).Encode(resp.Body) }
+}
+
+// defaultResponse mimics a healthy browser-exec: the URL resolves to itself, pages have a title
+// derived from the host, json-fetch returns an empty object and every target is reachable.
+func defaultResponse(c Call) Response {
+    var req struct{ URL string `json:"url"`; Country string `json:"country"` }
+    _ = json.Unmarshal(c.Body, &req)
+    if strings.TrimSpace(req.URL) == "" { return Fail(http.StatusBadRequest, "INVALID_ARGUMENT", "url required") }
+    u, err := url.Parse(req.URL)
+    if err != nil || u.Hostname() == "" { return Fail(http.StatusBadGateway, "RESOLVE_FAILED", "invalid url") }
+    host := u.Hostname()
+    switch c.Endpoint {
+    case browserexec.EndpointResolveOffer:
+        parts := strings.Split(host, ".")
+        brand := host
+        if len(parts) >= 2 { brand = parts[len(parts)-2] }
+        path := u.Path
+        if !strings.HasSuffix(path, "/") { path += "/" }
+        return OK(browserexec.ResolveOfferResult{
+            Ok: true, Status: 200, FinalUrl: u.Scheme + "://" + u.Host + path, FinalUrlSuffix: u.RawQuery,
+            Domain: host, Brand: brand, Via: "direct", Country: strings.ToUpper(req.Country),
+            ChainLength: 1, Chain: []string{req.URL}, Timings: &browserexec.ResolveTimings{},
+        })
+    case browserexec.EndpointPageSignals:
+        return OK(browserexec.PageSignals{Status: 200, Title: host, SiteName: strings.TrimPrefix(host, "www.")})
+    case browserexec.EndpointJSONFetch:
+        return OK(browserexec.JSONFetchResult{Status: 200, JSON: json.RawMessage(`{}`), Via: "direct"})
+    case browserexec.EndpointCheckAvailability:
+        return OK(browserexec.Availability{Ok: true, Status: 200, Engine: "fake"})
+    }
+    return Fail(http.StatusNotFound, "NOT_FOUND", "unknown endpoint")
+}
@@ -0,0 +1,257 @@
+// Package browserexec is a typed client for the Node browser-exec service
+// (/api/v1/browser/*), with per-endpoint deadlines, retries, a shared circuit
+// breaker and Prometheus metrics. browserexectest provides a scriptable fake.
+package browserexec
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    // ErrNotConfigured is returned by every call on a client without a base URL.
+    ErrNotConfigured = errors.New("browserexec: BROWSER_EXEC_URL not configured")
+    // ErrCircuitOpen is returned without calling the service while the breaker is open.
+    ErrCircuitOpen = errors.New("browserexec: circuit open")
+)
+
+// Error is a non-2xx answer from browser-exec ({"error":{"code","message"}}).
+type Error struct {
+    Endpoint   string
+    StatusCode int
+    Code       string
+    Message    string
+    RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+    if e.Code != "" { return fmt.Sprintf("browserexec %s: %d %s: %s", e.Endpoint, e.StatusCode, e.Code, e.Message) }
+    return fmt.Sprintf("browserexec %s: bad status: %d", e.Endpoint, e.StatusCode)
+}
+
+// Policy controls one endpoint's calls. Timeout bounds each attempt (the caller's ctx still wins);
+// Retries are extra attempts after the first, spaced by Backoff doubled per attempt (capped at 2s).
+type Policy struct {
+    Timeout time.Duration
+    Retries int
+    Backoff time.Duration
+}
+
+// defaultPolicies: navigation endpoints are slow and not retried client-side (browser-exec
+// retries internally where it makes sense); probes are cheap and retried once.
+var defaultPolicies = map[string]Policy{
+    EndpointResolveOffer:      {Timeout: 65 * time.Second, Retries: 0, Backoff: 300 * time.Millisecond},
+    EndpointPageSignals:       {Timeout: 16 * time.Second, Retries: 1, Backoff: 200 * time.Millisecond},
+    EndpointJSONFetch:         {Timeout: 35 * time.Second, Retries: 0, Backoff: 200 * time.Millisecond},
+    EndpointCheckAvailability: {Timeout: 16 * time.Second, Retries: 1, Backoff: 150 * time.Millisecond},
+}
+
+// DefaultPolicies returns a copy of the per-endpoint defaults every client starts from.
+func DefaultPolicies() map[string]Policy {
+    out := make(map[string]Policy, len(defaultPolicies))
+    for k, v := range defaultPolicies { out[k] = v }
+    return out
+}
+
+// Client calls browser-exec. The zero value and nil are not configured; use New or FromEnv.
+type Client struct {
+    base     string
+    token    string
+    hc       *http.Client
+    policies map[string]Policy
+    cb       *breaker
+}
+
+type Option func(*Client)
+
+// WithToken sets the internal service token (sent as Authorization: Bearer).
+func WithToken(tok string) Option { return func(c *Client) { c.token = strings.TrimSpace(tok) } }
+
+// WithHTTPClient replaces the transport client (deadlines come from policies and ctx, not hc.Timeout).
+func WithHTTPClient(hc *http.Client) Option { return func(c *Client) { if hc != nil { c.hc = hc } } }
+
+// WithPolicy overrides the policy for one endpoint.
+func WithPolicy(endpoint string, p Policy) Option { return func(c *Client) { c.policies[endpoint] = p } }
+
+// WithBreaker sets the breaker threshold (consecutive failures) and cooldown; threshold<=0 disables it.
+func WithBreaker(threshold int, cooldown time.Duration) Option {
+    return func(c *Client) {
+        if threshold <= 0 { c.cb = nil; return }
+        c.cb = newBreaker(threshold, cooldown)
+    }
+}
+
+// New returns a client for baseURL (e.g. http://browser-exec:8080). An empty baseURL yields a
+// client whose calls all fail with ErrNotConfigured.
+func New(baseURL string, opts ...Option) *Client {
+    c := &Client{
+        base:     strings.TrimRight(strings.TrimSpace(baseURL), "/"),
+        hc:       &http.Client{},
+        policies: DefaultPolicies(),
+        cb:       newBreaker(5, 10*time.Second),
+    }
+    for _, o := range opts { o(c) }
+    return c
+}
+
+// FromEnv builds a client from BROWSER_EXEC_URL and BROWSER_INTERNAL_TOKEN.
+// BROWSER_EXEC_RETRIES (0..3) overrides retries for every endpoint.
+func FromEnv(opts ...Option) *Client {
+    pre := []Option{WithToken(os.Getenv("BROWSER_INTERNAL_TOKEN"))}
+    if v := strings.TrimSpace(os.Getenv("BROWSER_EXEC_RETRIES")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 3 {
+            pre = append(pre, func(c *Client) {
+                for k, p := range c.policies { p.Retries = n; c.policies[k] = p }
+            })
+        }
+    }
+    return New(os.Getenv("BROWSER_EXEC_URL"), append(pre, opts...)...)
+}
+
+// Configured reports whether the client has a base URL.
+func (c *Client) Configured() bool { return c != nil && c.base != "" }
+
+// BaseURL returns the configured base URL without trailing slash.
+func (c *Client) BaseURL() string { if c == nil { return "" }; return c.base }
+
+// ResolveOffer follows the offer URL to its final landing page.
+func (c *Client) ResolveOffer(ctx context.Context, req ResolveOfferRequest) (*ResolveOfferResult, error) {
+    var out ResolveOfferResult
+    if err := c.call(ctx, EndpointResolveOffer, req, &out); err != nil { return nil, err }
+    return &out, nil
+}
+
+// PageSignals extracts title/site name and, on request, outbound links and page content.
+func (c *Client) PageSignals(ctx context.Context, req PageSignalsRequest) (*PageSignals, error) {
+    var out PageSignals
+    if err := c.call(ctx, EndpointPageSignals, req, &out); err != nil { return nil, err }
+    return &out, nil
+}
+
+// JSONFetch loads a JSON URL through a browser. A nil error only means browser-exec answered;
+// check JSONFetchResult.OK for the upstream outcome.
+func (c *Client) JSONFetch(ctx context.Context, req JSONFetchRequest) (*JSONFetchResult, error) {
+    var out JSONFetchResult
+    if err := c.call(ctx, EndpointJSONFetch, req, &out); err != nil { return nil, err }
+    return &out, nil
+}
+
+// CheckAvailability probes a URL. Unreachable targets are reported in the result, not as errors.
+func (c *Client) CheckAvailability(ctx context.Context, req CheckAvailabilityRequest) (*Availability, error) {
+    var out Availability
+    if err := c.call(ctx, EndpointCheckAvailability, req, &out); err != nil { return nil, err }
+    return &out, nil
+}
+
+func (c *Client) call(ctx context.Context, endpoint string, body, out any) error {
+    start := time.Now()
+    outcome := "error"
+    defer func() { observe(endpoint, outcome, time.Since(start)) }()
+    if !c.Configured() { outcome = "not_configured"; return ErrNotConfigured }
+    payload, err := json.Marshal(body)
+    if err != nil { return fmt.Errorf("browserexec %s: encode: %w", endpoint, err) }
+    pol := c.policies[endpoint]
+    var lastErr error
+    for attempt := 0; attempt <= pol.Retries; attempt++ {
+        if attempt > 0 {
+            metricRetries.WithLabelValues(endpoint).Inc()
+            wait := backoff(pol.Backoff, attempt)
+            var be *Error
+            if errors.As(lastErr, &be) && be.RetryAfter > wait && be.RetryAfter <= 2*time.Second { wait = be.RetryAfter }
+            select {
+            case <-time.After(wait):
+            case <-ctx.Done():
+                outcome = "canceled"
+                return lastErr
+            }
+        }
+        if !c.cb.allow() { outcome = "circuit_open"; return ErrCircuitOpen }
+        err := c.do(ctx, endpoint, pol.Timeout, payload, out)
+        // a cancelled caller says nothing about the service's health
+        if ctx.Err() != nil { c.cb.release() } else { c.cb.record(!unhealthy(ctx, err)) }
+        if err == nil { outcome = "ok"; return nil }
+        lastErr = err
+        outcome = outcomeOf(ctx, err)
+        if !retryable(ctx, err) { break }
+    }
+    return lastErr
+}
+
+func (c *Client) do(ctx context.Context, endpoint string, timeout time.Duration, payload []byte, out any) error {
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/api/v1/browser/"+endpoint, bytes.NewReader(payload))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", "application/json")
+    if c.token != "" { req.Header.Set("Authorization", "Bearer "+c.token) }
+    resp, err := c.hc.Do(req)
+    if err != nil { return fmt.Errorf("browserexec %s: %w", endpoint, err) }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 { return decodeError(endpoint, resp) }
+    if err := json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+        return fmt.Errorf("browserexec %s: decode: %w", endpoint, err)
+    }
+    return nil
+}
+
+func decodeError(endpoint string, resp *http.Response) *Error {
+    e := &Error{Endpoint: endpoint, StatusCode: resp.StatusCode}
+    var eb struct{ Error struct{ Code string `json:"code"`; Message string `json:"message"` } `json:"error"` }
+    if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&eb) == nil {
+        e.Code, e.Message = eb.Error.Code, eb.Error.Message
+    }
+    if e.Message == "" { e.Message = http.StatusText(resp.StatusCode) }
+    if v := strings.TrimSpace(resp.Header.Get("Retry-After")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 0 { e.RetryAfter = time.Duration(n) * time.Second }
+    }
+    return e
+}
+
+// retryable: transport errors and "try again" statuses (429, 503 OVERLOADED/MAINTENANCE/CAPACITY_EXHAUSTED).
+// 502/504 from navigation endpoints describe the target site and are not retried here.
+func retryable(ctx context.Context, err error) bool {
+    if err == nil || ctx.Err() != nil { return false }
+    var be *Error
+    if errors.As(err, &be) { return be.StatusCode == http.StatusTooManyRequests || be.StatusCode == http.StatusServiceUnavailable }
+    return true
+}
+
+// unhealthy decides what counts against the breaker: the service being unreachable, erroring
+// or shedding load. Target-side failures do not; caller cancellation is not recorded at all.
+func unhealthy(ctx context.Context, err error) bool {
+    if err == nil || ctx.Err() != nil { return false }
+    var be *Error
+    if errors.As(err, &be) { return be.StatusCode == http.StatusInternalServerError || be.StatusCode == http.StatusServiceUnavailable }
+    return true
+}
+
+func outcomeOf(ctx context.Context, err error) string {
+    if ctx.Err() != nil { return "canceled" }
+    var be *Error
+    if errors.As(err, &be) {
+        if be.StatusCode >= 500 { return "http_5xx" }
+        return "http_4xx"
+    }
+    if errors.Is(err, context.DeadlineExceeded) { return "timeout" }
+    return "error"
+}
+
+func backoff(base time.Duration, attempt int) time.Duration {
+    if base <= 0 { base = 200 * time.Millisecond }
+    d := base << (attempt - 1)
+    if d > 2*time.Second || d <= 0 { d = 2 * time.Second }
+    return d
+}
@@ -0,0 +1,141 @@
+package browserexec_test
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+    "github.com/xxrenzhe/autoads/pkg/browserexec/browserexectest"
+)
+
+func fastRetries(n int) browserexec.Option {
+    return func(c *browserexec.Client) {
+        for _, ep := range []string{browserexec.EndpointResolveOffer, browserexec.EndpointPageSignals, browserexec.EndpointJSONFetch, browserexec.EndpointCheckAvailability} {
+            browserexec.WithPolicy(ep, browserexec.Policy{Timeout: time.Second, Retries: n, Backoff: time.Millisecond})(c)
+        }
+    }
+}
+
+func TestResolveOfferTypedRoundTrip(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Token = "secret"
+
+    rr, err := srv.Client().ResolveOffer(context.Background(), browserexec.ResolveOfferRequest{URL: "https://www.shop.example.com/p?aff=1", Country: "de", StabilizeMs: 800})
+    if err != nil { t.Fatalf("resolve: %v", err) }
+    if !rr.Ok || rr.Domain != "www.shop.example.com" || rr.FinalUrlSuffix != "aff=1" || rr.Brand != "example" {
+        t.Fatalf("unexpected result: %+v", rr)
+    }
+    calls := srv.Calls(browserexec.EndpointResolveOffer)
+    if len(calls) != 1 { t.Fatalf("expected 1 call, got %d", len(calls)) }
+    var sent browserexec.ResolveOfferRequest
+    if err := calls[0].Decode(&sent); err != nil || sent.Country != "de" || sent.StabilizeMs != 800 {
+        t.Fatalf("request not encoded as expected: %+v %v", sent, err)
+    }
+    if got := calls[0].Header.Get("Authorization"); got != "Bearer secret" {
+        t.Fatalf("token header: %q", got)
+    }
+}
+
+func TestRetriesOverloadedThenSucceeds(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Enqueue(browserexec.EndpointPageSignals,
+        browserexectest.Fail(http.StatusServiceUnavailable, "OVERLOADED", "Too many concurrent tasks"),
+        browserexectest.OK(browserexec.PageSignals{Status: 200, Title: "Shop", Headings: []browserexec.PageHeading{{Level: 1, Text: "Running shoes"}}}),
+    )
+    ps, err := srv.Client(fastRetries(2)).PageSignals(context.Background(), browserexec.PageSignalsRequest{URL: "https://shop.example.com", Content: true})
+    if err != nil { t.Fatalf("page-signals: %v", err) }
+    if ps.Title != "Shop" || len(ps.Headings) != 1 { t.Fatalf("unexpected signals: %+v", ps) }
+    if n := len(srv.Calls(browserexec.EndpointPageSignals)); n != 2 { t.Fatalf("expected 2 attempts, got %d", n) }
+}
+
+func TestTargetFailureIsNotRetried(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(http.StatusBadGateway, "RESOLVE_FAILED", "net::ERR_NAME_NOT_RESOLVED"))
+    _, err := srv.Client(fastRetries(2)).ResolveOffer(context.Background(), browserexec.ResolveOfferRequest{URL: "https://nx.example"})
+    var be *browserexec.Error
+    if !errors.As(err, &be) || be.StatusCode != http.StatusBadGateway || be.Code != "RESOLVE_FAILED" {
+        t.Fatalf("expected typed 502 error, got %v", err)
+    }
+    if n := len(srv.Calls("")); n != 1 { t.Fatalf("expected no retry, got %d calls", n) }
+}
+
+func TestCircuitOpensAfterConsecutiveFailures(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Handle(browserexec.EndpointCheckAvailability, func(browserexectest.Call) browserexectest.Response {
+        return browserexectest.Fail(http.StatusServiceUnavailable, "MAINTENANCE", "Service in maintenance mode")
+    })
+    cli := srv.Client(fastRetries(0), browserexec.WithBreaker(2, time.Hour))
+    req := browserexec.CheckAvailabilityRequest{URL: "https://shop.example.com"}
+    for i := 0; i < 2; i++ {
+        if _, err := cli.CheckAvailability(context.Background(), req); err == nil { t.Fatal("expected failure") }
+    }
+    if _, err := cli.CheckAvailability(context.Background(), req); !errors.Is(err, browserexec.ErrCircuitOpen) {
+        t.Fatalf("expected circuit open, got %v", err)
+    }
+    if n := len(srv.Calls("")); n != 2 { t.Fatalf("open circuit must not call the service, got %d calls", n) }
+}
+
+func TestPolicyTimeoutBoundsAttempt(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Enqueue(browserexec.EndpointJSONFetch, browserexectest.Response{Status: 200, Body: map[string]any{"status": 200, "json": map[string]any{}}, Delay: time.Second})
+    cli := srv.Client(browserexec.WithPolicy(browserexec.EndpointJSONFetch, browserexec.Policy{Timeout: 50 * time.Millisecond}))
+    start := time.Now()
+    _, err := cli.JSONFetch(context.Background(), browserexec.JSONFetchRequest{URL: "https://data.example.com/api"})
+    if !errors.Is(err, context.DeadlineExceeded) { t.Fatalf("expected deadline exceeded, got %v", err) }
+    if time.Since(start) > 500*time.Millisecond { t.Fatalf("timeout not applied: %v", time.Since(start)) }
+}
+
+func TestJSONFetchAndNotConfigured(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Enqueue(browserexec.EndpointJSONFetch, browserexectest.OK(map[string]any{"status": 403, "json": nil, "text": "Access denied"}))
+    out, err := srv.Client().JSONFetch(context.Background(), browserexec.JSONFetchRequest{URL: "https://data.example.com/api"})
+    if err != nil || out.OK() || out.Text != "Access denied" { t.Fatalf("expected non-OK upstream result, got %+v %v", out, err) }
+    out, err = srv.Client().JSONFetch(context.Background(), browserexec.JSONFetchRequest{URL: "https://data.example.com/api"})
+    if err != nil || !out.OK() { t.Fatalf("expected default OK result, got %+v %v", out, err) }
+
+    var nilClient *browserexec.Client
+    if nilClient.Configured() || browserexec.New("").Configured() { t.Fatal("expected unconfigured clients") }
+    if _, err := browserexec.New("").PageSignals(context.Background(), browserexec.PageSignalsRequest{URL: "https://x.example"}); !errors.Is(err, browserexec.ErrNotConfigured) {
+        t.Fatalf("expected ErrNotConfigured, got %v", err)
+    }
+}
+
+func TestCancellationIsNotRecordedByBreaker(t *testing.T) {
+    srv := browserexectest.NewServer()
+    defer srv.Close()
+    srv.Enqueue(browserexec.EndpointCheckAvailability,
+        browserexectest.Fail(http.StatusServiceUnavailable, "MAINTENANCE", "Service in maintenance mode"),
+        browserexectest.Response{Status: 200, Body: map[string]any{"ok": true}, Delay: time.Second},
+        browserexectest.Fail(http.StatusServiceUnavailable, "MAINTENANCE", "Service in maintenance mode"),
+    )
+    cli := srv.Client(fastRetries(0), browserexec.WithBreaker(2, time.Hour))
+    req := browserexec.CheckAvailabilityRequest{URL: "https://shop.example.com"}
+    if _, err := cli.CheckAvailability(context.Background(), req); err == nil { t.Fatal("expected failure") }
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if _, err := cli.CheckAvailability(ctx, req); err == nil { t.Fatal("expected cancellation") }
+    // the cancelled call neither reset nor added to the failure count: one more failure opens the circuit
+    if _, err := cli.CheckAvailability(context.Background(), req); err == nil || errors.Is(err, browserexec.ErrCircuitOpen) {
+        t.Fatalf("expected service failure, got %v", err)
+    }
+    if _, err := cli.CheckAvailability(context.Background(), req); !errors.Is(err, browserexec.ErrCircuitOpen) {
+        t.Fatalf("expected circuit open, got %v", err)
+    }
+}
+
+func TestDefaultPoliciesIsACopy(t *testing.T) {
+    p := browserexec.DefaultPolicies()
+    p[browserexec.EndpointResolveOffer] = browserexec.Policy{Timeout: time.Millisecond}
+    if got := browserexec.DefaultPolicies()[browserexec.EndpointResolveOffer]; got.Timeout != 65*time.Second {
+        t.Fatalf("defaults were mutated: %+v", got)
+    }
+}
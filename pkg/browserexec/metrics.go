@@ -0,0 +1,39 @@
+package browserexec
+
+import (
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "browserexec_client_requests_total",
+        Help: "browser-exec client calls by endpoint and outcome (ok, http_4xx, http_5xx, timeout, canceled, circuit_open, not_configured, error)",
+    }, []string{"endpoint", "outcome"})
+    metricDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "browserexec_client_request_duration_seconds",
+        Help:    "browser-exec client call duration including retries",
+        Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 40, 70},
+    }, []string{"endpoint"})
+    metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "browserexec_client_retries_total",
+        Help: "browser-exec client retry attempts by endpoint",
+    }, []string{"endpoint"})
+    metricCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+        Name: "browserexec_client_circuit_open",
+        Help: "1 while the browser-exec client circuit breaker is open",
+    })
+)
+
+func init() {
+    _ = prometheus.Register(metricRequests)
+    _ = prometheus.Register(metricDuration)
+    _ = prometheus.Register(metricRetries)
+    _ = prometheus.Register(metricCircuitOpen)
+}
+
+func observe(endpoint, outcome string, d time.Duration) {
+    metricRequests.WithLabelValues(endpoint, outcome).Inc()
+    if outcome != "not_configured" { metricDuration.WithLabelValues(endpoint).Observe(d.Seconds()) }
+}
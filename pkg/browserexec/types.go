@@ -0,0 +1,127 @@
+package browserexec
+
+import "encoding/json"
+
+// Endpoint names under /api/v1/browser/. Also used as the metrics "endpoint" label and policy key.
+const (
+    EndpointResolveOffer      = "resolve-offer"
+    EndpointPageSignals       = "page-signals"
+    EndpointJSONFetch         = "json-fetch"
+    EndpointCheckAvailability = "check-availability"
+)
+
+// ResolveOfferRequest follows an offer URL through its redirect chain in a real browser.
+type ResolveOfferRequest struct {
+    URL              string            `json:"url"`
+    WaitUntil        string            `json:"waitUntil,omitempty"`   // domcontentloaded | load | networkidle (default)
+    TimeoutMs        int               `json:"timeoutMs,omitempty"`   // navigation budget on the browser side (max 60s)
+    StabilizeMs      int               `json:"stabilizeMs,omitempty"` // URL must stop changing for this long
+    Headers          map[string]string `json:"headers,omitempty"`
+    UserAgent        string            `json:"userAgent,omitempty"`
+    ProxyProviderURL string            `json:"proxyProviderURL,omitempty"`
+    Country          string            `json:"country,omitempty"` // ISO hint → PROXY_URL_<CC> on the browser side
+}
+
+type ResolveOfferResult struct {
+    Ok             bool            `json:"ok"`
+    Status         int             `json:"status"`
+    FinalUrl       string          `json:"finalUrl"`
+    FinalUrlSuffix string          `json:"finalUrlSuffix"`
+    Domain         string          `json:"domain"`
+    Brand          string          `json:"brand"`
+    Via            string          `json:"via"`
+    Country        string          `json:"country,omitempty"`
+    ChainLength    int             `json:"chainLength"`
+    Chain          []string        `json:"chain,omitempty"`
+    Timings        *ResolveTimings `json:"timings,omitempty"`
+}
+
+type ResolveTimings struct {
+    NavMs       int `json:"navMs"`
+    StabilizeMs int `json:"stabilizeMs"`
+}
+
+// PageSignalsRequest loads a page and extracts title/site name; Links and Content opt into heavier extraction.
+type PageSignalsRequest struct {
+    URL       string `json:"url"`
+    TimeoutMs int    `json:"timeoutMs,omitempty"`
+    Links     bool   `json:"links,omitempty"`
+    Content   bool   `json:"content,omitempty"`
+}
+
+type PageSignals struct {
+    Status   int    `json:"status"`
+    Title    string `json:"title"`
+    SiteName string `json:"siteName"`
+    // Only populated when requested with links=true
+    OutboundDomains []string `json:"outboundDomains,omitempty"`
+    Mentions        []string `json:"mentions,omitempty"`
+    // Only populated when requested with content=true
+    Headings        []PageHeading `json:"headings,omitempty"`
+    MetaDescription string        `json:"metaDescription,omitempty"`
+    MetaKeywords    []string      `json:"metaKeywords,omitempty"`
+    Products        []PageProduct `json:"products,omitempty"`
+}
+
+type PageHeading struct {
+    Level int    `json:"level"`
+    Text  string `json:"text"`
+}
+
+// PageProduct is a schema.org Product entry found in the page JSON-LD.
+type PageProduct struct {
+    Name     string `json:"name"`
+    Brand    string `json:"brand,omitempty"`
+    Category string `json:"category,omitempty"`
+}
+
+// JSONFetchRequest loads a JSON endpoint through a browser context (for APIs that block plain HTTP clients).
+type JSONFetchRequest struct {
+    URL              string            `json:"url"`
+    Headers          map[string]string `json:"headers,omitempty"`
+    UserAgent        string            `json:"userAgent,omitempty"`
+    WaitUntil        string            `json:"waitUntil,omitempty"`
+    TimeoutMs        int               `json:"timeoutMs,omitempty"`
+    ProxyProviderURL string            `json:"proxyProviderURL,omitempty"`
+    Country          string            `json:"country,omitempty"` // ISO hint → PROXY_URL_<CC>, no US fallback
+    Retries          int               `json:"retries,omitempty"` // browser-side retries (max 3)
+    BackoffMs        int               `json:"backoffMs,omitempty"`
+}
+
+type JSONFetchResult struct {
+    Status int             `json:"status"`
+    JSON   json.RawMessage `json:"json"`
+    Text   string          `json:"text,omitempty"` // body text when it did not parse as JSON
+    Via    string          `json:"via,omitempty"`
+}
+
+// OK reports a 2xx upstream status with a JSON body.
+func (r *JSONFetchResult) OK() bool {
+    if r == nil || r.Status < 200 || r.Status >= 300 { return false }
+    return len(r.JSON) > 0 && string(r.JSON) != "null"
+}
+
+// CheckAvailabilityRequest probes whether a URL is reachable.
+type CheckAvailabilityRequest struct {
+    URL              string `json:"url"`
+    TimeoutMs        int    `json:"timeoutMs,omitempty"`
+    Method           string `json:"method,omitempty"` // fetch engine only; default HEAD
+    Retries          int    `json:"retries,omitempty"`
+    BackoffMs        int    `json:"backoffMs,omitempty"`
+    ProxyProviderURL string `json:"proxyProviderURL,omitempty"`
+}
+
+// Availability is the probe outcome. The service answers 200 even for unreachable targets;
+// Ok/Status/Error describe the target, not the call.
+type Availability struct {
+    Ok     bool   `json:"ok"`
+    Status int    `json:"status"`
+    Engine string `json:"engine,omitempty"`
+    Error  string `json:"error,omitempty"`
+}
+
+// Reachable treats any 2xx/3xx target status as reachable even when Ok is unset.
+func (a *Availability) Reachable() bool {
+    if a == nil { return false }
+    return a.Ok || (a.Status >= 200 && a.Status < 400)
+}
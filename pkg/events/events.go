@@ -23,11 +23,13 @@ type Envelope struct {
     Data        any            `json:"data"`
 }
 
-// NewEnvelope creates a new envelope for the given event name and data.
+// NewEnvelope creates a new envelope for the given event name and data. Without WithID the id is
+// generated and differs on every call.
 func NewEnvelope(eventType string, data any, opts ...Option) Envelope {
     e := Envelope{SpecVersion: "1.0", ID: fmt.Sprintf("%d", time.Now().UnixNano()), Type: eventType, Time: time.Now().UTC(), Data: data}
     cfg := &config{}
     for _, o := range opts { o(cfg) }
+    if cfg.id != "" { e.ID = cfg.id }
     if cfg.source != "" { e.Source = cfg.source }
     if cfg.subject != "" { e.Subject = cfg.subject }
     return e
@@ -111,6 +113,15 @@ const (
     EventTokenReserved              = "TokenReserved"
     EventTokenDebited               = "TokenDebited"
     EventTokenReverted              = "TokenReverted"
+    EventTokensPurchased            = "TokensPurchased"
+    EventTokensGranted              = "TokensGranted"
+    EventTokensExpired              = "TokensExpired"
+    EventSubscriptionActivated      = "SubscriptionActivated"
+    EventSubscriptionRenewed        = "SubscriptionRenewed"
+    EventSubscriptionPastDue        = "SubscriptionPastDue"
+    EventSubscriptionCanceled       = "SubscriptionCanceled"
+    EventSubscriptionPlanChanged    = "SubscriptionPlanChanged"
+    EventUsageStatementIssued       = "UsageStatementIssued"
     EventWorkflowStarted            = "WorkflowStarted"
     EventWorkflowStepCompleted      = "WorkflowStepCompleted"
     EventWorkflowCompleted          = "WorkflowCompleted"
@@ -120,6 +131,8 @@ const (
 
 // Options for envelope metadata
 type Option func(*config)
-type config struct { source, subject string }
+type config struct { id, source, subject string }
+// WithID sets a stable envelope id, so a republished event keeps the id consumers dedupe on.
+func WithID(id string) Option     { return func(c *config) { c.id = id } }
 func WithSource(s string) Option  { return func(c *config) { c.source = s } }
 func WithSubject(s string) Option { return func(c *config) { c.subject = s } }
@@ -0,0 +1,187 @@
+package events
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/idempotency"
+)
+
+// Transactional outbox: a service records its events in event_outbox inside the transaction that
+// makes the business change (Enqueue), and a Relay publishes committed rows to Pub/Sub afterwards,
+// retrying with backoff until the publish succeeds. Delivery is at-least-once and never ahead of
+// the database: an event exists only if its change committed. Every message carries the outbox row
+// as its envelope id ("<source>:<id>", OutboxEventID) and idempotency key, so a retried publish
+// reaches consumers with the same id and they can drop the replay.
+
+// OutboxSchema creates event_outbox (mirrors schemas/sql/026_event_outbox.sql).
+var OutboxSchema = []string{
+    `CREATE TABLE IF NOT EXISTS event_outbox (
+        id              BIGSERIAL PRIMARY KEY,
+        source          TEXT NOT NULL,
+        event_type      TEXT NOT NULL,
+        subject         TEXT NOT NULL DEFAULT '',
+        payload         JSONB NOT NULL,
+        created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+        next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        attempts        INTEGER NOT NULL DEFAULT 0,
+        last_error      TEXT,
+        sent_at         TIMESTAMPTZ
+    )`,
+    `CREATE INDEX IF NOT EXISTS ix_event_outbox_pending ON event_outbox(source, next_attempt_at, id) WHERE sent_at IS NULL`,
+}
+
+// EnsureOutbox creates event_outbox when missing.
+func EnsureOutbox(ctx context.Context, db *sql.DB) error {
+    for _, q := range OutboxSchema {
+        if _, err := db.ExecContext(ctx, q); err != nil { return err }
+    }
+    return nil
+}
+
+// OutboxEvent is an event recorded for publishing after commit.
+type OutboxEvent struct {
+    Type    string
+    Subject string
+    Data    any
+}
+
+// Execer is what Enqueue writes through: the *sql.Tx of the business change, or *sql.DB for
+// events that are not tied to one.
+type Execer interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Enqueue records events of source in the outbox through x; they are published once x commits.
+func Enqueue(ctx context.Context, x Execer, source string, events ...OutboxEvent) error {
+    now := time.Now().UTC()
+    for _, e := range events {
+        payload, err := json.Marshal(e.Data)
+        if err != nil { return fmt.Errorf("marshal %s payload: %w", e.Type, err) }
+        if _, err := x.ExecContext(ctx, `
+            INSERT INTO event_outbox (source, event_type, subject, payload, created_at, next_attempt_at)
+            VALUES ($1, $2, $3, $4::jsonb, $5, $5)
+        `, source, e.Type, e.Subject, string(payload), now); err != nil {
+            return fmt.Errorf("enqueue %s: %w", e.Type, err)
+        }
+    }
+    return nil
+}
+
+// OutboxEventID is the envelope id the relay gives row id of source.
+func OutboxEventID(source string, id int64) string { return source + ":" + strconv.FormatInt(id, 10) }
+
+// OutboxPublisher is the subset of *Publisher the relay needs.
+type OutboxPublisher interface {
+    Publish(ctx context.Context, eventType string, data any, opts ...Option) error
+}
+
+// Relay publishes the pending outbox rows of Source and marks them sent. Several replicas may
+// relay concurrently: a batch is claimed in one short statement (FOR UPDATE SKIP LOCKED) that
+// moves its next_attempt_at past the Lease, and published outside any transaction, so no row lock
+// is held across network calls. Rows of a relay that dies mid-batch are due again once the
+// lease runs out.
+type Relay struct {
+    DB       *sql.DB
+    Pub      OutboxPublisher
+    Source   string
+    Interval time.Duration
+    Batch    int
+    // MaxBackoff caps the exponential retry delay of a failing row (default 5m).
+    MaxBackoff time.Duration
+    // Lease is how long a claimed batch is reserved for this relay (default 1m).
+    Lease time.Duration
+}
+
+// Run drains the outbox every Interval (default 1s) until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+    interval := r.Interval
+    if interval <= 0 { interval = time.Second }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        if _, err := r.Drain(ctx); err != nil && ctx.Err() == nil {
+            log.Printf("%s outbox: drain failed: %v", r.Source, err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+type outboxRow struct {
+    id       int64
+    typ      string
+    subject  string
+    payload  json.RawMessage
+    attempts int
+}
+
+// Drain publishes one batch of due rows and returns how many were sent.
+func (r *Relay) Drain(ctx context.Context) (int, error) {
+    batch := r.Batch
+    if batch <= 0 { batch = 100 }
+    lease := r.Lease
+    if lease <= 0 { lease = time.Minute }
+    rows, err := r.DB.QueryContext(ctx, `
+        UPDATE event_outbox SET next_attempt_at = $3
+        WHERE id IN (
+            SELECT id FROM event_outbox
+            WHERE source = $1 AND sent_at IS NULL AND next_attempt_at <= now()
+            ORDER BY id LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, event_type, subject, payload::text, attempts
+    `, r.Source, batch, time.Now().UTC().Add(lease))
+    if err != nil { return 0, fmt.Errorf("claim outbox rows: %w", err) }
+    var pending []outboxRow
+    for rows.Next() {
+        var o outboxRow
+        var payload string
+        if err := rows.Scan(&o.id, &o.typ, &o.subject, &payload, &o.attempts); err != nil { rows.Close(); return 0, fmt.Errorf("scan outbox row: %w", err) }
+        o.payload = json.RawMessage(payload)
+        pending = append(pending, o)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return 0, err }
+    // RETURNING has no order; publish in enqueue order
+    sort.Slice(pending, func(i, j int) bool { return pending[i].id < pending[j].id })
+
+    sent := 0
+    for _, o := range pending {
+        eventID := OutboxEventID(r.Source, o.id)
+        opts := []Option{WithID(eventID), WithSource(r.Source)}
+        if o.subject != "" { opts = append(opts, WithSubject(o.subject)) }
+        pctx := idempotency.WithContext(ctx, eventID)
+        if perr := r.Pub.Publish(pctx, o.typ, o.payload, opts...); perr != nil {
+            if _, err := r.DB.ExecContext(ctx, `UPDATE event_outbox SET attempts=attempts+1, last_error=$2, next_attempt_at=$3 WHERE id=$1`,
+                o.id, perr.Error(), time.Now().UTC().Add(r.backoff(o.attempts+1))); err != nil {
+                return sent, fmt.Errorf("record outbox failure: %w", err)
+            }
+            continue
+        }
+        if _, err := r.DB.ExecContext(ctx, `UPDATE event_outbox SET sent_at=now(), attempts=attempts+1, last_error=NULL WHERE id=$1`, o.id); err != nil {
+            return sent, fmt.Errorf("mark outbox row sent: %w", err)
+        }
+        sent++
+    }
+    return sent, nil
+}
+
+// backoff is 1s doubling per failed attempt, capped at MaxBackoff.
+func (r *Relay) backoff(attempts int) time.Duration {
+    max := r.MaxBackoff
+    if max <= 0 { max = 5 * time.Minute }
+    if attempts > 16 { return max }
+    d := time.Second << uint(attempts-1)
+    if d > max { d = max }
+    return d
+}
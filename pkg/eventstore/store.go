@@ -28,14 +28,25 @@ CREATE INDEX IF NOT EXISTS ix_event_store_time ON event_store(occurred_at DESC);
     return err
 }
 
+// Execer is what WriteWith writes through: a *sql.DB, or the *sql.Tx that also records the
+// event for publishing (pkg/events outbox).
+type Execer interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
 // WriteWithDB writes an event row using an existing *sql.DB connection.
 // payload and meta will be marshaled to JSON.
 func WriteWithDB(ctx context.Context, db *sql.DB, eventID, name, aggregateType, aggregateID string, version int, payload any, meta map[string]any) error {
     if db == nil { return nil }
+    return WriteWith(ctx, db, eventID, name, aggregateType, aggregateID, version, payload, meta)
+}
+
+// WriteWith writes an event row through x.
+func WriteWith(ctx context.Context, x Execer, eventID, name, aggregateType, aggregateID string, version int, payload any, meta map[string]any) error {
     if meta == nil { meta = map[string]any{} }
     pb, _ := json.Marshal(payload)
     mb, _ := json.Marshal(meta)
-    _, err := db.ExecContext(ctx, `
+    _, err := x.ExecContext(ctx, `
         INSERT INTO event_store (event_id, event_name, aggregate_id, aggregate_type, version, payload, metadata, occurred_at)
         VALUES ($1,$2,$3,$4,$5,$6::jsonb,$7::jsonb,$8)
     `, eventID, name, aggregateID, aggregateType, version, string(pb), string(mb), time.Now().UTC())
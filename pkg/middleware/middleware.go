@@ -3,6 +3,7 @@ package middleware
 import (
     "context"
     "net/http"
+    "strings"
 
     "github.com/xxrenzhe/autoads/pkg/auth"
     "github.com/xxrenzhe/autoads/pkg/errors"
@@ -13,6 +14,25 @@ type contextKey string
 
 const UserIDKey contextKey = "userID"
 
+// OrgIDKey holds the organization a request acts for (from OrgHeader); billing charges that
+// organization's wallet instead of the user's own.
+const OrgIDKey contextKey = "orgID"
+
+// OrgHeader selects the organization wallet; services forward it on calls to billing.
+const OrgHeader = "X-Org-Id"
+
+// OrgIDFrom returns the organization the request acts for ("" for the user's own wallet).
+func OrgIDFrom(ctx context.Context) string {
+    org, _ := ctx.Value(OrgIDKey).(string)
+    return org
+}
+
+// WithOrgID returns ctx acting for orgID, e.g. for background work started by a request.
+func WithOrgID(ctx context.Context, orgID string) context.Context {
+    if orgID == "" { return ctx }
+    return context.WithValue(ctx, OrgIDKey, orgID)
+}
+
 // AuthMiddleware is a placeholder for Firebase JWT validation.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,6 +44,7 @@ func AuthMiddleware(next http.Handler) http.Handler {
         }
         // TODO: 可在此处做用户存在性检查与懒注册事件
         ctx := context.WithValue(r.Context(), UserIDKey, uid)
+        ctx = WithOrgID(ctx, strings.TrimSpace(r.Header.Get(OrgHeader)))
         next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
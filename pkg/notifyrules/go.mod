@@ -0,0 +1,3 @@
+module github.com/xxrenzhe/autoads/pkg/notifyrules
+
+go 1.22
@@ -0,0 +1,153 @@
+// Package notifyrules is the single model of the notification_rules table. One row is either a
+// per-user event subscription (kind "event": route EventType, or "*", to Channel) or an SLO/metric
+// alert rule (kind "metric": alert when Service.Metric compares to Threshold). The notifications
+// service manages subscriptions and the console manages and evaluates metric rules through it.
+package notifyrules
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+const (
+    KindEvent  = "event"
+    KindMetric = "metric"
+
+    ScopeUser   = "user"
+    ScopeSystem = "system"
+
+    // AnyEvent subscribes to every event type.
+    AnyEvent = "*"
+
+    DefaultChannel   = "inapp"
+    DefaultWindowSec = 300
+)
+
+// Comparators are the supported metric comparisons.
+var Comparators = []string{"gt", "ge", "lt", "le", "eq", "ne"}
+
+var (
+    ErrNotFound = errors.New("rule not found")
+    ErrInvalid  = errors.New("invalid rule")
+)
+
+type Rule struct {
+    ID         int64          `json:"id"`
+    Kind       string         `json:"kind"`
+    Scope      string         `json:"scope"`
+    UserID     string         `json:"userId,omitempty"`
+    Channel    string         `json:"channel"`
+    EventType  string         `json:"eventType,omitempty"`
+    Service    string         `json:"service,omitempty"`
+    Metric     string         `json:"metric,omitempty"`
+    Comparator string         `json:"comparator,omitempty"`
+    Threshold  float64        `json:"threshold"`
+    WindowSec  int            `json:"windowSec,omitempty"`
+    Params     map[string]any `json:"params,omitempty"`
+    Enabled    bool           `json:"enabled"`
+    CreatedAt  time.Time      `json:"createdAt"`
+    UpdatedAt  time.Time      `json:"updatedAt"`
+}
+
+// Normalize trims and lower-cases the rule, fills defaults and checks the fields its kind needs.
+// An empty kind is inferred from Metric. Errors wrap ErrInvalid.
+func (r *Rule) Normalize() error {
+    r.Kind = strings.ToLower(strings.TrimSpace(r.Kind))
+    r.Scope = strings.ToLower(strings.TrimSpace(r.Scope))
+    r.UserID = strings.TrimSpace(r.UserID)
+    r.Channel = strings.ToLower(strings.TrimSpace(r.Channel))
+    r.EventType = strings.TrimSpace(r.EventType)
+    r.Service = strings.TrimSpace(r.Service)
+    r.Metric = strings.TrimSpace(r.Metric)
+    r.Comparator = strings.ToLower(strings.TrimSpace(r.Comparator))
+    if r.Kind == "" {
+        r.Kind = KindEvent
+        if r.Metric != "" { r.Kind = KindMetric }
+    }
+    if r.Channel == "" { r.Channel = DefaultChannel }
+    if r.Scope == "" {
+        r.Scope = ScopeSystem
+        if r.UserID != "" { r.Scope = ScopeUser }
+    }
+    switch r.Scope {
+    case ScopeUser:
+        if r.UserID == "" { return fmt.Errorf("%w: userId is required for user scope", ErrInvalid) }
+    case ScopeSystem:
+        r.UserID = ""
+    default:
+        return fmt.Errorf("%w: scope must be user or system", ErrInvalid)
+    }
+    switch r.Kind {
+    case KindEvent:
+        if r.Scope != ScopeUser { return fmt.Errorf("%w: event subscriptions belong to a user", ErrInvalid) }
+        if r.EventType == "" { return fmt.Errorf("%w: eventType is required", ErrInvalid) }
+        r.Service, r.Metric, r.Comparator, r.Threshold, r.WindowSec = "", "", "", 0, 0
+    case KindMetric:
+        if r.Service == "" || r.Metric == "" { return fmt.Errorf("%w: service and metric are required", ErrInvalid) }
+        if r.Comparator == "" { r.Comparator = "gt" }
+        if !validComparator(r.Comparator) { return fmt.Errorf("%w: comparator must be one of %s", ErrInvalid, strings.Join(Comparators, "|")) }
+        if r.WindowSec <= 0 { r.WindowSec = DefaultWindowSec }
+        r.EventType = ""
+    default:
+        return fmt.Errorf("%w: kind must be event or metric", ErrInvalid)
+    }
+    if r.Params == nil { r.Params = map[string]any{} }
+    return nil
+}
+
+// Breached reports whether value trips a metric rule.
+func (r *Rule) Breached(value float64) bool {
+    return r.Kind == KindMetric && Compare(value, r.Comparator, r.Threshold)
+}
+
+// Compare applies a comparator ("gt", "ge", "lt", "le", "eq", "ne") to value and threshold.
+// Unknown comparators never match.
+func Compare(value float64, comparator string, threshold float64) bool {
+    switch strings.ToLower(strings.TrimSpace(comparator)) {
+    case "gt": return value > threshold
+    case "ge": return value >= threshold
+    case "lt": return value < threshold
+    case "le": return value <= threshold
+    case "eq": return value == threshold
+    case "ne": return value != threshold
+    default: return false
+    }
+}
+
+func validComparator(c string) bool {
+    for _, v := range Comparators { if v == c { return true } }
+    return false
+}
+
+// Patch holds the fields of a partial update; nil fields are left unchanged.
+type Patch struct {
+    Scope      *string        `json:"scope"`
+    UserID     *string        `json:"userId"`
+    Channel    *string        `json:"channel"`
+    EventType  *string        `json:"eventType"`
+    Service    *string        `json:"service"`
+    Metric     *string        `json:"metric"`
+    Comparator *string        `json:"comparator"`
+    Threshold  *float64       `json:"threshold"`
+    WindowSec  *int           `json:"windowSec"`
+    Params     map[string]any `json:"params"`
+    Enabled    *bool          `json:"enabled"`
+}
+
+// Apply copies the set fields of p onto r. The kind of a rule never changes.
+func (p Patch) Apply(r *Rule) {
+    set := func(dst *string, v *string) { if v != nil { *dst = *v } }
+    set(&r.Scope, p.Scope)
+    set(&r.UserID, p.UserID)
+    set(&r.Channel, p.Channel)
+    set(&r.EventType, p.EventType)
+    set(&r.Service, p.Service)
+    set(&r.Metric, p.Metric)
+    set(&r.Comparator, p.Comparator)
+    if p.Threshold != nil { r.Threshold = *p.Threshold }
+    if p.WindowSec != nil { r.WindowSec = *p.WindowSec }
+    if p.Params != nil { r.Params = p.Params }
+    if p.Enabled != nil { r.Enabled = *p.Enabled }
+}
@@ -0,0 +1,70 @@
+package notifyrules
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestNormalize(t *testing.T) {
+    cases := []struct {
+        name  string
+        in    Rule
+        want  Rule
+        valid bool
+    }{
+        {"subscription", Rule{UserID: " u1 ", EventType: "TokenDebited", Channel: "Slack"}, Rule{Kind: KindEvent, Scope: ScopeUser, UserID: "u1", EventType: "TokenDebited", Channel: "slack"}, true},
+        {"metric defaults", Rule{Service: "adscenter", Metric: "p95_latency_ms", Threshold: 800}, Rule{Kind: KindMetric, Scope: ScopeSystem, Channel: DefaultChannel, Service: "adscenter", Metric: "p95_latency_ms", Comparator: "gt", Threshold: 800, WindowSec: DefaultWindowSec}, true},
+        {"system scope drops user", Rule{Scope: "system", UserID: "u1", Service: "offer", Metric: "dlq_size", Comparator: "GE"}, Rule{Kind: KindMetric, Scope: ScopeSystem, Channel: DefaultChannel, Service: "offer", Metric: "dlq_size", Comparator: "ge", WindowSec: DefaultWindowSec}, true},
+        {"user metric rule", Rule{Scope: "user", UserID: "u2", Service: "billing", Metric: "error_rate", Comparator: "ge", Threshold: 0.05, WindowSec: 60}, Rule{Kind: KindMetric, Scope: ScopeUser, UserID: "u2", Channel: DefaultChannel, Service: "billing", Metric: "error_rate", Comparator: "ge", Threshold: 0.05, WindowSec: 60}, true},
+        {"subscription needs a user", Rule{Kind: KindEvent, EventType: "*"}, Rule{}, false},
+        {"subscription needs an event", Rule{Kind: KindEvent, UserID: "u1"}, Rule{}, false},
+        {"metric needs a service", Rule{Kind: KindMetric, Metric: "error_rate"}, Rule{}, false},
+        {"unknown comparator", Rule{Service: "s", Metric: "m", Comparator: "between"}, Rule{}, false},
+        {"user scope needs a user", Rule{Scope: "user", Service: "s", Metric: "m"}, Rule{}, false},
+        {"unknown kind", Rule{Kind: "cron", UserID: "u1"}, Rule{}, false},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            r := c.in
+            err := r.Normalize()
+            if !c.valid {
+                if !errors.Is(err, ErrInvalid) { t.Fatalf("Expected ErrInvalid, but got %v", err) }
+                return
+            }
+            if err != nil { t.Fatalf("Expected a valid rule, but got %v", err) }
+            if len(r.Params) != 0 { t.Errorf("Expected empty params, but got %v", r.Params) }
+            r.Params = nil
+            if !reflect.DeepEqual(r, c.want) { t.Errorf("Expected %+v, but got %+v", c.want, r) }
+        })
+    }
+}
+
+func TestCompare(t *testing.T) {
+    cases := []struct {
+        cmp   string
+        value float64
+        want  bool
+    }{
+        {"gt", 11, true}, {"gt", 10, false},
+        {"ge", 10, true}, {"lt", 9, true},
+        {"le", 11, false}, {"eq", 10, true},
+        {"ne", 10, false}, {" GT ", 11, true},
+        {"between", 11, false},
+    }
+    for _, c := range cases {
+        if got := Compare(c.value, c.cmp, 10); got != c.want {
+            t.Errorf("%v %s 10: Expected %v, but got %v", c.value, c.cmp, c.want, got)
+        }
+    }
+}
+
+func TestPatchKeepsKind(t *testing.T) {
+    r := Rule{ID: 3, Kind: KindMetric, Scope: ScopeSystem, Service: "offer", Metric: "dlq_size", Comparator: "gt", Threshold: 10, WindowSec: 300}
+    th, en := 25.0, false
+    Patch{Threshold: &th, Enabled: &en}.Apply(&r)
+    if err := r.Normalize(); err != nil { t.Fatalf("Expected the patched rule to stay valid, but got %v", err) }
+    if r.Kind != KindMetric || r.Threshold != 25 || r.Enabled || !r.Breached(26) || r.Breached(25) {
+        t.Errorf("Expected the threshold and state to change only, but got %+v", r)
+    }
+}
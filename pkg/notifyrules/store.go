@@ -0,0 +1,207 @@
+package notifyrules
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+)
+
+// Schema brings notification_rules to the unified shape. It is idempotent and keeps existing
+// rows: the legacy subscription table (user_id, event_type, channel, enabled) and the alerting
+// columns added later are both accepted, rows are classified by kind and the placeholder
+// service/metric values once backfilled onto subscriptions are cleared. Duplicate subscriptions
+// (same user, event type and channel) collapse into the newest row before the unique index.
+var Schema = []string{
+    `CREATE TABLE IF NOT EXISTS notification_rules (
+        id          BIGSERIAL PRIMARY KEY,
+        kind        TEXT NOT NULL DEFAULT 'event',
+        scope       TEXT NOT NULL DEFAULT 'user',
+        user_id     TEXT,
+        channel     TEXT NOT NULL DEFAULT 'inapp',
+        event_type  TEXT,
+        service     TEXT,
+        metric      TEXT,
+        comparator  TEXT NOT NULL DEFAULT 'gt',
+        threshold   DOUBLE PRECISION,
+        window_sec  INT NOT NULL DEFAULT 300,
+        params      JSONB NOT NULL DEFAULT '{}'::jsonb,
+        enabled     BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS kind TEXT`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT 'system'`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS user_id TEXT`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT 'inapp'`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS event_type TEXT`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS service TEXT`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS metric TEXT`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS comparator TEXT NOT NULL DEFAULT 'gt'`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS threshold DOUBLE PRECISION`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS window_sec INT NOT NULL DEFAULT 300`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS params JSONB NOT NULL DEFAULT '{}'::jsonb`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+    `ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+    // each kind leaves the other kind's columns empty
+    `ALTER TABLE notification_rules ALTER COLUMN user_id DROP NOT NULL`,
+    `ALTER TABLE notification_rules ALTER COLUMN event_type DROP NOT NULL`,
+    `ALTER TABLE notification_rules ALTER COLUMN service DROP NOT NULL`,
+    `ALTER TABLE notification_rules ALTER COLUMN metric DROP NOT NULL`,
+    `ALTER TABLE notification_rules ALTER COLUMN threshold DROP NOT NULL`,
+    `UPDATE notification_rules SET user_id=NULL WHERE user_id=''`,
+    // subscriptions never had a threshold; everything else is an alert rule
+    `UPDATE notification_rules SET kind = CASE WHEN threshold IS NULL AND event_type IS NOT NULL AND user_id IS NOT NULL THEN 'event' ELSE 'metric' END WHERE kind IS NULL`,
+    `ALTER TABLE notification_rules ALTER COLUMN kind SET DEFAULT 'event'`,
+    `ALTER TABLE notification_rules ALTER COLUMN kind SET NOT NULL`,
+    `UPDATE notification_rules SET service=NULL, metric=NULL WHERE kind='event' AND service='system' AND metric=event_type`,
+    `UPDATE notification_rules SET scope='user' WHERE kind='event' AND scope<>'user'`,
+    `DELETE FROM notification_rules a USING notification_rules b
+        WHERE a.kind='event' AND b.kind='event' AND a.user_id=b.user_id AND a.event_type=b.event_type AND a.channel=b.channel AND a.id<b.id`,
+    `DROP INDEX IF EXISTS ux_notification_rules_user_event_channel`,
+    `CREATE UNIQUE INDEX IF NOT EXISTS ux_notification_rules_subscription ON notification_rules(user_id, event_type, channel) WHERE kind='event'`,
+    `CREATE INDEX IF NOT EXISTS ix_notification_rules_user ON notification_rules(user_id)`,
+    `CREATE INDEX IF NOT EXISTS ix_notif_rules_service_metric ON notification_rules(service, metric) WHERE enabled`,
+}
+
+const columns = `id, kind, scope, COALESCE(user_id,''), channel, COALESCE(event_type,''), COALESCE(service,''), COALESCE(metric,''),
+    comparator, COALESCE(threshold,0), window_sec, COALESCE(params,'{}'::jsonb)::text, enabled, created_at, updated_at`
+
+// Store reads and writes notification_rules.
+type Store struct{ db *sql.DB }
+
+func New(db *sql.DB) *Store { return &Store{db: db} }
+
+// EnsureSchema applies Schema statement by statement.
+func (s *Store) EnsureSchema(ctx context.Context) error {
+    for _, stmt := range Schema {
+        if _, err := s.db.ExecContext(ctx, stmt); err != nil { return fmt.Errorf("notification_rules schema: %w", err) }
+    }
+    return nil
+}
+
+// Filter selects rules for List; zero fields match everything.
+type Filter struct {
+    Kind      string
+    Scope     string
+    UserID    string
+    EventType string
+    Service   string
+    Metric    string
+    Enabled   *bool
+    Limit     int
+}
+
+// List returns matching rules, newest first. Limit defaults to 500.
+func (s *Store) List(ctx context.Context, f Filter) ([]*Rule, error) {
+    where := []string{}
+    args := []any{}
+    add := func(col string, v any) {
+        args = append(args, v)
+        where = append(where, fmt.Sprintf("%s=$%d", col, len(args)))
+    }
+    if f.Kind != "" { add("kind", f.Kind) }
+    if f.Scope != "" { add("scope", f.Scope) }
+    if f.UserID != "" { add("user_id", f.UserID) }
+    if f.EventType != "" { add("event_type", f.EventType) }
+    if f.Service != "" { add("service", f.Service) }
+    if f.Metric != "" { add("metric", f.Metric) }
+    if f.Enabled != nil { add("enabled", *f.Enabled) }
+    limit := f.Limit
+    if limit <= 0 || limit > 1000 { limit = 500 }
+    q := "SELECT " + columns + " FROM notification_rules"
+    if len(where) > 0 { q += " WHERE " + strings.Join(where, " AND ") }
+    q += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+    rows, err := s.db.QueryContext(ctx, q, args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*Rule
+    for rows.Next() {
+        r, err := scanRule(rows)
+        if err != nil { return nil, err }
+        out = append(out, r)
+    }
+    return out, rows.Err()
+}
+
+// Get returns one rule or ErrNotFound.
+func (s *Store) Get(ctx context.Context, id int64) (*Rule, error) {
+    r, err := scanRule(s.db.QueryRowContext(ctx, "SELECT "+columns+" FROM notification_rules WHERE id=$1", id))
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    return r, err
+}
+
+// Subscribe creates or updates the user's subscription of eventType (or AnyEvent) to channel.
+func (s *Store) Subscribe(ctx context.Context, userID, eventType, channel string, enabled bool) (*Rule, error) {
+    return s.Create(ctx, Rule{Kind: KindEvent, Scope: ScopeUser, UserID: userID, EventType: eventType, Channel: channel, Enabled: enabled})
+}
+
+// Create normalizes and stores r. A subscription that already exists for the same user, event
+// type and channel is updated in place instead.
+func (s *Store) Create(ctx context.Context, r Rule) (*Rule, error) {
+    if err := r.Normalize(); err != nil { return nil, err }
+    pb, err := json.Marshal(r.Params)
+    if err != nil { return nil, fmt.Errorf("%w: params: %v", ErrInvalid, err) }
+    q := `INSERT INTO notification_rules(kind, scope, user_id, channel, event_type, service, metric, comparator, threshold, window_sec, params, enabled)
+        VALUES ($1,$2,NULLIF($3,''),$4,NULLIF($5,''),NULLIF($6,''),NULLIF($7,''),COALESCE(NULLIF($8,''),'gt'),$9,$10,$11::jsonb,$12)`
+    threshold := sql.NullFloat64{Float64: r.Threshold, Valid: r.Kind == KindMetric}
+    window := r.WindowSec
+    if r.Kind == KindEvent {
+        window = DefaultWindowSec
+        q += ` ON CONFLICT (user_id, event_type, channel) WHERE kind='event' DO UPDATE SET enabled=EXCLUDED.enabled, params=EXCLUDED.params, updated_at=NOW()`
+    }
+    q += " RETURNING " + columns
+    return scanRule(s.db.QueryRowContext(ctx, q, r.Kind, r.Scope, r.UserID, r.Channel, r.EventType, r.Service, r.Metric, r.Comparator, threshold, window, string(pb), r.Enabled))
+}
+
+// Update applies p to rule id and stores the result; it returns ErrNotFound or a wrapped
+// ErrInvalid when the patched rule is incomplete.
+func (s *Store) Update(ctx context.Context, id int64, p Patch) (*Rule, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    r, err := scanRule(tx.QueryRowContext(ctx, "SELECT "+columns+" FROM notification_rules WHERE id=$1 FOR UPDATE", id))
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    p.Apply(r)
+    if err := r.Normalize(); err != nil { return nil, err }
+    pb, err := json.Marshal(r.Params)
+    if err != nil { return nil, fmt.Errorf("%w: params: %v", ErrInvalid, err) }
+    threshold := sql.NullFloat64{Float64: r.Threshold, Valid: r.Kind == KindMetric}
+    window := r.WindowSec
+    if r.Kind == KindEvent { window = DefaultWindowSec }
+    out, err := scanRule(tx.QueryRowContext(ctx, `
+        UPDATE notification_rules SET scope=$2, user_id=NULLIF($3,''), channel=$4, event_type=NULLIF($5,''), service=NULLIF($6,''), metric=NULLIF($7,''),
+            comparator=COALESCE(NULLIF($8,''),'gt'), threshold=$9, window_sec=$10, params=$11::jsonb, enabled=$12, updated_at=NOW()
+        WHERE id=$1 RETURNING `+columns,
+        id, r.Scope, r.UserID, r.Channel, r.EventType, r.Service, r.Metric, r.Comparator, threshold, window, string(pb), r.Enabled))
+    if err != nil { return nil, err }
+    return out, tx.Commit()
+}
+
+// Delete removes rule id; ErrNotFound when it does not exist.
+func (s *Store) Delete(ctx context.Context, id int64) error {
+    res, err := s.db.ExecContext(ctx, `DELETE FROM notification_rules WHERE id=$1`, id)
+    if err != nil { return err }
+    if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+    return nil
+}
+
+type scanner interface{ Scan(dest ...any) error }
+
+func scanRule(sc scanner) (*Rule, error) {
+    var r Rule
+    var params string
+    if err := sc.Scan(&r.ID, &r.Kind, &r.Scope, &r.UserID, &r.Channel, &r.EventType, &r.Service, &r.Metric, &r.Comparator, &r.Threshold, &r.WindowSec, &params, &r.Enabled, &r.CreatedAt, &r.UpdatedAt); err != nil {
+        return nil, err
+    }
+    _ = json.Unmarshal([]byte(params), &r.Params)
+    if r.Kind == KindEvent {
+        // the comparator and window columns keep their defaults on subscriptions
+        r.Comparator, r.WindowSec = "", 0
+    }
+    return &r, nil
+}
@@ -0,0 +1,88 @@
+package saga
+
+import (
+    "encoding/json"
+    stderrors "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "github.com/xxrenzhe/autoads/pkg/errors"
+)
+
+// AdminHandler serves the operator API of the registered sagas under prefix (mount it behind
+// admin auth):
+//
+//   GET  {prefix}?kind=&status=&stuck=1&limit=100  list instances
+//   GET  {prefix}/{id}                              instance and step log
+//   POST {prefix}/{id}/compensate                   undo it now; body {"reason": "..."}
+func (o *Orchestrator) AdminHandler(prefix string) http.Handler {
+    prefix = strings.TrimRight(prefix, "/")
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rest := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+        if rest == "" {
+            if r.Method != http.MethodGet { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+            o.adminList(w, r)
+            return
+        }
+        action := ""
+        if strings.HasSuffix(rest, "/compensate") { rest, action = strings.TrimSuffix(rest, "/compensate"), "compensate" }
+        id, err := url.PathUnescape(rest)
+        if err != nil || id == "" || strings.Contains(id, "/") { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+        switch {
+        case action == "" && r.Method == http.MethodGet:
+            o.adminGet(w, r, id)
+        case action == "compensate" && r.Method == http.MethodPost:
+            o.adminCompensate(w, r, id)
+        default:
+            errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil)
+        }
+    })
+}
+
+func (o *Orchestrator) adminList(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    f := Filter{Kind: strings.TrimSpace(q.Get("kind")), Status: strings.TrimSpace(q.Get("status")), Stuck: q.Get("stuck") == "1"}
+    if v := q.Get("limit"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil { f.Limit = n }
+    }
+    items, err := o.List(r.Context(), f)
+    if stderrors.Is(err, ErrUnknownKind) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "unknown kind", map[string]any{"kinds": o.Kinds()}); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if items == nil { items = []*Instance{} }
+    writeJSON(w, http.StatusOK, map[string]any{"items": items, "kinds": o.Kinds()})
+}
+
+func (o *Orchestrator) adminGet(w http.ResponseWriter, r *http.Request, id string) {
+    in, steps, err := o.Get(r.Context(), id)
+    if stderrors.Is(err, ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "saga not found", nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if steps == nil { steps = []StepLog{} }
+    writeJSON(w, http.StatusOK, map[string]any{"saga": in, "steps": steps})
+}
+
+func (o *Orchestrator) adminCompensate(w http.ResponseWriter, r *http.Request, id string) {
+    var body struct{ Reason string `json:"reason"` }
+    _ = json.NewDecoder(r.Body).Decode(&body)
+    reason := strings.TrimSpace(body.Reason)
+    if reason == "" { reason = "manual compensation" }
+    in, err := o.Compensate(r.Context(), id, reason)
+    switch {
+    case stderrors.Is(err, ErrNotFound), stderrors.Is(err, ErrUnknownKind):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "saga not found", nil)
+    case stderrors.Is(err, ErrInvalidState):
+        errors.Write(w, r, http.StatusConflict, "INVALID_STATE", "saga already finished", map[string]any{"status": in.Status})
+    case err != nil:
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "compensation failed", map[string]string{"error": err.Error()})
+    default:
+        // a compensation that fails again leaves the saga failed (or retrying); report where it stands
+        writeJSON(w, http.StatusOK, map[string]any{"saga": in})
+    }
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    _ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,45 @@
+package saga
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+)
+
+// BillingError is billing's answer other than 2xx to a reserve, commit or release call.
+type BillingError struct {
+    Action  string
+    Status  int
+    Code    string
+    Details any
+}
+
+func (e *BillingError) Error() string {
+    return fmt.Sprintf("billing %s: status %d %s", e.Action, e.Status, e.Code)
+}
+
+// Rejected reports whether billing refused a reservation for lack of tokens: INSUFFICIENT_TOKENS,
+// or SPEND_CAP_EXCEEDED when an organization member's cap is reached.
+func (e *BillingError) Rejected() bool {
+    return e.Status == http.StatusConflict && (e.Code == "INSUFFICIENT_TOKENS" || e.Code == "SPEND_CAP_EXCEEDED")
+}
+
+// BillingStep makes call, a billing reserve|commit|release for the saga's charge, a step Do or
+// Compensate. Billing's 4xx answers (a *BillingError) do not change on retry, so they are
+// permanent, except for 408 and 429: a rejected reservation fails the saga instead of retrying.
+// A release that finds no open hold (404, or 409 INVALID_STATE once it expired or was released)
+// has nothing left to undo. Holds are requested to outlive the saga's wait, and a commit that
+// still finds its hold expired is debited directly by billing.
+func BillingStep(action string, call func(context.Context, *Instance) error) func(context.Context, *Instance) error {
+    return func(ctx context.Context, in *Instance) error {
+        err := call(ctx, in)
+        var be *BillingError
+        if !errors.As(err, &be) { return err }
+        if action == "release" && (be.Status == http.StatusNotFound || be.Code == "INVALID_STATE") { return nil }
+        if be.Status >= 400 && be.Status < 500 && be.Status != http.StatusRequestTimeout && be.Status != http.StatusTooManyRequests {
+            return Permanent(err)
+        }
+        return err
+    }
+}
@@ -0,0 +1,39 @@
+package saga
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+)
+
+func TestBillingStepClassifiesAnswers(t *testing.T) {
+    cases := []struct {
+        action    string
+        err       error
+        ok        bool
+        permanent bool
+    }{
+        {"reserve", nil, true, false},
+        {"reserve", &BillingError{Status: http.StatusConflict, Code: "INSUFFICIENT_TOKENS"}, false, true},
+        {"reserve", &BillingError{Status: http.StatusForbidden, Code: "FORBIDDEN"}, false, true},
+        {"reserve", &BillingError{Status: http.StatusTooManyRequests, Code: "RATE_LIMITED"}, false, false},
+        {"reserve", errors.New("connection refused"), false, false},
+        {"commit", &BillingError{Status: http.StatusServiceUnavailable}, false, false},
+        {"commit", &BillingError{Status: http.StatusConflict, Code: "INVALID_STATE"}, false, true},
+        {"release", &BillingError{Status: http.StatusNotFound, Code: "NOT_FOUND"}, true, false},
+        {"release", &BillingError{Status: http.StatusConflict, Code: "INVALID_STATE"}, true, false},
+        {"release", &BillingError{Status: http.StatusInternalServerError, Code: "INTERNAL"}, false, false},
+    }
+    for _, c := range cases {
+        step := BillingStep(c.action, func(context.Context, *Instance) error { return c.err })
+        err := step(context.Background(), &Instance{})
+        if (err == nil) != c.ok || IsPermanent(err) != c.permanent {
+            t.Errorf("%s answered %v: got %v, want ok=%v permanent=%v", c.action, c.err, err, c.ok, c.permanent)
+        }
+    }
+    rejected := &BillingError{Action: "reserve", Status: http.StatusConflict, Code: "SPEND_CAP_EXCEEDED"}
+    if !rejected.Rejected() || (&BillingError{Status: http.StatusConflict, Code: "INVALID_STATE"}).Rejected() {
+        t.Fatal("Rejected should only hold for INSUFFICIENT_TOKENS and SPEND_CAP_EXCEEDED")
+    }
+}
@@ -0,0 +1,229 @@
+package saga
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "strings"
+    "time"
+)
+
+// eventsKey holds the events an instance has seen, so an early event is not lost.
+const eventsKey = "_events"
+
+// run advances one instance in memory; the Orchestrator loads and persists it around a run.
+type run struct {
+    def  *Definition
+    in   *Instance
+    now  time.Time
+    logs []StepLog
+    // lease is how long a claimed call may take before the timer counts it as failed.
+    lease time.Duration
+    // call is the Do or Compensate the run stopped at; the Orchestrator makes it outside the
+    // instance's transaction and hands the outcome to complete.
+    call func(ctx context.Context, in *Instance) error
+    // err is the error a step gave up with during this run.
+    err error
+}
+
+func (r *run) log(name, status string, attempts int, err error) {
+    l := StepLog{SagaID: r.in.ID, Name: name, Status: status, Attempts: attempts, UpdatedAt: r.now}
+    if err != nil { l.LastError = err.Error() }
+    r.logs = append(r.logs, l)
+}
+
+// advance moves the instance on until it waits, retries later, ends or needs a call.
+func (r *run) advance() {
+    in, steps := r.in, r.def.Steps
+    for {
+        switch in.Status {
+        case StatusRunning:
+            if in.Step >= len(steps) { r.finish(StatusCompleted); return }
+            st := steps[in.Step]
+            if st.Do != nil { r.claim(st.Do); return }
+            if !r.next(st) { return }
+        case StatusCompensating:
+            if in.Step < 0 { r.finish(StatusCompensated); return }
+            st := steps[in.Step]
+            if st.Compensate != nil { r.claim(st.Compensate); return }
+            in.Attempts = 0
+            in.Step--
+        default:
+            return
+        }
+    }
+}
+
+// claim makes fn the run's pending call. It counts as an attempt, and the instance's deadline
+// becomes the end of the lease: should the outcome never be recorded (the process died), the
+// timer counts the call as failed then.
+func (r *run) claim(fn func(ctx context.Context, in *Instance) error) {
+    in := r.in
+    in.Attempts++
+    in.Claim = newClaim()
+    d := r.now.Add(r.lease)
+    in.Deadline = &d
+    r.call = fn
+}
+
+// complete records the outcome of the claimed call and moves on.
+func (r *run) complete(err error) {
+    in := r.in
+    in.Claim, r.call = "", nil
+    switch in.Status {
+    case StatusRunning:
+        st := r.def.Steps[in.Step]
+        if err != nil {
+            r.log(st.Name, StepFailed, in.Attempts, err)
+            in.LastError = err.Error()
+            if !IsPermanent(err) && in.Attempts <= st.Retries { r.retryIn(st.backoff(in.Attempts)); return }
+            r.err = err
+            // a failed call may still have taken effect (e.g. it timed out), so it is undone
+            // too unless the failure is permanent
+            from := in.Step
+            if IsPermanent(err) { from-- }
+            r.compensateFrom(from)
+            break
+        }
+        r.log(st.Name, StepOK, in.Attempts, nil)
+        if !r.next(st) { return }
+    case StatusCompensating:
+        st := r.def.Steps[in.Step]
+        if err != nil {
+            r.log(st.Name, StepCompensationFailed, in.Attempts, err)
+            in.LastError = err.Error()
+            if !IsPermanent(err) && in.Attempts <= st.Retries { r.retryIn(st.backoff(in.Attempts)); return }
+            in.Status, in.Deadline = StatusFailed, nil
+            return
+        }
+        r.log(st.Name, StepCompensated, in.Attempts, nil)
+        in.Attempts = 0
+        in.Step--
+    default:
+        return
+    }
+    r.advance()
+}
+
+// next moves past st once its call (if any) succeeded. It returns false when st now waits for
+// its events.
+func (r *run) next(st Step) bool {
+    in := r.in
+    in.Attempts = 0
+    if st.waits() {
+        if et := seen(in, st.FailOn); et != "" { r.fail(st, "event "+et); return true }
+        if et := seen(in, st.Await); et != "" { r.log(st.Name, StepOK, 0, nil); in.Step++; return true }
+        in.Status = StatusWaiting
+        in.Deadline = nil
+        if st.Timeout > 0 { d := r.now.Add(st.Timeout); in.Deadline = &d }
+        r.log(st.Name, StepWaiting, 0, nil)
+        return false
+    }
+    in.Step++
+    return true
+}
+
+// signal applies an event: it is remembered, and completes or fails the step waiting for it.
+func (r *run) signal(eventType string, data map[string]any) {
+    in := r.in
+    if in.Data == nil { in.Data = map[string]any{} }
+    for k, v := range data { if k != eventsKey { in.Data[k] = v } }
+    markSeen(in, eventType)
+    if in.Status != StatusWaiting || in.Step >= len(r.def.Steps) { return }
+    st := r.def.Steps[in.Step]
+    switch {
+    case contains(st.FailOn, eventType):
+        r.fail(st, "event "+eventType)
+    case contains(st.Await, eventType):
+        r.log(st.Name, StepOK, 0, nil)
+        in.Step++
+        in.Status, in.Deadline = StatusRunning, nil
+    default:
+        return
+    }
+    r.advance()
+}
+
+// expire handles a passed deadline: a claimed call's lease ran out, a wait times out, a retry is due.
+func (r *run) expire() {
+    in := r.in
+    if in.Deadline == nil || in.Deadline.After(r.now) { return }
+    if in.Claim != "" {
+        r.complete(errors.New("call outcome not recorded within its lease"))
+        return
+    }
+    if in.Status == StatusWaiting {
+        st := r.def.Steps[in.Step]
+        in.LastError = "timed out waiting for " + strings.Join(st.Await, "|")
+        r.log(st.Name, StepTimeout, 0, errors.New(in.LastError))
+        r.err = errors.New(in.LastError)
+        r.compensateFrom(in.Step)
+    }
+    r.advance()
+}
+
+// compensate undoes the instance on request, e.g. an operator unsticking it. A call in flight
+// loses its claim, so its outcome is dropped; a Do that ran is undone.
+func (r *run) compensate(reason string) error {
+    in := r.in
+    switch in.Status {
+    case StatusRunning:
+        from := in.Step
+        if in.Attempts == 0 { from-- } // the current step never ran
+        r.compensateFrom(from)
+    case StatusWaiting, StatusFailed:
+        // waiting: the current step ran; failed: retry the compensation that gave up
+        r.compensateFrom(in.Step)
+    case StatusCompensating:
+        in.Attempts, in.Deadline, in.Claim = 0, nil, ""
+    default:
+        return ErrInvalidState
+    }
+    if reason == "" { reason = "manual compensation" }
+    in.LastError = reason
+    r.log("manual", StepManual, 0, errors.New(reason))
+    r.advance()
+    return nil
+}
+
+func (r *run) fail(st Step, reason string) {
+    r.in.LastError = reason
+    r.err = errors.New(reason)
+    r.log(st.Name, StepFailed, 0, r.err)
+    r.compensateFrom(r.in.Step)
+}
+
+func (r *run) compensateFrom(step int) {
+    if step >= len(r.def.Steps) { step = len(r.def.Steps) - 1 }
+    r.in.Status, r.in.Step, r.in.Attempts, r.in.Deadline, r.in.Claim = StatusCompensating, step, 0, nil, ""
+}
+
+func (r *run) finish(status string) { r.in.Status, r.in.Deadline = status, nil }
+
+func (r *run) retryIn(d time.Duration) {
+    t := r.now.Add(d)
+    r.in.Deadline = &t
+}
+
+// newClaim returns a random claim id.
+func newClaim() string {
+    b := make([]byte, 8)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+func markSeen(in *Instance, eventType string) {
+    list, _ := in.Data[eventsKey].([]any)
+    for _, v := range list { if v == eventType { return } }
+    in.Data[eventsKey] = append(list, eventType)
+}
+
+// seen returns the first of types the instance has already seen.
+func seen(in *Instance, types []string) string {
+    list, _ := in.Data[eventsKey].([]any)
+    for _, v := range list {
+        if s, ok := v.(string); ok && contains(types, s) { return s }
+    }
+    return ""
+}
@@ -0,0 +1,160 @@
+package saga
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+// billing records calls of a reserve → wait → commit saga whose calls fail on demand.
+type billing struct {
+    calls []string
+    fail  map[string]error
+}
+
+func (b *billing) call(name string) func(context.Context, *Instance) error {
+    return func(context.Context, *Instance) error {
+        b.calls = append(b.calls, name)
+        if err := b.fail[name]; err != nil { return err }
+        return nil
+    }
+}
+
+func (b *billing) def() *Definition {
+    return &Definition{Kind: "task", Steps: []Step{
+        {Name: "reserve", Do: b.call("reserve"), Compensate: b.call("release"), Retries: 2, Backoff: time.Second},
+        {Name: "execute", Await: []string{"Done"}, FailOn: []string{"Failed"}, Timeout: time.Hour},
+        {Name: "commit", Do: b.call("commit"), Retries: 1},
+    }}
+}
+
+var t0 = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newRun(def *Definition) *run {
+    return &run{def: def, now: t0, lease: time.Minute, in: &Instance{ID: "task:1", Kind: def.Kind, Status: StatusRunning, Data: map[string]any{}}}
+}
+
+// drive makes the calls the run claims, as the Orchestrator does between its transactions.
+func drive(r *run) {
+    for r.call != nil { r.complete(r.call(context.Background(), r.in)) }
+}
+
+func statuses(logs []StepLog) string {
+    var out []string
+    for _, l := range logs { out = append(out, l.Name+"="+l.Status) }
+    return strings.Join(out, ",")
+}
+
+func TestHappyPath(t *testing.T) {
+    b := &billing{}
+    r := newRun(b.def())
+    r.advance(); drive(r)
+    if r.in.Status != StatusWaiting || r.in.Step != 1 || r.in.Deadline == nil || !r.in.Deadline.Equal(t0.Add(time.Hour)) {
+        t.Fatalf("after start: %+v", r.in)
+    }
+    r.signal("Done", map[string]any{"items": 2}); drive(r)
+    if r.in.Status != StatusCompleted || r.in.Deadline != nil || r.err != nil { t.Fatalf("after Done: %+v err=%v", r.in, r.err) }
+    if strings.Join(b.calls, ",") != "reserve,commit" { t.Fatalf("calls = %v", b.calls) }
+    if got := statuses(r.logs); got != "reserve=ok,execute=waiting,execute=ok,commit=ok" { t.Fatalf("logs = %s", got) }
+    if r.in.Data["items"] != 2 { t.Fatalf("signal data not merged: %v", r.in.Data) }
+}
+
+func TestFailureCompensates(t *testing.T) {
+    b := &billing{}
+    r := newRun(b.def())
+    r.advance(); drive(r)
+    r.signal("Failed", nil); drive(r)
+    if r.in.Status != StatusCompensated || r.err == nil { t.Fatalf("status=%s err=%v", r.in.Status, r.err) }
+    if strings.Join(b.calls, ",") != "reserve,release" { t.Fatalf("calls = %v", b.calls) }
+}
+
+func TestEarlyEventIsRemembered(t *testing.T) {
+    b := &billing{fail: map[string]error{"reserve": errors.New("billing down")}}
+    r := newRun(b.def())
+    r.advance(); drive(r)
+    if r.in.Status != StatusRunning || r.in.Attempts != 1 || r.in.Deadline == nil || !r.in.Deadline.Equal(t0.Add(time.Second)) {
+        t.Fatalf("retry not scheduled: %+v", r.in)
+    }
+    // the task finishes while the reservation is still being retried
+    r.signal("Done", nil); drive(r)
+    if r.in.Status != StatusRunning { t.Fatalf("early event advanced the saga: %s", r.in.Status) }
+    b.fail = nil
+    r.now = t0.Add(time.Second)
+    r.expire(); drive(r)
+    if r.in.Status != StatusCompleted { t.Fatalf("status = %s", r.in.Status) }
+    if strings.Join(b.calls, ",") != "reserve,reserve,commit" { t.Fatalf("calls = %v", b.calls) }
+}
+
+func TestRetriesExhaustedAndPermanent(t *testing.T) {
+    b := &billing{fail: map[string]error{"reserve": errors.New("billing down")}}
+    r := newRun(b.def())
+    for i := 0; i < 3; i++ {
+        r.now = r.now.Add(time.Hour)
+        if i == 0 { r.advance() } else { r.expire() }
+        drive(r)
+    }
+    // a timed-out call may have reserved, so the step is undone too
+    if r.in.Status != StatusCompensated || strings.Join(b.calls, ",") != "reserve,reserve,reserve,release" {
+        t.Fatalf("status=%s calls=%v", r.in.Status, b.calls)
+    }
+
+    b = &billing{fail: map[string]error{"reserve": Permanent(errors.New("insufficient tokens"))}}
+    r = newRun(b.def())
+    r.advance(); drive(r)
+    if r.in.Status != StatusCompensated || strings.Join(b.calls, ",") != "reserve" || r.err == nil { t.Fatalf("status=%s calls=%v err=%v", r.in.Status, b.calls, r.err) }
+}
+
+func TestTimeoutAndManualCompensation(t *testing.T) {
+    b := &billing{fail: map[string]error{"release": Permanent(errors.New("billing rejected"))}}
+    r := newRun(b.def())
+    r.advance(); drive(r)
+    r.now = t0.Add(30 * time.Minute)
+    r.expire(); drive(r)
+    if r.in.Status != StatusWaiting { t.Fatalf("expired early: %s", r.in.Status) }
+    r.now = t0.Add(time.Hour)
+    r.expire(); drive(r)
+    if r.in.Status != StatusFailed || r.in.Step != 0 || !strings.Contains(r.in.LastError, "billing rejected") {
+        t.Fatalf("after timeout: %+v", r.in)
+    }
+    b.fail = nil
+    if err := r.compensate("operator"); err != nil { t.Fatal(err) }
+    drive(r)
+    if r.in.Status != StatusCompensated { t.Fatalf("status = %s", r.in.Status) }
+    if err := r.compensate("again"); !errors.Is(err, ErrInvalidState) { t.Fatalf("err = %v", err) }
+    if got := statuses(r.logs); !strings.Contains(got, "execute=timeout") || !strings.HasSuffix(got, "manual=manual,reserve=compensated") { t.Fatalf("logs = %s", got) }
+}
+
+func TestClaimedCallLease(t *testing.T) {
+    b := &billing{}
+    r := newRun(b.def())
+    r.advance()
+    if r.call == nil || r.in.Claim == "" || r.in.Attempts != 1 || r.in.Deadline == nil || !r.in.Deadline.Equal(t0.Add(time.Minute)) {
+        t.Fatalf("reserve not claimed: %+v", r.in)
+    }
+    // the process dies before recording the outcome: the timer counts the call as failed
+    r.call = nil
+    r.now = t0.Add(30 * time.Second)
+    r.expire()
+    if r.in.Claim == "" || r.in.Attempts != 1 { t.Fatalf("lease ended early: %+v", r.in) }
+    r.now = t0.Add(time.Minute)
+    r.expire()
+    if r.in.Claim != "" || r.in.Status != StatusRunning || !r.in.Deadline.Equal(r.now.Add(time.Second)) {
+        t.Fatalf("retry not scheduled after the lease: %+v", r.in)
+    }
+    r.now = r.now.Add(time.Second)
+    r.expire()
+    drive(r)
+    if r.in.Status != StatusWaiting || strings.Join(b.calls, ",") != "reserve" { t.Fatalf("status=%s calls=%v", r.in.Status, b.calls) }
+
+    // an operator compensating during a call takes the claim away and undoes the step
+    b = &billing{}
+    r = newRun(b.def())
+    r.advance()
+    claim := r.in.Claim
+    if err := r.compensate("operator"); err != nil { t.Fatal(err) }
+    if r.in.Claim == "" || r.in.Claim == claim || r.in.Status != StatusCompensating { t.Fatalf("after compensate: %+v", r.in) }
+    drive(r)
+    if r.in.Status != StatusCompensated || strings.Join(b.calls, ",") != "release" { t.Fatalf("status=%s calls=%v", r.in.Status, b.calls) }
+}
@@ -0,0 +1,7 @@
+module github.com/xxrenzhe/autoads/pkg/saga
+
+go 1.22
+
+require github.com/xxrenzhe/autoads/pkg/errors v0.0.1
+
+replace github.com/xxrenzhe/autoads/pkg/errors => ../errors
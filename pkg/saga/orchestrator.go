@@ -0,0 +1,355 @@
+package saga
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schema adds the orchestrator's columns to the saga tables, creating them when missing.
+var Schema = []string{
+    `CREATE TABLE IF NOT EXISTS "SagaInstance" (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        task_id TEXT,
+        status TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    )`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS step INT NOT NULL DEFAULT 0`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS data JSONB NOT NULL DEFAULT '{}'::jsonb`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS deadline TIMESTAMPTZ`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS last_error TEXT`,
+    `ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS claim TEXT`,
+    // rows of the notifications service's former saga coordinator have no deadline, so the
+    // timer would never pick them up; the orchestrator never leaves an active instance without one
+    `UPDATE "SagaInstance" SET deadline = updated_at WHERE deadline IS NULL AND status IN ('running','compensating')`,
+    `CREATE INDEX IF NOT EXISTS ix_saga_instance_due ON "SagaInstance"(deadline) WHERE status IN ('running','waiting','compensating')`,
+    `CREATE INDEX IF NOT EXISTS ix_saga_instance_kind_status ON "SagaInstance"(kind, status, updated_at DESC)`,
+    `CREATE TABLE IF NOT EXISTS "SagaStep" (
+        id BIGSERIAL PRIMARY KEY,
+        saga_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    )`,
+    `CREATE INDEX IF NOT EXISTS ix_saga_step_saga ON "SagaStep"(saga_id, id)`,
+}
+
+// Orchestrator runs the registered sagas. Each change to an instance happens in a short
+// transaction holding its row lock, so events, the timer and operators never advance it
+// concurrently. Step calls (Do, Compensate) are made between transactions: the instance is
+// claimed and committed, the call runs, and its outcome is recorded in a new transaction if
+// the claim still stands. Slow remote calls therefore hold neither row locks nor connections.
+type Orchestrator struct {
+    db   *sql.DB
+    defs map[string]*Definition
+    // CallTimeout bounds one Do or Compensate call; it is also the claim's lease, after which
+    // the timer counts the call as failed (default 1m).
+    CallTimeout time.Duration
+    // StuckAfter is how long an active instance may sit past its deadline (or without one)
+    // before it is listed as stuck (default 30m).
+    StuckAfter time.Duration
+    // Batch bounds the instances one timer tick handles (default 100).
+    Batch int
+    Now   func() time.Time
+}
+
+func New(db *sql.DB) *Orchestrator {
+    return &Orchestrator{db: db, defs: map[string]*Definition{}, CallTimeout: time.Minute, StuckAfter: 30 * time.Minute, Batch: 100}
+}
+
+// errClaimLost means the instance was claimed anew while a call was in flight.
+var errClaimLost = errors.New("saga: claim lost")
+
+// Register adds a saga definition; instances of unregistered kinds are left alone.
+func (o *Orchestrator) Register(def Definition) {
+    if def.Kind == "" || len(def.Steps) == 0 { panic("saga: definition needs a kind and steps") }
+    d := def
+    o.defs[def.Kind] = &d
+}
+
+// Kinds returns the registered kinds, sorted.
+func (o *Orchestrator) Kinds() []string {
+    out := make([]string, 0, len(o.defs))
+    for k := range o.defs { out = append(out, k) }
+    sort.Strings(out)
+    return out
+}
+
+func (o *Orchestrator) EnsureSchema(ctx context.Context) error {
+    for _, q := range Schema {
+        if _, err := o.db.ExecContext(ctx, q); err != nil { return fmt.Errorf("saga schema: %w", err) }
+    }
+    return nil
+}
+
+func (o *Orchestrator) now() time.Time {
+    if o.Now != nil { return o.Now() }
+    return time.Now()
+}
+
+func (o *Orchestrator) callTimeout() time.Duration {
+    if o.CallTimeout > 0 { return o.CallTimeout }
+    return time.Minute
+}
+
+func (o *Orchestrator) newRun(def *Definition, in *Instance) *run {
+    return &run{def: def, in: in, now: o.now(), lease: o.callTimeout()}
+}
+
+// ID is the instance id of kind and key.
+func ID(kind, key string) string { return kind + ":" + key }
+
+// Start creates the instance of kind for key and runs it as far as it goes now. Starting an
+// existing instance returns it unchanged, so callers may start on every delivery of an event.
+// The error is the one a step gave up with during this call (the instance then compensates).
+func (o *Orchestrator) Start(ctx context.Context, kind, key, userID string, data map[string]any) (*Instance, error) {
+    def := o.defs[kind]
+    if def == nil { return nil, ErrUnknownKind }
+    if data == nil { data = map[string]any{} }
+    db, _ := json.Marshal(data)
+    id := ID(kind, key)
+    tx, err := o.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    now := o.now()
+    // the deadline lets the timer pick the instance up should this process die before saving
+    res, err := tx.ExecContext(ctx, `INSERT INTO "SagaInstance"(id, user_id, kind, task_id, status, step, attempts, data, deadline, created_at, updated_at)
+        VALUES ($1,$2,$3,$4,'running',0,0,$5::jsonb,$6,$6,$6) ON CONFLICT (id) DO NOTHING`, id, userID, kind, key, string(db), now.UTC())
+    if err != nil { return nil, err }
+    created, _ := res.RowsAffected()
+    in, err := loadInstance(ctx, tx, id, false)
+    if err != nil { return nil, err }
+    if created == 0 { return in, tx.Commit() }
+    r := o.newRun(def, in)
+    r.advance()
+    if err := o.save(ctx, tx, r); err != nil { return in, err }
+    if err := tx.Commit(); err != nil { return in, err }
+    return result(o.calls(ctx, r))
+}
+
+// Signal delivers an event to the instance of kind for key. ErrNotFound means there is no such
+// instance (e.g. it was never started).
+func (o *Orchestrator) Signal(ctx context.Context, kind, key, eventType string, data map[string]any) (*Instance, error) {
+    return result(o.update(ctx, ID(kind, key), false, func(r *run) error { r.signal(eventType, data); return nil }))
+}
+
+// Compensate undoes an active or failed instance on an operator's request.
+func (o *Orchestrator) Compensate(ctx context.Context, id, reason string) (*Instance, error) {
+    return result(o.update(ctx, id, false, func(r *run) error { return r.compensate(reason) }))
+}
+
+// Tick handles instances whose deadline has passed: due retries, timed-out waits and calls whose
+// lease ran out. It returns how many it handled; instances that could not be updated are logged
+// and not counted.
+func (o *Orchestrator) Tick(ctx context.Context) (int, error) {
+    kinds := o.Kinds()
+    if len(kinds) == 0 { return 0, nil }
+    batch := o.Batch
+    if batch <= 0 { batch = 100 }
+    args := []any{o.now().UTC(), batch}
+    ph := make([]string, len(kinds))
+    for i, k := range kinds { args = append(args, k); ph[i] = "$" + strconv.Itoa(i+3) }
+    rows, err := o.db.QueryContext(ctx, `SELECT id FROM "SagaInstance" WHERE status IN ('running','waiting','compensating') AND deadline <= $1 AND kind IN (`+strings.Join(ph, ",")+`) ORDER BY deadline LIMIT $2`, args...)
+    if err != nil { return 0, err }
+    var ids []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil { rows.Close(); return 0, err }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return 0, err }
+    n := 0
+    for _, id := range ids {
+        _, err := o.update(ctx, id, true, func(r *run) error { r.expire(); return nil })
+        if errors.Is(err, ErrNotFound) { continue } // taken by another instance
+        if err != nil { log.Printf("saga: %s: %v", id, err); continue }
+        n++
+    }
+    return n, nil
+}
+
+// Run ticks every interval until ctx is done.
+func (o *Orchestrator) Run(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        if _, err := o.Tick(ctx); err != nil { log.Printf("saga: tick failed: %v", err) }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
+
+// update runs fn on the instance and then makes the calls it leads to. The error is about
+// loading or saving the instance; a step that gave up is reported in the run's err.
+func (o *Orchestrator) update(ctx context.Context, id string, skipLocked bool, fn func(r *run) error) (*run, error) {
+    r, err := o.apply(ctx, id, skipLocked, fn)
+    if err != nil { return r, err }
+    return o.calls(ctx, r)
+}
+
+// apply runs fn on the locked instance and saves it in one transaction. skipLocked makes a
+// locked instance report ErrNotFound instead of waiting.
+func (o *Orchestrator) apply(ctx context.Context, id string, skipLocked bool, fn func(r *run) error) (*run, error) {
+    tx, err := o.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    in, err := loadInstance(ctx, tx, id, skipLocked)
+    if err != nil { return nil, err }
+    def := o.defs[in.Kind]
+    if def == nil { return &run{in: in}, ErrUnknownKind }
+    r := o.newRun(def, in)
+    if err := fn(r); err != nil { return r, err }
+    if err := o.save(ctx, tx, r); err != nil { return r, err }
+    if err := tx.Commit(); err != nil { return r, err }
+    return r, nil
+}
+
+// calls makes the call r stopped at, outside any transaction, and records its outcome in a new
+// one; again while the instance needs further calls. When the claim no longer stands (an operator
+// compensated, or the timer took over after the lease) the outcome is dropped: the newer claim
+// decides, and billing calls are idempotent.
+func (o *Orchestrator) calls(ctx context.Context, r *run) (*run, error) {
+    // the outcome is recorded even when the caller gives up meanwhile
+    rctx := context.WithoutCancel(ctx)
+    for r.call != nil {
+        claim := r.in.Claim
+        cctx, cancel := context.WithTimeout(ctx, o.callTimeout())
+        cerr := r.call(cctx, r.in)
+        cancel()
+        next, err := o.apply(rctx, r.in.ID, false, func(n *run) error {
+            if n.in.Claim != claim { return errClaimLost }
+            n.complete(cerr)
+            return nil
+        })
+        if errors.Is(err, errClaimLost) {
+            log.Printf("saga: %s: claim replaced during the call, outcome dropped (%v)", r.in.ID, cerr)
+            return r, nil
+        }
+        if err != nil { return r, err }
+        if next.err == nil { next.err = r.err }
+        r = next
+    }
+    return r, nil
+}
+
+// result is what Start, Signal and Compensate return: a load or save error, else the error a
+// step gave up with.
+func result(r *run, err error) (*Instance, error) {
+    if r == nil { return nil, err }
+    if err != nil { return r.in, err }
+    return r.in, r.err
+}
+
+func (o *Orchestrator) save(ctx context.Context, tx *sql.Tx, r *run) error {
+    in := r.in
+    in.UpdatedAt = r.now
+    db, _ := json.Marshal(in.Data)
+    var deadline any
+    if in.Deadline != nil { deadline = in.Deadline.UTC() }
+    if _, err := tx.ExecContext(ctx, `UPDATE "SagaInstance" SET status=$2, step=$3, attempts=$4, data=$5::jsonb, deadline=$6, last_error=NULLIF($7,''), claim=NULLIF($8,''), updated_at=$9 WHERE id=$1`,
+        in.ID, in.Status, in.Step, in.Attempts, string(db), deadline, in.LastError, in.Claim, r.now.UTC()); err != nil { return err }
+    for _, l := range r.logs {
+        if _, err := tx.ExecContext(ctx, `INSERT INTO "SagaStep"(saga_id, name, status, attempts, last_error, updated_at) VALUES ($1,$2,$3,$4,NULLIF($5,''),$6)`,
+            in.ID, l.Name, l.Status, l.Attempts, l.LastError, l.UpdatedAt.UTC()); err != nil { return err }
+    }
+    return nil
+}
+
+const instanceColumns = `id, user_id, kind, COALESCE(task_id,''), status, step, attempts, data::text, deadline, COALESCE(claim,''), COALESCE(last_error,''), created_at, updated_at`
+
+type rowScanner interface{ Scan(dest ...any) error }
+
+func scanInstance(row rowScanner) (*Instance, error) {
+    var in Instance
+    var data string
+    var deadline sql.NullTime
+    if err := row.Scan(&in.ID, &in.UserID, &in.Kind, &in.Key, &in.Status, &in.Step, &in.Attempts, &data, &deadline, &in.Claim, &in.LastError, &in.CreatedAt, &in.UpdatedAt); err != nil { return nil, err }
+    _ = json.Unmarshal([]byte(data), &in.Data)
+    if in.Data == nil { in.Data = map[string]any{} }
+    if deadline.Valid { in.Deadline = &deadline.Time }
+    return &in, nil
+}
+
+func loadInstance(ctx context.Context, tx *sql.Tx, id string, skipLocked bool) (*Instance, error) {
+    lock := ` FOR UPDATE`
+    if skipLocked { lock += ` SKIP LOCKED` }
+    in, err := scanInstance(tx.QueryRowContext(ctx, `SELECT `+instanceColumns+` FROM "SagaInstance" WHERE id=$1`+lock, id))
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    return in, err
+}
+
+// Filter narrows List; empty fields match everything within the registered kinds.
+type Filter struct {
+    Kind   string
+    Status string
+    // Stuck lists failed instances and active ones past StuckAfter.
+    Stuck bool
+    Limit int
+}
+
+// List returns instances of the registered kinds, most recently updated first.
+func (o *Orchestrator) List(ctx context.Context, f Filter) ([]*Instance, error) {
+    kinds := o.Kinds()
+    if f.Kind != "" {
+        if o.defs[f.Kind] == nil { return nil, ErrUnknownKind }
+        kinds = []string{f.Kind}
+    }
+    if len(kinds) == 0 { return nil, nil }
+    var args []any
+    arg := func(v any) string { args = append(args, v); return "$" + strconv.Itoa(len(args)) }
+    ph := make([]string, len(kinds))
+    for i, k := range kinds { ph[i] = arg(k) }
+    where := []string{"kind IN (" + strings.Join(ph, ",") + ")"}
+    if f.Status != "" { where = append(where, "status="+arg(f.Status)) }
+    if f.Stuck {
+        stuck := o.StuckAfter
+        if stuck <= 0 { stuck = 30 * time.Minute }
+        where = append(where, "(status='failed' OR (status IN ('running','waiting','compensating') AND COALESCE(deadline, updated_at) < "+arg(o.now().Add(-stuck).UTC())+"))")
+    }
+    limit := f.Limit
+    if limit <= 0 || limit > 500 { limit = 100 }
+    rows, err := o.db.QueryContext(ctx, `SELECT `+instanceColumns+` FROM "SagaInstance" WHERE `+strings.Join(where, " AND ")+` ORDER BY updated_at DESC LIMIT `+arg(limit), args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*Instance
+    for rows.Next() {
+        in, err := scanInstance(rows)
+        if err != nil { return nil, err }
+        out = append(out, in)
+    }
+    return out, rows.Err()
+}
+
+// Get returns an instance with its step log, oldest first.
+func (o *Orchestrator) Get(ctx context.Context, id string) (*Instance, []StepLog, error) {
+    in, err := scanInstance(o.db.QueryRowContext(ctx, `SELECT `+instanceColumns+` FROM "SagaInstance" WHERE id=$1`, id))
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && o.defs[in.Kind] == nil) { return nil, nil, ErrNotFound }
+    if err != nil { return nil, nil, err }
+    rows, err := o.db.QueryContext(ctx, `SELECT id, saga_id, name, status, attempts, COALESCE(last_error,''), updated_at FROM "SagaStep" WHERE saga_id=$1 ORDER BY id`, id)
+    if err != nil { return in, nil, err }
+    defer rows.Close()
+    var steps []StepLog
+    for rows.Next() {
+        var l StepLog
+        if err := rows.Scan(&l.ID, &l.SagaID, &l.Name, &l.Status, &l.Attempts, &l.LastError, &l.UpdatedAt); err != nil { return in, nil, err }
+        steps = append(steps, l)
+    }
+    return in, steps, rows.Err()
+}
@@ -0,0 +1,152 @@
+// Package saga runs long-lived, multi-service flows (reserve tokens → do the work → commit, or
+// release on failure) as declared sagas. A Definition lists ordered steps; a step may call out
+// (Do), wait for events (Await/FailOn) with a timeout, and declare how to undo itself
+// (Compensate). When a step gives up, the completed steps are compensated in reverse order.
+// State lives in "SagaInstance" and every step outcome is logged in "SagaStep", so instances
+// survive restarts; an Orchestrator advances them on Start, on Signal (events) and on its timer
+// (retries and timeouts).
+package saga
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+)
+
+// Instance statuses.
+const (
+    // StatusRunning: the current step's Do is due (now, or at Deadline when retrying).
+    StatusRunning = "running"
+    // StatusWaiting: the current step waits for one of its events until Deadline.
+    StatusWaiting = "waiting"
+    StatusCompleted = "completed"
+    // StatusCompensating: completed steps are being undone, from Step downwards.
+    StatusCompensating = "compensating"
+    StatusCompensated  = "compensated"
+    // StatusFailed: a compensation gave up; the instance needs manual compensation.
+    StatusFailed = "failed"
+)
+
+// Step log outcomes written to "SagaStep".
+const (
+    StepOK                 = "ok"
+    StepFailed             = "failed"
+    StepWaiting            = "waiting"
+    StepTimeout            = "timeout"
+    StepCompensated        = "compensated"
+    StepCompensationFailed = "compensation_failed"
+    // StepManual records an operator's manual compensation request.
+    StepManual = "manual"
+)
+
+var (
+    ErrNotFound     = errors.New("saga not found")
+    ErrUnknownKind  = errors.New("unknown saga kind")
+    ErrInvalidState = errors.New("saga is not in a state that allows this")
+)
+
+// Definition declares one kind of saga.
+type Definition struct {
+    Kind  string
+    Steps []Step
+}
+
+// Step is one stage of a saga.
+type Step struct {
+    Name string
+    // Do performs the step; nil for steps that only wait for events.
+    Do func(ctx context.Context, in *Instance) error
+    // Compensate undoes the step after a later step gave up; nil when there is nothing to undo.
+    Compensate func(ctx context.Context, in *Instance) error
+    // Await are the events that complete the step, FailOn those that fail it. Events that
+    // arrive before the step is reached are remembered.
+    Await  []string
+    FailOn []string
+    // Timeout bounds the wait for Await (0: wait forever).
+    Timeout time.Duration
+    // Retries is how often a failed Do or Compensate is retried by the timer.
+    Retries int
+    // Backoff is the first retry delay (default 5s); it doubles for every further retry.
+    Backoff time.Duration
+}
+
+func (s Step) waits() bool { return len(s.Await) > 0 || len(s.FailOn) > 0 }
+
+func (s Step) backoff(attempt int) time.Duration {
+    d := s.Backoff
+    if d <= 0 { d = 5 * time.Second }
+    for i := 1; i < attempt && d < time.Hour; i++ { d *= 2 }
+    return d
+}
+
+// Instance is the persisted state of one saga run.
+type Instance struct {
+    // ID is Kind + ":" + Key.
+    ID     string `json:"id"`
+    Kind   string `json:"kind"`
+    Key    string `json:"key"`
+    UserID string `json:"userId"`
+    Status string `json:"status"`
+    // Step indexes the current step (while compensating: the next step to undo; -1 when done).
+    Step     int            `json:"step"`
+    Attempts int            `json:"attempts"`
+    Data     map[string]any `json:"data"`
+    // Deadline is when the timer next looks at the instance: a retry, a wait timeout or the end
+    // of a claimed call's lease.
+    Deadline *time.Time `json:"deadline,omitempty"`
+    // Claim identifies the Do or Compensate call in flight; only its owner records the outcome.
+    Claim     string    `json:"claim,omitempty"`
+    LastError string    `json:"lastError,omitempty"`
+    CreatedAt time.Time `json:"createdAt"`
+    UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// String returns Data[k] when it is a string.
+func (in *Instance) String(k string) string {
+    v, _ := in.Data[k].(string)
+    return v
+}
+
+// Decode copies Data[k] into dst (through JSON, as stored).
+func (in *Instance) Decode(k string, dst any) error {
+    v, ok := in.Data[k]
+    if !ok { return nil }
+    b, err := json.Marshal(v)
+    if err != nil { return err }
+    return json.Unmarshal(b, dst)
+}
+
+// StepLog is one recorded step outcome.
+type StepLog struct {
+    ID        int64     `json:"id"`
+    SagaID    string    `json:"sagaId"`
+    Name      string    `json:"name"`
+    Status    string    `json:"status"`
+    Attempts  int       `json:"attempts"`
+    LastError string    `json:"lastError,omitempty"`
+    UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// permanentError marks failures that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the failing Do or Compensate is not retried.
+func Permanent(err error) error {
+    if err == nil { return nil }
+    return permanentError{err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+    var p permanentError
+    return errors.As(err, &p)
+}
+
+func contains(xs []string, x string) bool {
+    for _, v := range xs { if v == x { return true } }
+    return false
+}
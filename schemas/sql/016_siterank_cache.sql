@@ -0,0 +1,36 @@
+-- Unified siterank result cache (memory -> Postgres tiers live in services/siterank/internal/cache,
+-- which only checks that this table exists: this file is the single copy of its DDL)
+-- namespace: sw | analysis | similar | geo; key: host|country (similar: host)
+-- fresh_until: served as hit; stale_until: served stale while a background refresh runs
+
+CREATE TABLE IF NOT EXISTS siterank_cache (
+  namespace   TEXT NOT NULL,
+  key         TEXT NOT NULL,
+  payload     JSONB NOT NULL,
+  ok          BOOLEAN NOT NULL,
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  fresh_until TIMESTAMPTZ NOT NULL,
+  stale_until TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (namespace, key)
+);
+
+CREATE INDEX IF NOT EXISTS ix_siterank_cache_stale ON siterank_cache(stale_until);
+
+-- Carry over still-valid SimilarWeb payloads from the legacy domain caches
+DO $$
+BEGIN
+  IF to_regclass('domain_country_cache') IS NOT NULL THEN
+    INSERT INTO siterank_cache(namespace, key, payload, ok, updated_at, fresh_until, stale_until)
+    SELECT 'sw', host || '|' || country, payload, ok, updated_at, expires_at, expires_at
+    FROM domain_country_cache
+    WHERE expires_at > now() AND host NOT LIKE 'geo:%' AND host NOT LIKE 'similar:%'
+    ON CONFLICT (namespace, key) DO NOTHING;
+  END IF;
+  IF to_regclass('domain_cache') IS NOT NULL THEN
+    INSERT INTO siterank_cache(namespace, key, payload, ok, updated_at, fresh_until, stale_until)
+    SELECT 'sw', host || '|', payload, ok, updated_at, expires_at, expires_at
+    FROM domain_cache
+    WHERE expires_at > now()
+    ON CONFLICT (namespace, key) DO NOTHING;
+  END IF;
+END $$;
@@ -0,0 +1,20 @@
+-- batchopen owns "BatchopenTask": versioned rows + transactional outbox
+-- version: bumped on every status change (optimistic concurrency)
+-- batchopen_outbox: events written in the task transaction, published by the batchopen relay
+
+ALTER TABLE "BatchopenTask" ADD COLUMN IF NOT EXISTS progress DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE "BatchopenTask" ADD COLUMN IF NOT EXISTS version  INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS batchopen_outbox (
+  id              BIGSERIAL PRIMARY KEY,
+  event_type      TEXT NOT NULL,
+  subject         TEXT NOT NULL,
+  payload         JSONB NOT NULL,
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  attempts        INTEGER NOT NULL DEFAULT 0,
+  last_error      TEXT,
+  sent_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ix_batchopen_outbox_pending ON batchopen_outbox(next_attempt_at, id) WHERE sent_at IS NULL;
@@ -0,0 +1,52 @@
+-- batchopen link-health jobs: one row per job, one row per checked offer link
+-- previous final_domain per offer drives the redirect_changed verdict
+
+CREATE TABLE IF NOT EXISTS batchopen_link_job (
+  id         TEXT PRIMARY KEY,
+  user_id    TEXT NOT NULL,
+  status     TEXT NOT NULL,
+  total      INTEGER NOT NULL DEFAULT 0,
+  checked    INTEGER NOT NULL DEFAULT 0,
+  report     JSONB,
+  error      TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_batchopen_link_job_user ON batchopen_link_job(user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS batchopen_link_check (
+  job_id          TEXT NOT NULL REFERENCES batchopen_link_job(id) ON DELETE CASCADE,
+  offer_id        TEXT NOT NULL,
+  user_id         TEXT NOT NULL,
+  url             TEXT NOT NULL,
+  status          INTEGER NOT NULL DEFAULT 0,
+  latency_ms      BIGINT NOT NULL DEFAULT 0,
+  final_url       TEXT,
+  final_domain    TEXT,
+  chain_length    INTEGER NOT NULL DEFAULT 0,
+  previous_domain TEXT,
+  verdict         TEXT NOT NULL,
+  error           TEXT,
+  checked_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (job_id, offer_id)
+);
+
+CREATE INDEX IF NOT EXISTS ix_batchopen_link_check_offer ON batchopen_link_check(user_id, offer_id, checked_at DESC);
+
+-- latest verdict on the offer itself (written by offer /internal/link-health)
+ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_status       TEXT;
+ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_final_domain TEXT;
+ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_checked_at   TIMESTAMPTZ;
+
+-- offer status transitions (link-health moves offers to/from "declining")
+CREATE TABLE IF NOT EXISTS "OfferStatusHistory" (
+  id          BIGSERIAL PRIMARY KEY,
+  offer_id    TEXT NOT NULL,
+  user_id     TEXT NOT NULL,
+  from_status TEXT NOT NULL,
+  to_status   TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS ix_offer_status_history_offer ON "OfferStatusHistory"(offer_id, created_at DESC);
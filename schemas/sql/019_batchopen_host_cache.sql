@@ -0,0 +1,19 @@
+-- batchopen host cache shared across instances (BATCHOPEN_CACHE_BACKEND=postgres)
+-- entries hold browser-exec outcomes per host or URL; leases elect one leader per key
+
+CREATE TABLE IF NOT EXISTS batchopen_host_cache (
+  key        TEXT PRIMARY KEY,
+  ok         BOOLEAN NOT NULL DEFAULT FALSE,
+  result     JSONB,
+  error      TEXT,
+  expires_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_batchopen_host_cache_expires ON batchopen_host_cache(expires_at);
+
+CREATE TABLE IF NOT EXISTS batchopen_host_lease (
+  key        TEXT PRIMARY KEY,
+  owner      TEXT NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
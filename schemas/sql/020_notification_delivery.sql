@@ -0,0 +1,41 @@
+-- External notification delivery: per-user endpoints (email address, webhook or Slack/Lark
+-- incoming-webhook URL) and a delivery queue with retries. notification_rules route a user's
+-- event types ('*' = all) to channel kinds; each matching endpoint gets one delivery per
+-- notification.
+
+CREATE TABLE IF NOT EXISTS notification_channels (
+  id         BIGSERIAL PRIMARY KEY,
+  user_id    TEXT        NOT NULL,
+  kind       TEXT        NOT NULL, -- email | webhook | slack | lark
+  name       TEXT        NOT NULL DEFAULT '',
+  target     TEXT        NOT NULL,
+  secret     TEXT        NOT NULL DEFAULT '', -- signs webhook and Lark posts
+  enabled    BOOLEAN     NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS ix_notification_channels_user ON notification_channels(user_id, kind);
+
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+  id              BIGSERIAL PRIMARY KEY,
+  notification_id BIGINT      NOT NULL,
+  user_id         TEXT        NOT NULL,
+  event_type      TEXT        NOT NULL,
+  channel         TEXT        NOT NULL,
+  endpoint_id     BIGINT      NOT NULL,
+  status          TEXT        NOT NULL DEFAULT 'pending', -- pending | sending | sent | failed
+  attempts        INT         NOT NULL DEFAULT 0,
+  max_attempts    INT         NOT NULL DEFAULT 6,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_error      TEXT,
+  payload         JSONB       NOT NULL,
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  sent_at         TIMESTAMPTZ,
+  UNIQUE (notification_id, endpoint_id)
+);
+CREATE INDEX IF NOT EXISTS ix_notification_deliveries_due ON notification_deliveries(next_attempt_at) WHERE status IN ('pending','sending');
+CREATE INDEX IF NOT EXISTS ix_notification_deliveries_user ON notification_deliveries(user_id, id DESC);
+
+-- The rules upsert conflicts on (user_id, event_type, channel)
+CREATE UNIQUE INDEX IF NOT EXISTS ux_notification_rules_user_event_channel ON notification_rules(user_id, event_type, channel);
@@ -0,0 +1,57 @@
+-- Unified notification rules. 003 created per-user event subscriptions
+-- (user_id, event_type, channel, enabled) and 014/015 added metric alert columns to the same
+-- table. Every row now carries a kind: 'event' routes a user's event type ('*' = all) to a
+-- channel, 'metric' alerts when service.metric compares to threshold. Existing rows are kept
+-- and classified; duplicate subscriptions collapse into the newest row. Mirrors
+-- pkg/notifyrules.Schema, which the notifications service applies at startup.
+
+CREATE TABLE IF NOT EXISTS notification_rules (
+  id          BIGSERIAL PRIMARY KEY,
+  kind        TEXT NOT NULL DEFAULT 'event',
+  scope       TEXT NOT NULL DEFAULT 'user',
+  user_id     TEXT,
+  channel     TEXT NOT NULL DEFAULT 'inapp',
+  event_type  TEXT,
+  service     TEXT,
+  metric      TEXT,
+  comparator  TEXT NOT NULL DEFAULT 'gt',
+  threshold   DOUBLE PRECISION,
+  window_sec  INT NOT NULL DEFAULT 300,
+  params      JSONB NOT NULL DEFAULT '{}'::jsonb,
+  enabled     BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS kind TEXT;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT 'system';
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS user_id TEXT;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT 'inapp';
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS event_type TEXT;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS service TEXT;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS metric TEXT;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS comparator TEXT NOT NULL DEFAULT 'gt';
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS threshold DOUBLE PRECISION;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS window_sec INT NOT NULL DEFAULT 300;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS params JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE notification_rules ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+-- each kind leaves the other kind's columns empty
+ALTER TABLE notification_rules ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE notification_rules ALTER COLUMN event_type DROP NOT NULL;
+ALTER TABLE notification_rules ALTER COLUMN service DROP NOT NULL;
+ALTER TABLE notification_rules ALTER COLUMN metric DROP NOT NULL;
+ALTER TABLE notification_rules ALTER COLUMN threshold DROP NOT NULL;
+UPDATE notification_rules SET user_id=NULL WHERE user_id='';
+-- subscriptions never had a threshold; everything else is an alert rule
+UPDATE notification_rules SET kind = CASE WHEN threshold IS NULL AND event_type IS NOT NULL AND user_id IS NOT NULL THEN 'event' ELSE 'metric' END WHERE kind IS NULL;
+ALTER TABLE notification_rules ALTER COLUMN kind SET DEFAULT 'event';
+ALTER TABLE notification_rules ALTER COLUMN kind SET NOT NULL;
+UPDATE notification_rules SET service=NULL, metric=NULL WHERE kind='event' AND service='system' AND metric=event_type;
+UPDATE notification_rules SET scope='user' WHERE kind='event' AND scope<>'user';
+DELETE FROM notification_rules a USING notification_rules b
+  WHERE a.kind='event' AND b.kind='event' AND a.user_id=b.user_id AND a.event_type=b.event_type AND a.channel=b.channel AND a.id<b.id;
+DROP INDEX IF EXISTS ux_notification_rules_user_event_channel;
+CREATE UNIQUE INDEX IF NOT EXISTS ux_notification_rules_subscription ON notification_rules(user_id, event_type, channel) WHERE kind='event';
+CREATE INDEX IF NOT EXISTS ix_notification_rules_user ON notification_rules(user_id);
+CREATE INDEX IF NOT EXISTS ix_notif_rules_service_metric ON notification_rules(service, metric) WHERE enabled;
@@ -0,0 +1,36 @@
+-- Notification digests and quiet hours. Users choose per category whether notifications arrive
+-- immediately or in an hourly/daily digest, and set quiet hours in their timezone. Held
+-- notifications wait in notification_digest_items until release_at; repeats of one aggregate
+-- fold into the unread user_notifications row with the same group_key.
+
+CREATE TABLE IF NOT EXISTS notification_preferences (
+  user_id      TEXT PRIMARY KEY,
+  timezone     TEXT NOT NULL DEFAULT 'UTC',
+  quiet_start  TEXT NOT NULL DEFAULT '',
+  quiet_end    TEXT NOT NULL DEFAULT '',
+  digest_at    TEXT NOT NULL DEFAULT '09:00',
+  default_mode TEXT NOT NULL DEFAULT 'immediate',
+  categories   JSONB NOT NULL DEFAULT '{}'::jsonb,
+  collapse     BOOLEAN NOT NULL DEFAULT TRUE,
+  updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS notification_digest_items (
+  id          BIGSERIAL PRIMARY KEY,
+  user_id     TEXT NOT NULL,
+  event_type  TEXT NOT NULL,
+  category    TEXT NOT NULL DEFAULT 'general',
+  severity    TEXT NOT NULL DEFAULT 'info',
+  group_key   TEXT NOT NULL DEFAULT '',
+  title       TEXT NOT NULL,
+  message     JSONB NOT NULL DEFAULT '{}'::jsonb,
+  release_at  TIMESTAMPTZ NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS ix_notification_digest_items_release ON notification_digest_items(release_at);
+CREATE INDEX IF NOT EXISTS ix_notification_digest_items_user ON notification_digest_items(user_id, release_at);
+
+ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS group_key TEXT;
+ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS repeat_count INT NOT NULL DEFAULT 1;
+ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS ix_user_notifications_group ON user_notifications(user_id, group_key, id DESC) WHERE group_key IS NOT NULL;
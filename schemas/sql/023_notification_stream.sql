@@ -0,0 +1,26 @@
+-- Notification stream. Inserts and in-place updates (collapsed repeats) of user_notifications and
+-- read marks in user_notification_state are announced on the user_notifications LISTEN/NOTIFY
+-- channel as {"u": user_id, "id": notification id, "op": insert|update|read}; each notifications
+-- instance keeps one LISTEN connection and wakes only the affected users' SSE streams.
+
+CREATE OR REPLACE FUNCTION notify_user_notification() RETURNS trigger AS $$
+BEGIN
+  IF TG_TABLE_NAME = 'user_notification_state' THEN
+    PERFORM pg_notify('user_notifications', json_build_object('u', NEW.user_id, 'id', NEW.last_read_id, 'op', 'read')::text);
+  ELSE
+    PERFORM pg_notify('user_notifications', json_build_object('u', NEW.user_id, 'id', NEW.id, 'op', lower(TG_OP))::text);
+  END IF;
+  RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname='trg_user_notifications_notify') THEN
+    CREATE TRIGGER trg_user_notifications_notify AFTER INSERT OR UPDATE ON user_notifications
+      FOR EACH ROW EXECUTE FUNCTION notify_user_notification();
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname='trg_user_notification_state_notify') THEN
+    CREATE TRIGGER trg_user_notification_state_notify AFTER INSERT OR UPDATE ON user_notification_state
+      FOR EACH ROW EXECUTE FUNCTION notify_user_notification();
+  END IF;
+END $$;
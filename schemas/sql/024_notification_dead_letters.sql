@@ -0,0 +1,28 @@
+-- Dead letters of the notifications subscriber. Each event type runs an ordered list of named
+-- handlers (in-app notification, Offer projections); a handler that gives up after its
+-- retries records the event here for itself alone instead of failing the whole message. Admins
+-- list them and replay the handler; a successful replay sets resolved_at.
+
+CREATE TABLE IF NOT EXISTS notification_dead_letters (
+  id          BIGSERIAL PRIMARY KEY,
+  handler     TEXT NOT NULL,
+  event_type  TEXT NOT NULL,
+  event_id    TEXT NOT NULL DEFAULT '',
+  envelope    JSONB NOT NULL,
+  error       TEXT NOT NULL DEFAULT '',
+  attempts    INT NOT NULL DEFAULT 1,
+  replays     INT NOT NULL DEFAULT 0,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  resolved_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS ix_notification_dead_letters_open ON notification_dead_letters(handler, id DESC) WHERE resolved_at IS NULL;
+
+-- Handlers that must run once per event (the in-app notification) claim the event id here in
+-- the transaction of their writes, so Pub/Sub redelivery, relay retries and dead-letter replay
+-- do not repeat them. Relayed events carry their outbox row as id (pkg/events).
+CREATE TABLE IF NOT EXISTS notification_handled_events (
+  handler    TEXT NOT NULL,
+  event_id   TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (handler, event_id)
+);
@@ -0,0 +1,39 @@
+-- Saga orchestrator state (pkg/saga). Billing of batchopen tasks and siterank analyses runs as
+-- declared sagas (reserve → wait for the outcome → commit, or release). "SagaInstance" keeps each
+-- run's position: the current step, its attempts, the saga data and the deadline at which the
+-- timer retries a step or times out a wait. Every step outcome is appended to "SagaStep".
+-- Admins list stuck instances and compensate them under /api/v1/{batchopen,siterank}/admin/sagas.
+
+CREATE TABLE IF NOT EXISTS "SagaInstance" (
+  id         TEXT PRIMARY KEY,
+  user_id    TEXT NOT NULL,
+  kind       TEXT NOT NULL,
+  task_id    TEXT,
+  status     TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS step INT NOT NULL DEFAULT 0;
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS data JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS deadline TIMESTAMPTZ;
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS last_error TEXT;
+-- claim identifies the step call in flight; calls run outside the row lock and only the
+-- claim's owner records the outcome (deadline is then the end of its lease)
+ALTER TABLE "SagaInstance" ADD COLUMN IF NOT EXISTS claim TEXT;
+-- rows of the notifications service's former saga coordinator have no deadline; give the
+-- active ones one so the timer picks them up
+UPDATE "SagaInstance" SET deadline = updated_at WHERE deadline IS NULL AND status IN ('running','compensating');
+CREATE INDEX IF NOT EXISTS ix_saga_instance_due ON "SagaInstance"(deadline) WHERE status IN ('running','waiting','compensating');
+CREATE INDEX IF NOT EXISTS ix_saga_instance_kind_status ON "SagaInstance"(kind, status, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS "SagaStep" (
+  id         BIGSERIAL PRIMARY KEY,
+  saga_id    TEXT NOT NULL,
+  name       TEXT NOT NULL,
+  status     TEXT NOT NULL,
+  attempts   INT NOT NULL DEFAULT 0,
+  last_error TEXT,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS ix_saga_step_saga ON "SagaStep"(saga_id, id);
@@ -0,0 +1,33 @@
+-- Shared transactional outbox (pkg/events). Services write their events here in the transaction
+-- of the business change; each service's relay publishes its own rows (source) to Pub/Sub,
+-- retrying with backoff (next_attempt_at, attempts, last_error) until sent_at is set. A relay
+-- claims a batch by moving next_attempt_at past a short lease and publishes outside any
+-- transaction.
+-- Replaces batchopen_outbox: its unsent rows move over; the old table is no longer written.
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+  id              BIGSERIAL PRIMARY KEY,
+  source          TEXT NOT NULL,
+  event_type      TEXT NOT NULL,
+  subject         TEXT NOT NULL DEFAULT '',
+  payload         JSONB NOT NULL,
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  attempts        INTEGER NOT NULL DEFAULT 0,
+  last_error      TEXT,
+  sent_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ix_event_outbox_pending ON event_outbox(source, next_attempt_at, id) WHERE sent_at IS NULL;
+
+DO $$
+BEGIN
+  IF to_regclass('batchopen_outbox') IS NOT NULL THEN
+    WITH moved AS (
+      DELETE FROM batchopen_outbox WHERE sent_at IS NULL
+      RETURNING event_type, subject, payload, created_at, attempts, last_error
+    )
+    INSERT INTO event_outbox(source, event_type, subject, payload, created_at, next_attempt_at, attempts, last_error)
+    SELECT 'batchopen', event_type, subject, payload, created_at, now(), attempts, last_error FROM moved;
+  END IF;
+END $$;
@@ -0,0 +1,17 @@
+-- Multi-geo siterank runs (POST /api/v1/siterank/analyze-geo). Every run is its own row, kept
+-- apart from "SiterankAnalysis", which holds the offer's regular analysis (one per offer and
+-- user) and must not be overwritten by a geo matrix. result holds the per-country matrix and
+-- the recommended countries.
+
+CREATE TABLE IF NOT EXISTS "SiterankGeoAnalysis" (
+  id         TEXT PRIMARY KEY,
+  user_id    TEXT NOT NULL,
+  offer_id   TEXT NOT NULL,
+  countries  JSONB NOT NULL,
+  status     TEXT NOT NULL,
+  result     JSONB,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_siterank_geo_offer_user ON "SiterankGeoAnalysis"(offer_id, user_id, created_at DESC);
@@ -90,9 +90,14 @@ func checkTables(ctx context.Context, db *sql.DB) {
         "\"SiterankAnalysis\"",
         "event_store",
         "domain_cache",
-        "domain_country_cache",
+        "siterank_cache",
         "idempotency_keys",
         "\"BatchopenTask\"",
+        "event_outbox",
+        "batchopen_link_job",
+        "batchopen_link_check",
+        "batchopen_host_cache",
+        "batchopen_host_lease",
         "\"BulkActionOperation\"",
         "\"BulkActionShard\"",
         "\"BulkActionAudit\"",
@@ -10,6 +10,7 @@ require (
 	github.com/lib/pq v1.10.9
 	github.com/oapi-codegen/runtime v1.1.2
 	github.com/xxrenzhe/autoads/pkg/auth v0.0.1
+	github.com/xxrenzhe/autoads/pkg/browserexec v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/config v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/errors v0.0.1
 	github.com/xxrenzhe/autoads/pkg/events v0.0.0-00010101000000-000000000000
@@ -96,3 +97,5 @@ replace github.com/xxrenzhe/autoads/pkg/middleware => ../../pkg/middleware
 replace github.com/xxrenzhe/autoads/pkg/telemetry => ../../pkg/telemetry
 
 replace github.com/xxrenzhe/autoads/pkg/config => ../../pkg/config
+
+replace github.com/xxrenzhe/autoads/pkg/browserexec => ../../pkg/browserexec
@@ -4,11 +4,11 @@ package executor
 
 import (
     "context"
+    "encoding/json"
     "errors"
-    "net/http"
     "strings"
     "time"
-    httpx "github.com/xxrenzhe/autoads/pkg/http"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
 )
 
 // Action represents a single bulk action unit.
@@ -41,11 +41,15 @@ type Config struct {
     CustomerID        string
 }
 
-type Executor struct{ cfg Config; http *httpx.Client }
+type Executor struct{ cfg Config; be *browserexec.Client }
 
 func New(cfg Config) *Executor {
     if cfg.Timeout <= 0 { cfg.Timeout = 5 * time.Second }
-    return &Executor{cfg: cfg, http: httpx.New(cfg.Timeout)}
+    // resolve client: single attempt bounded by cfg.Timeout
+    be := browserexec.New(cfg.BrowserExecURL,
+        browserexec.WithToken(cfg.InternalToken),
+        browserexec.WithPolicy(browserexec.EndpointResolveOffer, browserexec.Policy{Timeout: cfg.Timeout}))
+    return &Executor{cfg: cfg, be: be}
 }
 
 // ExecuteOne performs a single action. This is a minimal stub implementation:
@@ -85,17 +89,16 @@ func (e *Executor) rotateLink(ctx context.Context, a Action) (Result, error) {
     }
     if e.cfg.ValidateOnly { return Result{Success: true, Message: "validateOnly", Details: map[string]interface{}{"target": url}}, nil }
     // best-effort call browser-exec /resolve-offer
-    be := strings.TrimRight(e.cfg.BrowserExecURL, "/")
-    if be == "" {
+    if !e.be.Configured() {
         // fallback simulate suffix
         return Result{Success: true, Message: "rotated (stub)", Details: map[string]interface{}{"target": url, "finalUrlSuffix": time.Now().UTC().Format("20060102150405")}}, nil
     }
-    body := map[string]interface{}{"url": url, "timeoutMs": int(e.cfg.Timeout / time.Millisecond)}
-    hdr := map[string]string{}
-    if e.cfg.InternalToken != "" { hdr["Authorization"] = "Bearer "+e.cfg.InternalToken }
-    out := map[string]interface{}{}
-    if err := e.http.DoJSON(ctx, http.MethodPost, be+"/api/v1/browser/resolve-offer", body, hdr, 1, &out); err != nil {
+    rr, err := e.be.ResolveOffer(ctx, browserexec.ResolveOfferRequest{URL: url, TimeoutMs: int(e.cfg.Timeout / time.Millisecond)})
+    if err != nil {
         return Result{Success: false, Message: err.Error()}, err
     }
+    // details keep the resolve-offer JSON shape
+    out := map[string]interface{}{}
+    if b, err := json.Marshal(rr); err == nil { _ = json.Unmarshal(b, &out) }
     return Result{Success: true, Message: "rotated (resolved)", Details: out}, nil
 }
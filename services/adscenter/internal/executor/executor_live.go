@@ -15,6 +15,7 @@ import (
     "golang.org/x/oauth2"
     "golang.org/x/oauth2/google"
     httpx "github.com/xxrenzhe/autoads/pkg/http"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
 )
 
 type Action struct {
@@ -43,11 +44,14 @@ type Config struct {
     CustomerID         string
 }
 
-type Executor struct{ cfg Config; http *httpx.Client }
+type Executor struct{ cfg Config; http *httpx.Client; be *browserexec.Client }
 
 func New(cfg Config) *Executor {
     if cfg.Timeout <= 0 { cfg.Timeout = 6 * time.Second }
-    return &Executor{cfg: cfg, http: httpx.New(cfg.Timeout)}
+    be := browserexec.New(cfg.BrowserExecURL,
+        browserexec.WithToken(cfg.InternalToken),
+        browserexec.WithPolicy(browserexec.EndpointResolveOffer, browserexec.Policy{Timeout: cfg.Timeout}))
+    return &Executor{cfg: cfg, http: httpx.New(cfg.Timeout), be: be}
 }
 
 func (e *Executor) ExecuteOne(ctx context.Context, a Action) (Result, error) {
@@ -174,14 +178,9 @@ func (e *Executor) rotateLink(ctx context.Context, a Action) (Result, error) {
         var url string
         if v, ok := a.Params["links"].([]interface{}); ok && len(v) > 0 { if s0, ok2 := v[0].(string); ok2 { url = strings.TrimSpace(s0) } }
         if url == "" { if s0, ok := a.Params["targetDomain"].(string); ok { url = strings.TrimSpace(s0) } }
-        if url != "" && strings.TrimSpace(e.cfg.BrowserExecURL) != "" {
-            be := strings.TrimRight(e.cfg.BrowserExecURL, "/")
-            body := map[string]interface{}{"url": url, "timeoutMs": int(e.cfg.Timeout / time.Millisecond)}
-            hdr := map[string]string{}
-            if e.cfg.InternalToken != "" { hdr["Authorization"] = "Bearer "+e.cfg.InternalToken }
-            out := map[string]interface{}{}
-            if err := e.http.DoJSON(ctx, http.MethodPost, be+"/api/v1/browser/resolve-offer", body, hdr, 1, &out); err == nil {
-                if v, ok := out["finalUrlSuffix"].(string); ok { suffix = strings.TrimSpace(v) }
+        if url != "" && e.be.Configured() {
+            if rr, err := e.be.ResolveOffer(ctx, browserexec.ResolveOfferRequest{URL: url, TimeoutMs: int(e.cfg.Timeout / time.Millisecond)}); err == nil {
+                suffix = strings.TrimSpace(rr.FinalUrlSuffix)
             }
         }
         if suffix == "" { suffix = time.Now().UTC().Format("20060102150405") }
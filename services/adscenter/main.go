@@ -39,6 +39,7 @@ import (
     "fmt"
     neturl "net/url"
     httpx "github.com/xxrenzhe/autoads/pkg/http"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
     ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
@@ -144,6 +145,9 @@ func (s *Server) accountsHandler(w http.ResponseWriter, r *http.Request) {
     writeJSON(w, http.StatusOK, map[string]any{"items": items})
 }
 
+// outboxSource names adscenter's rows in event_outbox (pkg/events); the relay started in main publishes them.
+const outboxSource = "adscenter"
+
 type Server struct {
     db *sql.DB
     pcMu sync.RWMutex
@@ -851,18 +855,26 @@ func (s *Server) abTestsRefreshMetricsHandler(w http.ResponseWriter, r *http.Req
     writeJSON(w, http.StatusOK, map[string]any{"ok": true, "fetched": len(m)})
 }
 
+var (
+    landingProbeOnce sync.Once
+    landingProbeCli  *browserexec.Client
+)
+
+// landingProbe is the browser-exec client for preflight checks: one attempt within the 1.5s preflight budget.
+func landingProbe() *browserexec.Client {
+    landingProbeOnce.Do(func() {
+        landingProbeCli = browserexec.FromEnv(browserexec.WithPolicy(browserexec.EndpointCheckAvailability, browserexec.Policy{Timeout: 1500 * time.Millisecond}))
+    })
+    return landingProbeCli
+}
+
 // checkLandingReachability calls browser-exec /check-availability to verify landing URL.
 func checkLandingReachability(ctx context.Context, url string) *PreflightCheck {
-    be := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
-    if be == "" { return &PreflightCheck{Name:"landing.reachability", Status:"warn", Detail:"browser-exec not configured"} }
-    type reqT struct{ URL string `json:"url"`; Timeout int `json:"timeoutMs"` }
+    be := landingProbe()
+    if !be.Configured() { return &PreflightCheck{Name:"landing.reachability", Status:"warn", Detail:"browser-exec not configured"} }
     cctx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
     defer cancel()
-    hdr := map[string]string{"Content-Type": "application/json"}
-    if tok := strings.TrimSpace(os.Getenv("BROWSER_INTERNAL_TOKEN")); tok != "" { hdr["Authorization"] = "Bearer "+tok }
-    var out struct{ Ok bool `json:"ok"`; Status int `json:"status"` }
-    _ = httpx.New(1500*time.Millisecond).DoJSON(cctx, http.MethodPost, be+"/api/v1/browser/check-availability", reqT{URL:url, Timeout: 1200}, hdr, 1, &out)
-    if out.Ok || (out.Status >= 200 && out.Status < 400) {
+    if av, err := be.CheckAvailability(cctx, browserexec.CheckAvailabilityRequest{URL: url, TimeoutMs: 1200}); err == nil && av.Reachable() {
         return &PreflightCheck{Name:"landing.reachability", Status:"ok", Detail:"reachable"}
     }
     return &PreflightCheck{Name:"landing.reachability", Status:"warn", Detail:"unreachable or non-2xx"}
@@ -1654,6 +1666,18 @@ func main() {
     if err != nil { log.Fatalf("db: %v", err) }
     defer db.Close()
 
+    // Events leave through the event_outbox; the relay publishes them with retries
+    if err := ev.EnsureOutbox(ctx, db); err != nil {
+        log.Printf("WARN: ensure event_outbox ddl failed: %v", err)
+    }
+    if pub, err := ev.NewPublisher(ctx); err != nil {
+        log.Printf("WARN: adscenter publisher init failed: %v", err)
+    } else {
+        defer pub.Close()
+        relay := &ev.Relay{DB: db, Pub: pub, Source: outboxSource, Interval: time.Second}
+        go relay.Run(ctx)
+    }
+
     srv := &Server{db: db}
     r := chi.NewRouter()
     telemetry.RegisterDefaultMetrics("adscenter")
@@ -1705,6 +1729,8 @@ func main() {
     r.Handle("/api/v1/adscenter/bulk-actions/{id}/deadletters/retry-batch", middleware.AuthMiddleware(http.HandlerFunc(srv.retryDeadLetterBatchHandler)))
     // Keywords expansion (rule-based, no Ads API)
     r.Handle("/api/v1/adscenter/keywords/expand", middleware.AuthMiddleware(http.HandlerFunc(srv.keywordsExpandHandler)))
+    // Keyword ideas with volume/competition (used by siterank keyword enrichment)
+    r.Handle("/api/v1/adscenter/keywords/ideas", middleware.AuthMiddleware(http.HandlerFunc(srv.keywordIdeasHandler)))
     // Bulk audits & rollback (stubs)
     r.Handle("/api/v1/adscenter/bulk-actions/{id}/audits", middleware.AuthMiddleware(http.HandlerFunc(srv.bulkAuditsHandler)))
     r.Handle("/api/v1/adscenter/bulk-actions/{id}/rollback", middleware.AuthMiddleware(http.HandlerFunc(srv.bulkRollbackHandler)))
@@ -2215,7 +2241,7 @@ func (s *Server) bulkMatrixHandler(w http.ResponseWriter, r *http.Request) {
     })
 }
 
-// riskEvaluateHandler evaluates basic risk signals and writes an audit event; optionally publishes a notification.
+// riskEvaluateHandler evaluates basic risk signals and writes an audit event; records a notification when risks are found.
 // POST /api/v1/adscenter/risk/evaluate { accountId, landingUrl?, metrics }
 func (s *Server) riskEvaluateHandler(w http.ResponseWriter, r *http.Request) {
     uid, _ := r.Context().Value(middleware.UserIDKey).(string)
@@ -2241,22 +2267,10 @@ func (s *Server) riskEvaluateHandler(w http.ResponseWriter, r *http.Request) {
     if u := strings.TrimSpace(body.LandingURL); u != "" {
         if !strings.Contains(u, "utm_") && !strings.Contains(u, "gclid=") { add("TRACKING_MISSING", "warn", "缺少utm/gclid跟踪参数", map[string]any{"landingUrl": u}) }
     }
-    // audit best-effort
-    _ = writeAudit(r.Context(), s.db, uid, "risk_detected", map[string]any{"accountId": body.AccountID, "risks": risks})
-    // optional notification publish
-    go func() {
-        defer func(){ recover() }()
-        if pub, err := ev.NewPublisher(context.Background()); err == nil && len(risks) > 0 {
-            _ = pub.Publish(context.Background(), ev.EventNotificationCreated, map[string]any{
-                "userId": uid,
-                "type": "risk",
-                "title": "检测到广告风险",
-                "data": map[string]any{"accountId": body.AccountID, "risks": risks},
-                "createdAt": time.Now().UTC().Format(time.RFC3339),
-            }, ev.WithSource("adscenter"))
-            pub.Close()
-        }
-    }()
+    // audit and notification best-effort, recorded in one transaction; the relay publishes the notification
+    if err := s.recordRisks(r.Context(), uid, body.AccountID, risks); err != nil {
+        log.Printf("WARN: adscenter record risks failed: %v", err)
+    }
     w.Header().Set("Content-Type", "application/json")
     _ = json.NewEncoder(w).Encode(map[string]any{"items": risks})
 }
@@ -2353,7 +2367,28 @@ func (h *oasImpl) GetDiagnoseMetrics(w http.ResponseWriter, r *http.Request, par
 }
 
 // writeAudit writes an audit event best-effort.
-func writeAudit(ctx context.Context, db *sql.DB, userID, kind string, data map[string]any) error {
+// recordRisks writes the risk_detected audit event and, when risks were found, a NotificationCreated
+// event to the outbox in the same transaction.
+func (s *Server) recordRisks(ctx context.Context, uid, accountID string, risks []map[string]any) error {
+    if s.db == nil { return nil }
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    data := map[string]any{"accountId": accountID, "risks": risks}
+    if err := writeAudit(ctx, tx, uid, "risk_detected", data); err != nil { return err }
+    if len(risks) > 0 {
+        if err := ev.Enqueue(ctx, tx, outboxSource, ev.OutboxEvent{Type: ev.EventNotificationCreated, Subject: uid, Data: map[string]any{
+            "userId": uid,
+            "type": "risk",
+            "title": "检测到广告风险",
+            "data": data,
+            "createdAt": time.Now().UTC().Format(time.RFC3339),
+        }}); err != nil { return err }
+    }
+    return tx.Commit()
+}
+
+func writeAudit(ctx context.Context, db ev.Execer, userID, kind string, data map[string]any) error {
     if db == nil || userID == "" || kind == "" { return nil }
     b, _ := json.Marshal(data)
     _, err := db.ExecContext(ctx, `INSERT INTO "AuditEvent"(user_id, kind, data, created_at) VALUES ($1,$2,$3::jsonb,NOW())`, userID, kind, string(b))
@@ -2457,42 +2492,71 @@ func (s *Server) expandKeywordsHandler(w http.ResponseWriter, r *http.Request) {
     seedDomain := strings.TrimSpace(body.SeedDomain)
     if len(seeds) == 0 && seedDomain == "" { apperr.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "seedDomain or seedKeywords required", nil); return }
 
+    ideas, _ := s.keywordIdeasFor(r.Context(), uid, seedDomain, seeds)
+    type idea struct{ Keyword string `json:"keyword"`; Avg int `json:"avgMonthlySearches"`; Competition string `json:"competition"` }
+    items := make([]idea, 0, len(ideas))
+    for _, it := range ideas {
+        if it.AvgMonthlySearches <= 1000 { continue }
+        if strings.EqualFold(it.Competition, "HIGH") { continue }
+        items = append(items, idea{Keyword: it.Text, Avg: it.AvgMonthlySearches, Competition: strings.ToUpper(it.Competition)})
+    }
+    sort.Slice(items, func(i, j int) bool { return items[i].Avg > items[j].Avg })
+    if len(items) > 20 { items = items[:20] }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(struct{ Items []idea `json:"items"` }{Items: items})
+}
+
+// keywordIdeasFor returns keyword ideas (volume + competition) for seeds. Uses the live Ads client when
+// ADS_KEYWORD_LIVE=true and the user has a connected account; otherwise falls back to the stub. live reports which.
+func (s *Server) keywordIdeasFor(ctx context.Context, uid, seedDomain string, seeds []string) (ideas []adsstub.KeywordIdea, live bool) {
     // Optional LIVE integration (build tag 'ads_live' required for real API calls)
-    var ideas []adsstub.KeywordIdea
     if strings.EqualFold(strings.TrimSpace(os.Getenv("ADS_KEYWORD_LIVE")), "true") {
         // Load platform creds + user refresh token (similar to preflight)
-        creds, _ := adscfg.LoadAdsCreds(r.Context())
-        tokenEnc, loginCID, _, err := storage.GetUserRefreshToken(r.Context(), s.db, uid)
+        creds, _ := adscfg.LoadAdsCreds(ctx)
+        tokenEnc, loginCID, _, err := storage.GetUserRefreshToken(ctx, s.db, uid)
         if err == nil && tokenEnc != "" {
             if pt, ok := decryptWithRotation(tokenEnc); ok { creds.RefreshToken = pt } else { creds.RefreshToken = tokenEnc }
             if creds.LoginCustomerID == "" && loginCID != "" { creds.LoginCustomerID = loginCID }
-            if cli, err2 := adsstub.NewClient(r.Context(), adsstub.LiveConfig{
+            if cli, err2 := adsstub.NewClient(ctx, adsstub.LiveConfig{
                 DeveloperToken: creds.DeveloperToken,
                 OAuthClientID: creds.OAuthClientID,
                 OAuthClientSecret: creds.OAuthClientSecret,
                 RefreshToken: creds.RefreshToken,
                 LoginCustomerID: creds.LoginCustomerID,
             }); err2 == nil {
-                if its, err3 := cli.KeywordIdeas(r.Context(), seedDomain, seeds); err3 == nil { ideas = its }
+                if its, err3 := cli.KeywordIdeas(ctx, seedDomain, seeds); err3 == nil { return its, true }
             }
         }
     }
-    if ideas == nil {
-        // Fallback to stub
-        cli, _ := adsstub.NewClient(r.Context(), adsstub.LiveConfig{})
-        ideas, _ = cli.KeywordIdeas(r.Context(), seedDomain, seeds)
+    // Fallback to stub
+    cli, _ := adsstub.NewClient(ctx, adsstub.LiveConfig{})
+    ideas, _ = cli.KeywordIdeas(ctx, seedDomain, seeds)
+    return ideas, false
+}
+
+// POST /api/v1/adscenter/keywords/ideas
+// Unfiltered keyword ideas for enrichment by other services (e.g. siterank keyword pipeline).
+// body: { seedDomain?: string, seedKeywords?: [string] }
+// resp: { items: [{ keyword, avgMonthlySearches, competition }], live: bool }
+func (s *Server) keywordIdeasHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { apperr.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    if r.Method != http.MethodPost { apperr.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    var body struct{
+        SeedDomain   string   `json:"seedDomain"`
+        SeedKeywords []string `json:"seedKeywords"`
     }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil { apperr.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+    seeds := make([]string, 0, len(body.SeedKeywords))
+    for _, k := range body.SeedKeywords { k = strings.TrimSpace(k); if k != "" { seeds = append(seeds, k) } }
+    if len(seeds) > 50 { seeds = seeds[:50] }
+    seedDomain := strings.TrimSpace(body.SeedDomain)
+    if len(seeds) == 0 && seedDomain == "" { apperr.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "seedDomain or seedKeywords required", nil); return }
+    ideas, live := s.keywordIdeasFor(r.Context(), uid, seedDomain, seeds)
     type idea struct{ Keyword string `json:"keyword"`; Avg int `json:"avgMonthlySearches"`; Competition string `json:"competition"` }
     items := make([]idea, 0, len(ideas))
-    for _, it := range ideas {
-        if it.AvgMonthlySearches <= 1000 { continue }
-        if strings.EqualFold(it.Competition, "HIGH") { continue }
-        items = append(items, idea{Keyword: it.Text, Avg: it.AvgMonthlySearches, Competition: strings.ToUpper(it.Competition)})
-    }
-    sort.Slice(items, func(i, j int) bool { return items[i].Avg > items[j].Avg })
-    if len(items) > 20 { items = items[:20] }
-    w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(struct{ Items []idea `json:"items"` }{Items: items})
+    for _, it := range ideas { items = append(items, idea{Keyword: it.Text, Avg: it.AvgMonthlySearches, Competition: strings.ToUpper(it.Competition)}) }
+    writeJSON(w, http.StatusOK, map[string]any{"items": items, "live": live})
 }
 
 // executeNextShardHandler picks the next queued shard for a bulk operation and executes it (stub),
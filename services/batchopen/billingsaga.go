@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    stderrors "errors"
+    "log"
+    "time"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/pkg/saga"
+)
+
+// Task billing runs as the "batchopen" saga (pkg/saga), keyed by task id: tokens are reserved
+// when the task starts, committed once it completes and released when it fails, times out or an
+// operator compensates it (GET/POST /api/v1/batchopen/admin/sagas). Billing calls are retried by
+// the saga timer, so a billing outage no longer loses a commit or a release.
+
+const sagaBatchopen = "batchopen"
+
+const (
+    // executeTimeout bounds the wait for the task's outcome.
+    executeTimeout = 2 * time.Hour
+    // holdTTL is the reservation lifetime requested from billing (its default is 30m): the wait
+    // plus an hour for the commit and its first retries.
+    holdTTL = executeTimeout + time.Hour
+)
+
+// sagas is nil when DATABASE_URL is not set (task endpoints are disabled then as well).
+var sagas *saga.Orchestrator
+
+func newBillingSagas(db *sql.DB) *saga.Orchestrator {
+    o := saga.New(db)
+    o.Register(saga.Definition{Kind: sagaBatchopen, Steps: []saga.Step{
+        {Name: "reserve", Do: billingStep("reserve"), Compensate: billingStep("release"), Retries: 5},
+        {Name: "execute", Await: []string{ev.EventBatchOpsTaskCompleted}, FailOn: []string{ev.EventBatchOpsTaskFailed}, Timeout: executeTimeout},
+        {Name: "commit", Do: billingStep("commit"), Retries: 10, Backoff: 10 * time.Second},
+    }})
+    return o
+}
+
+// billingStep calls billing for the saga's task, paid by the organization it was started for;
+// saga.BillingStep decides which answers are worth a retry.
+func billingStep(action string) func(context.Context, *saga.Instance) error {
+    return saga.BillingStep(action, func(ctx context.Context, in *saga.Instance) error {
+        return billingAction(middleware.WithOrgID(ctx, in.String("orgId")), in.UserID, action, in.Key)
+    })
+}
+
+// startBilling starts the task's billing saga, which reserves its tokens; starting it again is a
+// no-op. It returns the *saga.BillingError billing refused the reservation with, which leaves the
+// task unpaid; other failures are logged and retried by the saga.
+func startBilling(ctx context.Context, taskID, uid string) *saga.BillingError {
+    if sagas == nil { return nil }
+    _, err := sagas.Start(ctx, sagaBatchopen, taskID, uid, map[string]any{"orgId": middleware.OrgIDFrom(ctx)})
+    if err == nil { return nil }
+    var be *saga.BillingError
+    if stderrors.As(err, &be) { return be }
+    log.Printf("batchopen: billing saga %s: %v", taskID, err)
+    return nil
+}
+
+// settleBilling hands the task's outcome (BatchOpsTaskCompleted or BatchOpsTaskFailed) to its
+// billing saga, which commits or releases the reservation. Tasks started before billing ran as a
+// saga have none.
+func settleBilling(ctx context.Context, taskID, eventType string) {
+    if sagas == nil { return }
+    if _, err := sagas.Signal(ctx, sagaBatchopen, taskID, eventType, nil); err != nil && !stderrors.Is(err, saga.ErrNotFound) {
+        log.Printf("batchopen: billing saga %s %s: %v", taskID, eventType, err)
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xxrenzhe/autoads/pkg/saga"
+)
+
+func TestBillingStepClassifiesAnswers(t *testing.T) {
+	answers := map[string]struct {
+		status int
+		code   string
+	}{}
+	var reserved map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if action == "reserve" {
+			_ = json.NewDecoder(r.Body).Decode(&reserved)
+		}
+		a := answers[action]
+		if a.status == 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(a.status)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": a.code}})
+	}))
+	defer srv.Close()
+	t.Setenv("BILLING_URL", srv.URL)
+	in := &saga.Instance{Key: "t1", UserID: "u1", Data: map[string]any{}}
+	ctx := context.Background()
+
+	if err := billingStep("reserve")(ctx, in); err != nil {
+		t.Fatalf("Expected reserve to succeed, but got %v", err)
+	}
+	if ttl, _ := reserved["ttlSeconds"].(float64); ttl <= executeTimeout.Seconds() {
+		t.Fatalf("Expected the hold to outlive the %v wait, but ttlSeconds = %v", executeTimeout, reserved["ttlSeconds"])
+	}
+
+	cases := []struct {
+		action    string
+		status    int
+		code      string
+		ok        bool
+		permanent bool
+	}{
+		{"reserve", http.StatusConflict, "INSUFFICIENT_TOKENS", false, true},
+		{"reserve", http.StatusConflict, "SPEND_CAP_EXCEEDED", false, true},
+		{"reserve", http.StatusForbidden, "FORBIDDEN", false, true},
+		{"reserve", http.StatusTooManyRequests, "RATE_LIMITED", false, false},
+		{"commit", http.StatusServiceUnavailable, "", false, false},
+		{"commit", http.StatusConflict, "INVALID_STATE", false, true},
+		{"release", http.StatusNotFound, "NOT_FOUND", true, false},
+		{"release", http.StatusConflict, "INVALID_STATE", true, false},
+		{"release", http.StatusInternalServerError, "INTERNAL", false, false},
+	}
+	for _, c := range cases {
+		answers[c.action] = struct {
+			status int
+			code   string
+		}{c.status, c.code}
+		err := billingStep(c.action)(ctx, in)
+		if (err == nil) != c.ok || saga.IsPermanent(err) != c.permanent {
+			t.Errorf("Expected %s answered %d %s to give ok=%v permanent=%v, but got %v", c.action, c.status, c.code, c.ok, c.permanent, err)
+		}
+		delete(answers, c.action)
+	}
+}
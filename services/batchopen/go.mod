@@ -12,12 +12,15 @@ require (
 	github.com/oapi-codegen/runtime v1.1.2
 	github.com/prometheus/client_golang v1.23.2
 	github.com/xxrenzhe/autoads/pkg/auth v0.0.1
+	github.com/xxrenzhe/autoads/pkg/browserexec v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/errors v0.0.1
 	github.com/xxrenzhe/autoads/pkg/eventbus v0.0.0-20250921095352-ef8078c06b83
 	github.com/xxrenzhe/autoads/pkg/events v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/http v0.0.0-00010101000000-000000000000
+	github.com/xxrenzhe/autoads/pkg/idempotency v0.0.0
 	github.com/xxrenzhe/autoads/pkg/logger v0.0.1
 	github.com/xxrenzhe/autoads/pkg/middleware v0.0.0-00010101000000-000000000000
+	github.com/xxrenzhe/autoads/pkg/saga v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/telemetry v0.0.0-00010101000000-000000000000
 )
 
@@ -50,7 +53,6 @@ require (
 	github.com/prometheus/procfs v0.16.1 // indirect
 	github.com/rs/zerolog v1.34.0 // indirect
 	github.com/xxrenzhe/autoads/pkg/httpclient v0.0.0 // indirect
-	github.com/xxrenzhe/autoads/pkg/idempotency v0.0.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.61.0 // indirect
@@ -95,3 +97,7 @@ replace github.com/xxrenzhe/autoads/pkg/middleware => ../../pkg/middleware
 replace github.com/xxrenzhe/autoads/pkg/idempotency => ../../pkg/idempotency
 
 replace github.com/xxrenzhe/autoads/pkg/httpclient => ../../pkg/httpclient
+
+replace github.com/xxrenzhe/autoads/pkg/browserexec => ../../pkg/browserexec
+
+replace github.com/xxrenzhe/autoads/pkg/saga => ../../pkg/saga
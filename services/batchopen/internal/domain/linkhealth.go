@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+// Link health verdicts. Dead, slow and redirect_changed links are flagged; unknown means the
+// check itself could not run (browser-exec unavailable) and says nothing about the link.
+const (
+	LinkOK              = "ok"
+	LinkDead            = "dead"
+	LinkSlow            = "slow"
+	LinkRedirectChanged = "redirect_changed"
+	LinkUnknown         = "unknown"
+)
+
+// Link-health job statuses.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// LinkJob is a bulk link-health run over a user's offers.
+type LinkJob struct {
+	ID        string      `json:"id"`
+	UserID    string      `json:"userId"`
+	Status    string      `json:"status"`
+	Total     int         `json:"total"`
+	Checked   int         `json:"checked"`
+	Report    *LinkReport `json:"report,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+// LinkCheck is the outcome of resolving one offer URL through its redirect chain.
+type LinkCheck struct {
+	OfferID     string `json:"offerId"`
+	URL         string `json:"url"`
+	Status      int    `json:"status"`
+	LatencyMs   int64  `json:"latencyMs"`
+	FinalURL    string `json:"finalUrl,omitempty"`
+	FinalDomain string `json:"finalDomain,omitempty"`
+	ChainLength int    `json:"chainLength"`
+	// PreviousDomain is the final domain seen by the last check of the same offer, if any.
+	PreviousDomain string    `json:"previousDomain,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Verdict        string    `json:"verdict"`
+	CheckedAt      time.Time `json:"checkedAt"`
+}
+
+// Classify sets Verdict from the check: dead (no usable response) wins over redirect_changed
+// (the chain now lands on a different site), which wins over slow (latency above slow).
+func (c *LinkCheck) Classify(slow time.Duration) string {
+	switch {
+	case c.Status == 0 || c.Status >= 400:
+		c.Verdict = LinkDead
+	case c.PreviousDomain != "" && c.FinalDomain != "" && siteOf(c.PreviousDomain) != siteOf(c.FinalDomain):
+		c.Verdict = LinkRedirectChanged
+	case slow > 0 && time.Duration(c.LatencyMs)*time.Millisecond > slow:
+		c.Verdict = LinkSlow
+	default:
+		c.Verdict = LinkOK
+	}
+	return c.Verdict
+}
+
+// LinkReport summarises a link-health job.
+type LinkReport struct {
+	Total           int         `json:"total"`
+	OK              int         `json:"ok"`
+	Dead            int         `json:"dead"`
+	Slow            int         `json:"slow"`
+	RedirectChanged int         `json:"redirectChanged"`
+	Unknown         int         `json:"unknown"`
+	Flagged         []LinkCheck `json:"flagged"`
+}
+
+// Summarize counts verdicts and lists the flagged links.
+func Summarize(checks []LinkCheck) LinkReport {
+	r := LinkReport{Total: len(checks), Flagged: []LinkCheck{}}
+	for _, c := range checks {
+		switch c.Verdict {
+		case LinkOK:
+			r.OK++
+			continue
+		case LinkUnknown:
+			r.Unknown++
+			continue
+		case LinkDead:
+			r.Dead++
+		case LinkSlow:
+			r.Slow++
+		case LinkRedirectChanged:
+			r.RedirectChanged++
+		}
+		r.Flagged = append(r.Flagged, c)
+	}
+	return r
+}
+
+// siteOf folds a host to its registrable-looking suffix (last two labels, www stripped), so
+// shop.example.com and www.example.com are the same site for redirect comparison.
+func siteOf(host string) string {
+	h := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+	parts := strings.Split(h, ".")
+	if len(parts) > 2 {
+		return strings.Join(parts[len(parts)-2:], ".")
+	}
+	return h
+}
@@ -0,0 +1,39 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkCheck_Classify(t *testing.T) {
+	slow := 3 * time.Second
+	cases := []struct {
+		name  string
+		check LinkCheck
+		want  string
+	}{
+		{"ok", LinkCheck{Status: 200, LatencyMs: 800, FinalDomain: "shop.example.com"}, LinkOK},
+		{"unreachable", LinkCheck{Status: 0, Error: "timeout"}, LinkDead},
+		{"not found", LinkCheck{Status: 404, LatencyMs: 5000}, LinkDead},
+		{"slow", LinkCheck{Status: 200, LatencyMs: 4500}, LinkSlow},
+		{"same site", LinkCheck{Status: 200, FinalDomain: "www.example.com", PreviousDomain: "shop.example.com"}, LinkOK},
+		{"redirect changed", LinkCheck{Status: 200, LatencyMs: 4500, FinalDomain: "parked.net", PreviousDomain: "example.com"}, LinkRedirectChanged},
+	}
+	for _, tc := range cases {
+		c := tc.check
+		if got := c.Classify(slow); got != tc.want || c.Verdict != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	checks := []LinkCheck{{Verdict: LinkOK}, {Verdict: LinkDead}, {Verdict: LinkSlow}, {Verdict: LinkRedirectChanged}, {Verdict: LinkOK}, {Verdict: LinkUnknown}}
+	r := Summarize(checks)
+	if r.Total != 6 || r.OK != 2 || r.Dead != 1 || r.Slow != 1 || r.RedirectChanged != 1 || r.Unknown != 1 {
+		t.Errorf("unexpected counts: %+v", r)
+	}
+	if len(r.Flagged) != 3 {
+		t.Errorf("Expected 3 flagged links, got %d", len(r.Flagged))
+	}
+}
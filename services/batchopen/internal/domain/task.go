@@ -2,9 +2,22 @@ package domain
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// Task statuses. A task moves queued -> running -> completed|failed; terminal states are final.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// ErrInvalidTransition is returned when a status change is not allowed from the current status.
+var ErrInvalidTransition = errors.New("invalid task transition")
+
 // Task represents a batchopen task.
 type Task struct {
 	ID               string          `json:"id"`
@@ -13,8 +26,11 @@ type Task struct {
 	SimulationConfig json.RawMessage `json:"simulationConfig"`
 	Status           string          `json:"status"` // "queued", "running", "completed", "failed"
 	Progress         float64         `json:"progress"`
-	CreatedAt        time.Time       `json:"createdAt"`
-	UpdatedAt        time.Time       `json:"updatedAt"`
+	Result           json.RawMessage `json:"result,omitempty"`
+	// Version is bumped on every persisted change and guards concurrent updates.
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 // NewTask creates a new batchopen task with a "queued" status.
@@ -25,17 +41,41 @@ func NewTask(id, userID, offerID string, config json.RawMessage) *Task {
 		UserID:           userID,
 		OfferID:          offerID,
 		SimulationConfig: config,
-		Status:           "queued",
+		Status:           StatusQueued,
 		Progress:         0.0,
 		CreatedAt:        now,
 		UpdatedAt:        now,
 	}
 }
 
-// Start marks the task as "running".
-func (t *Task) Start() {
-	t.Status = "running"
+// CanTransition reports whether a task may move from one status to another.
+func CanTransition(from, to string) bool {
+	switch from {
+	case StatusQueued:
+		return to == StatusRunning
+	case StatusRunning:
+		return to == StatusCompleted || to == StatusFailed
+	}
+	return false
+}
+
+// IsTerminal reports whether the task reached a final status.
+func (t *Task) IsTerminal() bool {
+	return t.Status == StatusCompleted || t.Status == StatusFailed
+}
+
+func (t *Task) transition(to string) error {
+	if !CanTransition(t.Status, to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, t.Status, to)
+	}
+	t.Status = to
 	t.UpdatedAt = time.Now()
+	return nil
+}
+
+// Start marks a queued task as "running".
+func (t *Task) Start() error {
+	return t.transition(StatusRunning)
 }
 
 // UpdateProgress updates the task's progress.
@@ -50,15 +90,16 @@ func (t *Task) UpdateProgress(progress float64) {
 	t.UpdatedAt = time.Now()
 }
 
-// Complete marks the task as "completed".
-func (t *Task) Complete() {
-	t.Status = "completed"
+// Complete marks a running task as "completed".
+func (t *Task) Complete() error {
+	if err := t.transition(StatusCompleted); err != nil {
+		return err
+	}
 	t.Progress = 100.0
-	t.UpdatedAt = time.Now()
+	return nil
 }
 
-// Fail marks the task as "failed".
-func (t *Task) Fail() {
-	t.Status = "failed"
-	t.UpdatedAt = time.Now()
+// Fail marks a running task as "failed".
+func (t *Task) Fail() error {
+	return t.transition(StatusFailed)
 }
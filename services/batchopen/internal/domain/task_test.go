@@ -2,6 +2,7 @@ package domain
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 )
@@ -40,7 +41,9 @@ func TestNewTask(t *testing.T) {
 func TestTask_Start(t *testing.T) {
 	task := NewTask("id", "user", "offer", nil)
 	time.Sleep(10 * time.Millisecond)
-	task.Start()
+	if err := task.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
 
 	if task.Status != "running" {
 		t.Errorf("Expected Status to be 'running', but got %s", task.Status)
@@ -77,7 +80,12 @@ func TestTask_UpdateProgress(t *testing.T) {
 func TestTask_Complete(t *testing.T) {
 	task := NewTask("id", "user", "offer", nil)
 	time.Sleep(10 * time.Millisecond)
-	task.Complete()
+	if err := task.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := task.Complete(); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
 
 	if task.Status != "completed" {
 		t.Errorf("Expected Status to be 'completed', but got %s", task.Status)
@@ -93,7 +101,12 @@ func TestTask_Complete(t *testing.T) {
 func TestTask_Fail(t *testing.T) {
 	task := NewTask("id", "user", "offer", nil)
 	time.Sleep(10 * time.Millisecond)
-	task.Fail()
+	if err := task.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := task.Fail(); err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
 
 	if task.Status != "failed" {
 		t.Errorf("Expected Status to be 'failed', but got %s", task.Status)
@@ -102,3 +115,28 @@ func TestTask_Fail(t *testing.T) {
 		t.Errorf("Expected UpdatedAt to be after CreatedAt")
 	}
 }
+
+func TestTask_InvalidTransitions(t *testing.T) {
+	task := NewTask("id", "user", "offer", nil)
+	if err := task.Complete(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected queued -> completed to be rejected, got %v", err)
+	}
+	if err := task.Fail(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected queued -> failed to be rejected, got %v", err)
+	}
+	if task.Status != StatusQueued {
+		t.Errorf("Expected rejected transitions to leave status queued, got %s", task.Status)
+	}
+
+	_ = task.Start()
+	if err := task.Start(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected running -> running to be rejected, got %v", err)
+	}
+	_ = task.Fail()
+	if !task.IsTerminal() {
+		t.Errorf("Expected failed task to be terminal")
+	}
+	if err := task.Complete(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected failed -> completed to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+// Package hostcache caches browser-exec results per key (host or URL) and coalesces concurrent
+// lookups for the same key, within one process and across instances sharing a Backend.
+//
+// On a miss one caller becomes the leader: it takes the key's lease in the backend, renews it
+// while the fetch runs (browser-exec resolves can outlast LeaseTTL) and stores the outcome. Callers in the same process wait on the leader's call; callers in
+// other instances wait for the stored outcome. A leader's error reaches every waiter (it is kept
+// for ErrTTL so remote waiters see it too) instead of being replaced by a synthetic failure;
+// errors are never served to callers that arrive after the leader finished, so retries refetch.
+package hostcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Value is a cached browser-exec outcome in its loosely-typed JSON shape.
+type Value struct {
+	OK     bool           `json:"ok"`
+	Result map[string]any `json:"result,omitempty"`
+}
+
+// Entry is what a Backend stores per key. Err is set when the leader's fetch failed.
+type Entry struct {
+	Value     Value     `json:"value"`
+	Err       string    `json:"err,omitempty"`
+	StoredAt  time.Time `json:"storedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Backend stores entries and per-key leader leases. Implementations must treat expired
+// entries and leases as absent.
+type Backend interface {
+	Name() string
+	Get(ctx context.Context, key string) (Entry, bool, error)
+	Set(ctx context.Context, key string, e Entry) error
+	// Acquire takes the key's lease for owner unless another owner holds an unexpired one; when
+	// owner already holds it, the lease is extended to ttl from now.
+	Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, key, owner string) error
+}
+
+// Fetch computes the value on a miss and chooses how long it stays cached.
+type Fetch func(ctx context.Context) (Value, time.Duration, error)
+
+// LeaderError is a leader's failure replayed from the backend to a caller that did not share
+// the leader's process.
+type LeaderError struct {
+	Key string
+	Msg string
+}
+
+func (e *LeaderError) Error() string { return fmt.Sprintf("hostcache %s: %s", e.Key, e.Msg) }
+
+// ErrLeaderTimeout is returned when another instance kept its lease past MaxWait without
+// storing an outcome.
+var ErrLeaderTimeout = errors.New("hostcache: timed out waiting for leader")
+
+// Options tune a Cache; zero values use the defaults noted per field.
+type Options struct {
+	ErrTTL       time.Duration // how long leader errors are kept for remote waiters (5s)
+	LeaseTTL     time.Duration // leader lease, renewed every LeaseTTL/3 while fetching; bounds a crashed leader's hold (30s)
+	MaxWait      time.Duration // how long a remote waiter follows a live leader before ErrLeaderTimeout (2m)
+	PollInterval time.Duration // remote waiter poll interval (100ms)
+}
+
+// Stats are the cache counters exposed on /stats and as Prometheus metrics.
+type Stats struct {
+	Backend      string `json:"backend"`
+	Hits         int64  `json:"hits"`
+	Misses       int64  `json:"misses"`
+	Coalesced    int64  `json:"coalesced"`
+	RemoteWaits  int64  `json:"remoteWaits"`
+	LeaderErrors int64  `json:"leaderErrors"`
+	BackendErrs  int64  `json:"backendErrors"`
+}
+
+type call struct {
+	done chan struct{}
+	val  Value
+	err  error
+}
+
+// Cache is safe for concurrent use.
+type Cache struct {
+	backend Backend
+	opts    Options
+	owner   string
+
+	mu    sync.Mutex
+	calls map[string]*call
+
+	hits, misses, coalesced, remoteWaits, leaderErrors, backendErrs atomic.Int64
+}
+
+// New returns a Cache over backend (Memory when nil).
+func New(backend Backend, opts Options) *Cache {
+	if backend == nil {
+		backend = NewMemory()
+	}
+	if opts.ErrTTL <= 0 {
+		opts.ErrTTL = 5 * time.Second
+	}
+	if opts.LeaseTTL <= 0 {
+		opts.LeaseTTL = 30 * time.Second
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = 2 * time.Minute
+	}
+	return &Cache{backend: backend, opts: opts, owner: uuid.NewString(), calls: map[string]*call{}}
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Backend:      c.backend.Name(),
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		Coalesced:    c.coalesced.Load(),
+		RemoteWaits:  c.remoteWaits.Load(),
+		LeaderErrors: c.leaderErrors.Load(),
+		BackendErrs:  c.backendErrs.Load(),
+	}
+}
+
+// Do returns the cached value for key or runs fetch once per key across all callers sharing
+// the backend. hit reports whether the value came from the cache.
+func (c *Cache) Do(ctx context.Context, key string, fetch Fetch) (v Value, hit bool, err error) {
+	if e, ok := c.get(ctx, key); ok && e.Err == "" {
+		c.hits.Add(1)
+		return e.Value, true, nil
+	}
+	c.misses.Add(1)
+
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		c.coalesced.Add(1)
+		select {
+		case <-cl.done:
+			return cl.val, false, cl.err
+		case <-ctx.Done():
+			return Value{}, false, ctx.Err()
+		}
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	cl.val, cl.err = c.lead(ctx, key, fetch)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+	return cl.val, false, cl.err
+}
+
+// lead runs on behalf of this process: it either wins the backend lease and fetches, or waits
+// for the instance that holds it.
+func (c *Cache) lead(ctx context.Context, key string, fetch Fetch) (Value, error) {
+	start := time.Now()
+	// a live leader renews its lease, so waiting is bounded by MaxWait; a crashed one's lease
+	// lapses within LeaseTTL and the next Acquire takes over
+	deadline := start.Add(c.opts.MaxWait)
+	waited := false
+	for {
+		ok, err := c.backend.Acquire(ctx, key, c.owner, c.opts.LeaseTTL)
+		if err != nil {
+			// backend trouble must not stall checks: fetch locally
+			c.backendErrs.Add(1)
+			log.Printf("hostcache: acquire %s via %s: %v", key, c.backend.Name(), err)
+			ok = true
+		}
+		if ok {
+			if waited {
+				// the holder we waited for may have stored an outcome right before releasing
+				if e, hit := c.get(ctx, key); hit && (e.Err == "" || !e.StoredAt.Before(start)) {
+					_ = c.backend.Release(ctx, key, c.owner)
+					return e.Value, entryErr(key, e)
+				}
+			}
+			return c.fetch(ctx, key, fetch)
+		}
+		if !waited {
+			waited = true
+			c.remoteWaits.Add(1)
+		}
+		select {
+		case <-ctx.Done():
+			return Value{}, ctx.Err()
+		case <-time.After(c.opts.PollInterval):
+		}
+		// errors count only when stored by the leader we are waiting for
+		if e, hit := c.get(ctx, key); hit && (e.Err == "" || !e.StoredAt.Before(start)) {
+			return e.Value, entryErr(key, e)
+		}
+		if time.Now().After(deadline) {
+			return Value{}, ErrLeaderTimeout
+		}
+	}
+}
+
+func (c *Cache) fetch(ctx context.Context, key string, fetch Fetch) (Value, error) {
+	defer func() {
+		if err := c.backend.Release(context.WithoutCancel(ctx), key, c.owner); err != nil {
+			c.backendErrs.Add(1)
+		}
+	}()
+	stop := c.renewLease(ctx, key)
+	v, ttl, err := fetch(ctx)
+	stop()
+	now := time.Now()
+	e := Entry{Value: v, StoredAt: now, ExpiresAt: now.Add(ttl)}
+	if err != nil {
+		c.leaderErrors.Add(1)
+		e = Entry{Err: err.Error(), StoredAt: now, ExpiresAt: now.Add(c.opts.ErrTTL)}
+	}
+	if ttl > 0 || err != nil {
+		if serr := c.backend.Set(context.WithoutCancel(ctx), key, e); serr != nil {
+			c.backendErrs.Add(1)
+			log.Printf("hostcache: set %s via %s: %v", key, c.backend.Name(), serr)
+		}
+	}
+	return v, err
+}
+
+// renewLease re-acquires this instance's lease on key every LeaseTTL/3 until the returned stop
+// is called, so remote waiters keep waiting for a slow leader instead of fetching again.
+func (c *Cache) renewLease(ctx context.Context, key string) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(c.opts.LeaseTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if _, err := c.backend.Acquire(context.WithoutCancel(ctx), key, c.owner, c.opts.LeaseTTL); err != nil {
+					c.backendErrs.Add(1)
+					log.Printf("hostcache: renew %s via %s: %v", key, c.backend.Name(), err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (c *Cache) get(ctx context.Context, key string) (Entry, bool) {
+	e, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		c.backendErrs.Add(1)
+		return Entry{}, false
+	}
+	if ok && !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt) {
+		return Entry{}, false
+	}
+	return e, ok
+}
+
+func entryErr(key string, e Entry) error {
+	if e.Err == "" {
+		return nil
+	}
+	return &LeaderError{Key: key, Msg: e.Err}
+}
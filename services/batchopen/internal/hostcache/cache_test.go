@@ -0,0 +1,187 @@
+package hostcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func value(status float64) Value {
+	return Value{OK: true, Result: map[string]any{"status": status}}
+}
+
+func TestDoCoalescesInProcess(t *testing.T) {
+	c := New(nil, Options{})
+	release := make(chan struct{})
+	var calls int32
+	fetch := func(context.Context) (Value, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return value(200), time.Minute, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]Value, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := c.Do(context.Background(), "example.com", fetch)
+			if err != nil {
+				t.Errorf("Do: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+	// wait until every caller is either leading or coalesced
+	for c.Stats().Misses < int64(len(results)) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected one fetch, got %d", n)
+	}
+	for _, v := range results {
+		if !v.OK || v.Result["status"] != float64(200) {
+			t.Fatalf("unexpected value %+v", v)
+		}
+	}
+	if s := c.Stats(); s.Coalesced != int64(len(results)-1) {
+		t.Fatalf("expected %d coalesced, got %+v", len(results)-1, s)
+	}
+	if _, hit, _ := c.Do(context.Background(), "example.com", fetch); !hit {
+		t.Fatal("expected cache hit after leader stored the value")
+	}
+}
+
+func TestLeaderErrorReachesWaiters(t *testing.T) {
+	shared := NewMemory()
+	a := New(shared, Options{})
+	b := New(shared, Options{PollInterval: 5 * time.Millisecond})
+	boom := errors.New("browser-exec overloaded")
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	errA := make(chan error, 2)
+	go func() {
+		_, _, err := a.Do(context.Background(), "shop.example.com", func(context.Context) (Value, time.Duration, error) {
+			close(started)
+			<-release
+			return Value{}, 0, boom
+		})
+		errA <- err
+	}()
+	<-started
+	// same-process waiter
+	go func() {
+		_, _, err := a.Do(context.Background(), "shop.example.com", func(context.Context) (Value, time.Duration, error) {
+			t.Error("coalesced caller must not fetch")
+			return Value{}, 0, nil
+		})
+		errA <- err
+	}()
+	// other instance
+	errB := make(chan error, 1)
+	go func() {
+		_, _, err := b.Do(context.Background(), "shop.example.com", func(context.Context) (Value, time.Duration, error) {
+			t.Error("remote waiter must not fetch while the lease is held")
+			return Value{}, 0, nil
+		})
+		errB <- err
+	}()
+	for b.Stats().RemoteWaits == 0 || a.Stats().Coalesced == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errA; !errors.Is(err, boom) {
+			t.Fatalf("in-process caller: expected leader error, got %v", err)
+		}
+	}
+	var le *LeaderError
+	if err := <-errB; !errors.As(err, &le) || le.Msg != boom.Error() {
+		t.Fatalf("remote caller: expected replayed leader error, got %v", err)
+	}
+	if s := a.Stats(); s.LeaderErrors != 1 {
+		t.Fatalf("expected one leader error, got %+v", s)
+	}
+	// a later caller retries instead of replaying the error
+	v, hit, err := b.Do(context.Background(), "shop.example.com", func(context.Context) (Value, time.Duration, error) {
+		return value(200), time.Minute, nil
+	})
+	if err != nil || hit || !v.OK {
+		t.Fatalf("expected fresh fetch after leader error, got %+v hit=%v err=%v", v, hit, err)
+	}
+}
+
+func TestRemoteWaiterTakesOverExpiredLease(t *testing.T) {
+	shared := NewMemory()
+	// a crashed instance left its lease behind
+	if ok, _ := shared.Acquire(context.Background(), "example.org", "ghost", 30*time.Millisecond); !ok {
+		t.Fatal("expected ghost lease")
+	}
+	c := New(shared, Options{PollInterval: 5 * time.Millisecond})
+	v, hit, err := c.Do(context.Background(), "example.org", func(context.Context) (Value, time.Duration, error) {
+		return value(204), time.Minute, nil
+	})
+	if err != nil || hit || v.Result["status"] != float64(204) {
+		t.Fatalf("expected own fetch after lease expiry, got %+v hit=%v err=%v", v, hit, err)
+	}
+	if s := c.Stats(); s.RemoteWaits != 1 {
+		t.Fatalf("expected one remote wait, got %+v", s)
+	}
+}
+
+func TestSlowLeaderKeepsLeaseForRemoteWaiters(t *testing.T) {
+	shared := NewMemory()
+	opts := Options{LeaseTTL: 30 * time.Millisecond, PollInterval: 5 * time.Millisecond}
+	a, b := New(shared, opts), New(shared, opts)
+	var calls int32
+	started := make(chan struct{})
+	slow := func(context.Context) (Value, time.Duration, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		time.Sleep(150 * time.Millisecond) // several lease TTLs
+		return value(200), time.Minute, nil
+	}
+	go func() { _, _, _ = a.Do(context.Background(), "slow.example.com", slow) }()
+	<-started
+	v, hit, err := b.Do(context.Background(), "slow.example.com", slow)
+	if err != nil || hit || v.Result["status"] != float64(200) {
+		t.Fatalf("expected the leader's value, got %+v hit=%v err=%v", v, hit, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected one fetch across instances, got %d", n)
+	}
+}
+
+func TestRemoteWaiterGivesUpAfterMaxWait(t *testing.T) {
+	shared := NewMemory()
+	opts := Options{LeaseTTL: 20 * time.Millisecond, PollInterval: 5 * time.Millisecond}
+	a := New(shared, opts)
+	b := New(shared, Options{LeaseTTL: opts.LeaseTTL, PollInterval: opts.PollInterval, MaxWait: 50 * time.Millisecond})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		_, _, _ = a.Do(context.Background(), "stuck.example.com", func(context.Context) (Value, time.Duration, error) {
+			close(started)
+			<-release
+			return value(200), time.Minute, nil
+		})
+	}()
+	<-started
+	if _, _, err := b.Do(context.Background(), "stuck.example.com", func(context.Context) (Value, time.Duration, error) {
+		t.Error("waiter fetched while the leader held a renewed lease")
+		return Value{}, 0, nil
+	}); !errors.Is(err, ErrLeaderTimeout) {
+		t.Fatalf("expected ErrLeaderTimeout, got %v", err)
+	}
+}
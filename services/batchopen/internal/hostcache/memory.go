@@ -0,0 +1,75 @@
+package hostcache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process backend. Sharing one Memory between several Caches behaves like
+// instances sharing a remote backend.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+	leases  map[string]lease
+	sweep   time.Time
+}
+
+type lease struct {
+	owner string
+	exp   time.Time
+}
+
+// NewMemory returns an empty in-process backend.
+func NewMemory() *Memory {
+	return &Memory{entries: map[string]Entry{}, leases: map[string]lease{}}
+}
+
+func (m *Memory) Name() string { return "memory" }
+
+func (m *Memory) Get(_ context.Context, key string) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.ExpiresAt) {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+func (m *Memory) Set(_ context.Context, key string, e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.entries[key] = e
+	// drop expired entries at most once a minute so the map does not grow unbounded
+	if now.Sub(m.sweep) > time.Minute {
+		m.sweep = now
+		for k, v := range m.entries {
+			if now.After(v.ExpiresAt) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Acquire(_ context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if l, ok := m.leases[key]; ok && l.owner != owner && now.Before(l.exp) {
+		return false, nil
+	}
+	m.leases[key] = lease{owner: owner, exp: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Release(_ context.Context, key, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.leases[key]; ok && l.owner == owner {
+		delete(m.leases, key)
+	}
+	return nil
+}
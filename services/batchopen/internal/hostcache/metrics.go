@@ -0,0 +1,24 @@
+package hostcache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Collectors exposes the counters as Prometheus counters named <prefix>_hits_total,
+// <prefix>_miss_total, <prefix>_coalesced_total, <prefix>_remote_waits_total,
+// <prefix>_leader_errors_total and <prefix>_backend_errors_total.
+func (c *Cache) Collectors(prefix string) []prometheus.Collector {
+	counter := func(name, help string, get func(Stats) int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        prefix + "_" + name,
+			Help:        help,
+			ConstLabels: prometheus.Labels{"backend": c.backend.Name()},
+		}, func() float64 { return float64(get(c.Stats())) })
+	}
+	return []prometheus.Collector{
+		counter("hits_total", "Total host-level cache hits", func(s Stats) int64 { return s.Hits }),
+		counter("miss_total", "Total host-level cache misses", func(s Stats) int64 { return s.Misses }),
+		counter("coalesced_total", "Lookups that joined an in-process leader instead of calling browser-exec", func(s Stats) int64 { return s.Coalesced }),
+		counter("remote_waits_total", "Lookups that waited for a leader in another instance", func(s Stats) int64 { return s.RemoteWaits }),
+		counter("leader_errors_total", "Leader fetches that failed and were propagated to waiters", func(s Stats) int64 { return s.LeaderErrors }),
+		counter("backend_errors_total", "Cache backend errors (treated as misses or local leadership)", func(s Stats) int64 { return s.BackendErrs }),
+	}
+}
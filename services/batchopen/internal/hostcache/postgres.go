@@ -0,0 +1,100 @@
+package hostcache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Postgres stores entries in batchopen_host_cache and leases in batchopen_host_lease
+// (schemas/sql/019_batchopen_host_cache.sql).
+type Postgres struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	sweep time.Time
+}
+
+// NewPostgres returns a backend on db.
+func NewPostgres(db *sql.DB) *Postgres { return &Postgres{db: db} }
+
+func (p *Postgres) Name() string { return "postgres" }
+
+func (p *Postgres) Get(ctx context.Context, key string) (Entry, bool, error) {
+	var e Entry
+	var result, errMsg sql.NullString
+	err := p.db.QueryRowContext(ctx, `
+        SELECT ok, result::text, error, updated_at, expires_at FROM batchopen_host_cache WHERE key=$1 AND expires_at > now()
+    `, key).Scan(&e.Value.OK, &result, &errMsg, &e.StoredAt, &e.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to query host cache: %w", err)
+	}
+	e.Err = errMsg.String
+	if result.Valid && result.String != "null" {
+		if err := json.Unmarshal([]byte(result.String), &e.Value.Result); err != nil {
+			return Entry{}, false, fmt.Errorf("failed to decode host cache entry: %w", err)
+		}
+	}
+	return e, true, nil
+}
+
+func (p *Postgres) Set(ctx context.Context, key string, e Entry) error {
+	var result any
+	if e.Value.Result != nil {
+		b, err := json.Marshal(e.Value.Result)
+		if err != nil {
+			return fmt.Errorf("failed to encode host cache entry: %w", err)
+		}
+		result = string(b)
+	}
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO batchopen_host_cache (key, ok, result, error, expires_at, updated_at)
+        VALUES ($1, $2, $3::jsonb, NULLIF($4,''), $5, $6)
+        ON CONFLICT (key) DO UPDATE SET ok=EXCLUDED.ok, result=EXCLUDED.result, error=EXCLUDED.error, expires_at=EXCLUDED.expires_at, updated_at=EXCLUDED.updated_at
+    `, key, e.Value.OK, result, e.Err, e.ExpiresAt.UTC(), e.StoredAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to upsert host cache: %w", err)
+	}
+	p.prune(ctx)
+	return nil
+}
+
+// prune deletes expired entries and leases at most once a minute per instance.
+func (p *Postgres) prune(ctx context.Context) {
+	p.mu.Lock()
+	if time.Since(p.sweep) < time.Minute {
+		p.mu.Unlock()
+		return
+	}
+	p.sweep = time.Now()
+	p.mu.Unlock()
+	_, _ = p.db.ExecContext(ctx, `DELETE FROM batchopen_host_cache WHERE expires_at < now() - interval '1 hour'`)
+	_, _ = p.db.ExecContext(ctx, `DELETE FROM batchopen_host_lease WHERE expires_at < now()`)
+}
+
+func (p *Postgres) Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	res, err := p.db.ExecContext(ctx, `
+        INSERT INTO batchopen_host_lease (key, owner, expires_at)
+        VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+        ON CONFLICT (key) DO UPDATE SET owner=EXCLUDED.owner, expires_at=EXCLUDED.expires_at
+        WHERE batchopen_host_lease.expires_at < now() OR batchopen_host_lease.owner = EXCLUDED.owner
+    `, key, owner, ttl.Milliseconds())
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire host lease: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (p *Postgres) Release(ctx context.Context, key, owner string) error {
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM batchopen_host_lease WHERE key=$1 AND owner=$2`, key, owner); err != nil {
+		return fmt.Errorf("failed to release host lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package hostcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis stores entries under <prefix>e:<key> and leases under <prefix>l:<key>, both with
+// native expiry.
+type Redis struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewRedis returns a backend on rdb; prefix namespaces the keys (default "batchopen:hc:").
+func NewRedis(rdb *redis.Client, prefix string) *Redis {
+	if prefix == "" {
+		prefix = "batchopen:hc:"
+	}
+	return &Redis{rdb: rdb, prefix: prefix}
+}
+
+func (r *Redis) Name() string { return "redis" }
+
+func (r *Redis) Get(ctx context.Context, key string) (Entry, bool, error) {
+	b, err := r.rdb.Get(ctx, r.prefix+"e:"+key).Bytes()
+	if err == redis.Nil {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to get host cache entry: %w", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Entry{}, false, fmt.Errorf("failed to decode host cache entry: %w", err)
+	}
+	return e, true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key string, e Entry) error {
+	ttl := time.Until(e.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode host cache entry: %w", err)
+	}
+	if err := r.rdb.Set(ctx, r.prefix+"e:"+key, b, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set host cache entry: %w", err)
+	}
+	return nil
+}
+
+// acquireScript takes the lease when it is free and extends it when owner already holds it.
+var acquireScript = redis.NewScript(`if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return 1 end
+if redis.call("GET", KEYS[1]) == ARGV[1] then redis.call("PEXPIRE", KEYS[1], ARGV[2]) return 1 end
+return 0`)
+
+func (r *Redis) Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	n, err := acquireScript.Run(ctx, r.rdb, []string{r.prefix + "l:" + key}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire host lease: %w", err)
+	}
+	return n == 1, nil
+}
+
+// releaseScript deletes the lease only while owner still holds it.
+var releaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+func (r *Redis) Release(ctx context.Context, key, owner string) error {
+	if err := releaseScript.Run(ctx, r.rdb, []string{r.prefix + "l:" + key}, owner).Err(); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to release host lease: %w", err)
+	}
+	return nil
+}
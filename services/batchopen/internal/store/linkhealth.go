@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+)
+
+// CreateLinkJob inserts a queued link-health job.
+func (s *TaskStore) CreateLinkJob(ctx context.Context, j *domain.LinkJob) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO batchopen_link_job (id, user_id, status, total, checked, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, 0, $5, $5)
+    `, j.ID, j.UserID, j.Status, j.Total, j.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to insert link job: %w", err)
+	}
+	return nil
+}
+
+// FinishLinkJob records the final status, report and error of a job.
+func (s *TaskStore) FinishLinkJob(ctx context.Context, id, status string, report *domain.LinkReport, errMsg string) error {
+	var rep any
+	if report != nil {
+		b, err := json.Marshal(report)
+		if err != nil {
+			return fmt.Errorf("failed to marshal link report: %w", err)
+		}
+		rep = string(b)
+	}
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE batchopen_link_job SET status=$2, report=$3::jsonb, error=NULLIF($4,''), updated_at=now() WHERE id=$1
+    `, id, status, rep, errMsg)
+	if err != nil {
+		return fmt.Errorf("failed to finish link job: %w", err)
+	}
+	return nil
+}
+
+// MarkLinkJobRunning moves a queued job to running.
+func (s *TaskStore) MarkLinkJobRunning(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE batchopen_link_job SET status=$2, updated_at=now() WHERE id=$1 AND status=$3`, id, domain.JobRunning, domain.JobQueued)
+	return err
+}
+
+// SaveLinkCheck stores one link result and advances the job's progress counter.
+func (s *TaskStore) SaveLinkCheck(ctx context.Context, jobID, userID string, c domain.LinkCheck) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // Rollback is a no-op if the transaction is committed.
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO batchopen_link_check (job_id, offer_id, user_id, url, status, latency_ms, final_url, final_domain, chain_length, previous_domain, verdict, error, checked_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7,''), NULLIF($8,''), $9, NULLIF($10,''), $11, NULLIF($12,''), $13)
+        ON CONFLICT (job_id, offer_id) DO NOTHING
+    `, jobID, c.OfferID, userID, c.URL, c.Status, c.LatencyMs, c.FinalURL, c.FinalDomain, c.ChainLength, c.PreviousDomain, c.Verdict, c.Error, c.CheckedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to insert link check: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE batchopen_link_job SET checked=checked+1, updated_at=now() WHERE id=$1`, jobID); err != nil {
+		return fmt.Errorf("failed to update link job progress: %w", err)
+	}
+	return tx.Commit()
+}
+
+// LastFinalDomains returns, per offer, the final domain of the most recent successful check.
+func (s *TaskStore) LastFinalDomains(ctx context.Context, userID string, offerIDs []string) (map[string]string, error) {
+	out := make(map[string]string, len(offerIDs))
+	if len(offerIDs) == 0 {
+		return out, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT DISTINCT ON (offer_id) offer_id, final_domain FROM batchopen_link_check
+        WHERE user_id=$1 AND offer_id = ANY($2) AND final_domain IS NOT NULL
+        ORDER BY offer_id, checked_at DESC
+    `, userID, pq.Array(offerIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query previous link checks: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var offerID, domainName string
+		if err := rows.Scan(&offerID, &domainName); err != nil {
+			return nil, fmt.Errorf("failed to scan previous link check: %w", err)
+		}
+		out[offerID] = domainName
+	}
+	return out, rows.Err()
+}
+
+// GetLinkJob returns the job owned by userID together with its per-link results.
+func (s *TaskStore) GetLinkJob(ctx context.Context, id, userID string) (*domain.LinkJob, []domain.LinkCheck, error) {
+	var j domain.LinkJob
+	var report, errMsg sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+        SELECT id, user_id, status, total, checked, report::text, error, created_at, updated_at FROM batchopen_link_job WHERE id=$1
+    `, id).Scan(&j.ID, &j.UserID, &j.Status, &j.Total, &j.Checked, &report, &errMsg, &j.CreatedAt, &j.UpdatedAt)
+	if err == sql.ErrNoRows || (err == nil && j.UserID != userID) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query link job: %w", err)
+	}
+	j.Error = errMsg.String
+	if report.Valid {
+		var r domain.LinkReport
+		if err := json.Unmarshal([]byte(report.String), &r); err == nil {
+			j.Report = &r
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT offer_id, url, status, latency_ms, COALESCE(final_url,''), COALESCE(final_domain,''), chain_length, COALESCE(previous_domain,''), verdict, COALESCE(error,''), checked_at
+        FROM batchopen_link_check WHERE job_id=$1 ORDER BY checked_at
+    `, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query link checks: %w", err)
+	}
+	defer rows.Close()
+	checks := []domain.LinkCheck{}
+	for rows.Next() {
+		var c domain.LinkCheck
+		var checkedAt time.Time
+		if err := rows.Scan(&c.OfferID, &c.URL, &c.Status, &c.LatencyMs, &c.FinalURL, &c.FinalDomain, &c.ChainLength, &c.PreviousDomain, &c.Verdict, &c.Error, &checkedAt); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan link check: %w", err)
+		}
+		c.CheckedAt = checkedAt
+		checks = append(checks, c)
+	}
+	return &j, checks, rows.Err()
+}
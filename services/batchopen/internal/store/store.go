@@ -0,0 +1,206 @@
+// Package store persists batchopen tasks in "BatchopenTask" and records their events in the
+// event_outbox (pkg/events) within the same transaction, so a task change and its events commit together.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+)
+
+var (
+	// ErrNotFound is returned for unknown tasks and for tasks owned by another user.
+	ErrNotFound = errors.New("task not found")
+	// ErrConflict is returned when the task changed since it was read (version mismatch).
+	ErrConflict = errors.New("task version conflict")
+)
+
+// Source is the outbox source of batchopen events; its events.Relay publishes them after commit.
+const Source = "batchopen"
+
+// Event is an outbox entry; an empty Subject defaults to the task (or job) id.
+type Event = ev.OutboxEvent
+
+// TaskStore reads and writes batchopen tasks.
+type TaskStore struct {
+	db *sql.DB
+}
+
+// New returns a TaskStore backed by db.
+func New(db *sql.DB) *TaskStore {
+	return &TaskStore{db: db}
+}
+
+// Create inserts a new task together with its events.
+func (s *TaskStore) Create(ctx context.Context, t *domain.Task, events ...Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // Rollback is a no-op if the transaction is committed.
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO "BatchopenTask" (id, "userId", "offerId", status, "simulationConfig", progress, version, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5::jsonb, $6, 0, $7, $7)
+    `, t.ID, t.UserID, t.OfferID, t.Status, nullJSON(t.SimulationConfig), t.Progress, t.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to insert task: %w", err)
+	}
+	if err := enqueue(ctx, tx, t.ID, events); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	t.Version = 0
+	return nil
+}
+
+// Get returns the task when it exists and belongs to userID.
+func (s *TaskStore) Get(ctx context.Context, id, userID string) (*domain.Task, error) {
+	return get(ctx, s.db, id, userID)
+}
+
+// List returns the user's most recently updated tasks.
+func (s *TaskStore) List(ctx context.Context, userID string, limit int) ([]*domain.Task, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	rows, err := s.db.QueryContext(ctx, selectTask+` WHERE "userId"=$1 ORDER BY updated_at DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %w", err)
+	}
+	defer rows.Close()
+	var out []*domain.Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// Transition loads the task owned by userID, lets apply move it through the domain state machine
+// and persists the result with optimistic versioning. The events returned by apply are written
+// to the outbox in the same transaction. A concurrent change yields ErrConflict; an illegal
+// status change yields domain.ErrInvalidTransition and nothing is written.
+func (s *TaskStore) Transition(ctx context.Context, id, userID string, apply func(*domain.Task) ([]Event, error)) (*domain.Task, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // Rollback is a no-op if the transaction is committed.
+
+	t, err := get(ctx, tx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	version := t.Version
+	events, err := apply(t)
+	if err != nil {
+		return t, err
+	}
+	res, err := tx.ExecContext(ctx, `
+        UPDATE "BatchopenTask"
+        SET status=$1, progress=$2, result=COALESCE($3::jsonb, result), version=version+1, updated_at=$4
+        WHERE id=$5 AND "userId"=$6 AND version=$7
+    `, t.Status, t.Progress, nullJSON(t.Result), t.UpdatedAt.UTC(), t.ID, userID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update task: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrConflict
+	}
+	if err := enqueue(ctx, tx, t.ID, events); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	t.Version = version + 1
+	return t, nil
+}
+
+// Enqueue records events that are not tied to a status change (e.g. BrowserExecRequested).
+func (s *TaskStore) Enqueue(ctx context.Context, subject string, events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := enqueue(ctx, tx, subject, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+const selectTask = `SELECT id, "userId", COALESCE("offerId",''), status, COALESCE("simulationConfig"::text,''), progress, COALESCE(result::text,''), version, created_at, updated_at FROM "BatchopenTask"`
+
+func get(ctx context.Context, q querier, id, userID string) (*domain.Task, error) {
+	t, err := scanTask(q.QueryRowContext(ctx, selectTask+` WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Other users' tasks are indistinguishable from missing ones.
+	if t.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+func scanTask(row scanner) (*domain.Task, error) {
+	var t domain.Task
+	var config, result string
+	if err := row.Scan(&t.ID, &t.UserID, &t.OfferID, &t.Status, &config, &t.Progress, &result, &t.Version, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan task: %w", err)
+	}
+	if config != "" && config != "null" {
+		t.SimulationConfig = json.RawMessage(config)
+	}
+	if result != "" && result != "null" {
+		t.Result = json.RawMessage(result)
+	}
+	return &t, nil
+}
+
+func enqueue(ctx context.Context, tx *sql.Tx, subject string, events []Event) error {
+	out := make([]Event, len(events))
+	for i, e := range events {
+		if e.Subject == "" {
+			e.Subject = subject
+		}
+		out[i] = e
+	}
+	return ev.Enqueue(ctx, tx, Source, out...)
+}
+
+func nullJSON(b json.RawMessage) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
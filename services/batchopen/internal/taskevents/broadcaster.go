@@ -0,0 +1,142 @@
+// Package taskevents fans task progress out to SSE listeners. Listeners of the same task share
+// one topic: the first subscriber starts the topic's upstream (e.g. a store poller that catches
+// changes made by other instances), later ones join it, and the last one to leave stops it.
+// The in-process runner publishes into the same topic; events carrying a task version are
+// delivered once per type and version, whichever source reports them first.
+package taskevents
+
+import (
+	"context"
+	"sync"
+)
+
+// Event types streamed to clients.
+const (
+	TypeState    = "state"    // status transition: {status, version}
+	TypeProgress = "progress" // per-step progress: {step, phase, progress}
+	TypeResult   = "result"   // final outcome; closes the stream
+)
+
+// Event is one message on a task topic. Version is the task version the event reflects (0 when
+// the event is not tied to a persisted change).
+type Event struct {
+	Type    string         `json:"type"`
+	Version int            `json:"version,omitempty"`
+	Data    map[string]any `json:"data"`
+}
+
+// Upstream feeds a topic until ctx is cancelled.
+type Upstream func(ctx context.Context, emit func(Event))
+
+type topic struct {
+	subs   map[chan Event]struct{}
+	seen   map[string]int // last delivered version per event type
+	cancel context.CancelFunc
+}
+
+// Broadcaster is safe for concurrent use. The zero value is not usable; use New.
+type Broadcaster struct {
+	buffer int
+
+	mu     sync.Mutex
+	topics map[string]*topic
+}
+
+// New returns a Broadcaster whose subscriber channels hold buffer events (16 when <= 0).
+// A subscriber that falls further behind is disconnected rather than blocking the topic.
+func New(buffer int) *Broadcaster {
+	if buffer <= 0 {
+		buffer = 16
+	}
+	return &Broadcaster{buffer: buffer, topics: map[string]*topic{}}
+}
+
+// Subscribe joins the topic for key, starting upstream when the topic has no listeners yet.
+// The returned channel is closed after a TypeResult event, when the subscriber is too slow, or
+// after unsubscribe is called.
+func (b *Broadcaster) Subscribe(key string, upstream Upstream) (<-chan Event, func()) {
+	ch := make(chan Event, b.buffer)
+	b.mu.Lock()
+	t, ok := b.topics[key]
+	if !ok {
+		t = &topic{subs: map[chan Event]struct{}{}, seen: map[string]int{}}
+		b.topics[key] = t
+	}
+	t.subs[ch] = struct{}{}
+	if !ok && upstream != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.cancel = cancel
+		go upstream(ctx, func(e Event) { b.Publish(key, e) })
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() { once.Do(func() { b.leave(key, t, ch) }) }
+}
+
+// Publish delivers e to the listeners of key; it is a no-op when nobody listens.
+func (b *Broadcaster) Publish(key string, e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[key]
+	if !ok {
+		return
+	}
+	if e.Version > 0 {
+		if e.Version <= t.seen[e.Type] {
+			return
+		}
+		t.seen[e.Type] = e.Version
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- e:
+		default:
+			// slow listener: drop it so it reconnects and resyncs from the snapshot
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+	if e.Type == TypeResult {
+		for ch := range t.subs {
+			close(ch)
+		}
+		t.subs = nil
+	}
+	if len(t.subs) == 0 {
+		b.drop(key, t)
+	}
+}
+
+// Listeners returns the number of subscribers of key.
+func (b *Broadcaster) Listeners(key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.topics[key]; ok {
+		return len(t.subs)
+	}
+	return 0
+}
+
+func (b *Broadcaster) leave(key string, t *topic, ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := t.subs[ch]; !ok {
+		return // already closed by Publish
+	}
+	delete(t.subs, ch)
+	close(ch)
+	if len(t.subs) == 0 {
+		b.drop(key, t)
+	}
+}
+
+// drop removes t and stops its upstream; b.mu must be held.
+func (b *Broadcaster) drop(key string, t *topic) {
+	if b.topics[key] == t {
+		delete(b.topics, key)
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
@@ -0,0 +1,101 @@
+package taskevents
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func recv(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestSubscribersShareOneUpstream(t *testing.T) {
+	b := New(0)
+	var started, stopped int32
+	emitted := make(chan func(Event), 1)
+	upstream := func(ctx context.Context, emit func(Event)) {
+		atomic.AddInt32(&started, 1)
+		emitted <- emit
+		<-ctx.Done()
+		atomic.AddInt32(&stopped, 1)
+	}
+	a, leaveA := b.Subscribe("t1", upstream)
+	c, leaveC := b.Subscribe("t1", upstream)
+	emit := <-emitted
+
+	emit(Event{Type: TypeState, Version: 1, Data: map[string]any{"status": "running"}})
+	// the runner reports the same version; listeners see it once
+	b.Publish("t1", Event{Type: TypeState, Version: 1, Data: map[string]any{"status": "running"}})
+	b.Publish("t1", Event{Type: TypeProgress, Data: map[string]any{"step": "fetch_offer", "phase": "started"}})
+	for _, ch := range []<-chan Event{a, c} {
+		if e := recv(t, ch); e.Type != TypeState || e.Version != 1 {
+			t.Fatalf("expected state v1, got %+v", e)
+		}
+		if e := recv(t, ch); e.Type != TypeProgress {
+			t.Fatalf("expected progress, got %+v", e)
+		}
+	}
+	if n := atomic.LoadInt32(&started); n != 1 {
+		t.Fatalf("expected one upstream, got %d", n)
+	}
+
+	leaveA()
+	if atomic.LoadInt32(&stopped) != 0 {
+		t.Fatal("upstream stopped while a listener remains")
+	}
+	leaveC()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&stopped) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&stopped) != 1 || b.Listeners("t1") != 0 {
+		t.Fatal("expected upstream to stop after the last listener left")
+	}
+}
+
+func TestResultClosesTopic(t *testing.T) {
+	b := New(0)
+	ch, leave := b.Subscribe("t2", nil)
+	defer leave()
+	b.Publish("t2", Event{Type: TypeResult, Version: 3, Data: map[string]any{"status": "completed"}})
+	if e := recv(t, ch); e.Type != TypeResult {
+		t.Fatalf("expected result, got %+v", e)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected channel to close after the result")
+	}
+	if b.Listeners("t2") != 0 {
+		t.Fatal("expected topic to be removed")
+	}
+}
+
+func TestSlowListenerIsDropped(t *testing.T) {
+	b := New(2)
+	slow, leaveSlow := b.Subscribe("t3", nil)
+	defer leaveSlow()
+	fast, leaveFast := b.Subscribe("t3", nil)
+	defer leaveFast()
+	for i := 1; i <= 3; i++ {
+		b.Publish("t3", Event{Type: TypeProgress, Version: i})
+		recv(t, fast)
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != 2 || b.Listeners("t3") != 1 {
+		t.Fatalf("expected slow listener dropped after 2 buffered events, got %d events, %d listeners", n, b.Listeners("t3"))
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    stderrors "errors"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/google/uuid"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    httpx "github.com/xxrenzhe/autoads/pkg/http"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/hostcache"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/store"
+)
+
+// Link-health jobs resolve every selected offer URL through browser-exec (redirect chain included),
+// record status/latency/final domain per link and report dead, slow or redirect-changed links.
+// Verdicts are pushed to the offer service so broken offers surface in offer status.
+
+type linkHealthRequest struct {
+    // OfferIDs selects offers to check; empty means all of the user's non-archived offers.
+    OfferIDs []string `json:"offerIds"`
+}
+
+type offerRef struct {
+    ID          string `json:"id"`
+    OriginalUrl string `json:"originalUrl"`
+    Status      string `json:"status"`
+}
+
+// linkResolution is the cached outcome of resolving one URL (JSON shape stored in the host cache).
+type linkResolution struct {
+    Status      int    `json:"status"`
+    FinalURL    string `json:"finalUrl,omitempty"`
+    Domain      string `json:"domain,omitempty"`
+    ChainLength int    `json:"chainLength"`
+    LatencyMs   int64  `json:"latencyMs"`
+    Error       string `json:"error,omitempty"`
+    // Inconclusive marks failures of browser-exec itself (overload, circuit open, auth).
+    Inconclusive bool `json:"-"`
+}
+
+var metricLinkChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "batchopen_link_checks_total",
+    Help: "Link-health checks by verdict",
+}, []string{"verdict"})
+
+func init() { _ = prometheus.Register(metricLinkChecks) }
+
+func envInt(key string, def, min, max int) int {
+    if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= min && n <= max { return n }
+    }
+    return def
+}
+
+// POST /api/v1/batchopen/link-health
+func createLinkHealthHandler(tasks *store.TaskStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if tasks == nil { errors.Write(w, r, http.StatusInternalServerError, "SERVER_NOT_CONFIGURED", "DATABASE_URL not set", nil); return }
+        uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+        if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated", nil); return }
+        var req linkHealthRequest
+        if r.ContentLength != 0 {
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid request body", nil); return }
+        }
+        offers, err := fetchOffers(r.Context(), r.Header)
+        if err != nil { errors.Write(w, r, http.StatusBadGateway, "UPSTREAM", "offer service unavailable", map[string]string{"error": err.Error()}); return }
+        selected, missing := selectOffers(offers, req.OfferIDs)
+        if len(missing) > 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "unknown offers", map[string]any{"offerIds": missing}); return }
+        if len(selected) == 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "no offers to check", nil); return }
+        if max := envInt("BATCHOPEN_LINK_HEALTH_MAX", 500, 1, 5000); len(selected) > max {
+            errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "too many offers", map[string]int{"max": max, "requested": len(selected)}); return
+        }
+        job := &domain.LinkJob{ID: uuid.New().String(), UserID: uid, Status: domain.JobQueued, Total: len(selected), CreatedAt: time.Now()}
+        if err := tasks.CreateLinkJob(r.Context(), job); err != nil {
+            log.Printf("batchopen: create link job failed: %v", err)
+            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "failed to create job", nil); return
+        }
+        writeJSON(w, http.StatusAccepted, map[string]any{"jobId": job.ID, "status": job.Status, "total": job.Total, "createdAt": job.CreatedAt.UTC()})
+        go runLinkHealth(tasks, job, selected)
+    }
+}
+
+// GET /api/v1/batchopen/link-health/{id}
+func getLinkHealthHandler(tasks *store.TaskStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if tasks == nil { errors.Write(w, r, http.StatusInternalServerError, "SERVER_NOT_CONFIGURED", "DATABASE_URL not set", nil); return }
+        uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+        job, links, err := tasks.GetLinkJob(r.Context(), chi.URLParam(r, "id"), uid)
+        if stderrors.Is(err, store.ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "job not found", nil); return }
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", nil); return }
+        writeJSON(w, http.StatusOK, map[string]any{"job": job, "links": links})
+    }
+}
+
+func selectOffers(offers []offerRef, ids []string) ([]offerRef, []string) {
+    if len(ids) == 0 {
+        out := make([]offerRef, 0, len(offers))
+        for _, o := range offers {
+            if o.Status == "archived" || strings.TrimSpace(o.OriginalUrl) == "" { continue }
+            out = append(out, o)
+        }
+        return out, nil
+    }
+    byID := make(map[string]offerRef, len(offers))
+    for _, o := range offers { byID[o.ID] = o }
+    var out []offerRef
+    var missing []string
+    seen := map[string]bool{}
+    for _, id := range ids {
+        id = strings.TrimSpace(id)
+        if id == "" || seen[id] { continue }
+        seen[id] = true
+        if o, ok := byID[id]; ok && strings.TrimSpace(o.OriginalUrl) != "" { out = append(out, o) } else { missing = append(missing, id) }
+    }
+    return out, missing
+}
+
+// forwardedAuthHeaders carry the caller's credentials to the offer service, which authenticates
+// the listing itself instead of trusting an identity asserted by batchopen.
+var forwardedAuthHeaders = []string{"Authorization", "X-Endpoint-API-UserInfo", "X-User-Id", middleware.OrgHeader}
+
+// fetchOffers lists the caller's offers from the offer service with the caller's own auth headers.
+func fetchOffers(ctx context.Context, caller http.Header) ([]offerRef, error) {
+    base := strings.TrimRight(os.Getenv("OFFER_SERVICE_URL"), "/")
+    if base == "" { return nil, stderrors.New("OFFER_SERVICE_URL not set") }
+    hdr := map[string]string{"Accept": "application/json"}
+    for _, k := range forwardedAuthHeaders {
+        if v := caller.Get(k); v != "" { hdr[k] = v }
+    }
+    var out []offerRef
+    if err := httpx.New(5*time.Second).DoJSON(ctx, http.MethodGet, base+"/api/v1/offers", nil, hdr, 1, &out); err != nil { return nil, err }
+    return out, nil
+}
+
+func runLinkHealth(tasks *store.TaskStore, job *domain.LinkJob, offers []offerRef) {
+    ctx := context.Background()
+    if err := tasks.MarkLinkJobRunning(ctx, job.ID); err != nil { log.Printf("batchopen: link job %s: %v", job.ID, err) }
+    ids := make([]string, len(offers))
+    for i, o := range offers { ids[i] = o.ID }
+    prev, err := tasks.LastFinalDomains(ctx, job.UserID, ids)
+    if err != nil {
+        log.Printf("batchopen: link job %s: %v", job.ID, err)
+        _ = tasks.FinishLinkJob(ctx, job.ID, domain.JobFailed, nil, "previous results unavailable")
+        return
+    }
+    slow := time.Duration(envInt("BATCHOPEN_LINK_SLOW_MS", 5000, 500, 60000)) * time.Millisecond
+    workers := envInt("BATCHOPEN_LINK_HEALTH_WORKERS", 4, 1, 32)
+
+    checks := make([]domain.LinkCheck, len(offers))
+    var next int64 = -1
+    var wg sync.WaitGroup
+    for i := 0; i < workers && i < len(offers); i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                k := int(atomic.AddInt64(&next, 1))
+                if k >= len(offers) { return }
+                c := checkLink(ctx, offers[k], prev[offers[k].ID], slow)
+                metricLinkChecks.WithLabelValues(c.Verdict).Inc()
+                if err := tasks.SaveLinkCheck(ctx, job.ID, job.UserID, c); err != nil { log.Printf("batchopen: link job %s: %v", job.ID, err) }
+                checks[k] = c
+            }
+        }()
+    }
+    wg.Wait()
+
+    report := domain.Summarize(checks)
+    if err := tasks.FinishLinkJob(ctx, job.ID, domain.JobCompleted, &report, ""); err != nil { log.Printf("batchopen: link job %s: %v", job.ID, err) }
+    if err := pushOfferLinkHealth(ctx, job, checks); err != nil { log.Printf("batchopen: link job %s: offer feed failed: %v", job.ID, err) }
+}
+
+// checkLink resolves one offer URL and classifies it against the previous final domain.
+func checkLink(ctx context.Context, o offerRef, prevDomain string, slow time.Duration) domain.LinkCheck {
+    res := resolveLink(ctx, strings.TrimSpace(o.OriginalUrl))
+    c := domain.LinkCheck{
+        OfferID: o.ID, URL: o.OriginalUrl, Status: res.Status, LatencyMs: res.LatencyMs,
+        FinalURL: res.FinalURL, FinalDomain: res.Domain, ChainLength: res.ChainLength,
+        PreviousDomain: prevDomain, Error: res.Error, CheckedAt: time.Now().UTC(),
+    }
+    if res.Inconclusive {
+        c.Verdict = domain.LinkUnknown
+        return c
+    }
+    c.Classify(slow)
+    return c
+}
+
+// resolveLink follows the redirect chain via browser-exec resolve-offer. Results share the host
+// cache with availability checks, keyed by the full URL, so parallel jobs resolve a URL once.
+func resolveLink(ctx context.Context, url string) linkResolution {
+    if !browserExec().Configured() || url == "" { return linkResolution{Error: "missing_browser_exec_or_url", Inconclusive: true} }
+    v, _, err := hostCache.Do(ctx, "resolve|"+url, func(ctx context.Context) (hostcache.Value, time.Duration, error) {
+        acquire()
+        atomic.AddInt32(&inflightCur, 1)
+        metricInflight.Inc()
+        defer release()
+        defer metricInflight.Dec()
+        defer atomic.AddInt32(&inflightCur, -1)
+
+        start := time.Now()
+        rr, err := browserExec().ResolveOffer(ctx, browserexec.ResolveOfferRequest{URL: url, WaitUntil: "domcontentloaded", TimeoutMs: 30000})
+        out := linkResolution{LatencyMs: time.Since(start).Milliseconds()}
+        if err != nil {
+            var be *browserexec.Error
+            // 502/504 come from the target (unreachable, timeout); anything else is browser-exec trouble
+            // and goes back to every waiter as an error instead of a cached verdict
+            if !stderrors.As(err, &be) || (be.StatusCode != http.StatusBadGateway && be.StatusCode != http.StatusGatewayTimeout) {
+                return hostcache.Value{}, 0, err
+            }
+            out.Error = err.Error()
+        } else {
+            out.Status, out.FinalURL, out.Domain, out.ChainLength = rr.Status, rr.FinalUrl, rr.Domain, rr.ChainLength
+            if !rr.Ok && out.Status == 0 { out.Error = "resolve_not_ok" }
+        }
+        var m map[string]any
+        b, _ := json.Marshal(out)
+        _ = json.Unmarshal(b, &m)
+        ttl := time.Duration(envInt("BATCHOPEN_LINK_CACHE_MS", 300000, 1000, 3600000)) * time.Millisecond
+        return hostcache.Value{OK: err == nil && rr.Ok, Result: m}, ttl, nil
+    })
+    if err != nil { return linkResolution{Error: err.Error(), Inconclusive: true} }
+    var out linkResolution
+    b, _ := json.Marshal(v.Result)
+    _ = json.Unmarshal(b, &out)
+    return out
+}
+
+// pushOfferLinkHealth feeds conclusive verdicts to the offer service (internal endpoint).
+func pushOfferLinkHealth(ctx context.Context, job *domain.LinkJob, checks []domain.LinkCheck) error {
+    base := strings.TrimRight(os.Getenv("OFFER_SERVICE_URL"), "/")
+    token := strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN"))
+    if base == "" || token == "" { return nil }
+    items := make([]map[string]any, 0, len(checks))
+    for _, c := range checks {
+        if c.Verdict == domain.LinkUnknown || c.OfferID == "" { continue }
+        items = append(items, map[string]any{"offerId": c.OfferID, "verdict": c.Verdict, "finalDomain": c.FinalDomain, "checkedAt": c.CheckedAt})
+    }
+    if len(items) == 0 { return nil }
+    hdr := map[string]string{"Content-Type": "application/json", "X-Service-Token": token}
+    body := map[string]any{"userId": job.UserID, "jobId": job.ID, "items": items}
+    return httpx.New(10*time.Second).DoJSON(ctx, http.MethodPost, base+"/api/v1/offers/internal/link-health", body, hdr, 2, nil)
+}
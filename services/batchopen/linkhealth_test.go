@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xxrenzhe/autoads/pkg/browserexec"
+	"github.com/xxrenzhe/autoads/pkg/browserexec/browserexectest"
+	"github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+	"github.com/xxrenzhe/autoads/services/batchopen/internal/hostcache"
+)
+
+func TestCheckLinkVerdicts(t *testing.T) {
+	fake := browserexectest.NewServer()
+	defer fake.Close()
+	beOnce.Do(func() {})
+	beClient = fake.Client(browserexec.WithPolicy(browserexec.EndpointResolveOffer, browserexec.Policy{Timeout: time.Second}))
+	hostCache = hostcache.New(nil, hostcache.Options{})
+
+	ctx := context.Background()
+	ok := checkLink(ctx, offerRef{ID: "o1", OriginalUrl: "https://shop.example.com/p?aff=1"}, "example.com", time.Minute)
+	if ok.Verdict != domain.LinkOK || ok.FinalDomain != "shop.example.com" || ok.ChainLength != 1 {
+		t.Fatalf("expected ok link, got %+v", ok)
+	}
+
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.OK(browserexec.ResolveOfferResult{Ok: true, Status: 200, FinalUrl: "https://parked.net/", Domain: "parked.net", ChainLength: 3}))
+	moved := checkLink(ctx, offerRef{ID: "o2", OriginalUrl: "https://go.example.com/r/2"}, "example.com", time.Minute)
+	if moved.Verdict != domain.LinkRedirectChanged {
+		t.Fatalf("expected redirect_changed, got %+v", moved)
+	}
+
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(http.StatusBadGateway, "RESOLVE_FAILED", "net::ERR_NAME_NOT_RESOLVED"))
+	dead := checkLink(ctx, offerRef{ID: "o3", OriginalUrl: "https://gone.example.org/"}, "", time.Minute)
+	if dead.Verdict != domain.LinkDead || dead.Error == "" {
+		t.Fatalf("expected dead link, got %+v", dead)
+	}
+
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(http.StatusUnauthorized, "UNAUTHORIZED", "internal token required"))
+	unknown := checkLink(ctx, offerRef{ID: "o4", OriginalUrl: "https://other.example.org/"}, "", time.Minute)
+	if unknown.Verdict != domain.LinkUnknown {
+		t.Fatalf("browser-exec failure must not mark the link dead, got %+v", unknown)
+	}
+
+	// same URL again is served from the cache without calling browser-exec
+	before := len(fake.Calls(browserexec.EndpointResolveOffer))
+	again := checkLink(ctx, offerRef{ID: "o1", OriginalUrl: "https://shop.example.com/p?aff=1"}, "example.com", time.Minute)
+	if again.Verdict != domain.LinkOK || len(fake.Calls(browserexec.EndpointResolveOffer)) != before {
+		t.Fatalf("expected cached resolution, got %+v", again)
+	}
+}
+
+func TestSelectOffers(t *testing.T) {
+	offers := []offerRef{{ID: "a", OriginalUrl: "https://a.example"}, {ID: "b", OriginalUrl: "https://b.example", Status: "archived"}, {ID: "c"}}
+	all, _ := selectOffers(offers, nil)
+	if len(all) != 1 || all[0].ID != "a" {
+		t.Fatalf("expected only active offers with URLs, got %+v", all)
+	}
+	picked, missing := selectOffers(offers, []string{"b", "x", "b"})
+	if len(picked) != 1 || picked[0].ID != "b" || len(missing) != 1 || missing[0] != "x" {
+		t.Fatalf("unexpected selection: %+v missing=%v", picked, missing)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+    "bytes"
     "context"
     "encoding/json"
+    stderrors "errors"
     "log"
     "net/http"
     "os"
@@ -25,6 +27,12 @@ import (
     "github.com/prometheus/client_golang/prometheus"
     "sync/atomic"
     httpx "github.com/xxrenzhe/autoads/pkg/http"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+    "github.com/xxrenzhe/autoads/pkg/saga"
+    "github.com/go-redis/redis/v8"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/hostcache"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/store"
 )
 
 type createTaskRequest struct {
@@ -47,26 +55,31 @@ func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 func health(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK); _, _ = w.Write([]byte("OK")) }
 func ready(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK); _, _ = w.Write([]byte("ready")) }
 func stats(w http.ResponseWriter, r *http.Request) {
-    hit := atomic.LoadInt64(&cacheHits)
-    miss := atomic.LoadInt64(&cacheMiss)
-    total := hit + miss
+    cs := hostCache.Stats()
+    total := cs.Hits + cs.Misses
     var hitRate int
-    if total > 0 { hitRate = int((hit * 100) / total) }
+    if total > 0 { hitRate = int((cs.Hits * 100) / total) }
     // request/error counters are Prometheus-only here; keep JSON minimal
     writeJSON(w, http.StatusOK, map[string]any{
         "inflight": atomic.LoadInt32(&inflightCur),
-        "cacheHits": hit,
-        "cacheMiss": miss,
+        "cacheHits": cs.Hits,
+        "cacheMiss": cs.Misses,
         "cacheHitRate": hitRate, // percent
+        "cacheCoalesced": cs.Coalesced,
+        "cacheRemoteWaits": cs.RemoteWaits,
+        "cacheLeaderErrors": cs.LeaderErrors,
+        "cacheBackendErrors": cs.BackendErrs,
+        "cacheBackend": cs.Backend,
     })
 }
 
-func createTaskHandler(pub *ev.Publisher) http.HandlerFunc {
+func createTaskHandler(tasks *store.TaskStore) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil)
         return
     }
+    if tasks == nil { errors.Write(w, r, http.StatusInternalServerError, "SERVER_NOT_CONFIGURED", "DATABASE_URL not set", nil); return }
     uid, _ := r.Context().Value(middleware.UserIDKey).(string)
     var req createTaskRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -77,101 +90,197 @@ func createTaskHandler(pub *ev.Publisher) http.HandlerFunc {
         errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "offerId is required", nil)
         return
     }
-    resp := createTaskResponse{
-        TaskID:    uuid.New().String(),
-        Status:    "queued",
-        CreatedAt: time.Now(),
-    }
-    // Publish event (best-effort)
-    if pub != nil {
-        _ = pub.Publish(r.Context(), ev.EventBatchOpsTaskQueued, map[string]any{
-            "taskId":   resp.TaskID,
-            "offerId":  req.OfferID,
-            "userId":   uid,
-            "queuedAt": resp.CreatedAt.UTC().Format(time.RFC3339),
-        }, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
+    var cfg json.RawMessage
+    if req.SimulationConfig != nil { cfg, _ = json.Marshal(req.SimulationConfig) }
+    t := domain.NewTask(uuid.New().String(), uid, req.OfferID, cfg)
+    // Task row and BatchOpsTaskQueued commit together; the outbox relay publishes afterwards.
+    queued := store.Event{Type: ev.EventBatchOpsTaskQueued, Data: map[string]any{
+        "taskId":   t.ID,
+        "offerId":  t.OfferID,
+        "userId":   uid,
+        "queuedAt": t.CreatedAt.UTC().Format(time.RFC3339),
+    }}
+    if err := tasks.Create(r.Context(), t, queued); err != nil {
+        log.Printf("batchopen: create task failed: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "failed to create task", nil)
+        return
     }
+    resp := createTaskResponse{TaskID: t.ID, Status: t.Status, CreatedAt: t.CreatedAt}
     // Firestore UI cache (best-effort)
     _ = writeTaskUI(r.Context(), uid, resp.TaskID, req.OfferID, resp.Status, resp.CreatedAt)
     writeJSON(w, http.StatusAccepted, resp)
 
     // Background execution via Browser-Exec (best-effort)
-    go func() {
-        ctx := context.Background()
-        // 1) reserve tokens
-        _ = billingAction(ctx, uid, "reserve", resp.TaskID)
-        // 2) fetch offer url
-        url := fetchOfferURL(ctx, req.OfferID, uid)
-        if url == "" {
-            _ = updateTaskUI(ctx, uid, resp.TaskID, map[string]any{"status": "failed", "error": "offer_url_not_found"})
-            if pub != nil { _ = pub.Publish(ctx, ev.EventBatchOpsTaskFailed, map[string]any{"taskId": resp.TaskID, "userId": uid, "failedAt": time.Now().UTC().Format(time.RFC3339), "reason": "offer_url_not_found"}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID)) }
-            _ = billingAction(ctx, uid, "release", resp.TaskID)
+    go runTask(tasks, t.ID, t.OfferID, uid, middleware.OrgIDFrom(r.Context()))
+  }
+}
+
+// runTask drives a freshly queued task through running -> completed|failed. Every status change
+// goes through the store, so a concurrent manual action wins and this run stops quietly.
+// Transitions and per-step progress are streamed to /tasks/{id}/events listeners. orgID, when set,
+// names the organization wallet that pays for the task.
+func runTask(tasks *store.TaskStore, taskID, offerID, uid, orgID string) {
+    ctx := middleware.WithOrgID(context.Background(), orgID)
+    t, err := startTask(ctx, tasks, taskID, uid, -1)
+    if err != nil {
+        log.Printf("batchopen: task %s not started: %v", taskID, err)
+        return
+    }
+    publishTransition(t)
+    // 1) reserve tokens
+    stepStarted(taskID, uid, stepReserve)
+    if be := startBilling(ctx, taskID, uid); be != nil {
+        reason := strings.ToLower(be.Code)
+        if reason == "" { reason = "billing_rejected" }
+        stepFailed(taskID, uid, stepReserve, reason)
+        t, err := failTask(ctx, tasks, taskID, uid, -1, map[string]any{"reason": reason})
+        if err != nil { log.Printf("batchopen: task %s fail: %v", taskID, err) } else { publishTransition(t) }
+        _ = updateTaskUI(ctx, uid, taskID, map[string]any{"status": "failed", "error": reason})
+        return
+    }
+    stepDone(ctx, tasks, taskID, uid, stepReserve, nil)
+    // 2) fetch offer url
+    stepStarted(taskID, uid, stepFetchOffer)
+    url := fetchOfferURL(ctx, offerID, uid)
+    if url == "" {
+        stepFailed(taskID, uid, stepFetchOffer, "offer_url_not_found")
+        t, err := failTask(ctx, tasks, taskID, uid, -1, map[string]any{"reason": "offer_url_not_found"})
+        if err != nil { log.Printf("batchopen: task %s fail: %v", taskID, err) } else { publishTransition(t) }
+        _ = updateTaskUI(ctx, uid, taskID, map[string]any{"status": "failed", "error": "offer_url_not_found"})
+        settleBilling(ctx, taskID, ev.EventBatchOpsTaskFailed)
+        return
+    }
+    stepDone(ctx, tasks, taskID, uid, stepFetchOffer, map[string]any{"url": url})
+    // 3) call browser-exec
+    // announce browser exec request
+    stepStarted(taskID, uid, stepBrowserCheck)
+    _ = tasks.Enqueue(ctx, taskID, store.Event{Type: ev.EventBrowserExecRequested, Data: map[string]any{"taskId": taskID, "userId": uid, "url": url, "requestedAt": time.Now().UTC().Format(time.RFC3339)}})
+    ok, beRes := browserExecCheckWithRetry(ctx, url)
+    stepDone(ctx, tasks, taskID, uid, stepBrowserCheck, map[string]any{"ok": ok, "status": beRes["status"]})
+    // compute simple quality score
+    stepStarted(taskID, uid, stepQuality)
+    qScore, qFactors := computeQuality(beRes)
+    quality := map[string]any{"score": qScore, "factors": qFactors}
+    stepDone(ctx, tasks, taskID, uid, stepQuality, map[string]any{"quality": qScore})
+    execDone := store.Event{Type: ev.EventBrowserExecCompleted, Data: map[string]any{"taskId": taskID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "ok": ok, "quality": qScore}}
+    if ok {
+        t, err := completeTask(ctx, tasks, taskID, uid, -1, map[string]any{"result": beRes, "quality": qScore}, execDone)
+        if err != nil {
+            log.Printf("batchopen: task %s complete: %v", taskID, err)
+            settleBilling(ctx, taskID, ev.EventBatchOpsTaskFailed)
             return
         }
-        // 3) call browser-exec
-        // announce browser exec request
-        if pub != nil {
-            _ = pub.Publish(ctx, ev.EventBrowserExecRequested, map[string]any{"taskId": resp.TaskID, "userId": uid, "url": url, "requestedAt": time.Now().UTC().Format(time.RFC3339)}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
-        }
-        ok, beRes := browserExecCheckWithRetry(ctx, url)
-        if ok {
-            // compute simple quality score
-            qScore, qFactors := computeQuality(beRes)
-            _ = updateTaskUI(ctx, uid, resp.TaskID, map[string]any{"status": "completed", "result": beRes, "quality": map[string]any{"score": qScore, "factors": qFactors}})
-            if pub != nil {
-                _ = pub.Publish(ctx, ev.EventBrowserExecCompleted, map[string]any{"taskId": resp.TaskID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "ok": true, "quality": qScore}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
-                _ = pub.Publish(ctx, ev.EventBatchOpsTaskCompleted, map[string]any{"taskId": resp.TaskID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "result": beRes, "quality": qScore}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
-            }
-            _ = billingAction(ctx, uid, "commit", resp.TaskID)
-        } else {
-            qScore, qFactors := computeQuality(beRes)
-            _ = updateTaskUI(ctx, uid, resp.TaskID, map[string]any{"status": "failed", "result": beRes, "quality": map[string]any{"score": qScore, "factors": qFactors}})
-            if pub != nil {
-                _ = pub.Publish(ctx, ev.EventBrowserExecCompleted, map[string]any{"taskId": resp.TaskID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "ok": false, "quality": qScore}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
-                _ = pub.Publish(ctx, ev.EventBatchOpsTaskFailed, map[string]any{"taskId": resp.TaskID, "userId": uid, "failedAt": time.Now().UTC().Format(time.RFC3339), "reason": beRes["error"]}, ev.WithSource("batchopen"), ev.WithSubject(resp.TaskID))
-            }
-            _ = billingAction(ctx, uid, "release", resp.TaskID)
-        }
-    }()
-  }
+        publishTransition(t)
+        _ = updateTaskUI(ctx, uid, taskID, map[string]any{"status": "completed", "result": beRes, "quality": quality})
+        settleBilling(ctx, taskID, ev.EventBatchOpsTaskCompleted)
+    } else {
+        reason, _ := beRes["error"].(string)
+        t, err := failTask(ctx, tasks, taskID, uid, -1, map[string]any{"reason": reason, "result": beRes, "quality": qScore}, execDone)
+        if err != nil { log.Printf("batchopen: task %s fail: %v", taskID, err) } else { publishTransition(t) }
+        _ = updateTaskUI(ctx, uid, taskID, map[string]any{"status": "failed", "result": beRes, "quality": quality})
+        settleBilling(ctx, taskID, ev.EventBatchOpsTaskFailed)
+    }
 }
 
-// taskActionHandler supports /api/v1/batchopen/tasks/{id}/start|complete|fail
-func taskActionHandler(pub *ev.Publisher) http.HandlerFunc {
+// startTask, completeTask and failTask apply one domain transition for the owner and enqueue the
+// matching BatchOps event (plus extra) in the same transaction. expect >= 0 pins the version the
+// caller last saw; -1 accepts the current one.
+func startTask(ctx context.Context, tasks *store.TaskStore, taskID, uid string, expect int, extra ...store.Event) (*domain.Task, error) {
+    return tasks.Transition(ctx, taskID, uid, func(t *domain.Task) ([]store.Event, error) {
+        if expect >= 0 && t.Version != expect { return nil, store.ErrConflict }
+        if err := t.Start(); err != nil { return nil, err }
+        e := store.Event{Type: ev.EventBatchOpsTaskStarted, Data: map[string]any{"taskId": t.ID, "userId": uid, "startedAt": t.UpdatedAt.UTC().Format(time.RFC3339)}}
+        return append([]store.Event{e}, extra...), nil
+    })
+}
+
+func completeTask(ctx context.Context, tasks *store.TaskStore, taskID, uid string, expect int, data map[string]any, extra ...store.Event) (*domain.Task, error) {
+    return tasks.Transition(ctx, taskID, uid, func(t *domain.Task) ([]store.Event, error) {
+        if expect >= 0 && t.Version != expect { return nil, store.ErrConflict }
+        if err := t.Complete(); err != nil { return nil, err }
+        if v, ok := data["result"]; ok && v != nil { t.Result, _ = json.Marshal(v) }
+        payload := map[string]any{"taskId": t.ID, "userId": uid, "completedAt": t.UpdatedAt.UTC().Format(time.RFC3339)}
+        for k, v := range data { payload[k] = v }
+        e := store.Event{Type: ev.EventBatchOpsTaskCompleted, Data: payload}
+        return append([]store.Event{e}, extra...), nil
+    })
+}
+
+func failTask(ctx context.Context, tasks *store.TaskStore, taskID, uid string, expect int, data map[string]any, extra ...store.Event) (*domain.Task, error) {
+    return tasks.Transition(ctx, taskID, uid, func(t *domain.Task) ([]store.Event, error) {
+        if expect >= 0 && t.Version != expect { return nil, store.ErrConflict }
+        if err := t.Fail(); err != nil { return nil, err }
+        res := map[string]any{"reason": data["reason"]}
+        if v, ok := data["result"]; ok && v != nil { res["result"] = v }
+        t.Result, _ = json.Marshal(res)
+        payload := map[string]any{"taskId": t.ID, "userId": uid, "failedAt": t.UpdatedAt.UTC().Format(time.RFC3339)}
+        for k, v := range data { payload[k] = v }
+        e := store.Event{Type: ev.EventBatchOpsTaskFailed, Data: payload}
+        return append([]store.Event{e}, extra...), nil
+    })
+}
+
+// taskActionHandler supports /api/v1/batchopen/tasks/{id}/start|complete|fail.
+// Only the owner may act on a task; an optional If-Match header carries the expected version.
+func taskActionHandler(tasks *store.TaskStore) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+        if tasks == nil { errors.Write(w, r, http.StatusInternalServerError, "SERVER_NOT_CONFIGURED", "DATABASE_URL not set", nil); return }
         uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+        if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated", nil); return }
         // path parsing
         p := strings.TrimPrefix(r.URL.Path, "/api/v1/batchopen/tasks/")
         seg := strings.Split(p, "/")
         if len(seg) < 2 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "taskId and action required", nil); return }
         taskID, action := strings.TrimSpace(seg[0]), strings.TrimSpace(seg[1])
         if taskID == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "taskId required", nil); return }
+        expect := -1
+        if v := strings.Trim(strings.TrimSpace(r.Header.Get("If-Match")), `"`); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "If-Match must be a task version", nil); return }
+            expect = n
+        }
         now := time.Now().UTC()
+        var (
+            t   *domain.Task
+            err error
+        )
         switch action {
         case "start":
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventBatchOpsTaskStarted, map[string]any{"taskId": taskID, "userId": uid, "startedAt": now.Format(time.RFC3339)}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventWorkflowStarted, map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "startedAt": now.Format(time.RFC3339)}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            _ = writeTaskUI(r.Context(), uid, taskID, "", "running", now)
-            _ = billingAction(r.Context(), uid, "reserve", taskID)
-            writeJSON(w, http.StatusOK, map[string]any{"taskId": taskID, "status": "running"})
+            t, err = startTask(r.Context(), tasks, taskID, uid, expect,
+                store.Event{Type: ev.EventWorkflowStarted, Data: map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "startedAt": now.Format(time.RFC3339)}})
         case "complete":
             var body map[string]any; _ = json.NewDecoder(r.Body).Decode(&body)
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventBatchOpsTaskCompleted, map[string]any{"taskId": taskID, "userId": uid, "completedAt": now.Format(time.RFC3339), "result": body}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventWorkflowCompleted, map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "completedAt": now.Format(time.RFC3339)}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            _ = writeTaskUI(r.Context(), uid, taskID, "", "completed", now)
-            _ = billingAction(r.Context(), uid, "commit", taskID)
-            writeJSON(w, http.StatusOK, map[string]any{"taskId": taskID, "status": "completed"})
+            t, err = completeTask(r.Context(), tasks, taskID, uid, expect, map[string]any{"result": body},
+                store.Event{Type: ev.EventWorkflowCompleted, Data: map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "completedAt": now.Format(time.RFC3339)}})
         case "fail":
             var body struct{ Reason string `json:"reason"` }; _ = json.NewDecoder(r.Body).Decode(&body)
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventBatchOpsTaskFailed, map[string]any{"taskId": taskID, "userId": uid, "failedAt": now.Format(time.RFC3339), "reason": body.Reason}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            if pub != nil { _ = pub.Publish(r.Context(), ev.EventWorkflowStepCompleted, map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "step": "fail", "time": now.Format(time.RFC3339), "status": "failed"}, ev.WithSource("batchopen"), ev.WithSubject(taskID)) }
-            _ = writeTaskUI(r.Context(), uid, taskID, "", "failed", now)
-            _ = billingAction(r.Context(), uid, "release", taskID)
-            writeJSON(w, http.StatusOK, map[string]any{"taskId": taskID, "status": "failed"})
+            t, err = failTask(r.Context(), tasks, taskID, uid, expect, map[string]any{"reason": body.Reason},
+                store.Event{Type: ev.EventWorkflowStepCompleted, Data: map[string]any{"workflow": "batchopen", "taskId": taskID, "userId": uid, "step": "fail", "time": now.Format(time.RFC3339), "status": "failed"}})
         default:
             errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "unknown action", map[string]string{"action": action})
+            return
+        }
+        switch {
+        case err == nil:
+        case stderrors.Is(err, store.ErrNotFound):
+            errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "task not found", nil); return
+        case stderrors.Is(err, store.ErrConflict):
+            errors.Write(w, r, http.StatusConflict, "CONFLICT", "task was modified concurrently", map[string]any{"expectedVersion": expect}); return
+        case stderrors.Is(err, domain.ErrInvalidTransition):
+            errors.Write(w, r, http.StatusConflict, "INVALID_STATE", "action not allowed in current status", map[string]any{"status": t.Status, "action": action}); return
+        default:
+            log.Printf("batchopen: task %s %s failed: %v", taskID, action, err)
+            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "task update failed", nil); return
         }
+        publishTransition(t)
+        _ = updateTaskUI(r.Context(), uid, taskID, map[string]any{"status": t.Status})
+        switch action {
+        case "start": startBilling(r.Context(), taskID, uid)
+        case "complete": settleBilling(r.Context(), taskID, ev.EventBatchOpsTaskCompleted)
+        case "fail": settleBilling(r.Context(), taskID, ev.EventBatchOpsTaskFailed)
+        }
+        writeJSON(w, http.StatusOK, map[string]any{"taskId": taskID, "status": t.Status, "version": t.Version})
     }
 }
 
@@ -181,6 +290,32 @@ func main() {
     // unified auth via pkg/middleware.AuthMiddleware
     var pub *ev.Publisher
     if p, err := ev.NewPublisher(ctx); err == nil { pub = p; defer p.Close() }
+    // batchopen owns "BatchopenTask"; events leave through the event_outbox (pkg/events)
+    var tasks *store.TaskStore
+    var db *sql.DB
+    if dsn := strings.TrimSpace(os.Getenv("DATABASE_URL")); dsn != "" {
+        var err error
+        db, err = sql.Open("postgres", dsn)
+        if err != nil { log.Fatalf("db open failed: %v", err) }
+        defer db.Close()
+        tasks = store.New(db)
+        if err := ev.EnsureOutbox(ctx, db); err != nil { log.Printf("batchopen: outbox schema: %v", err) }
+        relay := &ev.Relay{DB: db, Pub: pub, Source: store.Source, Interval: time.Second}
+        if v := strings.TrimSpace(os.Getenv("BATCHOPEN_OUTBOX_INTERVAL_MS")); v != "" {
+            if n, err := strconv.Atoi(v); err == nil && n >= 100 && n <= 60000 { relay.Interval = time.Duration(n) * time.Millisecond }
+        }
+        // without Pub/Sub the events stay in the outbox until a publisher is configured
+        if pub != nil { go relay.Run(ctx) }
+        sagas = newBillingSagas(db)
+        if err := sagas.EnsureSchema(ctx); err != nil { log.Printf("batchopen: saga schema: %v", err) }
+        go sagas.Run(ctx, 5*time.Second)
+    } else {
+        log.Println("batchopen: DATABASE_URL not set; task endpoints are disabled")
+    }
+
+    hostCache = newHostCache(db)
+    for _, c := range hostCache.Collectors("batchopen_host_cache") { _ = prometheus.Register(c) }
+    log.Printf("batchopen: host cache backend=%s", hostCache.Stats().Backend)
 
     r := chi.NewRouter()
     telemetry.RegisterDefaultMetrics("batchopen")
@@ -191,8 +326,21 @@ func main() {
     r.Get("/health", health)
     r.Get("/readyz", ready)
     r.Get("/api/v1/batchopen/stats", stats)
+    // bulk link-health jobs and task event streams (non-OAS), behind auth
+    r.Group(func(rch chi.Router) {
+        rch.Use(middleware.AuthMiddleware)
+        rch.Post("/api/v1/batchopen/link-health", createLinkHealthHandler(tasks))
+        rch.Get("/api/v1/batchopen/link-health/{id}", getLinkHealthHandler(tasks))
+        rch.Get("/api/v1/batchopen/tasks/{id}/events", taskEventsHandler(tasks))
+    })
+    // billing sagas: inspect and manually compensate stuck ones (admin only)
+    if sagas != nil {
+        h := sagas.AdminHandler("/api/v1/batchopen/admin/sagas")
+        r.With(middleware.AdminOnly).Handle("/api/v1/batchopen/admin/sagas", h)
+        r.With(middleware.AdminOnly).Handle("/api/v1/batchopen/admin/sagas/*", h)
+    }
     // OpenAPI chi server mount with auth middleware
-    oas := &oasImpl{pub: pub}
+    oas := &oasImpl{tasks: tasks}
     oapiHandler := api.HandlerWithOptions(oas, api.ChiServerOptions{
         BaseURL: "/api/v1",
         Middlewares: []api.MiddlewareFunc{
@@ -214,37 +362,26 @@ func main() {
 }
 
 // oasImpl implements OpenAPI server interface and delegates to existing logic
-type oasImpl struct{ pub *ev.Publisher }
+type oasImpl struct{ tasks *store.TaskStore }
 
 func (h *oasImpl) CreateBatchopenTask(w http.ResponseWriter, r *http.Request) {
     // reuse existing logic
-    createTaskHandler(h.pub)(w, r)
+    createTaskHandler(h.tasks)(w, r)
 }
 func (h *oasImpl) ListBatchopenTasks(w http.ResponseWriter, r *http.Request) {
-    // Minimal SQL read from BatchopenTask when DATABASE_URL is set; fallback 200 empty
-    dsn := strings.TrimSpace(os.Getenv("DATABASE_URL"))
+    // fallback 200 empty when the task store is not configured
     uid, _ := r.Context().Value(middleware.UserIDKey).(string)
-    if dsn == "" || uid == "" {
+    if h.tasks == nil || uid == "" {
         writeJSON(w, http.StatusOK, map[string]any{"items": []any{}})
         return
     }
-    db, err := sql.Open("postgres", dsn)
-    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "db open failed", nil); return }
-    defer db.Close()
-    rows, err := db.QueryContext(r.Context(), `SELECT id, "userId", "offerId", status, created_at, updated_at, COALESCE(result::text,'null') FROM "BatchopenTask" WHERE "userId"=$1 ORDER BY updated_at DESC LIMIT 50`, uid)
+    list, err := h.tasks.List(r.Context(), uid, 50)
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", nil); return }
-    defer rows.Close()
-    type item struct{ ID, UserID, OfferID, Status, CreatedAt, UpdatedAt string; Result json.RawMessage }
-    var items []item
-    for rows.Next() {
-        var it item
-        var created, updated sql.NullTime
-        var resultText string
-        if err := rows.Scan(&it.ID, &it.UserID, &it.OfferID, &it.Status, &created, &updated, &resultText); err != nil { continue }
-        if created.Valid { it.CreatedAt = created.Time.UTC().Format(time.RFC3339) }
-        if updated.Valid { it.UpdatedAt = updated.Time.UTC().Format(time.RFC3339) }
-        if resultText != "" && resultText != "null" { it.Result = json.RawMessage(resultText) }
-        items = append(items, it)
+    type item struct{ ID, UserID, OfferID, Status, CreatedAt, UpdatedAt string; Version int; Result json.RawMessage }
+    items := make([]item, 0, len(list))
+    for _, t := range list {
+        items = append(items, item{ID: t.ID, UserID: t.UserID, OfferID: t.OfferID, Status: t.Status, Version: t.Version, Result: t.Result,
+            CreatedAt: t.CreatedAt.UTC().Format(time.RFC3339), UpdatedAt: t.UpdatedAt.UTC().Format(time.RFC3339)})
     }
     writeJSON(w, http.StatusOK, map[string]any{"items": items})
 }
@@ -252,17 +389,17 @@ func (h *oasImpl) StartBatchopenTask(w http.ResponseWriter, r *http.Request, id
     // synthesize path and call handler
     r = r.Clone(r.Context())
     r.URL.Path = "/api/v1/batchopen/tasks/" + id + "/start"
-    taskActionHandler(h.pub)(w, r)
+    taskActionHandler(h.tasks)(w, r)
 }
 func (h *oasImpl) CompleteBatchopenTask(w http.ResponseWriter, r *http.Request, id string) {
     r = r.Clone(r.Context())
     r.URL.Path = "/api/v1/batchopen/tasks/" + id + "/complete"
-    taskActionHandler(h.pub)(w, r)
+    taskActionHandler(h.tasks)(w, r)
 }
 func (h *oasImpl) FailBatchopenTask(w http.ResponseWriter, r *http.Request, id string) {
     r = r.Clone(r.Context())
     r.URL.Path = "/api/v1/batchopen/tasks/" + id + "/fail"
-    taskActionHandler(h.pub)(w, r)
+    taskActionHandler(h.tasks)(w, r)
 }
 // GET /batchopen/templates
 func (h *oasImpl) ListSimulationTemplates(w http.ResponseWriter, r *http.Request) {
@@ -321,16 +458,40 @@ func fetchOfferURL(ctx context.Context, offerID, userID string) string {
 var (
     inflightOnce  sync.Once
     inflightSem   chan struct{}
-    hostCache     = map[string]hostCacheEntry{}
-    hostCacheMu   sync.RWMutex
-    sfMu          sync.Mutex
-    sfWaiters     = map[string][]chan singleflightRes{}
     inflightCur   int32
-    cacheHits     int64
-    cacheMiss     int64
+    // hostCache caches and coalesces browser-exec lookups; main swaps in the shared backend.
+    hostCache     = hostcache.New(nil, hostcache.Options{})
 )
-type hostCacheEntry struct{ ok bool; res map[string]any; exp time.Time }
-type singleflightRes struct{ ok bool; res map[string]any }
+
+// newHostCache picks the cache backend: BATCHOPEN_CACHE_BACKEND=memory|postgres|redis, or when
+// unset Redis (REDIS_URL) before Postgres (DATABASE_URL) before in-process memory.
+func newHostCache(db *sql.DB) *hostcache.Cache {
+    kind := strings.ToLower(strings.TrimSpace(os.Getenv("BATCHOPEN_CACHE_BACKEND")))
+    redisURL := strings.TrimSpace(os.Getenv("REDIS_URL"))
+    if kind == "" {
+        switch {
+        case redisURL != "": kind = "redis"
+        case db != nil: kind = "postgres"
+        default: kind = "memory"
+        }
+    }
+    opts := hostcache.Options{
+        ErrTTL:   time.Duration(envInt("BATCHOPEN_CACHE_ERR_TTL_MS", 5000, 100, 60000)) * time.Millisecond,
+        LeaseTTL: time.Duration(envInt("BATCHOPEN_CACHE_LEASE_MS", 30000, 1000, 120000)) * time.Millisecond,
+        // a remote waiter follows a live (lease-renewing) leader through a full resolve with retries
+        MaxWait:  time.Duration(envInt("BATCHOPEN_CACHE_MAX_WAIT_MS", 120000, 5000, 600000)) * time.Millisecond,
+    }
+    switch kind {
+    case "redis":
+        opt, err := redis.ParseURL(redisURL)
+        if err != nil { log.Printf("batchopen: invalid REDIS_URL (%v); host cache falls back to memory", err); break }
+        return hostcache.New(hostcache.NewRedis(redis.NewClient(opt), ""), opts)
+    case "postgres":
+        if db == nil { log.Printf("batchopen: postgres host cache needs DATABASE_URL; falling back to memory"); break }
+        return hostcache.New(hostcache.NewPostgres(db), opts)
+    }
+    return hostcache.New(hostcache.NewMemory(), opts)
+}
 
 // metrics
 var (
@@ -338,14 +499,6 @@ var (
         Name: "batchopen_inflight_current",
         Help: "Current in-flight browser-exec checks",
     })
-    metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
-        Name: "batchopen_host_cache_hits_total",
-        Help: "Total host-level cache hits",
-    })
-    metricCacheMiss = prometheus.NewCounter(prometheus.CounterOpts{
-        Name: "batchopen_host_cache_miss_total",
-        Help: "Total host-level cache misses",
-    })
     metricRequests = prometheus.NewCounter(prometheus.CounterOpts{
         Name: "batchopen_requests_total",
         Help: "Total availability requests via Browser-Exec",
@@ -358,8 +511,6 @@ var (
 
 func init() {
     _ = prometheus.Register(metricInflight)
-    _ = prometheus.Register(metricCacheHits)
-    _ = prometheus.Register(metricCacheMiss)
     _ = prometheus.Register(metricRequests)
     _ = prometheus.Register(metricErrors)
 }
@@ -377,53 +528,59 @@ func initInflight() {
 func acquire() { initInflight(); inflightSem <- struct{}{} }
 func release() { <-inflightSem }
 
+var (
+    beOnce   sync.Once
+    beClient *browserexec.Client
+)
+
+// browserExec returns the shared browser-exec client. Retries stay with browserExecCheckWithRetry,
+// so the client itself makes a single 5s attempt per call.
+func browserExec() *browserexec.Client {
+    beOnce.Do(func() {
+        beClient = browserexec.FromEnv(browserexec.WithPolicy(browserexec.EndpointCheckAvailability, browserexec.Policy{Timeout: 5 * time.Second}))
+    })
+    return beClient
+}
+
 func browserExecCheck(ctx context.Context, url string) (bool, map[string]any) {
-    be := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
-    if be == "" || url == "" { return false, map[string]any{"error": "missing_browser_exec_or_url"} }
-    // Host-level short cache to reduce duplicate checks
+    if !browserExec().Configured() || url == "" { return false, map[string]any{"error": "missing_browser_exec_or_url"} }
+    // Host-level short cache to reduce duplicate checks; parallel checks for the same host coalesce
     host := hostOf(url)
-    if host != "" {
-        if ok, res, hit := lookupHostCache(host); hit {
-            atomic.AddInt64(&cacheHits, 1)
-            metricCacheHits.Inc()
-            return ok, res
-        }
-        atomic.AddInt64(&cacheMiss, 1)
-        metricCacheMiss.Inc()
-        // Singleflight: coalesce parallel checks for same host
-        if ch := joinSingleflight(host); ch != nil {
-            r := <-ch
-            return r.ok, r.res
-        }
-        // mark as leader; ensure notify on return
-        defer func() { leaveSingleflight(host) }()
+    if host == "" {
+        ok, out, err := checkAvailability(ctx, url)
+        if err != nil { return false, map[string]any{"error": err.Error()} }
+        return ok, out
     }
-    // Concurrency guard
+    v, _, err := hostCache.Do(ctx, host, func(ctx context.Context) (hostcache.Value, time.Duration, error) {
+        ok, out, err := checkAvailability(ctx, url)
+        if err != nil { return hostcache.Value{}, 0, err }
+        ttlMs := 120000
+        if !ok { ttlMs = 30000 }
+        if v := strings.TrimSpace(os.Getenv("BATCHOPEN_DOMAIN_CACHE_MS")); v != "" {
+            if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 600000 { ttlMs = n }
+        }
+        return hostcache.Value{OK: ok, Result: out}, time.Duration(ttlMs) * time.Millisecond, nil
+    })
+    // the leader's error reaches every coalesced caller
+    if err != nil { return false, map[string]any{"error": err.Error()} }
+    return v.OK, v.Result
+}
+
+// checkAvailability makes one browser-exec availability call under the in-flight limit.
+func checkAvailability(ctx context.Context, url string) (bool, map[string]any, error) {
     acquire()
     atomic.AddInt32(&inflightCur, 1)
     metricInflight.Inc()
     defer release()
     defer metricInflight.Dec()
     defer atomic.AddInt32(&inflightCur, -1)
-    body := map[string]any{"url": url, "timeoutMs": 8000}
-    hdr := map[string]string{"Content-Type": "application/json"}
+    av, err := browserExec().CheckAvailability(ctx, browserexec.CheckAvailabilityRequest{URL: url, TimeoutMs: 8000})
+    if err != nil { return false, nil, err }
+    // keep the loosely-typed result shape (JSON numbers) used by the host cache, retry and quality scoring
     var out map[string]any
-    if err := httpx.New(5*time.Second).DoJSON(ctx, http.MethodPost, be+"/api/v1/browser/check-availability", body, hdr, 1, &out); err != nil {
-        return false, map[string]any{"error": err.Error()}
-    }
-    ok := false
-    if v, ok2 := out["ok"].(bool); ok2 { ok = v }
-    // if 'ok' not provided, consider http-level 2xx success path already implied by DoJSON
-    // fill cache
-    if host != "" {
-        ttlMs := 120000
-        if !ok { ttlMs = 30000 }
-        if v := strings.TrimSpace(os.Getenv("BATCHOPEN_DOMAIN_CACHE_MS")); v != "" {
-            if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 600000 { ttlMs = n }
-        }
-        saveHostCache(host, ok, out, time.Duration(ttlMs)*time.Millisecond)
-    }
-    return ok, out
+    b, _ := json.Marshal(av)
+    _ = json.Unmarshal(b, &out)
+    return av.Ok, out, nil
 }
 
 func browserExecCheckWithRetry(ctx context.Context, url string) (bool, map[string]any) {
@@ -480,25 +637,38 @@ func computeQuality(res map[string]any) (int, map[string]any) {
     return score, factors
 }
 
-// billingAction calls billing service reserve/commit/release for the task (best-effort, 2s timeout).
+// billingAction calls billing service reserve/commit/release for the task (2s timeout); the billing
+// saga retries it on error. A non-2xx answer is a *saga.BillingError.
+// Tasks are billed as one "batchopen.task" action; billing prices it from its price book. The
+// organization in ctx (middleware.OrgIDFrom), if any, pays instead of the user.
 func billingAction(ctx context.Context, userID, action, taskID string) error {
     base := strings.TrimRight(os.Getenv("BILLING_URL"), "/")
     if base == "" || userID == "" || taskID == "" { return nil }
-    amount := 1
-    if v := strings.TrimSpace(os.Getenv("BATCHOPEN_TOKENS_PER_TASK")); v != "" {
-        if n, err := strconv.Atoi(v); err == nil && n > 0 { amount = n }
-    }
-    body := map[string]any{"amount": amount, "taskId": taskID}
+    body := map[string]any{"taskId": taskID}
+    if action != "release" { body["action"], body["quantity"] = "batchopen.task", 1 }
+    if action == "reserve" { body["ttlSeconds"] = int(holdTTL / time.Second) }
     // For commit/release, allow idempotent txId to be taskID
     if action == "commit" || action == "release" { body["txId"] = taskID }
+    b, _ := json.Marshal(body)
     cctx, cancel := context.WithTimeout(ctx, 2*time.Second)
     defer cancel()
-    hdr := map[string]string{"Content-Type": "application/json", "X-User-Id": userID, "X-Idempotency-Key": "batchopen:"+action+":"+userID+":"+taskID}
-    _ = httpx.New(2*time.Second).DoJSON(cctx, http.MethodPost, base+"/api/v1/billing/tokens/"+action, body, hdr, 1, nil)
-    return nil
+    req, err := http.NewRequestWithContext(cctx, http.MethodPost, base+"/api/v1/billing/tokens/"+action, bytes.NewReader(b))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", "application/json")
+    req.Header.Set("X-User-Id", userID)
+    req.Header.Set("X-Idempotency-Key", "batchopen:"+action+":"+userID+":"+taskID)
+    if orgID := middleware.OrgIDFrom(ctx); orgID != "" { req.Header.Set(middleware.OrgHeader, orgID) }
+    resp, err := httpx.New(2*time.Second).DoRaw(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 200 && resp.StatusCode < 300 { return nil }
+    var eb struct{ Error struct{ Code string `json:"code"` } `json:"error"` }
+    _ = json.NewDecoder(resp.Body).Decode(&eb)
+    return &saga.BillingError{Action: action, Status: resp.StatusCode, Code: eb.Error.Code}
 }
 
-// helpers for host cache and singleflight
+// hostOf returns the cache key for availability checks (lower-case host without www.).
 func hostOf(raw string) string {
     if u, err := url.Parse(raw); err == nil {
         h := strings.ToLower(u.Hostname())
@@ -508,31 +678,3 @@ func hostOf(raw string) string {
     }
     return ""
 }
-func lookupHostCache(host string) (bool, map[string]any, bool) {
-    hostCacheMu.RLock(); e, ok := hostCache[host]; hostCacheMu.RUnlock()
-    if !ok || time.Now().After(e.exp) { return false, nil, false }
-    return e.ok, e.res, true
-}
-func saveHostCache(host string, ok bool, res map[string]any, ttl time.Duration) {
-    hostCacheMu.Lock(); hostCache[host] = hostCacheEntry{ok: ok, res: res, exp: time.Now().Add(ttl)}; hostCacheMu.Unlock()
-}
-func joinSingleflight(host string) <-chan singleflightRes {
-    sfMu.Lock(); defer sfMu.Unlock()
-    if chs, ok := sfWaiters[host]; ok {
-        ch := make(chan singleflightRes, 1)
-        sfWaiters[host] = append(chs, ch)
-        return ch
-    }
-    // mark leader by creating empty slice
-    sfWaiters[host] = []chan singleflightRes{}
-    return nil
-}
-func leaveSingleflight(host string) {
-    sfMu.Lock(); chs, ok := sfWaiters[host]; if ok { delete(sfWaiters, host) }; sfMu.Unlock()
-    if !ok || len(chs) == 0 { return }
-    // read from cache (which leader should have saved), otherwise send failure
-    ok2, res, hit := lookupHostCache(host)
-    r := singleflightRes{ok: ok2, res: res}
-    if !hit { r = singleflightRes{ok: false, res: map[string]any{"error": "singleflight_miss"}} }
-    for _, ch := range chs { ch <- r; close(ch) }
-}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    stderrors "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/domain"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/store"
+    "github.com/xxrenzhe/autoads/services/batchopen/internal/taskevents"
+)
+
+// Task progress streaming (GET /api/v1/batchopen/tasks/{id}/events).
+// The runner publishes state transitions and per-step progress into taskEvents; listeners of the
+// same task share one topic, keyed by owner and task id, whose upstream polls the store with the
+// owner's id, so changes made by other instances (or manual actions) reach every listener as well.
+
+// Task steps reported as progress events, with the progress reached when each step is done.
+const (
+    stepReserve      = "reserve_tokens"
+    stepFetchOffer   = "fetch_offer"
+    stepBrowserCheck = "browser_check"
+    stepQuality      = "quality_score"
+)
+
+var stepProgress = map[string]float64{stepReserve: 20, stepFetchOffer: 40, stepBrowserCheck: 80, stepQuality: 90}
+
+var taskEvents = taskevents.New(32)
+
+// taskTopic names the task's stream; keying by owner keeps a topic's poller on the owner's id.
+func taskTopic(uid, taskID string) string { return uid + "/" + taskID }
+
+// stepStarted announces a step; it is not persisted.
+func stepStarted(taskID, uid, step string) {
+    taskEvents.Publish(taskTopic(uid, taskID), taskevents.Event{Type: taskevents.TypeProgress, Data: map[string]any{"step": step, "phase": "started"}})
+}
+
+// stepFailed reports a step that ends the task; the failed transition follows.
+func stepFailed(taskID, uid, step, reason string) {
+    taskEvents.Publish(taskTopic(uid, taskID), taskevents.Event{Type: taskevents.TypeProgress, Data: map[string]any{"step": step, "phase": "failed", "reason": reason}})
+}
+
+// stepDone persists the progress reached by step and publishes it with the new task version.
+func stepDone(ctx context.Context, tasks *store.TaskStore, taskID, uid, step string, detail map[string]any) {
+    t, err := tasks.Transition(ctx, taskID, uid, func(t *domain.Task) ([]store.Event, error) {
+        if t.Status != domain.StatusRunning { return nil, domain.ErrInvalidTransition }
+        t.UpdateProgress(stepProgress[step])
+        return nil, nil
+    })
+    if err != nil {
+        if !stderrors.Is(err, domain.ErrInvalidTransition) { log.Printf("batchopen: task %s progress %s: %v", taskID, step, err) }
+        return
+    }
+    data := map[string]any{"step": step, "phase": "done", "progress": t.Progress}
+    for k, v := range detail { data[k] = v }
+    taskEvents.Publish(taskTopic(uid, taskID), taskevents.Event{Type: taskevents.TypeProgress, Version: t.Version, Data: data})
+}
+
+// publishTransition streams a persisted status change and, for terminal states, the result.
+func publishTransition(t *domain.Task) {
+    if t == nil { return }
+    taskEvents.Publish(taskTopic(t.UserID, t.ID), taskevents.Event{Type: taskevents.TypeState, Version: t.Version, Data: taskState(t)})
+    if t.IsTerminal() {
+        taskEvents.Publish(taskTopic(t.UserID, t.ID), taskevents.Event{Type: taskevents.TypeResult, Version: t.Version, Data: taskResult(t)})
+    }
+}
+
+func taskState(t *domain.Task) map[string]any {
+    return map[string]any{"status": t.Status, "progress": t.Progress, "version": t.Version, "updatedAt": t.UpdatedAt.UTC().Format(time.RFC3339)}
+}
+
+func taskResult(t *domain.Task) map[string]any {
+    out := map[string]any{"status": t.Status, "version": t.Version}
+    if len(t.Result) > 0 { out["result"] = t.Result }
+    return out
+}
+
+// pollTask is the shared upstream of a task topic: it reports changes seen in the store until the
+// task is terminal. Events the runner already published for a version are deduplicated.
+func pollTask(tasks *store.TaskStore, taskID, uid string) taskevents.Upstream {
+    interval := time.Duration(envInt("BATCHOPEN_SSE_POLL_MS", 1000, 200, 30000)) * time.Millisecond
+    return func(ctx context.Context, emit func(taskevents.Event)) {
+        var last *domain.Task
+        tick := time.NewTicker(interval)
+        defer tick.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-tick.C:
+            }
+            t, err := tasks.Get(ctx, taskID, uid)
+            if err != nil {
+                if ctx.Err() == nil { log.Printf("batchopen: poll task %s: %v", taskID, err) }
+                continue
+            }
+            if last != nil && t.Version == last.Version { continue }
+            if last == nil || t.Status != last.Status {
+                emit(taskevents.Event{Type: taskevents.TypeState, Version: t.Version, Data: taskState(t)})
+            }
+            if last == nil || t.Progress != last.Progress {
+                emit(taskevents.Event{Type: taskevents.TypeProgress, Version: t.Version, Data: map[string]any{"progress": t.Progress}})
+            }
+            if t.IsTerminal() {
+                emit(taskevents.Event{Type: taskevents.TypeResult, Version: t.Version, Data: taskResult(t)})
+                return
+            }
+            last = t
+        }
+    }
+}
+
+// taskEventsHandler streams a task's state, progress and final result as server-sent events:
+//  - event: state,    data: { status, progress, version, updatedAt } (first event is the snapshot)
+//  - event: progress, data: { step, phase: started|done|failed, progress }
+//  - event: result,   data: { status, version, result } (last event)
+//  - event: heartbeat, data: { t }
+// Events tied to a task version carry it as the SSE id.
+func taskEventsHandler(tasks *store.TaskStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if tasks == nil { errors.Write(w, r, http.StatusInternalServerError, "SERVER_NOT_CONFIGURED", "DATABASE_URL not set", nil); return }
+        uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+        if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated", nil); return }
+        taskID := chi.URLParam(r, "id")
+        fl, ok := w.(http.Flusher)
+        if !ok { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "stream not supported", nil); return }
+
+        // only the owner may open (and so install the poller of) the task's topic
+        if _, err := tasks.Get(r.Context(), taskID, uid); err != nil {
+            if stderrors.Is(err, store.ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "task not found", nil); return }
+            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", nil); return
+        }
+        // subscribe before reading the snapshot so no change falls in between
+        ch, unsubscribe := taskEvents.Subscribe(taskTopic(uid, taskID), pollTask(tasks, taskID, uid))
+        defer unsubscribe()
+        t, err := tasks.Get(r.Context(), taskID, uid)
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", nil); return }
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache, no-transform")
+        w.Header().Set("Connection", "keep-alive")
+        w.Header().Set("X-Accel-Buffering", "no")
+        writeSSE(w, t.Version, taskevents.TypeState, taskState(t))
+        if t.IsTerminal() {
+            writeSSE(w, t.Version, taskevents.TypeResult, taskResult(t))
+            fl.Flush()
+            return
+        }
+        fl.Flush()
+
+        hb := time.NewTicker(25 * time.Second)
+        defer hb.Stop()
+        for {
+            select {
+            case <-r.Context().Done():
+                return
+            case <-hb.C:
+                writeSSE(w, 0, "heartbeat", map[string]any{"t": time.Now().Unix()})
+                fl.Flush()
+            case e, ok := <-ch:
+                // closed: result delivered or listener too slow; clients reconnect and resync
+                if !ok { return }
+                if e.Version > 0 && e.Version <= t.Version { continue }
+                writeSSE(w, e.Version, e.Type, e.Data)
+                fl.Flush()
+                if e.Type == taskevents.TypeResult { return }
+            }
+        }
+    }
+}
+
+func writeSSE(w http.ResponseWriter, id int, event string, data any) {
+    b, _ := json.Marshal(data)
+    if id > 0 { fmt.Fprintf(w, "id: %d\n", id) }
+    fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    stderrors "errors"
+
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/billing/internal/domain"
+    "github.com/xxrenzhe/autoads/services/billing/internal/grants"
+    "github.com/xxrenzhe/autoads/services/billing/internal/subscriptions"
+    "github.com/xxrenzhe/autoads/services/billing/internal/tokens"
+)
+
+// configureGrants applies BILLING_REFERRAL_TOKENS and BILLING_REFERRAL_TTL_DAYS (0 = never expire).
+func configureGrants(g *grants.Store) {
+    if v := strings.TrimSpace(os.Getenv("BILLING_REFERRAL_TOKENS")); v != "" {
+        if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 { g.ReferralTokens = n }
+    }
+    if v := strings.TrimSpace(os.Getenv("BILLING_REFERRAL_TTL_DAYS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 0 { g.ReferralTTL = time.Duration(n) * 24 * time.Hour }
+    }
+}
+
+func writeGrantError(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case stderrors.Is(err, domain.ErrPromoNotFound):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", err.Error(), nil)
+    case stderrors.Is(err, domain.ErrPromoNotValid), stderrors.Is(err, domain.ErrPromoExhausted):
+        errors.Write(w, r, http.StatusConflict, "PROMO_UNAVAILABLE", err.Error(), nil)
+    case stderrors.Is(err, domain.ErrPromoRedeemed), stderrors.Is(err, domain.ErrReferralClaimed):
+        errors.Write(w, r, http.StatusConflict, "ALREADY_CLAIMED", err.Error(), nil)
+    case stderrors.Is(err, domain.ErrReferralInvalid), stderrors.Is(err, grants.ErrInvalid), stderrors.Is(err, grants.ErrInvalidGrant):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil)
+    default:
+        log.Printf("billing: grant request failed: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "grant request failed", nil)
+    }
+}
+
+
+// creditReferral pays the referrer when a referred user activates a paid plan or upgrades to one.
+func creditReferral(ctx context.Context, g *grants.Store, t *subscriptions.Transition) {
+    if g == nil || t == nil { return }
+    if t.Event != ev.EventSubscriptionActivated && t.Event != ev.EventSubscriptionPlanChanged { return }
+    if p, ok := domain.LookupPlan(t.PlanID); !ok || p.PriceCents <= 0 { return }
+    if _, _, err := g.Credit(ctx, t.UserID, time.Now()); err != nil { log.Printf("billing: referral credit for %s: %v", t.UserID, err) }
+}
+
+// runGrantExpirySweeper lapses granted tokens past their expiry (BILLING_GRANT_EXPIRY_SWEEP_MS,
+// default 10m).
+func runGrantExpirySweeper(ctx context.Context, store *tokens.Store) {
+    interval := 10 * time.Minute
+    if v := strings.TrimSpace(os.Getenv("BILLING_GRANT_EXPIRY_SWEEP_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 86400000 { interval = time.Duration(n) * time.Millisecond }
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+        expireGrants(ctx, store)
+    }
+}
+
+func expireGrants(ctx context.Context, store *tokens.Store) []*tokens.Result {
+    expired, err := store.ExpireGrants(ctx, time.Now(), 200)
+    if len(expired) > 0 { log.Printf("billing: expired %d token grants", len(expired)) }
+    if err != nil { log.Printf("billing: grant expiry sweep: %v", err) }
+    return expired
+}
+
+// redeemPromo credits the caller with a promo code's tokens. Body: {"code": "..."}
+func (h *Handler) redeemPromo(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var req struct{ Code string `json:"code"` }
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    if strings.TrimSpace(req.Code) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "code required", nil); return }
+    now := time.Now()
+    res, p, err := h.Grants.Redeem(r.Context(), uid, req.Code, now)
+    if err != nil { writeGrantError(w, r, err); return }
+    exp := p.GrantExpiry(now)
+    respondWithJSON(w, http.StatusOK, map[string]any{"code": p.Code, "tokens": p.Tokens, "expiresAt": exp, "txId": res.TxID, "balance": res.Wallet.Balance})
+}
+
+// getReferrals returns the caller's referral code and the users who claimed it.
+func (h *Handler) getReferrals(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    code, err := h.Grants.ReferralCode(r.Context(), uid)
+    if err != nil { writeGrantError(w, r, err); return }
+    items, err := h.Grants.Referrals(r.Context(), uid, 200)
+    if err != nil { writeGrantError(w, r, err); return }
+    if items == nil { items = []grants.Referral{} }
+    respondWithJSON(w, http.StatusOK, map[string]any{"code": code, "rewardTokens": h.Grants.ReferralTokens, "items": items})
+}
+
+// claimReferral records who referred the caller; the referrer is credited when the caller
+// activates a paid plan. Body: {"code": "..."}
+func (h *Handler) claimReferral(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var req struct{ Code string `json:"code"` }
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    if strings.TrimSpace(req.Code) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "code required", nil); return }
+    ref, err := h.Grants.Claim(r.Context(), uid, req.Code)
+    if err != nil { writeGrantError(w, r, err); return }
+    respondWithJSON(w, http.StatusCreated, ref)
+}
+
+// listGrants returns the caller's granted token lots, soonest-expiring first. Query: active=1
+// for lots with tokens left.
+func (h *Handler) listGrants(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    active := r.URL.Query().Get("active") == "1" || r.URL.Query().Get("active") == "true"
+    items, err := h.Tokens.Grants(r.Context(), uid, active, 200)
+    if err != nil { writeGrantError(w, r, err); return }
+    if items == nil { items = []*domain.TokenGrant{} }
+    domain.SortGrants(items)
+    respondWithJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+// promosInternal lists promo codes (GET) or creates/updates one (POST, body: domain.PromoCode
+// plus "actor"). Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) promosInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    if r.Method == http.MethodGet {
+        items, err := h.Grants.Promos(r.Context(), 500)
+        if err != nil { writeGrantError(w, r, err); return }
+        if items == nil { items = []*domain.PromoCode{} }
+        respondWithJSON(w, http.StatusOK, map[string]any{"items": items})
+        return
+    }
+    var req struct {
+        domain.PromoCode
+        Active *bool  `json:"active"`
+        Actor  string `json:"actor"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+    p := req.PromoCode
+    p.Active = req.Active == nil || *req.Active
+    out, err := h.Grants.SetPromo(r.Context(), p, req.Actor)
+    if err != nil { writeGrantError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, out)
+}
+
+// grantInternal issues an admin grant for the console. The reference makes it idempotent.
+// Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) grantInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    var req struct {
+        UserID    string     `json:"userId"`
+        Amount    int64      `json:"amount"`
+        ExpiresAt *time.Time `json:"expiresAt"`
+        Reason    string     `json:"reason"`
+        Reference string     `json:"reference"`
+        AdminID   string     `json:"adminId"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+    res, err := h.Grants.Admin(r.Context(), grants.AdminGrant{UserID: req.UserID, Amount: req.Amount, ExpiresAt: req.ExpiresAt, Reason: req.Reason, Reference: req.Reference, AdminID: req.AdminID})
+    if err != nil { writeGrantError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"userId": req.UserID, "amount": req.Amount, "expiresAt": req.ExpiresAt, "txId": res.TxID, "balance": res.Wallet.Balance, "replayed": res.Replayed})
+}
+
+// expireGrantsInternal runs the grant expiry sweep now.
+// Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) expireGrantsInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    expired := expireGrants(r.Context(), h.Tokens)
+    var total int64
+    for _, res := range expired { total += res.Spent }
+    respondWithJSON(w, http.StatusOK, map[string]any{"expired": len(expired), "tokens": total})
+}
@@ -0,0 +1,124 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Grant kinds: where tokens credited outside plans and purchases came from.
+const (
+	GrantPromo    = "promo"
+	GrantReferral = "referral"
+	GrantAdmin    = "admin"
+)
+
+var (
+	// ErrPromoNotFound is returned for unknown or disabled promo codes.
+	ErrPromoNotFound = errors.New("promo code not found")
+	// ErrPromoNotValid is returned outside a promo code's validity window.
+	ErrPromoNotValid = errors.New("promo code is not valid at this time")
+	// ErrPromoExhausted is returned when a promo code reached its redemption limit.
+	ErrPromoExhausted = errors.New("promo code redemption limit reached")
+	// ErrPromoRedeemed is returned when the user already redeemed the promo code.
+	ErrPromoRedeemed = errors.New("promo code already redeemed")
+	// ErrReferralInvalid is returned for unknown referral codes and self-referrals.
+	ErrReferralInvalid = errors.New("invalid referral code")
+	// ErrReferralClaimed is returned when the user was already referred.
+	ErrReferralClaimed = errors.New("referral already claimed")
+)
+
+// TokenGrant is a lot of granted tokens on a wallet. Remaining drops as the lot is spent; what
+// is left at ExpiresAt lapses. A nil ExpiresAt never expires.
+type TokenGrant struct {
+	ID        string     `json:"id"`
+	WalletID  string     `json:"walletId"`
+	Kind      string     `json:"kind"`
+	Amount    int64      `json:"amount"`
+	Remaining int64      `json:"remaining"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Reference string     `json:"reference,omitempty"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Expired reports whether the lot lapsed at now.
+func (g *TokenGrant) Expired(now time.Time) bool {
+	return g.ExpiresAt != nil && !now.Before(*g.ExpiresAt)
+}
+
+// SortGrants orders lots in the order they are spent: soonest-expiring first, lots that never
+// expire last, older before newer.
+func SortGrants(lots []*TokenGrant) {
+	sort.SliceStable(lots, func(i, j int) bool {
+		a, b := lots[i], lots[j]
+		switch {
+		case a.ExpiresAt == nil && b.ExpiresAt != nil:
+			return false
+		case a.ExpiresAt != nil && b.ExpiresAt == nil:
+			return true
+		case a.ExpiresAt != nil && !a.ExpiresAt.Equal(*b.ExpiresAt):
+			return a.ExpiresAt.Before(*b.ExpiresAt)
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// ConsumeGrants spends amount from lots in SortGrants order and returns what was taken per lot
+// id. Tokens beyond the lots' remaining come from the wallet's untracked balance and are not
+// reported.
+func ConsumeGrants(lots []*TokenGrant, amount int64) map[string]int64 {
+	SortGrants(lots)
+	used := map[string]int64{}
+	for _, g := range lots {
+		if amount <= 0 {
+			break
+		}
+		take := min(g.Remaining, amount)
+		if take <= 0 {
+			continue
+		}
+		g.Remaining -= take
+		amount -= take
+		used[g.ID] = take
+	}
+	return used
+}
+
+// PromoCode credits Tokens to each redeeming user once, within [ValidFrom, ValidUntil) and up to
+// MaxRedemptions redemptions in total (0 = unlimited). Granted tokens expire GrantTTLDays after
+// redemption (0 = never).
+type PromoCode struct {
+	Code           string     `json:"code"`
+	Tokens         int64      `json:"tokens"`
+	MaxRedemptions int64      `json:"maxRedemptions"`
+	Redeemed       int64      `json:"redeemed"`
+	ValidFrom      *time.Time `json:"validFrom,omitempty"`
+	ValidUntil     *time.Time `json:"validUntil,omitempty"`
+	GrantTTLDays   int        `json:"grantTtlDays"`
+	Active         bool       `json:"active"`
+	CreatedBy      string     `json:"createdBy,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// CanRedeem reports why the code cannot be redeemed at now, if it cannot.
+func (p *PromoCode) CanRedeem(now time.Time) error {
+	switch {
+	case !p.Active:
+		return ErrPromoNotFound
+	case p.ValidFrom != nil && now.Before(*p.ValidFrom), p.ValidUntil != nil && !now.Before(*p.ValidUntil):
+		return ErrPromoNotValid
+	case p.MaxRedemptions > 0 && p.Redeemed >= p.MaxRedemptions:
+		return ErrPromoExhausted
+	}
+	return nil
+}
+
+// GrantExpiry returns when tokens granted at now by the code expire (nil for never).
+func (p *PromoCode) GrantExpiry(now time.Time) *time.Time {
+	if p.GrantTTLDays <= 0 {
+		return nil
+	}
+	t := now.AddDate(0, 0, p.GrantTTLDays).UTC()
+	return &t
+}
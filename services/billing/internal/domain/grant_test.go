@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumeGrantsSoonestExpiringFirst(t *testing.T) {
+	now := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d int) *time.Time { t := now.AddDate(0, 0, d); return &t }
+	lots := []*TokenGrant{
+		{ID: "never", Remaining: 100, CreatedAt: now},
+		{ID: "late", Remaining: 50, ExpiresAt: at(30), CreatedAt: now},
+		{ID: "soon", Remaining: 20, ExpiresAt: at(3), CreatedAt: now.Add(time.Hour)},
+		{ID: "soon-older", Remaining: 10, ExpiresAt: at(3), CreatedAt: now},
+	}
+	used := ConsumeGrants(lots, 70)
+	want := map[string]int64{"soon-older": 10, "soon": 20, "late": 40}
+	if len(used) != len(want) {
+		t.Fatalf("Expected %v, but got %v", want, used)
+	}
+	for id, n := range want {
+		if used[id] != n {
+			t.Errorf("Expected %d from %s, but got %d", n, id, used[id])
+		}
+	}
+	if lots[3].ID != "never" || lots[3].Remaining != 100 {
+		t.Errorf("Expected the non-expiring lot last and untouched, but got %+v", lots[3])
+	}
+
+	// spends beyond the lots come from the untracked balance
+	used = ConsumeGrants(lots, 500)
+	if used["late"] != 10 || used["never"] != 100 || lots[3].Remaining != 0 {
+		t.Errorf("Expected the lots to be drained, but got %v", used)
+	}
+}
+
+func TestPromoCodeCanRedeem(t *testing.T) {
+	now := time.Date(2026, 9, 15, 0, 0, 0, 0, time.UTC)
+	from, until := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+	cases := []struct {
+		name string
+		p    PromoCode
+		want error
+	}{
+		{"open", PromoCode{Active: true, ValidFrom: &from, ValidUntil: &until, MaxRedemptions: 10, Redeemed: 9}, nil},
+		{"unlimited", PromoCode{Active: true, Redeemed: 1 << 20}, nil},
+		{"disabled", PromoCode{Active: false}, ErrPromoNotFound},
+		{"not yet", PromoCode{Active: true, ValidFrom: &until}, ErrPromoNotValid},
+		{"ended", PromoCode{Active: true, ValidUntil: &now}, ErrPromoNotValid},
+		{"exhausted", PromoCode{Active: true, MaxRedemptions: 10, Redeemed: 10}, ErrPromoExhausted},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.p.CanRedeem(now); !errors.Is(err, c.want) {
+				t.Errorf("Expected %v, but got %v", c.want, err)
+			}
+		})
+	}
+	p := PromoCode{GrantTTLDays: 2}
+	if exp := p.GrantExpiry(now); exp == nil || !exp.Equal(now.Add(48*time.Hour)) {
+		t.Errorf("Expected expiry in 48h, but got %v", exp)
+	}
+}
@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Hold statuses. A hold stays "held" until it is fully committed, released or expired.
+const (
+	HoldHeld      = "held"
+	HoldCommitted = "committed"
+	HoldReleased  = "released"
+	HoldExpired   = "expired"
+)
+
+var (
+	// ErrInsufficientTokens is returned when the available balance cannot cover a hold or debit.
+	ErrInsufficientTokens = errors.New("insufficient tokens")
+	// ErrHoldNotFound is returned for unknown reservations and reservations of another user.
+	ErrHoldNotFound = errors.New("reservation not found")
+	// ErrHoldClosed is returned when a reservation was already committed, released or expired.
+	ErrHoldClosed = errors.New("reservation is closed")
+	// ErrHoldExceeded is returned when a commit asks for more than the reservation still holds.
+	ErrHoldExceeded = errors.New("amount exceeds reserved tokens")
+)
+
+// Wallet is a user's token balance. Held tokens belong to the user but back open reservations,
+// so only Available() can be reserved or debited directly.
+type Wallet struct {
+	UserID  string `json:"userId"`
+	Balance int64  `json:"balance"`
+	Held    int64  `json:"held"`
+}
+
+// Available returns the tokens that are neither spent nor held.
+func (w *Wallet) Available() int64 {
+	return w.Balance - w.Held
+}
+
+// Hold moves amount from available to held.
+func (w *Wallet) Hold(amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("invalid hold amount %d", amount)
+	}
+	if w.Available() < amount {
+		return ErrInsufficientTokens
+	}
+	w.Held += amount
+	return nil
+}
+
+// Settle applies a reservation outcome: spent tokens leave the balance, released ones return to
+// available. Both leave the held total.
+func (w *Wallet) Settle(spent, released int64) {
+	w.Held -= spent + released
+	w.Balance -= spent
+}
+
+// Debit spends amount from the available balance without a reservation.
+func (w *Wallet) Debit(amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("invalid debit amount %d", amount)
+	}
+	if w.Available() < amount {
+		return ErrInsufficientTokens
+	}
+	w.Balance -= amount
+	return nil
+}
+
+// Hold is a token reservation. Commits may be partial; whatever is neither committed nor
+// released when the hold closes goes back to the wallet.
+type Hold struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	TaskID    string    `json:"taskId,omitempty"`
+	Amount    int64     `json:"amount"`
+	Committed int64     `json:"committed"`
+	Released  int64     `json:"released"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// PriceVersion and PlanID record the price book version and plan the hold was priced with;
+	// commits by action are priced the same way. Both are empty for raw-amount holds.
+	PriceVersion string `json:"priceVersion,omitempty"`
+	PlanID       string `json:"planId,omitempty"`
+	// WalletID is the wallet the hold draws on: the user's own or an organization wallet.
+	WalletID string `json:"walletId"`
+}
+
+// NewHold creates an open reservation that expires after ttl.
+func NewHold(id, userID, taskID string, amount int64, ttl time.Duration) *Hold {
+	now := time.Now()
+	return &Hold{
+		ID:        id,
+		UserID:    userID,
+		WalletID:  userID,
+		TaskID:    taskID,
+		Amount:    amount,
+		Status:    HoldHeld,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Remaining returns the tokens still held.
+func (h *Hold) Remaining() int64 {
+	return h.Amount - h.Committed - h.Released
+}
+
+// IsOpen reports whether the hold still reserves tokens.
+func (h *Hold) IsOpen() bool {
+	return h.Status == HoldHeld
+}
+
+// Commit spends amount from the hold (the remaining tokens when amount is 0). With final the
+// rest is released and the hold closes; otherwise it stays open for further commits.
+// It returns the tokens released back to the wallet.
+func (h *Hold) Commit(amount int64, final bool) (released int64, err error) {
+	if !h.IsOpen() {
+		return 0, fmt.Errorf("%w: %s", ErrHoldClosed, h.Status)
+	}
+	if amount == 0 {
+		amount = h.Remaining()
+	}
+	if amount < 0 || amount > h.Remaining() {
+		return 0, fmt.Errorf("%w: %d > %d", ErrHoldExceeded, amount, h.Remaining())
+	}
+	h.Committed += amount
+	h.UpdatedAt = time.Now()
+	if final || h.Remaining() == 0 {
+		released = h.Remaining()
+		h.Released += released
+		h.Status = HoldCommitted
+	}
+	return released, nil
+}
+
+// Release returns the remaining tokens to the wallet and closes the hold. A hold that already
+// committed part of its tokens still counts as committed.
+func (h *Hold) Release() (released int64, err error) {
+	return h.close(HoldReleased)
+}
+
+// Expire closes a stale hold like Release, recording that the holder never settled it.
+func (h *Hold) Expire(now time.Time) (released int64, err error) {
+	if h.IsOpen() && now.Before(h.ExpiresAt) {
+		return 0, fmt.Errorf("reservation %s not expired until %s", h.ID, h.ExpiresAt.Format(time.RFC3339))
+	}
+	return h.close(HoldExpired)
+}
+
+func (h *Hold) close(status string) (int64, error) {
+	if !h.IsOpen() {
+		return 0, fmt.Errorf("%w: %s", ErrHoldClosed, h.Status)
+	}
+	released := h.Remaining()
+	h.Released += released
+	h.Status = status
+	if h.Committed > 0 {
+		h.Status = HoldCommitted
+	}
+	h.UpdatedAt = time.Now()
+	return released, nil
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWalletHoldProtectsAvailableBalance(t *testing.T) {
+	w := &Wallet{UserID: "u1", Balance: 1}
+	if err := w.Hold(1); err != nil {
+		t.Fatalf("first hold: %v", err)
+	}
+	// a second task cannot reserve the same token
+	if err := w.Hold(1); !errors.Is(err, ErrInsufficientTokens) {
+		t.Fatalf("expected ErrInsufficientTokens, got %v", err)
+	}
+	if err := w.Debit(1); !errors.Is(err, ErrInsufficientTokens) {
+		t.Fatalf("direct debit must not spend held tokens, got %v", err)
+	}
+	if w.Available() != 0 || w.Held != 1 || w.Balance != 1 {
+		t.Fatalf("unexpected wallet %+v", w)
+	}
+}
+
+func TestHoldPartialCommits(t *testing.T) {
+	w := &Wallet{Balance: 20}
+	h := NewHold("r1", "u1", "task-1", 15, time.Minute)
+	if err := w.Hold(h.Amount); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := h.Commit(5, false)
+	if err != nil || released != 0 || !h.IsOpen() || h.Remaining() != 10 {
+		t.Fatalf("partial commit: released=%d err=%v hold=%+v", released, err, h)
+	}
+	w.Settle(5, released)
+
+	if _, err := h.Commit(11, false); !errors.Is(err, ErrHoldExceeded) {
+		t.Fatalf("expected ErrHoldExceeded, got %v", err)
+	}
+
+	released, err = h.Commit(4, true)
+	if err != nil || released != 6 || h.Status != HoldCommitted {
+		t.Fatalf("final commit: released=%d err=%v hold=%+v", released, err, h)
+	}
+	w.Settle(4, released)
+	if w.Balance != 11 || w.Held != 0 || w.Available() != 11 {
+		t.Fatalf("unexpected wallet after settlement %+v", w)
+	}
+
+	if _, err := h.Release(); !errors.Is(err, ErrHoldClosed) {
+		t.Fatalf("expected ErrHoldClosed, got %v", err)
+	}
+}
+
+func TestHoldCommitWithoutAmountTakesRemaining(t *testing.T) {
+	h := NewHold("r2", "u1", "", 7, time.Minute)
+	released, err := h.Commit(0, false)
+	if err != nil || released != 0 || h.Committed != 7 || h.Status != HoldCommitted {
+		t.Fatalf("unexpected commit result released=%d err=%v hold=%+v", released, err, h)
+	}
+}
+
+func TestHoldReleaseAndExpire(t *testing.T) {
+	h := NewHold("r3", "u1", "", 10, time.Minute)
+	if _, err := h.Expire(time.Now()); err == nil {
+		t.Fatal("expected an open, unexpired hold to refuse expiry")
+	}
+	released, err := h.Expire(h.ExpiresAt.Add(time.Second))
+	if err != nil || released != 10 || h.Status != HoldExpired {
+		t.Fatalf("expire: released=%d err=%v hold=%+v", released, err, h)
+	}
+
+	partial := NewHold("r4", "u1", "", 10, time.Minute)
+	if _, err := partial.Commit(3, false); err != nil {
+		t.Fatal(err)
+	}
+	released, err = partial.Release()
+	if err != nil || released != 7 || partial.Status != HoldCommitted {
+		t.Fatalf("release after partial commit: released=%d err=%v hold=%+v", released, err, partial)
+	}
+}
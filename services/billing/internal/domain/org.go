@@ -0,0 +1,141 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Organization member roles. Owners and admins manage members and caps; members spend.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Funding sources recorded on every token transaction.
+const (
+	FundingPersonal = "personal"
+	FundingOrg      = "org"
+)
+
+// OrgWalletPrefix qualifies organization wallets among wallet ids, which are otherwise user ids.
+const OrgWalletPrefix = "org:"
+
+var (
+	// ErrOrgNotFound is returned for unknown organizations.
+	ErrOrgNotFound = errors.New("organization not found")
+	// ErrNotMember is returned when a user acts for an organization they do not belong to.
+	ErrNotMember = errors.New("not a member of the organization")
+	// ErrForbidden is returned when a member's role does not allow the change.
+	ErrForbidden = errors.New("organization role does not allow this")
+	// ErrSpendCapExceeded is returned when an org-funded spend would pass a member's cap.
+	ErrSpendCapExceeded = errors.New("member spend cap exceeded")
+)
+
+// OrgWalletID returns the wallet id of an organization.
+func OrgWalletID(orgID string) string { return OrgWalletPrefix + orgID }
+
+// WalletOrg returns the organization of an org wallet id.
+func WalletOrg(walletID string) (string, bool) {
+	return strings.CutPrefix(walletID, OrgWalletPrefix)
+}
+
+// WalletFunding returns the funding source of spends from walletID.
+func WalletFunding(walletID string) string {
+	if _, ok := WalletOrg(walletID); ok {
+		return FundingOrg
+	}
+	return FundingPersonal
+}
+
+// Payer is who spends and which wallet pays: the user's own wallet, or the wallet of an
+// organization the user is a member of.
+type Payer struct {
+	UserID string
+	OrgID  string
+}
+
+// WalletID returns the id of the paying wallet.
+func (p Payer) WalletID() string {
+	if p.OrgID != "" {
+		return OrgWalletID(p.OrgID)
+	}
+	return p.UserID
+}
+
+// Funding returns FundingOrg or FundingPersonal.
+func (p Payer) Funding() string {
+	if p.OrgID != "" {
+		return FundingOrg
+	}
+	return FundingPersonal
+}
+
+// Organization shares one token wallet among its members.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"ownerId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Member is a user's role and spend caps in an organization. Caps bound what the member may
+// spend from the organization wallet per UTC day and month; zero means no cap.
+type Member struct {
+	OrgID      string    `json:"orgId"`
+	UserID     string    `json:"userId"`
+	Role       string    `json:"role"`
+	DailyCap   int64     `json:"dailyCap"`
+	MonthlyCap int64     `json:"monthlyCap"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ValidRole reports whether role is a known member role.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleOwner, RoleAdmin, RoleMember:
+		return true
+	}
+	return false
+}
+
+// CanManage reports whether the member may change members and caps.
+func (m Member) CanManage() bool {
+	return m.Role == RoleOwner || m.Role == RoleAdmin
+}
+
+// MemberSpend is what a member spent from the organization wallet in the current UTC day and
+// month, and what their open reservations on it still hold.
+type MemberSpend struct {
+	Day   int64 `json:"day"`
+	Month int64 `json:"month"`
+	Held  int64 `json:"held"`
+}
+
+// CapError reports which cap a spend would pass; it matches ErrSpendCapExceeded.
+type CapError struct {
+	Period string `json:"period"`
+	Cap    int64  `json:"cap"`
+	Used   int64  `json:"used"`
+}
+
+func (e *CapError) Error() string {
+	return fmt.Sprintf("%s: %s cap %d, %d used or held", ErrSpendCapExceeded, e.Period, e.Cap, e.Used)
+}
+
+func (e *CapError) Is(target error) bool { return target == ErrSpendCapExceeded }
+
+// CheckCap returns a *CapError when amount on top of what the member spent and holds would pass
+// their daily or monthly cap. Held tokens count because they are spent when committed.
+func (m Member) CheckCap(s MemberSpend, amount int64) error {
+	if used := s.Day + s.Held; m.DailyCap > 0 && used+amount > m.DailyCap {
+		return &CapError{Period: "day", Cap: m.DailyCap, Used: used}
+	}
+	if used := s.Month + s.Held; m.MonthlyCap > 0 && used+amount > m.MonthlyCap {
+		return &CapError{Period: "month", Cap: m.MonthlyCap, Used: used}
+	}
+	return nil
+}
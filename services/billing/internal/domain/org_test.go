@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemberCheckCap(t *testing.T) {
+	m := Member{Role: RoleMember, DailyCap: 100, MonthlyCap: 1000}
+	cases := []struct {
+		name   string
+		spend  MemberSpend
+		amount int64
+		period string
+	}{
+		{"within caps", MemberSpend{Day: 40, Month: 500, Held: 10}, 50, ""},
+		{"daily cap reached", MemberSpend{Day: 40, Month: 500, Held: 10}, 51, "day"},
+		{"held counts", MemberSpend{Day: 0, Month: 0, Held: 95}, 10, "day"},
+		{"monthly cap", MemberSpend{Day: 0, Month: 950}, 60, "month"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := m.CheckCap(c.spend, c.amount)
+			if c.period == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, but got %v", err)
+				}
+				return
+			}
+			var ce *CapError
+			if !errors.As(err, &ce) || !errors.Is(err, ErrSpendCapExceeded) || ce.Period != c.period {
+				t.Fatalf("Expected %s cap error, but got %v", c.period, err)
+			}
+		})
+	}
+	if err := (Member{Role: RoleOwner}).CheckCap(MemberSpend{Day: 1 << 40}, 1<<40); err != nil {
+		t.Errorf("Expected no cap for zero caps, but got %v", err)
+	}
+}
+
+func TestPayerWallet(t *testing.T) {
+	if p := (Payer{UserID: "u1"}); p.WalletID() != "u1" || p.Funding() != FundingPersonal {
+		t.Errorf("Expected personal wallet u1, but got %s/%s", p.WalletID(), p.Funding())
+	}
+	p := Payer{UserID: "u1", OrgID: "o1"}
+	if p.WalletID() != "org:o1" || p.Funding() != FundingOrg {
+		t.Errorf("Expected org wallet org:o1, but got %s/%s", p.WalletID(), p.Funding())
+	}
+	if org, ok := WalletOrg(p.WalletID()); !ok || org != "o1" {
+		t.Errorf("Expected org o1, but got %q", org)
+	}
+	if _, ok := WalletOrg("u1"); ok {
+		t.Error("Expected user wallet not to be an org wallet")
+	}
+}
@@ -1,10 +1,21 @@
 package domain
 
+import (
+	"math"
+	"strings"
+	"time"
+)
+
 // Plan defines the structure for a subscription plan.
 type Plan struct {
-	ID            string
-	Name          string
+	ID             string
+	Name           string
 	IncludedTokens int64
+	// PriceCents is the monthly fee in the smallest unit of Currency.
+	PriceCents int64
+	Currency   string
+	// RolloverTokens caps the unused plan tokens carried into the next period; the rest expire.
+	RolloverTokens int64
 }
 
 // Plan IDs
@@ -17,22 +28,120 @@ const (
 // AvailablePlans maps plan IDs to their definitions.
 var AvailablePlans = map[string]Plan{
 	FreePlanID: {
-		ID:            FreePlanID,
-		Name:          "Free",
+		ID:             FreePlanID,
+		Name:           "Free",
 		IncludedTokens: 1000,
+		Currency:       "CNY",
 	},
 	ProPlanID: {
-		ID:            ProPlanID,
-		Name:          "Pro",
+		ID:             ProPlanID,
+		Name:           "Pro",
 		IncludedTokens: 10000,
+		PriceCents:     29800,
+		Currency:       "CNY",
+		RolloverTokens: 10000,
 	},
 	MaxPlanID: {
-		ID:            MaxPlanID,
-		Name:          "Max",
+		ID:             MaxPlanID,
+		Name:           "Max",
 		IncludedTokens: 100000,
+		PriceCents:     99800,
+		Currency:       "CNY",
+		RolloverTokens: 100000,
 	},
 }
 
+// LookupPlan finds a plan by id or name; rows written by older code use ids like "free-plan"
+// and names like "Pro".
+func LookupPlan(ids ...string) (Plan, bool) {
+	for _, id := range ids {
+		key := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(id)), "-plan")
+		if p, ok := AvailablePlans[key]; ok {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Rollover splits the plan tokens left at a period boundary into tokens carried over and tokens
+// that expire. Tokens spent during the period count against plan tokens first, so at most the
+// available balance is left of them.
+func (p Plan) Rollover(planTokens, available int64) (rollover, expire int64) {
+	left := planTokens
+	if available < left {
+		left = available
+	}
+	if left <= 0 {
+		return 0, 0
+	}
+	rollover = left
+	if rollover > p.RolloverTokens {
+		rollover = p.RolloverTokens
+	}
+	return rollover, left - rollover
+}
+
+// Proration is the adjustment for switching plans part-way through a period.
+type Proration struct {
+	// Fraction of the period left at the switch.
+	Fraction float64 `json:"fraction"`
+	// ChargeCents is owed now for an upgrade; CreditCents is credited to the next renewal for a
+	// downgrade.
+	ChargeCents int64 `json:"chargeCents"`
+	CreditCents int64 `json:"creditCents"`
+	// Tokens are the extra plan tokens granted now for an upgrade. Downgrades keep the tokens
+	// already granted.
+	Tokens int64 `json:"tokens"`
+}
+
+// Prorate computes the adjustment for switching from one plan to another at now within the
+// period [start, end).
+func Prorate(from, to Plan, start, end, now time.Time) Proration {
+	total := end.Sub(start)
+	if total <= 0 || !now.Before(end) {
+		return Proration{}
+	}
+	left := end.Sub(now)
+	if left > total {
+		left = total
+	}
+	p := Proration{Fraction: float64(left) / float64(total)}
+	if d := to.PriceCents - from.PriceCents; d > 0 {
+		p.ChargeCents = int64(math.Round(float64(d) * p.Fraction))
+	} else {
+		p.CreditCents = int64(math.Round(float64(-d) * p.Fraction))
+	}
+	if d := to.IncludedTokens - from.IncludedTokens; d > 0 {
+		p.Tokens = int64(math.Round(float64(d) * p.Fraction))
+	}
+	return p
+}
+
+// TopUpPackage is a one-off token purchase.
+type TopUpPackage struct {
+	ID         string `json:"id"`
+	Tokens     int64  `json:"tokens"`
+	PriceCents int64  `json:"priceCents"`
+	Currency   string `json:"currency"`
+}
+
+// TopUpPackages lists the token packages on sale, smallest first.
+var TopUpPackages = []TopUpPackage{
+	{ID: "tokens-1k", Tokens: 1000, PriceCents: 3000, Currency: "CNY"},
+	{ID: "tokens-10k", Tokens: 10000, PriceCents: 28000, Currency: "CNY"},
+	{ID: "tokens-100k", Tokens: 100000, PriceCents: 250000, Currency: "CNY"},
+}
+
+// LookupTopUp finds a top-up package by id.
+func LookupTopUp(id string) (TopUpPackage, bool) {
+	for _, p := range TopUpPackages {
+		if p.ID == strings.ToLower(strings.TrimSpace(id)) {
+			return p, true
+		}
+	}
+	return TopUpPackage{}, false
+}
+
 // TokenConsumptionRules defines the cost for various actions.
 const (
 	SiterankCachedQueryCost    = 1
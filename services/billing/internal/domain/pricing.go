@@ -0,0 +1,193 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Action keys priced by the price book. Callers reserve and commit by action key and quantity;
+// billing resolves the token amount.
+const (
+	ActionSiterankCached      = "siterank.query.cached"
+	ActionSiterankRealtime    = "siterank.query.realtime"
+	ActionSiterankAI          = "siterank.ai"
+	ActionBatchopenTask       = "batchopen.task"
+	ActionBatchopenBrowser    = "batchopen.task.browser"
+	ActionAdscenterPreflight  = "adscenter.preflight"
+	ActionAdscenterBulkAction = "adscenter.bulk.action"
+	ActionAdscenterCompliance = "adscenter.ai.compliance"
+	ActionWorkflowStart       = "workflow.start"
+)
+
+var (
+	// ErrUnknownAction is returned when an action key has no price.
+	ErrUnknownAction = errors.New("unknown action")
+	// ErrPriceBookNotFound is returned for unknown price book versions.
+	ErrPriceBookNotFound = errors.New("price book not found")
+)
+
+// PriceBook is one immutable version of the per-action token prices. A new version is
+// published to change prices; reservations keep the version they were priced with.
+type PriceBook struct {
+	Version     string    `json:"version"`
+	EffectiveAt time.Time `json:"effectiveAt"`
+	// Prices are the base token prices per unit of each action.
+	Prices map[string]int64 `json:"prices"`
+	// Plans holds per-plan overrides keyed by plan id.
+	Plans map[string]PlanPricing `json:"plans,omitempty"`
+}
+
+// PlanPricing adjusts the base prices for subscribers of one plan.
+type PlanPricing struct {
+	// Prices replace the base unit price of individual actions.
+	Prices map[string]int64 `json:"prices,omitempty"`
+	// DiscountPercent applies to every action of the plan; Discounts overrides it per action.
+	DiscountPercent int64            `json:"discountPercent,omitempty"`
+	Discounts       map[string]int64 `json:"discounts,omitempty"`
+}
+
+// Item is a quantity of one action.
+type Item struct {
+	Action   string `json:"action"`
+	Quantity int64  `json:"quantity"`
+}
+
+// QuoteLine is the price of one item.
+type QuoteLine struct {
+	Action          string `json:"action"`
+	Quantity        int64  `json:"quantity"`
+	UnitPrice       int64  `json:"unitPrice"`
+	DiscountPercent int64  `json:"discountPercent,omitempty"`
+	Amount          int64  `json:"amount"`
+}
+
+// Quote is the token amount for a set of items under one price book version and plan. Quotes
+// without a version carry a raw amount from callers that predate the price book.
+type Quote struct {
+	Version string      `json:"priceVersion,omitempty"`
+	PlanID  string      `json:"planId,omitempty"`
+	Lines   []QuoteLine `json:"lines,omitempty"`
+	Amount  int64       `json:"amount"`
+}
+
+// FlatQuote wraps a caller-supplied amount.
+func FlatQuote(amount int64) *Quote {
+	return &Quote{Amount: amount}
+}
+
+// Metadata describes the quote for transaction metadata.
+func (q *Quote) Metadata() map[string]any {
+	if q == nil || q.Version == "" {
+		return nil
+	}
+	return map[string]any{"priceVersion": q.Version, "planId": q.PlanID, "lines": q.Lines}
+}
+
+// DefaultPriceBook is the built-in price book, used until another version is published.
+func DefaultPriceBook() *PriceBook {
+	return &PriceBook{
+		Version: "default",
+		Prices: map[string]int64{
+			ActionSiterankCached:      SiterankCachedQueryCost,
+			ActionSiterankRealtime:    SiterankRealtimeQueryCost,
+			ActionSiterankAI:          SiterankAIEvaluationCost,
+			ActionBatchopenTask:       BatchopenHTTPCost,
+			ActionBatchopenBrowser:    BatchopenPuppeteerCost,
+			ActionAdscenterPreflight:  1,
+			ActionAdscenterBulkAction: 1,
+			ActionAdscenterCompliance: AdscenterAIComplianceCost,
+			ActionWorkflowStart:       WorkflowStartCost,
+		},
+	}
+}
+
+// Validate checks that every price is positive and every discount leaves something to pay.
+func (b *PriceBook) Validate() error {
+	if strings.TrimSpace(b.Version) == "" {
+		return fmt.Errorf("price book version required")
+	}
+	if len(b.Prices) == 0 {
+		return fmt.Errorf("price book %s has no prices", b.Version)
+	}
+	for action, p := range b.Prices {
+		if p <= 0 {
+			return fmt.Errorf("price of %s must be positive", action)
+		}
+	}
+	for plan, pp := range b.Plans {
+		for action, p := range pp.Prices {
+			if _, ok := b.Prices[action]; !ok {
+				return fmt.Errorf("plan %s overrides unknown action %s", plan, action)
+			}
+			if p <= 0 {
+				return fmt.Errorf("plan %s price of %s must be positive", plan, action)
+			}
+		}
+		discounts := []int64{pp.DiscountPercent}
+		for _, d := range pp.Discounts {
+			discounts = append(discounts, d)
+		}
+		for _, d := range discounts {
+			if d < 0 || d >= 100 {
+				return fmt.Errorf("plan %s discount must be within [0, 100)", plan)
+			}
+		}
+	}
+	return nil
+}
+
+// Actions returns the priced action keys in order.
+func (b *PriceBook) Actions() []string {
+	out := make([]string, 0, len(b.Prices))
+	for a := range b.Prices {
+		out = append(out, a)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Quote prices items for a subscriber of planID. Discounts round up, so every priced unit costs
+// at least one token.
+func (b *PriceBook) Quote(planID string, items ...Item) (*Quote, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no items", ErrUnknownAction)
+	}
+	pp := b.Plans[planID]
+	q := &Quote{Version: b.Version, PlanID: planID}
+	for _, it := range items {
+		action := strings.ToLower(strings.TrimSpace(it.Action))
+		unit, ok := b.Prices[action]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownAction, it.Action)
+		}
+		qty := it.Quantity
+		if qty <= 0 {
+			qty = 1
+		}
+		if p, ok := pp.Prices[action]; ok {
+			unit = p
+		}
+		discount := pp.DiscountPercent
+		if d, ok := pp.Discounts[action]; ok {
+			discount = d
+		}
+		amount := (unit*qty*(100-discount) + 99) / 100
+		q.Lines = append(q.Lines, QuoteLine{Action: action, Quantity: qty, UnitPrice: unit, DiscountPercent: discount, Amount: amount})
+		q.Amount += amount
+	}
+	return q, nil
+}
+
+// UnitPrices returns the per-unit price of every action for planID after overrides and discounts.
+func (b *PriceBook) UnitPrices(planID string) map[string]int64 {
+	out := make(map[string]int64, len(b.Prices))
+	for _, a := range b.Actions() {
+		if q, err := b.Quote(planID, Item{Action: a, Quantity: 1}); err == nil {
+			out[a] = q.Amount
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPriceBookQuote(t *testing.T) {
+	b := DefaultPriceBook()
+	b.Version = "v2"
+	b.Plans = map[string]PlanPricing{
+		ProPlanID: {DiscountPercent: 10},
+		MaxPlanID: {Prices: map[string]int64{ActionSiterankAI: 6}, DiscountPercent: 20, Discounts: map[string]int64{ActionSiterankAI: 0}},
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		plan  string
+		items []Item
+		want  int64
+	}{
+		{"base price", FreePlanID, []Item{{Action: ActionSiterankRealtime, Quantity: 3}}, 15},
+		{"quantity defaults to one", FreePlanID, []Item{{Action: ActionSiterankAI}}, 10},
+		{"plan discount rounds up", ProPlanID, []Item{{Action: ActionBatchopenTask, Quantity: 1}}, 1},
+		{"plan discount", ProPlanID, []Item{{Action: ActionSiterankRealtime, Quantity: 4}}, 18},
+		{"override without discount", MaxPlanID, []Item{{Action: ActionSiterankAI, Quantity: 2}}, 12},
+		{"several items", MaxPlanID, []Item{{Action: ActionSiterankCached, Quantity: 5}, {Action: ActionSiterankAI, Quantity: 1}}, 4 + 6},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := b.Quote(c.plan, c.items...)
+			if err != nil {
+				t.Fatalf("Quote: %v", err)
+			}
+			if q.Amount != c.want {
+				t.Errorf("Expected amount %d, but got %d (%+v)", c.want, q.Amount, q.Lines)
+			}
+			if q.Version != "v2" || q.PlanID != c.plan {
+				t.Errorf("Expected version v2 and plan %s, but got %s and %s", c.plan, q.Version, q.PlanID)
+			}
+		})
+	}
+
+	if _, err := b.Quote(FreePlanID, Item{Action: "siterank.unknown"}); !errors.Is(err, ErrUnknownAction) {
+		t.Errorf("Expected ErrUnknownAction, but got %v", err)
+	}
+}
+
+func TestPriceBookValidate(t *testing.T) {
+	bad := []*PriceBook{
+		{Version: "", Prices: map[string]int64{ActionBatchopenTask: 1}},
+		{Version: "v", Prices: map[string]int64{ActionBatchopenTask: 0}},
+		{Version: "v", Prices: map[string]int64{ActionBatchopenTask: 1}, Plans: map[string]PlanPricing{ProPlanID: {DiscountPercent: 100}}},
+		{Version: "v", Prices: map[string]int64{ActionBatchopenTask: 1}, Plans: map[string]PlanPricing{ProPlanID: {Prices: map[string]int64{"other": 1}}}},
+	}
+	for i, b := range bad {
+		if err := b.Validate(); err == nil {
+			t.Errorf("case %d: expected validation error", i)
+		}
+	}
+}
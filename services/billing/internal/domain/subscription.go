@@ -1,19 +1,42 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
 	"time"
 )
 
+// Subscription statuses. A subscription moves trialing → active at the end of the trial,
+// active → past_due when a renewal charge fails, past_due → active when a retry succeeds and
+// past_due → canceled when the grace period runs out (or at period end after a cancel request).
+const (
+	StatusTrialing = "trialing"
+	StatusActive   = "active"
+	StatusPastDue  = "past_due"
+	StatusCanceled = "canceled"
+)
+
+// ErrSubscriptionCanceled is returned for changes to a canceled subscription.
+var ErrSubscriptionCanceled = errors.New("subscription is canceled")
+
 // Subscription represents a user's subscription plan.
 type Subscription struct {
-	ID               string    `json:"id"`
-	UserID           string    `json:"userId"`
-	PlanID           string    `json:"planId"`
-	PlanName         string    `json:"planName"`
-	Status           string    `json:"status"` // "trialing", "active", "canceled"
-	TrialEndsAt      *time.Time `json:"trialEndsAt,omitempty"`
-	CurrentPeriodEnd time.Time `json:"currentPeriodEnd"`
-	StripeCustomerID string    `json:"stripeCustomerId,omitempty"`
+	ID                 string     `json:"id"`
+	UserID             string     `json:"userId"`
+	PlanID             string     `json:"planId"`
+	PlanName           string     `json:"planName"`
+	Status             string     `json:"status"` // "trialing", "active", "past_due", "canceled"
+	TrialEndsAt        *time.Time `json:"trialEndsAt,omitempty"`
+	CurrentPeriodStart time.Time  `json:"currentPeriodStart"`
+	CurrentPeriodEnd   time.Time  `json:"currentPeriodEnd"`
+	CancelAtPeriodEnd  bool       `json:"cancelAtPeriodEnd"`
+	PastDueSince       *time.Time `json:"pastDueSince,omitempty"`
+	// PlanTokens are the plan tokens credited for the current period (grant plus rollover);
+	// only these expire at period end, purchased and reward tokens never do.
+	PlanTokens int64 `json:"planTokens"`
+	// CreditCents is prorated credit from downgrades, applied to the next renewal charge.
+	CreditCents      int64  `json:"creditCents"`
+	StripeCustomerID string `json:"stripeCustomerId,omitempty"`
 }
 
 // NewTrialSubscription creates a new trial subscription for a user.
@@ -22,29 +45,83 @@ func NewTrialSubscription(id, userID, planID, planName string, trialDays int) *S
 	trialEnds := now.AddDate(0, 0, trialDays)
 
 	return &Subscription{
-		ID:               id,
-		UserID:           userID,
-		PlanID:           planID,
-		PlanName:         planName,
-		Status:           "trialing",
-		TrialEndsAt:      &trialEnds,
-		CurrentPeriodEnd: trialEnds,
+		ID:                 id,
+		UserID:             userID,
+		PlanID:             planID,
+		PlanName:           planName,
+		Status:             StatusTrialing,
+		TrialEndsAt:        &trialEnds,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   trialEnds,
 	}
 }
 
 // IsTrialing checks if the subscription is currently in a trial period.
 func (s *Subscription) IsTrialing() bool {
-	return s.Status == "trialing" && s.TrialEndsAt != nil && s.TrialEndsAt.After(time.Now())
+	return s.Status == StatusTrialing && s.TrialEndsAt != nil && s.TrialEndsAt.After(time.Now())
 }
 
 // Activate activates the subscription, typically after a successful payment.
 func (s *Subscription) Activate(periodEnd time.Time) {
-	s.Status = "active"
+	s.Status = StatusActive
 	s.TrialEndsAt = nil
+	s.PastDueSince = nil
 	s.CurrentPeriodEnd = periodEnd
 }
 
 // Cancel cancels the subscription.
 func (s *Subscription) Cancel() {
-	s.Status = "canceled"
+	s.Status = StatusCanceled
+	s.CancelAtPeriodEnd = false
+}
+
+// IsDue reports whether the current period (or trial) ended at now.
+func (s *Subscription) IsDue(now time.Time) bool {
+	return s.Status != StatusCanceled && !now.Before(s.CurrentPeriodEnd)
+}
+
+// Renew starts the next monthly period and activates the subscription. A subscription that
+// lapsed for more than a period restarts at now instead of back-filling missed periods.
+func (s *Subscription) Renew(now time.Time) {
+	start := s.CurrentPeriodEnd
+	end := start.AddDate(0, 1, 0)
+	if !end.After(now) {
+		start, end = now, now.AddDate(0, 1, 0)
+	}
+	s.CurrentPeriodStart = start
+	s.Activate(end)
+}
+
+// MarkPastDue records a failed renewal charge; the first failure starts the grace period.
+func (s *Subscription) MarkPastDue(now time.Time) {
+	if s.PastDueSince == nil {
+		t := now
+		s.PastDueSince = &t
+	}
+	s.Status = StatusPastDue
+}
+
+// GraceExpired reports whether a past-due subscription exhausted its grace period.
+func (s *Subscription) GraceExpired(now time.Time, grace time.Duration) bool {
+	return s.Status == StatusPastDue && s.PastDueSince != nil && !now.Before(s.PastDueSince.Add(grace))
+}
+
+// ChangePlan switches to plan and returns the proration for the rest of the current period.
+func (s *Subscription) ChangePlan(to Plan, now time.Time) (Proration, error) {
+	if s.Status == StatusCanceled {
+		return Proration{}, ErrSubscriptionCanceled
+	}
+	from, ok := LookupPlan(s.PlanID, s.PlanName)
+	if !ok {
+		return Proration{}, fmt.Errorf("unknown current plan %q", s.PlanID)
+	}
+	var p Proration
+	// trials switch plans freely; the first charge happens when the trial ends
+	if s.Status != StatusTrialing {
+		p = Prorate(from, to, s.CurrentPeriodStart, s.CurrentPeriodEnd, now)
+	}
+	s.PlanID, s.PlanName = to.ID, to.Name
+	s.PlanTokens += p.Tokens
+	s.CreditCents += p.CreditCents
+	return p, nil
 }
@@ -84,3 +84,94 @@ func TestCancel(t *testing.T) {
 		t.Errorf("Expected Status to be 'canceled', but got %s", sub.Status)
 	}
 }
+
+func TestRenewStartsNextPeriod(t *testing.T) {
+	end := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	sub := &Subscription{Status: StatusPastDue, CurrentPeriodEnd: end}
+	sub.MarkPastDue(end)
+	sub.Renew(end.Add(time.Hour))
+	if sub.Status != StatusActive || sub.PastDueSince != nil {
+		t.Fatalf("expected active subscription, got %+v", sub)
+	}
+	if !sub.CurrentPeriodStart.Equal(end) || !sub.CurrentPeriodEnd.Equal(end.AddDate(0, 1, 0)) {
+		t.Errorf("unexpected period %s - %s", sub.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	}
+
+	// a subscription that lapsed for months restarts now
+	now := end.AddDate(0, 3, 0)
+	sub.Renew(now)
+	if !sub.CurrentPeriodStart.Equal(now) || !sub.CurrentPeriodEnd.Equal(now.AddDate(0, 1, 0)) {
+		t.Errorf("expected period to restart at %s, got %s - %s", now, sub.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	}
+}
+
+func TestPastDueGrace(t *testing.T) {
+	now := time.Now()
+	sub := &Subscription{Status: StatusActive}
+	sub.MarkPastDue(now)
+	sub.MarkPastDue(now.Add(time.Hour)) // retries keep the original start
+	if !sub.PastDueSince.Equal(now) {
+		t.Fatalf("expected grace to start at the first failure, got %s", sub.PastDueSince)
+	}
+	if sub.GraceExpired(now.Add(6*24*time.Hour), 7*24*time.Hour) {
+		t.Error("grace expired too early")
+	}
+	if !sub.GraceExpired(now.Add(7*24*time.Hour), 7*24*time.Hour) {
+		t.Error("expected grace to expire after 7 days")
+	}
+}
+
+func TestChangePlanProrates(t *testing.T) {
+	start := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+	half := start.AddDate(0, 0, 15)
+	sub := &Subscription{Status: StatusActive, PlanID: ProPlanID, CurrentPeriodStart: start, CurrentPeriodEnd: end, PlanTokens: 10000}
+
+	up, err := sub.ChangePlan(AvailablePlans[MaxPlanID], half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.ChargeCents != 35000 || up.CreditCents != 0 || up.Tokens != 45000 {
+		t.Errorf("unexpected upgrade proration %+v", up)
+	}
+	if sub.PlanID != MaxPlanID || sub.PlanTokens != 55000 {
+		t.Errorf("unexpected subscription after upgrade %+v", sub)
+	}
+
+	down, err := sub.ChangePlan(AvailablePlans[FreePlanID], half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down.ChargeCents != 0 || down.CreditCents != 49900 || down.Tokens != 0 || sub.CreditCents != 49900 {
+		t.Errorf("unexpected downgrade proration %+v (credit %d)", down, sub.CreditCents)
+	}
+
+	sub.Cancel()
+	if _, err := sub.ChangePlan(AvailablePlans[ProPlanID], half); err != ErrSubscriptionCanceled {
+		t.Errorf("expected ErrSubscriptionCanceled, got %v", err)
+	}
+}
+
+func TestPlanRollover(t *testing.T) {
+	pro := AvailablePlans[ProPlanID]
+	cases := []struct {
+		planTokens, available, rollover, expire int64
+	}{
+		{10000, 50000, 10000, 0},     // nothing spent, everything rolls over
+		{20000, 50000, 10000, 10000}, // rollover capped at one period
+		{10000, 4000, 4000, 0},       // spending used plan tokens first
+		{10000, 0, 0, 0},
+	}
+	for _, c := range cases {
+		r, e := pro.Rollover(c.planTokens, c.available)
+		if r != c.rollover || e != c.expire {
+			t.Errorf("Rollover(%d, %d) = %d, %d; want %d, %d", c.planTokens, c.available, r, e, c.rollover, c.expire)
+		}
+	}
+	if r, e := AvailablePlans[FreePlanID].Rollover(1000, 1000); r != 0 || e != 1000 {
+		t.Errorf("free plan tokens must not roll over, got %d, %d", r, e)
+	}
+	if p, ok := LookupPlan("", "free-plan"); !ok || p.ID != FreePlanID {
+		t.Errorf("expected free-plan to resolve to free, got %+v", p)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log" // Using standard log for simplicity in this module
+	"time"
+
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
 )
 
 // UserCheckedInPayload defines the expected structure for "UserCheckedIn" event data.
@@ -72,7 +75,26 @@ func HandleUserCheckedIn(ctx context.Context, db *sql.DB, payload []byte) error
 
 	balanceAfter := balanceBefore + int64(rewardTokens)
 
-	// 2. Create the CheckIn record.
+	// 2. Post the grant to the ledger; a redelivered event finds its entry and stops here.
+	ref := data.IdempotencyKey
+	if ref == "" {
+		ref = time.Now().UTC().Format("2006-01-02")
+	}
+	entry := &ledger.Entry{
+		Kind: ledger.KindGrant, UserID: data.UserID, Reference: fmt.Sprintf("checkin:%s:%s", data.UserID, ref),
+		Description: "daily_check_in", Lines: ledger.Move(ledger.System(ledger.AccountPromo), ledger.Wallet(data.UserID), int64(rewardTokens)),
+		Metadata: map[string]any{"streak": data.Streak, "idempotencyKey": data.IdempotencyKey},
+	}
+	posted, err := ledger.Post(ctx, ledger.SQLExec(tx), entry)
+	if err != nil {
+		return fmt.Errorf("failed to post check-in grant: %w", err)
+	}
+	if !posted {
+		log.Printf("Check-in for userID %s already granted (%s). Skipping.", data.UserID, entry.Reference)
+		return nil
+	}
+
+	// 3. Create the CheckIn record.
 	_, err = tx.ExecContext(ctx,
 		`INSERT INTO "CheckIn" (id, "userId", date, tokens, streak) VALUES (DEFAULT, $1, NOW(), $2, $3)`,
 		data.UserID, rewardTokens, data.Streak,
@@ -85,7 +107,7 @@ func HandleUserCheckedIn(ctx context.Context, db *sql.DB, payload []byte) error
 		}
 	}
 
-	// 3. Upsert the UserToken balance.
+	// 4. Upsert the UserToken balance.
 	_, err = tx.ExecContext(ctx, `
         INSERT INTO "UserToken" ("userId", balance, "updatedAt")
         VALUES ($1, $2, NOW())
@@ -97,12 +119,12 @@ func HandleUserCheckedIn(ctx context.Context, db *sql.DB, payload []byte) error
 		return fmt.Errorf("failed to upsert user token balance: %w", err)
 	}
 
-	// 4. Create a TokenTransaction record.
+	// 5. Create a TokenTransaction record.
 	_, err = tx.ExecContext(ctx, `
         INSERT INTO "TokenTransaction"
         (id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata, "createdAt")
-        VALUES (DEFAULT, $1, 'ACTIVITY', $2, $3, $4, 'daily_check_in', $5, $6, NOW())
-    `, data.UserID, rewardTokens, balanceBefore, balanceAfter,
+        VALUES ($1, $2, 'ACTIVITY', $3, $4, $5, 'daily_check_in', $6, $7, NOW())
+    `, entry.ID, data.UserID, rewardTokens, balanceBefore, balanceAfter,
 		fmt.Sprintf("Daily check-in reward (Day %d)", data.Streak),
 		fmt.Sprintf(`{"streak":%d,"idempotencyKey":"%s"}`, data.Streak, data.IdempotencyKey),
 	)
@@ -141,7 +163,6 @@ func HandleOnboardingStepCompleted(ctx context.Context, db *sql.DB, payload []by
 	defer tx.Rollback()
 
 	// 1. Mark the step as completed for the user in the read model.
-	// This makes the operation idempotent.
 	_, err = tx.ExecContext(ctx, `
         INSERT INTO "UserChecklistProgress" (id, "userId", "stepId", "isCompleted", "completedAt")
         VALUES (DEFAULT, $1, $2, TRUE, NOW())
@@ -151,6 +172,21 @@ func HandleOnboardingStepCompleted(ctx context.Context, db *sql.DB, payload []by
 		return fmt.Errorf("failed to mark onboarding step as completed: %w", err)
 	}
 
+	// Post the grant to the ledger; the step reference makes the reward one-time.
+	entry := &ledger.Entry{
+		Kind: ledger.KindGrant, UserID: data.UserID, Reference: fmt.Sprintf("onboarding:%s:%s", data.UserID, data.StepID),
+		Description: "onboarding_reward", Lines: ledger.Move(ledger.System(ledger.AccountPromo), ledger.Wallet(data.UserID), int64(rewardTokens)),
+		Metadata: map[string]any{"stepId": data.StepID},
+	}
+	posted, err := ledger.Post(ctx, ledger.SQLExec(tx), entry)
+	if err != nil {
+		return fmt.Errorf("failed to post onboarding grant: %w", err)
+	}
+	if !posted {
+		log.Printf("Onboarding step %s already rewarded for userID %s. Skipping.", data.StepID, data.UserID)
+		return nil
+	}
+
 	// 2. Get current token balance.
 	var balanceBefore int64
 	err = tx.QueryRowContext(ctx, `SELECT balance FROM "UserToken" WHERE "userId" = $1 FOR UPDATE`, data.UserID).Scan(&balanceBefore)
@@ -178,8 +214,8 @@ func HandleOnboardingStepCompleted(ctx context.Context, db *sql.DB, payload []by
 	_, err = tx.ExecContext(ctx, `
         INSERT INTO "TokenTransaction"
         (id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata, "createdAt")
-        VALUES (DEFAULT, $1, 'ACTIVITY', $2, $3, $4, 'onboarding_reward', $5, $6, NOW())
-    `, data.UserID, rewardTokens, balanceBefore, balanceBefore+int64(rewardTokens),
+        VALUES ($1, $2, 'ACTIVITY', $3, $4, $5, 'onboarding_reward', $6, $7, NOW())
+    `, entry.ID, data.UserID, rewardTokens, balanceBefore, balanceBefore+int64(rewardTokens),
 		fmt.Sprintf("Onboarding reward for step: %s", data.StepID),
 		fmt.Sprintf(`{"stepId":"%s"}`, data.StepID),
 	)
@@ -0,0 +1,338 @@
+// Package grants issues tokens outside plans and purchases: promo codes ("PromoCode",
+// "PromoRedemption") and referral credits ("ReferralCode", "Referral"). Grants go through the
+// tokens store as lots with an expiry, so they are spent soonest-expiring first and lapse when
+// the expiry sweeper runs.
+package grants
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/tokens"
+)
+
+// ErrInvalid is returned for promo code input the store rejects.
+var ErrInvalid = errors.New("invalid promo code")
+
+// ErrInvalidGrant is returned for an admin grant without user, positive amount or reference.
+var ErrInvalidGrant = errors.New("invalid admin grant")
+
+// errSettled aborts a referral credit that was already paid out.
+var errSettled = errors.New("referral already credited")
+
+// Referral is one referred user and whether the referrer was credited for them.
+type Referral struct {
+	ReferredID string     `json:"referredId"`
+	ReferrerID string     `json:"referrerId"`
+	Code       string     `json:"code"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreditedAt *time.Time `json:"creditedAt,omitempty"`
+}
+
+// Referral statuses.
+const (
+	ReferralPending  = "pending"
+	ReferralCredited = "credited"
+)
+
+// Store reads and writes promo codes and referrals and grants their tokens.
+type Store struct {
+	db     *pgxpool.Pool
+	tokens *tokens.Store
+	// ReferralTokens is what a referrer is credited per referred user activating a paid plan.
+	ReferralTokens int64
+	// ReferralTTL is how long referral credits stay spendable (0 = forever).
+	ReferralTTL time.Duration
+}
+
+// New returns a Store backed by db granting through ts: 500 referral tokens for 90 days.
+func New(db *pgxpool.Pool, ts *tokens.Store) *Store {
+	return &Store{db: db, tokens: ts, ReferralTokens: 500, ReferralTTL: 90 * 24 * time.Hour}
+}
+
+// NormalizeCode trims and upper-cases a promo or referral code.
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// SetPromo creates a promo code or updates its terms; the redemption count is kept.
+func (s *Store) SetPromo(ctx context.Context, p domain.PromoCode, actor string) (*domain.PromoCode, error) {
+	p.Code = NormalizeCode(p.Code)
+	switch {
+	case p.Code == "" || len(p.Code) > 64:
+		return nil, fmt.Errorf("%w: code must be 1-64 characters", ErrInvalid)
+	case p.Tokens <= 0:
+		return nil, fmt.Errorf("%w: tokens must be positive", ErrInvalid)
+	case p.MaxRedemptions < 0 || p.GrantTTLDays < 0:
+		return nil, fmt.Errorf("%w: limits must not be negative", ErrInvalid)
+	case p.ValidFrom != nil && p.ValidUntil != nil && !p.ValidFrom.Before(*p.ValidUntil):
+		return nil, fmt.Errorf("%w: validFrom must be before validUntil", ErrInvalid)
+	}
+	row := s.db.QueryRow(ctx, `
+        INSERT INTO "PromoCode" (code, tokens, "maxRedemptions", "validFrom", "validUntil", "grantTtlDays", active, "createdBy", "createdAt", "updatedAt")
+        VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NOW(), NOW())
+        ON CONFLICT (code) DO UPDATE SET tokens=EXCLUDED.tokens, "maxRedemptions"=EXCLUDED."maxRedemptions", "validFrom"=EXCLUDED."validFrom",
+            "validUntil"=EXCLUDED."validUntil", "grantTtlDays"=EXCLUDED."grantTtlDays", active=EXCLUDED.active, "updatedAt"=NOW()
+        RETURNING `+promoColumns, p.Code, p.Tokens, p.MaxRedemptions, p.ValidFrom, p.ValidUntil, p.GrantTTLDays, p.Active, actor)
+	return scanPromo(row)
+}
+
+// Promos lists promo codes, newest first.
+func (s *Store) Promos(ctx context.Context, limit int) ([]*domain.PromoCode, error) {
+	rows, err := s.db.Query(ctx, `SELECT `+promoColumns+` FROM "PromoCode" ORDER BY "createdAt" DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query promo codes: %w", err)
+	}
+	defer rows.Close()
+	var out []*domain.PromoCode
+	for rows.Next() {
+		p, err := scanPromo(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Redeem credits code's tokens to userID. The redemption is recorded and counted in the same
+// transaction as the grant, so the limit holds under concurrent redemptions; TokensGranted is
+// recorded with it.
+func (s *Store) Redeem(ctx context.Context, userID, code string, now time.Time) (*tokens.Result, *domain.PromoCode, error) {
+	code = NormalizeCode(code)
+	p, err := scanPromo(s.db.QueryRow(ctx, `SELECT `+promoColumns+` FROM "PromoCode" WHERE code=$1`, code))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.CanRedeem(now); err != nil {
+		return nil, p, err
+	}
+	res, err := s.tokens.Grant(ctx, tokens.Grant{
+		UserID: userID, Amount: p.Tokens, From: ledger.AccountPromo, Reference: "promo:" + p.Code + ":" + userID,
+		Source: "promo", Description: "promo code " + p.Code, Category: domain.GrantPromo, ExpiresAt: p.GrantExpiry(now),
+		Metadata: map[string]any{"code": p.Code},
+		Events:   granted(domain.GrantPromo, p.Tokens, p.GrantExpiry(now), map[string]any{"code": p.Code}),
+		Guard: func(ctx context.Context, tx pgx.Tx) error {
+			cur, err := scanPromo(tx.QueryRow(ctx, `SELECT `+promoColumns+` FROM "PromoCode" WHERE code=$1 FOR UPDATE`, p.Code))
+			if err != nil {
+				return err
+			}
+			if err := cur.CanRedeem(now); err != nil {
+				return err
+			}
+			tag, err := tx.Exec(ctx, `INSERT INTO "PromoRedemption" (code, "userId", "createdAt") VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, p.Code, userID, now.UTC())
+			if err != nil {
+				return fmt.Errorf("failed to insert promo redemption: %w", err)
+			}
+			if tag.RowsAffected() == 0 {
+				return domain.ErrPromoRedeemed
+			}
+			if _, err := tx.Exec(ctx, `UPDATE "PromoCode" SET redeemed=redeemed+1, "updatedAt"=NOW() WHERE code=$1`, p.Code); err != nil {
+				return fmt.Errorf("failed to count promo redemption: %w", err)
+			}
+			return nil
+		},
+	})
+	return res, p, err
+}
+
+// AdminGrant is a manual grant issued from the console. Reference makes it idempotent: a request
+// retried with the same reference grants once.
+type AdminGrant struct {
+	UserID    string
+	Amount    int64
+	ExpiresAt *time.Time
+	Reason    string
+	Reference string
+	AdminID   string
+}
+
+// Admin credits an admin grant as a lot of kind domain.GrantAdmin (promo -> wallet) and records
+// TokensGranted with it.
+func (s *Store) Admin(ctx context.Context, g AdminGrant) (*tokens.Result, error) {
+	g.Reference = strings.TrimSpace(g.Reference)
+	if g.UserID == "" || g.Amount <= 0 || g.Reference == "" {
+		return nil, ErrInvalidGrant
+	}
+	extra := map[string]any{"adminId": g.AdminID, "reason": g.Reason}
+	return s.tokens.Grant(ctx, tokens.Grant{
+		UserID: g.UserID, Amount: g.Amount, From: ledger.AccountPromo, Reference: "admin:" + g.Reference,
+		Source: "console", Description: "admin_grant", Category: domain.GrantAdmin, ExpiresAt: g.ExpiresAt, CreatedBy: g.AdminID,
+		Metadata: map[string]any{"adminId": g.AdminID, "reason": g.Reason},
+		Events:   granted(domain.GrantAdmin, g.Amount, g.ExpiresAt, extra),
+	})
+}
+
+// ReferralCode returns userID's referral code, creating it on first use.
+func (s *Store) ReferralCode(ctx context.Context, userID string) (string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		if _, err := s.db.Exec(ctx, `INSERT INTO "ReferralCode" ("userId", code) VALUES ($1, $2) ON CONFLICT DO NOTHING`, userID, newCode()); err != nil {
+			return "", fmt.Errorf("failed to insert referral code: %w", err)
+		}
+		var code string
+		err := s.db.QueryRow(ctx, `SELECT code FROM "ReferralCode" WHERE "userId"=$1`, userID).Scan(&code)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("failed to query referral code: %w", err)
+		}
+		// the generated code was taken; try another
+	}
+	return "", fmt.Errorf("failed to allocate a referral code")
+}
+
+// Claim records that referredID signed up with code. A user is referred once, not by
+// themselves, and only before they pay for a plan.
+func (s *Store) Claim(ctx context.Context, referredID, code string) (*Referral, error) {
+	code = NormalizeCode(code)
+	ref := &Referral{ReferredID: referredID, Code: code, Status: ReferralPending}
+	err := s.db.QueryRow(ctx, `SELECT "userId" FROM "ReferralCode" WHERE code=$1`, code).Scan(&ref.ReferrerID)
+	if errors.Is(err, pgx.ErrNoRows) || ref.ReferrerID == referredID {
+		return nil, domain.ErrReferralInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referral code: %w", err)
+	}
+	var planID, status string
+	err = s.db.QueryRow(ctx, `SELECT COALESCE("planId", ''), status FROM "Subscription" WHERE "userId"=$1`, referredID).Scan(&planID, &status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query subscription: %w", err)
+	}
+	if plan, ok := domain.LookupPlan(planID); ok && plan.PriceCents > 0 && status != domain.StatusCanceled {
+		return nil, domain.ErrReferralClaimed
+	}
+	err = s.db.QueryRow(ctx, `
+        INSERT INTO "Referral" ("referredId", "referrerId", code, status, "createdAt") VALUES ($1, $2, $3, $4, NOW())
+        ON CONFLICT ("referredId") DO NOTHING
+        RETURNING "createdAt"
+    `, referredID, ref.ReferrerID, code, ReferralPending).Scan(&ref.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrReferralClaimed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert referral: %w", err)
+	}
+	return ref, nil
+}
+
+// Referrals lists the users referrerID referred, newest first.
+func (s *Store) Referrals(ctx context.Context, referrerID string, limit int) ([]Referral, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT "referredId", "referrerId", code, status, "createdAt", "creditedAt" FROM "Referral"
+        WHERE "referrerId"=$1 ORDER BY "createdAt" DESC LIMIT $2
+    `, referrerID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referrals: %w", err)
+	}
+	defer rows.Close()
+	var out []Referral
+	for rows.Next() {
+		var r Referral
+		if err := rows.Scan(&r.ReferredID, &r.ReferrerID, &r.Code, &r.Status, &r.CreatedAt, &r.CreditedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan referral: %w", err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Credit pays the referrer of referredID once the referred user activates a paid plan, recording
+// TokensGranted with the grant. It returns nil without a pending referral, so it can run on
+// every activation.
+func (s *Store) Credit(ctx context.Context, referredID string, now time.Time) (*Referral, *tokens.Result, error) {
+	ref := &Referral{ReferredID: referredID}
+	err := s.db.QueryRow(ctx, `
+        SELECT "referrerId", code, status, "createdAt" FROM "Referral" WHERE "referredId"=$1
+    `, referredID).Scan(&ref.ReferrerID, &ref.Code, &ref.Status, &ref.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query referral: %w", err)
+	}
+	if ref.Status != ReferralPending || s.ReferralTokens <= 0 {
+		return nil, nil, nil
+	}
+	var expires *time.Time
+	if s.ReferralTTL > 0 {
+		t := now.Add(s.ReferralTTL).UTC()
+		expires = &t
+	}
+	res, err := s.tokens.Grant(ctx, tokens.Grant{
+		UserID: ref.ReferrerID, Amount: s.ReferralTokens, From: ledger.AccountPromo, Reference: "referral:" + referredID,
+		Source: "referral", Description: "referral credit", Category: domain.GrantReferral, ExpiresAt: expires,
+		Metadata: map[string]any{"referredId": referredID, "code": ref.Code},
+		Events:   granted(domain.GrantReferral, s.ReferralTokens, expires, map[string]any{"referredId": referredID, "code": ref.Code}),
+		Guard: func(ctx context.Context, tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, `
+                UPDATE "Referral" SET status=$2, "creditedAt"=$3 WHERE "referredId"=$1 AND status=$4
+            `, referredID, ReferralCredited, now.UTC(), ReferralPending)
+			if err != nil {
+				return fmt.Errorf("failed to update referral: %w", err)
+			}
+			if tag.RowsAffected() == 0 {
+				return errSettled
+			}
+			return nil
+		},
+	})
+	if errors.Is(err, errSettled) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ref.Status, ref.CreditedAt = ReferralCredited, &now
+	return ref, res, nil
+}
+
+// granted builds the TokensGranted event of a promo, referral or admin grant.
+func granted(kind string, amount int64, expiresAt *time.Time, extra map[string]any) func(*tokens.Result) []ev.OutboxEvent {
+	return func(res *tokens.Result) []ev.OutboxEvent {
+		data := map[string]any{"txId": res.TxID, "userId": res.Wallet.UserID, "kind": kind, "amount": amount, "balance": res.Wallet.Balance, "time": time.Now().UTC().Format(time.RFC3339)}
+		if expiresAt != nil {
+			data["expiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+		}
+		for k, v := range extra {
+			data[k] = v
+		}
+		return []ev.OutboxEvent{{Type: ev.EventTokensGranted, Subject: res.Wallet.UserID, Data: data}}
+	}
+}
+
+const promoColumns = `code, tokens, "maxRedemptions", redeemed, "validFrom", "validUntil", "grantTtlDays", active, COALESCE("createdBy", ''), "createdAt"`
+
+func scanPromo(row pgx.Row) (*domain.PromoCode, error) {
+	var p domain.PromoCode
+	err := row.Scan(&p.Code, &p.Tokens, &p.MaxRedemptions, &p.Redeemed, &p.ValidFrom, &p.ValidUntil, &p.GrantTTLDays, &p.Active, &p.CreatedBy, &p.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrPromoNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan promo code: %w", err)
+	}
+	return &p, nil
+}
+
+// codeAlphabet leaves out characters that are easy to confuse (0/O, 1/I/L).
+const codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+func newCode() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b)
+}
@@ -0,0 +1,171 @@
+// Package ledger records every token movement as a balanced double-entry journal entry.
+//
+// Each entry has two or more lines whose amounts sum to zero; an account's balance is the sum
+// of its lines. User accounts (wallet, held) are qualified by user id, or by "org:<id>" for
+// organization wallets; system accounts are shared. "UserToken".balance is a cache of
+// wallet+held and "UserToken".held of held ("OrganizationWallet" likewise); the Reconciler
+// reports wallets whose cache disagrees with the ledger.
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Account names.
+const (
+	AccountWallet   = "wallet"   // user: spendable tokens
+	AccountHeld     = "held"     // user: tokens backing open reservations
+	AccountPromo    = "promo"    // system: check-in, onboarding and other reward grants
+	AccountPlan     = "plan"     // system: monthly subscription allowances
+	AccountRevenue  = "revenue"  // system: tokens spent on actions
+	AccountExpired  = "expired"  // system: tokens that lapsed unused
+	AccountOpening  = "opening"  // system: balances that predate the ledger
+	AccountPurchase = "purchase" // system: tokens bought with top-ups
+)
+
+// Entry kinds.
+const (
+	KindGrant    = "grant"
+	KindReserve  = "reserve"
+	KindCommit   = "commit"
+	KindRelease  = "release"
+	KindDebit    = "debit"
+	KindRefund   = "refund"
+	KindExpiry   = "expiry"
+	KindOpening  = "opening"
+	KindTransfer = "transfer"
+)
+
+// ErrUnbalanced is returned for entries whose lines do not sum to zero.
+var ErrUnbalanced = errors.New("ledger entry is unbalanced")
+
+// Account identifies a ledger account; UserID is empty for system accounts.
+type Account struct {
+	Name   string `json:"name"`
+	UserID string `json:"userId,omitempty"`
+}
+
+// Wallet returns the user's spendable account.
+func Wallet(userID string) Account { return Account{Name: AccountWallet, UserID: userID} }
+
+// Held returns the user's reservation account.
+func Held(userID string) Account { return Account{Name: AccountHeld, UserID: userID} }
+
+// System returns a shared account.
+func System(name string) Account { return Account{Name: name} }
+
+// Line is one side of an entry; positive amounts add tokens to the account.
+type Line struct {
+	Account
+	Amount int64 `json:"amount"`
+}
+
+// Move returns the lines that move amount from one account to another (none for zero).
+func Move(from, to Account, amount int64) []Line {
+	if amount == 0 {
+		return nil
+	}
+	return []Line{{Account: from, Amount: -amount}, {Account: to, Amount: amount}}
+}
+
+// Entry is a journal entry. Reference makes posting idempotent per kind (e.g. a reservation
+// id or an event idempotency key); entries without one are always posted.
+type Entry struct {
+	ID          string         `json:"id"`
+	Kind        string         `json:"kind"`
+	UserID      string         `json:"userId,omitempty"`
+	Reference   string         `json:"reference,omitempty"`
+	Description string         `json:"description"`
+	Lines       []Line         `json:"lines"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
+// Validate checks that the entry has lines, no empty accounts and sums to zero.
+func (e *Entry) Validate() error {
+	if e.Kind == "" {
+		return fmt.Errorf("ledger entry kind required")
+	}
+	if len(e.Lines) < 2 {
+		return fmt.Errorf("%w: %d lines", ErrUnbalanced, len(e.Lines))
+	}
+	var sum int64
+	for _, l := range e.Lines {
+		if l.Name == "" || l.Amount == 0 {
+			return fmt.Errorf("invalid ledger line %+v", l)
+		}
+		if (l.Name == AccountWallet || l.Name == AccountHeld) && l.UserID == "" {
+			return fmt.Errorf("user account %s without user id", l.Name)
+		}
+		sum += l.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: lines sum to %d", ErrUnbalanced, sum)
+	}
+	return nil
+}
+
+// Exec runs a statement in the caller's transaction and reports the affected rows, so entries
+// commit atomically with the balance change they describe whichever driver the caller uses.
+type Exec func(ctx context.Context, query string, args ...any) (int64, error)
+
+// PgxExec adapts a pgx transaction.
+func PgxExec(tx pgx.Tx) Exec {
+	return func(ctx context.Context, query string, args ...any) (int64, error) {
+		tag, err := tx.Exec(ctx, query, args...)
+		return tag.RowsAffected(), err
+	}
+}
+
+// SQLExec adapts a database/sql transaction.
+func SQLExec(tx *sql.Tx) Exec {
+	return func(ctx context.Context, query string, args ...any) (int64, error) {
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+}
+
+// Post validates and writes e. It returns false without writing when an entry of the same kind
+// and reference was already posted.
+func Post(ctx context.Context, exec Exec, e *Entry) (bool, error) {
+	if err := e.Validate(); err != nil {
+		return false, err
+	}
+	if e.ID == "" {
+		e.ID = uuid.NewString()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	meta, _ := json.Marshal(e.Metadata)
+	n, err := exec(ctx, `
+        INSERT INTO "LedgerEntry" (id, kind, "userId", reference, description, metadata, "createdAt")
+        VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6::jsonb, $7)
+        ON CONFLICT (kind, reference) WHERE reference <> '' DO NOTHING
+    `, e.ID, e.Kind, e.UserID, e.Reference, e.Description, string(meta), e.CreatedAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to insert ledger entry: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	for _, l := range e.Lines {
+		if _, err := exec(ctx, `
+            INSERT INTO "LedgerLine" ("entryId", account, "userId", amount) VALUES ($1, $2, NULLIF($3, ''), $4)
+        `, e.ID, l.Name, l.UserID, l.Amount); err != nil {
+			return false, fmt.Errorf("failed to insert ledger line: %w", err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []Line
+		ok    bool
+	}{
+		{"grant", Move(System(AccountPromo), Wallet("u1"), 10), true},
+		{"commit with release", append(Move(Held("u1"), System(AccountRevenue), 4), Move(Held("u1"), Wallet("u1"), 6)...), true},
+		{"single line", []Line{{Account: Wallet("u1"), Amount: 10}}, false},
+		{"unbalanced", []Line{{Account: System(AccountPromo), Amount: -10}, {Account: Wallet("u1"), Amount: 9}}, false},
+		{"user account without user", Move(System(AccountPromo), Account{Name: AccountWallet}, 10), false},
+		{"zero amount", Move(System(AccountPromo), Wallet("u1"), 0), false},
+	}
+	for _, c := range cases {
+		e := &Entry{Kind: KindGrant, Lines: c.lines}
+		if err := e.Validate(); (err == nil) != c.ok {
+			t.Errorf("%s: Validate() = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+	e := &Entry{Kind: KindGrant, Lines: []Line{{Account: System(AccountPromo), Amount: -10}, {Account: Wallet("u1"), Amount: 9}}}
+	if err := e.Validate(); !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("expected ErrUnbalanced, got %v", err)
+	}
+}
+
+func TestPostSkipsDuplicateReference(t *testing.T) {
+	posted := map[string]bool{}
+	var lines int
+	exec := func(_ context.Context, query string, args ...any) (int64, error) {
+		if strings.Contains(query, `"LedgerEntry"`) {
+			key := args[1].(string) + "|" + args[3].(string)
+			if posted[key] {
+				return 0, nil
+			}
+			posted[key] = true
+			return 1, nil
+		}
+		lines++
+		return 1, nil
+	}
+	for i := 0; i < 2; i++ {
+		ok, err := Post(context.Background(), exec, &Entry{Kind: KindGrant, UserID: "u1", Reference: "checkin:u1:k1", Lines: Move(System(AccountPromo), Wallet("u1"), 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i == 0) {
+			t.Fatalf("post %d: posted=%v", i, ok)
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("expected lines written once, got %d", lines)
+	}
+}
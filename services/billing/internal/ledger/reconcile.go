@@ -0,0 +1,134 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+)
+
+// Mismatch is a user whose cached wallet disagrees with the journal.
+type Mismatch struct {
+	UserID        string `json:"userId"`
+	CachedBalance int64  `json:"cachedBalance"`
+	LedgerBalance int64  `json:"ledgerBalance"`
+	CachedHeld    int64  `json:"cachedHeld"`
+	LedgerHeld    int64  `json:"ledgerHeld"`
+}
+
+// Report is the outcome of one reconciliation run.
+type Report struct {
+	ID         string     `json:"id"`
+	RunAt      time.Time  `json:"runAt"`
+	Users      int64      `json:"users"`
+	Mismatches []Mismatch `json:"mismatches"`
+	// Unbalanced lists entries whose lines do not sum to zero (only possible through manual edits).
+	Unbalanced []string `json:"unbalanced"`
+}
+
+// Reconciler compares "UserToken" and "OrganizationWallet" against the journal and stores a report
+// per run.
+type Reconciler struct {
+	db *pgxpool.Pool
+	// Limit bounds the mismatches and unbalanced entries listed per report.
+	Limit int
+}
+
+// NewReconciler returns a Reconciler backed by db.
+func NewReconciler(db *pgxpool.Pool) *Reconciler {
+	return &Reconciler{db: db, Limit: 500}
+}
+
+// Run reconciles every wallet and stores the report in "LedgerReconciliation".
+func (r *Reconciler) Run(ctx context.Context) (*Report, error) {
+	rep := &Report{ID: uuid.NewString(), RunAt: time.Now().UTC(), Mismatches: []Mismatch{}, Unbalanced: []string{}}
+	// users with a wallet row, ledger lines or both; a missing side counts as zero
+	rows, err := r.db.Query(ctx, `
+        WITH journal AS (
+            SELECT "userId", SUM(amount)::bigint AS balance, COALESCE(SUM(amount) FILTER (WHERE account = $1), 0)::bigint AS held
+            FROM "LedgerLine" WHERE "userId" IS NOT NULL
+            GROUP BY "userId"
+        ), cached AS (
+            SELECT "userId", balance, held FROM "UserToken"
+            UNION ALL
+            SELECT $2 || "orgId", balance, held FROM "OrganizationWallet"
+        )
+        SELECT COALESCE(c."userId", j."userId"), COALESCE(c.balance, 0), COALESCE(j.balance, 0), COALESCE(c.held, 0), COALESCE(j.held, 0),
+               COUNT(*) OVER ()
+        FROM cached c FULL OUTER JOIN journal j ON j."userId" = c."userId"
+        ORDER BY (COALESCE(c.balance, 0) <> COALESCE(j.balance, 0) OR COALESCE(c.held, 0) <> COALESCE(j.held, 0)) DESC, 1
+    `, AccountHeld, domain.OrgWalletPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query balances: %w", err)
+	}
+	for rows.Next() {
+		var m Mismatch
+		if err := rows.Scan(&m.UserID, &m.CachedBalance, &m.LedgerBalance, &m.CachedHeld, &m.LedgerHeld, &rep.Users); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan balances: %w", err)
+		}
+		// mismatches sort first, so the first matching row ends the list
+		if m.CachedBalance == m.LedgerBalance && m.CachedHeld == m.LedgerHeld {
+			break
+		}
+		if len(rep.Mismatches) < r.Limit {
+			rep.Mismatches = append(rep.Mismatches, m)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate balances: %w", err)
+	}
+
+	rows, err = r.db.Query(ctx, `
+        SELECT "entryId" FROM "LedgerLine" GROUP BY "entryId" HAVING SUM(amount) <> 0 ORDER BY 1 LIMIT $1
+    `, r.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unbalanced entries: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan entry: %w", err)
+		}
+		rep.Unbalanced = append(rep.Unbalanced, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate entries: %w", err)
+	}
+
+	mismatches, _ := json.Marshal(rep.Mismatches)
+	unbalanced, _ := json.Marshal(rep.Unbalanced)
+	if _, err := r.db.Exec(ctx, `
+        INSERT INTO "LedgerReconciliation" (id, "runAt", users, mismatches, unbalanced) VALUES ($1, $2, $3, $4::jsonb, $5::jsonb)
+    `, rep.ID, rep.RunAt, rep.Users, string(mismatches), string(unbalanced)); err != nil {
+		return rep, fmt.Errorf("failed to store reconciliation: %w", err)
+	}
+	return rep, nil
+}
+
+// Latest returns the most recent stored report, or nil when reconciliation never ran.
+func (r *Reconciler) Latest(ctx context.Context) (*Report, error) {
+	var rep Report
+	var mismatches, unbalanced []byte
+	err := r.db.QueryRow(ctx, `
+        SELECT id, "runAt", users, mismatches, unbalanced FROM "LedgerReconciliation" ORDER BY "runAt" DESC LIMIT 1
+    `).Scan(&rep.ID, &rep.RunAt, &rep.Users, &mismatches, &unbalanced)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query reconciliation: %w", err)
+	}
+	_ = json.Unmarshal(mismatches, &rep.Mismatches)
+	_ = json.Unmarshal(unbalanced, &rep.Unbalanced)
+	return &rep, nil
+}
@@ -0,0 +1,26 @@
+-- Token holds: reservations move tokens from available to held until they are committed,
+-- released or expired. Available balance = balance - held.
+
+ALTER TABLE "UserToken" ADD COLUMN IF NOT EXISTS "held" BIGINT NOT NULL DEFAULT 0 CHECK ("held" >= 0);
+
+CREATE TABLE IF NOT EXISTS "TokenReservation" (
+  "id"        TEXT NOT NULL PRIMARY KEY,
+  "userId"    TEXT NOT NULL REFERENCES "User"("id") ON DELETE CASCADE,
+  "taskId"    TEXT NOT NULL DEFAULT '',
+  "amount"    BIGINT NOT NULL CHECK ("amount" > 0),
+  "committed" BIGINT NOT NULL DEFAULT 0,
+  "released"  BIGINT NOT NULL DEFAULT 0,
+  "status"    TEXT NOT NULL,
+  "expiresAt" TIMESTAMPTZ NOT NULL,
+  "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "updatedAt" TIMESTAMPTZ NOT NULL DEFAULT now(),
+  CHECK ("committed" + "released" <= "amount")
+);
+CREATE INDEX IF NOT EXISTS "TokenReservation_userId_taskId_idx" ON "TokenReservation"("userId", "taskId");
+CREATE INDEX IF NOT EXISTS "TokenReservation_held_expiresAt_idx" ON "TokenReservation"("expiresAt") WHERE "status" = 'held';
+-- at most one open hold per task
+CREATE UNIQUE INDEX IF NOT EXISTS "TokenReservation_open_task_key" ON "TokenReservation"("userId", "taskId") WHERE "status" = 'held' AND "taskId" <> '';
+
+-- settlement rows point back at their reservation
+ALTER TABLE "TokenTransaction" ADD COLUMN IF NOT EXISTS "reservationId" TEXT;
+CREATE INDEX IF NOT EXISTS "TokenTransaction_reservationId_idx" ON "TokenTransaction"("reservationId");
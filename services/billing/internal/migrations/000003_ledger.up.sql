@@ -0,0 +1,69 @@
+-- Double-entry token ledger: every grant, reservation, spend, release, refund and expiry is a
+-- "LedgerEntry" whose "LedgerLine" amounts sum to zero. User accounts (wallet, held) carry the
+-- user id, system accounts (promo, revenue, expired, opening) do not. "UserToken".balance caches
+-- wallet + held and "UserToken".held caches held.
+
+CREATE TABLE IF NOT EXISTS "LedgerEntry" (
+  "id"          TEXT NOT NULL PRIMARY KEY,
+  "kind"        TEXT NOT NULL,
+  "userId"      TEXT,
+  "reference"   TEXT NOT NULL DEFAULT '',
+  "description" TEXT NOT NULL DEFAULT '',
+  "metadata"    JSONB,
+  "createdAt"   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "LedgerEntry_userId_createdAt_idx" ON "LedgerEntry"("userId", "createdAt");
+-- posting the same (kind, reference) twice is a no-op
+CREATE UNIQUE INDEX IF NOT EXISTS "LedgerEntry_kind_reference_key" ON "LedgerEntry"("kind", "reference") WHERE "reference" <> '';
+
+CREATE TABLE IF NOT EXISTS "LedgerLine" (
+  "id"      BIGSERIAL PRIMARY KEY,
+  "entryId" TEXT NOT NULL REFERENCES "LedgerEntry"("id") ON DELETE CASCADE,
+  "account" TEXT NOT NULL,
+  "userId"  TEXT,
+  "amount"  BIGINT NOT NULL CHECK ("amount" <> 0)
+);
+CREATE INDEX IF NOT EXISTS "LedgerLine_entryId_idx" ON "LedgerLine"("entryId");
+CREATE INDEX IF NOT EXISTS "LedgerLine_userId_account_idx" ON "LedgerLine"("userId", "account");
+
+CREATE TABLE IF NOT EXISTS "LedgerReconciliation" (
+  "id"         TEXT NOT NULL PRIMARY KEY,
+  "runAt"      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "users"      BIGINT NOT NULL DEFAULT 0,
+  "mismatches" JSONB NOT NULL DEFAULT '[]',
+  "unbalanced" JSONB NOT NULL DEFAULT '[]'
+);
+CREATE INDEX IF NOT EXISTS "LedgerReconciliation_runAt_idx" ON "LedgerReconciliation"("runAt" DESC);
+
+-- One-time data steps of the ledger migrations. A step runs only while its row is missing.
+CREATE TABLE IF NOT EXISTS "LedgerBackfill" (
+  "name"      TEXT NOT NULL PRIMARY KEY,
+  "appliedAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Opening entries for wallets that predate the ledger, so existing balances reconcile. This runs
+-- once, before the ledger has posted anything else. Afterwards a wallet changed outside the
+-- ledger is reported by reconciliation instead of being given a new opening entry.
+INSERT INTO "LedgerEntry" ("id", "kind", "userId", "reference", "description", "createdAt")
+SELECT 'opening:' || t."userId", 'opening', t."userId", t."userId", 'opening balance', now()
+FROM "UserToken" t
+WHERE (t."balance" <> 0 OR t."held" <> 0)
+  AND NOT EXISTS (SELECT 1 FROM "LedgerBackfill" b WHERE b."name" = 'opening_balances')
+  AND NOT EXISTS (SELECT 1 FROM "LedgerEntry" e WHERE e."kind" <> 'opening')
+  AND NOT EXISTS (SELECT 1 FROM "LedgerLine" l WHERE l."userId" = t."userId")
+ON CONFLICT DO NOTHING;
+
+INSERT INTO "LedgerLine" ("entryId", "account", "userId", "amount")
+SELECT e."id", v."account", v."userId", v."amount"
+FROM "LedgerEntry" e
+JOIN "UserToken" t ON t."userId" = e."userId"
+CROSS JOIN LATERAL (VALUES
+  ('wallet', t."userId", t."balance" - t."held"),
+  ('held', t."userId", t."held"),
+  ('opening', NULL, -t."balance")
+) AS v("account", "userId", "amount")
+WHERE e."kind" = 'opening' AND v."amount" <> 0
+  AND NOT EXISTS (SELECT 1 FROM "LedgerBackfill" b WHERE b."name" = 'opening_balances')
+  AND NOT EXISTS (SELECT 1 FROM "LedgerLine" l WHERE l."entryId" = e."id");
+
+INSERT INTO "LedgerBackfill" ("name") VALUES ('opening_balances') ON CONFLICT DO NOTHING;
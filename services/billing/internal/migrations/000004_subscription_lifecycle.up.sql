@@ -0,0 +1,30 @@
+-- Subscription lifecycle: period bookkeeping for renewals, past-due retries and plan token
+-- rollover, plus a history of lifecycle transitions.
+
+ALTER TABLE "Subscription"
+  ADD COLUMN IF NOT EXISTS "currentPeriodStart" TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS "cancelAtPeriodEnd"  BOOLEAN NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS "pastDueSince"       TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS "nextAttemptAt"      TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS "planTokens"         BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS "creditCents"        BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS "updatedAt"          TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS "Subscription_status_currentPeriodEnd_idx" ON "Subscription"("status", "currentPeriodEnd");
+
+CREATE TABLE IF NOT EXISTS "SubscriptionTransition" (
+  "id"             TEXT NOT NULL PRIMARY KEY,
+  "subscriptionId" TEXT NOT NULL,
+  "userId"         TEXT NOT NULL,
+  "planId"         TEXT NOT NULL,
+  "event"          TEXT NOT NULL,
+  "from"           TEXT NOT NULL,
+  "to"             TEXT NOT NULL,
+  "reason"         TEXT NOT NULL DEFAULT '',
+  "periodStart"    TIMESTAMPTZ,
+  "periodEnd"      TIMESTAMPTZ,
+  "chargedCents"   BIGINT NOT NULL DEFAULT 0,
+  "granted"        BIGINT NOT NULL DEFAULT 0,
+  "expired"        BIGINT NOT NULL DEFAULT 0,
+  "createdAt"      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "SubscriptionTransition_userId_createdAt_idx" ON "SubscriptionTransition"("userId", "createdAt");
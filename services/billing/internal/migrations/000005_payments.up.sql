@@ -0,0 +1,37 @@
+-- Payments: checkout sessions started through a payment provider and the provider webhook
+-- events applied for them. Events are unique per provider event id so redeliveries are no-ops.
+
+CREATE TABLE IF NOT EXISTS "PaymentCheckout" (
+  "id"          TEXT NOT NULL PRIMARY KEY,
+  "provider"    TEXT NOT NULL,
+  "userId"      TEXT NOT NULL,
+  "kind"        TEXT NOT NULL,
+  "planId"      TEXT NOT NULL DEFAULT '',
+  "packageId"   TEXT NOT NULL DEFAULT '',
+  "tokens"      BIGINT NOT NULL DEFAULT 0,
+  "amountCents" BIGINT NOT NULL,
+  "currency"    TEXT NOT NULL,
+  "status"      TEXT NOT NULL DEFAULT 'open',
+  "url"         TEXT NOT NULL DEFAULT '',
+  "eventId"     TEXT,
+  "createdAt"   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "completedAt" TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS "PaymentCheckout_userId_createdAt_idx" ON "PaymentCheckout"("userId", "createdAt");
+
+CREATE TABLE IF NOT EXISTS "PaymentEvent" (
+  "provider"    TEXT NOT NULL,
+  "eventId"     TEXT NOT NULL,
+  "type"        TEXT NOT NULL,
+  "objectId"    TEXT NOT NULL DEFAULT '',
+  "userId"      TEXT,
+  "status"      TEXT NOT NULL,
+  "payload"     JSONB NOT NULL,
+  "error"       TEXT,
+  "attempts"    INT NOT NULL DEFAULT 1,
+  "createdAt"   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "updatedAt"   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "processedAt" TIMESTAMPTZ,
+  PRIMARY KEY ("provider", "eventId")
+);
+CREATE INDEX IF NOT EXISTS "PaymentEvent_status_updatedAt_idx" ON "PaymentEvent"("status", "updatedAt");
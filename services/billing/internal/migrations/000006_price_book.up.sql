@@ -0,0 +1,19 @@
+-- Price book: versioned per-action token prices with per-plan overrides and discounts. Rows
+-- are immutable, and the active version is the latest one whose effectiveAt has passed.
+
+CREATE TABLE IF NOT EXISTS "PriceBook" (
+  "version"     TEXT NOT NULL PRIMARY KEY,
+  "effectiveAt" TIMESTAMPTZ NOT NULL,
+  "book"        JSONB NOT NULL,
+  "createdAt"   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "PriceBook_effectiveAt_idx" ON "PriceBook"("effectiveAt");
+
+-- reservations keep the version and plan they were priced with, so commits by action price the same way
+ALTER TABLE "TokenReservation"
+  ADD COLUMN IF NOT EXISTS "priceVersion" TEXT,
+  ADD COLUMN IF NOT EXISTS "planId"       TEXT;
+
+-- every reserve/commit/release row records the price version it was charged under
+ALTER TABLE "TokenTransaction" ADD COLUMN IF NOT EXISTS "priceVersion" TEXT;
+CREATE INDEX IF NOT EXISTS "TokenTransaction_priceVersion_idx" ON "TokenTransaction"("priceVersion") WHERE "priceVersion" IS NOT NULL;
@@ -0,0 +1,20 @@
+-- Monthly usage statements. One row per user and month, numbered per user by "sequence", and the
+-- figures live in "data" with a checksum. Statements are immutable: the rules below turn
+-- updates and deletes into no-ops.
+
+CREATE TABLE IF NOT EXISTS "UsageStatement" (
+  "id"          TEXT NOT NULL PRIMARY KEY,
+  "userId"      TEXT NOT NULL,
+  "sequence"    BIGINT NOT NULL,
+  "periodStart" TIMESTAMPTZ NOT NULL,
+  "periodEnd"   TIMESTAMPTZ NOT NULL,
+  "data"        JSONB NOT NULL,
+  "checksum"    TEXT NOT NULL,
+  "createdAt"   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "UsageStatement_userId_sequence_key" ON "UsageStatement"("userId", "sequence");
+CREATE UNIQUE INDEX IF NOT EXISTS "UsageStatement_userId_periodStart_key" ON "UsageStatement"("userId", "periodStart");
+CREATE INDEX IF NOT EXISTS "UsageStatement_periodStart_idx" ON "UsageStatement"("periodStart");
+
+CREATE OR REPLACE RULE "UsageStatement_no_update" AS ON UPDATE TO "UsageStatement" DO INSTEAD NOTHING;
+CREATE OR REPLACE RULE "UsageStatement_no_delete" AS ON DELETE TO "UsageStatement" DO INSTEAD NOTHING;
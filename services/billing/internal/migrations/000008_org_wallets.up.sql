@@ -0,0 +1,39 @@
+-- Organizations share one token wallet among their members. "OrganizationWallet" caches the
+-- ledger's "org:<id>" wallet like "UserToken" does for users. Members have a role and optional
+-- daily/monthly spend caps on the shared wallet (0 = no cap).
+
+CREATE TABLE IF NOT EXISTS "Organization" (
+  "id"        TEXT NOT NULL PRIMARY KEY,
+  "name"      TEXT NOT NULL,
+  "ownerId"   TEXT NOT NULL REFERENCES "User"("id"),
+  "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "updatedAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS "OrganizationMember" (
+  "orgId"      TEXT NOT NULL REFERENCES "Organization"("id") ON DELETE CASCADE,
+  "userId"     TEXT NOT NULL REFERENCES "User"("id") ON DELETE CASCADE,
+  "role"       TEXT NOT NULL,
+  "dailyCap"   BIGINT NOT NULL DEFAULT 0 CHECK ("dailyCap" >= 0),
+  "monthlyCap" BIGINT NOT NULL DEFAULT 0 CHECK ("monthlyCap" >= 0),
+  "createdAt"  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "updatedAt"  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY ("orgId", "userId")
+);
+CREATE INDEX IF NOT EXISTS "OrganizationMember_userId_idx" ON "OrganizationMember"("userId");
+
+CREATE TABLE IF NOT EXISTS "OrganizationWallet" (
+  "orgId"     TEXT NOT NULL PRIMARY KEY REFERENCES "Organization"("id") ON DELETE CASCADE,
+  "balance"   BIGINT NOT NULL DEFAULT 0,
+  "held"      BIGINT NOT NULL DEFAULT 0 CHECK ("held" >= 0),
+  "updatedAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- reservations remember the wallet they draw on (NULL: the user's own)
+ALTER TABLE "TokenReservation" ADD COLUMN IF NOT EXISTS "walletId" TEXT;
+CREATE INDEX IF NOT EXISTS "TokenReservation_walletId_userId_idx" ON "TokenReservation"("walletId", "userId") WHERE "status" = 'held';
+
+-- every transaction records whether the user's own or an organization's wallet funded it
+ALTER TABLE "TokenTransaction" ADD COLUMN IF NOT EXISTS "fundingSource" TEXT NOT NULL DEFAULT 'personal';
+ALTER TABLE "TokenTransaction" ADD COLUMN IF NOT EXISTS "orgId" TEXT;
+CREATE INDEX IF NOT EXISTS "TokenTransaction_orgId_userId_createdAt_idx" ON "TokenTransaction"("orgId", "userId", "createdAt") WHERE "orgId" IS NOT NULL;
@@ -0,0 +1,59 @@
+-- Granted tokens are tracked in lots so that spends draw on the soonest-expiring lot first and
+-- what a lot still holds at "expiresAt" lapses ("expiresAt" NULL never expires). "remaining"
+-- never exceeds what the wallet holds, and tokens outside any lot (plan allowances, purchases,
+-- rewards) are spent after the lots.
+
+CREATE TABLE IF NOT EXISTS "TokenGrant" (
+  "id"        TEXT NOT NULL PRIMARY KEY,
+  "walletId"  TEXT NOT NULL,
+  "kind"      TEXT NOT NULL,
+  "amount"    BIGINT NOT NULL CHECK ("amount" > 0),
+  "remaining" BIGINT NOT NULL CHECK ("remaining" >= 0),
+  "expiresAt" TIMESTAMPTZ,
+  "reference" TEXT,
+  "createdBy" TEXT,
+  "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "TokenGrant_walletId_idx" ON "TokenGrant"("walletId") WHERE "remaining" > 0;
+CREATE INDEX IF NOT EXISTS "TokenGrant_expiresAt_idx" ON "TokenGrant"("expiresAt") WHERE "remaining" > 0 AND "expiresAt" IS NOT NULL;
+
+-- Promo codes: each user redeems a code once, within its window and up to "maxRedemptions"
+-- redemptions in total (0 = unlimited). Granted tokens expire "grantTtlDays" after redemption.
+CREATE TABLE IF NOT EXISTS "PromoCode" (
+  "code"           TEXT NOT NULL PRIMARY KEY,
+  "tokens"         BIGINT NOT NULL CHECK ("tokens" > 0),
+  "maxRedemptions" BIGINT NOT NULL DEFAULT 0 CHECK ("maxRedemptions" >= 0),
+  "redeemed"       BIGINT NOT NULL DEFAULT 0,
+  "validFrom"      TIMESTAMPTZ,
+  "validUntil"     TIMESTAMPTZ,
+  "grantTtlDays"   INTEGER NOT NULL DEFAULT 0 CHECK ("grantTtlDays" >= 0),
+  "active"         BOOLEAN NOT NULL DEFAULT true,
+  "createdBy"      TEXT,
+  "createdAt"      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "updatedAt"      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS "PromoRedemption" (
+  "code"      TEXT NOT NULL REFERENCES "PromoCode"("code") ON DELETE CASCADE,
+  "userId"    TEXT NOT NULL,
+  "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY ("code", "userId")
+);
+
+-- Referrals: every user has one code to share, a referred user claims it once, and the referrer
+-- is credited when the referred user first activates a paid plan.
+CREATE TABLE IF NOT EXISTS "ReferralCode" (
+  "userId"    TEXT NOT NULL PRIMARY KEY,
+  "code"      TEXT NOT NULL UNIQUE,
+  "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS "Referral" (
+  "referredId" TEXT NOT NULL PRIMARY KEY,
+  "referrerId" TEXT NOT NULL,
+  "code"       TEXT NOT NULL,
+  "status"     TEXT NOT NULL DEFAULT 'pending',
+  "createdAt"  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  "creditedAt" TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS "Referral_referrerId_idx" ON "Referral"("referrerId");
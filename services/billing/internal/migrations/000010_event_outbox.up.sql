@@ -0,0 +1,17 @@
+-- Shared transactional outbox (pkg/events, mirrors schemas/sql/026_event_outbox.sql). Billing
+-- records its events here in the transaction of the change, and the relay publishes rows of source
+-- 'billing' to Pub/Sub.
+CREATE TABLE IF NOT EXISTS event_outbox (
+  id              BIGSERIAL PRIMARY KEY,
+  source          TEXT NOT NULL,
+  event_type      TEXT NOT NULL,
+  subject         TEXT NOT NULL DEFAULT '',
+  payload         JSONB NOT NULL,
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  attempts        INTEGER NOT NULL DEFAULT 0,
+  last_error      TEXT,
+  sent_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ix_event_outbox_pending ON event_outbox(source, next_attempt_at, id) WHERE sent_at IS NULL;
@@ -0,0 +1,268 @@
+// Package orgs manages organizations ("Organization"), their members ("OrganizationMember") and
+// reports what each member consumed from the shared wallet ("OrganizationWallet"). The wallet
+// itself is moved by the tokens store like any user wallet.
+package orgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+)
+
+// MemberUsage is one member's consumption from the organization wallet over a period.
+type MemberUsage struct {
+	UserID     string `json:"userId"`
+	Role       string `json:"role"`
+	DailyCap   int64  `json:"dailyCap"`
+	MonthlyCap int64  `json:"monthlyCap"`
+	// Spent, Reserved and Released sum the member's org-funded transactions in the period.
+	Spent        int64 `json:"spent"`
+	Reserved     int64 `json:"reserved"`
+	Released     int64 `json:"released"`
+	Transferred  int64 `json:"transferred"`
+	Transactions int64 `json:"transactions"`
+	// SpentByAction splits Spent by the first priced action of each transaction.
+	SpentByAction map[string]int64 `json:"spentByAction"`
+}
+
+// ErrInvalid is returned for organization or member input the store rejects.
+var ErrInvalid = errors.New("invalid organization input")
+
+// Store reads and writes organizations and members.
+type Store struct {
+	db *pgxpool.Pool
+}
+
+// New returns a Store backed by db.
+func New(db *pgxpool.Pool) *Store {
+	return &Store{db: db}
+}
+
+// Create adds an organization owned by ownerID, with an empty wallet.
+func (s *Store) Create(ctx context.Context, ownerID, name string) (*domain.Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: name required", ErrInvalid)
+	}
+	o := &domain.Organization{ID: uuid.NewString(), Name: name, OwnerID: ownerID, CreatedAt: time.Now().UTC()}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback is a no-op if the transaction is committed.
+	if _, err := tx.Exec(ctx, `INSERT INTO "Organization" (id, name, "ownerId", "createdAt", "updatedAt") VALUES ($1, $2, $3, $4, $4)`, o.ID, o.Name, o.OwnerID, o.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert organization: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO "OrganizationMember" ("orgId", "userId", role, "dailyCap", "monthlyCap", "createdAt", "updatedAt") VALUES ($1, $2, $3, 0, 0, $4, $4)
+    `, o.ID, ownerID, domain.RoleOwner, o.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert organization owner: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO "OrganizationWallet" ("orgId", balance, held, "updatedAt") VALUES ($1, 0, 0, $2)`, o.ID, o.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert organization wallet: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return o, nil
+}
+
+// Get returns an organization.
+func (s *Store) Get(ctx context.Context, orgID string) (*domain.Organization, error) {
+	var o domain.Organization
+	err := s.db.QueryRow(ctx, `SELECT id, name, "ownerId", "createdAt" FROM "Organization" WHERE id=$1`, orgID).Scan(&o.ID, &o.Name, &o.OwnerID, &o.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+	return &o, nil
+}
+
+// ForUser returns the organizations userID belongs to with their membership.
+func (s *Store) ForUser(ctx context.Context, userID string) ([]domain.Organization, []domain.Member, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT o.id, o.name, o."ownerId", o."createdAt", m.role, m."dailyCap", m."monthlyCap", m."createdAt", m."updatedAt"
+        FROM "OrganizationMember" m JOIN "Organization" o ON o.id = m."orgId"
+        WHERE m."userId"=$1 ORDER BY o."createdAt"
+    `, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query organizations: %w", err)
+	}
+	defer rows.Close()
+	var (
+		orgs    []domain.Organization
+		members []domain.Member
+	)
+	for rows.Next() {
+		var o domain.Organization
+		m := domain.Member{UserID: userID}
+		if err := rows.Scan(&o.ID, &o.Name, &o.OwnerID, &o.CreatedAt, &m.Role, &m.DailyCap, &m.MonthlyCap, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan organization: %w", err)
+		}
+		m.OrgID = o.ID
+		orgs, members = append(orgs, o), append(members, m)
+	}
+	return orgs, members, rows.Err()
+}
+
+// Member returns userID's membership in orgID, or domain.ErrNotMember.
+func (s *Store) Member(ctx context.Context, orgID, userID string) (domain.Member, error) {
+	m := domain.Member{OrgID: orgID, UserID: userID}
+	err := s.db.QueryRow(ctx, `
+        SELECT role, "dailyCap", "monthlyCap", "createdAt", "updatedAt" FROM "OrganizationMember" WHERE "orgId"=$1 AND "userId"=$2
+    `, orgID, userID).Scan(&m.Role, &m.DailyCap, &m.MonthlyCap, &m.CreatedAt, &m.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, domain.ErrNotMember
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to query organization member: %w", err)
+	}
+	return m, nil
+}
+
+// Members lists the members of orgID, owner first.
+func (s *Store) Members(ctx context.Context, orgID string) ([]domain.Member, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT "userId", role, "dailyCap", "monthlyCap", "createdAt", "updatedAt" FROM "OrganizationMember"
+        WHERE "orgId"=$1 ORDER BY (role=$2) DESC, (role=$3) DESC, "createdAt"
+    `, orgID, domain.RoleOwner, domain.RoleAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization members: %w", err)
+	}
+	defer rows.Close()
+	var out []domain.Member
+	for rows.Next() {
+		m := domain.Member{OrgID: orgID}
+		if err := rows.Scan(&m.UserID, &m.Role, &m.DailyCap, &m.MonthlyCap, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan organization member: %w", err)
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// SetMember adds or updates a member on behalf of actor. Owners and admins manage members;
+// only the owner grants or changes the admin role, and the owner's own membership is fixed.
+func (s *Store) SetMember(ctx context.Context, actor domain.Member, m domain.Member) (domain.Member, error) {
+	if !actor.CanManage() {
+		return m, domain.ErrForbidden
+	}
+	if !domain.ValidRole(m.Role) || m.Role == domain.RoleOwner {
+		return m, fmt.Errorf("%w: role must be one of admin|member", ErrInvalid)
+	}
+	if m.DailyCap < 0 || m.MonthlyCap < 0 {
+		return m, fmt.Errorf("%w: caps must not be negative", ErrInvalid)
+	}
+	cur, err := s.Member(ctx, actor.OrgID, m.UserID)
+	if err != nil && !errors.Is(err, domain.ErrNotMember) {
+		return m, err
+	}
+	if cur.Role == domain.RoleOwner || (actor.Role != domain.RoleOwner && (m.Role == domain.RoleAdmin || cur.Role == domain.RoleAdmin)) {
+		return m, domain.ErrForbidden
+	}
+	m.OrgID = actor.OrgID
+	now := time.Now().UTC()
+	if err := s.db.QueryRow(ctx, `
+        INSERT INTO "OrganizationMember" ("orgId", "userId", role, "dailyCap", "monthlyCap", "createdAt", "updatedAt") VALUES ($1, $2, $3, $4, $5, $6, $6)
+        ON CONFLICT ("orgId", "userId") DO UPDATE SET role=EXCLUDED.role, "dailyCap"=EXCLUDED."dailyCap", "monthlyCap"=EXCLUDED."monthlyCap", "updatedAt"=EXCLUDED."updatedAt"
+        RETURNING "createdAt", "updatedAt"
+    `, m.OrgID, m.UserID, m.Role, m.DailyCap, m.MonthlyCap, now).Scan(&m.CreatedAt, &m.UpdatedAt); err != nil {
+		return m, fmt.Errorf("failed to save organization member: %w", err)
+	}
+	return m, nil
+}
+
+// RemoveMember removes userID on behalf of actor; members may remove themselves. Open
+// reservations of the member stay valid until they settle or expire.
+func (s *Store) RemoveMember(ctx context.Context, actor domain.Member, userID string) error {
+	cur, err := s.Member(ctx, actor.OrgID, userID)
+	if err != nil {
+		return err
+	}
+	self := actor.UserID == userID
+	if cur.Role == domain.RoleOwner || (!self && (!actor.CanManage() || (cur.Role == domain.RoleAdmin && actor.Role != domain.RoleOwner))) {
+		return domain.ErrForbidden
+	}
+	if _, err := s.db.Exec(ctx, `DELETE FROM "OrganizationMember" WHERE "orgId"=$1 AND "userId"=$2`, actor.OrgID, userID); err != nil {
+		return fmt.Errorf("failed to remove organization member: %w", err)
+	}
+	return nil
+}
+
+// Usage returns per-member consumption from the organization wallet in [start, end), including
+// former members with transactions in the period. userID limits it to one member.
+func (s *Store) Usage(ctx context.Context, orgID, userID string, start, end time.Time) ([]MemberUsage, error) {
+	rows, err := s.db.Query(ctx, `
+        WITH tx AS (
+            SELECT "userId", type, amount FROM "TokenTransaction"
+            WHERE "orgId"=$1 AND "createdAt" >= $2 AND "createdAt" < $3 AND ($4 = '' OR "userId"=$4)
+        ), totals AS (
+            SELECT "userId",
+                   COALESCE(SUM(amount) FILTER (WHERE type='debited'), 0)::bigint AS spent,
+                   COALESCE(SUM(amount) FILTER (WHERE type='reserved'), 0)::bigint AS reserved,
+                   COALESCE(SUM(amount) FILTER (WHERE type='reverted'), 0)::bigint AS released,
+                   COALESCE(SUM(amount) FILTER (WHERE type='transferred'), 0)::bigint AS transferred,
+                   COUNT(*) AS n
+            FROM tx GROUP BY "userId"
+        ), members AS (
+            SELECT "userId", role, "dailyCap", "monthlyCap" FROM "OrganizationMember" WHERE "orgId"=$1 AND ($4 = '' OR "userId"=$4)
+        )
+        SELECT COALESCE(m."userId", t."userId"), COALESCE(m.role, ''), COALESCE(m."dailyCap", 0), COALESCE(m."monthlyCap", 0),
+               COALESCE(t.spent, 0), COALESCE(t.reserved, 0), COALESCE(t.released, 0), COALESCE(t.transferred, 0), COALESCE(t.n, 0)
+        FROM members m FULL OUTER JOIN totals t ON t."userId" = m."userId"
+        ORDER BY 5 DESC, 1
+    `, orgID, start, end, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization usage: %w", err)
+	}
+	var out []MemberUsage
+	index := map[string]int{}
+	for rows.Next() {
+		u := MemberUsage{SpentByAction: map[string]int64{}}
+		if err := rows.Scan(&u.UserID, &u.Role, &u.DailyCap, &u.MonthlyCap, &u.Spent, &u.Reserved, &u.Released, &u.Transferred, &u.Transactions); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan organization usage: %w", err)
+		}
+		index[u.UserID] = len(out)
+		out = append(out, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query organization usage: %w", err)
+	}
+	rows, err = s.db.Query(ctx, `
+        SELECT "userId", COALESCE(metadata->'lines'->0->>'action', ''), SUM(amount)::bigint
+        FROM "TokenTransaction"
+        WHERE "orgId"=$1 AND type='debited' AND "createdAt" >= $2 AND "createdAt" < $3 AND ($4 = '' OR "userId"=$4)
+        GROUP BY 1, 2
+    `, orgID, start, end, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization usage: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			uid, action string
+			amount      int64
+		)
+		if err := rows.Scan(&uid, &action, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan organization usage: %w", err)
+		}
+		if action == "" {
+			action = "unpriced"
+		}
+		if i, ok := index[uid]; ok {
+			out[i].SpentByAction[action] += amount
+		}
+	}
+	return out, rows.Err()
+}
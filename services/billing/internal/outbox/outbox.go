@@ -0,0 +1,35 @@
+// Package outbox records billing's events in the shared transactional outbox (pkg/events,
+// "event_outbox") through the pgx transaction of the change they report, so an event is relayed
+// to Pub/Sub only if that change commits.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/jackc/pgx/v5"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+// Source is the outbox source of billing's events; the relay in main publishes these rows.
+const Source = "billing"
+
+// Enqueue records events in tx.
+func Enqueue(ctx context.Context, tx pgx.Tx, events ...ev.OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return ev.Enqueue(ctx, pgxExec{tx}, Source, events...)
+}
+
+// pgxExec adapts a pgx transaction to ev.Execer.
+type pgxExec struct{ tx pgx.Tx }
+
+func (x pgxExec) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	tag, err := x.tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(tag.RowsAffected()), nil
+}
@@ -0,0 +1,258 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deliverer sends a signed webhook to billing.
+type Deliverer func(ctx context.Context, payload []byte, header http.Header) error
+
+// DeliverTo posts webhooks to url.
+func DeliverTo(url string) Deliverer {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, payload []byte, header http.Header) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header = header.Clone()
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook delivery: status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// DeliverToHandler calls h in-process.
+func DeliverToHandler(h http.Handler) Deliverer {
+	return func(ctx context.Context, payload []byte, header http.Header) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/webhook", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header = header.Clone()
+		rec := &recorder{header: http.Header{}, code: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		if rec.code >= 300 {
+			return fmt.Errorf("webhook delivery: status %d: %s", rec.code, strings.TrimSpace(rec.body.String()))
+		}
+		return nil
+	}
+}
+
+// recorder is a minimal in-memory http.ResponseWriter.
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *recorder) WriteHeader(code int)        { r.code = code }
+
+// Fake is an in-process provider for local runs and tests. Checkouts complete when
+// CompleteCheckout is called (the fake checkout page does that); charges succeed unless the
+// customer was marked with Decline. Every outcome is delivered as a signed, Stripe-shaped
+// webhook through the Deliverer.
+type Fake struct {
+	secret  string
+	deliver Deliverer
+	// CheckoutURL formats the page that completes a session (default "fake://checkout/{id}").
+	CheckoutURL func(sessionID string) string
+
+	mu        sync.Mutex
+	seq       int
+	customers map[string]Customer
+	declined  map[string]bool
+	sessions  map[string]*fakeSession
+	idem      map[string]string
+	events    map[string][]byte
+}
+
+type fakeSession struct {
+	req     CheckoutRequest
+	session CheckoutSession
+}
+
+// NewFake returns a fake provider signing webhooks with secret.
+func NewFake(secret string, deliver Deliverer) *Fake {
+	return &Fake{
+		secret: secret, deliver: deliver,
+		customers: map[string]Customer{}, declined: map[string]bool{}, sessions: map[string]*fakeSession{},
+		idem: map[string]string{}, events: map[string][]byte{},
+	}
+}
+
+// Name implements Provider.
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq)
+}
+
+// CreateCustomer implements Provider.
+func (f *Fake) CreateCustomer(_ context.Context, c Customer) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, existing := range f.customers {
+		if existing.UserID == c.UserID {
+			return id, nil
+		}
+	}
+	id := f.nextID("cus")
+	f.customers[id] = c
+	return id, nil
+}
+
+// Decline makes every later charge of customerID fail.
+func (f *Fake) Decline(customerID string, decline bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.declined[customerID] = decline
+}
+
+// CreateCheckoutSession implements Provider.
+func (f *Fake) CreateCheckoutSession(_ context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	if req.AmountCents <= 0 {
+		return nil, fmt.Errorf("checkout amount must be positive")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.idem[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		cs := f.sessions[id].session
+		return &cs, nil
+	}
+	id := f.nextID("cs")
+	u := "fake://checkout/" + id
+	if f.CheckoutURL != nil {
+		u = f.CheckoutURL(id)
+	}
+	cs := CheckoutSession{ID: id, Provider: f.Name(), URL: u, Kind: req.Kind, AmountCents: req.AmountCents, Currency: req.Currency, ExpiresAt: time.Now().Add(24 * time.Hour).UTC()}
+	f.sessions[id] = &fakeSession{req: req, session: cs}
+	if req.IdempotencyKey != "" {
+		f.idem[req.IdempotencyKey] = id
+	}
+	return &cs, nil
+}
+
+// Session returns a checkout session and its success URL.
+func (f *Fake) Session(id string) (*CheckoutSession, string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, "", false
+	}
+	cs := s.session
+	return &cs, s.req.SuccessURL, true
+}
+
+// CompleteCheckout pays the session and delivers checkout.session.completed. Completing a
+// session again redelivers the same event.
+func (f *Fake) CompleteCheckout(ctx context.Context, sessionID string) (string, error) {
+	f.mu.Lock()
+	s, ok := f.sessions[sessionID]
+	if !ok {
+		f.mu.Unlock()
+		return "", fmt.Errorf("unknown checkout session %s", sessionID)
+	}
+	eventID := "evt_" + sessionID
+	payload, seen := f.events[eventID]
+	if !seen {
+		customer := s.req.CustomerID
+		if customer == "" {
+			customer = f.nextID("cus")
+			f.customers[customer] = Customer{UserID: s.req.UserID}
+		}
+		payload = f.event(eventID, EventCheckoutCompleted, map[string]any{
+			"id": sessionID, "object": "checkout.session", "customer": customer, "client_reference_id": s.req.UserID,
+			"amount_total": s.req.AmountCents, "currency": strings.ToLower(s.req.Currency), "payment_status": "paid",
+			"metadata": s.req.metadata(),
+		})
+	}
+	f.mu.Unlock()
+	return eventID, f.send(ctx, payload)
+}
+
+// Charge implements Provider.
+func (f *Fake) Charge(ctx context.Context, req ChargeRequest) (*Payment, error) {
+	f.mu.Lock()
+	if id, ok := f.idem[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		f.mu.Unlock()
+		return &Payment{ID: id, Status: "succeeded", AmountCents: req.AmountCents, Currency: req.Currency}, nil
+	}
+	if _, ok := f.customers[req.CustomerID]; !ok {
+		f.mu.Unlock()
+		return nil, ErrNoPaymentMethod
+	}
+	id := f.nextID("pi")
+	obj := map[string]any{"id": id, "object": "payment_intent", "customer": req.CustomerID, "amount": req.AmountCents, "currency": strings.ToLower(req.Currency), "metadata": req.Metadata}
+	declined := f.declined[req.CustomerID]
+	typ := EventPaymentSucceeded
+	if declined {
+		typ = EventPaymentFailed
+		obj["status"] = "requires_payment_method"
+		obj["last_payment_error"] = map[string]any{"message": "Your card was declined."}
+	} else {
+		obj["status"] = "succeeded"
+		if req.IdempotencyKey != "" {
+			f.idem[req.IdempotencyKey] = id
+		}
+	}
+	payload := f.event("evt_"+id, typ, obj)
+	f.mu.Unlock()
+
+	// the charge outcome stands even if the webhook is lost; Redeliver resends it
+	_ = f.send(ctx, payload)
+	if declined {
+		return &Payment{ID: id, Status: "requires_payment_method", AmountCents: req.AmountCents, Currency: req.Currency}, fmt.Errorf("%w: Your card was declined.", ErrDeclined)
+	}
+	return &Payment{ID: id, Status: "succeeded", AmountCents: req.AmountCents, Currency: req.Currency}, nil
+}
+
+// Redeliver sends a previously emitted event again, as providers do on timeouts.
+func (f *Fake) Redeliver(ctx context.Context, eventID string) error {
+	f.mu.Lock()
+	payload, ok := f.events[eventID]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown event %s", eventID)
+	}
+	return f.send(ctx, payload)
+}
+
+// VerifyWebhook implements Provider.
+func (f *Fake) VerifyWebhook(payload []byte, header http.Header) (*Event, error) {
+	return parseEvent(f.secret, payload, header, time.Now())
+}
+
+// event builds and remembers a webhook payload; callers hold f.mu.
+func (f *Fake) event(id, typ string, obj map[string]any) []byte {
+	b, _ := json.Marshal(map[string]any{"id": id, "object": "event", "type": typ, "created": time.Now().Unix(), "data": map[string]any{"object": obj}})
+	f.events[id] = b
+	return b
+}
+
+func (f *Fake) send(ctx context.Context, payload []byte) error {
+	if f.deliver == nil {
+		return nil
+	}
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set(SignatureHeader, Sign(f.secret, payload, time.Now()))
+	return f.deliver(ctx, payload, h)
+}
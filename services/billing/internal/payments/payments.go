@@ -0,0 +1,276 @@
+// Package payments puts payment providers behind one interface: customers, checkout sessions
+// for plans and token top-ups, off-session charges for renewals and signed webhooks.
+//
+// Providers speak Stripe's wire format for webhooks (event envelope and Stripe-Signature
+// header), so the Stripe implementation and the in-process Fake share the parsing and
+// verification code and the fake exercises the same path end to end.
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checkout kinds.
+const (
+	KindSubscription = "subscription"
+	KindTopUp        = "topup"
+)
+
+// Webhook event types (Stripe names).
+const (
+	EventCheckoutCompleted = "checkout.session.completed"
+	EventPaymentSucceeded  = "payment_intent.succeeded"
+	EventPaymentFailed     = "payment_intent.payment_failed"
+)
+
+// SignatureHeader carries the webhook signature.
+const SignatureHeader = "Stripe-Signature"
+
+// DefaultTolerance bounds the age of a signed webhook.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is returned for webhooks whose signature is missing, wrong or stale.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrDeclined is returned when the provider refuses a charge.
+	ErrDeclined = errors.New("payment declined")
+	// ErrNoPaymentMethod is returned for off-session charges of customers without a saved method.
+	ErrNoPaymentMethod = errors.New("no payment method on file")
+)
+
+// Provider is a payment provider.
+type Provider interface {
+	// Name is the provider key used in webhook URLs and stored events ("stripe", "fake").
+	Name() string
+	// CreateCustomer registers a paying customer and returns its provider id.
+	CreateCustomer(ctx context.Context, c Customer) (string, error)
+	// CreateCheckoutSession starts a hosted payment for a plan or a token top-up; the card is
+	// saved for later off-session renewals.
+	CreateCheckoutSession(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error)
+	// Charge collects money from a customer's saved payment method without the customer present.
+	Charge(ctx context.Context, req ChargeRequest) (*Payment, error)
+	// VerifyWebhook checks the signature of a webhook delivery and parses its event.
+	VerifyWebhook(payload []byte, header http.Header) (*Event, error)
+}
+
+// Customer describes a paying user.
+type Customer struct {
+	UserID string
+	Email  string
+	Name   string
+}
+
+// CheckoutRequest describes what a checkout session sells.
+type CheckoutRequest struct {
+	Kind        string
+	UserID      string
+	CustomerID  string
+	PlanID      string
+	PackageID   string
+	Tokens      int64
+	AmountCents int64
+	Currency    string
+	Description string
+	SuccessURL  string
+	CancelURL   string
+	// IdempotencyKey makes retried requests return the same session.
+	IdempotencyKey string
+}
+
+// metadata is attached to the session and its payment so webhooks can be attributed.
+func (r CheckoutRequest) metadata() map[string]string {
+	m := map[string]string{"userId": r.UserID, "kind": r.Kind}
+	if r.PlanID != "" {
+		m["planId"] = r.PlanID
+	}
+	if r.PackageID != "" {
+		m["packageId"] = r.PackageID
+	}
+	if r.Tokens > 0 {
+		m["tokens"] = strconv.FormatInt(r.Tokens, 10)
+	}
+	return m
+}
+
+// CheckoutSession is a started hosted payment; the customer completes it at URL.
+type CheckoutSession struct {
+	ID          string    `json:"id"`
+	Provider    string    `json:"provider"`
+	URL         string    `json:"url"`
+	Kind        string    `json:"kind"`
+	AmountCents int64     `json:"amountCents"`
+	Currency    string    `json:"currency"`
+	ExpiresAt   time.Time `json:"expiresAt,omitempty"`
+}
+
+// ChargeRequest is an off-session charge.
+type ChargeRequest struct {
+	CustomerID     string
+	AmountCents    int64
+	Currency       string
+	Description    string
+	IdempotencyKey string
+	Metadata       map[string]string
+}
+
+// Payment is the outcome of a charge.
+type Payment struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	AmountCents int64  `json:"amountCents"`
+	Currency    string `json:"currency"`
+}
+
+// Event is a verified webhook event.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+	// ObjectID is the checkout session or payment intent id.
+	ObjectID    string `json:"objectId"`
+	CustomerID  string `json:"customerId,omitempty"`
+	UserID      string `json:"userId,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	PlanID      string `json:"planId,omitempty"`
+	PackageID   string `json:"packageId,omitempty"`
+	Tokens      int64  `json:"tokens,omitempty"`
+	AmountCents int64  `json:"amountCents"`
+	Currency    string `json:"currency,omitempty"`
+	// Paid is set for completed checkouts whose payment cleared.
+	Paid    bool   `json:"paid"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// Sign returns the signature header value for payload at t.
+func Sign(secret string, payload []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, payload)
+}
+
+func signature(secret, ts string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header against payload; any v1 signature may match (providers
+// sign with every active secret while rotating).
+func Verify(secret string, payload []byte, header string, tolerance time.Duration, now time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("%w: no webhook secret configured", ErrInvalidSignature)
+	}
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return fmt.Errorf("%w: malformed header", ErrInvalidSignature)
+	}
+	if age := now.Sub(time.Unix(sec, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+	want := signature(secret, ts, payload)
+	for _, s := range sigs {
+		if hmac.Equal([]byte(s), []byte(want)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no matching signature", ErrInvalidSignature)
+}
+
+// stripeEvent is the webhook envelope.
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object stripeObject `json:"object"`
+	} `json:"data"`
+}
+
+// stripeObject holds the fields billing reads from checkout sessions and payment intents.
+type stripeObject struct {
+	ID                string            `json:"id"`
+	Object            string            `json:"object"`
+	Customer          string            `json:"customer"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	AmountTotal       int64             `json:"amount_total"`
+	Amount            int64             `json:"amount"`
+	Currency          string            `json:"currency"`
+	PaymentStatus     string            `json:"payment_status"`
+	Status            string            `json:"status"`
+	Metadata          map[string]string `json:"metadata"`
+	LastPaymentError  *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+// parseEvent verifies and decodes a webhook delivery.
+func parseEvent(secret string, payload []byte, header http.Header, now time.Time) (*Event, error) {
+	if err := Verify(secret, payload, header.Get(SignatureHeader), DefaultTolerance, now); err != nil {
+		return nil, err
+	}
+	var se stripeEvent
+	if err := json.Unmarshal(payload, &se); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	if se.ID == "" || se.Type == "" {
+		return nil, fmt.Errorf("invalid webhook payload: missing id or type")
+	}
+	o := se.Data.Object
+	e := &Event{
+		ID: se.ID, Type: se.Type, Created: time.Unix(se.Created, 0).UTC(), ObjectID: o.ID, CustomerID: o.Customer,
+		UserID: firstNonEmpty(o.Metadata["userId"], o.ClientReferenceID), Kind: o.Metadata["kind"],
+		PlanID: o.Metadata["planId"], PackageID: o.Metadata["packageId"], Currency: strings.ToUpper(o.Currency),
+		AmountCents: o.AmountTotal,
+	}
+	if e.AmountCents == 0 {
+		e.AmountCents = o.Amount
+	}
+	if v := o.Metadata["tokens"]; v != "" {
+		e.Tokens, _ = strconv.ParseInt(v, 10, 64)
+	}
+	switch se.Type {
+	case EventCheckoutCompleted:
+		e.Paid = o.PaymentStatus == "paid" || o.PaymentStatus == "no_payment_required"
+	case EventPaymentSucceeded:
+		e.Paid = true
+	case EventPaymentFailed:
+		if o.LastPaymentError != nil {
+			e.Failure = o.LastPaymentError.Message
+		}
+	}
+	return e, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
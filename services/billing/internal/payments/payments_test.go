@@ -0,0 +1,180 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xxrenzhe/autoads/services/billing/internal/subscriptions"
+	"github.com/xxrenzhe/autoads/services/billing/internal/tokens"
+)
+
+type memEvents struct {
+	mu     sync.Mutex
+	status map[string]string
+}
+
+func (m *memEvents) Claim(_ context.Context, provider string, e *Event, _ []byte) (bool, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := provider + "/" + e.ID
+	if st, ok := m.status[key]; ok && st != StatusFailed {
+		return false, st, nil
+	}
+	m.status[key] = StatusProcessing
+	return true, StatusProcessing, nil
+}
+
+func (m *memEvents) Finish(_ context.Context, provider, eventID string, procErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := StatusProcessed
+	if procErr != nil {
+		st = StatusFailed
+	}
+	m.status[provider+"/"+eventID] = st
+	return nil
+}
+
+// memWallet grants once per reference, like the ledger.
+type memWallet struct {
+	mu       sync.Mutex
+	balances map[string]int64
+	refs     map[string]bool
+}
+
+func (m *memWallet) Grant(_ context.Context, g tokens.Grant) (*tokens.Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refs[g.Reference] {
+		return &tokens.Result{Replayed: true}, nil
+	}
+	m.refs[g.Reference] = true
+	m.balances[g.UserID] += g.Amount
+	return &tokens.Result{}, nil
+}
+
+type memSubs struct {
+	activations []subscriptions.Activation
+}
+
+func (m *memSubs) Activate(_ context.Context, a subscriptions.Activation, now time.Time) (*subscriptions.Transition, error) {
+	m.activations = append(m.activations, a)
+	return &subscriptions.Transition{UserID: a.UserID, PlanID: a.PlanID, At: now}, nil
+}
+
+type harness struct {
+	fake    *Fake
+	events  *memEvents
+	wallet  *memWallet
+	subs    *memSubs
+	outputs []*Outcome
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{
+		events: &memEvents{status: map[string]string{}},
+		wallet: &memWallet{balances: map[string]int64{}, refs: map[string]bool{}},
+		subs:   &memSubs{},
+	}
+	p := &Processor{Events: h.events, Tokens: h.wallet, Subs: h.subs}
+	h.fake = NewFake("whsec_test", DeliverToHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		out, err := p.Handle(r.Context(), h.fake, body, r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.outputs = append(h.outputs, out)
+	})))
+	return h
+}
+
+func TestTopUpPurchaseGrantsTokensOnce(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	cs, err := h.fake.CreateCheckoutSession(ctx, CheckoutRequest{Kind: KindTopUp, UserID: "u1", PackageID: "tokens-1k", Tokens: 1000, AmountCents: 3000, Currency: "CNY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventID, err := h.fake.CompleteCheckout(ctx, cs.ID)
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if got := h.wallet.balances["u1"]; got != 1000 {
+		t.Fatalf("balance after purchase = %d, want 1000", got)
+	}
+	if err := h.fake.Redeliver(ctx, eventID); err != nil {
+		t.Fatalf("redeliver: %v", err)
+	}
+	if _, err := h.fake.CompleteCheckout(ctx, cs.ID); err != nil {
+		t.Fatalf("complete again: %v", err)
+	}
+	if got := h.wallet.balances["u1"]; got != 1000 {
+		t.Fatalf("balance after redelivery = %d, want 1000", got)
+	}
+	if len(h.outputs) != 3 || h.outputs[0].Granted != 1000 || !h.outputs[1].Duplicate || !h.outputs[2].Duplicate {
+		t.Fatalf("unexpected outcomes: %+v", h.outputs)
+	}
+}
+
+func TestSubscriptionCheckoutActivatesPlan(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	cs, err := h.fake.CreateCheckoutSession(ctx, CheckoutRequest{Kind: KindSubscription, UserID: "u2", PlanID: "pro", AmountCents: 29800, Currency: "CNY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.fake.CompleteCheckout(ctx, cs.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.subs.activations) != 1 {
+		t.Fatalf("activations = %d, want 1", len(h.subs.activations))
+	}
+	a := h.subs.activations[0]
+	if a.UserID != "u2" || a.PlanID != "pro" || a.CustomerID == "" || a.AmountCents != 29800 || a.Reference != "fake:"+cs.ID {
+		t.Fatalf("unexpected activation %+v", a)
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	f := NewFake("whsec_test", nil)
+	payload := []byte(`{"id":"evt_1","type":"checkout.session.completed","data":{"object":{}}}`)
+	hdr := http.Header{}
+	hdr.Set(SignatureHeader, Sign("whsec_other", payload, time.Now()))
+	if _, err := f.VerifyWebhook(payload, hdr); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("wrong secret: err = %v, want ErrInvalidSignature", err)
+	}
+	hdr.Set(SignatureHeader, Sign("whsec_test", payload, time.Now().Add(-time.Hour)))
+	if _, err := f.VerifyWebhook(payload, hdr); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("stale signature: err = %v, want ErrInvalidSignature", err)
+	}
+	hdr.Set(SignatureHeader, Sign("whsec_test", payload, time.Now()))
+	if _, err := f.VerifyWebhook(payload, hdr); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+}
+
+func TestChargerDeclined(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake("whsec_test", nil)
+	customer, _ := f.CreateCustomer(ctx, Customer{UserID: "u3"})
+	c := &Charger{Provider: f, Customer: func(context.Context, string) (string, error) { return customer, nil }}
+	charge := subscriptions.Charge{UserID: "u3", PlanID: "pro", AmountCents: 29800, Currency: "CNY", IdempotencyKey: "renewal:s1:1", Reason: "renewal"}
+	if err := c.Charge(ctx, charge); err != nil {
+		t.Fatalf("charge: %v", err)
+	}
+	f.Decline(customer, true)
+	charge.IdempotencyKey = "renewal:s1:2"
+	if err := c.Charge(ctx, charge); !errors.Is(err, ErrDeclined) {
+		t.Fatalf("declined charge: err = %v, want ErrDeclined", err)
+	}
+	noCard := &Charger{Provider: f, Customer: func(context.Context, string) (string, error) { return "", nil }}
+	if err := noCard.Charge(ctx, charge); !errors.Is(err, ErrNoPaymentMethod) {
+		t.Fatalf("no customer: err = %v, want ErrNoPaymentMethod", err)
+	}
+}
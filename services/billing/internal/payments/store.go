@@ -0,0 +1,77 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PGStore keeps webhook events in "PaymentEvent" and checkout sessions in "PaymentCheckout".
+type PGStore struct {
+	db *pgxpool.Pool
+}
+
+// NewPGStore returns a PGStore backed by db.
+func NewPGStore(db *pgxpool.Pool) *PGStore {
+	return &PGStore{db: db}
+}
+
+// Claim implements EventStore. A delivery stuck in processing for five minutes (the process
+// died) can be claimed again.
+func (s *PGStore) Claim(ctx context.Context, provider string, e *Event, payload []byte) (bool, string, error) {
+	tag, err := s.db.Exec(ctx, `
+        INSERT INTO "PaymentEvent" (provider, "eventId", type, "objectId", "userId", status, payload, attempts, "createdAt", "updatedAt")
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7::jsonb, 1, NOW(), NOW())
+        ON CONFLICT (provider, "eventId") DO UPDATE SET status=EXCLUDED.status, attempts="PaymentEvent".attempts + 1, "updatedAt"=NOW()
+        WHERE "PaymentEvent".status=$8 OR ("PaymentEvent".status=$6 AND "PaymentEvent"."updatedAt" < NOW() - interval '5 minutes')
+    `, provider, e.ID, e.Type, e.ObjectID, e.UserID, StatusProcessing, string(payload), StatusFailed)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to claim webhook event: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		return true, StatusProcessing, nil
+	}
+	var status string
+	if err := s.db.QueryRow(ctx, `SELECT status FROM "PaymentEvent" WHERE provider=$1 AND "eventId"=$2`, provider, e.ID).Scan(&status); err != nil {
+		return false, "", fmt.Errorf("failed to query webhook event: %w", err)
+	}
+	return false, status, nil
+}
+
+// Finish implements EventStore.
+func (s *PGStore) Finish(ctx context.Context, provider, eventID string, procErr error) error {
+	status, msg := StatusProcessed, ""
+	if procErr != nil {
+		status, msg = StatusFailed, procErr.Error()
+	}
+	if _, err := s.db.Exec(ctx, `
+        UPDATE "PaymentEvent" SET status=$3, error=NULLIF($4, ''), "processedAt"=CASE WHEN $3=$5 THEN NOW() END, "updatedAt"=NOW()
+        WHERE provider=$1 AND "eventId"=$2
+    `, provider, eventID, status, msg, StatusProcessed); err != nil {
+		return fmt.Errorf("failed to finish webhook event: %w", err)
+	}
+	return nil
+}
+
+// SaveCheckout records a started checkout session.
+func (s *PGStore) SaveCheckout(ctx context.Context, userID string, req CheckoutRequest, cs *CheckoutSession) error {
+	if _, err := s.db.Exec(ctx, `
+        INSERT INTO "PaymentCheckout" (id, provider, "userId", kind, "planId", "packageId", tokens, "amountCents", currency, status, url, "createdAt")
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'open', $10, NOW())
+        ON CONFLICT (id) DO NOTHING
+    `, cs.ID, cs.Provider, userID, req.Kind, req.PlanID, req.PackageID, req.Tokens, req.AmountCents, req.Currency, cs.URL); err != nil {
+		return fmt.Errorf("failed to store checkout: %w", err)
+	}
+	return nil
+}
+
+// CompleteCheckout marks a checkout session paid.
+func (s *PGStore) CompleteCheckout(ctx context.Context, provider, sessionID, eventID string) error {
+	if _, err := s.db.Exec(ctx, `
+        UPDATE "PaymentCheckout" SET status='completed', "eventId"=$3, "completedAt"=NOW() WHERE provider=$1 AND id=$2
+    `, provider, sessionID, eventID); err != nil {
+		return fmt.Errorf("failed to complete checkout: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe talks to Stripe's REST API with form-encoded requests.
+type Stripe struct {
+	secretKey     string
+	webhookSecret string
+	// BaseURL defaults to https://api.stripe.com; tests point it at a local server.
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// NewStripe returns a Stripe provider for an API secret key and a webhook signing secret.
+func NewStripe(secretKey, webhookSecret string) *Stripe {
+	return &Stripe{secretKey: secretKey, webhookSecret: webhookSecret, BaseURL: "https://api.stripe.com", HTTP: &http.Client{Timeout: 20 * time.Second}}
+}
+
+// Name implements Provider.
+func (s *Stripe) Name() string { return "stripe" }
+
+// CreateCustomer implements Provider.
+func (s *Stripe) CreateCustomer(ctx context.Context, c Customer) (string, error) {
+	form := url.Values{}
+	if c.Email != "" {
+		form.Set("email", c.Email)
+	}
+	if c.Name != "" {
+		form.Set("name", c.Name)
+	}
+	form.Set("metadata[userId]", c.UserID)
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/v1/customers", form, "customer:"+c.UserID, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// CreateCheckoutSession implements Provider.
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", req.SuccessURL)
+	form.Set("cancel_url", req.CancelURL)
+	form.Set("client_reference_id", req.UserID)
+	if req.CustomerID != "" {
+		form.Set("customer", req.CustomerID)
+	}
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(req.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("line_items[0][price_data][product_data][name]", req.Description)
+	// keep the card for off-session renewals
+	form.Set("payment_intent_data[setup_future_usage]", "off_session")
+	for k, v := range req.metadata() {
+		form.Set("metadata["+k+"]", v)
+		form.Set("payment_intent_data[metadata]["+k+"]", v)
+	}
+	var out struct {
+		ID        string `json:"id"`
+		URL       string `json:"url"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/v1/checkout/sessions", form, req.IdempotencyKey, &out); err != nil {
+		return nil, err
+	}
+	cs := &CheckoutSession{ID: out.ID, Provider: s.Name(), URL: out.URL, Kind: req.Kind, AmountCents: req.AmountCents, Currency: req.Currency}
+	if out.ExpiresAt > 0 {
+		cs.ExpiresAt = time.Unix(out.ExpiresAt, 0).UTC()
+	}
+	return cs, nil
+}
+
+// Charge implements Provider with a confirmed off-session PaymentIntent on the customer's
+// default payment method (or the first saved card).
+func (s *Stripe) Charge(ctx context.Context, req ChargeRequest) (*Payment, error) {
+	pm, err := s.paymentMethod(ctx, req.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("currency", strings.ToLower(req.Currency))
+	form.Set("customer", req.CustomerID)
+	form.Set("payment_method", pm)
+	form.Set("off_session", "true")
+	form.Set("confirm", "true")
+	if req.Description != "" {
+		form.Set("description", req.Description)
+	}
+	for k, v := range req.Metadata {
+		form.Set("metadata["+k+"]", v)
+	}
+	var out struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/v1/payment_intents", form, req.IdempotencyKey, &out); err != nil {
+		return nil, err
+	}
+	p := &Payment{ID: out.ID, Status: out.Status, AmountCents: out.Amount, Currency: strings.ToUpper(out.Currency)}
+	if out.Status != "succeeded" {
+		return p, fmt.Errorf("%w: payment intent %s is %s", ErrDeclined, out.ID, out.Status)
+	}
+	return p, nil
+}
+
+func (s *Stripe) paymentMethod(ctx context.Context, customerID string) (string, error) {
+	if customerID == "" {
+		return "", ErrNoPaymentMethod
+	}
+	var cust struct {
+		InvoiceSettings struct {
+			DefaultPaymentMethod string `json:"default_payment_method"`
+		} `json:"invoice_settings"`
+	}
+	if err := s.do(ctx, http.MethodGet, "/v1/customers/"+url.PathEscape(customerID), nil, "", &cust); err != nil {
+		return "", err
+	}
+	if pm := cust.InvoiceSettings.DefaultPaymentMethod; pm != "" {
+		return pm, nil
+	}
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	q := url.Values{"customer": {customerID}, "type": {"card"}, "limit": {"1"}}
+	if err := s.do(ctx, http.MethodGet, "/v1/payment_methods?"+q.Encode(), nil, "", &list); err != nil {
+		return "", err
+	}
+	if len(list.Data) == 0 {
+		return "", ErrNoPaymentMethod
+	}
+	return list.Data[0].ID, nil
+}
+
+// VerifyWebhook implements Provider.
+func (s *Stripe) VerifyWebhook(payload []byte, header http.Header) (*Event, error) {
+	return parseEvent(s.webhookSecret, payload, header, time.Now())
+}
+
+// stripeError is Stripe's error body.
+type stripeError struct {
+	Error struct {
+		Type        string `json:"type"`
+		Code        string `json:"code"`
+		DeclineCode string `json:"decline_code"`
+		Message     string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *Stripe) do(ctx context.Context, method, path string, form url.Values, idemKey string, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(s.BaseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.secretKey, "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idemKey != "" && method == http.MethodPost {
+		req.Header.Set("Idempotency-Key", idemKey)
+	}
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("stripe %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		var se stripeError
+		_ = json.Unmarshal(b, &se)
+		if se.Error.Type == "card_error" || resp.StatusCode == http.StatusPaymentRequired {
+			return fmt.Errorf("%w: %s", ErrDeclined, firstNonEmpty(se.Error.Message, se.Error.DeclineCode, se.Error.Code))
+		}
+		return fmt.Errorf("stripe %s %s: %d %s", method, path, resp.StatusCode, firstNonEmpty(se.Error.Message, string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("stripe %s %s: decode: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/subscriptions"
+	"github.com/xxrenzhe/autoads/services/billing/internal/tokens"
+)
+
+// Webhook processing statuses.
+const (
+	StatusProcessing = "processing"
+	StatusProcessed  = "processed"
+	StatusFailed     = "failed"
+)
+
+// ErrInFlight is returned when another delivery of the same event is being processed; the
+// provider retries later.
+var ErrInFlight = errors.New("webhook event is being processed")
+
+// EventStore records webhook events so each provider event id is applied once.
+type EventStore interface {
+	// Claim records e as processing. It returns the stored status instead when the event is
+	// already processed or in flight; failed events can be claimed again.
+	Claim(ctx context.Context, provider string, e *Event, payload []byte) (claimed bool, status string, err error)
+	// Finish marks a claimed event processed, or failed with procErr.
+	Finish(ctx context.Context, provider, eventID string, procErr error) error
+}
+
+// CheckoutStore is implemented by event stores that also track checkout sessions.
+type CheckoutStore interface {
+	CompleteCheckout(ctx context.Context, provider, sessionID, eventID string) error
+}
+
+// Granter credits tokens (tokens.Store).
+type Granter interface {
+	Grant(ctx context.Context, g tokens.Grant) (*tokens.Result, error)
+}
+
+// Activator starts paid subscription periods (subscriptions.Engine).
+type Activator interface {
+	Activate(ctx context.Context, a subscriptions.Activation, now time.Time) (*subscriptions.Transition, error)
+}
+
+// Outcome describes what a webhook delivery did.
+type Outcome struct {
+	Event     *Event                    `json:"event"`
+	Duplicate bool                      `json:"duplicate"`
+	Granted   int64                     `json:"granted,omitempty"`
+	Activated *subscriptions.Transition `json:"activated,omitempty"`
+}
+
+// Processor verifies webhook deliveries and applies them once per provider event id.
+type Processor struct {
+	Events EventStore
+	Tokens Granter
+	Subs   Activator
+}
+
+// Handle verifies payload with provider and applies the event. Duplicates of processed events
+// return an Outcome with Duplicate set and change nothing.
+func (p *Processor) Handle(ctx context.Context, provider Provider, payload []byte, header http.Header) (*Outcome, error) {
+	e, err := provider.VerifyWebhook(payload, header)
+	if err != nil {
+		return nil, err
+	}
+	out := &Outcome{Event: e}
+	claimed, status, err := p.Events.Claim(ctx, provider.Name(), e, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		if status == StatusProcessing {
+			return nil, ErrInFlight
+		}
+		out.Duplicate = true
+		return out, nil
+	}
+	applyErr := p.apply(ctx, provider.Name(), e, out)
+	if err := p.Events.Finish(ctx, provider.Name(), e.ID, applyErr); err != nil && applyErr == nil {
+		return nil, err
+	}
+	if applyErr != nil {
+		return nil, applyErr
+	}
+	return out, nil
+}
+
+func (p *Processor) apply(ctx context.Context, provider string, e *Event, out *Outcome) error {
+	if e.Type != EventCheckoutCompleted || !e.Paid {
+		// payment intents settle synchronously through Charge; their events are recorded only
+		return nil
+	}
+	if e.UserID == "" {
+		return fmt.Errorf("checkout %s has no user", e.ObjectID)
+	}
+	switch e.Kind {
+	case KindTopUp:
+		if e.Tokens <= 0 {
+			return fmt.Errorf("top-up checkout %s has no tokens", e.ObjectID)
+		}
+		res, err := p.Tokens.Grant(ctx, tokens.Grant{
+			UserID: e.UserID, Amount: e.Tokens, From: ledger.AccountPurchase, Reference: "purchase:" + provider + ":" + e.ObjectID,
+			Source: "purchase", Description: fmt.Sprintf("Token top-up %s", e.PackageID),
+			Metadata: map[string]any{"provider": provider, "sessionId": e.ObjectID, "packageId": e.PackageID, "amountCents": e.AmountCents, "currency": e.Currency},
+			Events: func(*tokens.Result) []ev.OutboxEvent {
+				return []ev.OutboxEvent{{Type: ev.EventTokensPurchased, Subject: e.UserID, Data: map[string]any{
+					"userId": e.UserID, "tokens": e.Tokens, "packageId": e.PackageID, "amountCents": e.AmountCents, "currency": e.Currency, "sessionId": e.ObjectID,
+				}}}
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if !res.Replayed {
+			out.Granted = e.Tokens
+		}
+	case KindSubscription:
+		if _, ok := domain.LookupPlan(e.PlanID); !ok {
+			return fmt.Errorf("subscription checkout %s has unknown plan %q", e.ObjectID, e.PlanID)
+		}
+		t, err := p.Subs.Activate(ctx, subscriptions.Activation{
+			UserID: e.UserID, PlanID: e.PlanID, CustomerID: e.CustomerID, AmountCents: e.AmountCents, Reference: provider + ":" + e.ObjectID,
+		}, time.Now())
+		if err != nil {
+			return err
+		}
+		out.Activated = t
+	default:
+		return fmt.Errorf("checkout %s has unknown kind %q", e.ObjectID, e.Kind)
+	}
+	if cs, ok := p.Events.(CheckoutStore); ok {
+		return cs.CompleteCheckout(ctx, provider, e.ObjectID, e.ID)
+	}
+	return nil
+}
+
+// Charger adapts a Provider to subscriptions.Charger, charging the subscription's saved
+// customer off-session.
+type Charger struct {
+	Provider Provider
+	// Customer returns the provider customer id of a user.
+	Customer func(ctx context.Context, userID string) (string, error)
+}
+
+// Charge implements subscriptions.Charger.
+func (c *Charger) Charge(ctx context.Context, ch subscriptions.Charge) error {
+	customer, err := c.Customer(ctx, ch.UserID)
+	if err != nil {
+		return err
+	}
+	if customer == "" {
+		return ErrNoPaymentMethod
+	}
+	_, err = c.Provider.Charge(ctx, ChargeRequest{
+		CustomerID: customer, AmountCents: ch.AmountCents, Currency: ch.Currency, IdempotencyKey: ch.IdempotencyKey,
+		Description: fmt.Sprintf("%s plan %s", ch.PlanID, ch.Reason),
+		Metadata:    map[string]string{"userId": ch.UserID, "subscriptionId": ch.SubscriptionID, "planId": ch.PlanID, "kind": ch.Reason},
+	})
+	return err
+}
@@ -0,0 +1,165 @@
+// Package pricing keeps the versioned price books ("PriceBook") and resolves quotes for
+// reservations. Versions are immutable once published; the active one is the latest version
+// whose effectiveAt has passed.
+package pricing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+)
+
+// ErrVersionExists is returned when publishing a version that is already stored.
+var ErrVersionExists = errors.New("price book version already exists")
+
+// Summary describes a stored version without its prices.
+type Summary struct {
+	Version     string    `json:"version"`
+	EffectiveAt time.Time `json:"effectiveAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Store reads and publishes price books. Versions are cached forever (they never change); the
+// active version is re-resolved every TTL.
+type Store struct {
+	db *pgxpool.Pool
+	// TTL bounds how long a newly effective version can go unnoticed (default 1m).
+	TTL time.Duration
+
+	mu       sync.Mutex
+	versions map[string]*domain.PriceBook
+	active   *domain.PriceBook
+	loadedAt time.Time
+}
+
+// New returns a Store backed by db.
+func New(db *pgxpool.Pool) *Store {
+	return &Store{db: db, TTL: time.Minute, versions: map[string]*domain.PriceBook{}}
+}
+
+// Seed stores b unless its version exists; it reports whether b was stored.
+func (s *Store) Seed(ctx context.Context, b *domain.PriceBook) (bool, error) {
+	err := s.Publish(ctx, b)
+	if errors.Is(err, ErrVersionExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Publish stores a new version. EffectiveAt defaults to now.
+func (s *Store) Publish(ctx context.Context, b *domain.PriceBook) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	if b.EffectiveAt.IsZero() {
+		b.EffectiveAt = time.Now().UTC()
+	}
+	raw, _ := json.Marshal(b)
+	tag, err := s.db.Exec(ctx, `
+        INSERT INTO "PriceBook" (version, "effectiveAt", book, "createdAt") VALUES ($1, $2, $3::jsonb, NOW())
+        ON CONFLICT (version) DO NOTHING
+    `, b.Version, b.EffectiveAt.UTC(), string(raw))
+	if err != nil {
+		return fmt.Errorf("failed to insert price book: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrVersionExists, b.Version)
+	}
+	s.mu.Lock()
+	s.loadedAt = time.Time{}
+	s.mu.Unlock()
+	return nil
+}
+
+// Active returns the price book in effect now.
+func (s *Store) Active(ctx context.Context) (*domain.PriceBook, error) {
+	s.mu.Lock()
+	if s.active != nil && time.Since(s.loadedAt) < s.TTL {
+		b := s.active
+		s.mu.Unlock()
+		return b, nil
+	}
+	s.mu.Unlock()
+	b, err := s.load(ctx, `SELECT book::text FROM "PriceBook" WHERE "effectiveAt" <= NOW() ORDER BY "effectiveAt" DESC, "createdAt" DESC LIMIT 1`)
+	if errors.Is(err, domain.ErrPriceBookNotFound) {
+		b, err = domain.DefaultPriceBook(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.active, s.loadedAt = b, time.Now()
+	s.mu.Unlock()
+	return b, nil
+}
+
+// Version returns a stored version; "" means the active one.
+func (s *Store) Version(ctx context.Context, version string) (*domain.PriceBook, error) {
+	if version == "" {
+		return s.Active(ctx)
+	}
+	s.mu.Lock()
+	b, ok := s.versions[version]
+	s.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	b, err := s.load(ctx, `SELECT book::text FROM "PriceBook" WHERE version=$1`, version)
+	if errors.Is(err, domain.ErrPriceBookNotFound) && version == domain.DefaultPriceBook().Version {
+		return domain.DefaultPriceBook(), nil
+	}
+	return b, err
+}
+
+// Quote prices items for planID under version ("" for the active version).
+func (s *Store) Quote(ctx context.Context, version, planID string, items []domain.Item) (*domain.Quote, error) {
+	b, err := s.Version(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return b.Quote(planID, items...)
+}
+
+// List returns every stored version, newest first.
+func (s *Store) List(ctx context.Context) ([]Summary, error) {
+	rows, err := s.db.Query(ctx, `SELECT version, "effectiveAt", "createdAt" FROM "PriceBook" ORDER BY "effectiveAt" DESC, "createdAt" DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query price books: %w", err)
+	}
+	defer rows.Close()
+	var out []Summary
+	for rows.Next() {
+		var sm Summary
+		if err := rows.Scan(&sm.Version, &sm.EffectiveAt, &sm.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan price book: %w", err)
+		}
+		out = append(out, sm)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) load(ctx context.Context, query string, args ...any) (*domain.PriceBook, error) {
+	var raw string
+	err := s.db.QueryRow(ctx, query, args...).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrPriceBookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query price book: %w", err)
+	}
+	var b domain.PriceBook
+	if err := json.Unmarshal([]byte(raw), &b); err != nil {
+		return nil, fmt.Errorf("failed to decode price book: %w", err)
+	}
+	s.mu.Lock()
+	s.versions[b.Version] = &b
+	s.mu.Unlock()
+	return &b, nil
+}
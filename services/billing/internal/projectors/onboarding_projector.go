@@ -6,6 +6,7 @@ import (
 	"context"
 	"log"
 	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -52,7 +53,14 @@ func (p *OnboardingProjector) HandleOfferCreated(ctx context.Context, event doma
 	if rewardTokens <= 0 {
 		log.Printf("PROJECTOR: No reward tokens for step '%s'. Marking as complete without reward.", stepID)
 	} else {
-		// 3. Update user's token balance.
+		// 3. Post the grant to the ledger and update user's token balance.
+		if _, err = ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{
+			Kind: ledger.KindGrant, UserID: event.UserID, Reference: "onboarding:" + event.UserID + ":" + stepID, Description: stepID,
+			Lines: ledger.Move(ledger.System(ledger.AccountPromo), ledger.Wallet(event.UserID), int64(rewardTokens)),
+		}); err != nil {
+			log.Printf("ERROR: Failed to post onboarding grant for user %s: %v", event.UserID, err)
+			return err // Rollback
+		}
 		_, err = tx.Exec(ctx, `UPDATE "UserToken" SET balance = balance + $1 WHERE "userId" = $2`, rewardTokens, event.UserID)
 		if err != nil {
 			log.Printf("ERROR: Failed to update token balance for user %s: %v", event.UserID, err)
@@ -5,6 +5,7 @@ package projectors
 import (
 	"context"
 	"database/sql"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
 	"github.com/xxrenzhe/autoads/services/identity/internal/domain"
 	"log"
 	"time"
@@ -43,12 +44,23 @@ func (p *SubscriptionProjector) HandleUserRegistered(ctx context.Context, event
 		return err
 	}
 
-	// 2. Create the initial token balance (1,000 for Free plan)
+	// 2. Grant the initial token balance (1,000 for Free plan) once per user
 	initialTokens := 1000
+	posted, err := ledger.Post(ctx, ledger.SQLExec(tx), &ledger.Entry{
+		Kind: ledger.KindGrant, UserID: event.UserID, Reference: "signup:" + event.UserID, Description: "signup_grant",
+		Lines: ledger.Move(ledger.System(ledger.AccountPromo), ledger.Wallet(event.UserID), int64(initialTokens)),
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to post signup grant for user %s: %v", event.UserID, err)
+		return err
+	}
+	if !posted {
+		return tx.Commit()
+	}
 	_, err = tx.ExecContext(ctx, `
 		INSERT INTO "UserToken" ("userId", balance, "updatedAt")
 		VALUES ($1, $2, NOW())
-		ON CONFLICT ("userId") DO NOTHING`,
+		ON CONFLICT ("userId") DO UPDATE SET balance = "UserToken".balance + $2, "updatedAt" = NOW()`,
 		event.UserID, initialTokens)
 	if err != nil {
 		log.Printf("ERROR: Failed to project user token for user %s: %v", event.UserID, err)
@@ -0,0 +1,161 @@
+package statements
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Download formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatPDF  = "pdf"
+)
+
+// ContentType returns the MIME type of a download format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatPDF:
+		return "application/pdf"
+	}
+	return "application/json"
+}
+
+// Filename returns the download name, e.g. "statement-2026-09-3.pdf".
+func (s *Statement) Filename(format string) string {
+	return fmt.Sprintf("statement-%s-%d.%s", s.PeriodStart.Format("2006-01"), s.Sequence, format)
+}
+
+// Render writes the statement in format (json, csv or pdf).
+func Render(w io.Writer, s *Statement, format string) error {
+	switch format {
+	case FormatJSON, "":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	case FormatCSV:
+		return RenderCSV(w, s)
+	case FormatPDF:
+		return RenderPDF(w, s)
+	}
+	return fmt.Errorf("unsupported statement format %q", format)
+}
+
+// rows lists the statement as (field, value) pairs in the order of the CSV and PDF renderings.
+func (s *Statement) rows() [][2]string {
+	i := func(n int64) string { return strconv.FormatInt(n, 10) }
+	out := [][2]string{
+		{"statement", s.ID},
+		{"sequence", i(s.Sequence)},
+		{"user", s.UserID},
+		{"period_start", s.PeriodStart.Format("2006-01-02")},
+		{"period_end", s.PeriodEnd.Format("2006-01-02")},
+		{"plan", s.PlanID},
+		{"plan_fee", money(s.PlanFeeCents)},
+		{"purchases", money(s.PurchaseCents)},
+		{"currency", s.Currency},
+		{"opening_balance", i(s.OpeningBalance)},
+		{"tokens_granted", i(s.Granted)},
+		{"tokens_purchased", i(s.Purchased)},
+		{"tokens_spent", i(s.Spent)},
+	}
+	for _, c := range Categories {
+		out = append(out, [2]string{"tokens_spent_" + c, i(s.SpentByCategory[c])})
+	}
+	return append(out,
+		[2]string{"tokens_reserved", i(s.Reserved)},
+		[2]string{"tokens_released", i(s.Released)},
+		[2]string{"tokens_refunded", i(s.Refunded)},
+		[2]string{"tokens_expired", i(s.Expired)},
+		[2]string{"tokens_transferred_in", i(s.TransferredIn)},
+		[2]string{"tokens_transferred_out", i(s.TransferredOut)},
+		[2]string{"closing_balance", i(s.ClosingBalance)},
+		[2]string{"generated_at", s.GeneratedAt.Format("2006-01-02T15:04:05Z07:00")},
+		[2]string{"checksum", s.Checksum},
+	)
+}
+
+func money(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// RenderCSV writes the statement as field,value rows.
+func RenderCSV(w io.Writer, s *Statement) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"field", "value"}); err != nil {
+		return err
+	}
+	for _, r := range s.rows() {
+		if err := cw.Write(r[:]); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// RenderPDF writes the statement as a one-page PDF in a built-in font. Values are ASCII (ids,
+// numbers and dates), so no font embedding is needed.
+func RenderPDF(w io.Writer, s *Statement) error {
+	var content bytes.Buffer
+	content.WriteString("BT\n/F1 16 Tf\n56 780 Td\n")
+	fmt.Fprintf(&content, "(%s) Tj\n", pdfText("Usage statement "+s.PeriodStart.Format("January 2006")))
+	content.WriteString("/F1 10 Tf\n0 -28 Td\n14 TL\n")
+	for _, r := range s.rows() {
+		label := strings.ReplaceAll(r[0], "_", " ")
+		fmt.Fprintf(&content, "(%s) Tj\n", pdfText(fmt.Sprintf("%-20s %s", label, r[1])))
+		content.WriteString("T*\n")
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// pdfText escapes a string for a PDF literal and drops characters outside printable ASCII.
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,158 @@
+// Package statements closes monthly usage statements: per wallet (a user's or an organization's)
+// and calendar month (UTC), the tokens granted, purchased, spent by action category, reserved
+// and released, plus the plan fee charged in the period. Statements are computed from the ledger
+// once the month is over, stored in "UsageStatement" with a per-wallet sequence number and never
+// changed afterwards.
+package statements
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+)
+
+// Spend categories; actions outside the known products count as CategoryOther.
+const (
+	CategorySiterank  = "siterank"
+	CategoryBatchopen = "batchopen"
+	CategoryAdscenter = "adscenter"
+	CategoryOther     = "other"
+)
+
+// Categories lists the spend categories in statement order.
+var Categories = []string{CategorySiterank, CategoryBatchopen, CategoryAdscenter, CategoryOther}
+
+// Statement summarizes the token usage of one wallet over [PeriodStart, PeriodEnd). UserID is a
+// user id or, for organization wallets, "org:<id>".
+type Statement struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"userId"`
+	Sequence    int64     `json:"sequence"`
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	PlanID      string    `json:"planId"`
+	// PlanFeeCents is what subscription charges billed in the period, in the smallest unit of Currency.
+	PlanFeeCents int64 `json:"planFeeCents"`
+	// PurchaseCents is what token top-ups completed in the period cost.
+	PurchaseCents int64  `json:"purchaseCents"`
+	Currency      string `json:"currency"`
+
+	OpeningBalance int64 `json:"openingBalance"`
+	// Granted counts plan allowances and rewards; purchased tokens are reported separately.
+	Granted   int64 `json:"granted"`
+	Purchased int64 `json:"purchased"`
+	Spent     int64 `json:"spent"`
+	// SpentByCategory always lists every category in Categories.
+	SpentByCategory map[string]int64 `json:"spentByCategory"`
+	Reserved        int64            `json:"reserved"`
+	// Released counts reserved tokens returned unspent, by release, expiry or partial commit.
+	Released int64 `json:"released"`
+	Refunded int64 `json:"refunded"`
+	Expired  int64 `json:"expired"`
+	// TransferredIn and TransferredOut count tokens moved between a member's and an
+	// organization's wallet.
+	TransferredIn  int64 `json:"transferredIn"`
+	TransferredOut int64 `json:"transferredOut"`
+	ClosingBalance int64 `json:"closingBalance"`
+
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Checksum is the SHA-256 of the statement figures, so copies can be checked against the original.
+	Checksum string `json:"checksum"`
+}
+
+// Movement is one ledger entry of the statement's user: its kind, the action category it was
+// priced for and the net amount per account.
+type Movement struct {
+	Kind     string
+	Category string
+	Accounts map[string]int64
+}
+
+// Period returns the calendar month (UTC) containing t.
+func Period(t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// LastClosed returns the start of the most recent month that ended before now.
+func LastClosed(now time.Time) time.Time {
+	start, _ := Period(now)
+	return start.AddDate(0, -1, 0)
+}
+
+// CategoryOf maps an action key (e.g. "siterank.query.realtime") to its spend category.
+func CategoryOf(action string) string {
+	prefix, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(action)), ".")
+	switch prefix {
+	case CategorySiterank, CategoryBatchopen, CategoryAdscenter:
+		return prefix
+	}
+	return CategoryOther
+}
+
+// Summarize adds the movements to s, which carries the opening balance, and derives the closing
+// balance and checksum. Tokens spent are what reached revenue; a commit returns the unspent rest of
+// its hold to the wallet, which counts as released.
+func Summarize(s *Statement, moves []Movement) {
+	if s.SpentByCategory == nil {
+		s.SpentByCategory = map[string]int64{}
+	}
+	for _, c := range Categories {
+		s.SpentByCategory[c] += 0
+	}
+	net := int64(0)
+	for _, m := range moves {
+		wallet := m.Accounts[ledger.AccountWallet]
+		held := m.Accounts[ledger.AccountHeld]
+		net += wallet + held
+		switch m.Kind {
+		case ledger.KindGrant:
+			if m.Accounts[ledger.AccountPurchase] != 0 {
+				s.Purchased += wallet
+			} else {
+				s.Granted += wallet
+			}
+		case ledger.KindReserve:
+			s.Reserved += held
+		case ledger.KindRelease:
+			s.Released += wallet
+		case ledger.KindCommit, ledger.KindDebit:
+			spent := m.Accounts[ledger.AccountRevenue]
+			s.Spent += spent
+			cat := m.Category
+			if cat == "" {
+				cat = CategoryOther
+			}
+			s.SpentByCategory[cat] += spent
+			if m.Kind == ledger.KindCommit {
+				s.Released += wallet
+			}
+		case ledger.KindRefund:
+			s.Refunded += wallet
+		case ledger.KindExpiry:
+			s.Expired += m.Accounts[ledger.AccountExpired]
+		case ledger.KindTransfer:
+			if wallet > 0 {
+				s.TransferredIn += wallet
+			} else {
+				s.TransferredOut -= wallet
+			}
+		}
+	}
+	s.ClosingBalance = s.OpeningBalance + net
+	s.Checksum = s.checksum()
+}
+
+// checksum hashes the figures; the id, sequence and generation time are not part of it.
+func (s *Statement) checksum() string {
+	c := *s
+	c.ID, c.Sequence, c.GeneratedAt, c.Checksum = "", 0, time.Time{}, ""
+	raw, _ := json.Marshal(c)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
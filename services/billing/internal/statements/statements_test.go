@@ -0,0 +1,128 @@
+package statements
+
+import (
+	"bytes"
+	"encoding/csv"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+)
+
+func sampleStatement() *Statement {
+	start, end := Period(time.Date(2026, 9, 14, 8, 0, 0, 0, time.UTC))
+	s := &Statement{ID: "st-1", UserID: "u1", Sequence: 3, PeriodStart: start, PeriodEnd: end, PlanID: "pro", PlanFeeCents: 29800, Currency: "CNY", OpeningBalance: 100}
+	Summarize(s, []Movement{
+		{Kind: ledger.KindGrant, Accounts: map[string]int64{ledger.AccountPlan: -1000, ledger.AccountWallet: 1000}},
+		{Kind: ledger.KindGrant, Accounts: map[string]int64{ledger.AccountPurchase: -500, ledger.AccountWallet: 500}},
+		{Kind: ledger.KindReserve, Accounts: map[string]int64{ledger.AccountWallet: -30, ledger.AccountHeld: 30}},
+		// partial commit: 20 spent, 10 back to the wallet
+		{Kind: ledger.KindCommit, Category: CategorySiterank, Accounts: map[string]int64{ledger.AccountHeld: -30, ledger.AccountRevenue: 20, ledger.AccountWallet: 10}},
+		{Kind: ledger.KindReserve, Accounts: map[string]int64{ledger.AccountWallet: -5, ledger.AccountHeld: 5}},
+		{Kind: ledger.KindRelease, Accounts: map[string]int64{ledger.AccountHeld: -5, ledger.AccountWallet: 5}},
+		{Kind: ledger.KindDebit, Category: CategoryBatchopen, Accounts: map[string]int64{ledger.AccountWallet: -7, ledger.AccountRevenue: 7}},
+		{Kind: ledger.KindDebit, Accounts: map[string]int64{ledger.AccountWallet: -2, ledger.AccountRevenue: 2}},
+		{Kind: ledger.KindExpiry, Accounts: map[string]int64{ledger.AccountWallet: -40, ledger.AccountExpired: 40}},
+		// funding an organization wallet only shows the user's side
+		{Kind: ledger.KindTransfer, Accounts: map[string]int64{ledger.AccountWallet: -50}},
+	})
+	return s
+}
+
+func TestSummarize(t *testing.T) {
+	s := sampleStatement()
+	want := map[string][2]int64{
+		"granted":   {s.Granted, 1000},
+		"purchased": {s.Purchased, 500},
+		"spent":     {s.Spent, 29},
+		"reserved":  {s.Reserved, 35},
+		"released":  {s.Released, 15},
+		"expired":   {s.Expired, 40},
+		"closing":   {s.ClosingBalance, 100 + 1000 + 500 - 29 - 40 - 50},
+		"transfer":  {s.TransferredOut, 50},
+		"siterank":  {s.SpentByCategory[CategorySiterank], 20},
+		"batchopen": {s.SpentByCategory[CategoryBatchopen], 7},
+		"adscenter": {s.SpentByCategory[CategoryAdscenter], 0},
+		"other":     {s.SpentByCategory[CategoryOther], 2},
+	}
+	for name, v := range want {
+		if v[0] != v[1] {
+			t.Errorf("%s = %d, want %d", name, v[0], v[1])
+		}
+	}
+	if s.Checksum == "" {
+		t.Fatal("checksum not set")
+	}
+	again := sampleStatement()
+	again.ID, again.Sequence = "st-2", 9
+	if again.checksum() != s.Checksum {
+		t.Error("checksum depends on id or sequence")
+	}
+	again.PlanFeeCents++
+	if again.checksum() == s.Checksum {
+		t.Error("checksum ignores the plan fee")
+	}
+}
+
+func TestCategoryOf(t *testing.T) {
+	cases := map[string]string{
+		"siterank.query.realtime": CategorySiterank,
+		"batchopen.task":          CategoryBatchopen,
+		"Adscenter.bulk.action":   CategoryAdscenter,
+		"workflow.start":          CategoryOther,
+		"":                        CategoryOther,
+	}
+	for action, want := range cases {
+		if got := CategoryOf(action); got != want {
+			t.Errorf("CategoryOf(%q) = %s, want %s", action, got, want)
+		}
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, sampleStatement(), FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid csv: %v", err)
+	}
+	fields := map[string]string{}
+	for _, r := range records[1:] {
+		fields[r[0]] = r[1]
+	}
+	if fields["plan_fee"] != "298.00" || fields["tokens_spent_siterank"] != "20" || fields["period_start"] != "2026-09-01" || fields["sequence"] != "3" {
+		t.Fatalf("unexpected csv fields: %v", fields)
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, sampleStatement(), FormatPDF); err != nil {
+		t.Fatal(err)
+	}
+	doc := buf.String()
+	if !strings.HasPrefix(doc, "%PDF-1.4\n") || !strings.HasSuffix(doc, "%%EOF\n") {
+		t.Fatal("missing PDF header or trailer")
+	}
+	if !strings.Contains(doc, "(Usage statement September 2026) Tj") {
+		t.Error("missing title")
+	}
+	// every xref offset must point at its object
+	m := regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(doc)
+	if m == nil {
+		t.Fatal("missing startxref")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	lines := strings.Split(doc[xref:], "\n")
+	for i := 1; i <= 5; i++ {
+		off, _ := strconv.Atoi(lines[2+i][:10])
+		if want := strconv.Itoa(i) + " 0 obj"; !strings.HasPrefix(doc[off:], want) {
+			t.Errorf("xref entry %d points at %q", i, doc[off:off+10])
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package statements
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/outbox"
+)
+
+// ErrNotFound is returned for unknown statements.
+var ErrNotFound = errors.New("statement not found")
+
+// ErrPeriodOpen is returned when closing a month that has not ended yet.
+var ErrPeriodOpen = errors.New("statement period has not ended")
+
+// Store generates and reads statements in "UsageStatement".
+type Store struct {
+	db *pgxpool.Pool
+}
+
+// New returns a Store backed by db.
+func New(db *pgxpool.Pool) *Store {
+	return &Store{db: db}
+}
+
+// Close generates the statements of the month starting at start for up to limit users with
+// activity in it and no statement yet. It returns the statements it created; run it again until
+// none are returned to close a busy month.
+func (s *Store) Close(ctx context.Context, start time.Time, now time.Time, limit int) ([]*Statement, error) {
+	start, end := Period(start)
+	if end.After(now) {
+		return nil, ErrPeriodOpen
+	}
+	rows, err := s.db.Query(ctx, `
+        SELECT u."userId" FROM (
+            SELECT DISTINCT l."userId" FROM "LedgerLine" l JOIN "LedgerEntry" e ON e.id = l."entryId"
+            WHERE l."userId" IS NOT NULL AND e."createdAt" >= $1 AND e."createdAt" < $2
+            UNION
+            SELECT DISTINCT "userId" FROM "SubscriptionTransition" WHERE "createdAt" >= $1 AND "createdAt" < $2
+        ) u
+        WHERE NOT EXISTS (SELECT 1 FROM "UsageStatement" st WHERE st."userId" = u."userId" AND st."periodStart" = $1)
+        ORDER BY u."userId"
+        LIMIT $3
+    `, start, end, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query statement users: %w", err)
+	}
+	var users []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan statement user: %w", err)
+		}
+		users = append(users, uid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query statement users: %w", err)
+	}
+	var out []*Statement
+	for _, uid := range users {
+		st, created, err := s.Generate(ctx, uid, start, now)
+		if err != nil {
+			return out, fmt.Errorf("user %s: %w", uid, err)
+		}
+		if created {
+			out = append(out, st)
+		}
+	}
+	return out, nil
+}
+
+// Generate returns the user's statement for the month starting at start, computing and storing
+// it first if it does not exist. created reports whether this call stored it; UsageStatementIssued
+// is recorded in the outbox with the statement.
+func (s *Store) Generate(ctx context.Context, userID string, start time.Time, now time.Time) (st *Statement, created bool, err error) {
+	start, end := Period(start)
+	if end.After(now) {
+		return nil, false, ErrPeriodOpen
+	}
+	if st, err := s.byPeriod(ctx, userID, start); err == nil {
+		return st, false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, false, err
+	}
+	st, err = s.compute(ctx, userID, start, end)
+	if err != nil {
+		return nil, false, err
+	}
+	st.ID, st.GeneratedAt = uuid.NewString(), now.UTC()
+	raw, _ := json.Marshal(st)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback is a no-op if the transaction is committed.
+	// the sequence is the user's next number; a concurrent close of the same period loses the insert
+	err = tx.QueryRow(ctx, `
+        INSERT INTO "UsageStatement" (id, "userId", sequence, "periodStart", "periodEnd", data, checksum, "createdAt")
+        SELECT $1, $2, COALESCE(MAX(sequence), 0) + 1, $3, $4, $5::jsonb, $6, $7
+        FROM "UsageStatement" WHERE "userId" = $2
+        ON CONFLICT DO NOTHING
+        RETURNING sequence
+    `, st.ID, userID, start, end, string(raw), st.Checksum, st.GeneratedAt).Scan(&st.Sequence)
+	created = err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, fmt.Errorf("failed to store statement: %w", err)
+	}
+	if created {
+		if err := outbox.Enqueue(ctx, tx, ev.OutboxEvent{Type: ev.EventUsageStatementIssued, Subject: st.ID, Data: map[string]any{
+			"statementId": st.ID, "userId": st.UserID, "sequence": st.Sequence, "periodStart": st.PeriodStart.Format(time.RFC3339), "periodEnd": st.PeriodEnd.Format(time.RFC3339),
+			"spent": st.Spent, "planFeeCents": st.PlanFeeCents, "currency": st.Currency,
+		}}); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	st, err = s.byPeriod(ctx, userID, start)
+	return st, created && err == nil, err
+}
+
+// List returns the user's statements, newest first.
+func (s *Store) List(ctx context.Context, userID string, limit int) ([]*Statement, error) {
+	return s.query(ctx, `WHERE "userId"=$1 ORDER BY sequence DESC LIMIT $2`, userID, limit)
+}
+
+// Get returns the user's statement with the given sequence number.
+func (s *Store) Get(ctx context.Context, userID string, sequence int64) (*Statement, error) {
+	out, err := s.query(ctx, `WHERE "userId"=$1 AND sequence=$2`, userID, sequence)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, ErrNotFound
+	}
+	return out[0], nil
+}
+
+func (s *Store) byPeriod(ctx context.Context, userID string, start time.Time) (*Statement, error) {
+	out, err := s.query(ctx, `WHERE "userId"=$1 AND "periodStart"=$2`, userID, start)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, ErrNotFound
+	}
+	return out[0], nil
+}
+
+// query reads stored statements; the sequence is assigned on insert, so it comes from its column.
+func (s *Store) query(ctx context.Context, where string, args ...any) ([]*Statement, error) {
+	rows, err := s.db.Query(ctx, `SELECT sequence, data::text FROM "UsageStatement" `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query statements: %w", err)
+	}
+	defer rows.Close()
+	var out []*Statement
+	for rows.Next() {
+		var (
+			seq int64
+			raw string
+		)
+		if err := rows.Scan(&seq, &raw); err != nil {
+			return nil, fmt.Errorf("failed to scan statement: %w", err)
+		}
+		var st Statement
+		if err := json.Unmarshal([]byte(raw), &st); err != nil {
+			return nil, fmt.Errorf("failed to decode statement: %w", err)
+		}
+		st.Sequence = seq
+		out = append(out, &st)
+	}
+	return out, rows.Err()
+}
+
+// compute builds the statement from the ledger, subscription transitions and checkouts.
+func (s *Store) compute(ctx context.Context, userID string, start, end time.Time) (*Statement, error) {
+	st := &Statement{UserID: userID, PeriodStart: start, PeriodEnd: end, PlanID: domain.FreePlanID, Currency: "CNY"}
+	if _, ok := domain.WalletOrg(userID); ok {
+		// organizations have no plan of their own
+		st.PlanID = ""
+	}
+	if err := s.db.QueryRow(ctx, `
+        SELECT COALESCE(SUM(l.amount), 0)::bigint FROM "LedgerLine" l JOIN "LedgerEntry" e ON e.id = l."entryId"
+        WHERE l."userId" = $1 AND e."createdAt" < $2
+    `, userID, start).Scan(&st.OpeningBalance); err != nil {
+		return nil, fmt.Errorf("failed to query opening balance: %w", err)
+	}
+	moves, err := s.movements(ctx, userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var planID *string
+	if err := s.db.QueryRow(ctx, `
+        SELECT COALESCE(SUM("chargedCents") FILTER (WHERE "createdAt" >= $2), 0)::bigint,
+               (SELECT "planId" FROM "SubscriptionTransition" WHERE "userId" = $1 AND "createdAt" < $3 ORDER BY "createdAt" DESC LIMIT 1)
+        FROM "SubscriptionTransition" WHERE "userId" = $1 AND "createdAt" < $3
+    `, userID, start, end).Scan(&st.PlanFeeCents, &planID); err != nil {
+		return nil, fmt.Errorf("failed to query plan fee: %w", err)
+	}
+	if planID != nil && *planID != "" {
+		st.PlanID = *planID
+	}
+	if p, ok := domain.LookupPlan(st.PlanID); ok && p.Currency != "" {
+		st.Currency = p.Currency
+	}
+	if err := s.db.QueryRow(ctx, `
+        SELECT COALESCE(SUM("amountCents"), 0)::bigint FROM "PaymentCheckout"
+        WHERE "userId" = $1 AND kind = 'topup' AND status = 'completed' AND "completedAt" >= $2 AND "completedAt" < $3
+    `, userID, start, end).Scan(&st.PurchaseCents); err != nil {
+		return nil, fmt.Errorf("failed to query top-ups: %w", err)
+	}
+	Summarize(st, moves)
+	return st, nil
+}
+
+// movements returns the ledger entries in the period that move the wallet of userID (a user or
+// organization wallet id), with the amounts of that wallet's and the system accounts. The spend
+// category comes from the first priced action recorded on the entry.
+func (s *Store) movements(ctx context.Context, userID string, start, end time.Time) ([]Movement, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT e.id, e.kind, COALESCE(e.metadata->'lines'->0->>'action', ''), l.account, SUM(l.amount)::bigint
+        FROM "LedgerEntry" e JOIN "LedgerLine" l ON l."entryId" = e.id
+        WHERE e."createdAt" >= $2 AND e."createdAt" < $3 AND (l."userId" = $1 OR l."userId" IS NULL)
+          AND EXISTS (SELECT 1 FROM "LedgerLine" o WHERE o."entryId" = e.id AND o."userId" = $1)
+        GROUP BY e.id, e.kind, e."createdAt", 3, l.account
+        ORDER BY e."createdAt", e.id
+    `, userID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+	var (
+		out  []Movement
+		last string
+	)
+	for rows.Next() {
+		var (
+			id, kind, action, account string
+			amount                    int64
+		)
+		if err := rows.Scan(&id, &kind, &action, &account, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger line: %w", err)
+		}
+		if id != last || len(out) == 0 {
+			cat := ""
+			if action != "" {
+				cat = CategoryOf(action)
+			}
+			out = append(out, Movement{Kind: kind, Category: cat, Accounts: map[string]int64{}})
+			last = id
+		}
+		out[len(out)-1].Accounts[account] += amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	return out, nil
+}
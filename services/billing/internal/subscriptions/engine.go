@@ -0,0 +1,463 @@
+// Package subscriptions drives the subscription lifecycle: trial end, monthly renewals with
+// plan token grants and expiry, past-due retries, cancellation and prorated plan changes.
+//
+// Every step is idempotent. Charges carry an idempotency key and token grants and expiries
+// carry ledger references derived from the period being closed, so a sweep that crashes half
+// way simply repeats the step; the subscription row is written last, guarded by the state it
+// was read in.
+package subscriptions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/outbox"
+	"github.com/xxrenzhe/autoads/services/billing/internal/tokens"
+)
+
+var (
+	// ErrNotFound is returned when the user has no subscription.
+	ErrNotFound = errors.New("subscription not found")
+	// ErrUnknownPlan is returned for plan ids outside domain.AvailablePlans.
+	ErrUnknownPlan = errors.New("unknown plan")
+	// ErrConflict is returned when the subscription changed while a step was applied.
+	ErrConflict = errors.New("subscription changed concurrently")
+	// ErrPaymentFailed wraps charge errors for plan changes.
+	ErrPaymentFailed = errors.New("payment failed")
+)
+
+// Charge asks the payment provider for money.
+type Charge struct {
+	SubscriptionID string
+	UserID         string
+	PlanID         string
+	AmountCents    int64
+	Currency       string
+	// IdempotencyKey identifies the charge; the provider must not collect the same key twice.
+	IdempotencyKey string
+	// Reason is "renewal" or "proration".
+	Reason string
+}
+
+// Charger collects subscription fees.
+type Charger interface {
+	Charge(ctx context.Context, c Charge) error
+}
+
+// Transition is one lifecycle step, published as Event through the outbox.
+type Transition struct {
+	Event          string            `json:"event"`
+	SubscriptionID string            `json:"subscriptionId"`
+	UserID         string            `json:"userId"`
+	PlanID         string            `json:"planId"`
+	From           string            `json:"from"`
+	To             string            `json:"to"`
+	Reason         string            `json:"reason,omitempty"`
+	PeriodStart    time.Time         `json:"periodStart"`
+	PeriodEnd      time.Time         `json:"periodEnd"`
+	ChargedCents   int64             `json:"chargedCents,omitempty"`
+	Granted        int64             `json:"granted,omitempty"`
+	Rollover       int64             `json:"rollover,omitempty"`
+	Expired        int64             `json:"expired,omitempty"`
+	Proration      *domain.Proration `json:"proration,omitempty"`
+	At             time.Time         `json:"at"`
+}
+
+// Engine applies lifecycle steps to "Subscription" rows.
+type Engine struct {
+	db      *pgxpool.Pool
+	tokens  *tokens.Store
+	charger Charger
+	// Grace is how long a past-due subscription keeps retrying before it is canceled.
+	Grace time.Duration
+	// RetryInterval spaces renewal charge retries of past-due subscriptions.
+	RetryInterval time.Duration
+}
+
+// New returns an Engine. A nil charger means fees are collected out of band, so paid renewals
+// always succeed.
+func New(db *pgxpool.Pool, store *tokens.Store, charger Charger) *Engine {
+	return &Engine{db: db, tokens: store, charger: charger, Grace: 7 * 24 * time.Hour, RetryInterval: 24 * time.Hour}
+}
+
+// SetCharger replaces the charger (nil collects out of band).
+func (e *Engine) SetCharger(c Charger) { e.charger = c }
+
+// Get returns the user's subscription.
+func (e *Engine) Get(ctx context.Context, userID string) (*domain.Subscription, error) {
+	s, _, err := e.load(ctx, `"userId"=$1`, userID)
+	return s, err
+}
+
+// Sweep advances up to limit subscriptions whose period ended before now and returns the
+// transitions. A failing subscription is logged and skipped so it cannot stall the others.
+func (e *Engine) Sweep(ctx context.Context, now time.Time, limit int) ([]Transition, error) {
+	rows, err := e.db.Query(ctx, `
+        SELECT id FROM "Subscription"
+        WHERE status IN ($1, $2, $3) AND "currentPeriodEnd" <= $4 AND ("nextAttemptAt" IS NULL OR "nextAttemptAt" <= $4)
+        ORDER BY "currentPeriodEnd"
+        LIMIT $5
+    `, domain.StatusTrialing, domain.StatusActive, domain.StatusPastDue, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due subscriptions: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate subscriptions: %w", err)
+	}
+
+	var out []Transition
+	for _, id := range ids {
+		t, err := e.advance(ctx, id, now)
+		if err != nil {
+			log.Printf("billing: subscription %s: %v", id, err)
+			continue
+		}
+		if t != nil {
+			out = append(out, *t)
+		}
+	}
+	return out, nil
+}
+
+// advance closes the period of one due subscription: cancel it, renew it or mark it past due.
+func (e *Engine) advance(ctx context.Context, id string, now time.Time) (*Transition, error) {
+	s, next, err := e.load(ctx, `id=$1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDue(now) || (next != nil && now.Before(*next)) {
+		return nil, nil
+	}
+	plan, ok := domain.LookupPlan(s.PlanID, s.PlanName)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlan, s.PlanID)
+	}
+	prev := *s
+	t := &Transition{SubscriptionID: s.ID, UserID: s.UserID, PlanID: plan.ID, From: s.Status, At: now}
+	// plan tokens of the closing period, keyed by its end so retries reuse the same entries
+	period := fmt.Sprintf("%s:%d", s.ID, s.CurrentPeriodEnd.Unix())
+
+	if s.CancelAtPeriodEnd || s.GraceExpired(now, e.Grace) {
+		t.Reason = "grace_expired"
+		if s.CancelAtPeriodEnd {
+			t.Reason = "canceled_at_period_end"
+		}
+		// nothing rolls over into a period that never starts
+		if _, err := e.expirePlanTokens(ctx, s, domain.Plan{}, period, t); err != nil {
+			return nil, err
+		}
+		s.Cancel()
+		s.PlanTokens = 0
+		t.Event, t.To = ev.EventSubscriptionCanceled, s.Status
+		t.PeriodStart, t.PeriodEnd = s.CurrentPeriodStart, s.CurrentPeriodEnd
+		return t, e.save(ctx, &prev, s, nil, t)
+	}
+
+	amount := plan.PriceCents - s.CreditCents
+	if amount < 0 {
+		amount = 0
+	}
+	if amount > 0 && e.charger != nil {
+		err := e.charger.Charge(ctx, Charge{
+			SubscriptionID: s.ID, UserID: s.UserID, PlanID: plan.ID, AmountCents: amount, Currency: plan.Currency,
+			IdempotencyKey: "renewal:" + period, Reason: "renewal",
+		})
+		if err != nil {
+			s.MarkPastDue(now)
+			retry := now.Add(e.RetryInterval)
+			t.Reason = err.Error()
+			if prev.Status == domain.StatusPastDue {
+				// still failing; only the retry time moves
+				return nil, e.save(ctx, &prev, s, &retry, nil)
+			}
+			t.Event, t.To = ev.EventSubscriptionPastDue, s.Status
+			t.PeriodStart, t.PeriodEnd = s.CurrentPeriodStart, s.CurrentPeriodEnd
+			return t, e.save(ctx, &prev, s, &retry, t)
+		}
+		t.ChargedCents = amount
+	}
+	s.CreditCents -= plan.PriceCents - amount
+
+	rollover, err := e.expirePlanTokens(ctx, s, plan, period, t)
+	if err != nil {
+		return nil, err
+	}
+	s.Renew(now)
+	s.PlanTokens = rollover
+	if plan.IncludedTokens > 0 {
+		res, err := e.tokens.Grant(ctx, tokens.Grant{
+			UserID: s.UserID, Amount: plan.IncludedTokens, From: ledger.AccountPlan, Reference: "plan-grant:" + period,
+			Source: "subscription", Description: fmt.Sprintf("%s plan tokens %s", plan.Name, s.CurrentPeriodStart.Format("2006-01-02")),
+			Metadata: map[string]any{"subscriptionId": s.ID, "planId": plan.ID, "periodEnd": s.CurrentPeriodEnd.UTC().Format(time.RFC3339)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant plan tokens: %w", err)
+		}
+		s.PlanTokens += plan.IncludedTokens
+		if !res.Replayed {
+			t.Granted = plan.IncludedTokens
+		}
+	}
+	t.Event, t.To = ev.EventSubscriptionRenewed, s.Status
+	if prev.Status != domain.StatusActive {
+		t.Event = ev.EventSubscriptionActivated
+	}
+	t.PeriodStart, t.PeriodEnd = s.CurrentPeriodStart, s.CurrentPeriodEnd
+	return t, e.save(ctx, &prev, s, nil, t)
+}
+
+// expirePlanTokens expires the plan tokens of the closing period that exceed plan's rollover
+// cap and returns the tokens carried over.
+func (e *Engine) expirePlanTokens(ctx context.Context, s *domain.Subscription, plan domain.Plan, period string, t *Transition) (int64, error) {
+	if s.PlanTokens <= 0 {
+		return 0, nil
+	}
+	w, err := e.tokens.Wallet(ctx, s.UserID)
+	if err != nil {
+		return 0, err
+	}
+	rollover, expire := plan.Rollover(s.PlanTokens, w.Available())
+	t.Rollover = rollover
+	if expire > 0 {
+		res, err := e.tokens.Expire(ctx, s.UserID, expire, "plan-expiry:"+period, "plan tokens expired",
+			map[string]any{"subscriptionId": s.ID, "planId": s.PlanID, "rollover": rollover})
+		if err != nil {
+			return 0, fmt.Errorf("failed to expire plan tokens: %w", err)
+		}
+		t.Expired = res.Spent
+	}
+	return rollover, nil
+}
+
+// ChangePlan switches the user's plan now. Upgrades charge the prorated price difference and
+// grant the prorated extra tokens; downgrades credit the difference to the next renewal.
+func (e *Engine) ChangePlan(ctx context.Context, userID, planID string, now time.Time) (*Transition, error) {
+	to, ok := domain.LookupPlan(planID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlan, planID)
+	}
+	s, _, err := e.load(ctx, `"userId"=$1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	prev := *s
+	from, _ := domain.LookupPlan(s.PlanID, s.PlanName)
+	if from.ID == to.ID {
+		return nil, nil
+	}
+	p, err := s.ChangePlan(to, now)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("proration:%s:%s:%s:%d", s.ID, from.ID, to.ID, now.Unix())
+	if p.ChargeCents > 0 && e.charger != nil {
+		if err := e.charger.Charge(ctx, Charge{
+			SubscriptionID: s.ID, UserID: s.UserID, PlanID: to.ID, AmountCents: p.ChargeCents, Currency: to.Currency,
+			IdempotencyKey: key, Reason: "proration",
+		}); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPaymentFailed, err)
+		}
+	}
+	if p.Tokens > 0 {
+		if _, err := e.tokens.Grant(ctx, tokens.Grant{
+			UserID: s.UserID, Amount: p.Tokens, From: ledger.AccountPlan, Reference: key,
+			Source: "subscription", Description: fmt.Sprintf("%s plan upgrade tokens", to.Name),
+			Metadata: map[string]any{"subscriptionId": s.ID, "from": from.ID, "to": to.ID, "fraction": p.Fraction},
+		}); err != nil {
+			return nil, fmt.Errorf("failed to grant upgrade tokens: %w", err)
+		}
+	}
+	t := &Transition{
+		Event: ev.EventSubscriptionPlanChanged, SubscriptionID: s.ID, UserID: s.UserID, PlanID: to.ID,
+		From: prev.Status, To: s.Status, Reason: from.ID + "->" + to.ID, PeriodStart: s.CurrentPeriodStart, PeriodEnd: s.CurrentPeriodEnd,
+		ChargedCents: p.ChargeCents, Granted: p.Tokens, Proration: &p, At: now,
+	}
+	return t, e.save(ctx, &prev, s, nil, t)
+}
+
+// Cancel cancels the user's subscription, at the end of the current period when atPeriodEnd is
+// set (no transition is returned until then) or immediately otherwise.
+func (e *Engine) Cancel(ctx context.Context, userID string, atPeriodEnd bool, now time.Time) (*domain.Subscription, *Transition, error) {
+	s, _, err := e.load(ctx, `"userId"=$1`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.Status == domain.StatusCanceled {
+		return s, nil, nil
+	}
+	prev := *s
+	if atPeriodEnd {
+		s.CancelAtPeriodEnd = true
+		return s, nil, e.save(ctx, &prev, s, nil, nil)
+	}
+	s.Cancel()
+	t := &Transition{
+		Event: ev.EventSubscriptionCanceled, SubscriptionID: s.ID, UserID: s.UserID, PlanID: s.PlanID,
+		From: prev.Status, To: s.Status, Reason: "canceled_by_user", PeriodStart: s.CurrentPeriodStart, PeriodEnd: s.CurrentPeriodEnd, At: now,
+	}
+	return s, t, e.save(ctx, &prev, s, nil, t)
+}
+
+// Resume withdraws a pending cancel-at-period-end request.
+func (e *Engine) Resume(ctx context.Context, userID string) (*domain.Subscription, error) {
+	s, _, err := e.load(ctx, `"userId"=$1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == domain.StatusCanceled {
+		return nil, domain.ErrSubscriptionCanceled
+	}
+	if !s.CancelAtPeriodEnd {
+		return s, nil
+	}
+	prev := *s
+	s.CancelAtPeriodEnd = false
+	return s, e.save(ctx, &prev, s, nil, nil)
+}
+
+// Activation starts a paid period after a completed checkout.
+type Activation struct {
+	UserID      string
+	PlanID      string
+	CustomerID  string
+	AmountCents int64
+	// Reference identifies the payment (e.g. the checkout session); activating the same
+	// reference twice is a no-op.
+	Reference string
+}
+
+// Activate puts the user on a.PlanID for a new period starting now and grants the plan's
+// tokens. Users without a subscription row get one.
+func (e *Engine) Activate(ctx context.Context, a Activation, now time.Time) (*Transition, error) {
+	plan, ok := domain.LookupPlan(a.PlanID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPlan, a.PlanID)
+	}
+	if _, err := e.db.Exec(ctx, `
+        INSERT INTO "Subscription" (id, "userId", "planId", "planName", status, "currentPeriodStart", "currentPeriodEnd")
+        VALUES ($1, $2, $3, $4, $5, $6, $6)
+        ON CONFLICT ("userId") DO NOTHING
+    `, uuid.NewString(), a.UserID, plan.ID, plan.Name, domain.StatusCanceled, now.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to create subscription: %w", err)
+	}
+	s, _, err := e.load(ctx, `"userId"=$1`, a.UserID)
+	if err != nil {
+		return nil, err
+	}
+	prev := *s
+	granted := int64(0)
+	if plan.IncludedTokens > 0 {
+		res, err := e.tokens.Grant(ctx, tokens.Grant{
+			UserID: s.UserID, Amount: plan.IncludedTokens, From: ledger.AccountPlan, Reference: "activation:" + a.Reference,
+			Source: "subscription", Description: fmt.Sprintf("%s plan tokens %s", plan.Name, now.Format("2006-01-02")),
+			Metadata: map[string]any{"subscriptionId": s.ID, "planId": plan.ID, "reference": a.Reference},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant plan tokens: %w", err)
+		}
+		if res.Replayed {
+			// this payment already activated the subscription
+			return nil, nil
+		}
+		granted = plan.IncludedTokens
+	}
+	s.PlanID, s.PlanName = plan.ID, plan.Name
+	s.CurrentPeriodStart = now
+	s.Activate(now.AddDate(0, 1, 0))
+	s.CancelAtPeriodEnd = false
+	s.PlanTokens += granted
+	if a.CustomerID != "" {
+		s.StripeCustomerID = a.CustomerID
+	}
+	t := &Transition{
+		Event: ev.EventSubscriptionActivated, SubscriptionID: s.ID, UserID: s.UserID, PlanID: plan.ID,
+		From: prev.Status, To: s.Status, Reason: "checkout", PeriodStart: s.CurrentPeriodStart, PeriodEnd: s.CurrentPeriodEnd,
+		ChargedCents: a.AmountCents, Granted: granted, At: now,
+	}
+	return t, e.save(ctx, &prev, s, nil, t)
+}
+
+// SetCustomer stores the payment provider's customer id on the user's subscription.
+func (e *Engine) SetCustomer(ctx context.Context, userID, customerID string) error {
+	if _, err := e.db.Exec(ctx, `UPDATE "Subscription" SET "stripeCustomerId"=$2, "updatedAt"=NOW() WHERE "userId"=$1`, userID, customerID); err != nil {
+		return fmt.Errorf("failed to store customer: %w", err)
+	}
+	return nil
+}
+
+func (e *Engine) load(ctx context.Context, where string, arg any) (*domain.Subscription, *time.Time, error) {
+	var s domain.Subscription
+	var next *time.Time
+	err := e.db.QueryRow(ctx, `
+        SELECT id, "userId", COALESCE("planId", ''), COALESCE("planName", ''), status, "trialEndsAt",
+               COALESCE("currentPeriodStart", "currentPeriodEnd" - interval '1 month'), "currentPeriodEnd",
+               "cancelAtPeriodEnd", "pastDueSince", "nextAttemptAt", "planTokens", "creditCents", COALESCE("stripeCustomerId", '')
+        FROM "Subscription" WHERE `+where, arg).Scan(&s.ID, &s.UserID, &s.PlanID, &s.PlanName, &s.Status, &s.TrialEndsAt,
+		&s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CancelAtPeriodEnd, &s.PastDueSince, &next, &s.PlanTokens, &s.CreditCents, &s.StripeCustomerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query subscription: %w", err)
+	}
+	return &s, next, nil
+}
+
+// save writes s if the row still matches prev and records t in "SubscriptionTransition" and, as
+// its Event, in the outbox.
+func (e *Engine) save(ctx context.Context, prev, s *domain.Subscription, nextAttempt *time.Time, t *Transition) error {
+	tx, err := e.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback is a no-op if the transaction is committed.
+	tag, err := tx.Exec(ctx, `
+        UPDATE "Subscription" SET "planId"=$2, "planName"=$3, status=$4, "trialEndsAt"=$5, "currentPeriodStart"=$6, "currentPeriodEnd"=$7,
+            "cancelAtPeriodEnd"=$8, "pastDueSince"=$9, "nextAttemptAt"=$10, "planTokens"=$11, "creditCents"=$12,
+            "stripeCustomerId"=NULLIF($13, ''), "updatedAt"=NOW()
+        WHERE id=$1 AND status=$14 AND "currentPeriodEnd"=$15 AND COALESCE("planId", '')=$16
+    `, s.ID, s.PlanID, s.PlanName, s.Status, s.TrialEndsAt, s.CurrentPeriodStart.UTC(), s.CurrentPeriodEnd.UTC(),
+		s.CancelAtPeriodEnd, s.PastDueSince, nextAttempt, s.PlanTokens, s.CreditCents, s.StripeCustomerID,
+		prev.Status, prev.CurrentPeriodEnd, prev.PlanID)
+	if err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrConflict
+	}
+	if t != nil {
+		if _, err := tx.Exec(ctx, `
+            INSERT INTO "SubscriptionTransition" (id, "subscriptionId", "userId", "planId", event, "from", "to", reason, "periodStart", "periodEnd", "chargedCents", granted, expired, "createdAt")
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+        `, uuid.NewString(), t.SubscriptionID, t.UserID, t.PlanID, t.Event, t.From, t.To, t.Reason, t.PeriodStart.UTC(), t.PeriodEnd.UTC(),
+			t.ChargedCents, t.Granted, t.Expired, t.At.UTC()); err != nil {
+			return fmt.Errorf("failed to record transition: %w", err)
+		}
+		if err := outbox.Enqueue(ctx, tx, ev.OutboxEvent{Type: t.Event, Subject: t.SubscriptionID, Data: t}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/outbox"
+)
+
+// Grant credits tokens to a user's wallet from a system account.
+type Grant struct {
+	UserID string
+	Amount int64
+	// Kind is the ledger entry kind (ledger.KindGrant when empty, ledger.KindRefund for refunds).
+	Kind string
+	// From is the funding account (ledger.AccountPromo when empty).
+	From string
+	// Reference makes the grant idempotent: a second grant with the same kind and reference is
+	// not applied.
+	Reference   string
+	Source      string
+	Description string
+	Metadata    map[string]any
+	// Category (domain.GrantPromo, GrantReferral, GrantAdmin) or ExpiresAt record the grant as a
+	// lot in "TokenGrant", which spends soonest-expiring first and lapses at ExpiresAt.
+	Category  string
+	ExpiresAt *time.Time
+	// CreatedBy is the admin or process that issued the grant.
+	CreatedBy string
+	// Guard runs in the grant's transaction before anything is posted, e.g. to record a promo
+	// redemption atomically with its grant; an error aborts the grant.
+	Guard func(ctx context.Context, tx pgx.Tx) error
+	// Events returns the events recorded in the outbox with a posted grant (TokensGranted,
+	// TokensPurchased, ...); a replayed grant records none.
+	Events func(res *Result) []ev.OutboxEvent
+}
+
+// Grant posts g and raises the wallet balance. A grant that was already posted returns the
+// current wallet with Replayed set.
+func (s *Store) Grant(ctx context.Context, g Grant) (*Result, error) {
+	if g.Amount <= 0 {
+		return nil, fmt.Errorf("invalid grant amount %d", g.Amount)
+	}
+	if g.Kind == "" {
+		g.Kind = ledger.KindGrant
+	}
+	if g.From == "" {
+		g.From = ledger.AccountPromo
+	}
+	if g.Source == "" {
+		g.Source = "billing"
+	}
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, err := lockWallet(ctx, tx, g.UserID)
+		if err != nil {
+			return err
+		}
+		if g.Guard != nil {
+			if err := g.Guard(ctx, tx); err != nil {
+				return err
+			}
+		}
+		id := uuid.NewString()
+		if g.Category != "" || g.ExpiresAt != nil {
+			if g.Metadata == nil {
+				g.Metadata = map[string]any{}
+			}
+			g.Metadata["grantId"], g.Metadata["grantKind"] = id, g.Category
+			if g.ExpiresAt != nil {
+				g.Metadata["expiresAt"] = g.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+		}
+		posted, err := ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{
+			ID: id, Kind: g.Kind, UserID: g.UserID, Reference: g.Reference, Description: g.Description,
+			Lines: ledger.Move(ledger.System(g.From), ledger.Wallet(g.UserID), g.Amount), Metadata: g.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+		if !posted {
+			res = &Result{Wallet: w, Replayed: true}
+			return nil
+		}
+		typ := "granted"
+		if g.Kind == ledger.KindRefund {
+			typ = "refunded"
+		}
+		before := w.Balance
+		w.Balance += g.Amount
+		if err := saveWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		if err := insertTxRow(ctx, tx, id, g.UserID, g.UserID, typ, g.Amount, before, w.Balance, g.Source, g.Description, "", "", g.Metadata); err != nil {
+			return err
+		}
+		if g.Category != "" || g.ExpiresAt != nil {
+			if _, err := tx.Exec(ctx, `
+                INSERT INTO "TokenGrant" (id, "walletId", kind, amount, remaining, "expiresAt", reference, "createdBy", "createdAt")
+                VALUES ($1, $2, $3, $4, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NOW())
+            `, id, g.UserID, g.Category, g.Amount, g.ExpiresAt, g.Reference, g.CreatedBy); err != nil {
+				return fmt.Errorf("failed to insert token grant: %w", err)
+			}
+		}
+		res = &Result{Wallet: w, TxID: id}
+		if g.Events != nil {
+			return outbox.Enqueue(ctx, tx, g.Events(res)...)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Expire removes up to amount tokens from the available balance into the expired account, e.g.
+// plan tokens that did not roll over. Result.Spent is the amount actually expired; an expiry
+// whose reference was already posted returns Replayed.
+func (s *Store) Expire(ctx context.Context, userID string, amount int64, ref, desc string, meta map[string]any) (*Result, error) {
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, err := lockWallet(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if amount > w.Available() {
+			amount = w.Available()
+		}
+		res = &Result{Wallet: w}
+		if amount <= 0 {
+			return nil
+		}
+		id := uuid.NewString()
+		posted, err := ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{
+			ID: id, Kind: ledger.KindExpiry, UserID: userID, Reference: ref, Description: desc,
+			Lines: ledger.Move(ledger.Wallet(userID), ledger.System(ledger.AccountExpired), amount), Metadata: meta,
+		})
+		if err != nil {
+			return err
+		}
+		if !posted {
+			res.Replayed = true
+			return nil
+		}
+		before := w.Balance
+		if err := w.Debit(amount); err != nil {
+			return err
+		}
+		if err := saveWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		if err := fitGrants(ctx, tx, w); err != nil {
+			return err
+		}
+		if err := insertTxRow(ctx, tx, id, userID, userID, "expired", amount, before, w.Balance, "billing", desc, "", "", meta); err != nil {
+			return err
+		}
+		res = &Result{Wallet: w, TxID: id, Spent: amount}
+		return nil
+	})
+	return res, err
+}
+
+// Grants returns the grant lots of a wallet, newest first; active limits them to lots with
+// tokens left.
+func (s *Store) Grants(ctx context.Context, walletID string, active bool, limit int) ([]*domain.TokenGrant, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT id, "walletId", kind, amount, remaining, "expiresAt", COALESCE(reference, ''), COALESCE("createdBy", ''), "createdAt"
+        FROM "TokenGrant"
+        WHERE "walletId"=$1 AND (NOT $2 OR remaining > 0)
+        ORDER BY "createdAt" DESC
+        LIMIT $3
+    `, walletID, active, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token grants: %w", err)
+	}
+	defer rows.Close()
+	var out []*domain.TokenGrant
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+// ExpireGrants lapses up to limit grant lots whose expiry passed before now: what they still
+// hold moves from the wallet to the expired account. Tokens of a lot that are held by an open
+// reservation stay until it settles; the lot is retried on the next sweep. Each lot expires in
+// its own transaction.
+func (s *Store) ExpireGrants(ctx context.Context, now time.Time, limit int) ([]*Result, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT id, "walletId" FROM "TokenGrant"
+        WHERE remaining > 0 AND "expiresAt" <= $1
+        ORDER BY "expiresAt"
+        LIMIT $2
+    `, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due grants: %w", err)
+	}
+	type due struct{ id, walletID string }
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.walletID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan grant: %w", err)
+		}
+		list = append(list, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate grants: %w", err)
+	}
+
+	out := make([]*Result, 0, len(list))
+	for _, d := range list {
+		var res *Result
+		err := s.inTx(ctx, func(tx pgx.Tx) error {
+			res = nil
+			w, err := lockWallet(ctx, tx, d.walletID)
+			if err != nil {
+				return err
+			}
+			g, err := scanGrant(tx.QueryRow(ctx, `
+                SELECT id, "walletId", kind, amount, remaining, "expiresAt", COALESCE(reference, ''), COALESCE("createdBy", ''), "createdAt"
+                FROM "TokenGrant" WHERE id=$1 FOR UPDATE
+            `, d.id))
+			if err != nil {
+				return err
+			}
+			amount := min(g.Remaining, w.Available())
+			if !g.Expired(now) || amount <= 0 {
+				return nil
+			}
+			id := uuid.NewString()
+			meta := map[string]any{"grantId": g.ID, "grantKind": g.Kind, "action": "expire", "expiresAt": g.ExpiresAt.UTC().Format(time.RFC3339)}
+			// the remaining amount is part of the reference, so a lot expired in parts posts each part once
+			ref := "grant-expiry:" + g.ID + ":" + strconv.FormatInt(g.Remaining, 10)
+			posted, err := ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{
+				ID: id, Kind: ledger.KindExpiry, UserID: g.WalletID, Reference: ref, Description: "granted tokens expired",
+				Lines: ledger.Move(ledger.Wallet(g.WalletID), ledger.System(ledger.AccountExpired), amount), Metadata: meta,
+			})
+			if err != nil || !posted {
+				return err
+			}
+			before := w.Balance
+			if err := w.Debit(amount); err != nil {
+				return err
+			}
+			if err := saveWallet(ctx, tx, w); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `UPDATE "TokenGrant" SET remaining=remaining-$2 WHERE id=$1`, g.ID, amount); err != nil {
+				return fmt.Errorf("failed to update token grant: %w", err)
+			}
+			if err := insertTxRow(ctx, tx, id, g.WalletID, g.WalletID, "expired", amount, before, w.Balance, "billing", "granted tokens expired", "", "", meta); err != nil {
+				return err
+			}
+			res = &Result{Wallet: w, TxID: id, Spent: amount}
+			return outbox.Enqueue(ctx, tx, ev.OutboxEvent{Type: ev.EventTokensExpired, Subject: w.UserID, Data: map[string]any{
+				"txId": id, "userId": w.UserID, "amount": amount, "balance": w.Balance, "time": time.Now().UTC().Format(time.RFC3339),
+			}})
+		})
+		if err != nil {
+			return out, fmt.Errorf("failed to expire grant %s: %w", d.id, err)
+		}
+		if res != nil {
+			out = append(out, res)
+		}
+	}
+	return out, nil
+}
+
+// consumeGrants takes amount tokens spent from walletID out of its grant lots, soonest-expiring
+// first, and returns what was taken per lot (recorded with the transaction).
+func consumeGrants(ctx context.Context, tx pgx.Tx, walletID string, amount int64) (map[string]int64, error) {
+	if amount <= 0 {
+		return nil, nil
+	}
+	lots, err := lockGrants(ctx, tx, walletID)
+	if err != nil || len(lots) == 0 {
+		return nil, err
+	}
+	used := domain.ConsumeGrants(lots, amount)
+	return used, saveGrantUse(ctx, tx, used)
+}
+
+// fitGrants trims the lots of w, soonest-expiring first, so they never hold more than the
+// balance after tokens left it other than by spending (e.g. plan token expiry).
+func fitGrants(ctx context.Context, tx pgx.Tx, w domain.Wallet) error {
+	lots, err := lockGrants(ctx, tx, w.UserID)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, g := range lots {
+		total += g.Remaining
+	}
+	if total <= w.Balance {
+		return nil
+	}
+	return saveGrantUse(ctx, tx, domain.ConsumeGrants(lots, total-w.Balance))
+}
+
+func lockGrants(ctx context.Context, tx pgx.Tx, walletID string) ([]*domain.TokenGrant, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT id, "walletId", kind, amount, remaining, "expiresAt", COALESCE(reference, ''), COALESCE("createdBy", ''), "createdAt"
+        FROM "TokenGrant"
+        WHERE "walletId"=$1 AND remaining > 0
+        FOR UPDATE
+    `, walletID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock token grants: %w", err)
+	}
+	defer rows.Close()
+	var lots []*domain.TokenGrant
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		lots = append(lots, g)
+	}
+	return lots, rows.Err()
+}
+
+func saveGrantUse(ctx context.Context, tx pgx.Tx, used map[string]int64) error {
+	for id, n := range used {
+		if _, err := tx.Exec(ctx, `UPDATE "TokenGrant" SET remaining=remaining-$2 WHERE id=$1`, id, n); err != nil {
+			return fmt.Errorf("failed to update token grant: %w", err)
+		}
+	}
+	return nil
+}
+
+func scanGrant(row pgx.Row) (*domain.TokenGrant, error) {
+	var g domain.TokenGrant
+	err := row.Scan(&g.ID, &g.WalletID, &g.Kind, &g.Amount, &g.Remaining, &g.ExpiresAt, &g.Reference, &g.CreatedBy, &g.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("token grant not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan token grant: %w", err)
+	}
+	return &g, nil
+}
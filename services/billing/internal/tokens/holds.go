@@ -0,0 +1,527 @@
+// Package tokens keeps token wallets ("UserToken": balance and held; "OrganizationWallet" for
+// organizations) and reservations ("TokenReservation"). Every change also posts a balanced ledger entry in the same transaction,
+// so the wallet columns stay a cache of the journal. Every change runs in a serializable transaction that locks the wallet row
+// and then the reservation row FOR UPDATE, and is retried when Postgres aborts it with a
+// serialization failure or deadlock. Granted tokens are tracked in lots ("TokenGrant") that
+// spends draw on soonest-expiring first; see grants.go. The events of a change (TokenReserved,
+// TokenDebited, ...) are recorded in the outbox in its transaction.
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/outbox"
+)
+
+// maxAttempts bounds retries of a serializable transaction.
+const maxAttempts = 5
+
+// Store reads and writes wallets and reservations.
+type Store struct {
+	db *pgxpool.Pool
+}
+
+// New returns a Store backed by db.
+func New(db *pgxpool.Pool) *Store {
+	return &Store{db: db}
+}
+
+// Result describes one settled operation: the reservation (nil for direct debits), the wallet
+// after the change, the TokenTransaction row written and how many tokens went back to available.
+type Result struct {
+	Hold     *domain.Hold
+	Wallet   domain.Wallet
+	TxID     string
+	Spent    int64
+	Released int64
+	// Replayed is set when Reserve found an open hold for the same task instead of creating one.
+	Replayed bool
+}
+
+// Wallet returns a wallet by id, a user id or domain.OrgWalletID (zero when it has none yet).
+func (s *Store) Wallet(ctx context.Context, walletID string) (domain.Wallet, error) {
+	w := domain.Wallet{UserID: walletID}
+	query, key := walletQuery(walletID)
+	err := s.db.QueryRow(ctx, query, key).Scan(&w.Balance, &w.Held)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return w, fmt.Errorf("failed to query wallet: %w", err)
+	}
+	return w, nil
+}
+
+// Reserve holds q.Amount tokens of p's wallet for p.UserID until ttl passes; the hold keeps q's
+// price version. A second reservation for the same taskID while the first is open returns the
+// open one. When the available balance is too low it returns domain.ErrInsufficientTokens
+// together with the current wallet; org-funded holds also count against the member's caps.
+func (s *Store) Reserve(ctx context.Context, p domain.Payer, taskID string, q *domain.Quote, ttl time.Duration) (*Result, error) {
+	amount, userID := q.Amount, p.UserID
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, err := lockWallet(ctx, tx, p.WalletID())
+		if err != nil {
+			return err
+		}
+		res = &Result{Wallet: w}
+		if taskID != "" {
+			h, err := lockHold(ctx, tx, userID, taskID)
+			if err == nil && h.IsOpen() {
+				res.Hold, res.TxID, res.Replayed = h, h.ID, true
+				return nil
+			}
+			if err != nil && !errors.Is(err, domain.ErrHoldNotFound) {
+				return err
+			}
+		}
+		if err := checkMember(ctx, tx, p, amount); err != nil {
+			return err
+		}
+		h := domain.NewHold(uuid.NewString(), userID, taskID, amount, ttl)
+		h.PriceVersion, h.PlanID, h.WalletID = q.Version, q.PlanID, w.UserID
+		availableBefore := w.Available()
+		if err := w.Hold(amount); err != nil {
+			return err
+		}
+		if err := saveWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+            INSERT INTO "TokenReservation" (id, "userId", "taskId", amount, committed, released, status, "expiresAt", "createdAt", "updatedAt", "priceVersion", "planId", "walletId")
+            VALUES ($1, $2, $3, $4, 0, 0, $5, $6, $7, $7, NULLIF($8, ''), NULLIF($9, ''), $10)
+        `, h.ID, userID, taskID, amount, h.Status, h.ExpiresAt.UTC(), h.CreatedAt.UTC(), h.PriceVersion, h.PlanID, h.WalletID); err != nil {
+			return fmt.Errorf("failed to insert reservation: %w", err)
+		}
+		meta := withQuote(map[string]any{"taskId": taskID, "action": "reserve", "availableBefore": availableBefore, "availableAfter": w.Available(), "expiresAt": h.ExpiresAt.UTC().Format(time.RFC3339)}, q)
+		if err := insertTx(ctx, tx, h.ID, userID, w.UserID, "reserved", amount, w.Balance, w.Balance, "reserve", h.ID, h.PriceVersion, meta); err != nil {
+			return err
+		}
+		if err := post(ctx, tx, ledger.KindReserve, userID, h.ID, "reserve", ledger.Move(ledger.Wallet(w.UserID), ledger.Held(w.UserID), amount), meta); err != nil {
+			return err
+		}
+		if err := outbox.Enqueue(ctx, tx, ev.OutboxEvent{Type: ev.EventTokenReserved, Subject: h.ID, Data: map[string]any{
+			"txId": h.ID, "reservationId": h.ID, "userId": userID, "walletId": h.WalletID, "fundingSource": p.Funding(), "amount": amount,
+			"items": q.Lines, "priceVersion": q.Version, "taskId": taskID, "expiresAt": h.ExpiresAt.UTC().Format(time.RFC3339), "time": time.Now().UTC().Format(time.RFC3339),
+		}}); err != nil {
+			return err
+		}
+		res.Hold, res.Wallet, res.TxID = h, w, h.ID
+		return nil
+	})
+	return res, err
+}
+
+// Commit spends amount from the reservation ref (its id or task id); amount 0 spends everything
+// still held. With final the remainder is released and the reservation closes; otherwise it
+// stays open for further partial commits. q, when the amount was priced by action, is recorded
+// with the transaction.
+func (s *Store) Commit(ctx context.Context, userID, ref string, amount int64, final bool, q *domain.Quote) (*Result, error) {
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, h, err := lockHoldWallet(ctx, tx, userID, ref)
+		if err != nil {
+			return err
+		}
+		before := h.Committed
+		released, err := h.Commit(amount, final)
+		if err != nil {
+			res = &Result{Hold: h, Wallet: w}
+			return err
+		}
+		spent := h.Committed - before
+		balanceBefore := w.Balance
+		w.Settle(spent, released)
+		if err := saveWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		if err := saveHold(ctx, tx, h); err != nil {
+			return err
+		}
+		used, err := consumeGrants(ctx, tx, w.UserID, spent)
+		if err != nil {
+			return err
+		}
+		id := uuid.NewString()
+		meta := withQuote(map[string]any{"taskId": h.TaskID, "action": "commit", "released": released, "final": h.Status != domain.HoldHeld}, q)
+		withGrants(meta, used)
+		if err := insertTx(ctx, tx, id, userID, w.UserID, "debited", spent, balanceBefore, w.Balance, "commit", h.ID, h.PriceVersion, meta); err != nil {
+			return err
+		}
+		lines := append(ledger.Move(ledger.Held(w.UserID), ledger.System(ledger.AccountRevenue), spent),
+			ledger.Move(ledger.Held(w.UserID), ledger.Wallet(w.UserID), released)...)
+		if err := post(ctx, tx, ledger.KindCommit, userID, id, "commit", lines, meta); err != nil {
+			return err
+		}
+		if err := outbox.Enqueue(ctx, tx, debited(id, userID, w.UserID, domain.WalletFunding(w.UserID), spent, h.TaskID, h, released)); err != nil {
+			return err
+		}
+		res = &Result{Hold: h, Wallet: w, TxID: id, Spent: spent, Released: released}
+		return nil
+	})
+	return res, err
+}
+
+// Release returns whatever the reservation ref still holds to the available balance.
+func (s *Store) Release(ctx context.Context, userID, ref string) (*Result, error) {
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, h, err := lockHoldWallet(ctx, tx, userID, ref)
+		if err != nil {
+			return err
+		}
+		released, err := h.Release()
+		if err != nil {
+			res = &Result{Hold: h, Wallet: w}
+			return err
+		}
+		res, err = settleRelease(ctx, tx, w, h, released, "release")
+		return err
+	})
+	return res, err
+}
+
+// Hold returns the reservation ref (its id or task id) without locking it.
+func (s *Store) Hold(ctx context.Context, userID, ref string) (*domain.Hold, error) {
+	var h *domain.Hold
+	err := s.tryTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		h, err = lockHold(ctx, tx, userID, ref)
+		return err
+	})
+	return h, err
+}
+
+// Debit spends q.Amount from the available balance of p's wallet without a reservation (callers
+// that skipped reserve, e.g. because billing was unreachable at the time).
+func (s *Store) Debit(ctx context.Context, p domain.Payer, taskID string, q *domain.Quote) (*Result, error) {
+	amount, userID := q.Amount, p.UserID
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		w, err := lockWallet(ctx, tx, p.WalletID())
+		if err != nil {
+			return err
+		}
+		if err := checkMember(ctx, tx, p, amount); err != nil {
+			res = &Result{Wallet: w}
+			return err
+		}
+		before := w.Balance
+		if err := w.Debit(amount); err != nil {
+			res = &Result{Wallet: w}
+			return err
+		}
+		if err := saveWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		used, err := consumeGrants(ctx, tx, w.UserID, amount)
+		if err != nil {
+			return err
+		}
+		id := uuid.NewString()
+		meta := withQuote(map[string]any{"taskId": taskID, "action": "commit"}, q)
+		withGrants(meta, used)
+		if err := insertTx(ctx, tx, id, userID, w.UserID, "debited", amount, before, w.Balance, "commit", "", q.Version, meta); err != nil {
+			return err
+		}
+		if err := post(ctx, tx, ledger.KindDebit, userID, id, "commit", ledger.Move(ledger.Wallet(w.UserID), ledger.System(ledger.AccountRevenue), amount), meta); err != nil {
+			return err
+		}
+		if err := outbox.Enqueue(ctx, tx, debited(id, userID, w.UserID, p.Funding(), amount, taskID, nil, 0)); err != nil {
+			return err
+		}
+		res = &Result{Wallet: w, TxID: id, Spent: amount}
+		return nil
+	})
+	return res, err
+}
+
+// ExpireDue closes up to limit reservations whose expiry passed before now and returns their
+// settlements. Each reservation expires in its own transaction; one that was settled in the
+// meantime is skipped.
+func (s *Store) ExpireDue(ctx context.Context, now time.Time, limit int) ([]*Result, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT id, "userId", COALESCE("walletId", "userId") FROM "TokenReservation"
+        WHERE status=$1 AND "expiresAt" < $2
+        ORDER BY "expiresAt"
+        LIMIT $3
+    `, domain.HoldHeld, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due reservations: %w", err)
+	}
+	type due struct{ id, userID, walletID string }
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.userID, &d.walletID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan reservation: %w", err)
+		}
+		list = append(list, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate reservations: %w", err)
+	}
+
+	out := make([]*Result, 0, len(list))
+	for _, d := range list {
+		var res *Result
+		err := s.inTx(ctx, func(tx pgx.Tx) error {
+			res = nil
+			w, err := lockWallet(ctx, tx, d.walletID)
+			if err != nil {
+				return err
+			}
+			h, err := lockHold(ctx, tx, d.userID, d.id)
+			if err != nil {
+				return err
+			}
+			if !h.IsOpen() || now.Before(h.ExpiresAt) {
+				return nil
+			}
+			released, err := h.Expire(now)
+			if err != nil {
+				return err
+			}
+			res, err = settleRelease(ctx, tx, w, h, released, "expire")
+			return err
+		})
+		if err != nil {
+			return out, fmt.Errorf("failed to expire reservation %s: %w", d.id, err)
+		}
+		if res != nil {
+			out = append(out, res)
+		}
+	}
+	return out, nil
+}
+
+func settleRelease(ctx context.Context, tx pgx.Tx, w domain.Wallet, h *domain.Hold, released int64, action string) (*Result, error) {
+	w.Settle(0, released)
+	if err := saveWallet(ctx, tx, w); err != nil {
+		return nil, err
+	}
+	if err := saveHold(ctx, tx, h); err != nil {
+		return nil, err
+	}
+	id := uuid.NewString()
+	meta := map[string]any{"taskId": h.TaskID, "action": action}
+	if err := insertTx(ctx, tx, id, h.UserID, w.UserID, "reverted", released, w.Balance, w.Balance, action, h.ID, h.PriceVersion, meta); err != nil {
+		return nil, err
+	}
+	if err := post(ctx, tx, ledger.KindRelease, h.UserID, id, action, ledger.Move(ledger.Held(w.UserID), ledger.Wallet(w.UserID), released), meta); err != nil {
+		return nil, err
+	}
+	reason := "released"
+	if action == "expire" {
+		reason = "expired"
+	}
+	if err := outbox.Enqueue(ctx, tx, ev.OutboxEvent{Type: ev.EventTokenReverted, Subject: id, Data: map[string]any{
+		"txId": id, "reservationId": h.ID, "userId": h.UserID, "amount": released, "taskId": h.TaskID, "reason": reason, "time": time.Now().UTC().Format(time.RFC3339),
+	}}); err != nil {
+		return nil, err
+	}
+	return &Result{Hold: h, Wallet: w, TxID: id, Released: released}, nil
+}
+
+// debited is the TokenDebited event of a spend; h is the reservation it settled, if any.
+func debited(txID, userID, walletID, funding string, amount int64, taskID string, h *domain.Hold, released int64) ev.OutboxEvent {
+	data := map[string]any{"txId": txID, "userId": userID, "walletId": walletID, "fundingSource": funding, "amount": amount, "taskId": taskID, "time": time.Now().UTC().Format(time.RFC3339)}
+	if h != nil {
+		data["reservationId"], data["released"] = h.ID, released
+	}
+	return ev.OutboxEvent{Type: ev.EventTokenDebited, Subject: txID, Data: data}
+}
+
+// inTx runs fn in a serializable transaction, retrying on serialization failures and deadlocks.
+func (s *Store) inTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.tryTx(ctx, fn)
+		if err == nil || !retryable(err) || attempt >= maxAttempts {
+			return err
+		}
+		backoff := time.Duration(attempt*attempt)*10*time.Millisecond + time.Duration(rand.Intn(10))*time.Millisecond
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (s *Store) tryTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback is a no-op if the transaction is committed.
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// walletQuery returns the balance query of a wallet id and the key to pass to it.
+func walletQuery(walletID string) (string, string) {
+	if org, ok := domain.WalletOrg(walletID); ok {
+		return `SELECT balance, held FROM "OrganizationWallet" WHERE "orgId"=$1`, org
+	}
+	return `SELECT balance, held FROM "UserToken" WHERE "userId"=$1`, walletID
+}
+
+func lockWallet(ctx context.Context, tx pgx.Tx, walletID string) (domain.Wallet, error) {
+	w := domain.Wallet{UserID: walletID}
+	query, key := walletQuery(walletID)
+	err := tx.QueryRow(ctx, query+" FOR UPDATE", key).Scan(&w.Balance, &w.Held)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return w, fmt.Errorf("failed to lock wallet: %w", err)
+	}
+	return w, nil
+}
+
+func saveWallet(ctx context.Context, tx pgx.Tx, w domain.Wallet) error {
+	query := `
+        INSERT INTO "UserToken" ("userId", balance, held, "updatedAt") VALUES ($1, $2, $3, NOW())
+        ON CONFLICT ("userId") DO UPDATE SET balance=EXCLUDED.balance, held=EXCLUDED.held, "updatedAt"=EXCLUDED."updatedAt"
+    `
+	key := w.UserID
+	if org, ok := domain.WalletOrg(w.UserID); ok {
+		query = `
+        INSERT INTO "OrganizationWallet" ("orgId", balance, held, "updatedAt") VALUES ($1, $2, $3, NOW())
+        ON CONFLICT ("orgId") DO UPDATE SET balance=EXCLUDED.balance, held=EXCLUDED.held, "updatedAt"=EXCLUDED."updatedAt"
+    `
+		key = org
+	}
+	_, err := tx.Exec(ctx, query, key, w.Balance, w.Held)
+	if err != nil {
+		return fmt.Errorf("failed to update wallet: %w", err)
+	}
+	return nil
+}
+
+// lockHold finds the reservation by id or task id, preferring an open one.
+func lockHold(ctx context.Context, tx pgx.Tx, userID, ref string) (*domain.Hold, error) {
+	var h domain.Hold
+	err := tx.QueryRow(ctx, `
+        SELECT id, "userId", "taskId", amount, committed, released, status, "expiresAt", "createdAt", "updatedAt",
+               COALESCE("priceVersion", ''), COALESCE("planId", ''), COALESCE("walletId", "userId")
+        FROM "TokenReservation"
+        WHERE "userId"=$1 AND (id=$2 OR ("taskId"=$2 AND "taskId" <> ''))
+        ORDER BY (status=$3) DESC, "createdAt" DESC
+        LIMIT 1
+        FOR UPDATE
+    `, userID, ref, domain.HoldHeld).Scan(&h.ID, &h.UserID, &h.TaskID, &h.Amount, &h.Committed, &h.Released, &h.Status, &h.ExpiresAt, &h.CreatedAt, &h.UpdatedAt, &h.PriceVersion, &h.PlanID, &h.WalletID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, domain.ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock reservation: %w", err)
+	}
+	return &h, nil
+}
+
+// lockHoldWallet locks the wallet a reservation draws on and then the reservation, in the same
+// order as Reserve.
+func lockHoldWallet(ctx context.Context, tx pgx.Tx, userID, ref string) (domain.Wallet, *domain.Hold, error) {
+	var walletID string
+	err := tx.QueryRow(ctx, `
+        SELECT COALESCE("walletId", "userId") FROM "TokenReservation"
+        WHERE "userId"=$1 AND (id=$2 OR ("taskId"=$2 AND "taskId" <> ''))
+        ORDER BY (status=$3) DESC, "createdAt" DESC
+        LIMIT 1
+    `, userID, ref, domain.HoldHeld).Scan(&walletID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.Wallet{}, nil, domain.ErrHoldNotFound
+	}
+	if err != nil {
+		return domain.Wallet{}, nil, fmt.Errorf("failed to query reservation: %w", err)
+	}
+	w, err := lockWallet(ctx, tx, walletID)
+	if err != nil {
+		return w, nil, err
+	}
+	h, err := lockHold(ctx, tx, userID, ref)
+	if err != nil {
+		return w, nil, err
+	}
+	if h.WalletID != walletID {
+		// another reservation for the task opened in between; the serializable retry sorts it out
+		return w, nil, fmt.Errorf("reservation %s moved wallets", ref)
+	}
+	return w, h, nil
+}
+
+func saveHold(ctx context.Context, tx pgx.Tx, h *domain.Hold) error {
+	_, err := tx.Exec(ctx, `
+        UPDATE "TokenReservation" SET committed=$2, released=$3, status=$4, "updatedAt"=$5 WHERE id=$1
+    `, h.ID, h.Committed, h.Released, h.Status, h.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to update reservation: %w", err)
+	}
+	return nil
+}
+
+// post writes the ledger entry for a wallet change. Entries without lines (a commit of zero
+// tokens, say) are skipped.
+func post(ctx context.Context, tx pgx.Tx, kind, userID, ref, desc string, lines []ledger.Line, meta map[string]any) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	_, err := ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{Kind: kind, UserID: userID, Reference: ref, Description: desc, Lines: lines, Metadata: meta})
+	return err
+}
+
+// withGrants records which grant lots a spend drew on.
+func withGrants(meta map[string]any, used map[string]int64) {
+	if len(used) > 0 {
+		meta["grants"] = used
+	}
+}
+
+// withQuote adds the price breakdown of q to meta.
+func withQuote(meta map[string]any, q *domain.Quote) map[string]any {
+	for k, v := range q.Metadata() {
+		meta[k] = v
+	}
+	return meta
+}
+
+func insertTx(ctx context.Context, tx pgx.Tx, id, userID, walletID, typ string, amount, before, after int64, desc, reservationID, priceVersion string, meta map[string]any) error {
+	return insertTxRow(ctx, tx, id, userID, walletID, typ, amount, before, after, "billing", desc, reservationID, priceVersion, meta)
+}
+
+// insertTxRow writes the TokenTransaction of userID; walletID is the wallet that moved, which
+// sets the funding source (balances before and after are that wallet's).
+func insertTxRow(ctx context.Context, tx pgx.Tx, id, userID, walletID, typ string, amount, before, after int64, source, desc, reservationID, priceVersion string, meta map[string]any) error {
+	b, _ := json.Marshal(meta)
+	funding, orgID := domain.FundingPersonal, ""
+	if org, ok := domain.WalletOrg(walletID); ok {
+		funding, orgID = domain.FundingOrg, org
+	}
+	_, err := tx.Exec(ctx, `
+        INSERT INTO "TokenTransaction" (id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata, "reservationId", "priceVersion", "fundingSource", "orgId")
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::jsonb, NULLIF($10, ''), NULLIF($11, ''), $12, NULLIF($13, ''))
+    `, id, userID, typ, amount, before, after, source, desc, string(b), reservationID, priceVersion, funding, orgID)
+	if err != nil {
+		return fmt.Errorf("failed to insert token transaction: %w", err)
+	}
+	return nil
+}
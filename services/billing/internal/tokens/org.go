@@ -0,0 +1,141 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+)
+
+// checkMember verifies that an org-funded spend of amount is made by a member within their caps.
+// It runs after the organization wallet is locked, so a member's concurrent spends are serialized.
+func checkMember(ctx context.Context, tx pgx.Tx, p domain.Payer, amount int64) error {
+	if p.OrgID == "" {
+		return nil
+	}
+	m, err := member(ctx, tx, p.OrgID, p.UserID)
+	if err != nil {
+		return err
+	}
+	spend, err := memberSpend(ctx, tx, p.OrgID, p.UserID, time.Now())
+	if err != nil {
+		return err
+	}
+	return m.CheckCap(spend, amount)
+}
+
+func member(ctx context.Context, q pgx.Tx, orgID, userID string) (domain.Member, error) {
+	m := domain.Member{OrgID: orgID, UserID: userID}
+	err := q.QueryRow(ctx, `
+        SELECT role, "dailyCap", "monthlyCap" FROM "OrganizationMember" WHERE "orgId"=$1 AND "userId"=$2
+    `, orgID, userID).Scan(&m.Role, &m.DailyCap, &m.MonthlyCap)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, domain.ErrNotMember
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to query organization member: %w", err)
+	}
+	return m, nil
+}
+
+// memberSpend sums what the member spent from the organization wallet in the UTC day and month
+// of now and what their open reservations on it hold.
+func memberSpend(ctx context.Context, tx pgx.Tx, orgID, userID string, now time.Time) (domain.MemberSpend, error) {
+	var s domain.MemberSpend
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if err := tx.QueryRow(ctx, `
+        SELECT COALESCE(SUM(amount) FILTER (WHERE "createdAt" >= $3), 0)::bigint, COALESCE(SUM(amount), 0)::bigint
+        FROM "TokenTransaction"
+        WHERE "orgId"=$1 AND "userId"=$2 AND type='debited' AND "createdAt" >= $4
+    `, orgID, userID, day, month).Scan(&s.Day, &s.Month); err != nil {
+		return s, fmt.Errorf("failed to query member spend: %w", err)
+	}
+	if err := tx.QueryRow(ctx, `
+        SELECT COALESCE(SUM(amount - committed - released), 0)::bigint FROM "TokenReservation"
+        WHERE "walletId"=$1 AND "userId"=$2 AND status=$3
+    `, domain.OrgWalletID(orgID), userID, domain.HoldHeld).Scan(&s.Held); err != nil {
+		return s, fmt.Errorf("failed to query member holds: %w", err)
+	}
+	return s, nil
+}
+
+// MemberSpend returns what userID spent from the organization wallet today and this month.
+func (s *Store) MemberSpend(ctx context.Context, orgID, userID string) (domain.MemberSpend, error) {
+	var out domain.MemberSpend
+	err := s.tryTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		out, err = memberSpend(ctx, tx, orgID, userID, time.Now())
+		return err
+	})
+	return out, err
+}
+
+// Transfer moves amount from a member's own wallet into the organization wallet. ref makes the
+// transfer idempotent. Result.Wallet is the organization wallet after the transfer.
+func (s *Store) Transfer(ctx context.Context, userID, orgID string, amount int64, ref string) (*Result, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid transfer amount %d", amount)
+	}
+	orgWallet := domain.OrgWalletID(orgID)
+	var res *Result
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		own, err := lockWallet(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		org, err := lockWallet(ctx, tx, orgWallet)
+		if err != nil {
+			return err
+		}
+		if _, err := member(ctx, tx, orgID, userID); err != nil {
+			return err
+		}
+		res = &Result{Wallet: org}
+		id := uuid.NewString()
+		meta := map[string]any{"orgId": orgID, "action": "transfer"}
+		posted, err := ledger.Post(ctx, ledger.PgxExec(tx), &ledger.Entry{
+			ID: id, Kind: ledger.KindTransfer, UserID: userID, Reference: ref, Description: "org transfer",
+			Lines: ledger.Move(ledger.Wallet(userID), ledger.Wallet(orgWallet), amount), Metadata: meta,
+		})
+		if err != nil {
+			return err
+		}
+		if !posted {
+			res.Replayed = true
+			return nil
+		}
+		ownBefore, orgBefore := own.Balance, org.Balance
+		if err := own.Debit(amount); err != nil {
+			res.Wallet = own
+			return err
+		}
+		org.Balance += amount
+		if err := saveWallet(ctx, tx, own); err != nil {
+			return err
+		}
+		used, err := consumeGrants(ctx, tx, userID, amount)
+		if err != nil {
+			return err
+		}
+		withGrants(meta, used)
+		if err := saveWallet(ctx, tx, org); err != nil {
+			return err
+		}
+		if err := insertTx(ctx, tx, id, userID, userID, "transferred", amount, ownBefore, own.Balance, "org transfer", "", "", meta); err != nil {
+			return err
+		}
+		if err := insertTx(ctx, tx, uuid.NewString(), userID, orgWallet, "transferred", amount, orgBefore, org.Balance, "org transfer", "", "", meta); err != nil {
+			return err
+		}
+		res = &Result{Wallet: org, TxID: id, Spent: amount}
+		return nil
+	})
+	return res, err
+}
@@ -2,17 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	stderrors "errors"
 
     "github.com/xxrenzhe/autoads/pkg/middleware"
 	"github.com/xxrenzhe/autoads/services/billing/internal/config"
+	"github.com/xxrenzhe/autoads/services/billing/internal/domain"
+	"github.com/xxrenzhe/autoads/services/billing/internal/grants"
+	"github.com/xxrenzhe/autoads/services/billing/internal/ledger"
+	"github.com/xxrenzhe/autoads/services/billing/internal/orgs"
+	"github.com/xxrenzhe/autoads/services/billing/internal/outbox"
+	"github.com/xxrenzhe/autoads/services/billing/internal/payments"
+	"github.com/xxrenzhe/autoads/services/billing/internal/pricing"
+	"github.com/xxrenzhe/autoads/services/billing/internal/statements"
+	"github.com/xxrenzhe/autoads/services/billing/internal/subscriptions"
+	"github.com/xxrenzhe/autoads/services/billing/internal/tokens"
 
 
     "github.com/jackc/pgx/v5"
@@ -60,17 +75,58 @@ func main() {
     r.Get("/health", apiHandler.healthz)
     r.Get("/healthz", apiHandler.healthz)
     // Atomic billing endpoints will be bound via OpenAPI chi server
-    var pub *ev.Publisher
-    if p, err := ev.NewPublisher(ctx); err == nil { pub = p; defer p.Close() }
+    // Events are recorded in event_outbox with each change; the relay publishes them.
+    if pub, err := ev.NewPublisher(ctx); err == nil {
+        defer pub.Close()
+        sqlDB, err := sql.Open("postgres", cfg.DatabaseURL)
+        if err != nil { log.Fatalf("Failed to open outbox database: %v", err) }
+        defer sqlDB.Close()
+        relay := &ev.Relay{DB: sqlDB, Pub: pub, Source: outbox.Source, Interval: time.Second}
+        go relay.Run(ctx)
+    }
+    if err := apiHandler.initPayments(); err != nil { log.Fatalf("Failed to configure payments: %v", err) }
+    seedPriceBooks(ctx, apiHandler.Pricing)
+    go runHoldSweeper(ctx, apiHandler.Tokens)
+    go runReconciler(ctx, apiHandler.Ledger)
+    go runSubscriptionSweeper(ctx, apiHandler.Subs, apiHandler.Grants)
+    go runGrantExpirySweeper(ctx, apiHandler.Tokens)
+    go runStatementCloser(ctx, apiHandler.Statements)
     // Custom non-OAS endpoints first (so they aren't shadowed), all behind auth
     r.Group(func(rch chi.Router) {
         rch.Use(middleware.AuthMiddleware)
         rch.Get("/api/v1/billing/config", apiHandler.getBillingConfig)
+        rch.Post("/api/v1/billing/pricing/quote", apiHandler.quotePrice)
         rch.Get("/api/v1/billing/tokens/transactions/{id}", apiHandler.getTokenTransactionByID)
+        rch.Post("/api/v1/billing/subscription/plan", apiHandler.changePlan)
+        rch.Post("/api/v1/billing/subscription/cancel", apiHandler.cancelSubscription)
+        rch.Post("/api/v1/billing/subscription/resume", apiHandler.resumeSubscription)
+        rch.Post("/api/v1/billing/checkout", apiHandler.createCheckout(payments.KindSubscription))
+        rch.Post("/api/v1/billing/tokens/topup", apiHandler.createCheckout(payments.KindTopUp))
+        rch.Get("/api/v1/billing/tokens/topup/packages", apiHandler.listTopUpPackages)
+        rch.Get("/api/v1/billing/statements", apiHandler.listStatements)
+        rch.Get("/api/v1/billing/statements/{seq}", apiHandler.getStatement)
+        rch.Post("/api/v1/billing/orgs", apiHandler.createOrg)
+        rch.Get("/api/v1/billing/orgs", apiHandler.listOrgs)
+        rch.Get("/api/v1/billing/orgs/{orgId}", apiHandler.getOrg)
+        rch.Put("/api/v1/billing/orgs/{orgId}/members/{userId}", apiHandler.putOrgMember)
+        rch.Delete("/api/v1/billing/orgs/{orgId}/members/{userId}", apiHandler.deleteOrgMember)
+        rch.Post("/api/v1/billing/orgs/{orgId}/transfer", apiHandler.transferToOrg)
+        rch.Get("/api/v1/billing/orgs/{orgId}/usage", apiHandler.orgUsage)
+        rch.Get("/api/v1/billing/orgs/{orgId}/statements", apiHandler.listOrgStatements)
+        rch.Get("/api/v1/billing/orgs/{orgId}/statements/{seq}", apiHandler.getOrgStatement)
+        rch.Post("/api/v1/billing/promos/redeem", apiHandler.redeemPromo)
+        rch.Get("/api/v1/billing/referrals", apiHandler.getReferrals)
+        rch.Post("/api/v1/billing/referrals/claim", apiHandler.claimReferral)
+        rch.Get("/api/v1/billing/tokens/grants", apiHandler.listGrants)
     })
+    // Provider webhooks are authenticated by their signature
+    r.Post("/api/v1/billing/webhooks/{provider}", apiHandler.paymentWebhook)
+    if _, ok := apiHandler.Payments.(*payments.Fake); ok {
+        r.Get("/api/v1/billing/fake/checkout/{id}", apiHandler.fakeCheckout)
+    }
 
     // Bind OpenAPI chi server under /api/v1/billing
-    oas := &oasImpl{h: apiHandler, pub: pub}
+    oas := &oasImpl{h: apiHandler}
     oapiHandler := api.HandlerWithOptions(oas, api.ChiServerOptions{
         BaseURL: "/api/v1/billing",
         Middlewares: []api.MiddlewareFunc{
@@ -80,6 +136,21 @@ func main() {
     })
     r.Mount("/", oapiHandler)
 
+    // Internal ledger reconciliation (protected via X-Service-Token)
+    r.Get("/api/v1/billing/internal/reconcile", apiHandler.reconcileInternal)
+    r.Post("/api/v1/billing/internal/reconcile", apiHandler.reconcileInternal)
+    // Internal price book management (protected via X-Service-Token)
+    r.Get("/api/v1/billing/internal/pricebooks", apiHandler.priceBooksInternal)
+    r.Post("/api/v1/billing/internal/pricebooks", apiHandler.priceBooksInternal)
+    // Internal statement close for a past month (protected via X-Service-Token)
+    r.Post("/api/v1/billing/internal/statements/close", apiHandler.closeStatementsInternal)
+    // Internal promo code management and grant expiry (protected via X-Service-Token)
+    r.Get("/api/v1/billing/internal/promos", apiHandler.promosInternal)
+    r.Post("/api/v1/billing/internal/promos", apiHandler.promosInternal)
+    r.Post("/api/v1/billing/internal/grants/expire", apiHandler.expireGrantsInternal)
+    // Internal admin grants issued from the console (protected via X-Service-Token)
+    r.Post("/api/v1/billing/internal/grants", apiHandler.grantInternal)
+
     log.Printf("Billing service HTTP server listening on port %s", cfg.Port)
     if err := http.ListenAndServe(":"+cfg.Port, r); err != nil {
         log.Fatalf("failed to start server: %v", err)
@@ -123,8 +194,17 @@ func runMigrations(databaseURL string) error {
 	}
 	return tx.Commit()
 }
-type Handler struct { DB *pgxpool.Pool }
-func NewHandler(db *pgxpool.Pool) *Handler { return &Handler{DB: db} }
+type Handler struct {
+    DB *pgxpool.Pool; Tokens *tokens.Store; Ledger *ledger.Reconciler; Subs *subscriptions.Engine; Pricing *pricing.Store; Statements *statements.Store; Orgs *orgs.Store; Grants *grants.Store
+    // Payments is nil when no provider is configured (BILLING_PAYMENT_PROVIDER).
+    Payments payments.Provider; PayStore *payments.PGStore; Webhooks *payments.Processor
+}
+func NewHandler(db *pgxpool.Pool) *Handler {
+    store := tokens.New(db)
+    g := grants.New(db, store)
+    configureGrants(g)
+    return &Handler{DB: db, Tokens: store, Ledger: ledger.NewReconciler(db), Subs: subscriptions.New(db, store, nil), Pricing: pricing.New(db), Statements: statements.New(db), Orgs: orgs.New(db), Grants: g}
+}
 func (h *Handler) RegisterRoutes(mux *http.ServeMux, authMiddleware func(http.Handler) http.Handler) {
 	mux.HandleFunc("/healthz", h.healthz)
 	mux.HandleFunc("/health", h.healthz)
@@ -133,20 +213,17 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux, authMiddleware func(http.Ha
 	mux.Handle("/api/v1/billing/tokens/transactions", authMiddleware(http.HandlerFunc(h.getTokenTransactions)))
 }
 func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
-type Subscription struct {
-	ID string `json:"id"`; PlanName string `json:"planName"`; Status string `json:"status"`; CurrentPeriodEnd time.Time `json:"currentPeriodEnd"`
-}
 type TokenBalance struct {
-	Balance int64 `json:"balance"`; UpdatedAt time.Time `json:"updatedAt"`
+	Balance int64 `json:"balance"`; Held int64 `json:"held"`; Available int64 `json:"available"`; UpdatedAt time.Time `json:"updatedAt"`
 }
 type TokenTransaction struct {
 	ID string `json:"id"`; Type string `json:"type"`; Amount int `json:"amount"`; Description string `json:"description"`; CreatedAt time.Time `json:"createdAt"`
+	FundingSource string `json:"fundingSource"`; OrgID string `json:"orgId,omitempty"`
 }
 func (h *Handler) getSubscription(w http.ResponseWriter, r *http.Request) {
     userID, ok := r.Context().Value(middleware.UserIDKey).(string)
     if !ok { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
-	var sub Subscription
-	err := h.DB.QueryRow(r.Context(), `SELECT id, "planName", status, "currentPeriodEnd" FROM "Subscription" WHERE "userId" = $1`, userID).Scan(&sub.ID, &sub.PlanName, &sub.Status, &sub.CurrentPeriodEnd)
+	sub, err := h.Subs.Get(r.Context(), userID)
     if err != nil { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "Not found", nil); return }
 	respondWithJSON(w, http.StatusOK, sub)
     _ = writeBillingUI(r.Context(), userID, map[string]any{"subscription": sub})
@@ -155,8 +232,9 @@ func (h *Handler) getTokenBalance(w http.ResponseWriter, r *http.Request) {
     userID, ok := r.Context().Value(middleware.UserIDKey).(string)
     if !ok { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
 	var balance TokenBalance
-	err := h.DB.QueryRow(r.Context(), `SELECT balance, "updatedAt" FROM "UserToken" WHERE "userId" = $1`, userID).Scan(&balance.Balance, &balance.UpdatedAt)
+	err := h.DB.QueryRow(r.Context(), `SELECT balance, held, "updatedAt" FROM "UserToken" WHERE "userId" = $1`, userID).Scan(&balance.Balance, &balance.Held, &balance.UpdatedAt)
     if err != nil { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "Not found", nil); return }
+    balance.Available = balance.Balance - balance.Held
 	respondWithJSON(w, http.StatusOK, balance)
     _ = writeBillingUI(r.Context(), userID, map[string]any{"tokens": balance})
 }
@@ -164,14 +242,14 @@ func (h *Handler) getTokenTransactions(w http.ResponseWriter, r *http.Request) {
     uid, _ := r.Context().Value(middleware.UserIDKey).(string)
     if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
     rows, err := h.DB.Query(r.Context(), `
-        SELECT id, type, amount, description, "createdAt" FROM "TokenTransaction"
+        SELECT id, type, amount, description, "createdAt", COALESCE("fundingSource", 'personal'), COALESCE("orgId", '') FROM "TokenTransaction"
         WHERE "userId"=$1 ORDER BY "createdAt" DESC LIMIT 50`, uid)
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
     defer rows.Close()
     list := make([]TokenTransaction, 0, 50)
     for rows.Next() {
         var t TokenTransaction
-        if err := rows.Scan(&t.ID, &t.Type, &t.Amount, &t.Description, &t.CreatedAt); err == nil {
+        if err := rows.Scan(&t.ID, &t.Type, &t.Amount, &t.Description, &t.CreatedAt, &t.FundingSource, &t.OrgID); err == nil {
             list = append(list, t)
         }
     }
@@ -197,109 +275,476 @@ func writeBillingUI(ctx context.Context, userID string, patch map[string]any) er
     return err
 }
 
-// --- Atomic Billing minimal endpoints ---
-// reserveTokens publishes TokenReserved and writes a TokenTransaction row (type=reserved). No balance mutation here.
-func (h *Handler) reserveTokens(pub *ev.Publisher) func(http.ResponseWriter, *http.Request) {
-    type reqT struct{ Amount int `json:"amount"`; TaskID string `json:"taskId"` }
-    return func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
-        uid, _ := r.Context().Value(middleware.UserIDKey).(string)
-        var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
-        if uid == "" || req.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid", nil); return }
-        // Idempotency
-        idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
-        id := ""
-        if idem != "" {
-            if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.reserve"); ok { id = ex }
+// --- Atomic Billing endpoints ---
+// Reservations are real holds: reserve moves tokens from available to held, commit spends from a
+// hold (partially or finally) and release/expiry return the rest. See internal/tokens.
+
+// holdTTL is how long a reservation lives before the sweeper releases it (BILLING_HOLD_TTL_SECONDS, default 30m).
+func holdTTL(requested int) time.Duration {
+    ttl := 30 * time.Minute
+    if v := strings.TrimSpace(os.Getenv("BILLING_HOLD_TTL_SECONDS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 60 && n <= 86400 { ttl = time.Duration(n) * time.Second }
+    }
+    if requested >= 60 && requested <= 86400 { ttl = time.Duration(requested) * time.Second }
+    return ttl
+}
+
+// writeHoldError maps reservation errors to API errors; res carries the wallet/hold when known.
+func writeHoldError(w http.ResponseWriter, r *http.Request, err error, res *tokens.Result, attempt int64) {
+    switch {
+    case stderrors.Is(err, domain.ErrInsufficientTokens):
+        details := map[string]any{"attempt": attempt}
+        if res != nil { details["balance"], details["held"], details["available"] = res.Wallet.Balance, res.Wallet.Held, res.Wallet.Available() }
+        errors.Write(w, r, http.StatusConflict, "INSUFFICIENT_TOKENS", "insufficient token balance", details)
+    case stderrors.Is(err, domain.ErrSpendCapExceeded):
+        details := map[string]any{"attempt": attempt}
+        var capErr *domain.CapError
+        if stderrors.As(err, &capErr) { details["period"], details["cap"], details["used"] = capErr.Period, capErr.Cap, capErr.Used }
+        errors.Write(w, r, http.StatusConflict, "SPEND_CAP_EXCEEDED", err.Error(), details)
+    case stderrors.Is(err, domain.ErrNotMember), stderrors.Is(err, domain.ErrOrgNotFound):
+        errors.Write(w, r, http.StatusForbidden, "FORBIDDEN", "not a member of the organization", nil)
+    case stderrors.Is(err, domain.ErrHoldNotFound):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "reservation not found", nil)
+    case stderrors.Is(err, domain.ErrHoldClosed):
+        details := map[string]any{}
+        if res != nil && res.Hold != nil { details["reservationId"], details["status"] = res.Hold.ID, res.Hold.Status }
+        errors.Write(w, r, http.StatusConflict, "INVALID_STATE", "reservation is already settled", details)
+    case stderrors.Is(err, domain.ErrUnknownAction):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), map[string]any{"hint": "GET /api/v1/billing/config lists the priced actions"})
+    case stderrors.Is(err, domain.ErrHoldExceeded):
+        details := map[string]any{"attempt": attempt}
+        if res != nil && res.Hold != nil { details["remaining"] = res.Hold.Remaining() }
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "amount exceeds reserved tokens", details)
+    default:
+        log.Printf("billing: reservation failed: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "reservation update failed", nil)
+    }
+}
+
+func holdResponse(res *tokens.Result, status string) map[string]any {
+    out := map[string]any{"txId": res.TxID, "status": status, "balance": res.Wallet.Balance, "held": res.Wallet.Held, "available": res.Wallet.Available()}
+    if h := res.Hold; h != nil {
+        out["reservationId"] = h.ID
+        out["reservation"] = map[string]any{"id": h.ID, "status": h.Status, "amount": h.Amount, "committed": h.Committed, "released": h.Released, "remaining": h.Remaining(), "expiresAt": h.ExpiresAt.UTC().Format(time.RFC3339)}
+    }
+    return out
+}
+
+// pricedReq names what a reserve/commit pays for: one action with a quantity, or several items.
+// Billing prices them from the price book; a raw amount is still accepted from older callers.
+type pricedReq struct {
+    Action string `json:"action"`; Quantity int64 `json:"quantity"`; Items []domain.Item `json:"items"`
+}
+
+func (p pricedReq) items() []domain.Item {
+    items := p.Items
+    if strings.TrimSpace(p.Action) != "" { items = append(items, domain.Item{Action: p.Action, Quantity: p.Quantity}) }
+    return items
+}
+
+// planFor returns the plan the caller is priced at: their subscription's plan while it is not
+// canceled, free otherwise.
+func (h *Handler) planFor(ctx context.Context, uid string) string {
+    sub, err := h.Subs.Get(ctx, uid)
+    if err != nil || sub.Status == domain.StatusCanceled { return domain.FreePlanID }
+    if p, ok := domain.LookupPlan(sub.PlanID, sub.PlanName); ok { return p.ID }
+    return domain.FreePlanID
+}
+
+// quote prices items for the caller under version ("" for the active price book) and planID (""
+// for the caller's current plan). Without items it wraps the raw amount.
+func (h *Handler) quote(ctx context.Context, uid, version, planID string, items []domain.Item, amount int64) (*domain.Quote, error) {
+    if len(items) == 0 { return domain.FlatQuote(amount), nil }
+    if planID == "" { planID = h.planFor(ctx, uid) }
+    return h.Pricing.Quote(ctx, version, planID, items)
+}
+
+// reserveTokens holds tokens for a task: available balance drops, held grows. The amount is
+// priced from action/quantity (or items) with the active price book. Reserving again for a task
+// with an open hold returns that hold. With X-Org-Id the organization wallet pays, within the
+// caller's member caps.
+func (h *Handler) reserveTokens(w http.ResponseWriter, r *http.Request) {
+    type reqT struct{ pricedReq; Amount int `json:"amount"`; TaskID string `json:"taskId"`; TTLSeconds int `json:"ttlSeconds"` }
+    if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
+    items := req.items()
+    if uid == "" || (len(items) == 0 && req.Amount <= 0) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "action or amount required", nil); return }
+    // Idempotency
+    idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
+    if idem != "" {
+        if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.reserve"); ok {
+            respondWithJSON(w, http.StatusAccepted, map[string]any{"txId": ex, "reservationId": ex, "status": "reserved"})
+            return
         }
-        if id == "" { id = newID() }
-        // snapshot current balance for audit fields (no mutation)
-        var before int64
-        _ = h.DB.QueryRow(r.Context(), `SELECT balance FROM "UserToken" WHERE "userId"=$1`, uid).Scan(&before)
-        meta := map[string]any{"taskId": req.TaskID, "action": "reserve"}
-        _, _ = h.DB.Exec(r.Context(), `INSERT INTO "TokenTransaction"(id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata) VALUES ($1,$2,'reserved',$3,$4,$4,'billing','reserve',to_jsonb($5::json))`, id, uid, req.Amount, before, mustJSON(meta))
-        if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.reserve", id, 24*time.Hour) }
-        if pub != nil { _ = pub.Publish(r.Context(), ev.EventTokenReserved, map[string]any{"txId": id, "userId": uid, "amount": req.Amount, "taskId": req.TaskID, "time": time.Now().UTC().Format(time.RFC3339)}, ev.WithSource("billing"), ev.WithSubject(id)) }
-        respondWithJSON(w, http.StatusAccepted, map[string]any{"txId": id, "status": "reserved"})
     }
+    q, err := h.quote(r.Context(), uid, "", "", items, int64(req.Amount))
+    if err != nil { writeHoldError(w, r, err, nil, 0); return }
+    p := payer(r)
+    res, err := h.Tokens.Reserve(r.Context(), p, strings.TrimSpace(req.TaskID), q, holdTTL(req.TTLSeconds))
+    if err != nil { writeHoldError(w, r, err, res, q.Amount); return }
+    if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.reserve", res.TxID, 24*time.Hour) }
+    out := holdResponse(res, "reserved")
+    if q.Version != "" { out["quote"] = q }
+    respondWithJSON(w, http.StatusAccepted, out)
 }
 
-func (h *Handler) commitTokens(pub *ev.Publisher) func(http.ResponseWriter, *http.Request) {
-    type reqT struct{ TxID string `json:"txId"`; Amount int `json:"amount"`; TaskID string `json:"taskId"` }
-    return func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
-        uid, _ := r.Context().Value(middleware.UserIDKey).(string)
-        var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
-        if uid == "" || req.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid", nil); return }
-        // Idempotency
-        idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
-        if idem != "" {
-            if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.commit"); ok {
-                respondWithJSON(w, http.StatusOK, map[string]any{"txId": ex, "status": "committed"})
-                return
-            }
+// commitTokens spends from a reservation, referenced by reservationId (txId and taskId are accepted
+// for older callers). What is spent is priced from action/quantity (or items) with the price book
+// version and plan the reservation was made under, capped at what it still holds; without either
+// it defaults to everything still held. final (default true) releases the remainder, final=false
+// keeps it held for further partial commits. Without any reservation, or when the one referenced
+// by txId/taskId has expired (its holder waited past the TTL), the usage is debited from the
+// available balance directly, of the wallet X-Org-Id selects. Commits settle against the wallet
+// the reservation was made on.
+func (h *Handler) commitTokens(w http.ResponseWriter, r *http.Request) {
+    type reqT struct{ pricedReq; ReservationID string `json:"reservationId"`; TxID string `json:"txId"`; Amount int `json:"amount"`; TaskID string `json:"taskId"`; Final *bool `json:"final"` }
+    if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
+    ref := firstNonEmpty(req.ReservationID, req.TxID, req.TaskID)
+    items := req.items()
+    if uid == "" || req.Amount < 0 || (ref == "" && req.Amount == 0 && len(items) == 0) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid", nil); return }
+    // Idempotency
+    idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
+    if idem != "" {
+        if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.commit"); ok {
+            respondWithJSON(w, http.StatusOK, map[string]any{"txId": ex, "status": "committed"})
+            return
+        }
+    }
+    final := req.Final == nil || *req.Final
+    commit := func() (*tokens.Result, error) {
+        if ref == "" { return nil, domain.ErrHoldNotFound }
+        amount := int64(req.Amount)
+        var q *domain.Quote
+        if len(items) > 0 {
+            hold, err := h.Tokens.Hold(r.Context(), uid, ref)
+            if err != nil { return nil, err }
+            if q, err = h.quote(r.Context(), uid, hold.PriceVersion, hold.PlanID, items, 0); err != nil { return nil, err }
+            // the reservation is the ceiling; usage beyond the estimate is not charged
+            amount = q.Amount
+            if rem := hold.Remaining(); amount > rem && hold.IsOpen() { amount = rem }
+        }
+        return h.Tokens.Commit(r.Context(), uid, ref, amount, final, q)
+    }
+    res, err := commit()
+    expired := stderrors.Is(err, domain.ErrHoldClosed) && res != nil && res.Hold != nil && res.Hold.Status == domain.HoldExpired
+    if (expired || stderrors.Is(err, domain.ErrHoldNotFound)) && req.ReservationID == "" && (req.Amount > 0 || len(items) > 0) {
+        // an expired hold's tokens are back in the balance; price them as the hold was
+        version, planID := "", ""
+        if expired { version, planID = res.Hold.PriceVersion, res.Hold.PlanID }
+        var q *domain.Quote
+        if q, err = h.quote(r.Context(), uid, version, planID, items, int64(req.Amount)); err == nil {
+            res, err = h.Tokens.Debit(r.Context(), payer(r), req.TaskID, q)
         }
-        id := req.TxID
-        if id == "" { id = newID() }
-        // atomic debit
-        tx, err := h.DB.Begin(r.Context())
-        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "begin tx failed", map[string]string{"error": err.Error()}); return }
-        defer tx.Rollback(r.Context())
-        var before int64
-        // lock row if exists
-        _ = tx.QueryRow(r.Context(), `SELECT balance FROM "UserToken" WHERE "userId"=$1 FOR UPDATE`, uid).Scan(&before)
-        if before < int64(req.Amount) {
-            errors.Write(w, r, http.StatusConflict, "INSUFFICIENT_TOKENS", "insufficient token balance", map[string]any{"balance": before, "attempt": req.Amount})
+    }
+    if err != nil { writeHoldError(w, r, err, res, int64(req.Amount)); return }
+    if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.commit", res.TxID, 24*time.Hour) }
+    respondWithJSON(w, http.StatusOK, holdResponse(res, "committed"))
+}
+
+// releaseTokens returns what a reservation still holds to the available balance.
+func (h *Handler) releaseTokens(w http.ResponseWriter, r *http.Request) {
+    type reqT struct{ ReservationID string `json:"reservationId"`; TxID string `json:"txId"`; Amount int `json:"amount"`; TaskID string `json:"taskId"` }
+    if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
+    ref := firstNonEmpty(req.ReservationID, req.TxID, req.TaskID)
+    if uid == "" || ref == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "reservationId required", nil); return }
+    // Idempotency
+    idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
+    if idem != "" {
+        if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.release"); ok {
+            respondWithJSON(w, http.StatusOK, map[string]any{"txId": ex, "status": "released"})
             return
         }
-        after := before - int64(req.Amount)
-        // upsert balance
-        if before == 0 {
-            // ensure row exists to allow update
-            _, _ = tx.Exec(r.Context(), `INSERT INTO "UserToken"("userId", balance, "updatedAt") VALUES ($1, $2, NOW()) ON CONFLICT ("userId") DO NOTHING`, uid, before)
+    }
+    res, err := h.Tokens.Release(r.Context(), uid, ref)
+    if err != nil { writeHoldError(w, r, err, res, 0); return }
+    if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.release", res.TxID, 24*time.Hour) }
+    respondWithJSON(w, http.StatusOK, holdResponse(res, "released"))
+}
+
+
+// runHoldSweeper releases reservations past their expiry (BILLING_HOLD_SWEEP_MS, default 60s).
+func runHoldSweeper(ctx context.Context, store *tokens.Store) {
+    interval := time.Minute
+    if v := strings.TrimSpace(os.Getenv("BILLING_HOLD_SWEEP_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 3600000 { interval = time.Duration(n) * time.Millisecond }
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
         }
-        if _, err := tx.Exec(r.Context(), `UPDATE "UserToken" SET balance=$1, "updatedAt"=NOW() WHERE "userId"=$2`, after, uid); err != nil {
-            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "update balance failed", map[string]string{"error": err.Error()}); return
+        expired, err := store.ExpireDue(ctx, time.Now(), 200)
+        if len(expired) > 0 { log.Printf("billing: expired %d token reservations", len(expired)) }
+        if err != nil { log.Printf("billing: hold sweep: %v", err) }
+    }
+}
+
+// runReconciler checks cached wallets against the ledger once a day at BILLING_RECONCILE_AT
+// (HH:MM UTC, default 03:00). Instances that find a report from the last 12h skip the run.
+func runReconciler(ctx context.Context, rec *ledger.Reconciler) {
+    hour, minute := 3, 0
+    if v := strings.TrimSpace(os.Getenv("BILLING_RECONCILE_AT")); v != "" {
+        if t, err := time.Parse("15:04", v); err == nil { hour, minute = t.Hour(), t.Minute() } else { log.Printf("billing: invalid BILLING_RECONCILE_AT %q, using 03:00", v) }
+    }
+    for {
+        now := time.Now().UTC()
+        next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, time.UTC)
+        if !next.After(now) { next = next.AddDate(0, 0, 1) }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(time.Until(next)):
         }
-        meta := map[string]any{"taskId": req.TaskID, "action": "commit"}
-        if _, err := tx.Exec(r.Context(), `INSERT INTO "TokenTransaction"(id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata) VALUES ($1,$2,'debited',$3,$4,$5,'billing','commit',to_jsonb($6::json))`, id, uid, req.Amount, before, after, mustJSON(meta)); err != nil {
-            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "insert tx failed", map[string]string{"error": err.Error()}); return
+        if last, err := rec.Latest(ctx); err == nil && last != nil && time.Since(last.RunAt) < 12*time.Hour { continue }
+        rep, err := rec.Run(ctx)
+        if err != nil { log.Printf("billing: ledger reconciliation: %v", err); continue }
+        logReconciliation(rep)
+    }
+}
+
+func logReconciliation(rep *ledger.Report) {
+    if len(rep.Mismatches) == 0 && len(rep.Unbalanced) == 0 {
+        log.Printf("billing: ledger reconciliation %s: %d wallets match", rep.ID, rep.Users)
+        return
+    }
+    log.Printf("billing: ledger reconciliation %s: %d of %d wallets disagree with the ledger, %d unbalanced entries", rep.ID, len(rep.Mismatches), rep.Users, len(rep.Unbalanced))
+    for _, m := range rep.Mismatches {
+        log.Printf("billing: ledger mismatch user=%s balance=%d ledgerBalance=%d held=%d ledgerHeld=%d", m.UserID, m.CachedBalance, m.LedgerBalance, m.CachedHeld, m.LedgerHeld)
+    }
+}
+
+// reconcileInternal returns the latest reconciliation report (GET) or runs one now (POST).
+// Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) reconcileInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    if r.Method == http.MethodGet {
+        rep, err := h.Ledger.Latest(r.Context())
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+        if rep == nil { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "no reconciliation yet", nil); return }
+        respondWithJSON(w, http.StatusOK, rep)
+        return
+    }
+    rep, err := h.Ledger.Run(r.Context())
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "reconciliation failed", map[string]string{"error": err.Error()}); return }
+    logReconciliation(rep)
+    respondWithJSON(w, http.StatusOK, rep)
+}
+
+// runSubscriptionSweeper renews, marks past due or cancels subscriptions whose period ended
+// (BILLING_SUBSCRIPTION_SWEEP_MS, default 5m; BILLING_PAST_DUE_GRACE_HOURS, default 168).
+func runSubscriptionSweeper(ctx context.Context, subs *subscriptions.Engine, g *grants.Store) {
+    interval := 5 * time.Minute
+    if v := strings.TrimSpace(os.Getenv("BILLING_SUBSCRIPTION_SWEEP_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 3600000 { interval = time.Duration(n) * time.Millisecond }
+    }
+    if v := strings.TrimSpace(os.Getenv("BILLING_PAST_DUE_GRACE_HOURS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 { subs.Grace = time.Duration(n) * time.Hour }
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
         }
-        if err := tx.Commit(r.Context()); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "commit failed", map[string]string{"error": err.Error()}); return }
-        if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.commit", id, 24*time.Hour) }
-        if pub != nil { _ = pub.Publish(r.Context(), ev.EventTokenDebited, map[string]any{"txId": id, "userId": uid, "amount": req.Amount, "taskId": req.TaskID, "time": time.Now().UTC().Format(time.RFC3339)}, ev.WithSource("billing"), ev.WithSubject(id)) }
-        respondWithJSON(w, http.StatusOK, map[string]any{"txId": id, "status": "committed", "balance": after})
+        done, err := subs.Sweep(ctx, time.Now(), 200)
+        for i := range done { creditReferral(ctx, g, &done[i]) }
+        if len(done) > 0 { log.Printf("billing: advanced %d subscriptions", len(done)) }
+        if err != nil { log.Printf("billing: subscription sweep: %v", err) }
+    }
+}
+
+
+func writeSubscriptionError(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case stderrors.Is(err, subscriptions.ErrNotFound):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "subscription not found", nil)
+    case stderrors.Is(err, subscriptions.ErrUnknownPlan):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "planId must be one of free|pro|max", nil)
+    case stderrors.Is(err, domain.ErrSubscriptionCanceled):
+        errors.Write(w, r, http.StatusConflict, "INVALID_STATE", err.Error(), nil)
+    case stderrors.Is(err, subscriptions.ErrConflict):
+        errors.Write(w, r, http.StatusConflict, "CONFLICT", err.Error(), nil)
+    case stderrors.Is(err, subscriptions.ErrPaymentFailed):
+        errors.Write(w, r, http.StatusPaymentRequired, "PAYMENT_FAILED", err.Error(), nil)
+    default:
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "subscription update failed", map[string]string{"error": err.Error()})
+    }
+}
+
+// changePlan switches the caller's plan with proration. Body: {"planId": "free|pro|max"}
+func (h *Handler) changePlan(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var body struct{ PlanID string `json:"planId"` }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.PlanID) == "" {
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "planId required", nil); return
     }
+    t, err := h.Subs.ChangePlan(r.Context(), uid, body.PlanID, time.Now())
+    if err != nil { writeSubscriptionError(w, r, err); return }
+    creditReferral(r.Context(), h.Grants, t)
+    sub, err := h.Subs.Get(r.Context(), uid)
+    if err != nil { writeSubscriptionError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"subscription": sub, "transition": t})
+}
+
+// cancelSubscription cancels the caller's subscription. Body: {"atPeriodEnd": true} (default true)
+func (h *Handler) cancelSubscription(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var body struct{ AtPeriodEnd *bool `json:"atPeriodEnd"` }
+    _ = json.NewDecoder(r.Body).Decode(&body)
+    atPeriodEnd := body.AtPeriodEnd == nil || *body.AtPeriodEnd
+    sub, _, err := h.Subs.Cancel(r.Context(), uid, atPeriodEnd, time.Now())
+    if err != nil { writeSubscriptionError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"subscription": sub})
 }
 
-func (h *Handler) releaseTokens(pub *ev.Publisher) func(http.ResponseWriter, *http.Request) {
-    type reqT struct{ TxID string `json:"txId"`; Amount int `json:"amount"`; TaskID string `json:"taskId"` }
+// resumeSubscription withdraws a pending cancel-at-period-end request.
+func (h *Handler) resumeSubscription(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    sub, err := h.Subs.Resume(r.Context(), uid)
+    if err != nil { writeSubscriptionError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"subscription": sub})
+}
+
+// initPayments configures the payment provider from BILLING_PAYMENT_PROVIDER:
+//   stripe: STRIPE_SECRET_KEY and STRIPE_WEBHOOK_SECRET
+//   fake:   BILLING_FAKE_WEBHOOK_SECRET (default "whsec_fake"); webhooks go to BILLING_FAKE_WEBHOOK_URL
+//           or straight to this process, and checkout pages are served under BILLING_PUBLIC_URL.
+// Renewals are charged through the provider once one is configured.
+func (h *Handler) initPayments() error {
+    h.PayStore = payments.NewPGStore(h.DB)
+    h.Webhooks = &payments.Processor{Events: h.PayStore, Tokens: h.Tokens, Subs: h.Subs}
+    switch p := strings.ToLower(strings.TrimSpace(os.Getenv("BILLING_PAYMENT_PROVIDER"))); p {
+    case "":
+        log.Println("billing: no payment provider configured; checkout disabled")
+        return nil
+    case "stripe":
+        key, secret := strings.TrimSpace(os.Getenv("STRIPE_SECRET_KEY")), strings.TrimSpace(os.Getenv("STRIPE_WEBHOOK_SECRET"))
+        if key == "" || secret == "" { return fmt.Errorf("STRIPE_SECRET_KEY and STRIPE_WEBHOOK_SECRET are required") }
+        h.Payments = payments.NewStripe(key, secret)
+    case "fake":
+        deliver := payments.DeliverToHandler(http.HandlerFunc(h.paymentWebhook))
+        if u := strings.TrimSpace(os.Getenv("BILLING_FAKE_WEBHOOK_URL")); u != "" { deliver = payments.DeliverTo(u) }
+        f := payments.NewFake(firstNonEmpty(os.Getenv("BILLING_FAKE_WEBHOOK_SECRET"), "whsec_fake"), deliver)
+        base := strings.TrimRight(strings.TrimSpace(os.Getenv("BILLING_PUBLIC_URL")), "/")
+        f.CheckoutURL = func(id string) string { return base + "/api/v1/billing/fake/checkout/" + id }
+        h.Payments = f
+    default:
+        return fmt.Errorf("unknown payment provider %q", p)
+    }
+    h.Subs.SetCharger(&payments.Charger{Provider: h.Payments, Customer: h.customerID})
+    log.Printf("billing: payments via %s", h.Payments.Name())
+    return nil
+}
+
+// customerID returns the caller's saved provider customer id, if any.
+func (h *Handler) customerID(ctx context.Context, userID string) (string, error) {
+    var id string
+    err := h.DB.QueryRow(ctx, `SELECT COALESCE("stripeCustomerId", '') FROM "Subscription" WHERE "userId"=$1`, userID).Scan(&id)
+    if stderrors.Is(err, pgx.ErrNoRows) { return "", nil }
+    return id, err
+}
+
+// createCheckout starts a hosted checkout for a plan (kind subscription, body {"planId": "pro|max"})
+// or a token top-up (kind topup, body {"packageId": "tokens-10k"}). Optional successUrl/cancelUrl.
+func (h *Handler) createCheckout(kind string) func(http.ResponseWriter, *http.Request) {
     return func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
         uid, _ := r.Context().Value(middleware.UserIDKey).(string)
-        var req reqT; _ = json.NewDecoder(r.Body).Decode(&req)
-        if uid == "" || req.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid", nil); return }
-        // Idempotency
-        idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key"))
-        if idem != "" {
-            if ex, ok := h.lookupIdem(r.Context(), idem, uid, "billing.release"); ok {
-                respondWithJSON(w, http.StatusOK, map[string]any{"txId": ex, "status": "released"})
-                return
+        if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+        if h.Payments == nil { errors.Write(w, r, http.StatusServiceUnavailable, "UNAVAILABLE", "payments are not configured", nil); return }
+        var body struct{ PlanID string `json:"planId"`; PackageID string `json:"packageId"`; SuccessURL string `json:"successUrl"`; CancelURL string `json:"cancelUrl"` }
+        _ = json.NewDecoder(r.Body).Decode(&body)
+        req := payments.CheckoutRequest{Kind: kind, UserID: uid, SuccessURL: firstNonEmpty(body.SuccessURL, os.Getenv("BILLING_CHECKOUT_SUCCESS_URL")), CancelURL: firstNonEmpty(body.CancelURL, os.Getenv("BILLING_CHECKOUT_CANCEL_URL"))}
+        if kind == payments.KindTopUp {
+            pkg, ok := domain.LookupTopUp(body.PackageID)
+            if !ok { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "unknown packageId", nil); return }
+            req.PackageID, req.Tokens, req.AmountCents, req.Currency = pkg.ID, pkg.Tokens, pkg.PriceCents, pkg.Currency
+            req.Description = fmt.Sprintf("%d tokens", pkg.Tokens)
+        } else {
+            plan, ok := domain.LookupPlan(body.PlanID)
+            if !ok || plan.PriceCents <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "planId must be one of pro|max", nil); return }
+            req.PlanID, req.AmountCents, req.Currency = plan.ID, plan.PriceCents, plan.Currency
+            req.Description = plan.Name + " plan (1 month)"
+        }
+        customer, err := h.customerID(r.Context(), uid)
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+        if customer == "" {
+            if customer, err = h.Payments.CreateCustomer(r.Context(), payments.Customer{UserID: uid}); err != nil {
+                errors.Write(w, r, http.StatusBadGateway, "PAYMENT_FAILED", "failed to create customer", map[string]string{"error": err.Error()}); return
             }
+            if err := h.Subs.SetCustomer(r.Context(), uid, customer); err != nil { log.Printf("billing: save customer %s: %v", uid, err) }
         }
-        id := req.TxID
-        if id == "" { id = newID() }
-        // record reversal (no balance mutation since reserve didn't deduct)
-        var before int64
-        _ = h.DB.QueryRow(r.Context(), `SELECT balance FROM "UserToken" WHERE "userId"=$1`, uid).Scan(&before)
-        meta := map[string]any{"taskId": req.TaskID, "action": "release"}
-        _, _ = h.DB.Exec(r.Context(), `INSERT INTO "TokenTransaction"(id, "userId", type, amount, "balanceBefore", "balanceAfter", source, description, metadata) VALUES ($1,$2,'reverted',$3,$4,$4,'billing','release',to_jsonb($5::json))`, id, uid, req.Amount, before, mustJSON(meta))
-        if idem != "" { _ = h.upsertIdem(r.Context(), idem, uid, "billing.release", id, 24*time.Hour) }
-        if pub != nil { _ = pub.Publish(r.Context(), ev.EventTokenReverted, map[string]any{"txId": id, "userId": uid, "amount": req.Amount, "taskId": req.TaskID, "time": time.Now().UTC().Format(time.RFC3339)}, ev.WithSource("billing"), ev.WithSubject(id)) }
-        respondWithJSON(w, http.StatusOK, map[string]any{"txId": id, "status": "released"})
+        req.CustomerID = customer
+        if key := strings.TrimSpace(r.Header.Get("X-Idempotency-Key")); key != "" { req.IdempotencyKey = "checkout:" + uid + ":" + key }
+        cs, err := h.Payments.CreateCheckoutSession(r.Context(), req)
+        if err != nil { errors.Write(w, r, http.StatusBadGateway, "PAYMENT_FAILED", "failed to start checkout", map[string]string{"error": err.Error()}); return }
+        if err := h.PayStore.SaveCheckout(r.Context(), uid, req, cs); err != nil { log.Printf("billing: save checkout %s: %v", cs.ID, err) }
+        respondWithJSON(w, http.StatusCreated, cs)
     }
 }
 
+func (h *Handler) listTopUpPackages(w http.ResponseWriter, r *http.Request) {
+    respondWithJSON(w, http.StatusOK, map[string]any{"items": domain.TopUpPackages})
+}
+
+// paymentWebhook applies a signed provider webhook. Replays of processed events return 200;
+// failures return 5xx so the provider redelivers.
+func (h *Handler) paymentWebhook(w http.ResponseWriter, r *http.Request) {
+    if h.Payments == nil { errors.Write(w, r, http.StatusServiceUnavailable, "UNAVAILABLE", "payments are not configured", nil); return }
+    if p := chi.URLParam(r, "provider"); p != "" && p != h.Payments.Name() {
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "unknown payment provider", nil); return
+    }
+    payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "read body failed", nil); return }
+    out, err := h.Webhooks.Handle(r.Context(), h.Payments, payload, r.Header)
+    switch {
+    case stderrors.Is(err, payments.ErrInvalidSignature):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return
+    case stderrors.Is(err, payments.ErrInFlight):
+        errors.Write(w, r, http.StatusConflict, "CONFLICT", err.Error(), nil); return
+    case err != nil:
+        log.Printf("billing: webhook: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "webhook processing failed", map[string]string{"error": err.Error()}); return
+    }
+    creditReferral(r.Context(), h.Grants, out.Activated)
+    respondWithJSON(w, http.StatusOK, map[string]any{"received": true, "duplicate": out.Duplicate})
+}
+
+// fakeCheckout stands in for the provider's hosted page: it pays the session, which delivers the
+// signed webhook, and redirects to the success URL.
+func (h *Handler) fakeCheckout(w http.ResponseWriter, r *http.Request) {
+    f, _ := h.Payments.(*payments.Fake)
+    id := chi.URLParam(r, "id")
+    cs, success, ok := f.Session(id)
+    if !ok { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "checkout session not found", nil); return }
+    eventID, err := f.CompleteCheckout(r.Context(), id)
+    if err != nil { errors.Write(w, r, http.StatusBadGateway, "PAYMENT_FAILED", "webhook delivery failed", map[string]string{"error": err.Error()}); return }
+    if success != "" { http.Redirect(w, r, success, http.StatusSeeOther); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"session": cs, "eventId": eventID})
+}
+
+func firstNonEmpty(vals ...string) string {
+    for _, v := range vals {
+        if v = strings.TrimSpace(v); v != "" { return v }
+    }
+    return ""
+}
+
 func newID() string { return strings.ReplaceAll(time.Now().UTC().Format("20060102150405.000000000"), ".", "") }
 
 // Idempotency helpers
@@ -319,52 +764,201 @@ func (h *Handler) upsertIdem(ctx context.Context, key, userID, scope, targetID s
 }
 
 // --- OpenAPI adapter ---
-type oasImpl struct{ h *Handler; pub *ev.Publisher }
+type oasImpl struct{ h *Handler }
 
 func (o *oasImpl) GetSubscription(w http.ResponseWriter, r *http.Request)        { o.h.getSubscription(w, r) }
 func (o *oasImpl) GetTokenBalance(w http.ResponseWriter, r *http.Request)        { o.h.getTokenBalance(w, r) }
 func (o *oasImpl) ListTokenTransactions(w http.ResponseWriter, r *http.Request)  { o.h.getTokenTransactions(w, r) }
-func (o *oasImpl) ReserveTokens(w http.ResponseWriter, r *http.Request)          { o.h.reserveTokens(o.pub)(w, r) }
-func (o *oasImpl) CommitTokens(w http.ResponseWriter, r *http.Request)           { o.h.commitTokens(o.pub)(w, r) }
-func (o *oasImpl) ReleaseTokens(w http.ResponseWriter, r *http.Request)          { o.h.releaseTokens(o.pub)(w, r) }
+func (o *oasImpl) ReserveTokens(w http.ResponseWriter, r *http.Request)          { o.h.reserveTokens(w, r) }
+func (o *oasImpl) CommitTokens(w http.ResponseWriter, r *http.Request)           { o.h.commitTokens(w, r) }
+func (o *oasImpl) ReleaseTokens(w http.ResponseWriter, r *http.Request)          { o.h.releaseTokens(w, r) }
 
 // --- Non-OAS handlers ---
-// getBillingConfig returns central pricing/limits config. Source: Secret Manager (projects/<id>/secrets/billing-pricing),
-// or env BILLING_PRICING_JSON as fallback. Response is JSON passthrough with sensible defaults.
+// getBillingConfig returns the caller's per-action prices from the active price book (plan
+// overrides and discounts applied) next to the base prices.
 func (h *Handler) getBillingConfig(w http.ResponseWriter, r *http.Request) {
-    type cfgOut struct{
-        Pricing map[string]int `json:"pricing"`
-        Limits  map[string]int `json:"limits,omitempty"`
-        UpdatedAt string      `json:"updatedAt"`
-        Source   string      `json:"source"`
-    }
-    // Default pricing
-    out := cfgOut{
-        Pricing: map[string]int{ "siterank.analyze": 1, "batchopen.task": 1, "adscenter.preflight": 1 },
-        Limits:  map[string]int{ "daily.maxTasks": 1000 },
-        UpdatedAt: time.Now().UTC().Format(time.RFC3339),
-        Source: "default",
-    }
-    // Try Secret Manager JSON (cache TTL 5m)
-    // Priority 1: explicit env mapping BILLING_PRICING_SECRET (full resource or shorthand)
-    if js := strings.TrimSpace(os.Getenv("BILLING_PRICING_SECRET")); js != "" {
-        if val, err := cfgpkg.SecretCached(r.Context(), js, 5*time.Minute); err == nil && strings.TrimSpace(val) != "" {
-            if m := parsePricingJSON(val); m != nil { out.Pricing = m; out.Source = "secret" }
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    book, err := h.Pricing.Active(r.Context())
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "price book unavailable", map[string]string{"error": err.Error()}); return }
+    plan := h.planFor(r.Context(), uid)
+    respondWithJSON(w, http.StatusOK, map[string]any{
+        "pricing": book.UnitPrices(plan), "basePricing": book.Prices, "planId": plan,
+        "priceVersion": book.Version, "effectiveAt": book.EffectiveAt,
+        "limits": map[string]int{"daily.maxTasks": 1000},
+        "updatedAt": time.Now().UTC().Format(time.RFC3339), "source": "pricebook",
+    })
+}
+
+// quotePrice prices action/quantity (or items) for the caller without reserving anything.
+func (h *Handler) quotePrice(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var req pricedReq
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    items := req.items()
+    if len(items) == 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "action or items required", nil); return }
+    q, err := h.quote(r.Context(), uid, "", "", items, 0)
+    if err != nil { writeHoldError(w, r, err, nil, 0); return }
+    respondWithJSON(w, http.StatusOK, q)
+}
+
+// priceBooksInternal lists the stored price book versions (GET) or publishes a new one (POST,
+// body: a price book; effectiveAt defaults to now). Versions are immutable.
+// Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) priceBooksInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    if r.Method == http.MethodGet {
+        list, err := h.Pricing.List(r.Context())
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+        active, err := h.Pricing.Active(r.Context())
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+        respondWithJSON(w, http.StatusOK, map[string]any{"items": list, "active": active})
+        return
+    }
+    var book domain.PriceBook
+    if err := json.NewDecoder(r.Body).Decode(&book); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid price book", nil); return }
+    if err := h.Pricing.Publish(r.Context(), &book); err != nil {
+        if stderrors.Is(err, pricing.ErrVersionExists) { errors.Write(w, r, http.StatusConflict, "CONFLICT", err.Error(), nil); return }
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return
+    }
+    log.Printf("billing: published price book %s effective %s", book.Version, book.EffectiveAt.Format(time.RFC3339))
+    respondWithJSON(w, http.StatusCreated, book)
+}
+
+// seedPriceBooks stores the built-in price book and, when configured, the one from
+// BILLING_PRICING_SECRET, the stack's billing-pricing secret or BILLING_PRICING_JSON. Versions
+// already stored are left alone.
+func seedPriceBooks(ctx context.Context, store *pricing.Store) {
+    books := []*domain.PriceBook{domain.DefaultPriceBook()}
+    val := ""
+    if name := strings.TrimSpace(os.Getenv("BILLING_PRICING_SECRET")); name != "" {
+        if v, err := cfgpkg.SecretCached(ctx, name, 5*time.Minute); err == nil { val = v }
+    }
+    if strings.TrimSpace(val) == "" {
+        if v, err := cfgpkg.SecretForStack(ctx, "billing-pricing"); err == nil { val = v }
+    }
+    if strings.TrimSpace(val) == "" { val = os.Getenv("BILLING_PRICING_JSON") }
+    if strings.TrimSpace(val) != "" {
+        if b, err := parsePriceBook(val); err == nil { books = append(books, b) } else { log.Printf("billing: ignoring configured price book: %v", err) }
+    }
+    for _, b := range books {
+        if ok, err := store.Seed(ctx, b); err != nil {
+            log.Printf("billing: seed price book %s: %v", b.Version, err)
+        } else if ok {
+            log.Printf("billing: seeded price book %s", b.Version)
         }
     }
-    // Priority 2: secret inferred by STACK, e.g., billing-pricing-preview → fallback billing-pricing
-    if out.Source == "default" {
-        if val, err := cfgpkg.SecretForStack(r.Context(), "billing-pricing"); err == nil && strings.TrimSpace(val) != "" {
-            if m := parsePricingJSON(val); m != nil { out.Pricing = m; out.Source = "secret(stack)" }
+}
+
+// runStatementCloser generates the statements of the month that just ended. It checks every
+// BILLING_STATEMENT_SWEEP_MS (default 1h) and closes the month in batches; closing is idempotent
+// per user and month, so several instances may run it.
+func runStatementCloser(ctx context.Context, store *statements.Store) {
+    interval := time.Hour
+    if v := strings.TrimSpace(os.Getenv("BILLING_STATEMENT_SWEEP_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1000 && n <= 86400000 { interval = time.Duration(n) * time.Millisecond }
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        now := time.Now()
+        month := statements.LastClosed(now)
+        for {
+            done, err := store.Close(ctx, month, now, 200)
+            if len(done) > 0 { log.Printf("billing: issued %d usage statements for %s", len(done), month.Format("2006-01")) }
+            if err != nil { log.Printf("billing: statement close: %v", err) }
+            if err != nil || len(done) < 200 { break }
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
         }
     }
-    // Fallback to env JSON
-    if out.Source == "default" {
-        if val := strings.TrimSpace(os.Getenv("BILLING_PRICING_JSON")); val != "" {
-            if m := parsePricingJSON(val); m != nil { out.Pricing = m; out.Source = "env" }
+}
+
+
+// listStatements returns the caller's usage statements, newest first. Query: limit (default 24, max 120)
+func (h *Handler) listStatements(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    h.serveStatementList(w, r, uid)
+}
+
+// getStatement downloads one of the caller's statements by sequence number.
+// Query: format=json|csv|pdf (default json); a ".csv" or ".pdf" suffix on the sequence works too.
+func (h *Handler) getStatement(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    h.serveStatement(w, r, uid)
+}
+
+// serveStatementList and serveStatement answer for the statements of walletID, a user or an
+// organization wallet the caller may read.
+func (h *Handler) serveStatementList(w http.ResponseWriter, r *http.Request, walletID string) {
+    limit := 24
+    if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 120 { limit = v }
+    items, err := h.Statements.List(r.Context(), walletID, limit)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if items == nil { items = []*statements.Statement{} }
+    respondWithJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+func (h *Handler) serveStatement(w http.ResponseWriter, r *http.Request, walletID string) {
+    raw := chi.URLParam(r, "seq")
+    format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+    if i := strings.LastIndex(raw, "."); i > 0 && format == "" { raw, format = raw[:i], strings.ToLower(raw[i+1:]) }
+    if format == "" { format = statements.FormatJSON }
+    if format != statements.FormatJSON && format != statements.FormatCSV && format != statements.FormatPDF {
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "format must be one of json|csv|pdf", nil); return
+    }
+    seq, err := strconv.ParseInt(raw, 10, 64)
+    if err != nil || seq <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid statement sequence", nil); return }
+    st, err := h.Statements.Get(r.Context(), walletID, seq)
+    if stderrors.Is(err, statements.ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "statement not found", nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    w.Header().Set("Content-Type", statements.ContentType(format))
+    if format != statements.FormatJSON { w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", st.Filename(format))) }
+    if err := statements.Render(w, st, format); err != nil { log.Printf("billing: render statement %s: %v", st.ID, err) }
+}
+
+// closeStatementsInternal generates the statements of a past month now.
+// Query: period=YYYY-MM (default: the last closed month), userId (optional, one user only).
+// Secured via X-Service-Token header == INTERNAL_SERVICE_TOKEN env.
+func (h *Handler) closeStatementsInternal(w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) {
+        errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return
+    }
+    now := time.Now()
+    month := statements.LastClosed(now)
+    if v := strings.TrimSpace(r.URL.Query().Get("period")); v != "" {
+        t, err := time.Parse("2006-01", v)
+        if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "period must be YYYY-MM", nil); return }
+        month = t
+    }
+    var (
+        issued []*statements.Statement
+        err error
+    )
+    if uid := strings.TrimSpace(r.URL.Query().Get("userId")); uid != "" {
+        st, created, gerr := h.Statements.Generate(r.Context(), uid, month, now)
+        if created { issued = append(issued, st) }
+        err = gerr
+    } else {
+        for {
+            done, cerr := h.Statements.Close(r.Context(), month, now, 200)
+            issued, err = append(issued, done...), cerr
+            if cerr != nil || len(done) < 200 { break }
         }
     }
-    respondWithJSON(w, http.StatusOK, out)
+    if stderrors.Is(err, statements.ErrPeriodOpen) { errors.Write(w, r, http.StatusConflict, "INVALID_STATE", err.Error(), nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "statement close failed", map[string]any{"error": err.Error(), "issued": len(issued)}); return }
+    if issued == nil { issued = []*statements.Statement{} }
+    respondWithJSON(w, http.StatusOK, map[string]any{"period": month.Format("2006-01"), "issued": issued})
 }
 
 // getTokenTransactionByID returns a transaction that belongs to the current user.
@@ -374,10 +968,10 @@ func (h *Handler) getTokenTransactionByID(w http.ResponseWriter, r *http.Request
     id := chi.URLParam(r, "id")
     if strings.TrimSpace(id) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id required", nil); return }
     var (
-        tType string; amount int; before, after int64; source, desc string; created time.Time; metadataJSON *string
+        tType string; amount int; before, after int64; source, desc string; created time.Time; metadataJSON *string; priceVersion string
     )
-    err := h.DB.QueryRow(r.Context(), `SELECT type, amount, "balanceBefore", "balanceAfter", source, description, "createdAt", metadata::text FROM "TokenTransaction" WHERE id=$1 AND "userId"=$2`, id, uid).
-        Scan(&tType, &amount, &before, &after, &source, &desc, &created, &metadataJSON)
+    err := h.DB.QueryRow(r.Context(), `SELECT type, amount, "balanceBefore", "balanceAfter", source, description, "createdAt", metadata::text, COALESCE("priceVersion", '') FROM "TokenTransaction" WHERE id=$1 AND "userId"=$2`, id, uid).
+        Scan(&tType, &amount, &before, &after, &source, &desc, &created, &metadataJSON, &priceVersion)
     if err != nil {
         if err == pgx.ErrNoRows { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "transaction not found", nil); return }
         errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return
@@ -385,15 +979,23 @@ func (h *Handler) getTokenTransactionByID(w http.ResponseWriter, r *http.Request
     var metadata map[string]any
     if metadataJSON != nil && *metadataJSON != "" { _ = json.Unmarshal([]byte(*metadataJSON), &metadata) }
     respondWithJSON(w, http.StatusOK, map[string]any{
-        "id": id, "type": tType, "amount": amount, "balanceBefore": before, "balanceAfter": after, "source": source, "description": desc, "createdAt": created, "metadata": metadata,
+        "id": id, "type": tType, "amount": amount, "balanceBefore": before, "balanceAfter": after, "source": source, "description": desc, "createdAt": created, "metadata": metadata, "priceVersion": priceVersion,
     })
 }
 
 // helpers
 func mustJSON(v any) string { b, _ := json.Marshal(v); return string(b) }
-// removed legacy getSecret helper; using pkg/config.SecretCached instead
-func parsePricingJSON(val string) map[string]int {
-    var m map[string]int
-    if err := json.Unmarshal([]byte(val), &m); err != nil { return nil }
-    return m
+
+// parsePriceBook reads a price book, or a flat {"action": tokens} map as the base prices of a
+// version named after its content.
+func parsePriceBook(val string) (*domain.PriceBook, error) {
+    var b domain.PriceBook
+    if err := json.Unmarshal([]byte(val), &b); err == nil && len(b.Prices) > 0 {
+        return &b, b.Validate()
+    }
+    var m map[string]int64
+    if err := json.Unmarshal([]byte(val), &m); err != nil { return nil, err }
+    sum := sha256.Sum256([]byte(mustJSON(m)))
+    b = domain.PriceBook{Version: "config-" + hex.EncodeToString(sum[:4]), Prices: m}
+    return &b, b.Validate()
 }
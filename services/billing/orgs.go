@@ -0,0 +1,168 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+    stderrors "errors"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/billing/internal/domain"
+    "github.com/xxrenzhe/autoads/services/billing/internal/orgs"
+    "github.com/xxrenzhe/autoads/services/billing/internal/statements"
+)
+
+// payer returns who pays for the request: the organization named by the X-Org-Id header when
+// present, the caller's own wallet otherwise. Membership and caps are checked by the tokens store.
+func payer(r *http.Request) domain.Payer {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    return domain.Payer{UserID: uid, OrgID: middleware.OrgIDFrom(r.Context())}
+}
+
+func writeOrgError(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case stderrors.Is(err, domain.ErrOrgNotFound), stderrors.Is(err, domain.ErrNotMember):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "organization not found", nil)
+    case stderrors.Is(err, orgs.ErrInvalid):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil)
+    case stderrors.Is(err, domain.ErrForbidden):
+        errors.Write(w, r, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+    case stderrors.Is(err, domain.ErrInsufficientTokens):
+        errors.Write(w, r, http.StatusConflict, "INSUFFICIENT_TOKENS", "insufficient token balance", nil)
+    default:
+        log.Printf("billing: organization request failed: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "organization request failed", nil)
+    }
+}
+
+// orgMember resolves the caller's membership in the {orgId} of the route; it writes 404 for
+// non-members.
+func (h *Handler) orgMember(w http.ResponseWriter, r *http.Request) (domain.Member, bool) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return domain.Member{}, false }
+    m, err := h.Orgs.Member(r.Context(), chi.URLParam(r, "orgId"), uid)
+    if err != nil { writeOrgError(w, r, err); return m, false }
+    return m, true
+}
+
+// createOrg creates an organization owned by the caller. Body: {"name": "..."}
+func (h *Handler) createOrg(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var req struct{ Name string `json:"name"` }
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    if strings.TrimSpace(req.Name) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "name required", nil); return }
+    o, err := h.Orgs.Create(r.Context(), uid, req.Name)
+    if err != nil { writeOrgError(w, r, err); return }
+    respondWithJSON(w, http.StatusCreated, o)
+}
+
+// listOrgs returns the organizations the caller belongs to with their role and the shared balance.
+func (h *Handler) listOrgs(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    list, members, err := h.Orgs.ForUser(r.Context(), uid)
+    if err != nil { writeOrgError(w, r, err); return }
+    items := make([]map[string]any, 0, len(list))
+    for i, o := range list {
+        wal, err := h.Tokens.Wallet(r.Context(), domain.OrgWalletID(o.ID))
+        if err != nil { writeOrgError(w, r, err); return }
+        items = append(items, map[string]any{"id": o.ID, "name": o.Name, "ownerId": o.OwnerID, "createdAt": o.CreatedAt, "role": members[i].Role, "dailyCap": members[i].DailyCap, "monthlyCap": members[i].MonthlyCap, "balance": wal.Balance, "held": wal.Held, "available": wal.Available()})
+    }
+    respondWithJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+// getOrg returns an organization with its wallet, members and the caller's spend today and this month.
+func (h *Handler) getOrg(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    o, err := h.Orgs.Get(r.Context(), me.OrgID)
+    if err != nil { writeOrgError(w, r, err); return }
+    wal, err := h.Tokens.Wallet(r.Context(), domain.OrgWalletID(o.ID))
+    if err != nil { writeOrgError(w, r, err); return }
+    members, err := h.Orgs.Members(r.Context(), o.ID)
+    if err != nil { writeOrgError(w, r, err); return }
+    spend, err := h.Tokens.MemberSpend(r.Context(), o.ID, me.UserID)
+    if err != nil { writeOrgError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{
+        "organization": o, "role": me.Role, "members": members, "mySpend": spend,
+        "wallet": map[string]any{"balance": wal.Balance, "held": wal.Held, "available": wal.Available()},
+    })
+}
+
+// putOrgMember adds a member or changes their role and caps (owner/admin).
+// Body: {"role": "admin|member", "dailyCap": 0, "monthlyCap": 0} (0 = no cap)
+func (h *Handler) putOrgMember(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    var req struct{ Role string `json:"role"`; DailyCap int64 `json:"dailyCap"`; MonthlyCap int64 `json:"monthlyCap"` }
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    if req.Role == "" { req.Role = domain.RoleMember }
+    userID := strings.TrimSpace(chi.URLParam(r, "userId"))
+    if userID == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "userId required", nil); return }
+    m, err := h.Orgs.SetMember(r.Context(), me, domain.Member{UserID: userID, Role: strings.ToLower(strings.TrimSpace(req.Role)), DailyCap: req.DailyCap, MonthlyCap: req.MonthlyCap})
+    if err != nil { writeOrgError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, m)
+}
+
+// deleteOrgMember removes a member (owner/admin, or the member themselves).
+func (h *Handler) deleteOrgMember(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    if err := h.Orgs.RemoveMember(r.Context(), me, chi.URLParam(r, "userId")); err != nil { writeOrgError(w, r, err); return }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// transferToOrg moves tokens from the caller's own wallet into the organization wallet.
+// Body: {"amount": n}; X-Idempotency-Key makes retries safe.
+func (h *Handler) transferToOrg(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    var req struct{ Amount int64 `json:"amount"` }
+    _ = json.NewDecoder(r.Body).Decode(&req)
+    if req.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "amount must be positive", nil); return }
+    ref := ""
+    if idem := strings.TrimSpace(r.Header.Get("X-Idempotency-Key")); idem != "" { ref = "transfer:" + me.UserID + ":" + idem }
+    res, err := h.Tokens.Transfer(r.Context(), me.UserID, me.OrgID, req.Amount, ref)
+    if err != nil { writeOrgError(w, r, err); return }
+    respondWithJSON(w, http.StatusOK, map[string]any{"txId": res.TxID, "replayed": res.Replayed, "wallet": map[string]any{"balance": res.Wallet.Balance, "held": res.Wallet.Held, "available": res.Wallet.Available()}})
+}
+
+// orgUsage returns per-member consumption of the organization wallet for a month. Owners and
+// admins see every member, members only themselves. Query: period=YYYY-MM (default: this month)
+func (h *Handler) orgUsage(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    start, end := statements.Period(time.Now())
+    if v := strings.TrimSpace(r.URL.Query().Get("period")); v != "" {
+        t, err := time.Parse("2006-01", v)
+        if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "period must be YYYY-MM", nil); return }
+        start, end = statements.Period(t)
+    }
+    only := ""
+    if !me.CanManage() { only = me.UserID }
+    items, err := h.Orgs.Usage(r.Context(), me.OrgID, only, start, end)
+    if err != nil { writeOrgError(w, r, err); return }
+    if items == nil { items = []orgs.MemberUsage{} }
+    respondWithJSON(w, http.StatusOK, map[string]any{"orgId": me.OrgID, "period": start.Format("2006-01"), "periodStart": start, "periodEnd": end, "items": items})
+}
+
+// listOrgStatements and getOrgStatement serve the organization wallet's monthly statements to
+// owners and admins.
+func (h *Handler) listOrgStatements(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    if !me.CanManage() { writeOrgError(w, r, domain.ErrForbidden); return }
+    h.serveStatementList(w, r, domain.OrgWalletID(me.OrgID))
+}
+
+func (h *Handler) getOrgStatement(w http.ResponseWriter, r *http.Request) {
+    me, ok := h.orgMember(w, r)
+    if !ok { return }
+    if !me.CanManage() { writeOrgError(w, r, domain.ErrForbidden); return }
+    h.serveStatement(w, r, domain.OrgWalletID(me.OrgID))
+}
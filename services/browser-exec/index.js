@@ -132,6 +132,15 @@ app.get('/api/v1/browser/capacity', (req, res) => {
   } catch (e) { return res.status(500).json({ error: { code: 'CAPACITY_FAILED', message: String(e?.message || e) } }) }
 })
 
+// proxyProviderFor picks the proxy provider of a request: the explicit provider, else the country's
+// PROXY_URL_<CC>, else PROXY_URL_US when no country was asked for. A country without its own
+// provider gets none, so the request goes direct (via: 'direct') instead of from US IPs.
+function proxyProviderFor(explicit, country) {
+  const cc = String(country || '').trim().toUpperCase()
+  const fallback = cc ? process.env[`PROXY_URL_${cc}`] : process.env.PROXY_URL_US
+  return String(explicit || fallback || '').trim()
+}
+
 // Resolve an affiliate Offer URL to final landing page; return final URL, suffix, domain, brand
 app.post('/api/v1/browser/resolve-offer', withSlot(async (req, res) => {
   if (!USE_PW) return res.status(400).json({ error: { code: 'PLAYWRIGHT_DISABLED', message: 'playwright disabled' } })
@@ -142,7 +151,8 @@ app.post('/api/v1/browser/resolve-offer', withSlot(async (req, res) => {
     stabilizeMs = 1200,            // URL稳定判定窗口
     headers = {},
     userAgent,
-    proxyProviderURL
+    proxyProviderURL,
+    country                        // optional ISO country hint → PROXY_URL_<CC> (no US fallback)
   } = req.body || {}
   if (!url) return res.status(400).json({ error: { code: 'INVALID_ARGUMENT', message: 'url required' } })
   resolveCounter.inc()
@@ -176,7 +186,7 @@ app.post('/api/v1/browser/resolve-offer', withSlot(async (req, res) => {
 
   let proxyOpt = undefined
   try {
-    const provider = String(proxyProviderURL || process.env.PROXY_URL_US || '').trim()
+    const provider = proxyProviderFor(proxyProviderURL, country)
     if (provider) {
       proxyOpt = await pickWorkingProxy(provider, 5)
     }
@@ -234,6 +244,7 @@ app.post('/api/v1/browser/resolve-offer', withSlot(async (req, res) => {
       domain,
       brand,
       via: proxyOpt ? 'proxy' : 'direct',
+      country: String(country || '').trim().toUpperCase() || undefined,
       chainLength: chain.length,
       chain,
       timings: { navMs: Date.now() - t0, stabilizeMs: stabilizeMsSpent }
@@ -355,7 +366,8 @@ app.post('/api/v1/browser/json-fetch', withSlot(async (req, res) => {
     timeoutMs = 20000,              // clamp 1s..30s
     proxyProviderURL,
     retries = 1,
-    backoffMs = 200
+    backoffMs = 200,
+    country                         // optional ISO country hint → PROXY_URL_<CC> (no US fallback)
   } = req.body || {}
   if (!url) return res.status(400).json({ error: { code: 'INVALID_ARGUMENT', message: 'url required' } })
   const wUntil = ['domcontentloaded','load','networkidle'].includes(String(waitUntil)) ? String(waitUntil) : 'domcontentloaded'
@@ -389,7 +401,7 @@ app.post('/api/v1/browser/json-fetch', withSlot(async (req, res) => {
   const attempt = async () => {
     let proxyOpt = undefined
     try {
-      const provider = String(proxyProviderURL || process.env.PROXY_URL_US || '').trim()
+      const provider = proxyProviderFor(proxyProviderURL, country)
       if (provider) {
         // probe a few proxies; fallback to random if probe fails
         proxyOpt = await pickWorkingProxy(provider, 5)
@@ -441,8 +453,9 @@ app.post('/api/v1/browser/json-fetch', withSlot(async (req, res) => {
 }))
 
 // Page signals: title and og:site_name (best-effort)
+// Optional: links=true adds outboundDomains (external anchor hosts) and mentions (domain-like tokens in body text)
 app.post('/api/v1/browser/page-signals', withSlot(async (req, res) => {
-  const { url, timeoutMs = 8000 } = req.body || {}
+  const { url, timeoutMs = 8000, links = false, content = false } = req.body || {}
   if (!url) return res.status(400).json({ error: { code: 'INVALID_ARGUMENT', message: 'url required' } })
   const timeout = Math.min(15000, Math.max(1000, timeoutMs))
   try {
@@ -456,6 +469,28 @@ app.post('/api/v1/browser/page-signals', withSlot(async (req, res) => {
           title: document?.title || '',
           siteName: (document.querySelector('meta[property="og:site_name"]')?.getAttribute('content')) || ''
         }))
+        if (links) {
+          const extra = await page.evaluate(() => {
+            const self = location.hostname.replace(/^www\./, '')
+            const hosts = new Set()
+            for (const a of Array.from(document.querySelectorAll('a[href]')).slice(0, 2000)) {
+              try {
+                const h = new URL(a.href, location.href).hostname.replace(/^www\./, '')
+                if (h && h !== self && !h.endsWith('.' + self)) hosts.add(h)
+              } catch {}
+            }
+            const text = (document.body && document.body.innerText || '').slice(0, 200000)
+            const found = text.match(/\b[a-z0-9][a-z0-9-]{1,62}\.(?:com|net|org|io|co|shop|store|us|uk|de|fr)\b/gi) || []
+            const mentions = Array.from(new Set(found.map(m => m.toLowerCase()).filter(m => m !== self)))
+            return { outboundDomains: Array.from(hosts).slice(0, 200), mentions: mentions.slice(0, 100) }
+          })
+          Object.assign(info, extra)
+        }
+        if (content) {
+          // headings, meta description/keywords and schema.org Product JSON-LD
+          const html = await page.content()
+          Object.assign(info, extractPageContent(html))
+        }
         return res.json({ status, ...info })
       } finally { try { await page.close() } catch {}; await pool.release(h) }
     }
@@ -476,7 +511,20 @@ app.post('/api/v1/browser/page-signals', withSlot(async (req, res) => {
       const m = seg.match(/content=["']([^"']+)["']/i)
       if (m && m[1]) siteName = m[1]
     }
-    return res.json({ status, title, siteName })
+    const out = { status, title, siteName }
+    if (links) {
+      const self = new URL(r.url || url).hostname.replace(/^www\./, '')
+      const hosts = new Set()
+      for (const m of html.matchAll(/href=["'](https?:\/\/[^"'#?\/]+)/gi)) {
+        try { const h = new URL(m[1]).hostname.replace(/^www\./, ''); if (h && h !== self && !h.endsWith('.' + self)) hosts.add(h) } catch {}
+      }
+      const text = html.replace(/<[^>]+>/g, ' ')
+      const found = text.match(/\b[a-z0-9][a-z0-9-]{1,62}\.(?:com|net|org|io|co|shop|store|us|uk|de|fr)\b/gi) || []
+      out.outboundDomains = Array.from(hosts).slice(0, 200)
+      out.mentions = Array.from(new Set(found.map(m => m.toLowerCase()).filter(m => m !== self))).slice(0, 100)
+    }
+    if (content) Object.assign(out, extractPageContent(html))
+    return res.json(out)
   } catch (e) {
     return res.status(502).json({ error: { code: 'PAGE_SIGNALS_FAILED', message: String(e?.message || e) } })
   }
@@ -513,6 +561,45 @@ const port = process.env.PORT || 8080
 app.listen(port, () => console.log(`[browser-exec] listening on :${port}`))
 
 // ---- helpers ----
+// extractPageContent pulls keyword-bearing content from raw HTML: h1-h3 headings, meta description/keywords
+// and schema.org Product entries from JSON-LD blocks.
+function extractPageContent(html) {
+  const strip = (s) => String(s || '').replace(/<[^>]+>/g, ' ').replace(/&amp;/g, '&').replace(/&nbsp;/g, ' ').replace(/&#39;|&apos;/g, "'").replace(/&quot;/g, '"').replace(/\s+/g, ' ').trim()
+  const headings = []
+  for (const m of html.matchAll(/<h([1-3])[^>]*>([\s\S]*?)<\/h\1>/gi)) {
+    const text = strip(m[2])
+    if (text && text.length <= 200) headings.push({ level: Number(m[1]), text })
+    if (headings.length >= 50) break
+  }
+  const meta = (name) => {
+    const re = new RegExp(`<meta[^>]+(?:name|property)=["']${name}["'][^>]*>`, 'i')
+    const tag = html.match(re)
+    if (!tag) return ''
+    const c = tag[0].match(/content=["']([^"']*)["']/i)
+    return c ? strip(c[1]) : ''
+  }
+  const metaDescription = meta('description') || meta('og:description')
+  const metaKeywords = meta('keywords').split(',').map(s => s.trim()).filter(Boolean).slice(0, 50)
+  const products = []
+  const visit = (node) => {
+    if (!node || typeof node !== 'object' || products.length >= 20) return
+    if (Array.isArray(node)) { node.forEach(visit); return }
+    const type = [].concat(node['@type'] || [])
+    if (type.some(t => String(t).toLowerCase() === 'product')) {
+      const brand = typeof node.brand === 'string' ? node.brand : (node.brand && node.brand.name) || ''
+      const category = Array.isArray(node.category) ? node.category.join(' > ') : (node.category || '')
+      if (node.name) products.push({ name: strip(node.name), brand: strip(brand), category: strip(category) })
+    }
+    if (node['@graph']) visit(node['@graph'])
+    if (node.itemListElement) visit(node.itemListElement)
+    if (node.item) visit(node.item)
+  }
+  for (const m of html.matchAll(/<script[^>]+type=["']application\/ld\+json["'][^>]*>([\s\S]*?)<\/script>/gi)) {
+    try { visit(JSON.parse(m[1].trim())) } catch {}
+  }
+  return { headings, metaDescription, metaKeywords, products }
+}
+
 async function simulateClick(url, opts = {}) {
   if (!USE_PW) return { ok: false, status: 0, error: 'playwright disabled' }
   const t0 = Date.now()
@@ -13,6 +13,7 @@ require (
 	github.com/xxrenzhe/autoads/pkg/logger v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/idempotency v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/httpclient v0.0.0-00010101000000-000000000000
+	github.com/xxrenzhe/autoads/pkg/notifyrules v0.0.0-00010101000000-000000000000
 )
 
 require (
@@ -58,3 +59,4 @@ replace github.com/xxrenzhe/autoads/pkg/auth => ../../pkg/auth
 replace github.com/xxrenzhe/autoads/pkg/logger => ../../pkg/logger
 replace github.com/xxrenzhe/autoads/pkg/idempotency => ../../pkg/idempotency
 replace github.com/xxrenzhe/autoads/pkg/httpclient => ../../pkg/httpclient
+replace github.com/xxrenzhe/autoads/pkg/notifyrules => ../../pkg/notifyrules
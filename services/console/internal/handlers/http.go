@@ -13,11 +13,17 @@ import (
     "sort"
     "fmt"
     "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    stderrors "errors"
 
     "github.com/jackc/pgx/v5/pgxpool"
+    "github.com/jackc/pgx/v5/stdlib"
     "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/idempotency"
     "github.com/xxrenzhe/autoads/pkg/auth"
     "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/pkg/notifyrules"
     secretmanager "cloud.google.com/go/secretmanager/apiv1"
     "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
     httpx "github.com/xxrenzhe/autoads/pkg/http"
@@ -35,6 +41,9 @@ type User struct {
 type Handler struct {
 	DB *pgxpool.Pool
 	// publisher events.Publisher
+
+	rulesOnce sync.Once
+	rules     *notifyrules.Store
 }
 
 func NewHandler(db *pgxpool.Pool) *Handler {
@@ -62,6 +71,9 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
     // Users tree: /api/v1/console/users/{id}[/(tokens|subscription|role)]
     mux.Handle("/api/v1/console/users/", middleware.AuthMiddleware(middleware.AdminOnly(http.HandlerFunc(h.usersTree))))
     // Token stats (aggregate)
+    // Organizations (shared token wallets) and per-member consumption
+    mux.Handle("/api/v1/console/orgs", middleware.AuthMiddleware(middleware.AdminOnly(http.HandlerFunc(h.getOrgs))))
+    mux.Handle("/api/v1/console/orgs/", middleware.AuthMiddleware(middleware.AdminOnly(http.HandlerFunc(h.orgsTree))))
     mux.Handle("/api/v1/console/tokens/stats", middleware.AuthMiddleware(middleware.AdminOnly(http.HandlerFunc(h.getTokenStats))))
     // Admin dashboard stats
     mux.Handle("/api/v1/console/stats", middleware.AuthMiddleware(middleware.AdminOnly(http.HandlerFunc(h.getAdminStats))))
@@ -364,16 +376,10 @@ func (h *Handler) usersTree(w http.ResponseWriter, r *http.Request) {
         }
     case http.MethodPost:
         if sub == "tokens" {
-            var body struct{ Amount int `json:"amount"` }
+            var body adminGrant
             if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
-            if body.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "amount must be >0", nil); return }
-            tx, err := h.DB.Begin(r.Context())
-            if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "begin tx failed", nil); return }
-            defer tx.Rollback(r.Context())
-            _, _ = tx.Exec(r.Context(), `INSERT INTO "UserToken"("userId", balance, "updatedAt") VALUES ($1, 0, NOW()) ON CONFLICT ("userId") DO NOTHING`, uid)
-            if _, err := tx.Exec(r.Context(), `UPDATE "UserToken" SET balance = balance + $1, "updatedAt"=NOW() WHERE "userId"=$2`, body.Amount, uid); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "update failed", map[string]string{"error": err.Error()}); return }
-            if err := tx.Commit(r.Context()); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "commit failed", map[string]string{"error": err.Error()}); return }
-            _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "userId": uid, "amount": body.Amount})
+            if err := body.validate(time.Now()); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return }
+            h.writeGrant(w, r, uid, body)
             return
         }
         errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "unsupported action", nil)
@@ -385,7 +391,7 @@ func (h *Handler) usersTree(w http.ResponseWriter, r *http.Request) {
 
 // userActions handles sub-paths under /api/v1/console/users/{id}/...
 // Supported:
-//  - POST /api/v1/console/users/{id}/tokens  body: { amount: number }
+//  - POST /api/v1/console/users/{id}/tokens  body: { amount: number, expiresAt?: RFC3339, ttlDays?: number, reason?: string }
 func (h *Handler) userActions(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
     // crude path parse
@@ -405,21 +411,72 @@ func (h *Handler) userActions(w http.ResponseWriter, r *http.Request) {
     if userID == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "user id required", nil); return }
     if rest != "tokens" { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "unsupported action", nil); return }
     // parse body
-    var body struct{ Amount int `json:"amount"` }
+    var body adminGrant
     if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
-    if body.Amount <= 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "amount must be >0", nil); return }
-    // upsert tokens
-    tx, err := h.DB.Begin(r.Context())
-    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "begin tx failed", nil); return }
-    defer tx.Rollback(r.Context())
-    // ensure row
-    _, _ = tx.Exec(r.Context(), `INSERT INTO "UserToken"("userId", balance, "updatedAt") VALUES ($1, 0, NOW()) ON CONFLICT ("userId") DO NOTHING`, userID)
-    // increment
-    if _, err := tx.Exec(r.Context(), `UPDATE "UserToken" SET balance = balance + $1, "updatedAt"=NOW() WHERE "userId"=$2`, body.Amount, userID); err != nil {
-        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "update failed", map[string]string{"error": err.Error()}); return
-    }
-    if err := tx.Commit(r.Context()); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "commit failed", map[string]string{"error": err.Error()}); return }
-    _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "userId": userID, "amount": body.Amount})
+    if err := body.validate(time.Now()); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return }
+    h.writeGrant(w, r, userID, body)
+}
+
+// adminGrant is a manual token grant. The tokens expire at ExpiresAt, or TTLDays after the grant;
+// without either they never expire.
+type adminGrant struct {
+    Amount    int        `json:"amount"`
+    ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+    TTLDays   int        `json:"ttlDays,omitempty"`
+    Reason    string     `json:"reason,omitempty"`
+    // Reference identifies the grant to billing: a retried request with the same reference (or
+    // X-Idempotency-Key) grants once.
+    Reference string     `json:"reference,omitempty"`
+}
+
+func (g *adminGrant) validate(now time.Time) error {
+    if g.Amount <= 0 { return fmt.Errorf("amount must be >0") }
+    if g.TTLDays < 0 { return fmt.Errorf("ttlDays must be >=0") }
+    if g.ExpiresAt == nil && g.TTLDays > 0 { t := now.AddDate(0, 0, g.TTLDays).UTC(); g.ExpiresAt = &t }
+    if g.ExpiresAt != nil && !g.ExpiresAt.After(now) { return fmt.Errorf("expiresAt must be in the future") }
+    g.Reason = strings.TrimSpace(g.Reason)
+    g.Reference = strings.TrimSpace(g.Reference)
+    if g.Reference != "" && !idempotency.Validate(g.Reference) { return fmt.Errorf("invalid reference") }
+    return nil
+}
+
+// writeGrant grants g to userID through billing and writes the result. The grant's reference is
+// its body reference, else the request's X-Idempotency-Key, else a fresh one.
+func (h *Handler) writeGrant(w http.ResponseWriter, r *http.Request, userID string, g adminGrant) {
+    if g.Reference == "" { g.Reference = idempotency.FromHeader(r) }
+    if g.Reference == "" { g.Reference = newGrantReference() }
+    out, err := grantTokens(r.Context(), userID, g)
+    if err != nil { errors.Write(w, r, http.StatusBadGateway, "UPSTREAM", "grant failed", map[string]string{"error": err.Error()}); return }
+    _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "userId": userID, "amount": g.Amount, "expiresAt": g.ExpiresAt, "reference": g.Reference, "txId": out.TxID, "balance": out.Balance, "replayed": out.Replayed})
+}
+
+// grantResult is billing's answer to an admin grant.
+type grantResult struct {
+    TxID     string `json:"txId"`
+    Balance  int64  `json:"balance"`
+    Replayed bool   `json:"replayed"`
+}
+
+// grantTokens asks billing to credit an admin grant (POST /api/v1/billing/internal/grants).
+// Billing posts it to the ledger as a "TokenGrant" lot with its TokenTransaction and TokensGranted
+// event; the reference makes the call safe to retry.
+func grantTokens(ctx context.Context, userID string, g adminGrant) (*grantResult, error) {
+    base := strings.TrimRight(os.Getenv("BILLING_URL"), "/")
+    if base == "" { return nil, fmt.Errorf("BILLING_URL not set") }
+    token := strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN"))
+    if token == "" { return nil, fmt.Errorf("INTERNAL_SERVICE_TOKEN not set") }
+    adminID, _ := ctx.Value(middleware.UserIDKey).(string)
+    body := map[string]any{"userId": userID, "amount": g.Amount, "expiresAt": g.ExpiresAt, "reason": g.Reason, "reference": g.Reference, "adminId": adminID}
+    var out grantResult
+    if err := httpx.New(5*time.Second).DoJSON(ctx, http.MethodPost, base+"/api/v1/billing/internal/grants", body, map[string]string{"X-Service-Token": token}, 3, &out); err != nil { return nil, err }
+    return &out, nil
+}
+
+// newGrantReference returns a random reference for a grant request that did not bring one.
+func newGrantReference() string {
+    b := make([]byte, 16)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
 }
 
 // getTokenStats returns aggregate stats for tokens across users.
@@ -433,6 +490,78 @@ func (h *Handler) getTokenStats(w http.ResponseWriter, r *http.Request) {
     _ = json.NewEncoder(w).Encode(map[string]any{"users": count, "totalTokens": sum})
 }
 
+// getOrgs lists organizations with their shared wallet and member count.
+// GET /api/v1/console/orgs?q=&limit=50&offset=0
+func (h *Handler) getOrgs(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    q := strings.TrimSpace(r.URL.Query().Get("q"))
+    limit, offset := 50, 0
+    if v := r.URL.Query().Get("limit"); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 200 { limit = n } }
+    if v := r.URL.Query().Get("offset"); v != "" { if n, err := strconv.Atoi(v); err == nil && n >= 0 { offset = n } }
+    rows, err := h.DB.Query(r.Context(), `
+        SELECT o.id, o.name, o."ownerId", o."createdAt", COALESCE(w.balance,0), COALESCE(w.held,0),
+               (SELECT COUNT(1) FROM "OrganizationMember" m WHERE m."orgId"=o.id)
+        FROM "Organization" o LEFT JOIN "OrganizationWallet" w ON w."orgId"=o.id
+        WHERE $1='' OR o.name ILIKE '%'||$1||'%' OR o.id=$1
+        ORDER BY o."createdAt" DESC LIMIT $2 OFFSET $3`, q, limit, offset)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    defer rows.Close()
+    items := []map[string]any{}
+    for rows.Next() {
+        var id, name, owner string; var created time.Time; var balance, held, members int64
+        if err := rows.Scan(&id, &name, &owner, &created, &balance, &held, &members); err != nil { continue }
+        items = append(items, map[string]any{"id": id, "name": name, "ownerId": owner, "createdAt": created, "balance": balance, "held": held, "available": balance - held, "members": members})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"items": items, "limit": limit, "offset": offset, "query": q})
+}
+
+// orgsTree serves GET /api/v1/console/orgs/{id}/usage?period=YYYY-MM: per-member consumption of
+// the organization wallet in a month (default: the current one), including former members.
+func (h *Handler) orgsTree(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    rest := strings.TrimPrefix(r.URL.Path, "/api/v1/console/orgs/")
+    orgID, sub, _ := strings.Cut(rest, "/")
+    if orgID == "" || sub != "usage" { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+    now := time.Now().UTC()
+    start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    if v := strings.TrimSpace(r.URL.Query().Get("period")); v != "" {
+        t, err := time.Parse("2006-01", v)
+        if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "period must be YYYY-MM", nil); return }
+        start = t
+    }
+    end := start.AddDate(0, 1, 0)
+    rows, err := h.DB.Query(r.Context(), `
+        WITH spend AS (
+            SELECT "userId",
+                   COALESCE(SUM(amount) FILTER (WHERE type='debited'), 0)::bigint AS spent,
+                   COALESCE(SUM(amount) FILTER (WHERE type='reserved'), 0)::bigint AS reserved,
+                   COALESCE(SUM(amount) FILTER (WHERE type='released'), 0)::bigint AS released,
+                   COUNT(1) AS txs
+            FROM "TokenTransaction"
+            WHERE "orgId"=$1 AND "fundingSource"='org' AND "createdAt" >= $2 AND "createdAt" < $3
+            GROUP BY "userId"
+        )
+        SELECT COALESCE(m."userId", s."userId"), COALESCE(u.email, ''), COALESCE(m.role, ''), COALESCE(m."dailyCap", 0), COALESCE(m."monthlyCap", 0),
+               COALESCE(s.spent, 0), COALESCE(s.reserved, 0), COALESCE(s.released, 0), COALESCE(s.txs, 0)
+        FROM (SELECT * FROM "OrganizationMember" WHERE "orgId"=$1) m
+        FULL OUTER JOIN spend s ON s."userId"=m."userId"
+        LEFT JOIN "User" u ON u.id=COALESCE(m."userId", s."userId")
+        ORDER BY 6 DESC, 1`, orgID, start, end)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    defer rows.Close()
+    items := []map[string]any{}
+    var total int64
+    for rows.Next() {
+        var uid, email, role string; var daily, monthly, spent, reserved, released, txs int64
+        if err := rows.Scan(&uid, &email, &role, &daily, &monthly, &spent, &reserved, &released, &txs); err != nil { continue }
+        total += spent
+        items = append(items, map[string]any{"userId": uid, "email": email, "role": role, "dailyCap": daily, "monthlyCap": monthly, "spent": spent, "reserved": reserved, "released": released, "transactions": txs})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"orgId": orgID, "period": start.Format("2006-01"), "totalSpent": total, "items": items})
+}
+
 // getAdminStats returns aggregated counters for admin dashboard.
 // GET /api/v1/console/stats
 func (h *Handler) getAdminStats(w http.ResponseWriter, r *http.Request) {
@@ -864,97 +993,79 @@ func (h *Handler) exportEventsCSV(w http.ResponseWriter, r *http.Request) {
 
 // --- Notification Rules (admin) ---
 
-// rulesHandler handles /api/v1/console/notifications/rules (GET list, POST create)
+// ruleStore exposes notification_rules through the model shared with the notifications service,
+// over a database/sql view of the pool.
+func (h *Handler) ruleStore() *notifyrules.Store {
+    h.rulesOnce.Do(func() { h.rules = notifyrules.New(stdlib.OpenDBFromPool(h.DB)) })
+    return h.rules
+}
+
+func writeRuleError(w http.ResponseWriter, r *http.Request, err error, action string) {
+    switch {
+    case stderrors.Is(err, notifyrules.ErrNotFound):
+        errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "rule not found", nil)
+    case stderrors.Is(err, notifyrules.ErrInvalid):
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil)
+    default:
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", action+" failed", map[string]string{"error": err.Error()})
+    }
+}
+
+// rulesHandler handles /api/v1/console/notifications/rules (GET list, POST create).
+// Rules are metric alert rules unless kind=event is given; user event subscriptions are
+// managed by the notifications service but can be listed here with kind=event.
 func (h *Handler) rulesHandler(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case http.MethodGet:
-        // filters: service, metric, scope, enabled
+        // filters: kind (default metric), service, metric, scope, userId, enabled
         q := r.URL.Query()
-        service := strings.TrimSpace(q.Get("service"))
-        metric := strings.TrimSpace(q.Get("metric"))
-        scope := strings.TrimSpace(q.Get("scope"))
-        enabled := strings.TrimSpace(q.Get("enabled"))
-        wh := []string{}
-        args := []any{}
-        if service != "" { wh = append(wh, fmt.Sprintf("service=$%d", len(args)+1)); args = append(args, service) }
-        if metric != "" { wh = append(wh, fmt.Sprintf("metric=$%d", len(args)+1)); args = append(args, metric) }
-        if scope != "" { wh = append(wh, fmt.Sprintf("scope=$%d", len(args)+1)); args = append(args, scope) }
-        if enabled != "" { wh = append(wh, fmt.Sprintf("enabled=$%d", len(args)+1)); args = append(args, enabled == "true") }
-        sql := "SELECT id,scope,COALESCE(user_id,''),service,metric,comparator,threshold,window_sec,enabled,COALESCE(params,'{}')::text,created_at,updated_at FROM notification_rules"
-        if len(wh) > 0 { sql += " WHERE "+strings.Join(wh, " AND ") }
-        sql += " ORDER BY created_at DESC LIMIT 500"
-        rows, err := h.DB.Query(r.Context(), sql, args...)
-        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
-        defer rows.Close()
-        type item struct{ ID int64 `json:"id"`; Scope, UserID, Service, Metric, Comparator string; Threshold float64; WindowSec int; Enabled bool; Params string; CreatedAt, UpdatedAt time.Time }
-        var items []item
-        for rows.Next() {
-            var it item
-            if err := rows.Scan(&it.ID, &it.Scope, &it.UserID, &it.Service, &it.Metric, &it.Comparator, &it.Threshold, &it.WindowSec, &it.Enabled, &it.Params, &it.CreatedAt, &it.UpdatedAt); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "scan failed", nil); return }
-            items = append(items, it)
-        }
+        f := notifyrules.Filter{Kind: notifyrules.KindMetric, Service: strings.TrimSpace(q.Get("service")), Metric: strings.TrimSpace(q.Get("metric")), Scope: strings.TrimSpace(q.Get("scope")), UserID: strings.TrimSpace(q.Get("userId"))}
+        if k := strings.TrimSpace(q.Get("kind")); k == "all" { f.Kind = "" } else if k != "" { f.Kind = k }
+        if v := strings.TrimSpace(q.Get("enabled")); v != "" { en := v == "true"; f.Enabled = &en }
+        items, err := h.ruleStore().List(r.Context(), f)
+        if err != nil { writeRuleError(w, r, err, "query"); return }
+        if items == nil { items = []*notifyrules.Rule{} }
         _ = json.NewEncoder(w).Encode(map[string]any{"items": items})
         return
     case http.MethodPost:
-        var body struct{ Scope, UserID, Service, Metric, Comparator string; Threshold float64; WindowSec int; Enabled *bool; Params map[string]any }
+        var body struct {
+            notifyrules.Rule
+            Enabled *bool `json:"enabled"`
+        }
         if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
-        if strings.TrimSpace(body.Service) == "" || strings.TrimSpace(body.Metric) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "service/metric required", nil); return }
-        if body.Comparator == "" { body.Comparator = "gt" }
-        if body.WindowSec <= 0 { body.WindowSec = 300 }
-        en := true; if body.Enabled != nil { en = *body.Enabled }
-        pb, _ := json.Marshal(body.Params)
-        var id int64
-        err := h.DB.QueryRow(r.Context(), `
-            INSERT INTO notification_rules(scope, user_id, service, metric, comparator, threshold, window_sec, enabled, params, created_at, updated_at)
-            VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9::jsonb,NOW(),NOW()) RETURNING id
-        `, strings.TrimSpace(body.Scope), strings.TrimSpace(body.UserID), strings.TrimSpace(body.Service), strings.TrimSpace(body.Metric), strings.TrimSpace(body.Comparator), body.Threshold, body.WindowSec, en, string(pb)).Scan(&id)
-        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "insert failed", map[string]string{"error": err.Error()}); return }
-        _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "id": id})
+        in := body.Rule
+        if in.Kind == "" { in.Kind = notifyrules.KindMetric }
+        in.ID = 0
+        in.Enabled = body.Enabled == nil || *body.Enabled
+        rule, err := h.ruleStore().Create(r.Context(), in)
+        if err != nil { writeRuleError(w, r, err, "insert"); return }
+        _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "id": rule.ID, "rule": rule})
         return
     default:
         errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return
     }
 }
 
-// rulesTree handles /api/v1/console/notifications/rules/{id} (GET, PUT, DELETE)
+// rulesTree handles /api/v1/console/notifications/rules/{id} (GET, PUT partial update, DELETE)
 func (h *Handler) rulesTree(w http.ResponseWriter, r *http.Request) {
     path := strings.TrimPrefix(r.URL.Path, "/api/v1/console/notifications/rules/")
-    id := strings.TrimSpace(path)
-    if id == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id required", nil); return }
+    id, err := strconv.ParseInt(strings.TrimSpace(path), 10, 64)
+    if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id must be integer string", nil); return }
     switch r.Method {
     case http.MethodGet:
-        var rec struct{ ID int64; Scope, UserID, Service, Metric, Comparator string; Threshold float64; WindowSec int; Enabled bool; Params string; CreatedAt, UpdatedAt time.Time }
-        err := h.DB.QueryRow(r.Context(), `SELECT id,scope,COALESCE(user_id,''),service,metric,comparator,threshold,window_sec,enabled,COALESCE(params,'{}')::text,created_at,updated_at FROM notification_rules WHERE id=$1`, id).
-            Scan(&rec.ID, &rec.Scope, &rec.UserID, &rec.Service, &rec.Metric, &rec.Comparator, &rec.Threshold, &rec.WindowSec, &rec.Enabled, &rec.Params, &rec.CreatedAt, &rec.UpdatedAt)
-        if err != nil { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "rule not found", nil); return }
-        _ = json.NewEncoder(w).Encode(rec)
+        rule, err := h.ruleStore().Get(r.Context(), id)
+        if err != nil { writeRuleError(w, r, err, "query"); return }
+        _ = json.NewEncoder(w).Encode(rule)
         return
     case http.MethodPut:
-        var body struct{ Scope, UserID, Service, Metric, Comparator string; Threshold *float64; WindowSec *int; Enabled *bool; Params map[string]any }
-        if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
-        // Build dynamic update
-        sets := []string{"updated_at=NOW()"}
-        args := []any{}
-        if strings.TrimSpace(body.Scope) != "" { sets = append(sets, fmt.Sprintf("scope=$%d", len(args)+1)); args = append(args, strings.TrimSpace(body.Scope)) }
-        if body.UserID != "" { sets = append(sets, fmt.Sprintf("user_id=$%d", len(args)+1)); args = append(args, strings.TrimSpace(body.UserID)) }
-        if strings.TrimSpace(body.Service) != "" { sets = append(sets, fmt.Sprintf("service=$%d", len(args)+1)); args = append(args, strings.TrimSpace(body.Service)) }
-        if strings.TrimSpace(body.Metric) != "" { sets = append(sets, fmt.Sprintf("metric=$%d", len(args)+1)); args = append(args, strings.TrimSpace(body.Metric)) }
-        if strings.TrimSpace(body.Comparator) != "" { sets = append(sets, fmt.Sprintf("comparator=$%d", len(args)+1)); args = append(args, strings.TrimSpace(body.Comparator)) }
-        if body.Threshold != nil { sets = append(sets, fmt.Sprintf("threshold=$%d", len(args)+1)); args = append(args, *body.Threshold) }
-        if body.WindowSec != nil { sets = append(sets, fmt.Sprintf("window_sec=$%d", len(args)+1)); args = append(args, *body.WindowSec) }
-        if body.Enabled != nil { sets = append(sets, fmt.Sprintf("enabled=$%d", len(args)+1)); args = append(args, *body.Enabled) }
-        if body.Params != nil { pb, _ := json.Marshal(body.Params); sets = append(sets, fmt.Sprintf("params=$%d::jsonb", len(args)+1)); args = append(args, string(pb)) }
-        args = append(args, id)
-        sql := fmt.Sprintf("UPDATE notification_rules SET %s WHERE id=$%d", strings.Join(sets, ","), len(args))
-        ct, err := h.DB.Exec(r.Context(), sql, args...)
-        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "update failed", map[string]string{"error": err.Error()}); return }
-        if ct.RowsAffected() == 0 { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "rule not found", nil); return }
-        _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "id": id})
+        var p notifyrules.Patch
+        if err := json.NewDecoder(r.Body).Decode(&p); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+        rule, err := h.ruleStore().Update(r.Context(), id, p)
+        if err != nil { writeRuleError(w, r, err, "update"); return }
+        _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "id": id, "rule": rule})
         return
     case http.MethodDelete:
-        ct, err := h.DB.Exec(r.Context(), `DELETE FROM notification_rules WHERE id=$1`, id)
-        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "delete failed", map[string]string{"error": err.Error()}); return }
-        if ct.RowsAffected() == 0 { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "rule not found", nil); return }
+        if err := h.ruleStore().Delete(r.Context(), id); err != nil { writeRuleError(w, r, err, "delete"); return }
         w.WriteHeader(http.StatusNoContent)
         return
     default:
@@ -989,57 +1100,45 @@ func (h *Handler) rulesEvaluate(w http.ResponseWriter, r *http.Request) {
     if snap == nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "SLO snapshot unavailable", nil); return }
     services, _ := snap["services"].(map[string]any)
     // load rules
-    rows, err := h.DB.Query(r.Context(), `SELECT id, scope, COALESCE(user_id,''), service, metric, comparator, threshold, window_sec, enabled FROM notification_rules WHERE enabled=true LIMIT 1000`)
+    enabled := true
+    rules, err := h.ruleStore().List(r.Context(), notifyrules.Filter{Kind: notifyrules.KindMetric, Enabled: &enabled, Limit: 1000})
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query rules failed", map[string]string{"error": err.Error()}); return }
-    defer rows.Close()
-    type rule struct{ id int64; scope, user, service, metric, cmp string; th float64; win int }
-    var rules []rule
-    for rows.Next() { var x rule; if err := rows.Scan(&x.id,&x.scope,&x.user,&x.service,&x.metric,&x.cmp,&x.th,&x.win, new(bool)); err==nil { rules = append(rules, x) } }
     triggered := 0
     for _, rl := range rules {
         val := 0.0
-        switch strings.ToLower(rl.metric) {
+        switch strings.ToLower(rl.Metric) {
         case "p95_latency_ms":
-            if s, ok := services[rl.service].(map[string]any); ok { if v, ok := s["p95"].(float64); ok { val = v } }
+            if s, ok := services[rl.Service].(map[string]any); ok { if v, ok := s["p95"].(float64); ok { val = v } }
         case "error_rate":
-            if s, ok := services[rl.service].(map[string]any); ok { if v, ok := s["errorRate"].(float64); ok { val = v } }
+            if s, ok := services[rl.Service].(map[string]any); ok { if v, ok := s["errorRate"].(float64); ok { val = v } }
         case "dlq_size":
-            if rl.service == "offer" { // minimal: Offer KPI DLQ
+            if rl.Service == "offer" { // minimal: Offer KPI DLQ
                 _ = h.DB.QueryRow(r.Context(), `SELECT COUNT(1) FROM "OfferKpiDeadLetter" WHERE status<>'resolved'`).Scan(&val)
             }
         default:
             continue
         }
-        if evalCmp(val, rl.cmp, rl.th) {
-            if h.emitAlertOnce(r.Context(), rl.service, rl.metric, rl.cmp, rl.th, val) { triggered++ }
+        if rl.Breached(val) {
+            if h.emitAlertOnce(r.Context(), rl, val) { triggered++ }
         }
     }
     _ = json.NewEncoder(w).Encode(map[string]any{"status":"ok","triggered": triggered})
 }
 
-func evalCmp(val float64, cmp string, th float64) bool {
-    switch strings.ToLower(strings.TrimSpace(cmp)) {
-    case "gt": return val > th
-    case "ge": return val >= th
-    case "lt": return val < th
-    case "le": return val <= th
-    case "eq": return val == th
-    case "ne": return val != th
-    default: return false
-    }
-}
-
 // emitAlertOnce writes an ALERT into user_notifications with simple suppression within last 10 minutes.
-func (h *Handler) emitAlertOnce(ctx context.Context, svc, metric, cmp string, th, value float64) bool {
+// System rules alert "admin" (console alerts aggregation); user-scoped rules alert their user.
+func (h *Handler) emitAlertOnce(ctx context.Context, rl *notifyrules.Rule, value float64) bool {
     ttl := 10 // minutes
+    to := "admin"
+    if rl.Scope == notifyrules.ScopeUser && rl.UserID != "" { to = rl.UserID }
+    svc, metric, cmp, th := rl.Service, rl.Metric, rl.Comparator, rl.Threshold
     var exists int
-    _ = h.DB.QueryRow(ctx, `SELECT COUNT(1) FROM user_notifications WHERE created_at > NOW() - ($1 || ' minutes')::interval AND type='ALERT' AND title ILIKE $2`, ttl, "%"+svc+"."+metric+"%").Scan(&exists)
+    _ = h.DB.QueryRow(ctx, `SELECT COUNT(1) FROM user_notifications WHERE user_id=$3 AND created_at > NOW() - ($1 || ' minutes')::interval AND type='ALERT' AND title ILIKE $2`, ttl, "%"+svc+"."+metric+"%", to).Scan(&exists)
     if exists > 0 { return false }
     title := fmt.Sprintf("SLO 告警：%s.%s %s %.2f，当前值 %.2f", svc, metric, cmp, th, value)
-    msg := map[string]any{"severity":"warn","category":"slo","service":svc,"metric":metric,"comparator":cmp,"threshold":th,"value":value}
+    msg := map[string]any{"severity":"warn","category":"slo","ruleId":rl.ID,"service":svc,"metric":metric,"comparator":cmp,"threshold":th,"value":value}
     b, _ := json.Marshal(msg)
-    // use 'admin' as user scope for console alerts aggregation
-    _, err := h.DB.Exec(ctx, `INSERT INTO user_notifications(user_id,type,title,message,created_at) VALUES ($1,'ALERT',$2,$3,NOW())`, "admin", title, string(b))
+    _, err := h.DB.Exec(ctx, `INSERT INTO user_notifications(user_id,type,title,message,created_at) VALUES ($1,'ALERT',$2,$3,NOW())`, to, title, string(b))
     return err == nil
 }
 
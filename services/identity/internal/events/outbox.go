@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
+	"github.com/xxrenzhe/autoads/services/identity/internal/domain"
+)
+
+// Identity events leave through the shared event_outbox (pkg/events): a handler records the event
+// with Enqueue and the relay started in main hands committed rows to a Publisher (RelayPublisher),
+// retrying until the publish succeeds.
+
+// OutboxSource names identity's rows in event_outbox.
+const OutboxSource = "identity"
+
+// Enqueue records event in the outbox through db.
+func Enqueue(ctx context.Context, db *pgxpool.Pool, event DomainEvent, subject string) error {
+	return ev.Enqueue(ctx, pgxExec{db}, OutboxSource, ev.OutboxEvent{Type: event.EventType(), Subject: subject, Data: event})
+}
+
+// pgxExec adapts a pgx pool to ev.Execer.
+type pgxExec struct{ db *pgxpool.Pool }
+
+func (x pgxExec) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	tag, err := x.db.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(tag.RowsAffected()), nil
+}
+
+// RelayPublisher lets the outbox relay publish through a Publisher: it decodes each row back into
+// its domain event, so subscribers see the same messages as before.
+type RelayPublisher struct {
+	Next Publisher
+}
+
+// Publish implements ev.OutboxPublisher.
+func (p RelayPublisher) Publish(ctx context.Context, eventType string, data any, _ ...ev.Option) error {
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		raw = b
+	}
+	var event DomainEvent
+	switch eventType {
+	case (domain.UserRegisteredEvent{}).EventType():
+		var e domain.UserRegisteredEvent
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", eventType, err)
+		}
+		event = e
+	default:
+		return fmt.Errorf("unknown event type %q", eventType)
+	}
+	return p.Next.Publish(ctx, event)
+}
@@ -19,17 +19,15 @@ import (
 
 // Handler holds the dependencies for the HTTP handlers.
 type Handler struct {
-	DB             *pgxpool.Pool
-	AuthClient     *firebaseauth.Client
-	EventPublisher events.Publisher
+	DB         *pgxpool.Pool
+	AuthClient *firebaseauth.Client
 }
 
 // NewHandler creates a new Handler with dependencies.
-func NewHandler(db *pgxpool.Pool, authClient *firebaseauth.Client, publisher events.Publisher) *Handler {
+func NewHandler(db *pgxpool.Pool, authClient *firebaseauth.Client) *Handler {
 	return &Handler{
-		DB:             db,
-		AuthClient:     authClient,
-		EventPublisher: publisher,
+		DB:         db,
+		AuthClient: authClient,
 	}
 }
 
@@ -142,7 +140,7 @@ func (h *Handler) registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// User does not exist, publish a UserRegistered event.
+	// User does not exist, record a UserRegistered event; the projector creates the user.
 	event := domain.UserRegisteredEvent{
 		UserID:       firebaseUID,
 		Email:        firebaseUser.Email,
@@ -151,9 +149,9 @@ func (h *Handler) registerUser(w http.ResponseWriter, r *http.Request) {
 		RegisteredAt: time.Now(),
 	}
 
-	err = h.EventPublisher.Publish(r.Context(), event)
+	err = events.Enqueue(r.Context(), h.DB, event, event.UserID)
 	if err != nil {
-		log.Printf("Error publishing UserRegisteredEvent: %v", err)
+		log.Printf("Error recording UserRegisteredEvent: %v", err)
 		http.Error(w, "Failed to process registration", http.StatusInternalServerError)
 		return
 	}
@@ -10,8 +10,11 @@ import (
 	"github.com/xxrenzhe/autoads/services/identity/internal/projectors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
 func main() {
@@ -71,13 +74,22 @@ func main() {
 		publisher = bus
 	}
 
+	// Events are recorded in event_outbox (pkg/events); the relay hands them to the publisher.
+	outboxDB := stdlib.OpenDBFromPool(dbpool)
+	defer outboxDB.Close()
+	if err := ev.EnsureOutbox(ctx, outboxDB); err != nil {
+		log.Fatalf("Failed to create event outbox: %v", err)
+	}
+	relay := &ev.Relay{DB: outboxDB, Pub: events.RelayPublisher{Next: &events.LoggingMiddleware{Next: publisher}}, Source: events.OutboxSource, Interval: time.Second}
+	go relay.Run(ctx)
+
 	log.Println("Starting identity service...")
 
 	// Create a new ServeMux
 	mux := http.NewServeMux()
 
 	// Initialize handlers with all dependencies and register routes
-	apiHandler := handlers.NewHandler(dbpool, authClient.Client, &events.LoggingMiddleware{Next: publisher})
+	apiHandler := handlers.NewHandler(dbpool, authClient.Client)
 	apiHandler.RegisterRoutes(mux, authClient.Middleware)
 
 	log.Printf("Identity service listening on port %s", cfg.Port)
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    stderrors "errors"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/events"
+)
+
+var (
+    deadLetters *events.DeadLetters
+    // subscriber is nil when Pub/Sub is not configured; dead letters can then be listed but not replayed.
+    subscriber *events.Subscriber
+)
+
+// deadLettersHandler: GET /api/v1/notifications/admin/dead-letters?handler=&eventType=&resolved=1&limit=100
+// Events a subscriber handler gave up on, newest first.
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    f := events.DeadLetterFilter{Handler: strings.TrimSpace(q.Get("handler")), EventType: strings.TrimSpace(q.Get("eventType")), Resolved: q.Get("resolved") == "1"}
+    if v := q.Get("limit"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil { f.Limit = n }
+    }
+    items, err := deadLetters.List(r.Context(), f)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if items == nil { items = []events.DeadLetter{} }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
+
+// replayDeadLetterHandler: POST /api/v1/notifications/admin/dead-letters/{id}/replay runs the failed
+// handler once more; the dead letter is resolved when it succeeds.
+func replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+    if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id must be integer string", nil); return }
+    if subscriber == nil { errors.Write(w, r, http.StatusServiceUnavailable, "UNAVAILABLE", "subscriber not running", nil); return }
+    d, err := subscriber.ReplayDeadLetter(r.Context(), id)
+    if stderrors.Is(err, events.ErrDeadLetterNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "replay failed", map[string]string{"error": err.Error()}); return }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"ok": d.ResolvedAt != nil, "deadLetter": d})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/mail"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    stderrors "errors"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/delivery"
+)
+
+var dispatcher *delivery.Dispatcher
+
+// startDelivery prepares the delivery queue and starts the dispatcher. Email is enabled by
+// SMTP_ADDR; webhook and chat channels are always available. NOTIFY_DELIVERY_INTERVAL_MS
+// (default 5s) and NOTIFY_DELIVERY_MAX_ATTEMPTS (default 6) tune the dispatcher.
+func startDelivery(ctx context.Context) *delivery.Dispatcher {
+    store := delivery.NewStore(db)
+    if err := store.EnsureSchema(ctx); err != nil { log.Warn().Err(err).Msg("notifications: ensure delivery DDL failed") }
+    // webhook and chat posts go to user-supplied URLs: public https addresses only
+    client := delivery.NewClient(10 * time.Second)
+    d := delivery.NewDispatcher(store, &delivery.Webhook{Client: client}, delivery.NewSlack(client), delivery.NewLark(client))
+    if s := delivery.SMTPFromEnv(); s != nil { d.Register(s) } else { log.Info().Msg("notifications: SMTP_ADDR not set; email deliveries will fail") }
+    if v := strings.TrimSpace(os.Getenv("NOTIFY_DELIVERY_MAX_ATTEMPTS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 20 { d.MaxAttempts = n }
+    }
+    interval := 5 * time.Second
+    if v := strings.TrimSpace(os.Getenv("NOTIFY_DELIVERY_INTERVAL_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 200 { interval = time.Duration(n) * time.Millisecond }
+    }
+    go d.Run(ctx, interval)
+    return d
+}
+
+// validateEndpoint checks the target of an endpoint for its kind.
+func validateEndpoint(ep *delivery.Endpoint) string {
+    ep.Kind = strings.ToLower(strings.TrimSpace(ep.Kind))
+    ep.Target = strings.TrimSpace(ep.Target)
+    switch ep.Kind {
+    case delivery.KindEmail:
+        if _, err := mail.ParseAddress(ep.Target); err != nil { return "target must be an email address" }
+    case delivery.KindWebhook, delivery.KindSlack, delivery.KindLark:
+        if err := delivery.CheckTarget(ep.Target); err != nil { return "target must be a public https URL" }
+    default:
+        return "kind must be one of email|webhook|slack|lark"
+    }
+    return ""
+}
+
+// channelsHandler: GET lists the caller's endpoints; POST creates one.
+// Body: { kind: email|webhook|slack|lark, target, name?, secret?, enabled? }
+func channelsHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    store := dispatcher.Store
+    if r.Method == http.MethodGet {
+        items, err := store.Endpoints(r.Context(), uid)
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+        if items == nil { items = []*delivery.Endpoint{} }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+        return
+    }
+    saveChannel(w, r, uid, 0)
+}
+
+// channelHandler: PUT updates an endpoint (an empty secret keeps the current one); DELETE removes it.
+func channelHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+    if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id must be integer string", nil); return }
+    if r.Method == http.MethodDelete {
+        if err := dispatcher.Store.DeleteEndpoint(r.Context(), uid, id); err != nil {
+            if stderrors.Is(err, delivery.ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+            errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "delete failed", map[string]string{"error": err.Error()}); return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    saveChannel(w, r, uid, id)
+}
+
+func saveChannel(w http.ResponseWriter, r *http.Request, uid string, id int64) {
+    var body struct {
+        Kind    string `json:"kind"`
+        Name    string `json:"name"`
+        Target  string `json:"target"`
+        Secret  string `json:"secret"`
+        Enabled *bool  `json:"enabled"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+    ep := delivery.Endpoint{ID: id, UserID: uid, Kind: body.Kind, Name: strings.TrimSpace(body.Name), Target: body.Target, Secret: strings.TrimSpace(body.Secret), Enabled: body.Enabled == nil || *body.Enabled}
+    if msg := validateEndpoint(&ep); msg != "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", msg, nil); return }
+    out, err := dispatcher.Store.SaveEndpoint(r.Context(), ep)
+    if stderrors.Is(err, delivery.ErrNotFound) { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "save failed", map[string]string{"error": err.Error()}); return }
+    w.Header().Set("Content-Type", "application/json")
+    if id == 0 { w.WriteHeader(http.StatusCreated) }
+    _ = json.NewEncoder(w).Encode(out)
+}
+
+// testChannelHandler: POST /api/v1/notifications/channels/{id}/test sends a test message now.
+func testChannelHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+    if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "id must be integer string", nil); return }
+    ep, err := dispatcher.Store.Endpoint(r.Context(), id)
+    if err != nil || ep.UserID != uid { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "not found", nil); return }
+    m := delivery.Message{UserID: uid, EventType: "NotificationTest", Title: "测试通知", Summary: "如果你收到这条消息，说明该通知渠道配置正确。", Severity: "info", Category: "system", CreatedAt: time.Now().UTC()}
+    w.Header().Set("Content-Type", "application/json")
+    if err := dispatcher.Send(r.Context(), *ep, m); err != nil {
+        _ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": err.Error()})
+        return
+    }
+    _ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+}
+
+// deliveriesHandler: GET /api/v1/notifications/deliveries?notificationId=&limit=50
+// Delivery records of the caller's notifications: channel, status, attempts and last error.
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    q := r.URL.Query()
+    limit := 50
+    if v := q.Get("limit"); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 200 { limit = n } }
+    var nid int64
+    if v := strings.TrimSpace(q.Get("notificationId")); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "notificationId must be integer string", nil); return }
+        nid = n
+    }
+    items, err := dispatcher.Store.Deliveries(r.Context(), uid, nid, limit)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if items == nil { items = []*delivery.Delivery{} }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    stderrors "errors"
+
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/digest"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/events"
+)
+
+var digests *digest.Store
+
+// newDigestStore reads NOTIFY_COLLAPSE_WINDOW_SEC (default 900; 0 disables collapsing).
+func newDigestStore() *digest.Store {
+    s := digest.NewStore(db)
+    if v := strings.TrimSpace(os.Getenv("NOTIFY_COLLAPSE_WINDOW_SEC")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 0 { s.CollapseWindow = time.Duration(n) * time.Second }
+    }
+    return s
+}
+
+// startDigests builds due digests through the subscriber every NOTIFY_DIGEST_INTERVAL_MS
+// (default 60s). Items only arrive through the subscriber, so there is nothing to build without it.
+func startDigests(ctx context.Context, sub *events.Subscriber) {
+    interval := time.Minute
+    if v := strings.TrimSpace(os.Getenv("NOTIFY_DIGEST_INTERVAL_MS")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1000 { interval = time.Duration(n) * time.Millisecond }
+    }
+    b := &digest.Builder{Store: digests, Deliver: sub.DeliverDigest}
+    go b.Run(ctx, interval)
+}
+
+// preferencesHandler: GET returns the caller's delivery preferences (defaults if never saved); PUT replaces them.
+// Body: { timezone, quietStart: "HH:MM", quietEnd: "HH:MM", digestAt: "HH:MM", default: immediate|hourly|daily,
+// categories: { workflow: hourly, billing: daily, ... }, collapse }
+func preferencesHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    var p digest.Preferences
+    var err error
+    if r.Method == http.MethodPut {
+        p = digest.Defaults(uid)
+        if err := json.NewDecoder(r.Body).Decode(&p); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+        p.UserID = uid
+        p, err = digests.SavePreferences(r.Context(), p)
+    } else {
+        p, err = digests.Preferences(r.Context(), uid)
+    }
+    if stderrors.Is(err, digest.ErrInvalid) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return }
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "preferences failed", map[string]string{"error": err.Error()}); return }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(p)
+}
+
+// pendingDigestHandler: GET /api/v1/notifications/digest lists notifications held for the caller's
+// next digest or until their quiet hours end.
+func pendingDigestHandler(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    items, err := digests.Pending(r.Context(), uid, 500)
+    if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
+    if items == nil { items = []digest.Item{} }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+}
@@ -8,22 +8,25 @@ import (
     "os"
     "strconv"
     "time"
+    stderrors "errors"
 
     "github.com/xxrenzhe/autoads/pkg/errors"
     "github.com/xxrenzhe/autoads/pkg/logger"
     "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/pkg/notifyrules"
     _ "github.com/lib/pq"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/delivery"
     "github.com/xxrenzhe/autoads/services/notifications/internal/events"
     "github.com/go-chi/chi/v5"
     api "github.com/xxrenzhe/autoads/services/notifications/internal/oapi"
     tshim "github.com/xxrenzhe/autoads/services/notifications/internal/telemetryshim"
     "strings"
-    "fmt"
     ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
 var log = logger.Get()
 var db *sql.DB
+var rules *notifyrules.Store
 
 type Notification struct {
     ID        string `json:"id"`
@@ -41,7 +44,12 @@ func main() {
     db, err = sql.Open("postgres", dsn)
     if err != nil { log.Fatal().Err(err).Msg("db open") }
     if err := db.Ping(); err != nil { log.Fatal().Err(err).Msg("db ping") }
+    rules = notifyrules.New(db)
+    digests = newDigestStore()
+    deadLetters = events.NewDeadLetters(db)
     if err := ensureDDL(db); err != nil { log.Warn().Err(err).Msg("ensure DDL failed") }
+    dispatcher = startDelivery(context.Background())
+    startStream(context.Background(), dsn)
 
     r := chi.NewRouter()
     tshim.RegisterDefaultMetrics("notifications")
@@ -58,6 +66,20 @@ func main() {
     // Plain route (fallback) + streaming + OpenAPI chi server
     r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/recent", recentHandler)
     r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/stream", sseNotifications)
+    // External delivery channels (email/webhook/slack/lark) and delivery records
+    r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/channels", channelsHandler)
+    r.With(middleware.AuthMiddleware).Post("/api/v1/notifications/channels", channelsHandler)
+    r.With(middleware.AuthMiddleware).Put("/api/v1/notifications/channels/{id}", channelHandler)
+    r.With(middleware.AuthMiddleware).Delete("/api/v1/notifications/channels/{id}", channelHandler)
+    r.With(middleware.AuthMiddleware).Post("/api/v1/notifications/channels/{id}/test", testChannelHandler)
+    r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/deliveries", deliveriesHandler)
+    // Digest and quiet-hour preferences, and notifications held for the next digest
+    r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/preferences", preferencesHandler)
+    r.With(middleware.AuthMiddleware).Put("/api/v1/notifications/preferences", preferencesHandler)
+    r.With(middleware.AuthMiddleware).Get("/api/v1/notifications/digest", pendingDigestHandler)
+    // admin: events that subscriber handlers failed on
+    r.With(middleware.AdminOnly).Get("/api/v1/notifications/admin/dead-letters", deadLettersHandler)
+    r.With(middleware.AdminOnly).Post("/api/v1/notifications/admin/dead-letters/{id}/replay", replayDeadLetterHandler)
     // Minimal event_store query for current user (3.1 部分落地)
     r.With(middleware.AuthMiddleware).Get("/api/v1/console/events", listEventsHandler)
     r.With(middleware.AuthMiddleware).Get("/api/v1/console/events/export", exportEventsHandler)
@@ -81,13 +103,19 @@ func main() {
 
     // Start subscriber (best-effort)
     if os.Getenv("GOOGLE_CLOUD_PROJECT") != "" && os.Getenv("PUBSUB_SUBSCRIPTION_ID") != "" {
-        var pub *ev.Publisher
-        if p, err := ev.NewPublisher(context.Background()); err == nil { pub = p } else { log.Warn().Err(err).Msg("notifications: publisher init failed; NotificationSent disabled") }
-        sub, err := events.NewSubscriber(context.Background(), db, pub)
+        // NotificationSent is recorded in event_outbox with its notification; the relay publishes it
+        if err := ev.EnsureOutbox(context.Background(), db); err != nil { log.Warn().Err(err).Msg("notifications: ensure event_outbox ddl failed") }
+        if pub, err := ev.NewPublisher(context.Background()); err == nil {
+            relay := &ev.Relay{DB: db, Pub: pub, Source: events.OutboxSource, Interval: time.Second}
+            go relay.Run(context.Background())
+        } else { log.Warn().Err(err).Msg("notifications: publisher init failed; NotificationSent stays in the outbox") }
+        sub, err := events.NewSubscriber(context.Background(), db, dispatcher, digests)
         if err != nil {
             log.Warn().Err(err).Msg("notifications: subscriber init failed")
         } else {
             sub.Start(context.Background())
+            subscriber = sub
+            startDigests(context.Background(), sub)
         }
     }
 
@@ -115,25 +143,15 @@ func (oas *oasImpl) GetUnreadCount(w http.ResponseWriter, r *http.Request) {
     unreadCountHandler(w, r)
 }
 
-// Rules endpoints (minimal): GET list, POST upsert
+// Rules endpoints: the caller's event subscriptions (notifyrules kind "event"). GET lists, POST upserts.
 func (oas *oasImpl) ListNotificationRules(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
     uid, _ := r.Context().Value(middleware.UserIDKey).(string)
     if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
-    rows, err := db.Query(`SELECT id, event_type, channel, enabled, created_at, updated_at FROM notification_rules WHERE user_id=$1 ORDER BY id DESC`, uid)
+    items, err := rules.List(r.Context(), notifyrules.Filter{Kind: notifyrules.KindEvent, UserID: uid})
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
-    defer rows.Close()
-    type Rule struct{ ID int64 `json:"id"`; EventType, Channel string `json:"eventType","json:"channel"`; Enabled bool `json:"enabled"`; CreatedAt, UpdatedAt sql.NullTime }
-    out := []map[string]any{}
-    for rows.Next() {
-        var id int64; var eventType, channel string; var enabled bool; var cAt, uAt sql.NullTime
-        if err := rows.Scan(&id, &eventType, &channel, &enabled, &cAt, &uAt); err == nil {
-            m := map[string]any{"id": fmt.Sprintf("%d", id), "eventType": eventType, "channel": channel, "enabled": enabled}
-            if cAt.Valid { m["createdAt"] = cAt.Time.UTC().Format(time.RFC3339) }
-            if uAt.Valid { m["updatedAt"] = uAt.Time.UTC().Format(time.RFC3339) }
-            out = append(out, m)
-        }
-    }
+    out := make([]api.NotificationRule, 0, len(items))
+    for _, it := range items { out = append(out, ruleOut(it)) }
     _ = json.NewEncoder(w).Encode(map[string]any{"items": out})
 }
 
@@ -143,24 +161,17 @@ func (oas *oasImpl) UpsertNotificationRule(w http.ResponseWriter, r *http.Reques
     if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
     var body struct{ EventType, Channel string; Enabled bool }
     if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
-    if strings.TrimSpace(body.EventType) == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "eventType required", nil); return }
-    ch := strings.ToLower(strings.TrimSpace(body.Channel)); if ch == "" { ch = "inapp" }
-    // ensure table
-    _, _ = db.Exec(`CREATE TABLE IF NOT EXISTS notification_rules (
-        id BIGSERIAL PRIMARY KEY,
-        user_id TEXT NOT NULL,
-        event_type TEXT NOT NULL,
-        channel TEXT NOT NULL DEFAULT 'inapp',
-        enabled BOOLEAN NOT NULL DEFAULT TRUE,
-        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-        updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-    )`)
-    // upsert (by user+event_type+channel)
-    _, err := db.Exec(`INSERT INTO notification_rules(user_id,event_type,channel,enabled,created_at,updated_at)
-        VALUES ($1,$2,$3,$4,NOW(),NOW())
-        ON CONFLICT (user_id,event_type,channel) DO UPDATE SET enabled=EXCLUDED.enabled, updated_at=NOW()`, uid, body.EventType, ch, body.Enabled)
+    ch := strings.ToLower(strings.TrimSpace(body.Channel)); if ch == "" { ch = notifyrules.DefaultChannel }
+    if !delivery.ValidKind(ch) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "channel must be one of "+strings.Join(delivery.Kinds, "|"), nil); return }
+    rule, err := rules.Subscribe(r.Context(), uid, body.EventType, ch, body.Enabled)
+    if stderrors.Is(err, notifyrules.ErrInvalid) { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error(), nil); return }
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "upsert failed", map[string]string{"error": err.Error()}); return }
-    _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+    _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "rule": ruleOut(rule)})
+}
+
+func ruleOut(it *notifyrules.Rule) api.NotificationRule {
+    c, u := it.CreatedAt.UTC(), it.UpdatedAt.UTC()
+    return api.NotificationRule{Id: strconv.FormatInt(it.ID, 10), EventType: it.EventType, Channel: api.NotificationRuleChannel(it.Channel), Enabled: it.Enabled, CreatedAt: &c, UpdatedAt: &u}
 }
 
 func recentHandler(w http.ResponseWriter, r *http.Request) {
@@ -433,92 +444,6 @@ func listEventTypesHandler(w http.ResponseWriter, r *http.Request) {
     _ = json.NewEncoder(w).Encode(struct{ Items []it `json:"items"` }{Items: out})
 }
 
-// sseNotifications streams unread count and new notification tips for current user.
-// Events:
-//  - event: unread, data: { count }
-//  - event: heartbeat, data: { t }
-//  - event: new, data: { id, type, title, createdAt }
-func sseNotifications(w http.ResponseWriter, r *http.Request) {
-    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
-    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
-    // SSE headers
-    w.Header().Set("Content-Type", "text/event-stream")
-    w.Header().Set("Cache-Control", "no-cache, no-transform")
-    w.Header().Set("Connection", "keep-alive")
-    fl, ok := w.(http.Flusher)
-    if !ok { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "stream not supported", nil); return }
-
-    // Compute initial last id and unread count
-    var lastID int64
-    _ = db.QueryRow(`SELECT COALESCE(MAX(id),0) FROM user_notifications WHERE user_id=$1`, uid).Scan(&lastID)
-    var lastRead int64
-    _ = db.QueryRow(`SELECT last_read_id FROM user_notification_state WHERE user_id=$1`, uid).Scan(&lastRead)
-    unread := int64(0)
-    _ = db.QueryRow(`SELECT COUNT(1) FROM user_notifications WHERE user_id=$1 AND id>$2`, uid, lastRead).Scan(&unread)
-    // send initial unread
-    fmt.Fprintf(w, "event: unread\n")
-    fmt.Fprintf(w, "data: {\"count\": %d}\n\n", unread)
-    fl.Flush()
-
-    ticker := time.NewTicker(10 * time.Second)
-    defer ticker.Stop()
-    hb := time.NewTicker(25 * time.Second)
-    defer hb.Stop()
-
-    cn := r.Context().Done()
-    for {
-        select {
-        case <-cn:
-            return
-        case <-ticker.C:
-            var maxID int64
-            _ = db.QueryRow(`SELECT COALESCE(MAX(id),0) FROM user_notifications WHERE user_id=$1`, uid).Scan(&maxID)
-            if maxID > lastID {
-                // Send summary of new notifications; include minimal payload keys for client-side correlation
-                rows, err := db.Query(`SELECT id, type, title, message, created_at FROM user_notifications WHERE user_id=$1 AND id>$2 ORDER BY id ASC LIMIT 10`, uid, lastID)
-                if err == nil {
-                    defer rows.Close()
-                    for rows.Next() {
-                        var id int64; var typ, title, message string; var createdAt time.Time
-                        if err := rows.Scan(&id, &typ, &title, &message, &createdAt); err == nil {
-                            // minimal extraction: offerId, analysisId, step (if present in message JSON)
-                            offerId := ""; analysisId := ""; step := ""
-                            if message != "" {
-                                var m map[string]any
-                                if json.Unmarshal([]byte(message), &m) == nil {
-                                    if data, ok := m["data"].(map[string]any); ok {
-                                        if v, ok := data["offerId"].(string); ok { offerId = v }
-                                        if v, ok := data["analysisId"].(string); ok { analysisId = v }
-                                        if v, ok := data["step"].(string); ok { step = v }
-                                        // sometimes nested under workflow fields
-                                        if step == "" {
-                                            if v, ok := data["name"].(string); ok { step = v }
-                                        }
-                                    }
-                                }
-                            }
-                            fmt.Fprintf(w, "event: new\n")
-                            // print minimal JSON; ensure proper escaping for title
-                            fmt.Fprintf(w, "data: {\"id\":%d,\"type\":\"%s\",\"title\":%q,\"createdAt\":%q,\"offerId\":%q,\"analysisId\":%q,\"step\":%q}\n\n", id, typ, title, createdAt.UTC().Format(time.RFC3339), offerId, analysisId, step)
-                            lastID = id
-                        }
-                    }
-                    fl.Flush()
-                }
-            }
-            // unread update
-            _ = db.QueryRow(`SELECT last_read_id FROM user_notification_state WHERE user_id=$1`, uid).Scan(&lastRead)
-            _ = db.QueryRow(`SELECT COUNT(1) FROM user_notifications WHERE user_id=$1 AND id>$2`, uid, lastRead).Scan(&unread)
-            fmt.Fprintf(w, "event: unread\n")
-            fmt.Fprintf(w, "data: {\"count\": %d}\n\n", unread)
-            fl.Flush()
-        case <-hb.C:
-            fmt.Fprintf(w, ": keepalive\n\n")
-            fl.Flush()
-        }
-    }
-}
-
 // ensureDDL creates minimal tables used by notifications service if missing.
 func ensureDDL(db *sql.DB) error {
     stmts := []string{
@@ -540,7 +465,12 @@ func ensureDDL(db *sql.DB) error {
     for _, s := range stmts {
         if _, err := db.Exec(s); err != nil { return err }
     }
-    return nil
+    // notification_rules (event subscriptions and metric alert rules) is shared with the console
+    if err := rules.EnsureSchema(context.Background()); err != nil { return err }
+    // preferences, held digest items and the collapsing columns of user_notifications
+    if err := digests.EnsureSchema(context.Background()); err != nil { return err }
+    // events the subscriber's handlers failed on
+    return deadLetters.EnsureSchema(context.Background())
 }
 
 // markReadHandler: POST /api/v1/notifications/read { lastId: string }
@@ -0,0 +1,202 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    stderrors "errors"
+
+    "github.com/lib/pq"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/stream"
+)
+
+var hub = stream.NewHub()
+
+const (
+    // maxReplay bounds the notifications replayed to one stream; a stream further behind is told
+    // to reset (reload the list) and continues from the newest notification.
+    maxReplay = 200
+    // streamWriteTimeout drops streams whose client stopped reading; EventSource reconnects and
+    // resumes from Last-Event-ID.
+    streamWriteTimeout = 10 * time.Second
+    // lateWindow: notification ids are taken from the sequence at insert, so a notification can
+    // commit after one with a higher id was streamed. Catch-up also re-reads the user's
+    // notifications created within lateWindow below the cursor and sends those not sent yet.
+    lateWindow = 30 * time.Second
+)
+
+// startStream runs the instance's single LISTEN connection. The change triggers are installed
+// by schemas/sql/023_notification_stream.sql.
+func startStream(ctx context.Context, dsn string) {
+    go stream.Listen(ctx, dsn, hub)
+}
+
+// streamCursor is what a stream has delivered: the notifications up to lastID, except ones
+// committed late, and the recent ids in sent (with their creation time, for pruning).
+type streamCursor struct {
+    lastID int64
+    sent   map[int64]time.Time
+}
+
+// markRecent records the user's notifications up to lastID created within lateWindow as sent.
+func (cur *streamCursor) markRecent(ctx context.Context, uid string) {
+    cur.sent = map[int64]time.Time{}
+    rows, err := db.QueryContext(ctx, `SELECT id, created_at FROM user_notifications WHERE user_id=$1 AND id<=$2 AND created_at > NOW() - make_interval(secs => $3)`, uid, cur.lastID, lateWindow.Seconds())
+    if err != nil { return }
+    defer rows.Close()
+    for rows.Next() {
+        var id int64
+        var at time.Time
+        if rows.Scan(&id, &at) == nil { cur.sent[id] = at }
+    }
+}
+
+type streamItem struct {
+    ID         int64  `json:"id"`
+    Type       string `json:"type"`
+    Title      string `json:"title"`
+    Count      int    `json:"count"`
+    CreatedAt  string `json:"createdAt"`
+    OfferID    string `json:"offerId"`
+    AnalysisID string `json:"analysisId"`
+    Step       string `json:"step"`
+    at         time.Time
+}
+
+// sseNotifications: GET /api/v1/notifications/stream
+// Events: "new" (id: notification id, so EventSource resumes with Last-Event-ID), "update" (a
+// collapsed notification changed), "unread" ({count}) and "reset" (too far behind; reload).
+func sseNotifications(w http.ResponseWriter, r *http.Request) {
+    uid, _ := r.Context().Value(middleware.UserIDKey).(string)
+    if uid == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
+    fl, ok := w.(http.Flusher)
+    if !ok { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "stream not supported", nil); return }
+    c, err := hub.Subscribe(uid)
+    if stderrors.Is(err, stream.ErrTooManyStreams) { errors.Write(w, r, http.StatusTooManyRequests, "TOO_MANY_STREAMS", "too many open notification streams", nil); return }
+    defer hub.Unsubscribe(c)
+    // SSE headers
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache, no-transform")
+    w.Header().Set("Connection", "keep-alive")
+
+    ctx := r.Context()
+    rc := http.NewResponseController(w)
+    send := func(s string) error {
+        _ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+        if _, err := fmt.Fprint(w, s); err != nil { return err }
+        fl.Flush()
+        return nil
+    }
+    // Subscribed before reading, so nothing committed from here on is missed. A fresh stream starts
+    // after what the client just loaded; a resumed one may repeat notifications it got shortly
+    // before disconnecting, since only their highest id survives in Last-Event-ID.
+    cur := &streamCursor{sent: map[int64]time.Time{}}
+    lastID, resumed := stream.ResumeID(r)
+    cur.lastID = lastID
+    if !resumed {
+        _ = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id),0) FROM user_notifications WHERE user_id=$1`, uid).Scan(&cur.lastID)
+        cur.markRecent(ctx, uid)
+    }
+    if send("retry: 5000\n\n") != nil { return }
+    if resumed { if streamCatchUp(ctx, send, uid, cur) != nil { return } }
+    if streamUnread(ctx, send, uid) != nil { return }
+
+    hb := time.NewTicker(25 * time.Second)
+    defer hb.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-c.Wake():
+            p := c.Take()
+            if streamCatchUp(ctx, send, uid, cur) != nil { return }
+            if len(p.Updated) > 0 && streamUpdates(ctx, send, uid, p.Updated, cur.lastID) != nil { return }
+            if streamUnread(ctx, send, uid) != nil { return }
+        case <-hb.C:
+            if send(": keepalive\n\n") != nil { return }
+        }
+    }
+}
+
+// streamCatchUp sends the notifications the cursor has not delivered (after lastID, or committed
+// late below it), or "reset" when more than maxReplay are missing.
+func streamCatchUp(ctx context.Context, send func(string) error, uid string, cur *streamCursor) error {
+    items, err := streamItems(ctx, `SELECT id, type, title, message, repeat_count, created_at FROM user_notifications
+        WHERE user_id=$1 AND (id>$2 OR created_at > NOW() - make_interval(secs => $3)) ORDER BY id ASC LIMIT $4`, uid, cur.lastID, lateWindow.Seconds(), maxReplay+1+len(cur.sent))
+    if err != nil { return nil } // transient; the next wake-up retries
+    fresh := items[:0]
+    for _, it := range items {
+        if _, ok := cur.sent[it.ID]; !ok { fresh = append(fresh, it) }
+    }
+    if len(fresh) > maxReplay {
+        _ = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id),0) FROM user_notifications WHERE user_id=$1`, uid).Scan(&cur.lastID)
+        cur.markRecent(ctx, uid)
+        return send(fmt.Sprintf("id: %d\nevent: reset\ndata: {\"lastId\":%d}\n\n", cur.lastID, cur.lastID))
+    }
+    for _, it := range fresh {
+        b, _ := json.Marshal(it)
+        // a late notification keeps the event id at the cursor, so Last-Event-ID never moves back
+        if err := send(fmt.Sprintf("id: %d\nevent: new\ndata: %s\n\n", max(it.ID, cur.lastID), b)); err != nil { return err }
+        cur.sent[it.ID] = it.at
+        if it.ID > cur.lastID { cur.lastID = it.ID }
+    }
+    // forget ids too old to come back through the window (with margin for clock skew)
+    for id, at := range cur.sent {
+        if time.Since(at) > 2*lateWindow { delete(cur.sent, id) }
+    }
+    return nil
+}
+
+// streamUpdates re-sends notifications the client already has that were changed in place.
+func streamUpdates(ctx context.Context, send func(string) error, uid string, ids []int64, lastID int64) error {
+    items, err := streamItems(ctx, `SELECT id, type, title, message, repeat_count, created_at FROM user_notifications WHERE user_id=$1 AND id = ANY($2) AND id <= $3 ORDER BY id ASC`, uid, pq.Array(ids), lastID)
+    if err != nil { return nil }
+    for _, it := range items {
+        b, _ := json.Marshal(it)
+        if err := send(fmt.Sprintf("event: update\ndata: %s\n\n", b)); err != nil { return err }
+    }
+    return nil
+}
+
+func streamUnread(ctx context.Context, send func(string) error, uid string) error {
+    var unread int64
+    _ = db.QueryRowContext(ctx, `SELECT COUNT(1) FROM user_notifications WHERE user_id=$1 AND id > COALESCE((SELECT last_read_id FROM user_notification_state WHERE user_id=$1),0)`, uid).Scan(&unread)
+    return send(fmt.Sprintf("event: unread\ndata: {\"count\": %d}\n\n", unread))
+}
+
+func streamItems(ctx context.Context, q string, args ...any) ([]streamItem, error) {
+    rows, err := db.QueryContext(ctx, q, args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []streamItem
+    for rows.Next() {
+        var it streamItem
+        var message string
+        var createdAt time.Time
+        var count sql.NullInt64
+        if err := rows.Scan(&it.ID, &it.Type, &it.Title, &message, &count, &createdAt); err != nil { return nil, err }
+        it.Count = 1
+        if count.Valid { it.Count = int(count.Int64) }
+        it.at = createdAt
+        it.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+        // minimal extraction for client-side correlation: offerId, analysisId, step
+        var m map[string]any
+        if strings.TrimSpace(message) != "" && json.Unmarshal([]byte(message), &m) == nil {
+            if data, ok := m["data"].(map[string]any); ok {
+                if v, ok := data["offerId"].(string); ok { it.OfferID = v }
+                if v, ok := data["analysisId"].(string); ok { it.AnalysisID = v }
+                if v, ok := data["step"].(string); ok { it.Step = v }
+                // sometimes nested under workflow fields
+                if it.Step == "" { if v, ok := data["name"].(string); ok { it.Step = v } }
+            }
+        }
+        out = append(out, it)
+    }
+    return out, rows.Err()
+}
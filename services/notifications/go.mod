@@ -11,6 +11,7 @@ require (
 	github.com/xxrenzhe/autoads/pkg/errors v0.0.1
 	github.com/xxrenzhe/autoads/pkg/logger v0.0.1
 	github.com/xxrenzhe/autoads/pkg/middleware v0.0.1
+	github.com/xxrenzhe/autoads/pkg/notifyrules v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/telemetry v0.0.0-00010101000000-000000000000
 )
 
@@ -72,3 +73,5 @@ replace github.com/xxrenzhe/autoads/pkg/middleware => ../../pkg/middleware
 replace github.com/xxrenzhe/autoads/pkg/auth => ../../pkg/auth
 
 replace github.com/xxrenzhe/autoads/pkg/telemetry => ../../pkg/telemetry
+
+replace github.com/xxrenzhe/autoads/pkg/notifyrules => ../../pkg/notifyrules
@@ -0,0 +1,96 @@
+// Package delivery sends notifications outside the app: email over SMTP, signed outbound
+// webhooks and Slack/Lark incoming webhooks. notification_rules route a user's event types to
+// channel kinds; every matching endpoint of the user (notification_channels) gets a queued
+// delivery (notification_deliveries) that the Dispatcher sends, retries with backoff and records.
+package delivery
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Channel kinds. KindInApp is the in-app feed (user_notifications) and is never queued.
+const (
+    KindInApp   = "inapp"
+    KindEmail   = "email"
+    KindWebhook = "webhook"
+    KindSlack   = "slack"
+    KindLark    = "lark"
+)
+
+// Kinds lists the kinds a rule may route to.
+var Kinds = []string{KindInApp, KindEmail, KindWebhook, KindSlack, KindLark}
+
+// ValidKind reports whether kind is one of Kinds.
+func ValidKind(kind string) bool {
+    for _, k := range Kinds {
+        if k == kind { return true }
+    }
+    return false
+}
+
+// Message is a notification as delivered to every channel.
+type Message struct {
+    NotificationID int64          `json:"notificationId"`
+    UserID         string         `json:"userId"`
+    EventType      string         `json:"type"`
+    Title          string         `json:"title"`
+    Severity       string         `json:"severity,omitempty"`
+    Category       string         `json:"category,omitempty"`
+    Summary        string         `json:"summary,omitempty"`
+    Data           map[string]any `json:"data,omitempty"`
+    CreatedAt      time.Time      `json:"createdAt"`
+    // Covers are further event types whose rules route the message, e.g. those a digest summarizes.
+    Covers []string `json:"covers,omitempty"`
+}
+
+// Text renders the message as plain text for email and chat.
+func (m Message) Text() string { return m.Title + "\n" + m.Details() }
+
+// Details is the text below the title: the summary, if any, and the event type and time.
+func (m Message) Details() string {
+    var b strings.Builder
+    if m.Summary != "" { b.WriteString(m.Summary + "\n") }
+    fmt.Fprintf(&b, "\n%s · %s", m.EventType, m.CreatedAt.UTC().Format(time.RFC3339))
+    return b.String()
+}
+
+// Endpoint is where a user receives one kind of channel: an email address, a webhook URL or a
+// chat incoming-webhook URL. Secret signs webhook and Lark posts.
+type Endpoint struct {
+    ID        int64     `json:"id"`
+    UserID    string    `json:"userId"`
+    Kind      string    `json:"kind"`
+    Name      string    `json:"name,omitempty"`
+    Target    string    `json:"target"`
+    Secret    string    `json:"-"`
+    Enabled   bool      `json:"enabled"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+// Channel delivers a message to an endpoint of its kind.
+type Channel interface {
+    Kind() string
+    Send(ctx context.Context, ep Endpoint, m Message) error
+}
+
+// PermanentError marks a failure that retrying cannot fix (bad address, 4xx response).
+type PermanentError struct{ Err error }
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the Dispatcher gives up on the delivery instead of retrying.
+func Permanent(err error) error {
+    if err == nil { return nil }
+    return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err was wrapped by Permanent.
+func IsPermanent(err error) bool {
+    var p *PermanentError
+    return errors.As(err, &p)
+}
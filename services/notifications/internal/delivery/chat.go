@@ -0,0 +1,60 @@
+package delivery
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Chat posts to Slack or Lark (Feishu) incoming webhooks. Slack takes {"text": ...}; Lark takes a
+// text message and, when the bot has signature verification on (the endpoint secret), a
+// timestamp and sign.
+type Chat struct {
+    Flavor string // KindSlack or KindLark
+    Client *http.Client
+    Now    func() time.Time
+}
+
+// NewSlack and NewLark return the chat channel of each flavor.
+func NewSlack(c *http.Client) *Chat { return &Chat{Flavor: KindSlack, Client: c} }
+func NewLark(c *http.Client) *Chat  { return &Chat{Flavor: KindLark, Client: c} }
+
+func (c *Chat) Kind() string { return c.Flavor }
+
+func (c *Chat) Send(ctx context.Context, ep Endpoint, m Message) error {
+    now := time.Now
+    if c.Now != nil { now = c.Now }
+    var body map[string]any
+    switch c.Flavor {
+    case KindLark:
+        body = map[string]any{"msg_type": "text", "content": map[string]any{"text": m.Text()}}
+        if ep.Secret != "" {
+            ts := strconv.FormatInt(now().Unix(), 10)
+            body["timestamp"], body["sign"] = ts, LarkSign(ep.Secret, ts)
+        }
+    default:
+        body = map[string]any{"text": "*" + m.Title + "*\n" + m.Details()}
+    }
+    b, _ := json.Marshal(body)
+    out, err := post(ctx, c.Client, ep.Target, b, nil)
+    if err != nil || c.Flavor != KindLark { return err }
+    // Lark answers 200 with a non-zero code for rejected messages (bad sign, bot removed)
+    var res struct{ Code int `json:"code"`; Msg string `json:"msg"` }
+    if json.Unmarshal(out, &res) == nil && res.Code != 0 {
+        return Permanent(fmt.Errorf("lark rejected the message: %d %s", res.Code, res.Msg))
+    }
+    return nil
+}
+
+// LarkSign is Lark's custom-bot signature: base64(HMAC-SHA256 keyed by "<timestamp>\n<secret>"
+// over an empty message).
+func LarkSign(secret, ts string) string {
+    mac := hmac.New(sha256.New, []byte(ts+"\n"+secret))
+    return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,126 @@
+package delivery
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+)
+
+// Outcome is the result of one delivery attempt.
+type Outcome struct {
+    Status        string
+    NextAttemptAt time.Time
+    Error         string
+}
+
+// Dispatcher sends queued deliveries through the registered channels.
+type Dispatcher struct {
+    Store       *Store
+    // MaxAttempts is stamped on new deliveries (default 6).
+    MaxAttempts int
+    // Backoff is the wait after the n-th failed attempt (default: 30s doubling, at most 1h).
+    Backoff func(attempt int) time.Duration
+    // Lease is how long a claimed delivery is hidden from other dispatchers (default 2m).
+    Lease time.Duration
+    Batch int
+    Now   func() time.Time
+
+    channels map[string]Channel
+}
+
+// NewDispatcher returns a dispatcher over store sending through chans.
+func NewDispatcher(store *Store, chans ...Channel) *Dispatcher {
+    d := &Dispatcher{Store: store, MaxAttempts: 6, Backoff: DefaultBackoff, Lease: 2 * time.Minute, Batch: 50, Now: time.Now, channels: map[string]Channel{}}
+    for _, c := range chans { d.Register(c) }
+    return d
+}
+
+// Register adds or replaces the channel of c's kind.
+func (d *Dispatcher) Register(c Channel) { d.channels[c.Kind()] = c }
+
+// Channel returns the channel of a kind, if registered.
+func (d *Dispatcher) Channel(kind string) (Channel, bool) {
+    c, ok := d.channels[kind]
+    return c, ok
+}
+
+// DefaultBackoff waits 30s after the first failure and doubles up to an hour.
+func DefaultBackoff(attempt int) time.Duration {
+    if attempt < 1 { attempt = 1 }
+    if attempt > 8 { return time.Hour }
+    return min(30*time.Second<<(attempt-1), time.Hour)
+}
+
+// Enqueue queues m for the endpoints the user's rules route it to.
+func (d *Dispatcher) Enqueue(ctx context.Context, m Message) (int, error) {
+    return d.Store.Enqueue(ctx, m, d.MaxAttempts)
+}
+
+// Run dispatches due deliveries every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+        for {
+            n, err := d.RunOnce(ctx)
+            if err != nil { log.Printf("notifications: delivery dispatch: %v", err) }
+            if err != nil || n < d.Batch { break }
+        }
+    }
+}
+
+// RunOnce claims one batch of due deliveries, attempts each and records the outcomes. It returns
+// how many deliveries it claimed.
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+    batch, err := d.Store.Claim(ctx, d.Now(), d.Lease, d.Batch)
+    if err != nil { return 0, err }
+    for _, dl := range batch {
+        var ep *Endpoint
+        if e, err := d.Store.Endpoint(ctx, dl.EndpointID); err == nil {
+            ep = e
+        } else if !errors.Is(err, ErrNotFound) {
+            // leave it leased; it is retried when the lease expires
+            log.Printf("notifications: delivery %d endpoint lookup: %v", dl.ID, err)
+            continue
+        }
+        o := d.Attempt(ctx, dl, ep)
+        if o.Status == StatusFailed { log.Printf("notifications: delivery %d to %s failed after %d attempts: %s", dl.ID, dl.Channel, dl.Attempts, o.Error) }
+        if err := d.Store.Finish(ctx, dl.ID, o); err != nil { log.Printf("notifications: delivery %d record outcome: %v", dl.ID, err) }
+    }
+    return len(batch), nil
+}
+
+// Attempt sends a claimed delivery (dl.Attempts already counts this attempt) to ep and decides
+// what happens next: sent, retried after Backoff, or failed for good when the error is
+// permanent, the endpoint is gone or attempts ran out.
+func (d *Dispatcher) Attempt(ctx context.Context, dl *Delivery, ep *Endpoint) Outcome {
+    now := d.Now()
+    fail := func(err error) Outcome { return Outcome{Status: StatusFailed, NextAttemptAt: now, Error: err.Error()} }
+    ch, ok := d.channels[dl.Channel]
+    if !ok { return fail(fmt.Errorf("channel %s is not configured", dl.Channel)) }
+    if ep == nil || !ep.Enabled { return fail(fmt.Errorf("endpoint %d was removed or disabled", dl.EndpointID)) }
+    cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    err := ch.Send(cctx, *ep, dl.Message)
+    switch {
+    case err == nil:
+        return Outcome{Status: StatusSent, NextAttemptAt: now}
+    case IsPermanent(err), dl.Attempts >= dl.MaxAttempts:
+        return fail(err)
+    }
+    return Outcome{Status: StatusPending, NextAttemptAt: now.Add(d.Backoff(dl.Attempts)), Error: err.Error()}
+}
+
+// Send delivers m to ep right away without queueing (endpoint tests).
+func (d *Dispatcher) Send(ctx context.Context, ep Endpoint, m Message) error {
+    ch, ok := d.channels[ep.Kind]
+    if !ok { return fmt.Errorf("channel %s is not configured", ep.Kind) }
+    return ch.Send(ctx, ep, m)
+}
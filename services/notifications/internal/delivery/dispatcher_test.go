@@ -0,0 +1,70 @@
+package delivery
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+type fakeChannel struct {
+    kind string
+    err  error
+    sent []Message
+}
+
+func (f *fakeChannel) Kind() string { return f.kind }
+func (f *fakeChannel) Send(_ context.Context, _ Endpoint, m Message) error {
+    f.sent = append(f.sent, m)
+    return f.err
+}
+
+func TestAttemptOutcomes(t *testing.T) {
+    now := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+    flaky := &fakeChannel{kind: KindWebhook, err: errors.New("connection reset")}
+    d := NewDispatcher(nil, flaky, &fakeChannel{kind: KindSlack}, &fakeChannel{kind: KindLark, err: Permanent(errors.New("sign match fail"))})
+    d.Now = func() time.Time { return now }
+    ep := &Endpoint{ID: 1, Enabled: true}
+
+    cases := []struct {
+        name    string
+        dl      Delivery
+        ep      *Endpoint
+        status  string
+        retryIn time.Duration
+    }{
+        {"sent", Delivery{Channel: KindSlack, Attempts: 1, MaxAttempts: 6}, ep, StatusSent, 0},
+        {"retry", Delivery{Channel: KindWebhook, Attempts: 2, MaxAttempts: 6}, ep, StatusPending, time.Minute},
+        {"out of attempts", Delivery{Channel: KindWebhook, Attempts: 6, MaxAttempts: 6}, ep, StatusFailed, 0},
+        {"permanent", Delivery{Channel: KindLark, Attempts: 1, MaxAttempts: 6}, ep, StatusFailed, 0},
+        {"unconfigured", Delivery{Channel: KindEmail, Attempts: 1, MaxAttempts: 6}, ep, StatusFailed, 0},
+        {"endpoint removed", Delivery{Channel: KindSlack, Attempts: 1, MaxAttempts: 6}, nil, StatusFailed, 0},
+        {"endpoint disabled", Delivery{Channel: KindSlack, Attempts: 1, MaxAttempts: 6}, &Endpoint{ID: 1}, StatusFailed, 0},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            o := d.Attempt(context.Background(), &c.dl, c.ep)
+            if o.Status != c.status {
+                t.Fatalf("Expected %s, but got %+v", c.status, o)
+            }
+            if got := o.NextAttemptAt.Sub(now); got != c.retryIn {
+                t.Errorf("Expected the next attempt in %v, but got %v", c.retryIn, got)
+            }
+            if c.status != StatusSent && o.Error == "" {
+                t.Errorf("Expected the error to be recorded")
+            }
+        })
+    }
+}
+
+func TestDefaultBackoff(t *testing.T) {
+    want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+    for i, w := range want {
+        if got := DefaultBackoff(i + 1); got != w {
+            t.Errorf("attempt %d: Expected %v, but got %v", i+1, w, got)
+        }
+    }
+    if got := DefaultBackoff(40); got != time.Hour {
+        t.Errorf("Expected the backoff to be capped at an hour, but got %v", got)
+    }
+}
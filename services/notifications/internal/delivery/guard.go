@@ -0,0 +1,105 @@
+package delivery
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Webhook and chat targets are user-supplied URLs, so outbound posts must not reach the service's
+// own network. CheckTarget rejects obviously internal targets when an endpoint is saved; the
+// client from NewClient enforces the rule where it matters, on the address actually dialled
+// (after DNS, so rebinding a public name to an internal address does not get through) and on
+// every redirect.
+
+// ErrBlockedTarget is returned for targets that are not public https endpoints.
+var ErrBlockedTarget = errors.New("target is not a public https endpoint")
+
+// blockedNets are special-purpose ranges not covered by net.IP's classification helpers.
+var blockedNets = func() []*net.IPNet {
+    var out []*net.IPNet
+    for _, cidr := range []string{
+        "0.0.0.0/8",     // "this network"
+        "100.64.0.0/10", // carrier-grade NAT
+        "192.0.0.0/24",  // IETF protocol assignments
+        "198.18.0.0/15", // benchmarking
+        "240.0.0.0/4",   // reserved
+        "64:ff9b::/96",  // NAT64 (embeds IPv4 addresses)
+    } {
+        _, n, _ := net.ParseCIDR(cidr)
+        out = append(out, n)
+    }
+    return out
+}()
+
+// PublicIP reports whether ip is a globally routable unicast address: not loopback, private
+// (RFC 1918, fc00::/7), link-local (incl. 169.254.169.254 metadata), unspecified or multicast.
+func PublicIP(ip net.IP) bool {
+    if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+        ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+        return false
+    }
+    if v4 := ip.To4(); v4 != nil { ip = v4 }
+    for _, n := range blockedNets {
+        if n.Contains(ip) { return false }
+    }
+    return true
+}
+
+// CheckTarget validates a webhook or chat URL: https, a host, and no internal IP literal or
+// localhost name. Names are resolved only at dial time (see NewClient).
+func CheckTarget(raw string) error {
+    u, err := url.Parse(strings.TrimSpace(raw))
+    if err != nil || u.Host == "" { return fmt.Errorf("%w: invalid URL", ErrBlockedTarget) }
+    if u.Scheme != "https" { return fmt.Errorf("%w: https required", ErrBlockedTarget) }
+    host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+    if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") {
+        return fmt.Errorf("%w: internal host", ErrBlockedTarget)
+    }
+    if ip := net.ParseIP(host); ip != nil && !PublicIP(ip) {
+        return fmt.Errorf("%w: internal address", ErrBlockedTarget)
+    }
+    return nil
+}
+
+// dialControl refuses connections to non-public addresses; it runs on the resolved IP.
+func dialControl(network, address string, _ syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil { return fmt.Errorf("%w: %v", ErrBlockedTarget, err) }
+    if !PublicIP(net.ParseIP(host)) { return fmt.Errorf("%w: %s", ErrBlockedTarget, host) }
+    return nil
+}
+
+// NewClient returns the HTTP client for outbound webhook and chat posts: every request (the first
+// and each of at most three redirects) must pass CheckTarget, connections go to public addresses
+// only, and proxy settings are ignored (a proxy would dial on the client's behalf).
+func NewClient(timeout time.Duration) *http.Client {
+    dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second, Control: dialControl}
+    return &http.Client{
+        Timeout: timeout,
+        Transport: guardedTransport{&http.Transport{
+            Proxy:               nil,
+            DialContext:         dialer.DialContext,
+            TLSHandshakeTimeout: 5 * time.Second,
+            MaxIdleConns:        50,
+            IdleConnTimeout:     90 * time.Second,
+        }},
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) >= 3 { return fmt.Errorf("%w: too many redirects", ErrBlockedTarget) }
+            return nil
+        },
+    }
+}
+
+// guardedTransport checks each request's URL before it is sent, which covers redirects as well.
+type guardedTransport struct{ next http.RoundTripper }
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if err := CheckTarget(req.URL.String()); err != nil { return nil, err }
+    return t.next.RoundTrip(req)
+}
@@ -0,0 +1,74 @@
+package delivery
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestCheckTarget(t *testing.T) {
+    cases := []struct {
+        url string
+        ok  bool
+    }{
+        {"https://hooks.slack.com/services/T0/B0/x", true},
+        {"https://93.184.216.34/hook", true},
+        {"http://hooks.example.com/hook", false},
+        {"https://localhost/hook", false},
+        {"https://metadata.google.internal/computeMetadata/v1/", false},
+        {"https://127.0.0.1:8080/", false},
+        {"https://10.0.0.5/", false},
+        {"https://172.16.3.1/", false},
+        {"https://192.168.1.1/", false},
+        {"https://169.254.169.254/latest/meta-data/", false},
+        {"https://[::1]/", false},
+        {"https://[fd00::1]/", false},
+        {"https://0.0.0.0/", false},
+        {"https://100.64.0.1/", false},
+        {"https:///nohost", false},
+    }
+    for _, c := range cases {
+        if err := CheckTarget(c.url); (err == nil) != c.ok {
+            t.Errorf("CheckTarget(%q) = %v, want ok=%v", c.url, err, c.ok)
+        }
+    }
+}
+
+func TestDialRefusesInternalAddresses(t *testing.T) {
+    for _, addr := range []string{"127.0.0.1:443", "10.1.2.3:443", "169.254.169.254:80", "[::1]:443", "[::ffff:127.0.0.1]:443"} {
+        if err := dialControl("tcp", addr, nil); !errors.Is(err, ErrBlockedTarget) {
+            t.Errorf("dialControl(%s) = %v, want ErrBlockedTarget", addr, err)
+        }
+    }
+    if err := dialControl("tcp", net.JoinHostPort("93.184.216.34", "443"), nil); err != nil {
+        t.Errorf("Expected a public address to be dialled, but got %v", err)
+    }
+}
+
+func TestGuardedClientBlocksInternalTargets(t *testing.T) {
+    hit := false
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+    defer srv.Close()
+    https := "https://" + strings.TrimPrefix(srv.URL, "http://")
+    for _, target := range []string{srv.URL, https} {
+        err := (&Webhook{Client: NewClient(0)}).Send(context.Background(), Endpoint{Target: target}, testMessage)
+        if !IsPermanent(err) || !errors.Is(err, ErrBlockedTarget) {
+            t.Errorf("%s: Expected a permanent blocked-target error, but got %v", target, err)
+        }
+    }
+    if hit {
+        t.Error("Expected the loopback receiver never to be called")
+    }
+}
+
+func TestFailedResponseBodyIsNotReported(t *testing.T) {
+    srv, _ := receiver(t, http.StatusInternalServerError, "db password=hunter2")
+    err := (&Webhook{Client: srv.Client()}).Send(context.Background(), Endpoint{Target: srv.URL}, testMessage)
+    if err == nil || strings.Contains(err.Error(), "hunter2") || err.Error() != "endpoint responded 500" {
+        t.Errorf("Expected only the status code, but got %v", err)
+    }
+}
@@ -0,0 +1,98 @@
+package delivery
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "mime"
+    "net"
+    "net/mail"
+    "net/smtp"
+    "net/textproto"
+    "os"
+    "strings"
+    "time"
+)
+
+// SMTP sends email through a relay. Username/Password enable PLAIN auth, which net/smtp only
+// allows over TLS or to localhost.
+type SMTP struct {
+    Addr     string // host:port
+    From     string
+    Username string
+    Password string
+    Timeout  time.Duration
+}
+
+// SMTPFromEnv configures SMTP from SMTP_ADDR, SMTP_FROM, SMTP_USERNAME and SMTP_PASSWORD; it
+// returns nil without SMTP_ADDR.
+func SMTPFromEnv() *SMTP {
+    addr := strings.TrimSpace(os.Getenv("SMTP_ADDR"))
+    if addr == "" { return nil }
+    from := strings.TrimSpace(os.Getenv("SMTP_FROM"))
+    if from == "" { from = "AutoAds <no-reply@autoads.dev>" }
+    return &SMTP{Addr: addr, From: from, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD")}
+}
+
+func (s *SMTP) Kind() string { return KindEmail }
+
+func (s *SMTP) Send(ctx context.Context, ep Endpoint, m Message) error {
+    to, err := mail.ParseAddress(ep.Target)
+    if err != nil { return Permanent(fmt.Errorf("invalid email address %q: %w", ep.Target, err)) }
+    from, err := mail.ParseAddress(s.From)
+    if err != nil { return Permanent(fmt.Errorf("invalid SMTP_FROM %q: %w", s.From, err)) }
+    msg := buildEmail(from, to, m)
+
+    timeout := s.Timeout
+    if timeout <= 0 { timeout = 15 * time.Second }
+    d := net.Dialer{Timeout: timeout}
+    conn, err := d.DialContext(ctx, "tcp", s.Addr)
+    if err != nil { return err }
+    _ = conn.SetDeadline(time.Now().Add(timeout))
+    host, _, _ := net.SplitHostPort(s.Addr)
+    c, err := smtp.NewClient(conn, host)
+    if err != nil { conn.Close(); return err }
+    defer c.Close()
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil { return err }
+    }
+    if s.Username != "" {
+        if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil { return Permanent(err) }
+    }
+    if err := c.Mail(from.Address); err != nil { return err }
+    if err := c.Rcpt(to.Address); err != nil { return rejected(err) }
+    w, err := c.Data()
+    if err != nil { return err }
+    if _, err := w.Write(msg); err != nil { return err }
+    if err := w.Close(); err != nil { return err }
+    return c.Quit()
+}
+
+// rejected treats 5xx replies to RCPT as permanent.
+func rejected(err error) error {
+    var te *textproto.Error
+    if errors.As(err, &te) && te.Code >= 500 { return Permanent(err) }
+    return err
+}
+
+func buildEmail(from, to *mail.Address, m Message) []byte {
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "From: %s\r\n", from.String())
+    fmt.Fprintf(&b, "To: %s\r\n", to.String())
+    fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Title))
+    fmt.Fprintf(&b, "Date: %s\r\n", m.CreatedAt.UTC().Format(time.RFC1123Z))
+    fmt.Fprintf(&b, "Message-ID: <notification-%d@autoads>\r\n", m.NotificationID)
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+    body := base64.StdEncoding.EncodeToString([]byte(m.Text()))
+    for len(body) > 76 {
+        b.WriteString(body[:76] + "\r\n")
+        body = body[76:]
+    }
+    b.WriteString(body + "\r\n")
+    return b.Bytes()
+}
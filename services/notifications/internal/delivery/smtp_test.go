@@ -0,0 +1,132 @@
+package delivery
+
+import (
+    "bufio"
+    "context"
+    "encoding/base64"
+    "mime"
+    "net"
+    "net/mail"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// smtpSink is a minimal local SMTP server that records the messages it accepts. Recipients in
+// reject get a 550.
+type smtpSink struct {
+    ln     net.Listener
+    reject map[string]bool
+    mu     sync.Mutex
+    msgs   []sinkMessage
+}
+
+type sinkMessage struct {
+    From string
+    To   []string
+    Data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    s := &smtpSink{ln: ln, reject: map[string]bool{}}
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go s.serve(c)
+        }
+    }()
+    return s
+}
+
+func (s *smtpSink) serve(c net.Conn) {
+    defer c.Close()
+    r, w := bufio.NewReader(c), bufio.NewWriter(c)
+    reply := func(line string) { w.WriteString(line + "\r\n"); w.Flush() }
+    reply("220 sink ESMTP")
+    var m sinkMessage
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil { return }
+        cmd := strings.ToUpper(strings.TrimSpace(line))
+        switch {
+        case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+            reply("250 sink")
+        case strings.HasPrefix(cmd, "MAIL FROM:"):
+            m = sinkMessage{From: strings.Trim(strings.TrimSpace(line)[10:], "<>")}
+            reply("250 ok")
+        case strings.HasPrefix(cmd, "RCPT TO:"):
+            to := strings.Trim(strings.TrimSpace(line)[8:], "<>")
+            if s.reject[to] { reply("550 no such user"); continue }
+            m.To = append(m.To, to)
+            reply("250 ok")
+        case cmd == "DATA":
+            reply("354 go ahead")
+            var b strings.Builder
+            for {
+                l, err := r.ReadString('\n')
+                if err != nil { return }
+                if l == ".\r\n" { break }
+                b.WriteString(l)
+            }
+            m.Data = b.String()
+            s.mu.Lock()
+            s.msgs = append(s.msgs, m)
+            s.mu.Unlock()
+            reply("250 queued")
+        case cmd == "QUIT":
+            reply("221 bye")
+            return
+        default:
+            reply("250 ok")
+        }
+    }
+}
+
+func (s *smtpSink) messages() []sinkMessage {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]sinkMessage(nil), s.msgs...)
+}
+
+func TestSMTPSendsToSink(t *testing.T) {
+    sink := newSMTPSink(t)
+    ch := &SMTP{Addr: sink.ln.Addr().String(), From: "AutoAds <no-reply@autoads.dev>", Timeout: 5 * time.Second}
+    m := Message{NotificationID: 42, UserID: "u1", EventType: "BatchOpsTaskFailed", Title: "批量任务失败", Summary: "proxy unavailable", CreatedAt: time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)}
+    if err := ch.Send(context.Background(), Endpoint{Kind: KindEmail, Target: "ops@example.com"}, m); err != nil {
+        t.Fatalf("Expected the email to be accepted, but got %v", err)
+    }
+    msgs := sink.messages()
+    if len(msgs) != 1 || msgs[0].From != "no-reply@autoads.dev" || len(msgs[0].To) != 1 || msgs[0].To[0] != "ops@example.com" {
+        t.Fatalf("Expected one message to ops@example.com, but got %+v", msgs)
+    }
+    parsed, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+    if err != nil { t.Fatalf("Expected a parseable message, but got %v", err) }
+    if subj, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subj != m.Title {
+        t.Errorf("Expected subject %q, but got %q", m.Title, subj)
+    }
+    raw, _ := bufio.NewReader(parsed.Body).ReadString(0)
+    body, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(strings.TrimSpace(raw), "\r\n", ""))
+    if err != nil { t.Fatalf("Expected a base64 body, but got %v", err) }
+    if !strings.Contains(string(body), "proxy unavailable") || !strings.Contains(string(body), "BatchOpsTaskFailed") {
+        t.Errorf("Expected the summary and event type in the body, but got %q", body)
+    }
+}
+
+func TestSMTPRejectedRecipientIsPermanent(t *testing.T) {
+    sink := newSMTPSink(t)
+    sink.reject["gone@example.com"] = true
+    ch := &SMTP{Addr: sink.ln.Addr().String(), From: "no-reply@autoads.dev", Timeout: 5 * time.Second}
+    err := ch.Send(context.Background(), Endpoint{Kind: KindEmail, Target: "gone@example.com"}, Message{Title: "t", CreatedAt: time.Now()})
+    if err == nil || !IsPermanent(err) {
+        t.Fatalf("Expected a permanent error for a rejected recipient, but got %v", err)
+    }
+    if err := ch.Send(context.Background(), Endpoint{Kind: KindEmail, Target: "not an address"}, Message{Title: "t"}); !IsPermanent(err) {
+        t.Errorf("Expected a permanent error for an invalid address, but got %v", err)
+    }
+}
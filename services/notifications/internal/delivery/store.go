@@ -0,0 +1,225 @@
+package delivery
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// Delivery statuses. A delivery is pending until sent or given up on (failed); sending marks a
+// claimed delivery, which is claimable again once its lease expires.
+const (
+    StatusPending = "pending"
+    StatusSending = "sending"
+    StatusSent    = "sent"
+    StatusFailed  = "failed"
+)
+
+// ErrNotFound is returned for unknown endpoints.
+var ErrNotFound = errors.New("not found")
+
+// Delivery is one message queued for one endpoint.
+type Delivery struct {
+    ID             int64      `json:"id"`
+    NotificationID int64      `json:"notificationId"`
+    UserID         string     `json:"userId"`
+    EventType      string     `json:"eventType"`
+    Channel        string     `json:"channel"`
+    EndpointID     int64      `json:"endpointId"`
+    Status         string     `json:"status"`
+    Attempts       int        `json:"attempts"`
+    MaxAttempts    int        `json:"maxAttempts"`
+    NextAttemptAt  time.Time  `json:"nextAttemptAt"`
+    LastError      string     `json:"lastError,omitempty"`
+    CreatedAt      time.Time  `json:"createdAt"`
+    SentAt         *time.Time `json:"sentAt,omitempty"`
+    Message        Message    `json:"-"`
+}
+
+// Store keeps endpoints and the delivery queue in Postgres.
+type Store struct{ db *sql.DB }
+
+func NewStore(db *sql.DB) *Store { return &Store{db: db} }
+
+// EnsureSchema creates the endpoint and delivery tables if missing (see schemas/sql/020).
+func (s *Store) EnsureSchema(ctx context.Context) error {
+    stmts := []string{
+        `CREATE TABLE IF NOT EXISTS notification_channels (
+            id BIGSERIAL PRIMARY KEY,
+            user_id TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            target TEXT NOT NULL,
+            secret TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        )`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_channels_user ON notification_channels(user_id, kind)`,
+        `CREATE TABLE IF NOT EXISTS notification_deliveries (
+            id BIGSERIAL PRIMARY KEY,
+            notification_id BIGINT NOT NULL,
+            user_id TEXT NOT NULL,
+            event_type TEXT NOT NULL,
+            channel TEXT NOT NULL,
+            endpoint_id BIGINT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INT NOT NULL DEFAULT 0,
+            max_attempts INT NOT NULL DEFAULT 6,
+            next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            last_error TEXT,
+            payload JSONB NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            sent_at TIMESTAMPTZ,
+            UNIQUE (notification_id, endpoint_id)
+        )`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_deliveries_due ON notification_deliveries(next_attempt_at) WHERE status IN ('pending','sending')`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_deliveries_user ON notification_deliveries(user_id, id DESC)`,
+    }
+    for _, q := range stmts {
+        if _, err := s.db.ExecContext(ctx, q); err != nil { return err }
+    }
+    return nil
+}
+
+const endpointColumns = `id, user_id, kind, name, target, secret, enabled, created_at`
+
+func scanEndpoint(row interface{ Scan(...any) error }) (*Endpoint, error) {
+    var ep Endpoint
+    if err := row.Scan(&ep.ID, &ep.UserID, &ep.Kind, &ep.Name, &ep.Target, &ep.Secret, &ep.Enabled, &ep.CreatedAt); err != nil { return nil, err }
+    return &ep, nil
+}
+
+// Endpoints lists a user's endpoints.
+func (s *Store) Endpoints(ctx context.Context, userID string) ([]*Endpoint, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT `+endpointColumns+` FROM notification_channels WHERE user_id=$1 ORDER BY id`, userID)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*Endpoint
+    for rows.Next() {
+        ep, err := scanEndpoint(rows)
+        if err != nil { return nil, err }
+        out = append(out, ep)
+    }
+    return out, rows.Err()
+}
+
+// Endpoint returns an endpoint by id (ErrNotFound if missing).
+func (s *Store) Endpoint(ctx context.Context, id int64) (*Endpoint, error) {
+    ep, err := scanEndpoint(s.db.QueryRowContext(ctx, `SELECT `+endpointColumns+` FROM notification_channels WHERE id=$1`, id))
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    return ep, err
+}
+
+// SaveEndpoint creates an endpoint (ID 0) or updates the user's endpoint ep.ID. An empty secret
+// on update keeps the current one.
+func (s *Store) SaveEndpoint(ctx context.Context, ep Endpoint) (*Endpoint, error) {
+    if ep.ID == 0 {
+        return scanEndpoint(s.db.QueryRowContext(ctx, `
+            INSERT INTO notification_channels(user_id, kind, name, target, secret, enabled, created_at, updated_at)
+            VALUES ($1,$2,$3,$4,$5,$6,NOW(),NOW())
+            RETURNING `+endpointColumns, ep.UserID, ep.Kind, ep.Name, ep.Target, ep.Secret, ep.Enabled))
+    }
+    out, err := scanEndpoint(s.db.QueryRowContext(ctx, `
+        UPDATE notification_channels SET kind=$3, name=$4, target=$5, secret=COALESCE(NULLIF($6,''), secret), enabled=$7, updated_at=NOW()
+        WHERE id=$1 AND user_id=$2
+        RETURNING `+endpointColumns, ep.ID, ep.UserID, ep.Kind, ep.Name, ep.Target, ep.Secret, ep.Enabled))
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    return out, err
+}
+
+// DeleteEndpoint removes the user's endpoint; queued deliveries to it fail on their next attempt.
+func (s *Store) DeleteEndpoint(ctx context.Context, userID string, id int64) error {
+    res, err := s.db.ExecContext(ctx, `DELETE FROM notification_channels WHERE id=$1 AND user_id=$2`, id, userID)
+    if err != nil { return err }
+    if n, _ := res.RowsAffected(); n == 0 { return ErrNotFound }
+    return nil
+}
+
+// Enqueue queues m for every enabled endpoint of the user whose kind an enabled rule routes
+// m.EventType, one of m.Covers or "*" to. Enqueuing the same notification twice is a no-op.
+func (s *Store) Enqueue(ctx context.Context, m Message, maxAttempts int) (int, error) {
+    if m.UserID == "" || m.NotificationID == 0 { return 0, nil }
+    payload, err := json.Marshal(m)
+    if err != nil { return 0, err }
+    covers, _ := json.Marshal(append([]string{}, m.Covers...))
+    res, err := s.db.ExecContext(ctx, `
+        INSERT INTO notification_deliveries(notification_id, user_id, event_type, channel, endpoint_id, max_attempts, payload)
+        SELECT $1, c.user_id, $3, c.kind, c.id, $4, $5::jsonb
+        FROM notification_channels c
+        WHERE c.user_id=$2 AND c.enabled AND EXISTS (
+            SELECT 1 FROM notification_rules r
+            WHERE r.kind='event' AND r.user_id=c.user_id AND r.enabled AND r.channel=c.kind AND (r.event_type IN ($3,'*') OR r.event_type IN (SELECT jsonb_array_elements_text($6::jsonb))))
+        ON CONFLICT (notification_id, endpoint_id) DO NOTHING
+    `, m.NotificationID, m.UserID, m.EventType, maxAttempts, string(payload), string(covers))
+    if err != nil { return 0, fmt.Errorf("enqueue deliveries: %w", err) }
+    n, _ := res.RowsAffected()
+    return int(n), nil
+}
+
+// Claim takes up to limit due deliveries, counts the attempt and leases them until now+lease so
+// that concurrent dispatchers skip them.
+func (s *Store) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+    rows, err := s.db.QueryContext(ctx, `
+        UPDATE notification_deliveries SET status='sending', attempts=attempts+1, next_attempt_at=$2, updated_at=NOW()
+        WHERE id IN (
+            SELECT id FROM notification_deliveries
+            WHERE status IN ('pending','sending') AND next_attempt_at <= $1
+            ORDER BY next_attempt_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED)
+        RETURNING id, notification_id, user_id, event_type, channel, endpoint_id, status, attempts, max_attempts, next_attempt_at, created_at, payload
+    `, now.UTC(), now.Add(lease).UTC(), limit)
+    if err != nil { return nil, fmt.Errorf("claim deliveries: %w", err) }
+    defer rows.Close()
+    var out []*Delivery
+    for rows.Next() {
+        var d Delivery
+        var payload []byte
+        if err := rows.Scan(&d.ID, &d.NotificationID, &d.UserID, &d.EventType, &d.Channel, &d.EndpointID, &d.Status, &d.Attempts, &d.MaxAttempts, &d.NextAttemptAt, &d.CreatedAt, &payload); err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal(payload, &d.Message); err != nil { return nil, fmt.Errorf("delivery %d payload: %w", d.ID, err) }
+        out = append(out, &d)
+    }
+    return out, rows.Err()
+}
+
+// Finish records the outcome of an attempt.
+func (s *Store) Finish(ctx context.Context, id int64, o Outcome) error {
+    _, err := s.db.ExecContext(ctx, `
+        UPDATE notification_deliveries
+        SET status=$2, next_attempt_at=$3, last_error=NULLIF($4,''), updated_at=NOW(),
+            sent_at=CASE WHEN $2='sent' THEN NOW() ELSE sent_at END
+        WHERE id=$1
+    `, id, o.Status, o.NextAttemptAt.UTC(), o.Error)
+    return err
+}
+
+// Deliveries lists a user's delivery records, newest first; notificationID > 0 narrows them to
+// one notification.
+func (s *Store) Deliveries(ctx context.Context, userID string, notificationID int64, limit int) ([]*Delivery, error) {
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, notification_id, user_id, event_type, channel, endpoint_id, status, attempts, max_attempts, next_attempt_at, COALESCE(last_error,''), created_at, sent_at
+        FROM notification_deliveries
+        WHERE user_id=$1 AND ($2=0 OR notification_id=$2)
+        ORDER BY id DESC LIMIT $3
+    `, userID, notificationID, limit)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*Delivery
+    for rows.Next() {
+        var d Delivery
+        var sentAt sql.NullTime
+        if err := rows.Scan(&d.ID, &d.NotificationID, &d.UserID, &d.EventType, &d.Channel, &d.EndpointID, &d.Status, &d.Attempts, &d.MaxAttempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &sentAt); err != nil {
+            return nil, err
+        }
+        if sentAt.Valid { t := sentAt.Time; d.SentAt = &t }
+        out = append(out, &d)
+    }
+    return out, rows.Err()
+}
@@ -0,0 +1,125 @@
+package delivery
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Webhook headers. SignatureHeader carries "t=<unix>,v1=<hex HMAC-SHA256 of "<t>.<body>">",
+// the scheme billing verifies for payment webhooks.
+const (
+    SignatureHeader = "X-Autoads-Signature"
+    EventHeader     = "X-Autoads-Event"
+    DeliveryHeader  = "X-Autoads-Delivery"
+)
+
+// ErrInvalidSignature is returned by Verify.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Webhook POSTs the message as JSON to the endpoint URL, signed with the endpoint secret.
+type Webhook struct {
+    Client *http.Client
+    Now    func() time.Time
+}
+
+func (h *Webhook) Kind() string { return KindWebhook }
+
+// WebhookPayload is the body of an outbound webhook.
+type WebhookPayload struct {
+    ID        string    `json:"id"`
+    Type      string    `json:"type"`
+    CreatedAt time.Time `json:"createdAt"`
+    Data      Message   `json:"data"`
+}
+
+func (h *Webhook) Send(ctx context.Context, ep Endpoint, m Message) error {
+    id := strconv.FormatInt(m.NotificationID, 10)
+    body, err := json.Marshal(WebhookPayload{ID: id, Type: m.EventType, CreatedAt: m.CreatedAt.UTC(), Data: m})
+    if err != nil { return Permanent(err) }
+    now := time.Now
+    if h.Now != nil { now = h.Now }
+    hdr := http.Header{}
+    hdr.Set(EventHeader, m.EventType)
+    hdr.Set(DeliveryHeader, id)
+    if ep.Secret != "" { hdr.Set(SignatureHeader, Sign(ep.Secret, body, now())) }
+    _, err = post(ctx, h.Client, ep.Target, body, hdr)
+    return err
+}
+
+// Sign returns the signature header value for payload at t.
+func Sign(secret string, payload []byte, t time.Time) string {
+    ts := strconv.FormatInt(t.Unix(), 10)
+    return "t=" + ts + ",v1=" + signature(secret, ts, payload)
+}
+
+func signature(secret, ts string, payload []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(ts))
+    mac.Write([]byte("."))
+    mac.Write(payload)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header against payload, for receivers written in Go.
+func Verify(secret string, payload []byte, header string, tolerance time.Duration, now time.Time) error {
+    var ts string
+    var sigs []string
+    for _, part := range strings.Split(header, ",") {
+        k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+        if !ok { continue }
+        switch k {
+        case "t":
+            ts = v
+        case "v1":
+            sigs = append(sigs, v)
+        }
+    }
+    sec, err := strconv.ParseInt(ts, 10, 64)
+    if err != nil || len(sigs) == 0 { return fmt.Errorf("%w: malformed header", ErrInvalidSignature) }
+    if age := now.Sub(time.Unix(sec, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+        return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+    }
+    want := signature(secret, ts, payload)
+    for _, s := range sigs {
+        if hmac.Equal([]byte(s), []byte(want)) { return nil }
+    }
+    return fmt.Errorf("%w: no matching signature", ErrInvalidSignature)
+}
+
+// post sends a JSON body and returns up to 64KiB of a 2xx response. 4xx responses other than 408
+// and 429 are permanent failures; other non-2xx responses are retried. Errors carry only the
+// status code: the body of a failed response never reaches the caller or last_error.
+func post(ctx context.Context, client *http.Client, url string, body []byte, hdr http.Header) ([]byte, error) {
+    if client == nil { client = NewClient(10 * time.Second) }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+    if err != nil { return nil, Permanent(err) }
+    for k, v := range hdr { req.Header[k] = v }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "autoads-notifications/1")
+    resp, err := client.Do(req)
+    if err != nil {
+        if errors.Is(err, ErrBlockedTarget) { return nil, Permanent(ErrBlockedTarget) }
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+        out, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+        return out, nil
+    }
+    err = fmt.Errorf("endpoint responded %d", resp.StatusCode)
+    if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+        return nil, Permanent(err)
+    }
+    return nil, err
+}
@@ -0,0 +1,108 @@
+package delivery
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+type received struct {
+    header http.Header
+    body   []byte
+}
+
+func receiver(t *testing.T, status int, reply string) (*httptest.Server, chan received) {
+    t.Helper()
+    got := make(chan received, 4)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, _ := io.ReadAll(r.Body)
+        got <- received{header: r.Header.Clone(), body: b}
+        w.WriteHeader(status)
+        _, _ = w.Write([]byte(reply))
+    }))
+    t.Cleanup(srv.Close)
+    return srv, got
+}
+
+var testMessage = Message{NotificationID: 7, UserID: "u1", EventType: "TokenDebited", Title: "扣费成功", Severity: "success", CreatedAt: time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)}
+
+func TestWebhookIsSigned(t *testing.T) {
+    srv, got := receiver(t, http.StatusOK, "")
+    now := time.Date(2026, 10, 1, 8, 0, 5, 0, time.UTC)
+    h := &Webhook{Client: srv.Client(), Now: func() time.Time { return now }}
+    if err := h.Send(context.Background(), Endpoint{Kind: KindWebhook, Target: srv.URL, Secret: "whsec_test"}, testMessage); err != nil {
+        t.Fatalf("Expected the webhook to be delivered, but got %v", err)
+    }
+    r := <-got
+    if err := Verify("whsec_test", r.body, r.header.Get(SignatureHeader), 5*time.Minute, now); err != nil {
+        t.Errorf("Expected a valid signature, but got %v", err)
+    }
+    if err := Verify("other", r.body, r.header.Get(SignatureHeader), 5*time.Minute, now); !errors.Is(err, ErrInvalidSignature) {
+        t.Errorf("Expected a mismatch with another secret, but got %v", err)
+    }
+    if r.header.Get(EventHeader) != "TokenDebited" || r.header.Get(DeliveryHeader) != "7" {
+        t.Errorf("Expected event and delivery headers, but got %v", r.header)
+    }
+    var p WebhookPayload
+    if err := json.Unmarshal(r.body, &p); err != nil || p.ID != "7" || p.Data.Title != testMessage.Title {
+        t.Errorf("Expected the notification in the payload, but got %+v (%v)", p, err)
+    }
+}
+
+func TestWebhookStatusClassification(t *testing.T) {
+    cases := []struct {
+        status    int
+        permanent bool
+    }{
+        {http.StatusGone, true},
+        {http.StatusTooManyRequests, false},
+        {http.StatusBadGateway, false},
+    }
+    for _, c := range cases {
+        srv, _ := receiver(t, c.status, "nope")
+        err := (&Webhook{Client: srv.Client()}).Send(context.Background(), Endpoint{Target: srv.URL}, testMessage)
+        if err == nil || IsPermanent(err) != c.permanent {
+            t.Errorf("status %d: Expected permanent=%v, but got %v", c.status, c.permanent, err)
+        }
+    }
+}
+
+func TestChatFlavors(t *testing.T) {
+    srv, got := receiver(t, http.StatusOK, "ok")
+    if err := NewSlack(srv.Client()).Send(context.Background(), Endpoint{Target: srv.URL}, testMessage); err != nil {
+        t.Fatalf("Expected the Slack post to succeed, but got %v", err)
+    }
+    var slack map[string]any
+    _ = json.Unmarshal((<-got).body, &slack)
+    if text, _ := slack["text"].(string); !strings.HasPrefix(text, "*扣费成功*\n") {
+        t.Errorf("Expected a bold title, but got %q", text)
+    }
+
+    lark, lgot := receiver(t, http.StatusOK, `{"code":0,"msg":"success"}`)
+    ch := NewLark(lark.Client())
+    ch.Now = func() time.Time { return time.Unix(1700000000, 0) }
+    if err := ch.Send(context.Background(), Endpoint{Target: lark.URL, Secret: "s3"}, testMessage); err != nil {
+        t.Fatalf("Expected the Lark post to succeed, but got %v", err)
+    }
+    var body struct {
+        MsgType   string `json:"msg_type"`
+        Timestamp string `json:"timestamp"`
+        Sign      string `json:"sign"`
+        Content   struct{ Text string `json:"text"` } `json:"content"`
+    }
+    _ = json.Unmarshal((<-lgot).body, &body)
+    if body.MsgType != "text" || body.Timestamp != "1700000000" || body.Sign != LarkSign("s3", "1700000000") || !strings.Contains(body.Content.Text, "TokenDebited") {
+        t.Errorf("Expected a signed text message, but got %+v", body)
+    }
+
+    rejecting, _ := receiver(t, http.StatusOK, `{"code":19021,"msg":"sign match fail"}`)
+    if err := NewLark(rejecting.Client()).Send(context.Background(), Endpoint{Target: rejecting.URL}, testMessage); !IsPermanent(err) {
+        t.Errorf("Expected a permanent error for a rejected Lark message, but got %v", err)
+    }
+}
@@ -0,0 +1,141 @@
+package digest
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// maxLines bounds the summary lines of one digest; the rest are counted.
+const maxLines = 20
+
+// Digest is one notification built from a user's released items.
+type Digest struct {
+    UserID    string
+    EventType string
+    Title     string
+    Message   map[string]any
+    // Covers lists the event types summarized, so channel rules for any of them route the digest.
+    Covers []string
+}
+
+// Group is a run of items with the same event type and aggregate.
+type Group struct {
+    EventType string         `json:"type"`
+    GroupKey  string         `json:"groupKey,omitempty"`
+    Title     string         `json:"title"`
+    Category  string         `json:"category"`
+    Count     int            `json:"count"`
+    First     time.Time      `json:"first"`
+    Last      time.Time      `json:"last"`
+    Data      map[string]any `json:"data,omitempty"`
+}
+
+var severityRank = map[string]int{"info": 0, "success": 1, "warn": 2, "error": 3}
+
+// Build summarizes items (oldest first) into one digest. Items of one event type and aggregate
+// collapse into a group that keeps the latest payload; groups keep first-seen order. A single
+// item, typically held over quiet hours, is passed on as it was.
+func Build(userID string, items []Item, loc *time.Location) Digest {
+    if len(items) == 1 {
+        it := items[0]
+        return Digest{UserID: userID, EventType: it.EventType, Title: it.Title, Message: it.Message, Covers: []string{it.EventType}}
+    }
+    if loc == nil { loc = time.UTC }
+    var groups []*Group
+    index := map[string]*Group{}
+    covers := []string{}
+    severity := "info"
+    for _, it := range items {
+        if severityRank[it.Severity] > severityRank[severity] { severity = it.Severity }
+        k := it.EventType + "|" + it.GroupKey
+        if it.GroupKey == "" { k = fmt.Sprintf("%s|#%d", it.EventType, it.ID) }
+        g, ok := index[k]
+        if !ok {
+            g = &Group{EventType: it.EventType, GroupKey: it.GroupKey, Title: it.Title, Category: it.Category, First: it.CreatedAt}
+            index[k] = g
+            groups = append(groups, g)
+            if !contains(covers, it.EventType) { covers = append(covers, it.EventType) }
+        }
+        g.Count++
+        g.Last = it.CreatedAt
+        if data, ok := it.Message["data"].(map[string]any); ok { g.Data = data }
+    }
+    var b strings.Builder
+    for i, g := range groups {
+        if i == maxLines {
+            fmt.Fprintf(&b, "… 另有 %d 项", len(groups)-maxLines)
+            break
+        }
+        if i > 0 { b.WriteString("\n") }
+        fmt.Fprintf(&b, "· %s", g.Title)
+        if g.Count > 1 { fmt.Fprintf(&b, " ×%d", g.Count) }
+        fmt.Fprintf(&b, "（%s）", g.Last.In(loc).Format("01-02 15:04"))
+    }
+    from, to := time.Time{}, time.Time{}
+    if len(items) > 0 { from, to = items[0].CreatedAt, items[len(items)-1].CreatedAt }
+    return Digest{
+        UserID:    userID,
+        EventType: EventType,
+        Title:     fmt.Sprintf("通知摘要：%d 条通知", len(items)),
+        Message: map[string]any{
+            "severity":  severity,
+            "category":  "digest",
+            "eventType": EventType,
+            "summary":   b.String(),
+            "time":      time.Now().UTC().Format(time.RFC3339),
+            "data":      map[string]any{"total": len(items), "groups": groups, "from": from.UTC().Format(time.RFC3339), "to": to.UTC().Format(time.RFC3339)},
+        },
+        Covers: covers,
+    }
+}
+
+func contains(xs []string, x string) bool {
+    for _, v := range xs { if v == x { return true } }
+    return false
+}
+
+// Builder releases due items and hands each user's digest to Deliver.
+type Builder struct {
+    Store   *Store
+    Deliver func(ctx context.Context, d Digest) error
+    Now     func() time.Time
+    Batch   int
+}
+
+// RunOnce builds the digests due now and returns how many were delivered.
+func (b *Builder) RunOnce(ctx context.Context) (int, error) {
+    now := time.Now()
+    if b.Now != nil { now = b.Now() }
+    batch := b.Batch
+    if batch <= 0 { batch = 100 }
+    users, err := b.Store.DueUsers(ctx, now, batch)
+    if err != nil { return 0, err }
+    sent := 0
+    for _, uid := range users {
+        prefs, err := b.Store.Preferences(ctx, uid)
+        if err != nil { prefs = Defaults(uid) }
+        n, err := b.Store.Release(ctx, uid, now, func(items []Item) error {
+            return b.Deliver(ctx, Build(uid, items, prefs.Location()))
+        })
+        if err != nil { log.Printf("notifications: digest for %s failed: %v", uid, err); continue }
+        if n > 0 { sent++ }
+    }
+    return sent, nil
+}
+
+// Run builds due digests every interval until ctx is done.
+func (b *Builder) Run(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        if _, err := b.RunOnce(ctx); err != nil { log.Printf("notifications: digest run failed: %v", err) }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
@@ -0,0 +1,44 @@
+package digest
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestBuildCollapsesGroups(t *testing.T) {
+    t0 := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+    step := func(id int64, analysis string, min int) Item {
+        return Item{ID: id, EventType: "WorkflowStepCompleted", Category: "workflow", Severity: "info", GroupKey: "WorkflowStepCompleted:" + analysis, Title: "工作流步骤完成", CreatedAt: t0.Add(time.Duration(min) * time.Minute),
+            Message: map[string]any{"data": map[string]any{"analysisId": analysis, "name": id}}}
+    }
+    items := []Item{step(1, "a1", 0), step(2, "a1", 1), step(3, "a2", 2), step(4, "a1", 3),
+        {ID: 5, EventType: "TokenDebited", Category: "billing", Severity: "success", Title: "扣费成功", CreatedAt: t0.Add(4 * time.Minute)},
+        {ID: 6, EventType: "TokenDebited", Category: "billing", Severity: "success", Title: "扣费成功", CreatedAt: t0.Add(5 * time.Minute)},
+        step(7, "a1", 6)}
+    d := Build("u1", items, time.UTC)
+    if d.EventType != EventType || d.Title != "通知摘要：7 条通知" {
+        t.Fatalf("Expected a digest of 7 notifications, but got %q %q", d.EventType, d.Title)
+    }
+    groups := d.Message["data"].(map[string]any)["groups"].([]*Group)
+    counts := []int{}
+    for _, g := range groups { counts = append(counts, g.Count) }
+    if len(groups) != 4 || counts[0] != 4 || counts[1] != 1 || groups[0].Data["name"] != int64(7) {
+        t.Errorf("Expected a1 steps collapsed with the latest payload, but got %v", counts)
+    }
+    summary := d.Message["summary"].(string)
+    if !strings.HasPrefix(summary, "· 工作流步骤完成 ×4（10-01 08:06）") || strings.Count(summary, "扣费成功") != 2 {
+        t.Errorf("Unexpected summary %q", summary)
+    }
+    if d.Message["severity"] != "success" || strings.Join(d.Covers, ",") != "WorkflowStepCompleted,TokenDebited" {
+        t.Errorf("Expected the highest severity and covered types, but got %v %v", d.Message["severity"], d.Covers)
+    }
+}
+
+func TestBuildSingleItemPassesThrough(t *testing.T) {
+    it := Item{ID: 9, EventType: "BatchOpsTaskCompleted", Title: "批量任务完成", Message: map[string]any{"severity": "success"}}
+    d := Build("u1", []Item{it}, nil)
+    if d.EventType != it.EventType || d.Title != it.Title || d.Message["severity"] != "success" {
+        t.Errorf("Expected the held notification unchanged, but got %+v", d)
+    }
+}
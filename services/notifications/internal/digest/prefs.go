@@ -0,0 +1,141 @@
+// Package digest decides when a notification reaches its user: immediately, held for an hourly or
+// daily digest of its category, or held until the user's quiet hours end. Held notifications are
+// summarized into one digest notification by the Builder, and repeated events of one aggregate
+// (an analysis, task or offer) collapse into a single unread notification.
+package digest
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    // runtime images ship without a zoneinfo database
+    _ "time/tzdata"
+)
+
+const (
+    ModeImmediate = "immediate"
+    ModeHourly    = "hourly"
+    ModeDaily     = "daily"
+
+    // EventType is the notification type of a digest summary.
+    EventType = "NotificationDigest"
+)
+
+var Modes = []string{ModeImmediate, ModeHourly, ModeDaily}
+
+var ErrInvalid = errors.New("invalid preferences")
+
+// Preferences are a user's delivery preferences. Clock times are "HH:MM" in Timezone; quiet hours
+// may wrap midnight and are off when QuietStart or QuietEnd is empty.
+type Preferences struct {
+    UserID     string            `json:"userId"`
+    Timezone   string            `json:"timezone"`
+    QuietStart string            `json:"quietStart"`
+    QuietEnd   string            `json:"quietEnd"`
+    DigestAt   string            `json:"digestAt"`
+    Default    string            `json:"default"`
+    Categories map[string]string `json:"categories"`
+    Collapse   bool              `json:"collapse"`
+    UpdatedAt  *time.Time        `json:"updatedAt,omitempty"`
+}
+
+// Defaults are the preferences of a user who never saved any: everything immediate, collapsing on.
+func Defaults(userID string) Preferences {
+    return Preferences{UserID: userID, Timezone: "UTC", DigestAt: "09:00", Default: ModeImmediate, Categories: map[string]string{}, Collapse: true}
+}
+
+// Normalize fills defaults and validates the timezone, clock times and modes. Errors wrap ErrInvalid.
+func (p *Preferences) Normalize() error {
+    p.Timezone = strings.TrimSpace(p.Timezone)
+    if p.Timezone == "" { p.Timezone = "UTC" }
+    if _, err := time.LoadLocation(p.Timezone); err != nil { return fmt.Errorf("%w: unknown timezone %q", ErrInvalid, p.Timezone) }
+    p.QuietStart, p.QuietEnd, p.DigestAt = strings.TrimSpace(p.QuietStart), strings.TrimSpace(p.QuietEnd), strings.TrimSpace(p.DigestAt)
+    if (p.QuietStart == "") != (p.QuietEnd == "") { return fmt.Errorf("%w: quietStart and quietEnd go together", ErrInvalid) }
+    if p.DigestAt == "" { p.DigestAt = "09:00" }
+    for _, c := range []string{p.QuietStart, p.QuietEnd, p.DigestAt} {
+        if _, ok := clock(c); c != "" && !ok { return fmt.Errorf("%w: %q is not an HH:MM time", ErrInvalid, c) }
+    }
+    p.Default = strings.ToLower(strings.TrimSpace(p.Default))
+    if p.Default == "" { p.Default = ModeImmediate }
+    if !validMode(p.Default) { return fmt.Errorf("%w: mode must be one of %s", ErrInvalid, strings.Join(Modes, "|")) }
+    cats := map[string]string{}
+    for k, v := range p.Categories {
+        k, v = strings.ToLower(strings.TrimSpace(k)), strings.ToLower(strings.TrimSpace(v))
+        if k == "" { continue }
+        if !validMode(v) { return fmt.Errorf("%w: mode of %s must be one of %s", ErrInvalid, k, strings.Join(Modes, "|")) }
+        cats[k] = v
+    }
+    p.Categories = cats
+    return nil
+}
+
+// ModeFor returns the mode of a notification category.
+func (p Preferences) ModeFor(category string) string {
+    if m, ok := p.Categories[strings.ToLower(category)]; ok { return m }
+    if p.Default == "" { return ModeImmediate }
+    return p.Default
+}
+
+// Location is the user's timezone, UTC when unknown.
+func (p Preferences) Location() *time.Location {
+    if loc, err := time.LoadLocation(p.Timezone); err == nil && p.Timezone != "" { return loc }
+    return time.UTC
+}
+
+// Quiet reports whether t falls in the user's quiet hours.
+func (p Preferences) Quiet(t time.Time) bool {
+    start, ok1 := clock(p.QuietStart)
+    end, ok2 := clock(p.QuietEnd)
+    if !ok1 || !ok2 || start == end { return false }
+    lt := t.In(p.Location())
+    m := lt.Hour()*60 + lt.Minute()
+    if start < end { return m >= start && m < end }
+    return m >= start || m < end
+}
+
+// QuietUntil returns the end of the quiet period that contains t.
+func (p Preferences) QuietUntil(t time.Time) time.Time {
+    end, _ := clock(p.QuietEnd)
+    return nextClock(t, end, p.Location())
+}
+
+// Decide returns when a notification of category and severity created at t should be released,
+// or the zero time when it goes out now. Errors bypass quiet hours but not a chosen digest.
+func (p Preferences) Decide(category, severity string, t time.Time) time.Time {
+    loc := p.Location()
+    var at time.Time
+    switch p.ModeFor(category) {
+    case ModeHourly:
+        lt := t.In(loc)
+        at = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, loc).Add(time.Hour)
+    case ModeDaily:
+        m, _ := clock(p.DigestAt)
+        at = nextClock(t, m, loc)
+    default:
+        if severity == "error" || !p.Quiet(t) { return time.Time{} }
+        return p.QuietUntil(t)
+    }
+    if p.Quiet(at) { at = p.QuietUntil(at) }
+    return at
+}
+
+// nextClock returns the first time after t at minute-of-day m in loc.
+func nextClock(t time.Time, m int, loc *time.Location) time.Time {
+    lt := t.In(loc)
+    at := time.Date(lt.Year(), lt.Month(), lt.Day(), m/60, m%60, 0, 0, loc)
+    if !at.After(t) { at = time.Date(lt.Year(), lt.Month(), lt.Day()+1, m/60, m%60, 0, 0, loc) }
+    return at
+}
+
+// clock parses "HH:MM" into minutes after midnight.
+func clock(s string) (int, bool) {
+    t, err := time.Parse("15:04", s)
+    if err != nil { return 0, false }
+    return t.Hour()*60 + t.Minute(), true
+}
+
+func validMode(m string) bool {
+    for _, v := range Modes { if v == m { return true } }
+    return false
+}
@@ -0,0 +1,75 @@
+package digest
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestQuietHours(t *testing.T) {
+    p := Defaults("u1")
+    p.Timezone, p.QuietStart, p.QuietEnd = "Asia/Shanghai", "22:00", "07:30"
+    if err := p.Normalize(); err != nil { t.Fatalf("Expected valid preferences, but got %v", err) }
+    cst := p.Location()
+    cases := []struct {
+        at    time.Time
+        quiet bool
+        until time.Time
+    }{
+        {time.Date(2026, 10, 1, 23, 15, 0, 0, cst), true, time.Date(2026, 10, 2, 7, 30, 0, 0, cst)},
+        {time.Date(2026, 10, 2, 6, 0, 0, 0, cst), true, time.Date(2026, 10, 2, 7, 30, 0, 0, cst)},
+        {time.Date(2026, 10, 2, 7, 30, 0, 0, cst), false, time.Time{}},
+        {time.Date(2026, 10, 2, 12, 0, 0, 0, cst), false, time.Time{}},
+    }
+    for _, c := range cases {
+        at := c.at.UTC()
+        if got := p.Quiet(at); got != c.quiet {
+            t.Errorf("%v: Expected quiet=%v, but got %v", c.at, c.quiet, got)
+        }
+        if c.quiet && !p.QuietUntil(at).Equal(c.until) {
+            t.Errorf("%v: Expected quiet hours to end at %v, but got %v", c.at, c.until, p.QuietUntil(at))
+        }
+    }
+}
+
+func TestDecide(t *testing.T) {
+    p := Defaults("u1")
+    p.Timezone, p.QuietStart, p.QuietEnd, p.DigestAt = "America/New_York", "21:00", "08:00", "07:00"
+    p.Categories = map[string]string{"workflow": "hourly", "Billing": "DAILY"}
+    if err := p.Normalize(); err != nil { t.Fatalf("Expected valid preferences, but got %v", err) }
+    ny := p.Location()
+    at := func(d, h, m int) time.Time { return time.Date(2026, 10, d, h, m, 0, 0, ny) }
+    cases := []struct {
+        name     string
+        category string
+        severity string
+        now      time.Time
+        want     time.Time
+    }{
+        {"immediate by day", "offer", "info", at(1, 14, 0), time.Time{}},
+        {"held over quiet hours", "offer", "info", at(1, 23, 0), at(2, 8, 0)},
+        {"errors bypass quiet hours", "batchopen", "error", at(1, 23, 0), time.Time{}},
+        {"hourly", "workflow", "info", at(1, 14, 20), at(1, 15, 0)},
+        {"hourly into quiet hours", "workflow", "info", at(1, 20, 40), at(2, 8, 0)},
+        {"daily digest time is quiet", "billing", "info", at(1, 10, 0), at(2, 8, 0)},
+    }
+    for _, c := range cases {
+        if got := p.Decide(c.category, c.severity, c.now); !got.Equal(c.want) {
+            t.Errorf("%s: Expected %v, but got %v", c.name, c.want, got)
+        }
+    }
+}
+
+func TestNormalizeRejects(t *testing.T) {
+    cases := map[string]Preferences{
+        "timezone":   {Timezone: "Mars/Olympus"},
+        "half quiet": {QuietStart: "22:00"},
+        "clock":      {QuietStart: "25:00", QuietEnd: "07:00"},
+        "mode":       {Categories: map[string]string{"billing": "weekly"}},
+    }
+    for name, p := range cases {
+        if err := p.Normalize(); !errors.Is(err, ErrInvalid) {
+            t.Errorf("%s: Expected ErrInvalid, but got %v", name, err)
+        }
+    }
+}
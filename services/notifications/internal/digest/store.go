@@ -0,0 +1,202 @@
+package digest
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// Item is a notification held for a digest or until quiet hours end.
+type Item struct {
+    ID        int64          `json:"id"`
+    UserID    string         `json:"userId"`
+    EventType string         `json:"type"`
+    Category  string         `json:"category"`
+    Severity  string         `json:"severity"`
+    GroupKey  string         `json:"groupKey,omitempty"`
+    Title     string         `json:"title"`
+    Message   map[string]any `json:"message"`
+    ReleaseAt time.Time      `json:"releaseAt"`
+    CreatedAt time.Time      `json:"createdAt"`
+}
+
+// Store keeps preferences and held items, and collapses repeats in user_notifications.
+type Store struct {
+    db *sql.DB
+    // w is what Hold and Collapse write through: db, or the transaction given to In.
+    w writer
+    // CollapseWindow bounds how old an unread notification may be to absorb a repeat (default 15m).
+    CollapseWindow time.Duration
+}
+
+func NewStore(db *sql.DB) *Store { return &Store{db: db, w: db, CollapseWindow: 15 * time.Minute} }
+
+type writer interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// In returns a copy of the store whose Hold and Collapse write through tx, so they commit or roll
+// back with the caller's other writes.
+func (s *Store) In(tx *sql.Tx) *Store {
+    c := *s
+    c.w = tx
+    return &c
+}
+
+// EnsureSchema creates the preference and digest tables and the collapsing columns of
+// user_notifications, which must already exist.
+func (s *Store) EnsureSchema(ctx context.Context) error {
+    stmts := []string{
+        `CREATE TABLE IF NOT EXISTS notification_preferences (
+            user_id      TEXT PRIMARY KEY,
+            timezone     TEXT NOT NULL DEFAULT 'UTC',
+            quiet_start  TEXT NOT NULL DEFAULT '',
+            quiet_end    TEXT NOT NULL DEFAULT '',
+            digest_at    TEXT NOT NULL DEFAULT '09:00',
+            default_mode TEXT NOT NULL DEFAULT 'immediate',
+            categories   JSONB NOT NULL DEFAULT '{}'::jsonb,
+            collapse     BOOLEAN NOT NULL DEFAULT TRUE,
+            updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        )`,
+        `CREATE TABLE IF NOT EXISTS notification_digest_items (
+            id          BIGSERIAL PRIMARY KEY,
+            user_id     TEXT NOT NULL,
+            event_type  TEXT NOT NULL,
+            category    TEXT NOT NULL DEFAULT 'general',
+            severity    TEXT NOT NULL DEFAULT 'info',
+            group_key   TEXT NOT NULL DEFAULT '',
+            title       TEXT NOT NULL,
+            message     JSONB NOT NULL DEFAULT '{}'::jsonb,
+            release_at  TIMESTAMPTZ NOT NULL,
+            created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        )`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_digest_items_release ON notification_digest_items(release_at)`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_digest_items_user ON notification_digest_items(user_id, release_at)`,
+        `ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS group_key TEXT`,
+        `ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS repeat_count INT NOT NULL DEFAULT 1`,
+        `ALTER TABLE user_notifications ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+        `CREATE INDEX IF NOT EXISTS ix_user_notifications_group ON user_notifications(user_id, group_key, id DESC) WHERE group_key IS NOT NULL`,
+    }
+    for _, q := range stmts {
+        if _, err := s.db.ExecContext(ctx, q); err != nil { return fmt.Errorf("digest schema: %w", err) }
+    }
+    return nil
+}
+
+// Preferences returns the user's saved preferences, or Defaults.
+func (s *Store) Preferences(ctx context.Context, userID string) (Preferences, error) {
+    p := Defaults(userID)
+    var cats string
+    var updated time.Time
+    err := s.db.QueryRowContext(ctx, `SELECT timezone, quiet_start, quiet_end, digest_at, default_mode, categories::text, collapse, updated_at FROM notification_preferences WHERE user_id=$1`, userID).
+        Scan(&p.Timezone, &p.QuietStart, &p.QuietEnd, &p.DigestAt, &p.Default, &cats, &p.Collapse, &updated)
+    if errors.Is(err, sql.ErrNoRows) { return p, nil }
+    if err != nil { return p, err }
+    _ = json.Unmarshal([]byte(cats), &p.Categories)
+    if p.Categories == nil { p.Categories = map[string]string{} }
+    p.UpdatedAt = &updated
+    return p, nil
+}
+
+// SavePreferences normalizes and stores p.
+func (s *Store) SavePreferences(ctx context.Context, p Preferences) (Preferences, error) {
+    if err := p.Normalize(); err != nil { return p, err }
+    cats, _ := json.Marshal(p.Categories)
+    var updated time.Time
+    err := s.db.QueryRowContext(ctx, `
+        INSERT INTO notification_preferences(user_id, timezone, quiet_start, quiet_end, digest_at, default_mode, categories, collapse, updated_at)
+        VALUES ($1,$2,$3,$4,$5,$6,$7::jsonb,$8,NOW())
+        ON CONFLICT (user_id) DO UPDATE SET timezone=EXCLUDED.timezone, quiet_start=EXCLUDED.quiet_start, quiet_end=EXCLUDED.quiet_end,
+            digest_at=EXCLUDED.digest_at, default_mode=EXCLUDED.default_mode, categories=EXCLUDED.categories, collapse=EXCLUDED.collapse, updated_at=NOW()
+        RETURNING updated_at
+    `, p.UserID, p.Timezone, p.QuietStart, p.QuietEnd, p.DigestAt, p.Default, string(cats), p.Collapse).Scan(&updated)
+    if err != nil { return p, err }
+    p.UpdatedAt = &updated
+    return p, nil
+}
+
+// Hold stores an item until its ReleaseAt.
+func (s *Store) Hold(ctx context.Context, it Item) error {
+    mb, _ := json.Marshal(it.Message)
+    _, err := s.w.ExecContext(ctx, `INSERT INTO notification_digest_items(user_id, event_type, category, severity, group_key, title, message, release_at) VALUES ($1,$2,$3,$4,$5,$6,$7::jsonb,$8)`,
+        it.UserID, it.EventType, it.Category, it.Severity, it.GroupKey, it.Title, string(mb), it.ReleaseAt.UTC())
+    return err
+}
+
+// Pending lists the user's held items, oldest first.
+func (s *Store) Pending(ctx context.Context, userID string, limit int) ([]Item, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT `+itemColumns+` FROM notification_digest_items WHERE user_id=$1 ORDER BY id LIMIT $2`, userID, limit)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    return scanItems(rows)
+}
+
+// DueUsers returns users with items released at or before now.
+func (s *Store) DueUsers(ctx context.Context, now time.Time, limit int) ([]string, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM notification_digest_items WHERE release_at <= $1 LIMIT $2`, now.UTC(), limit)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []string
+    for rows.Next() {
+        var u string
+        if err := rows.Scan(&u); err != nil { return nil, err }
+        out = append(out, u)
+    }
+    return out, rows.Err()
+}
+
+// Release removes the user's items due at now and passes them to fn; the items are kept when fn
+// fails. Concurrent releases of one user never see the same item.
+func (s *Store) Release(ctx context.Context, userID string, now time.Time, fn func([]Item) error) (int, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return 0, err }
+    defer tx.Rollback()
+    rows, err := tx.QueryContext(ctx, `DELETE FROM notification_digest_items WHERE user_id=$1 AND release_at <= $2 RETURNING `+itemColumns, userID, now.UTC())
+    if err != nil { return 0, err }
+    items, err := scanItems(rows)
+    rows.Close()
+    if err != nil { return 0, err }
+    if len(items) == 0 { return 0, nil }
+    if err := fn(items); err != nil { return 0, err }
+    return len(items), tx.Commit()
+}
+
+// Collapse folds a repeat of groupKey into the user's newest unread notification of that group
+// created within CollapseWindow: the title gets a "×n" suffix and the message is replaced. It
+// returns the notification id and count, or 0 when there is nothing to fold into.
+func (s *Store) Collapse(ctx context.Context, userID, groupKey, title string, msg map[string]any) (int64, int, error) {
+    if groupKey == "" { return 0, 0, nil }
+    mb, _ := json.Marshal(msg)
+    var id int64
+    var n int
+    err := s.w.QueryRowContext(ctx, `
+        UPDATE user_notifications n SET repeat_count=n.repeat_count+1, title=$4 || ' ×' || (n.repeat_count+1),
+            message=jsonb_set($5::jsonb, '{count}', to_jsonb(n.repeat_count+1))::text, updated_at=NOW()
+        WHERE n.id = (
+            SELECT id FROM user_notifications
+            WHERE user_id=$1 AND group_key=$2 AND created_at > NOW() - make_interval(secs => $3)
+              AND id > COALESCE((SELECT last_read_id FROM user_notification_state WHERE user_id=$1), 0)
+            ORDER BY id DESC LIMIT 1)
+        RETURNING n.id, n.repeat_count
+    `, userID, groupKey, s.CollapseWindow.Seconds(), title, string(mb)).Scan(&id, &n)
+    if errors.Is(err, sql.ErrNoRows) { return 0, 0, nil }
+    return id, n, err
+}
+
+const itemColumns = `id, user_id, event_type, category, severity, group_key, title, message::text, release_at, created_at`
+
+func scanItems(rows *sql.Rows) ([]Item, error) {
+    var out []Item
+    for rows.Next() {
+        var it Item
+        var msg string
+        if err := rows.Scan(&it.ID, &it.UserID, &it.EventType, &it.Category, &it.Severity, &it.GroupKey, &it.Title, &msg, &it.ReleaseAt, &it.CreatedAt); err != nil { return nil, err }
+        _ = json.Unmarshal([]byte(msg), &it.Message)
+        out = append(out, it)
+    }
+    return out, rows.Err()
+}
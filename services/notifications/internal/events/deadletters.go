@@ -0,0 +1,132 @@
+package events
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+// DeadLetter is an event one handler failed on.
+type DeadLetter struct {
+    ID         int64       `json:"id"`
+    Handler    string      `json:"handler"`
+    EventType  string      `json:"eventType"`
+    EventID    string      `json:"eventId"`
+    Envelope   ev.Envelope `json:"envelope"`
+    Error      string      `json:"error"`
+    Attempts   int         `json:"attempts"`
+    Replays    int         `json:"replays"`
+    CreatedAt  time.Time   `json:"createdAt"`
+    ResolvedAt *time.Time  `json:"resolvedAt,omitempty"`
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetters keeps failed handler runs in notification_dead_letters.
+type DeadLetters struct{ db *sql.DB }
+
+func NewDeadLetters(db *sql.DB) *DeadLetters { return &DeadLetters{db: db} }
+
+func (s *DeadLetters) EnsureSchema(ctx context.Context) error {
+    stmts := []string{
+        `CREATE TABLE IF NOT EXISTS notification_dead_letters (
+            id          BIGSERIAL PRIMARY KEY,
+            handler     TEXT NOT NULL,
+            event_type  TEXT NOT NULL,
+            event_id    TEXT NOT NULL DEFAULT '',
+            envelope    JSONB NOT NULL,
+            error       TEXT NOT NULL DEFAULT '',
+            attempts    INT NOT NULL DEFAULT 1,
+            replays     INT NOT NULL DEFAULT 0,
+            created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            resolved_at TIMESTAMPTZ
+        )`,
+        `CREATE INDEX IF NOT EXISTS ix_notification_dead_letters_open ON notification_dead_letters(handler, id DESC) WHERE resolved_at IS NULL`,
+        // events a once-only handler has run on (see Subscriber.notifyOnce)
+        `CREATE TABLE IF NOT EXISTS notification_handled_events (
+            handler    TEXT NOT NULL,
+            event_id   TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (handler, event_id)
+        )`,
+    }
+    for _, q := range stmts {
+        if _, err := s.db.ExecContext(ctx, q); err != nil { return err }
+    }
+    return nil
+}
+
+func (s *DeadLetters) Put(ctx context.Context, d DeadLetter) error {
+    b, err := json.Marshal(d.Envelope)
+    if err != nil { return err }
+    _, err = s.db.ExecContext(ctx, `INSERT INTO notification_dead_letters(handler, event_type, event_id, envelope, error, attempts) VALUES ($1,$2,$3,$4::jsonb,$5,$6)`,
+        d.Handler, d.EventType, d.EventID, string(b), d.Error, d.Attempts)
+    return err
+}
+
+// DeadLetterFilter narrows List; empty fields match everything.
+type DeadLetterFilter struct {
+    Handler   string
+    EventType string
+    // Resolved also lists dead letters that were replayed successfully.
+    Resolved bool
+    Limit    int
+}
+
+// List returns dead letters, newest first.
+func (s *DeadLetters) List(ctx context.Context, f DeadLetterFilter) ([]DeadLetter, error) {
+    where := []string{"TRUE"}
+    args := []any{}
+    if f.Handler != "" { args = append(args, f.Handler); where = append(where, "handler=$"+strconv.Itoa(len(args))) }
+    if f.EventType != "" { args = append(args, f.EventType); where = append(where, "event_type=$"+strconv.Itoa(len(args))) }
+    if !f.Resolved { where = append(where, "resolved_at IS NULL") }
+    limit := f.Limit
+    if limit <= 0 || limit > 500 { limit = 100 }
+    args = append(args, limit)
+    rows, err := s.db.QueryContext(ctx, `SELECT `+deadLetterColumns+` FROM notification_dead_letters WHERE `+strings.Join(where, " AND ")+` ORDER BY id DESC LIMIT $`+strconv.Itoa(len(args)), args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []DeadLetter
+    for rows.Next() {
+        d, err := scanDeadLetter(rows)
+        if err != nil { return nil, err }
+        out = append(out, d)
+    }
+    return out, rows.Err()
+}
+
+func (s *DeadLetters) Get(ctx context.Context, id int64) (DeadLetter, error) {
+    d, err := scanDeadLetter(s.db.QueryRowContext(ctx, `SELECT `+deadLetterColumns+` FROM notification_dead_letters WHERE id=$1`, id))
+    if errors.Is(err, sql.ErrNoRows) { return d, ErrDeadLetterNotFound }
+    return d, err
+}
+
+// Replayed records a replay of d; a successful one (replayErr nil) resolves it.
+func (s *DeadLetters) Replayed(ctx context.Context, id int64, replayErr error) error {
+    if replayErr == nil {
+        _, err := s.db.ExecContext(ctx, `UPDATE notification_dead_letters SET replays=replays+1, resolved_at=NOW() WHERE id=$1`, id)
+        return err
+    }
+    _, err := s.db.ExecContext(ctx, `UPDATE notification_dead_letters SET replays=replays+1, error=$2 WHERE id=$1`, id, replayErr.Error())
+    return err
+}
+
+const deadLetterColumns = `id, handler, event_type, event_id, envelope::text, error, attempts, replays, created_at, resolved_at`
+
+type rowScanner interface{ Scan(dest ...any) error }
+
+func scanDeadLetter(row rowScanner) (DeadLetter, error) {
+    var d DeadLetter
+    var env string
+    var resolved sql.NullTime
+    if err := row.Scan(&d.ID, &d.Handler, &d.EventType, &d.EventID, &env, &d.Error, &d.Attempts, &d.Replays, &d.CreatedAt, &resolved); err != nil { return d, err }
+    _ = json.Unmarshal([]byte(env), &d.Envelope)
+    if resolved.Valid { d.ResolvedAt = &resolved.Time }
+    return d, nil
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+    "context"
+    "time"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+// notifyTypes are the events that become in-app notifications.
+var notifyTypes = []string{
+    ev.EventSiterankRequested, ev.EventSiterankCompleted, ev.EventOfferCreated,
+    ev.EventWorkflowStarted, ev.EventWorkflowStepCompleted, ev.EventWorkflowCompleted,
+    ev.EventBatchOpsTaskQueued, ev.EventBatchOpsTaskStarted, ev.EventBatchOpsTaskCompleted, ev.EventBatchOpsTaskFailed,
+    ev.EventBrowserExecRequested, ev.EventBrowserExecCompleted,
+    ev.EventTokenReserved, ev.EventTokenDebited, ev.EventTokenReverted,
+    ev.EventNotificationCreated,
+}
+
+var (
+    notifyPolicy     = Policy{Attempts: 3, Backoff: 200 * time.Millisecond, Timeout: 10 * time.Second}
+    projectionPolicy = Policy{Attempts: 3, Backoff: 500 * time.Millisecond, Timeout: 5 * time.Second}
+)
+
+type offerCreated struct {
+    OfferID     string `json:"offerId"`
+    UserID      string `json:"userId"`
+    Name        string `json:"name"`
+    OriginalURL string `json:"originalUrl"`
+    Status      string `json:"status"`
+}
+
+type siterankCompleted struct {
+    AnalysisID string   `json:"analysisId"`
+    OfferID    string   `json:"offerId"`
+    UserID     string   `json:"userId"`
+    Score      *float64 `json:"score"`
+    // Mode is "multi-geo" for a geo run, which does not evaluate the offer
+    Mode       string   `json:"mode"`
+}
+
+// registry declares what the subscriber does with each event, in order.
+func (s *Subscriber) registry() *Registry {
+    r := NewRegistry(s.dead)
+    On(r, "notification", notifyPolicy, func(ctx context.Context, env ev.Envelope, p map[string]any) error {
+        if p == nil { p = map[string]any{} }
+        return s.notifyOnce(ctx, env, p)
+    }, notifyTypes...)
+    On(r, "offer.created", projectionPolicy, func(ctx context.Context, _ ev.Envelope, p offerCreated) error {
+        return s.projectOfferCreated(ctx, p)
+    }, ev.EventOfferCreated)
+    On(r, "offer.evaluated", projectionPolicy, func(ctx context.Context, _ ev.Envelope, p siterankCompleted) error {
+        return s.projectOfferEvaluated(ctx, p)
+    }, ev.EventSiterankCompleted)
+    // "BatchopenTask" is written by batchopen itself (versioned, see 017), which also runs its billing
+    // saga (pkg/saga); no projection here
+    return r
+}
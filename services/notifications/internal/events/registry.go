@@ -0,0 +1,158 @@
+package events
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+// ErrorPolicy decides what happens when a handler has used up its attempts.
+type ErrorPolicy int
+
+const (
+    // OnErrorDeadLetter records the event for the handler, so it can be inspected and replayed.
+    OnErrorDeadLetter ErrorPolicy = iota
+    // OnErrorDrop only logs the failure; for best-effort side effects.
+    OnErrorDrop
+)
+
+// Policy is the retry and error policy of one handler.
+type Policy struct {
+    // Attempts is how often the handler runs before it gives up (default 1).
+    Attempts int
+    // Backoff is the pause before the second attempt; it doubles for every further attempt.
+    Backoff time.Duration
+    // Timeout bounds each attempt (0: no bound beyond the message context).
+    Timeout time.Duration
+    OnError ErrorPolicy
+}
+
+// permanentError marks failures that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the handler is not retried.
+func Permanent(err error) error {
+    if err == nil { return nil }
+    return permanentError{err}
+}
+
+// Handler is one named reaction to an event type.
+type Handler struct {
+    Name   string
+    Policy Policy
+    run    func(ctx context.Context, env ev.Envelope) error
+}
+
+// DeadLetterSink stores events a handler failed on.
+type DeadLetterSink interface {
+    Put(ctx context.Context, d DeadLetter) error
+}
+
+// Registry runs the handlers of each event type in registration order. A failing handler never
+// stops the others: once its policy gives up, the event is dead-lettered for that handler alone.
+type Registry struct {
+    handlers map[string][]*Handler
+    byName   map[string]*Handler
+    dead     DeadLetterSink
+    sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func NewRegistry(dead DeadLetterSink) *Registry {
+    return &Registry{handlers: map[string][]*Handler{}, byName: map[string]*Handler{}, dead: dead, sleep: sleepCtx}
+}
+
+// On registers fn under name for the given event types. The envelope data is decoded into T
+// with ev.UnmarshalData; data that does not decode is dead-lettered without retrying. A name
+// identifies one handler across event types and must be unique.
+func On[T any](r *Registry, name string, p Policy, fn func(ctx context.Context, env ev.Envelope, data T) error, eventTypes ...string) {
+    if _, dup := r.byName[name]; dup { panic("events: duplicate handler " + name) }
+    h := &Handler{Name: name, Policy: p, run: func(ctx context.Context, env ev.Envelope) error {
+        var data T
+        if err := ev.UnmarshalData(env, &data); err != nil { return Permanent(fmt.Errorf("decode %s: %w", env.Type, err)) }
+        return fn(ctx, env, data)
+    }}
+    r.byName[name] = h
+    for _, et := range eventTypes { r.handlers[et] = append(r.handlers[et], h) }
+}
+
+// Handles reports whether any handler is registered for eventType.
+func (r *Registry) Handles(eventType string) bool { return len(r.handlers[eventType]) > 0 }
+
+// Handle runs every handler of env.Type. It returns the number of handlers that failed; their
+// failures are dead-lettered or dropped according to their policies. The error is non-nil when a
+// dead letter could not be written: the failure is then recorded nowhere, so the caller must
+// not acknowledge the message.
+func (r *Registry) Handle(ctx context.Context, env ev.Envelope) (int, error) {
+    failed := 0
+    var lost error
+    for _, h := range r.handlers[env.Type] {
+        attempts, err := r.attempt(ctx, h, env)
+        if err == nil { continue }
+        failed++
+        if h.Policy.OnError == OnErrorDrop || r.dead == nil {
+            log.Printf("notifications: handler %s failed on %s %s after %d attempt(s): %v", h.Name, env.Type, env.ID, attempts, err)
+            continue
+        }
+        d := DeadLetter{Handler: h.Name, EventType: env.Type, EventID: env.ID, Envelope: env, Error: err.Error(), Attempts: attempts}
+        if derr := r.dead.Put(ctx, d); derr != nil {
+            log.Printf("notifications: dead-letter for %s on %s %s failed: %v (handler error: %v)", h.Name, env.Type, env.ID, derr, err)
+            if lost == nil { lost = fmt.Errorf("dead-letter %s on %s %s: %w", h.Name, env.Type, env.ID, derr) }
+        } else {
+            log.Printf("notifications: handler %s failed on %s %s after %d attempt(s), dead-lettered: %v", h.Name, env.Type, env.ID, attempts, err)
+        }
+    }
+    return failed, lost
+}
+
+// Replay runs the named handler once more on env, e.g. for a dead letter; nothing is dead-lettered.
+func (r *Registry) Replay(ctx context.Context, name string, env ev.Envelope) error {
+    h, ok := r.byName[name]
+    if !ok { return fmt.Errorf("unknown handler %q", name) }
+    _, err := r.attempt(ctx, h, env)
+    return err
+}
+
+func (r *Registry) attempt(ctx context.Context, h *Handler, env ev.Envelope) (int, error) {
+    max := h.Policy.Attempts
+    if max < 1 { max = 1 }
+    backoff := h.Policy.Backoff
+    var err error
+    for i := 1; ; i++ {
+        err = r.once(ctx, h, env)
+        var perm permanentError
+        if err == nil || i >= max || errors.As(err, &perm) { return i, err }
+        if serr := r.sleep(ctx, backoff); serr != nil { return i, err }
+        backoff *= 2
+    }
+}
+
+func (r *Registry) once(ctx context.Context, h *Handler, env ev.Envelope) (err error) {
+    if h.Policy.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, h.Policy.Timeout)
+        defer cancel()
+    }
+    defer func() {
+        if p := recover(); p != nil { err = Permanent(fmt.Errorf("panic: %v", p)) }
+    }()
+    return h.run(ctx, env)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+    if d <= 0 { return ctx.Err() }
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-t.C:
+        return nil
+    }
+}
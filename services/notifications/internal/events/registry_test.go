@@ -0,0 +1,98 @@
+package events
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+type memDead struct{ got []DeadLetter }
+
+func (m *memDead) Put(_ context.Context, d DeadLetter) error { m.got = append(m.got, d); return nil }
+
+func newTestRegistry(dead DeadLetterSink) *Registry {
+    r := NewRegistry(dead)
+    r.sleep = func(context.Context, time.Duration) error { return nil }
+    return r
+}
+
+func TestRegistryRunsInOrderAndIsolatesFailures(t *testing.T) {
+    dead := &memDead{}
+    r := newTestRegistry(dead)
+    var order []string
+    type task struct{ TaskID string `json:"taskId"` }
+    On(r, "first", Policy{}, func(_ context.Context, _ ev.Envelope, p task) error {
+        order = append(order, "first:"+p.TaskID)
+        return errors.New("projection down")
+    }, "T")
+    On(r, "second", Policy{}, func(_ context.Context, env ev.Envelope, p map[string]any) error {
+        order = append(order, "second:"+env.Type)
+        return nil
+    }, "T", "U")
+    failed, err := r.Handle(context.Background(), ev.Envelope{ID: "e1", Type: "T", Data: map[string]any{"taskId": "t1"}})
+    if failed != 1 || err != nil { t.Fatalf("failed = %d, err = %v, want 1, nil", failed, err) }
+    if strings.Join(order, ",") != "first:t1,second:T" { t.Fatalf("order = %v", order) }
+    if len(dead.got) != 1 || dead.got[0].Handler != "first" || dead.got[0].EventID != "e1" || dead.got[0].Error != "projection down" {
+        t.Fatalf("dead letters = %+v", dead.got)
+    }
+    if !r.Handles("U") || r.Handles("V") { t.Fatal("Handles mismatch") }
+}
+
+type brokenDead struct{}
+
+func (brokenDead) Put(context.Context, DeadLetter) error { return errors.New("db down") }
+
+func TestRegistryReportsLostDeadLetters(t *testing.T) {
+    r := newTestRegistry(brokenDead{})
+    On(r, "ok", Policy{}, func(context.Context, ev.Envelope, map[string]any) error { return nil }, "T")
+    On(r, "dropped", Policy{OnError: OnErrorDrop}, func(context.Context, ev.Envelope, map[string]any) error { return errors.New("x") }, "T")
+    if failed, err := r.Handle(context.Background(), ev.Envelope{ID: "e1", Type: "T"}); failed != 1 || err != nil {
+        t.Fatalf("without dead letters: failed=%d err=%v", failed, err)
+    }
+    On(r, "dead", Policy{}, func(context.Context, ev.Envelope, map[string]any) error { return errors.New("projection down") }, "T")
+    failed, err := r.Handle(context.Background(), ev.Envelope{ID: "e2", Type: "T"})
+    if failed != 2 || err == nil || !strings.Contains(err.Error(), "db down") {
+        t.Fatalf("lost dead letter: failed=%d err=%v", failed, err)
+    }
+}
+
+func TestRegistryRetriesPerPolicy(t *testing.T) {
+    dead := &memDead{}
+    r := newTestRegistry(dead)
+    calls := 0
+    On(r, "flaky", Policy{Attempts: 3}, func(context.Context, ev.Envelope, map[string]any) error {
+        calls++
+        if calls < 3 { return errors.New("transient") }
+        return nil
+    }, "T")
+    if failed, _ := r.Handle(context.Background(), ev.Envelope{Type: "T"}); failed != 0 || calls != 3 {
+        t.Fatalf("failed=%d calls=%d", failed, calls)
+    }
+    calls = 0
+    On(r, "broken", Policy{Attempts: 5, OnError: OnErrorDrop}, func(context.Context, ev.Envelope, map[string]any) error {
+        calls++
+        return Permanent(errors.New("bad input"))
+    }, "P")
+    if failed, _ := r.Handle(context.Background(), ev.Envelope{Type: "P"}); failed != 1 || calls != 1 {
+        t.Fatalf("permanent: failed=%d calls=%d", failed, calls)
+    }
+    if len(dead.got) != 0 { t.Fatalf("dropped failure was dead-lettered: %+v", dead.got) }
+}
+
+func TestRegistryDecodeFailureAndReplay(t *testing.T) {
+    dead := &memDead{}
+    r := newTestRegistry(dead)
+    calls := 0
+    type offer struct{ Score float64 `json:"score"` }
+    On(r, "typed", Policy{Attempts: 3}, func(context.Context, ev.Envelope, offer) error { calls++; return nil }, "T")
+    r.Handle(context.Background(), ev.Envelope{Type: "T", Data: map[string]any{"score": "high"}})
+    if calls != 0 || len(dead.got) != 1 || dead.got[0].Attempts != 1 { t.Fatalf("calls=%d dead=%+v", calls, dead.got) }
+    if err := r.Replay(context.Background(), "typed", ev.Envelope{Type: "T", Data: map[string]any{"score": 0.5}}); err != nil || calls != 1 {
+        t.Fatalf("replay err=%v calls=%d", err, calls)
+    }
+    if err := r.Replay(context.Background(), "missing", ev.Envelope{}); err == nil { t.Fatal("unknown handler replayed") }
+}
@@ -13,17 +13,23 @@ import (
     "cloud.google.com/go/firestore"
     "strings"
     ev "github.com/xxrenzhe/autoads/pkg/events"
-    "net/http"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/delivery"
+    "github.com/xxrenzhe/autoads/services/notifications/internal/digest"
 )
 
 type Subscriber struct {
     client *pubsub.Client
     sub    *pubsub.Subscription
     db     *sql.DB
-    pub    *ev.Publisher
+    // deliveries queues email/webhook/chat copies of notifications (optional)
+    deliveries *delivery.Dispatcher
+    // digests holds notifications for digests and quiet hours and collapses repeats (optional)
+    digests *digest.Store
+    handlers *Registry
+    dead     *DeadLetters
 }
 
-func NewSubscriber(ctx context.Context, db *sql.DB, pub *ev.Publisher) (*Subscriber, error) {
+func NewSubscriber(ctx context.Context, db *sql.DB, deliveries *delivery.Dispatcher, digests *digest.Store) (*Subscriber, error) {
     projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
     subID := os.Getenv("PUBSUB_SUBSCRIPTION_ID")
     topicID := os.Getenv("PUBSUB_TOPIC_ID")
@@ -44,7 +50,9 @@ func NewSubscriber(ctx context.Context, db *sql.DB, pub *ev.Publisher) (*Subscri
     // Ensure event store DDL (idempotent)
     if err := ensureEventStoreDDL(db); err != nil { log.Printf("notifications: WARN ensure event_store ddl failed: %v", err) }
     log.Printf("notifications: subscriber initialized (project=%s, sub=%s)", projectID, subID)
-    return &Subscriber{client: c, sub: s, db: db, pub: pub}, nil
+    sub := &Subscriber{client: c, sub: s, db: db, deliveries: deliveries, digests: digests, dead: NewDeadLetters(db)}
+    sub.handlers = sub.registry()
+    return sub, nil
 }
 
 func (s *Subscriber) Start(ctx context.Context) {
@@ -56,82 +64,46 @@ func (s *Subscriber) Start(ctx context.Context) {
             log.Printf("notifications: received event type=%s", et)
             // Persist event to SQL event store (best-effort)
             _ = s.storeEvent(cctx, et, msg)
-            switch et {
-            case "SiterankCompleted":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                // unwrap envelope if present
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, "SiterankCompleted")
-                // best-effort: project Offer status -> evaluated & write siterankScore if present
-                offID, _ := strMap(payload, "offerId")
-                uid, _ := strMap(payload, "userId")
-                var score *float64
-                if v, ok := payload["score"].(float64); ok { score = &v }
-                if offID != "" && uid != "" {
-                    if score != nil {
-                        if _, err := s.db.ExecContext(cctx, `UPDATE "Offer" SET status='evaluated', "siterankScore"=$1 WHERE id=$2 AND "userId"=$3`, *score, offID, uid); err != nil {
-                            _, _ = s.db.ExecContext(cctx, `UPDATE "Offer" SET status='evaluated', siterankScore=$1 WHERE id=$2 AND userid=$3`, *score, offID, uid)
-                        }
-                    } else {
-                        if _, err := s.db.ExecContext(cctx, `UPDATE "Offer" SET status='evaluated' WHERE id=$1 AND "userId"=$2`, offID, uid); err != nil {
-                            _, _ = s.db.ExecContext(cctx, `UPDATE "Offer" SET status='evaluated' WHERE id=$1 AND userid=$2`, offID, uid)
-                        }
-                    }
-                }
-                msg.Ack()
-            case "OfferCreated", "SiterankRequested":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                if et == "OfferCreated" { _ = s.projectOfferCreated(cctx, payload) }
-                msg.Ack()
-            case "WorkflowStarted", "WorkflowStepCompleted", "WorkflowCompleted":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                msg.Ack()
-            case "BatchOpsTaskQueued", "BatchOpsTaskStarted", "BatchOpsTaskCompleted", "BatchOpsTaskFailed":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                _ = s.projectBatchopenTask(cctx, et, payload)
-                if strings.ToLower(strings.TrimSpace(os.Getenv("ENABLE_SAGA"))) == "1" {
-                    if err := s.handleBatchopenSaga(cctx, et, payload); err != nil { log.Printf("notifications: saga error: %v", err) }
-                }
-                msg.Ack()
-            case "BrowserExecRequested", "BrowserExecCompleted":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                msg.Ack()
-            case "TokenReserved", "TokenDebited", "TokenReverted":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                msg.Ack()
-            case "NotificationCreated":
-                var payload map[string]any
-                if err := json.Unmarshal(msg.Data, &payload); err != nil { log.Printf("notifications: bad payload: %v", err); msg.Nack(); return }
-                if dv, ok := payload["data"].(map[string]any); ok { payload = dv }
-                _ = s.insertNotification(cctx, payload, et)
-                msg.Ack()
-            default:
-                msg.Ack()
+            if !s.handlers.Handles(et) { msg.Ack(); return }
+            // failed handlers are dead-lettered on their own, so the message is done unless a dead
+            // letter could not be written; then Pub/Sub redelivers it (handlers are idempotent)
+            if _, err := s.handlers.Handle(cctx, envelopeOf(et, msg)); err != nil {
+                log.Printf("notifications: nack %s %s: %v", et, msg.ID, err)
+                msg.Nack()
+                return
             }
+            msg.Ack()
         })
         if err != nil { log.Printf("notifications: subscriber stopped: %v", err) } else { log.Printf("notifications: Receive returned nil (stopped)") }
     }()
 }
 
+// envelopeOf decodes the message envelope, or wraps a bare payload as its data.
+func envelopeOf(eventType string, msg *pubsub.Message) ev.Envelope {
+    var env ev.Envelope
+    if err := json.Unmarshal(msg.Data, &env); err != nil || env.Type == "" {
+        env = ev.Envelope{SpecVersion: "1.0", ID: msg.Attributes["id"], Source: msg.Attributes["source"], Subject: msg.Attributes["subject"], Time: msg.PublishTime.UTC(), Data: json.RawMessage(msg.Data)}
+    }
+    if env.ID == "" { env.ID = msg.ID }
+    env.Type = eventType
+    return env
+}
+
+// ReplayDeadLetter runs the failed handler of a dead letter again and records the outcome.
+func (s *Subscriber) ReplayDeadLetter(ctx context.Context, id int64) (DeadLetter, error) {
+    d, err := s.dead.Get(ctx, id)
+    if err != nil { return d, err }
+    rerr := s.handlers.Replay(ctx, d.Handler, d.Envelope)
+    if err := s.dead.Replayed(ctx, id, rerr); err != nil { return d, err }
+    return s.dead.Get(ctx, id)
+}
+
 func (s *Subscriber) Close() { if s.client != nil { s.client.Close() } }
 
-func (s *Subscriber) insertNotification(ctx context.Context, payload map[string]any, eventType string) error {
+// insertNotification writes the notification for an event through tx: held for a digest, folded
+// into a repeat, or stored and announced. It returns the routing to run once tx commits (nil when
+// there is nothing to route).
+func (s *Subscriber) insertNotification(ctx context.Context, tx *sql.Tx, payload map[string]any, eventType string) (func(), error) {
     // Resolve userId (best-effort)
     userID := ""
     if v, ok := payload["userId"].(string); ok { userID = v }
@@ -146,27 +118,137 @@ func (s *Subscriber) insertNotification(ctx context.Context, payload map[string]
     }
     // Rule engine: compute title/severity/category and normalized message
     title, msg := composeNotification(eventType, payload)
+    key := groupKey(eventType, payload)
+    if s.digests != nil && userID != "" {
+        prefs, err := s.digests.Preferences(ctx, userID)
+        if err != nil { log.Printf("notifications: load preferences failed userId=%s: %v", userID, err); prefs = digest.Defaults(userID) }
+        category, _ := strMap(msg, "category")
+        severity, _ := strMap(msg, "severity")
+        digests := s.digests.In(tx)
+        if at := prefs.Decide(category, severity, time.Now()); !at.IsZero() {
+            err := savepoint(ctx, tx, func() error {
+                return digests.Hold(ctx, digest.Item{UserID: userID, EventType: eventType, Category: category, Severity: severity, GroupKey: key, Title: title, Message: msg, ReleaseAt: at})
+            })
+            if err == nil { log.Printf("notifications: held userId=%s type=%s until %s", userID, eventType, at.UTC().Format(time.RFC3339)); return nil, nil }
+            log.Printf("notifications: hold failed, notifying now: %v", err)
+        } else if prefs.Collapse {
+            var id int64
+            var n int
+            if err := savepoint(ctx, tx, func() (err error) { id, n, err = digests.Collapse(ctx, userID, key, title, msg); return err }); err != nil {
+                log.Printf("notifications: collapse failed: %v", err)
+            } else if id > 0 {
+                log.Printf("notifications: collapsed userId=%s type=%s into id=%d (x%d)", userID, eventType, id, n)
+                return nil, nil
+            }
+        }
+    }
+    return s.notify(ctx, tx, userID, eventType, title, msg, key, nil)
+}
+
+// savepoint runs fn inside a savepoint of tx, so a failed fn leaves tx usable as if it never ran.
+func savepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+    if _, err := tx.ExecContext(ctx, `SAVEPOINT notify_step`); err != nil { return err }
+    if err := fn(); err != nil {
+        if _, rerr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT notify_step`); rerr != nil { return rerr }
+        return err
+    }
+    _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT notify_step`)
+    return err
+}
+
+// notifyOnce runs insertNotification at most once per event, so redelivery, relay retries and
+// dead-letter replay do not notify twice. The event is claimed in notification_handled_events by
+// its envelope id, which relayed events take from their outbox row (pkg/events), in the same
+// transaction as the notification: a run that fails or crashes leaves neither, so its retries
+// still get through, and a concurrent duplicate waits on the claim and then skips.
+func (s *Subscriber) notifyOnce(ctx context.Context, env ev.Envelope, payload map[string]any) error {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    if env.ID != "" {
+        res, err := tx.ExecContext(ctx, `INSERT INTO notification_handled_events(handler, event_id) VALUES ('notification', $1) ON CONFLICT DO NOTHING`, env.ID)
+        if err != nil { return fmt.Errorf("claim event %s: %w", env.ID, err) }
+        if n, _ := res.RowsAffected(); n == 0 {
+            log.Printf("notifications: %s %s already notified, skipped", env.Type, env.ID)
+            return nil
+        }
+    }
+    route, err := s.insertNotification(ctx, tx, payload, env.Type)
+    if err != nil { return err }
+    if err := tx.Commit(); err != nil { return err }
+    if route != nil { route() }
+    return nil
+}
+
+// DeliverDigest stores a digest built from held notifications and routes it like any other.
+func (s *Subscriber) DeliverDigest(ctx context.Context, d digest.Digest) error {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    route, err := s.notify(ctx, tx, d.UserID, d.EventType, d.Title, d.Message, "", d.Covers)
+    if err != nil { return err }
+    if err := tx.Commit(); err != nil { return err }
+    route()
+    return nil
+}
+
+// OutboxSource names the notifications service's rows in event_outbox (pkg/events); the relay
+// started in cmd/server publishes them.
+const OutboxSource = "notifications"
+
+// notify inserts the in-app notification through tx and records NotificationSent for downstream
+// consumers with it, so the event is published only for a stored notification. The returned
+// routing queues the external deliveries and must run after tx commits.
+func (s *Subscriber) notify(ctx context.Context, tx *sql.Tx, userID, eventType, title string, msg map[string]any, groupKey string, covers []string) (func(), error) {
     messageB, _ := json.Marshal(msg)
     var id int64
-    err := s.db.QueryRowContext(ctx, `INSERT INTO user_notifications (user_id, type, title, message, created_at) VALUES ($1,$2,$3,$4,NOW()) RETURNING id`, userID, eventType, title, string(messageB)).Scan(&id)
-    if err != nil {
+    if err := tx.QueryRowContext(ctx, `INSERT INTO user_notifications (user_id, type, title, message, group_key, created_at) VALUES ($1,$2,$3,$4,NULLIF($5,''),NOW()) RETURNING id`, userID, eventType, title, string(messageB), groupKey).Scan(&id); err != nil {
         log.Printf("notifications: insert failed: %v", err)
-    } else {
-        log.Printf("notifications: insert ok userId=%s type=%s id=%d", userID, eventType, id)
+        return nil, err
     }
-    // Best-effort Firestore UI cache
-    _ = writeNotificationUI(ctx, userID, map[string]any{"type": eventType, "title": title, "payload": msg, "createdAt": time.Now().UTC()})
-    // Publish NotificationSent for downstream consumers (best-effort)
-    if s.pub != nil && id > 0 {
-        _ = s.pub.Publish(ctx, ev.EventNotificationSent, map[string]any{
-            "userId": userID,
-            "notificationId": fmt.Sprintf("%d", id),
-            "type": eventType,
-            "title": title,
-            "time": time.Now().UTC().Format(time.RFC3339),
-        }, ev.WithSource("notifications"), ev.WithSubject(fmt.Sprintf("%d", id)))
+    nid := fmt.Sprintf("%d", id)
+    if err := ev.Enqueue(ctx, tx, OutboxSource, ev.OutboxEvent{Type: ev.EventNotificationSent, Subject: nid, Data: map[string]any{
+        "userId": userID,
+        "notificationId": nid,
+        "type": eventType,
+        "title": title,
+        "time": time.Now().UTC().Format(time.RFC3339),
+    }}); err != nil {
+        return nil, err
     }
-    return err
+    return func() {
+        log.Printf("notifications: insert ok userId=%s type=%s id=%d", userID, eventType, id)
+        // Route to the user's external channels (email/webhook/chat); sent by the dispatcher
+        if s.deliveries != nil && userID != "" {
+            m := deliveryMessage(id, userID, eventType, title, msg)
+            m.Covers = covers
+            if n, err := s.deliveries.Enqueue(ctx, m); err != nil {
+                log.Printf("notifications: enqueue deliveries failed id=%d: %v", id, err)
+            } else if n > 0 {
+                log.Printf("notifications: queued %d deliveries id=%d", n, id)
+            }
+        }
+        // Best-effort Firestore UI cache
+        _ = writeNotificationUI(ctx, userID, map[string]any{"type": eventType, "title": title, "payload": msg, "createdAt": time.Now().UTC()})
+    }, nil
+}
+
+// groupKey identifies repeats of an event for one aggregate (analysis, task or offer, in that
+// order of preference); events without an aggregate never collapse.
+func groupKey(eventType string, p map[string]any) string {
+    for _, k := range []string{"analysisId", "taskId", "offerId"} {
+        if v, ok := strMap(p, k); ok && v != "" { return eventType + ":" + v }
+    }
+    return ""
+}
+
+func deliveryMessage(id int64, userID, eventType, title string, msg map[string]any) delivery.Message {
+    m := delivery.Message{NotificationID: id, UserID: userID, EventType: eventType, Title: title, CreatedAt: time.Now().UTC()}
+    m.Severity, _ = strMap(msg, "severity")
+    m.Category, _ = strMap(msg, "category")
+    m.Summary, _ = strMap(msg, "summary")
+    if data, ok := msg["data"].(map[string]any); ok { m.Data = data }
+    return m
 }
 
 // --- Event Store sink (3.1: 事件存储基础设施最小实现) ---
@@ -329,165 +411,22 @@ func composeNotification(eventType string, p map[string]any) (string, map[string
     return title, msg
 }
 
-// --- Saga Coordinator (minimal) ---
-
-func (s *Subscriber) handleBatchopenSaga(ctx context.Context, eventType string, p map[string]any) error {
-    // Extract basics
-    userID, _ := strMap(p, "userId")
-    taskID, _ := strMap(p, "taskId")
-    if userID == "" || taskID == "" { return nil }
-    if err := s.sagaEnsureDDL(); err != nil { return err }
-    sagaID := "batchopen:" + taskID
-    switch eventType {
-    case "BatchOpsTaskQueued", "BatchOpsTaskStarted":
-        _ = s.sagaUpsertInstance(ctx, sagaID, userID, "batchopen", taskID, "running")
-        // reserve tokens (idempotent)
-        if err := s.sagaBilling(ctx, userID, taskID, "reserve"); err != nil {
-            _ = s.sagaInsertStep(ctx, sagaID, "reserve", "failed", err.Error())
-            return err
-        }
-        _ = s.sagaInsertStep(ctx, sagaID, "reserve", "ok", "")
-    case "BatchOpsTaskCompleted":
-        if err := s.sagaBilling(ctx, userID, taskID, "commit"); err != nil {
-            _ = s.sagaInsertStep(ctx, sagaID, "commit", "failed", err.Error())
-            return err
-        }
-        _ = s.sagaInsertStep(ctx, sagaID, "commit", "ok", "")
-        _ = s.sagaUpdateStatus(ctx, sagaID, "completed")
-    case "BatchOpsTaskFailed":
-        if err := s.sagaBilling(ctx, userID, taskID, "release"); err != nil {
-            _ = s.sagaInsertStep(ctx, sagaID, "release", "failed", err.Error())
-            return err
-        }
-        _ = s.sagaInsertStep(ctx, sagaID, "release", "ok", "")
-        _ = s.sagaUpdateStatus(ctx, sagaID, "compensated")
-    }
-    return nil
-}
-
-func (s *Subscriber) sagaEnsureDDL() error {
-    stmts := []string{
-        `CREATE TABLE IF NOT EXISTS "SagaInstance" (
-            id TEXT PRIMARY KEY,
-            user_id TEXT NOT NULL,
-            kind TEXT NOT NULL,
-            task_id TEXT,
-            status TEXT NOT NULL,
-            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-        )`,
-        `CREATE TABLE IF NOT EXISTS "SagaStep" (
-            id BIGSERIAL PRIMARY KEY,
-            saga_id TEXT NOT NULL,
-            name TEXT NOT NULL,
-            status TEXT NOT NULL,
-            attempts INT NOT NULL DEFAULT 0,
-            last_error TEXT,
-            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-        )`,
-    }
-    for _, q := range stmts { if _, err := s.db.Exec(q); err != nil { return err } }
-    return nil
-}
-
-func (s *Subscriber) sagaUpsertInstance(ctx context.Context, sagaID, userID, kind, taskID, status string) error {
-    _, err := s.db.ExecContext(ctx, `
-        INSERT INTO "SagaInstance"(id, user_id, kind, task_id, status, created_at, updated_at)
-        VALUES ($1,$2,$3,$4,$5,NOW(),NOW())
-        ON CONFLICT (id) DO UPDATE SET status=EXCLUDED.status, updated_at=NOW()
-    `, sagaID, userID, kind, taskID, status)
-    return err
-}
-
-func (s *Subscriber) sagaUpdateStatus(ctx context.Context, sagaID, status string) error {
-    _, err := s.db.ExecContext(ctx, `UPDATE "SagaInstance" SET status=$1, updated_at=NOW() WHERE id=$2`, status, sagaID)
-    return err
-}
-
-func (s *Subscriber) sagaInsertStep(ctx context.Context, sagaID, name, status, lastErr string) error {
-    _, err := s.db.ExecContext(ctx, `INSERT INTO "SagaStep"(saga_id, name, status, attempts, last_error, updated_at) VALUES ($1,$2,$3,1,$4,NOW())`, sagaID, name, status, lastErr)
-    return err
-}
-
-func (s *Subscriber) sagaBilling(ctx context.Context, userID, taskID, action string) error {
-    base := strings.TrimRight(os.Getenv("BILLING_URL"), "/")
-    if base == "" { return fmt.Errorf("BILLING_URL not set") }
-    url := base + "/api/v1/billing/tokens/" + action
-    amount := 1
-    if v := strings.TrimSpace(os.Getenv("SAGA_RESERVE_AMOUNT")); v != "" {
-        var n int; _, _ = fmt.Sscanf(v, "%d", &n); if n > 0 { amount = n }
-    }
-    body := map[string]any{"amount": amount, "taskId": taskID}
-    if action == "commit" || action == "release" { body["txId"] = taskID }
-    b, _ := json.Marshal(body)
-    cctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-    defer cancel()
-    req, _ := http.NewRequestWithContext(cctx, http.MethodPost, url, strings.NewReader(string(b)))
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("X-User-Id", userID)
-    req.Header.Set("X-Idempotency-Key", fmt.Sprintf("saga:%s:%s", action, taskID))
-    resp, err := http.DefaultClient.Do(req)
-    if resp != nil { _ = resp.Body.Close() }
-    if err != nil { return err }
-    // accept any 2xx/202
-    if resp.StatusCode < 200 || resp.StatusCode >= 300 { return fmt.Errorf("billing %s status=%d", action, resp.StatusCode) }
-    return nil
-}
-
 // projectOfferCreated writes the Offer read model row (id,userId,name,originalUrl,status,createdAt)
-func (s *Subscriber) projectOfferCreated(ctx context.Context, p map[string]any) error {
-    // extract fields safely
-    getStr := func(k string) string { if v, ok := p[k].(string); ok { return v }; return "" }
-    id := getStr("offerId")
-    user := getStr("userId")
-    name := getStr("name")
-    original := getStr("originalUrl")
-    status := getStr("status")
-    if id == "" || user == "" || original == "" { return nil }
+func (s *Subscriber) projectOfferCreated(ctx context.Context, p offerCreated) error {
+    if p.OfferID == "" || p.UserID == "" || p.OriginalURL == "" { return nil }
     // createdAt is optional; server defaults now()
     _, err := s.db.ExecContext(ctx, `
         INSERT INTO "Offer" (id, userid, name, originalurl, status, created_at)
         VALUES ($1,$2,$3,$4,$5, NOW())
         ON CONFLICT (id) DO NOTHING
-    `, id, user, name, original, status)
-    if err != nil { log.Printf("notifications: projectOfferCreated failed: %v", err) }
+    `, p.OfferID, p.UserID, p.Name, p.OriginalURL, p.Status)
     return err
 }
 
-// projectBatchopenTask upserts task status into read model table BatchopenTask.
-func (s *Subscriber) projectBatchopenTask(ctx context.Context, eventType string, p map[string]any) error {
-    getStr := func(k string) string { if v, ok := p[k].(string); ok { return v }; return "" }
-    taskID := getStr("taskId")
-    userID := getStr("userId")
-    offerID := getStr("offerId")
-    if taskID == "" || userID == "" { return nil }
-    status := "queued"
-    switch eventType {
-    case "BatchOpsTaskQueued": status = "queued"
-    case "BatchOpsTaskStarted": status = "running"
-    case "BatchOpsTaskCompleted": status = "completed"
-    case "BatchOpsTaskFailed": status = "failed"
-    }
-    // optional result
-    var resultJSON string
-    if m, ok := p["result"].(map[string]any); ok { if b, err := json.Marshal(m); err == nil { resultJSON = string(b) } }
-    // upsert
-    if status == "queued" {
-        _, err := s.db.ExecContext(ctx, `
-            INSERT INTO "BatchopenTask"(id, "userId", "offerId", status, created_at, updated_at)
-            VALUES ($1,$2,$3,$4,NOW(),NOW())
-            ON CONFLICT (id) DO UPDATE SET status=EXCLUDED.status, updated_at=NOW()
-        `, taskID, userID, offerID, status)
-        if err != nil { log.Printf("projectBatchopenTask insert failed: %v", err) }
-        return err
-    }
-    if resultJSON != "" {
-        _, err := s.db.ExecContext(ctx, `UPDATE "BatchopenTask" SET status=$1, result=$2::jsonb, updated_at=NOW() WHERE id=$3`, status, resultJSON, taskID)
-        if err != nil { log.Printf("projectBatchopenTask update failed: %v", err) }
-        return err
-    }
-    _, err := s.db.ExecContext(ctx, `UPDATE "BatchopenTask" SET status=$1, updated_at=NOW() WHERE id=$2`, status, taskID)
-    if err != nil { log.Printf("projectBatchopenTask update failed: %v", err) }
+// projectOfferEvaluated marks the Offer evaluated and keeps its siterank score when one is given.
+func (s *Subscriber) projectOfferEvaluated(ctx context.Context, p siterankCompleted) error {
+    if p.OfferID == "" || p.UserID == "" || p.Mode == "multi-geo" { return nil }
+    _, err := s.db.ExecContext(ctx, `UPDATE "Offer" SET status='evaluated', siterankScore=COALESCE($1, siterankScore) WHERE id=$2 AND userid=$3`, p.Score, p.OfferID, p.UserID)
     return err
 }
 
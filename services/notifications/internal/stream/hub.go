@@ -0,0 +1,149 @@
+// Package stream pushes notification changes to open SSE connections. A database trigger
+// announces every insert or update of user_notifications (and read marks) on one LISTEN/NOTIFY
+// channel; a single listener per instance relays them to a Hub, which wakes only the streams of
+// the affected user. Wake-ups are coalesced, so a slow stream never blocks the hub: it simply
+// catches up from the database on its next turn.
+package stream
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "sort"
+    "strings"
+    "sync"
+)
+
+const (
+    OpInsert = "insert"
+    OpUpdate = "update"
+    OpRead   = "read"
+)
+
+// Event is the payload of one notification on Channel.
+type Event struct {
+    UserID string `json:"u"`
+    ID     int64  `json:"id"`
+    Op     string `json:"op"`
+}
+
+var ErrTooManyStreams = errors.New("too many open streams")
+
+// maxUpdates bounds the updated ids remembered per stream; beyond it the stream resyncs.
+const maxUpdates = 64
+
+// Pending is what changed for a stream since it last looked.
+type Pending struct {
+    // Updated are ids of notifications changed in place (collapsed repeats).
+    Updated []int64
+    // Resync asks the stream to re-read everything after its last id, e.g. after the listener
+    // reconnected and notifications may have been missed.
+    Resync bool
+}
+
+// Client is one open stream of a user.
+type Client struct {
+    UserID  string
+    wake    chan struct{}
+    mu      sync.Mutex
+    updated map[int64]struct{}
+    resync  bool
+}
+
+// Wake is signalled when something changed; several changes may share one signal.
+func (c *Client) Wake() <-chan struct{} { return c.wake }
+
+// Take returns and clears what changed.
+func (c *Client) Take() Pending {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    p := Pending{Resync: c.resync}
+    for id := range c.updated { p.Updated = append(p.Updated, id) }
+    sort.Slice(p.Updated, func(i, j int) bool { return p.Updated[i] < p.Updated[j] })
+    c.updated, c.resync = nil, false
+    return p
+}
+
+func (c *Client) signal(e Event) {
+    c.mu.Lock()
+    switch e.Op {
+    case OpUpdate:
+        if c.updated == nil { c.updated = map[int64]struct{}{} }
+        if len(c.updated) >= maxUpdates { c.resync = true } else { c.updated[e.ID] = struct{}{} }
+    case "":
+        c.resync = true
+    }
+    c.mu.Unlock()
+    select {
+    case c.wake <- struct{}{}:
+    default: // a wake-up is already pending
+    }
+}
+
+// Hub routes events to the streams of their user.
+type Hub struct {
+    // MaxPerUser caps the open streams of one user (default 8).
+    MaxPerUser int
+    mu         sync.RWMutex
+    clients    map[string]map[*Client]struct{}
+}
+
+func NewHub() *Hub { return &Hub{MaxPerUser: 8, clients: map[string]map[*Client]struct{}{}} }
+
+// Subscribe opens a stream for userID.
+func (h *Hub) Subscribe(userID string) (*Client, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    set := h.clients[userID]
+    if h.MaxPerUser > 0 && len(set) >= h.MaxPerUser { return nil, ErrTooManyStreams }
+    if set == nil { set = map[*Client]struct{}{}; h.clients[userID] = set }
+    c := &Client{UserID: userID, wake: make(chan struct{}, 1)}
+    set[c] = struct{}{}
+    return c, nil
+}
+
+// Unsubscribe closes a stream.
+func (h *Hub) Unsubscribe(c *Client) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if set := h.clients[c.UserID]; set != nil {
+        delete(set, c)
+        if len(set) == 0 { delete(h.clients, c.UserID) }
+    }
+}
+
+// Publish wakes the streams of e.UserID. It never blocks.
+func (h *Hub) Publish(e Event) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    for c := range h.clients[e.UserID] { c.signal(e) }
+}
+
+// Resync wakes every stream with Resync set.
+func (h *Hub) Resync() {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    for _, set := range h.clients {
+        for c := range set { c.signal(Event{UserID: c.UserID}) }
+    }
+}
+
+// Len returns the number of open streams.
+func (h *Hub) Len() int {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    n := 0
+    for _, set := range h.clients { n += len(set) }
+    return n
+}
+
+// ResumeID returns the id a reconnecting client saw last: the Last-Event-ID header that
+// EventSource sends, or the lastEventId query parameter for a fresh page.
+func ResumeID(r *http.Request) (int64, bool) {
+    v := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+    if v == "" { v = strings.TrimSpace(r.URL.Query().Get("lastEventId")) }
+    if v == "" { return 0, false }
+    id, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || id < 0 { return 0, false }
+    return id, true
+}
@@ -0,0 +1,87 @@
+package stream
+
+import (
+    "errors"
+    "net/http/httptest"
+    "testing"
+)
+
+func woken(c *Client) bool {
+    select {
+    case <-c.Wake():
+        return true
+    default:
+        return false
+    }
+}
+
+func TestPublishWakesOnlyTheUser(t *testing.T) {
+    h := NewHub()
+    a1, _ := h.Subscribe("a")
+    a2, _ := h.Subscribe("a")
+    b, _ := h.Subscribe("b")
+    for i := int64(1); i <= 5; i++ { h.Publish(Event{UserID: "a", ID: i, Op: OpInsert}) }
+    if !woken(a1) || !woken(a2) {
+        t.Fatalf("Expected both streams of a to wake")
+    }
+    if woken(a1) {
+        t.Errorf("Expected five inserts to coalesce into one wake-up")
+    }
+    if woken(b) {
+        t.Errorf("Expected b not to wake")
+    }
+    h.Unsubscribe(a2)
+    h.Publish(Event{UserID: "a", ID: 6, Op: OpInsert})
+    if woken(a2) || h.Len() != 2 {
+        t.Errorf("Expected the closed stream to be gone, but %d remain", h.Len())
+    }
+}
+
+func TestUpdatesAndResync(t *testing.T) {
+    h := NewHub()
+    c, _ := h.Subscribe("a")
+    h.Publish(Event{UserID: "a", ID: 9, Op: OpUpdate})
+    h.Publish(Event{UserID: "a", ID: 3, Op: OpUpdate})
+    h.Publish(Event{UserID: "a", ID: 9, Op: OpUpdate})
+    p := c.Take()
+    if len(p.Updated) != 2 || p.Updated[0] != 3 || p.Updated[1] != 9 || p.Resync {
+        t.Errorf("Expected updates 3 and 9, but got %+v", p)
+    }
+    for i := int64(0); i <= maxUpdates; i++ { h.Publish(Event{UserID: "a", ID: i, Op: OpUpdate}) }
+    if p := c.Take(); !p.Resync {
+        t.Errorf("Expected a resync once too many updates pile up")
+    }
+    h.Resync()
+    if p := c.Take(); !p.Resync || len(p.Updated) != 0 {
+        t.Errorf("Expected a resync after the listener reconnects, but got %+v", p)
+    }
+}
+
+func TestMaxPerUser(t *testing.T) {
+    h := NewHub()
+    h.MaxPerUser = 2
+    _, _ = h.Subscribe("a")
+    _, _ = h.Subscribe("a")
+    if _, err := h.Subscribe("a"); !errors.Is(err, ErrTooManyStreams) {
+        t.Errorf("Expected ErrTooManyStreams, but got %v", err)
+    }
+    if _, err := h.Subscribe("b"); err != nil {
+        t.Errorf("Expected other users to be unaffected, but got %v", err)
+    }
+}
+
+func TestResumeID(t *testing.T) {
+    r := httptest.NewRequest("GET", "/api/v1/notifications/stream?lastEventId=12", nil)
+    if id, ok := ResumeID(r); !ok || id != 12 {
+        t.Errorf("Expected 12 from the query, but got %d %v", id, ok)
+    }
+    r.Header.Set("Last-Event-ID", "40")
+    if id, ok := ResumeID(r); !ok || id != 40 {
+        t.Errorf("Expected the header to win, but got %d %v", id, ok)
+    }
+    r = httptest.NewRequest("GET", "/api/v1/notifications/stream", nil)
+    r.Header.Set("Last-Event-ID", "abc")
+    if _, ok := ResumeID(r); ok {
+        t.Errorf("Expected no resume id for a malformed header")
+    }
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// Channel is the LISTEN/NOTIFY channel of notification changes, fed by the triggers of
+// schemas/sql/023_notification_stream.sql on commit, so streams never see uncommitted rows.
+const Channel = "user_notifications"
+
+// Listen relays Channel to hub over one dedicated connection until ctx is done. After a
+// reconnect, notifications sent while disconnected are lost, so every stream resyncs.
+func Listen(ctx context.Context, dsn string, hub *Hub) {
+    l := pq.NewListener(dsn, time.Second, time.Minute, func(t pq.ListenerEventType, err error) {
+        switch t {
+        case pq.ListenerEventDisconnected:
+            log.Printf("notifications: stream listener disconnected: %v", err)
+        case pq.ListenerEventReconnected:
+            log.Printf("notifications: stream listener reconnected")
+        case pq.ListenerEventConnectionAttemptFailed:
+            log.Printf("notifications: stream listener connect failed: %v", err)
+        }
+    })
+    defer l.Close()
+    if err := l.Listen(Channel); err != nil { log.Printf("notifications: LISTEN %s failed: %v", Channel, err); return }
+    ping := time.NewTicker(90 * time.Second)
+    defer ping.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case n := <-l.Notify:
+            if n == nil { hub.Resync(); continue }
+            var e Event
+            if err := json.Unmarshal([]byte(n.Extra), &e); err != nil || e.UserID == "" { continue }
+            hub.Publish(e)
+        case <-ping.C:
+            go func() { _ = l.Ping() }()
+        }
+    }
+}
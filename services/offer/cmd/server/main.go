@@ -13,7 +13,7 @@ import (
     "github.com/google/uuid"
     _ "github.com/lib/pq"
     "github.com/xxrenzhe/autoads/services/offer/internal/domain"
-    "github.com/xxrenzhe/autoads/services/offer/internal/events"
+    ev "github.com/xxrenzhe/autoads/pkg/events"
     "github.com/xxrenzhe/autoads/pkg/logger"
     "github.com/xxrenzhe/autoads/pkg/middleware"
     apperr "github.com/xxrenzhe/autoads/pkg/errors"
@@ -26,11 +26,13 @@ type OfferCreateRequest struct {
 	OriginalUrl string `json:"originalUrl"`
 }
 
+// outboxSource names this service's rows in event_outbox.
+const outboxSource = "offer"
+
 var (
-    db        *sql.DB
-    ctx       = context.Background()
-    log       = logger.Get()
-    publisher events.Publisher
+    db  *sql.DB
+    ctx = context.Background()
+    log = logger.Get()
 )
 
 func main() {
@@ -54,14 +56,17 @@ func main() {
 	}
 	log.Info().Msg("Successfully connected to the database!")
 
-	// Initialize the Pub/Sub publisher.
-    publisher, err = events.NewPublisher(ctx)
+	// Events are recorded in the event_outbox; the relay publishes them to Pub/Sub.
+    if err := ev.EnsureOutbox(ctx, db); err != nil {
+        log.Fatal().Err(err).Msg("Failed to create event outbox")
+    }
+    pub, err := ev.NewPublisher(ctx)
     if err != nil {
         log.Fatal().Err(err).Msg("Failed to create event publisher")
     }
-    if closer, ok := publisher.(interface{ Close() }); ok {
-        defer closer.Close()
-    }
+    defer pub.Close()
+    relay := &ev.Relay{DB: db, Pub: pub, Source: outboxSource, Interval: time.Second}
+    go relay.Run(ctx)
 	
 	// Initialize the Pub/Sub subscriber.
     // (Optional) Event subscriber can be initialized here if available.
@@ -145,7 +150,7 @@ func createOffer(w http.ResponseWriter, r *http.Request) {
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apperr.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
 	
 	offerID := uuid.New().String()
-    // Publish the OfferCreated domain event (CQRS write path)
+    // Record the OfferCreated domain event for publishing (CQRS write path)
     evt := domain.OfferCreatedEvent{
         OfferID:     offerID,
         UserID:      userID,
@@ -154,9 +159,9 @@ func createOffer(w http.ResponseWriter, r *http.Request) {
         Status:      "evaluating",
         CreatedAt:   time.Now(),
     }
-    err := publisher.Publish(r.Context(), evt)
+    err := ev.Enqueue(r.Context(), db, outboxSource, ev.OutboxEvent{Type: ev.EventOfferCreated, Subject: offerID, Data: evt})
     if err != nil {
-        log.Error().Err(err).Msg("Failed to publish OfferCreated event")
+        log.Error().Err(err).Msg("Failed to record OfferCreated event")
         apperr.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Failed to create offer", nil)
         return
     }
@@ -12,8 +12,6 @@ import (
     "github.com/xxrenzhe/autoads/pkg/errors"
     "github.com/xxrenzhe/autoads/pkg/middleware"
     "github.com/xxrenzhe/autoads/services/offer/internal/domain"
-    "github.com/xxrenzhe/autoads/services/offer/internal/events"
-    estore "github.com/xxrenzhe/autoads/pkg/eventstore"
     "strings"
     "syscall"
     "fmt"
@@ -33,21 +31,26 @@ type Offer struct {
 	OriginalUrl string    `json:"originalUrl"`
 	Status      string    `json:"status"`
 	SiterankScore *float64 `json:"siterankScore,omitempty"`
+	// LinkStatus is the latest batchopen link-health verdict (ok, dead, slow, redirect_changed).
+	LinkStatus  *string   `json:"linkStatus,omitempty"`
 	CreatedAt   time.Time `json:"createdAt"`
 }
 
 // Handler holds dependencies for the HTTP handlers.
 type Handler struct {
-    DB        *sql.DB
-    Publisher events.Publisher
+    DB *sql.DB
 }
 
 // NewHandler creates a new Handler.
-func NewHandler(db *sql.DB, publisher events.Publisher) *Handler {
+func NewHandler(db *sql.DB) *Handler {
     // Ensure read model has expected columns (preview safeguard)
     _, _ = db.Exec(`ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT ''`)
     _, _ = db.Exec(`ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS siterankScore DOUBLE PRECISION`)
-    return &Handler{DB: db, Publisher: publisher}
+    // link-health columns read by every offer query (also shipped by schemas/sql/018_batchopen_link_health.sql)
+    _, _ = db.Exec(`ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_status TEXT`)
+    _, _ = db.Exec(`ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_final_domain TEXT`)
+    _, _ = db.Exec(`ALTER TABLE "Offer" ADD COLUMN IF NOT EXISTS link_checked_at TIMESTAMPTZ`)
+    return &Handler{DB: db}
 }
 
 // RegisterRoutes registers the HTTP routes for the service.
@@ -159,9 +162,9 @@ func (h *Handler) offerTreeHandler(w http.ResponseWriter, r *http.Request) {
         var o Offer
         var createdAt time.Time
         err := h.DB.QueryRowContext(r.Context(), `
-            SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, created_at AS "createdAt"
+            SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, link_status, created_at AS "createdAt"
             FROM "Offer" WHERE id=$1 AND userid=$2
-        `, id, userID).Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &createdAt)
+        `, id, userID).Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.LinkStatus, &createdAt)
         if err != nil {
             if err == sql.ErrNoRows { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "offer not found", nil); return }
             log.Printf("offerByID query error: %v", err)
@@ -243,9 +246,9 @@ func (h *Handler) offerTreeHandler(w http.ResponseWriter, r *http.Request) {
             var o Offer
             var createdAt time.Time
             err = h.DB.QueryRowContext(r.Context(), `
-                SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, created_at AS "createdAt"
+                SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, link_status, created_at AS "createdAt"
                 FROM "Offer" WHERE id=$1 AND userid=$2
-            `, id, userID).Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &createdAt)
+            `, id, userID).Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.LinkStatus, &createdAt)
             if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "reload failed", map[string]string{"error": err.Error()}); return }
             o.CreatedAt = createdAt
             w.Header().Set("Content-Type", "application/json")
@@ -753,7 +756,7 @@ func (h *Handler) retryKpiDLQInternal(w http.ResponseWriter, r *http.Request) {
     _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "retried": retried, "resolved": resolved, "errors": errs})
 }
 
-// createOffer validates the request and publishes an OfferCreated event.
+// createOffer validates the request and records an OfferCreated event for publishing.
 func (h *Handler) createOffer(w http.ResponseWriter, r *http.Request) {
     userID, ok := r.Context().Value(middleware.UserIDKey).(string)
     if !ok || userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized: User ID is missing", nil); return }
@@ -796,10 +799,7 @@ func (h *Handler) createOffer(w http.ResponseWriter, r *http.Request) {
         CreatedAt:   time.Now(),
     }
 
-    	    if err := h.Publisher.Publish(r.Context(), event); err != nil { log.Printf("Error publishing OfferCreatedEvent: %v", err); errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Failed to process the request", nil); return }
-    // best-effort event_store write (idempotent by offerId)
-    _ = estore.EnsureDDL(h.DB)
-    _ = estore.WriteWithDB(r.Context(), h.DB, event.OfferID, "OfferCreated", "offer", event.OfferID, 1, event, map[string]any{"userId": userID})
+    if err := h.recordOfferCreated(r.Context(), event); err != nil { log.Printf("Error recording OfferCreatedEvent: %v", err); errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Failed to process the request", nil); return }
 
     // persist idempotency mapping
     if idem != "" { _ = h.upsertIdem(r.Context(), idem, userID, scope, event.OfferID, 24*time.Hour) }
@@ -814,7 +814,7 @@ func (h *Handler) getOffers(w http.ResponseWriter, r *http.Request) {
 	if !ok || userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized: User ID is missing", nil); return }
 
     rows, err := h.DB.QueryContext(r.Context(), `
-        SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, created_at AS "createdAt"
+        SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, link_status, created_at AS "createdAt"
         FROM "Offer" WHERE userid = $1
     `, userID)
 	if err != nil { log.Printf("Error querying offers: %v", err); errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil); return }
@@ -823,7 +823,7 @@ func (h *Handler) getOffers(w http.ResponseWriter, r *http.Request) {
 	var offers []Offer
 	for rows.Next() {
 		var o Offer
-        if err := rows.Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.CreatedAt); err != nil { log.Printf("Error scanning offer row: %v", err); errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil); return }
+        if err := rows.Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.LinkStatus, &o.CreatedAt); err != nil { log.Printf("Error scanning offer row: %v", err); errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil); return }
 		offers = append(offers, o)
 	}
 
@@ -837,7 +837,7 @@ func (h *Handler) debugOffers(w http.ResponseWriter, r *http.Request) {
     userID, ok := r.Context().Value(middleware.UserIDKey).(string)
     if !ok || userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized", nil); return }
     rows, err := h.DB.QueryContext(r.Context(), `
-        SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, created_at AS "createdAt"
+        SELECT id, userid AS "userId", name, originalurl AS "originalUrl", status, siterankScore, link_status, created_at AS "createdAt"
         FROM "Offer" WHERE userid = $1 ORDER BY created_at DESC LIMIT 5
     `, userID)
     if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "query failed", map[string]string{"error": err.Error()}); return }
@@ -845,7 +845,7 @@ func (h *Handler) debugOffers(w http.ResponseWriter, r *http.Request) {
     var items []Offer
     for rows.Next() {
         var o Offer
-        if err := rows.Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.CreatedAt); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "scan failed", map[string]string{"error": err.Error()}); return }
+        if err := rows.Scan(&o.ID, &o.UserID, &o.Name, &o.OriginalUrl, &o.Status, &o.SiterankScore, &o.LinkStatus, &o.CreatedAt); err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "scan failed", map[string]string{"error": err.Error()}); return }
         items = append(items, o)
     }
     w.Header().Set("Content-Type", "application/json")
@@ -935,6 +935,73 @@ func (h *Handler) AutoStatusHandler(w http.ResponseWriter, r *http.Request) {
     _ = json.NewEncoder(w).Encode(map[string]any{"updated": len(changed), "items": changed})
 }
 
+// --- Link health feed (internal) ---
+// POST /api/v1/offers/internal/link-health
+// Called by batchopen after a link-health job. Secured via X-Service-Token == INTERNAL_SERVICE_TOKEN.
+// Records the latest verdict on the offer and moves offers with dead links to "declining"; an offer
+// declined for a dead link returns to its previous status once the link checks healthy again.
+// Status changes are recorded in "OfferStatusHistory" (schemas/sql/018_batchopen_link_health.sql).
+func (h *Handler) LinkHealthHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { errors.Write(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed", nil); return }
+    token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+    if token == "" || token != strings.TrimSpace(os.Getenv("INTERNAL_SERVICE_TOKEN")) { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "invalid service token", nil); return }
+    var body struct {
+        UserID string `json:"userId"`
+        JobID  string `json:"jobId"`
+        Items  []struct {
+            OfferID     string    `json:"offerId"`
+            Verdict     string    `json:"verdict"`
+            FinalDomain string    `json:"finalDomain"`
+            CheckedAt   time.Time `json:"checkedAt"`
+        } `json:"items"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "userId and items required", nil); return }
+    allowed := map[string]bool{"ok": true, "dead": true, "slow": true, "redirect_changed": true}
+    type upd struct{ ID, From, To string }
+    changed := make([]upd, 0, 8)
+    updated := 0
+    for _, it := range body.Items {
+        if it.OfferID == "" || !allowed[it.Verdict] { continue }
+        if it.CheckedAt.IsZero() { it.CheckedAt = time.Now().UTC() }
+        tx, err := h.DB.BeginTx(r.Context(), &sql.TxOptions{})
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "begin tx failed", nil); return }
+        var cur string
+        var prevVerdict sql.NullString
+        if err := tx.QueryRowContext(r.Context(), `SELECT status, link_status FROM "Offer" WHERE id=$1 AND userid=$2 FOR UPDATE`, it.OfferID, body.UserID).Scan(&cur, &prevVerdict); err != nil { _ = tx.Rollback(); continue }
+        // ignore stale results from an older job
+        res, err := tx.ExecContext(r.Context(), `UPDATE "Offer" SET link_status=$1, link_final_domain=NULLIF($2,''), link_checked_at=$3 WHERE id=$4 AND (link_checked_at IS NULL OR link_checked_at <= $3)`, it.Verdict, it.FinalDomain, it.CheckedAt, it.OfferID)
+        if err != nil { _ = tx.Rollback(); continue }
+        if n, _ := res.RowsAffected(); n == 0 { _ = tx.Rollback(); continue }
+        next := ""
+        switch {
+        case it.Verdict == "dead" && cur != "declining" && cur != "archived":
+            next = "declining"
+        case linkHealthy(it.Verdict) && cur == "declining" && prevVerdict.String == "dead":
+            // declined by the dead link (not by KPIs): restore the status it had before
+            next = "evaluating"
+            var from string
+            if err := tx.QueryRowContext(r.Context(), `SELECT from_status FROM "OfferStatusHistory" WHERE offer_id=$1 AND to_status='declining' ORDER BY created_at DESC, id DESC LIMIT 1`, it.OfferID).Scan(&from); err == nil && from != "" && from != "declining" {
+                next = from
+            }
+        }
+        if next != "" {
+            if _, err := tx.ExecContext(r.Context(), `UPDATE "Offer" SET status=$2, updated_at=NOW() WHERE id=$1`, it.OfferID, next); err != nil { _ = tx.Rollback(); continue }
+            if _, err := tx.ExecContext(r.Context(), `INSERT INTO "OfferStatusHistory"(offer_id,user_id,from_status,to_status) VALUES ($1,$2,$3,$4)`, it.OfferID, body.UserID, cur, next); err != nil {
+                log.Printf("link-health: status history for offer %s failed: %v", it.OfferID, err)
+                _ = tx.Rollback(); continue
+            }
+        }
+        if err := tx.Commit(); err != nil { continue }
+        updated++
+        if next != "" { changed = append(changed, upd{ID: it.OfferID, From: cur, To: next}) }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "jobId": body.JobID, "updated": updated, "statusChanged": changed})
+}
+
+// linkHealthy reports whether a link-health verdict means the offer link works again.
+func linkHealthy(verdict string) bool { return verdict == "ok" || verdict == "slow" }
+
 type kpiPoint2 struct{ Impressions int64; Clicks int64; Spend float64; Revenue float64; ROSC float64 }
 func computeDeterministicKPI(offerID string) []kpiPoint2 {
     h := fnv.New32a(); _, _ = h.Write([]byte(offerID)); seed := int64(h.Sum32())
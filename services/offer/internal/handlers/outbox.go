@@ -0,0 +1,27 @@
+package handlers
+
+import (
+    "context"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+    estore "github.com/xxrenzhe/autoads/pkg/eventstore"
+    "github.com/xxrenzhe/autoads/services/offer/internal/domain"
+)
+
+// Offer events leave through the event_outbox (pkg/events): they are recorded in the transaction
+// that stores them in event_store, and the relay started in main publishes them with retries.
+
+// OutboxSource names the offer service's rows in event_outbox and is the source of its events.
+const OutboxSource = "offer"
+
+// recordOfferCreated stores OfferCreated in event_store and the outbox in one transaction; the
+// read model is built from the published event.
+func (h *Handler) recordOfferCreated(ctx context.Context, e domain.OfferCreatedEvent) error {
+    _ = estore.EnsureDDL(h.DB)
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    if err := estore.WriteWith(ctx, tx, e.OfferID, "OfferCreated", "offer", e.OfferID, 1, e, map[string]any{"userId": e.UserID}); err != nil { return err }
+    if err := ev.Enqueue(ctx, tx, OutboxSource, ev.OutboxEvent{Type: ev.EventOfferCreated, Subject: e.OfferID, Data: e}); err != nil { return err }
+    return tx.Commit()
+}
@@ -7,7 +7,6 @@ import (
     "net/http"
     "time"
     "github.com/xxrenzhe/autoads/services/offer/internal/config"
-    "github.com/xxrenzhe/autoads/services/offer/internal/events"
     "github.com/xxrenzhe/autoads/services/offer/internal/handlers"
     ev "github.com/xxrenzhe/autoads/pkg/events"
     "github.com/xxrenzhe/autoads/pkg/telemetry"
@@ -33,13 +32,17 @@ func main() {
 
     // unified auth via pkg/middleware.AuthMiddleware
 
-    // Offer service: publish via unified pkg/events. Projections由 notifications 服务负责。
-    var publisherPub events.Publisher = &events.NoopPublisher{}
+    // Offer service: events leave through the event_outbox (pkg/events); the relay publishes them
+    // with retries. Projections由 notifications 服务负责。
+    if err := ev.EnsureOutbox(ctx, db); err != nil {
+        log.Printf("WARN: ensure event_outbox ddl failed: %v", err)
+    }
     if p, err := ev.NewPublisher(ctx); err != nil {
-        log.Printf("WARN: pkg/events publisher unavailable: %v; falling back to NoopPublisher", err)
+        log.Printf("WARN: pkg/events publisher unavailable: %v; events stay in the outbox", err)
     } else {
-        publisherPub = events.NewEVAdapter(p)
         defer p.Close()
+        relay := &ev.Relay{DB: db, Pub: p, Source: handlers.OutboxSource, Interval: time.Second}
+        go relay.Run(ctx)
     }
 
 
@@ -56,7 +59,7 @@ func main() {
     // Also expose /health and /healthz endpoints
     // before mounting OpenAPI routes.
     // Create handler instance to reuse readyz/healthz if needed
-    h := handlers.NewHandler(db, &events.LoggingMiddleware{Next: publisherPub})
+    h := handlers.NewHandler(db)
 
     // Telemetry and logging
     // (matches siterank/adscenter/billing/batchopen)
@@ -99,6 +102,8 @@ func main() {
 
     // Internal auto-status endpoint (protected via X-Service-Token)
     r.Handle("/api/v1/offers/internal/auto-status", http.HandlerFunc(h.AutoStatusHandler))
+    // Internal link-health feed from batchopen (protected via X-Service-Token)
+    r.Handle("/api/v1/offers/internal/link-health", http.HandlerFunc(h.LinkHealthHandler))
 
     log.Printf("Offer service listening on port %s", cfg.Port)
     if err := http.ListenAndServe(":"+cfg.Port, r); err != nil {
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    stderrors "errors"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+    "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/pkg/saga"
+    rcache "github.com/xxrenzhe/autoads/services/siterank/internal/cache"
+)
+
+// Billed action keys; billing prices them from its price book.
+const (
+    actionCachedQuery   = "siterank.query.cached"
+    actionRealtimeQuery = "siterank.query.realtime"
+    actionAIEvaluation  = "siterank.ai"
+)
+
+// billingItem is a quantity of one billed action.
+type billingItem struct {
+    Action   string `json:"action"`
+    Quantity int    `json:"quantity"`
+}
+
+// analysisCharge is what an analysis run reports back for settlement.
+type analysisCharge struct {
+    Completed bool
+    Items     []billingItem
+    Stages    []string
+}
+
+// add counts one more unit of action.
+func (c *analysisCharge) add(action string) {
+    for i := range c.Items {
+        if c.Items[i].Action == action { c.Items[i].Quantity++; return }
+    }
+    c.Items = append(c.Items, billingItem{Action: action, Quantity: 1})
+}
+
+// queryActionFor maps cache status to the billed query action: served from cache (fresh or stale) vs realtime.
+// A cached failure (rcache.Failed) produced no data and maps to no action; callers do not bill it.
+func queryActionFor(st rcache.Status) string {
+    switch st {
+    case rcache.Hit, rcache.Stale:
+        return actionCachedQuery
+    case rcache.Failed:
+        return ""
+    }
+    return actionRealtimeQuery
+}
+
+func queryStageFor(st rcache.Status) string {
+    switch st {
+    case rcache.Hit, rcache.Stale:
+        return "cache"
+    case rcache.Failed:
+        return "cache-failed"
+    }
+    return "realtime"
+}
+
+// aiScoringEnabled mirrors the condition under which analyzeWithResolveAndAI calls the AI scorer.
+func aiScoringEnabled() bool {
+    return strings.TrimSpace(os.Getenv("ANALYZE_WITH_RESOLVE")) == "1" && strings.TrimSpace(os.Getenv("AI_SCORING_URL")) != ""
+}
+
+// estimateAnalysisItems is the upper bound held on accept: a realtime fetch plus AI scoring when configured.
+func estimateAnalysisItems() []billingItem {
+    items := []billingItem{{Action: actionRealtimeQuery, Quantity: 1}}
+    if aiScoringEnabled() { items = append(items, billingItem{Action: actionAIEvaluation, Quantity: 1}) }
+    return items
+}
+
+// billingAction calls billing reserve|commit|release for one analysis run (no-op when BILLING_URL is unset).
+// Reserve and commit send the billed actions; billing prices them (commits at the reservation's price
+// version, capped at what it holds). Idempotency follows batchopen's billingAction:
+// "siterank:"+action+":"+userID+":"+chargeID. The caller's X-Org-Id is forwarded so the
+// organization wallet pays when the request names one. A non-2xx answer is a *saga.BillingError.
+func (s *Server) billingAction(ctx context.Context, userID, action, chargeID string, items []billingItem) error {
+    base := strings.TrimRight(os.Getenv("BILLING_URL"), "/")
+    if base == "" || userID == "" || chargeID == "" || (action != "release" && len(items) == 0) { return nil }
+    body := map[string]any{"taskId": chargeID}
+    if action != "release" { body["items"] = items }
+    if action == "reserve" { body["ttlSeconds"] = int(holdTTL / time.Second) }
+    // For commit/release, allow idempotent txId to be the charge id
+    if action == "commit" || action == "release" { body["txId"] = chargeID }
+    b, _ := json.Marshal(body)
+    cctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(cctx, http.MethodPost, base+"/api/v1/billing/tokens/"+action, bytes.NewReader(b))
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", "application/json")
+    req.Header.Set("X-User-Id", userID)
+    req.Header.Set("X-Idempotency-Key", "siterank:"+action+":"+userID+":"+chargeID)
+    if orgID := middleware.OrgIDFrom(ctx); orgID != "" { req.Header.Set(middleware.OrgHeader, orgID) }
+    resp, err := s.httpClient.DoRaw(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 200 && resp.StatusCode < 300 { return nil }
+    var eb struct{ Error struct{ Code string `json:"code"`; Details any `json:"details"` } `json:"error"` }
+    _ = json.NewDecoder(resp.Body).Decode(&eb)
+    return &saga.BillingError{Action: action, Status: resp.StatusCode, Code: eb.Error.Code, Details: eb.Error.Details}
+}
+
+// Analysis billing runs as the "siterank" saga (pkg/saga), keyed by charge id: reserve the
+// estimate, wait for the run to settle, commit what it used — or release the hold when the run fails,
+// bills nothing, times out or an operator compensates it (GET/POST /api/v1/siterank/admin/sagas).
+// The saga timer retries billing calls that fail.
+const (
+    sagaSiterank = "siterank"
+    // sagaRunFailed settles a run that must not be charged; it is only seen by the saga.
+    sagaRunFailed = "SiterankFailed"
+    // analyzeTimeout bounds the wait for the run's outcome.
+    analyzeTimeout = 30 * time.Minute
+    // holdTTL is the reservation lifetime requested from billing (its default is 30m, as long as
+    // the wait): the wait plus an hour for the commit and its first retries.
+    holdTTL = analyzeTimeout + time.Hour
+)
+
+func (s *Server) newBillingSagas(db *sql.DB) *saga.Orchestrator {
+    o := saga.New(db)
+    o.Register(saga.Definition{Kind: sagaSiterank, Steps: []saga.Step{
+        {Name: "reserve", Do: s.billingStep("reserve", "items"), Compensate: s.billingStep("release", ""), Retries: 5},
+        {Name: "analyze", Await: []string{ev.EventSiterankCompleted}, FailOn: []string{sagaRunFailed}, Timeout: analyzeTimeout},
+        {Name: "commit", Do: s.billingStep("commit", "charged"), Retries: 10, Backoff: 10 * time.Second},
+    }})
+    return o
+}
+
+// billingStep calls billing for the saga's charge with the items stored under itemsKey;
+// saga.BillingStep decides which answers are worth a retry.
+func (s *Server) billingStep(action, itemsKey string) func(context.Context, *saga.Instance) error {
+    return saga.BillingStep(action, func(ctx context.Context, in *saga.Instance) error {
+        var items []billingItem
+        if itemsKey != "" {
+            if err := in.Decode(itemsKey, &items); err != nil { return saga.Permanent(err) }
+        }
+        return s.billingAction(middleware.WithOrgID(ctx, in.String("orgId")), in.UserID, action, in.Key, items)
+    })
+}
+
+// reserveOrReject starts the charge's billing saga, which holds tokens for the items. On
+// insufficient balance it writes 402 INSUFFICIENT_TOKENS (SPEND_CAP_EXCEEDED for a member over
+// their cap) and returns false; other billing errors are retried by the saga and the request proceeds.
+func (s *Server) reserveOrReject(w http.ResponseWriter, r *http.Request, userID, chargeID string, items []billingItem) bool {
+    if s.sagas == nil { return true }
+    _, err := s.sagas.Start(r.Context(), sagaSiterank, chargeID, userID, map[string]any{"items": items, "orgId": middleware.OrgIDFrom(r.Context())})
+    if err == nil { return true }
+    var be *saga.BillingError
+    if stderrors.As(err, &be) && be.Rejected() {
+        msg := "Insufficient token balance for siterank analysis"
+        if be.Code == "SPEND_CAP_EXCEEDED" { msg = "Organization spend cap reached for siterank analysis" }
+        errors.Write(w, r, http.StatusPaymentRequired, be.Code, msg, map[string]any{"items": items, "billing": be.Details})
+        return false
+    }
+    log.Printf("WARN: siterank reserve failed for %s: %v", chargeID, err)
+    return true
+}
+
+// settleCharge hands the run's outcome to its billing saga: commit the stages that ran when the
+// analysis completed, release the hold when it failed (or nothing billable ran).
+func (s *Server) settleCharge(ctx context.Context, chargeID string, ch analysisCharge) {
+    if s.sagas == nil { return }
+    eventType, data := sagaRunFailed, map[string]any(nil)
+    if ch.Completed && len(ch.Items) > 0 { eventType, data = ev.EventSiterankCompleted, map[string]any{"charged": ch.Items, "stages": ch.Stages} }
+    if _, err := s.sagas.Signal(ctx, sagaSiterank, chargeID, eventType, data); err != nil {
+        log.Printf("WARN: siterank settle %s failed for %s: %v", eventType, chargeID, err)
+    }
+}
+
+// runBilled runs fn in the background and settles its charge when it returns.
+func (s *Server) runBilled(chargeID string, fn func(ctx context.Context) analysisCharge) {
+    go func() {
+        ctx := context.Background()
+        s.settleCharge(ctx, chargeID, fn(ctx))
+    }()
+}
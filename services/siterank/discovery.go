@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+    api "github.com/xxrenzhe/autoads/services/siterank/internal/oapi"
+)
+
+// candidateSet keeps discovered competitor domains in insertion order together with how each was found.
+type candidateSet struct {
+    seed    string
+    order   []string
+    sources map[string][]string
+}
+
+func newCandidateSet(seed string) *candidateSet {
+    return &candidateSet{seed: normalizeDomain(seed), sources: map[string][]string{}}
+}
+
+// add records domain with source; ignores the seed itself, its subdomains and known platform domains.
+func (c *candidateSet) add(raw, source string) {
+    d := normalizeDomain(raw)
+    if d == "" || d == c.seed || strings.HasSuffix(d, "."+c.seed) || isPlatformDomain(d) { return }
+    srcs, ok := c.sources[d]
+    if !ok { c.order = append(c.order, d) }
+    if !contains(srcs, source) { c.sources[d] = append(srcs, source) }
+}
+
+func (c *candidateSet) len() int { return len(c.order) }
+
+// discoverCandidates expands the candidate set from three sources:
+//  1) similar-sites lists from the traffic provider
+//  2) outbound links and brand mentions on the resolved landing page (browser-exec)
+//  3) past SiterankHistory analyses of the user's other offers in the same category
+func (s *Server) discoverCandidates(ctx context.Context, cands *candidateSet, userID, offerID, seed string, seedSW *SimilarWebResponse) {
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    collect := func(source string, fn func() []string) {
+        defer wg.Done()
+        list := fn()
+        mu.Lock(); defer mu.Unlock()
+        for _, d := range list { cands.add(d, source) }
+    }
+    var outbound, mentions []string
+    wg.Add(3)
+    go collect(string(api.SimilarSites), func() []string { return s.fetchSimilarSites(ctx, seed) })
+    go func() {
+        defer wg.Done()
+        outbound, mentions = s.mineLandingPage(ctx, seed)
+    }()
+    go collect(string(api.History), func() []string {
+        if seedSW == nil || strings.TrimSpace(seedSW.Category) == "" { return nil }
+        return s.historyDomainsInCategory(ctx, userID, offerID, seedSW.Category)
+    })
+    wg.Wait()
+    for _, d := range outbound { cands.add(d, string(api.OutboundLink)) }
+    for _, d := range mentions { cands.add(d, string(api.BrandMention)) }
+}
+
+// rankCandidates scores each candidate against the seed via computeSimilarity (bounded concurrency).
+func (s *Server) rankCandidates(ctx context.Context, seed string, seedSW *SimilarWebResponse, cands *candidateSet, country string) []api.SimilarityItem {
+    max := 30
+    if v := strings.TrimSpace(os.Getenv("SITERANK_DISCOVERY_MAX")); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 200 { max = n } }
+    domains := cands.order
+    if len(domains) > max { domains = domains[:max] }
+    out := make([]api.SimilarityItem, len(domains))
+    sem := make(chan struct{}, 4)
+    var wg sync.WaitGroup
+    for i, d := range domains {
+        wg.Add(1)
+        go func(i int, d string) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            sw, _ := s.fetchSimilarWebMetrics(ctx, d, country)
+            score, factors := computeSimilarity(seed, d, seedSW, sw, country)
+            srcs := make([]api.SimilarityItemSources, 0, len(cands.sources[d]))
+            for _, src := range cands.sources[d] { srcs = append(srcs, api.SimilarityItemSources(src)) }
+            factors["sources"] = cands.sources[d]
+            out[i] = api.SimilarityItem{Domain: d, Score: float32(score), Factors: &factors, Sources: &srcs}
+        }(i, d)
+    }
+    wg.Wait()
+    return out
+}
+
+// fetchSimilarSites returns the provider's similar-sites list for host. Uses SIMILARWEB_SIMILAR_URL
+// (fmt template with %s host) or the default data endpoint, direct first then browser-exec; cached via the result cache.
+func (s *Server) fetchSimilarSites(ctx context.Context, host string) []string {
+    e, _, err := s.rc.Fetch(ctx, cacheNsSimilar, host, cachePolicy(cacheNsSimilar), func(fctx context.Context) (string, bool, error) {
+        tpl := strings.TrimSpace(os.Getenv("SIMILARWEB_SIMILAR_URL"))
+        if tpl == "" { tpl = strings.TrimSpace(os.Getenv("SIMILARWEB_BASE_URL")) }
+        if tpl == "" { tpl = "https://data.similarweb.com/api/v1/data?domain=%s" }
+        apiURL := fmt.Sprintf(tpl, host)
+        headers := map[string]string{"User-Agent": defaultUA()}
+        if h := strings.TrimSpace(os.Getenv("SIMILARWEB_USER_AGENT")); h != "" { headers["User-Agent"] = h }
+        cctx, cancel := context.WithTimeout(fctx, 8*time.Second)
+        defer cancel()
+        var raw map[string]any
+        if err := s.httpClient.DoJSON(cctx, http.MethodGet, apiURL, nil, headers, 1, &raw); err != nil {
+            raw = nil
+            if txt, ok := s.fetchBrowserJSON(cctx, apiURL, headers); ok { _ = json.Unmarshal([]byte(txt), &raw) }
+        }
+        if raw == nil { return `[]`, false, nil }
+        return mustJSON(parseSimilarSites(raw)), true, nil
+    })
+    if err != nil || !e.Ok { return nil }
+    var list []string
+    if json.Unmarshal([]byte(e.Payload), &list) != nil { return nil }
+    return list
+}
+
+// parseSimilarSites accepts the flexible shapes seen from providers:
+// similar_sites / SimilarSites / similarSites as []string or []{site|Site|domain|Domain}.
+func parseSimilarSites(raw map[string]any) []string {
+    out := []string{}
+    for _, key := range []string{"similar_sites", "SimilarSites", "similarSites", "SimilarSitesByRank"} {
+        arr, ok := raw[key].([]any)
+        if !ok { continue }
+        for _, it := range arr {
+            switch v := it.(type) {
+            case string:
+                out = append(out, v)
+            case map[string]any:
+                for _, f := range []string{"site", "Site", "domain", "Domain"} {
+                    if sv, ok := v[f].(string); ok && sv != "" { out = append(out, sv); break }
+                }
+            }
+        }
+    }
+    return unique(out)
+}
+
+// resolveLanding follows the seed's redirects via browser-exec (within budget) and returns the final
+// landing URL and its domain; it falls back to https://seed and seed when resolving fails.
+func (s *Server) resolveLanding(ctx context.Context, seed string, budget time.Duration) (string, string) {
+    finalURL, domain := "https://"+seed, seed
+    if !s.be.Configured() { return finalURL, domain }
+    ctxRes, cancel := context.WithTimeout(ctx, budget)
+    defer cancel()
+    rr, err := s.be.ResolveOffer(ctxRes, browserexec.ResolveOfferRequest{URL: finalURL, WaitUntil: "domcontentloaded", TimeoutMs: int(budget.Milliseconds()) - 1000, StabilizeMs: 800})
+    if err != nil || rr.FinalUrl == "" { return finalURL, domain }
+    finalURL = rr.FinalUrl
+    if d := normalizeDomain(rr.Domain); d != "" {
+        domain = d
+    } else if d := normalizeDomain(rr.FinalUrl); d != "" {
+        domain = d
+    }
+    return finalURL, domain
+}
+
+// mineLandingPage resolves the seed landing via browser-exec and returns outbound link domains and brand mentions.
+func (s *Server) mineLandingPage(ctx context.Context, seed string) ([]string, []string) {
+    if !s.be.Configured() { return nil, nil }
+    finalURL, _ := s.resolveLanding(ctx, seed, 10*time.Second)
+    ctxPg, cancel2 := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel2()
+    ps, err := s.be.PageSignals(ctxPg, browserexec.PageSignalsRequest{URL: finalURL, TimeoutMs: 8000, Links: true})
+    if err != nil { return nil, nil }
+    return ps.OutboundDomains, ps.Mentions
+}
+
+// historyDomainsInCategory returns final domains from the user's past analyses of other offers in category.
+func (s *Server) historyDomainsInCategory(ctx context.Context, userID, offerID, category string) []string {
+    if userID == "" || category == "" { return nil }
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT DISTINCT domain
+        FROM "SiterankHistory"
+        WHERE user_id=$1 AND offer_id<>$2 AND domain<>''
+          AND lower(category) = lower($3)
+        LIMIT 50
+    `, userID, offerID, category)
+    if err != nil { return nil }
+    defer rows.Close()
+    out := []string{}
+    for rows.Next() {
+        var d string
+        if rows.Scan(&d) == nil && d != "" { out = append(out, d) }
+    }
+    return out
+}
+
+// normalizeDomain lowercases and strips scheme, path and "www."; returns "" for non-domains.
+func normalizeDomain(raw string) string {
+    d := strings.ToLower(strings.TrimSpace(raw))
+    if d == "" { return "" }
+    if strings.Contains(d, "://") {
+        if u, err := url.Parse(d); err == nil { d = u.Hostname() }
+    }
+    if i := strings.IndexAny(d, "/?#:"); i >= 0 { d = d[:i] }
+    d = strings.TrimPrefix(strings.TrimSuffix(d, "."), "www.")
+    if !strings.Contains(d, ".") { return "" }
+    return d
+}
+
+// isPlatformDomain filters social/CDN/infra domains that show up on most landing pages.
+func isPlatformDomain(d string) bool {
+    platforms := []string{
+        "facebook.com", "instagram.com", "twitter.com", "x.com", "youtube.com", "tiktok.com", "linkedin.com", "pinterest.com",
+        "google.com", "googleapis.com", "gstatic.com", "googletagmanager.com", "doubleclick.net", "apple.com", "microsoft.com",
+        "cloudflare.com", "cloudfront.net", "amazonaws.com", "akamaihd.net", "shopify.com", "wordpress.com", "wp.com",
+        "paypal.com", "visa.com", "mastercard.com", "trustpilot.com", "w3.org", "schema.org",
+    }
+    for _, p := range platforms {
+        if d == p || strings.HasSuffix(d, "."+p) { return true }
+    }
+    return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xxrenzhe/autoads/pkg/browserexec"
+	"github.com/xxrenzhe/autoads/pkg/browserexec/browserexectest"
+)
+
+func TestMineLandingPageUsesResolvedURL(t *testing.T) {
+	fake := browserexectest.NewServer()
+	defer fake.Close()
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.OK(browserexec.ResolveOfferResult{Ok: true, Status: 200, FinalUrl: "https://shop.example.com/landing/", Domain: "shop.example.com"}))
+	fake.Enqueue(browserexec.EndpointPageSignals, browserexectest.OK(browserexec.PageSignals{Status: 200, OutboundDomains: []string{"rival.com"}, Mentions: []string{"other.shop"}}))
+
+	s := &Server{be: fake.Client()}
+	outbound, mentions := s.mineLandingPage(context.Background(), "example.com")
+	if len(outbound) != 1 || outbound[0] != "rival.com" || len(mentions) != 1 {
+		t.Fatalf("unexpected signals: %v %v", outbound, mentions)
+	}
+	var req browserexec.PageSignalsRequest
+	if err := fake.Calls(browserexec.EndpointPageSignals)[0].Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.URL != "https://shop.example.com/landing/" || !req.Links {
+		t.Fatalf("page-signals not called on resolved landing with links: %+v", req)
+	}
+}
+
+func TestResolveOfferForCountrySendsProxyHint(t *testing.T) {
+	t.Setenv("PROXY_URL_DE", "https://proxies.example/de.txt")
+	fake := browserexectest.NewServer()
+	defer fake.Close()
+
+	s := &Server{be: fake.Client()}
+	rr, err := s.resolveOfferForCountry(context.Background(), "https://offer.example.com/go?id=1", "DE")
+	if err != nil || rr.Domain != "offer.example.com" {
+		t.Fatalf("resolve: %+v %v", rr, err)
+	}
+	var req browserexec.ResolveOfferRequest
+	_ = fake.Calls(browserexec.EndpointResolveOffer)[0].Decode(&req)
+	if req.Country != "DE" || req.ProxyProviderURL != "https://proxies.example/de.txt" {
+		t.Fatalf("country hint not forwarded: %+v", req)
+	}
+
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(http.StatusGatewayTimeout, "RESOLVE_TIMEOUT", "Timeout 45000ms exceeded"))
+	if _, err := s.resolveOfferForCountry(context.Background(), "https://offer.example.com/go?id=1", "DE"); err == nil {
+		t.Fatal("expected resolve timeout to surface as error")
+	}
+}
+
+func TestResolveLandingFollowsTracker(t *testing.T) {
+	fake := browserexectest.NewServer()
+	defer fake.Close()
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.OK(browserexec.ResolveOfferResult{Ok: true, Status: 200, FinalUrl: "https://www.merchant.com/shoes?ref=1", Domain: "www.merchant.com"}))
+
+	s := &Server{be: fake.Client()}
+	finalURL, domain := s.resolveLanding(context.Background(), "track.example.net", 6*time.Second)
+	if finalURL != "https://www.merchant.com/shoes?ref=1" || domain != "merchant.com" {
+		t.Fatalf("landing = %q %q", finalURL, domain)
+	}
+	if brand, _ := tokenizeDomain(domain); brand != "merchant" {
+		t.Fatalf("keywords would be mined for %q", brand)
+	}
+
+	fake.Enqueue(browserexec.EndpointResolveOffer, browserexectest.Fail(http.StatusGatewayTimeout, "RESOLVE_TIMEOUT", "Timeout exceeded"))
+	if finalURL, domain := s.resolveLanding(context.Background(), "track.example.net", 6*time.Second); finalURL != "https://track.example.net" || domain != "track.example.net" {
+		t.Fatalf("fallback = %q %q", finalURL, domain)
+	}
+}
+
+func TestHistoryCategoryAcrossPayloadShapes(t *testing.T) {
+	cases := map[string]string{
+		`{"global_rank":12,"category":"Lifestyle/Fashion"}`:                            "Lifestyle/Fashion",
+		`{"GlobalRank":{"Rank":12},"Category":"Lifestyle/Fashion"}`:                    "Lifestyle/Fashion",
+		`{"resolve":{"domain":"a.com"},"similarweb":{"category":"Lifestyle/Fashion"}}`: "Lifestyle/Fashion",
+		`{"resolve":{"domain":"a.com"},"similarweb":null}`:                             "",
+	}
+	for payload, want := range cases {
+		if got := historyCategory(payload); got != want {
+			t.Errorf("historyCategory(%s) = %q, want %q", payload, got, want)
+		}
+	}
+}
@@ -18,6 +18,8 @@ replace github.com/xxrenzhe/autoads/pkg/telemetry => ../../pkg/telemetry
 replace github.com/xxrenzhe/autoads/pkg/middleware => ../../pkg/middleware
 replace github.com/xxrenzhe/autoads/pkg/eventstore => ../../pkg/eventstore
 replace github.com/xxrenzhe/autoads/pkg/idempotency => ../../pkg/idempotency
+replace github.com/xxrenzhe/autoads/pkg/browserexec => ../../pkg/browserexec
+replace github.com/xxrenzhe/autoads/pkg/saga => ../../pkg/saga
 
 	require (
 	cloud.google.com/go/firestore v1.18.0
@@ -28,6 +30,7 @@ replace github.com/xxrenzhe/autoads/pkg/idempotency => ../../pkg/idempotency
 	github.com/lib/pq v1.10.9
 	github.com/oapi-codegen/runtime v1.1.2
 	github.com/xxrenzhe/autoads/pkg/auth v0.0.1
+	github.com/xxrenzhe/autoads/pkg/browserexec v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/config v0.0.0-20250921095352-ef8078c06b83
 	github.com/xxrenzhe/autoads/pkg/errors v0.0.1
 	github.com/xxrenzhe/autoads/pkg/events v0.0.0-00010101000000-000000000000
@@ -35,6 +38,7 @@ replace github.com/xxrenzhe/autoads/pkg/idempotency => ../../pkg/idempotency
 	github.com/xxrenzhe/autoads/pkg/http v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/logger v0.0.1
 	github.com/xxrenzhe/autoads/pkg/middleware v0.0.0-20250921095352-ef8078c06b83
+	github.com/xxrenzhe/autoads/pkg/saga v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/telemetry v0.0.0-00010101000000-000000000000
 	github.com/xxrenzhe/autoads/pkg/eventstore v0.0.0-00010101000000-000000000000
 )
@@ -0,0 +1,410 @@
+// Package cache implements siterank's two-tier result cache (memory -> Postgres)
+// with per-key success/failure TTLs and stale-while-revalidate.
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Status is the outcome of a cache lookup.
+type Status string
+
+const (
+	Hit   Status = "hit"   // fresh entry
+	Stale Status = "stale" // expired but within the stale window; served while a refresh runs
+	// Failed is a fresh cached failure (negative caching): the fetch is not retried until FailTTL
+	// passes, but there is no value to serve, so it is neither counted nor billed as a hit.
+	Failed Status = "failed"
+	Miss   Status = "miss" // nothing usable; value was (or must be) fetched in the request path
+)
+
+// Policy controls how long an entry is fresh and how long it may be served stale.
+type Policy struct {
+	OkTTL    time.Duration // fresh window for successful results
+	FailTTL  time.Duration // fresh window for failures (negative caching)
+	StaleTTL time.Duration // extra window after OkTTL in which the entry is served stale
+	MemTTL   time.Duration // max time an entry lives in memory before re-reading Postgres (0 = 5m)
+}
+
+// Entry is a cached payload (JSON text) with its freshness bounds.
+type Entry struct {
+	Payload    string    `json:"payload"`
+	Ok         bool      `json:"ok"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	FreshUntil time.Time `json:"freshUntil"`
+	StaleUntil time.Time `json:"staleUntil"`
+}
+
+// Fetcher produces a fresh value. ok=false is cached as a failure for FailTTL;
+// a non-nil error means "do not cache" (e.g. cancelled context).
+type Fetcher func(ctx context.Context) (payload string, ok bool, err error)
+
+type memEntry struct {
+	Entry
+	memUntil time.Time
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	entry Entry
+	err   error
+}
+
+// Cache is safe for concurrent use. A nil db disables the Postgres tier.
+type Cache struct {
+	db *sql.DB
+
+	mu     sync.RWMutex
+	mem    map[string]memEntry
+	maxMem int
+
+	flightMu   sync.Mutex
+	inflight   map[string]*call
+	refreshing map[string]struct{}
+
+	refreshTimeout time.Duration
+	now            func() time.Time
+
+	hits, stales, failed, misses, refreshes, refreshFailures, invalidations atomic.Int64
+}
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "siterank_cache_requests_total",
+		Help: "Siterank cache lookups by namespace, tier and status (hit|stale|failed|miss)",
+	}, []string{"namespace", "tier", "status"})
+	metricRefresh = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "siterank_cache_refresh_total",
+		Help: "Background stale-while-revalidate refreshes by outcome",
+	}, []string{"namespace", "outcome"})
+	metricInvalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "siterank_cache_invalidations_total",
+		Help: "Explicit cache invalidations by namespace",
+	}, []string{"namespace"})
+)
+
+func init() {
+	_ = prometheus.Register(metricRequests)
+	_ = prometheus.Register(metricRefresh)
+	_ = prometheus.Register(metricInvalidations)
+}
+
+// New returns a cache backed by db (may be nil for memory-only use).
+func New(db *sql.DB) *Cache {
+	return &Cache{
+		db:             db,
+		mem:            map[string]memEntry{},
+		maxMem:         10000,
+		inflight:       map[string]*call{},
+		refreshing:     map[string]struct{}{},
+		refreshTimeout: 60 * time.Second,
+		now:            time.Now,
+	}
+}
+
+// Check reports whether the siterank_cache table exists. It is created (and filled from the legacy
+// domain caches) by schemas/sql/016_siterank_cache.sql, the only copy of its DDL.
+func Check(ctx context.Context, db *sql.DB) error {
+	var name sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('siterank_cache')::text`).Scan(&name); err != nil {
+		return err
+	}
+	if !name.Valid {
+		return errors.New("siterank_cache missing: apply schemas/sql/016_siterank_cache.sql")
+	}
+	return nil
+}
+
+// Key joins parts with "|" (e.g. Key(host, country)).
+func Key(parts ...string) string { return strings.Join(parts, "|") }
+
+func memKey(ns, key string) string { return ns + "\x00" + key }
+
+// Get returns the entry for (ns,key) and whether it is fresh, stale or missing.
+func (c *Cache) Get(ctx context.Context, ns, key string) (Entry, Status) {
+	e, st, tier := c.get(ctx, ns, key)
+	c.observe(ns, tier, st)
+	return e, st
+}
+
+func (c *Cache) get(ctx context.Context, ns, key string) (Entry, Status, string) {
+	now := c.now()
+	c.mu.RLock()
+	me, ok := c.mem[memKey(ns, key)]
+	c.mu.RUnlock()
+	if ok && now.Before(me.memUntil) {
+		if st := classify(me.Entry, now); st != Miss {
+			return me.Entry, st, "memory"
+		}
+	}
+	if c.db == nil {
+		return Entry{}, Miss, "none"
+	}
+	var e Entry
+	err := c.db.QueryRowContext(ctx, `SELECT payload::text, ok, updated_at, fresh_until, stale_until FROM siterank_cache WHERE namespace=$1 AND key=$2 AND stale_until > NOW()`, ns, key).
+		Scan(&e.Payload, &e.Ok, &e.UpdatedAt, &e.FreshUntil, &e.StaleUntil)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("siterank cache read failed for %s/%s: %v", ns, key, err)
+		}
+		return Entry{}, Miss, "none"
+	}
+	c.putMem(ns, key, e, 0)
+	st := classify(e, now)
+	if st == Miss {
+		return Entry{}, Miss, "none"
+	}
+	return e, st, "postgres"
+}
+
+func classify(e Entry, now time.Time) Status {
+	switch {
+	case now.Before(e.FreshUntil) && !e.Ok:
+		return Failed
+	case now.Before(e.FreshUntil):
+		return Hit
+	case now.Before(e.StaleUntil):
+		return Stale
+	default:
+		return Miss
+	}
+}
+
+// Set stores payload under (ns,key) in both tiers using p's TTLs.
+func (c *Cache) Set(ctx context.Context, ns, key, payload string, ok bool, p Policy) error {
+	now := c.now()
+	e := Entry{Payload: payload, Ok: ok, UpdatedAt: now}
+	if ok {
+		e.FreshUntil = now.Add(p.OkTTL)
+		e.StaleUntil = e.FreshUntil.Add(p.StaleTTL)
+	} else {
+		// failures are never served stale: once FailTTL passes we retry in the request path
+		e.FreshUntil = now.Add(p.FailTTL)
+		e.StaleUntil = e.FreshUntil
+	}
+	c.putMem(ns, key, e, p.MemTTL)
+	if c.db == nil {
+		return nil
+	}
+	_, err := c.db.ExecContext(ctx, `
+        INSERT INTO siterank_cache (namespace, key, payload, ok, updated_at, fresh_until, stale_until)
+        VALUES ($1, $2, $3::jsonb, $4, $5, $6, $7)
+        ON CONFLICT (namespace, key) DO UPDATE SET payload=EXCLUDED.payload, ok=EXCLUDED.ok, updated_at=EXCLUDED.updated_at,
+            fresh_until=EXCLUDED.fresh_until, stale_until=EXCLUDED.stale_until
+    `, ns, key, payload, ok, e.UpdatedAt, e.FreshUntil, e.StaleUntil)
+	if err != nil {
+		log.Printf("siterank cache upsert failed for %s/%s: %v", ns, key, err)
+	}
+	return err
+}
+
+// Fetch returns the cached value, refreshing it in the background when stale and
+// fetching it synchronously (coalesced per key) on a miss. A cached failure is returned
+// as Failed without fetching until its FailTTL passes.
+func (c *Cache) Fetch(ctx context.Context, ns, key string, p Policy, fn Fetcher) (Entry, Status, error) {
+	e, st := c.Get(ctx, ns, key)
+	switch st {
+	case Hit, Failed:
+		return e, st, nil
+	case Stale:
+		c.refreshAsync(ns, key, p, fn, e)
+		return e, Stale, nil
+	}
+	e, err := c.fetchOnce(ctx, ns, key, p, fn)
+	return e, Miss, err
+}
+
+func (c *Cache) fetchOnce(ctx context.Context, ns, key string, p Policy, fn Fetcher) (Entry, error) {
+	mk := memKey(ns, key)
+	c.flightMu.Lock()
+	if cl, ok := c.inflight[mk]; ok {
+		c.flightMu.Unlock()
+		cl.wg.Wait()
+		return cl.entry, cl.err
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	c.inflight[mk] = cl
+	c.flightMu.Unlock()
+
+	payload, ok, err := fn(ctx)
+	if err == nil {
+		_ = c.Set(ctx, ns, key, payload, ok, p)
+		cl.entry = Entry{Payload: payload, Ok: ok, UpdatedAt: c.now()}
+	}
+	cl.err = err
+
+	c.flightMu.Lock()
+	delete(c.inflight, mk)
+	c.flightMu.Unlock()
+	cl.wg.Done()
+	return cl.entry, cl.err
+}
+
+// refreshAsync revalidates a stale entry once per key. A failed refresh keeps the
+// previous successful value until its stale window ends.
+func (c *Cache) refreshAsync(ns, key string, p Policy, fn Fetcher, prev Entry) {
+	mk := memKey(ns, key)
+	c.flightMu.Lock()
+	if _, busy := c.refreshing[mk]; busy {
+		c.flightMu.Unlock()
+		return
+	}
+	c.refreshing[mk] = struct{}{}
+	c.flightMu.Unlock()
+	go func() {
+		defer func() {
+			c.flightMu.Lock()
+			delete(c.refreshing, mk)
+			c.flightMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), c.refreshTimeout)
+		defer cancel()
+		c.refreshes.Add(1)
+		payload, ok, err := fn(ctx)
+		if err != nil || (!ok && prev.Ok) {
+			c.refreshFailures.Add(1)
+			metricRefresh.WithLabelValues(ns, "failed").Inc()
+			return
+		}
+		_ = c.Set(ctx, ns, key, payload, ok, p)
+		metricRefresh.WithLabelValues(ns, "ok").Inc()
+	}()
+}
+
+// Invalidate removes entries in ns whose key starts with keyPrefix (empty = whole namespace).
+// Returns the number of memory and Postgres entries removed.
+func (c *Cache) Invalidate(ctx context.Context, ns, keyPrefix string) (int, int64, error) {
+	c.mu.Lock()
+	removed := 0
+	for mk := range c.mem {
+		if strings.HasPrefix(mk, memKey(ns, keyPrefix)) {
+			delete(c.mem, mk)
+			removed++
+		}
+	}
+	c.mu.Unlock()
+	c.invalidations.Add(1)
+	metricInvalidations.WithLabelValues(ns).Inc()
+	if c.db == nil {
+		return removed, 0, nil
+	}
+	res, err := c.db.ExecContext(ctx, `DELETE FROM siterank_cache WHERE namespace=$1 AND starts_with(key, $2)`, ns, keyPrefix)
+	if err != nil {
+		return removed, 0, err
+	}
+	n, _ := res.RowsAffected()
+	return removed, n, nil
+}
+
+// Purge deletes rows past their stale window from Postgres and drops expired memory entries.
+func (c *Cache) Purge(ctx context.Context) (int64, error) {
+	now := c.now()
+	c.mu.Lock()
+	for mk, me := range c.mem {
+		if !now.Before(me.StaleUntil) || !now.Before(me.memUntil) {
+			delete(c.mem, mk)
+		}
+	}
+	c.mu.Unlock()
+	if c.db == nil {
+		return 0, nil
+	}
+	res, err := c.db.ExecContext(ctx, `DELETE FROM siterank_cache WHERE stale_until < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StartJanitor purges expired entries every interval until ctx is done.
+func (c *Cache) StartJanitor(ctx context.Context, every time.Duration) {
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if n, err := c.Purge(ctx); err != nil {
+					log.Printf("siterank cache purge failed: %v", err)
+				} else if n > 0 {
+					log.Printf("siterank cache purged %d expired rows", n)
+				}
+			}
+		}
+	}()
+}
+
+// Stats returns process-local counters (Prometheus carries the labelled series).
+func (c *Cache) Stats() map[string]any {
+	c.mu.RLock()
+	size := len(c.mem)
+	c.mu.RUnlock()
+	c.flightMu.Lock()
+	refreshing := len(c.refreshing)
+	c.flightMu.Unlock()
+	return map[string]any{
+		"memoryEntries":   size,
+		"hits":            c.hits.Load(),
+		"stale":           c.stales.Load(),
+		"failed":          c.failed.Load(),
+		"misses":          c.misses.Load(),
+		"refreshes":       c.refreshes.Load(),
+		"refreshFailures": c.refreshFailures.Load(),
+		"refreshing":      refreshing,
+		"invalidations":   c.invalidations.Load(),
+	}
+}
+
+func (c *Cache) observe(ns, tier string, st Status) {
+	switch st {
+	case Hit:
+		c.hits.Add(1)
+	case Stale:
+		c.stales.Add(1)
+	case Failed:
+		c.failed.Add(1)
+	default:
+		c.misses.Add(1)
+	}
+	metricRequests.WithLabelValues(ns, tier, string(st)).Inc()
+}
+
+func (c *Cache) putMem(ns, key string, e Entry, memTTL time.Duration) {
+	if memTTL <= 0 {
+		memTTL = 5 * time.Minute
+	}
+	until := c.now().Add(memTTL)
+	if e.StaleUntil.Before(until) {
+		until = e.StaleUntil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.mem) >= c.maxMem {
+		now := c.now()
+		for mk, me := range c.mem {
+			if !now.Before(me.memUntil) {
+				delete(c.mem, mk)
+			}
+		}
+		// still full: drop an arbitrary entry rather than grow unbounded
+		for mk := range c.mem {
+			if len(c.mem) < c.maxMem {
+				break
+			}
+			delete(c.mem, mk)
+		}
+	}
+	c.mem[memKey(ns, key)] = memEntry{Entry: e, memUntil: until}
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time      { c.mu.Lock(); defer c.mu.Unlock(); return c.t }
+func (c *clock) add(d time.Duration) { c.mu.Lock(); c.t = c.t.Add(d); c.mu.Unlock() }
+
+func newTestCache() (*Cache, *clock) {
+	clk := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := New(nil)
+	c.now = clk.now
+	return c, clk
+}
+
+var policy = Policy{OkTTL: time.Hour, FailTTL: time.Minute, StaleTTL: time.Hour, MemTTL: 24 * time.Hour}
+
+func TestFetchMissThenHit(t *testing.T) {
+	c, _ := newTestCache()
+	calls := 0
+	fn := func(ctx context.Context) (string, bool, error) { calls++; return `{"v":1}`, true, nil }
+
+	e, st, err := c.Fetch(context.Background(), "sw", Key("example.com", "US"), policy, fn)
+	if err != nil || st != Miss || e.Payload != `{"v":1}` {
+		t.Fatalf("first fetch: got %v %v %v", e.Payload, st, err)
+	}
+	e, st, _ = c.Fetch(context.Background(), "sw", Key("example.com", "US"), policy, fn)
+	if st != Hit || e.Payload != `{"v":1}` || calls != 1 {
+		t.Fatalf("second fetch: got %v %v calls=%d", e.Payload, st, calls)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c, clk := newTestCache()
+	ctx := context.Background()
+	_ = c.Set(ctx, "sw", "k", `{"v":1}`, true, policy)
+	clk.add(90 * time.Minute) // past OkTTL, inside StaleTTL
+
+	done := make(chan struct{})
+	fn := func(ctx context.Context) (string, bool, error) { defer close(done); return `{"v":2}`, true, nil }
+	e, st, _ := c.Fetch(ctx, "sw", "k", policy, fn)
+	if st != Stale || e.Payload != `{"v":1}` {
+		t.Fatalf("expected stale v1, got %v %v", e.Payload, st)
+	}
+	<-done
+	// refresh writes after fn returns; poll briefly
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if e, st := c.Get(ctx, "sw", "k"); st == Hit && e.Payload == `{"v":2}` {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("background refresh did not replace stale entry")
+}
+
+func TestFailedRefreshKeepsStaleValue(t *testing.T) {
+	c, clk := newTestCache()
+	ctx := context.Background()
+	_ = c.Set(ctx, "sw", "k", `{"v":1}`, true, policy)
+	clk.add(90 * time.Minute)
+	done := make(chan struct{})
+	_, _, _ = c.Fetch(ctx, "sw", "k", policy, func(ctx context.Context) (string, bool, error) { defer close(done); return `{}`, false, nil })
+	<-done
+	time.Sleep(10 * time.Millisecond)
+	if e, st := c.Get(ctx, "sw", "k"); st != Stale || e.Payload != `{"v":1}` {
+		t.Fatalf("expected stale v1 kept, got %v %v", e.Payload, st)
+	}
+}
+
+func TestFailureTTLAndNoStale(t *testing.T) {
+	c, clk := newTestCache()
+	ctx := context.Background()
+	_ = c.Set(ctx, "sw", "k", `{"error":"x"}`, false, policy)
+	if e, st := c.Get(ctx, "sw", "k"); st != Failed || e.Ok {
+		t.Fatalf("expected cached failure, got ok=%v %v", e.Ok, st)
+	}
+	calls := 0
+	if _, st, _ := c.Fetch(ctx, "sw", "k", policy, func(ctx context.Context) (string, bool, error) { calls++; return `{}`, true, nil }); st != Failed || calls != 0 {
+		t.Fatalf("expected cached failure without fetching, got %v calls=%d", st, calls)
+	}
+	if stats := c.Stats(); stats["hits"] != int64(0) || stats["failed"] != int64(2) {
+		t.Fatalf("cached failures counted as hits: %v", stats)
+	}
+	clk.add(2 * time.Minute)
+	if _, st := c.Get(ctx, "sw", "k"); st != Miss {
+		t.Fatalf("expected miss after FailTTL, got %v", st)
+	}
+}
+
+func TestFetchErrorIsNotCached(t *testing.T) {
+	c, _ := newTestCache()
+	ctx := context.Background()
+	_, _, err := c.Fetch(ctx, "sw", "k", policy, func(ctx context.Context) (string, bool, error) { return "", false, errors.New("boom") })
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if _, st := c.Get(ctx, "sw", "k"); st != Miss {
+		t.Fatalf("expected miss, got %v", st)
+	}
+}
+
+func TestFetchCoalescesConcurrentMisses(t *testing.T) {
+	c, _ := newTestCache()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (string, bool, error) {
+		calls.Add(1)
+		<-release
+		return `{"v":1}`, true, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() { defer wg.Done(); _, _, _ = c.Fetch(context.Background(), "sw", "k", policy, fn) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected 1 fetch, got %d", n)
+	}
+}
+
+func TestInvalidatePrefix(t *testing.T) {
+	c, _ := newTestCache()
+	ctx := context.Background()
+	_ = c.Set(ctx, "sw", Key("a.com", "US"), `{}`, true, policy)
+	_ = c.Set(ctx, "sw", Key("a.com", "DE"), `{}`, true, policy)
+	_ = c.Set(ctx, "sw", Key("b.com", "US"), `{}`, true, policy)
+	mem, _, err := c.Invalidate(ctx, "sw", "a.com|")
+	if err != nil || mem != 2 {
+		t.Fatalf("expected 2 removed, got %d %v", mem, err)
+	}
+	if _, st := c.Get(ctx, "sw", Key("b.com", "US")); st != Hit {
+		t.Fatalf("b.com should remain cached, got %v", st)
+	}
+}
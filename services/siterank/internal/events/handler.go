@@ -11,8 +11,14 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
+// OutboxSource names this worker's rows in the shared event_outbox (pkg/events). It differs from
+// the siterank service's source because the relay started in cmd/server publishes them through
+// Publisher, whose message format is the workflow one.
+const OutboxSource = "siterank.workflow"
+
 // WorkflowStepStartedPayload defines the incoming event structure.
 type WorkflowStepStartedPayload struct {
 	WorkflowProgressID string                 `json:"workflowProgressId"`
@@ -48,7 +54,7 @@ func simulateSiterankAnalysis(url string) (float64, map[string]interface{}) {
 }
 
 // HandleWorkflowStepStarted processes the event to perform a siterank analysis.
-func HandleWorkflowStepStarted(ctx context.Context, db *sql.DB, publisher *Publisher, payload []byte) error {
+func HandleWorkflowStepStarted(ctx context.Context, db *sql.DB, payload []byte) error {
 	var data WorkflowStepStartedPayload
 	if err := json.Unmarshal(payload, &data); err != nil {
 		return fmt.Errorf("failed to unmarshal payload: %w", err)
@@ -96,7 +102,7 @@ func HandleWorkflowStepStarted(ctx context.Context, db *sql.DB, publisher *Publi
 		return fmt.Errorf("failed to insert siterank analysis: %w", err)
 	}
 
-	// Publish an event to notify that the analysis is complete.
+	// Record an event, in the same transaction, to notify that the analysis is complete.
 	completedPayload := SiterankAnalysisCompletedPayload{
 		AnalysisID: analysisID,
 		UserID:     data.UserID,
@@ -104,8 +110,8 @@ func HandleWorkflowStepStarted(ctx context.Context, db *sql.DB, publisher *Publi
 		Score:      score,
 	}
 
-	if err := publisher.Publish(ctx, "SiterankAnalysisCompleted", completedPayload); err != nil {
-		return fmt.Errorf("failed to publish completion event: %w", err)
+	if err := ev.Enqueue(ctx, tx, OutboxSource, ev.OutboxEvent{Type: "SiterankAnalysisCompleted", Subject: analysisID, Data: completedPayload}); err != nil {
+		return fmt.Errorf("failed to record completion event: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"cloud.google.com/go/pubsub"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
 type Publisher struct {
@@ -28,7 +29,8 @@ func NewPublisher(ctx context.Context) (*Publisher, error) {
 	return &Publisher{ client: client, topic: topic }, nil
 }
 
-func (p *Publisher) Publish(ctx context.Context, eventType string, payload interface{}) error {
+// Publish implements ev.OutboxPublisher for the outbox relay; options are not used.
+func (p *Publisher) Publish(ctx context.Context, eventType string, payload interface{}, _ ...ev.Option) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
@@ -12,18 +12,17 @@ import (
 )
 
 type Subscriber struct {
-	client    *pubsub.Client
-	db        *sql.DB
-	publisher *Publisher
+	client *pubsub.Client
+	db     *sql.DB
 }
 
-func NewSubscriber(ctx context.Context, db *sql.DB, publisher *Publisher) (*Subscriber, error) {
+func NewSubscriber(ctx context.Context, db *sql.DB) (*Subscriber, error) {
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	client, err := pubsub.NewClient(ctx, projectID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
 	}
-	return &Subscriber{ client: client, db: db, publisher: publisher }, nil
+	return &Subscriber{ client: client, db: db }, nil
 }
 
 func (s *Subscriber) StartListening(ctx context.Context) {
@@ -38,7 +37,7 @@ func (s *Subscriber) StartListening(ctx context.Context) {
 		var err error
 		switch eventType {
 		case "WorkflowStepStarted":
-			err = HandleWorkflowStepStarted(cctx, s.db, s.publisher, msg.Data)
+			err = HandleWorkflowStepStarted(cctx, s.db, msg.Data)
 		default:
 			msg.Ack()
 			return
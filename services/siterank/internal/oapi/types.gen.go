@@ -19,6 +19,23 @@ const (
 	Running   AnalysisStatus = "running"
 )
 
+// Defines values for KeywordIntent.
+const (
+	Commercial    KeywordIntent = "commercial"
+	Informational KeywordIntent = "informational"
+	Navigational  KeywordIntent = "navigational"
+	Transactional KeywordIntent = "transactional"
+)
+
+// Defines values for SimilarityItemSources.
+const (
+	BrandMention SimilarityItemSources = "brand_mention"
+	History      SimilarityItemSources = "history"
+	OutboundLink SimilarityItemSources = "outbound_link"
+	Provided     SimilarityItemSources = "provided"
+	SimilarSites SimilarityItemSources = "similar_sites"
+)
+
 // Analysis defines model for Analysis.
 type Analysis struct {
 	CreatedAt time.Time               `json:"createdAt"`
@@ -43,15 +60,38 @@ type HistoryItem struct {
 	UserId     string                  `json:"userId"`
 }
 
+// KeywordCluster Lexical keyword group, ready to be created as an ad group
+type KeywordCluster struct {
+	AdGroupName string              `json:"adGroupName"`
+	Intent      KeywordIntent       `json:"intent"`
+	Keywords    []KeywordSuggestion `json:"keywords"`
+
+	// Theme shared head term of the cluster
+	Theme       string `json:"theme"`
+	TotalVolume int    `json:"totalVolume"`
+}
+
+// KeywordIntent defines model for KeywordIntent.
+type KeywordIntent string
+
 // KeywordSuggestion defines model for KeywordSuggestion.
 type KeywordSuggestion struct {
-	Keyword string `json:"keyword"`
+	// AvgMonthlySearches present when enriched
+	AvgMonthlySearches *int `json:"avgMonthlySearches,omitempty"`
+
+	// Competition LOW | MEDIUM | HIGH when enriched
+	Competition *string        `json:"competition,omitempty"`
+	Intent      *KeywordIntent `json:"intent,omitempty"`
+	Keyword     string         `json:"keyword"`
 
 	// Reason brief why this keyword was suggested
 	Reason *string `json:"reason,omitempty"`
 
 	// Score 0..1
 	Score float32 `json:"score"`
+
+	// Source where the candidate came from (title, heading, meta, product, domain, ideas)
+	Source *string `json:"source,omitempty"`
 }
 
 // SimilarityItem defines model for SimilarityItem.
@@ -59,8 +99,14 @@ type SimilarityItem struct {
 	Domain  string                  `json:"domain"`
 	Factors *map[string]interface{} `json:"factors,omitempty"`
 	Score   float32                 `json:"score"`
+
+	// Sources How the candidate was found
+	Sources *[]SimilarityItemSources `json:"sources,omitempty"`
 }
 
+// SimilarityItemSources defines model for SimilarityItem.Sources.
+type SimilarityItemSources string
+
 // TrendPoint defines model for TrendPoint.
 type TrendPoint struct {
 	AvgScore float32 `json:"avgScore"`
@@ -80,6 +126,10 @@ type SuggestKeywordsJSONBody struct {
 	// Country Optional ISO country code
 	Country *string `json:"country,omitempty"`
 
+	// Enrich Enrich with volume/competition from adscenter
+	Enrich      *bool `json:"enrich,omitempty"`
+	MaxClusters *int  `json:"maxClusters,omitempty"`
+
 	// MinScore 0..1 score threshold
 	MinScore *float32 `json:"minScore,omitempty"`
 
@@ -90,10 +140,17 @@ type SuggestKeywordsJSONBody struct {
 
 // ComputeSimilarOffersJSONBody defines parameters for ComputeSimilarOffers.
 type ComputeSimilarOffersJSONBody struct {
-	Candidates []string `json:"candidates"`
+	Candidates *[]string `json:"candidates,omitempty"`
 
 	// Country Optional ISO country code
-	Country    *string `json:"country,omitempty"`
+	Country *string `json:"country,omitempty"`
+
+	// Discover Also discover candidates (implied when candidates is empty)
+	Discover *bool `json:"discover,omitempty"`
+	Limit    *int  `json:"limit,omitempty"`
+
+	// OfferId Optional seed offer; excluded from history expansion
+	OfferId    *string `json:"offerId,omitempty"`
 	SeedDomain string  `json:"seedDomain"`
 }
 
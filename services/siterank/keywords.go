@@ -0,0 +1,355 @@
+package main
+
+import (
+    "context"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    api "github.com/xxrenzhe/autoads/services/siterank/internal/oapi"
+)
+
+// keywordCandidate is a phrase mined from the landing page (or keyword ideas) plus enrichment and scoring.
+type keywordCandidate struct {
+    Keyword     string
+    Source      string  // title | heading | meta | product | domain | ideas
+    Weight      float64 // 0..1 relevance from where/how often the phrase appeared
+    Volume      int
+    Competition string
+    Enriched    bool
+    Intent      api.KeywordIntent
+    Score       float64
+}
+
+const (
+    maxKeywordCandidates = 150
+    maxClusterKeywords   = 20 // keeps clusters within a reasonable ad group size
+)
+
+var keywordReasons = map[string]string{
+    "title":   "来自标题",
+    "heading": "来自页面标题(H1-H3)",
+    "meta":    "来自Meta描述/关键词",
+    "product": "来自商品结构化数据",
+    "domain":  "来自域名",
+    "ideas":   "关键词规划扩展",
+}
+
+// phraseStopWords break n-grams; unlike isStopToken they keep intent modifiers such as "best" or "buy".
+var phraseStopWords = map[string]struct{}{
+    "a": {}, "an": {}, "the": {}, "and": {}, "or": {}, "for": {}, "with": {}, "you": {}, "your": {}, "our": {}, "of": {},
+    "to": {}, "in": {}, "on": {}, "at": {}, "by": {}, "from": {}, "is": {}, "are": {}, "be": {}, "this": {}, "that": {},
+    "it": {}, "its": {}, "we": {}, "us": {}, "all": {}, "more": {}, "now": {}, "com": {}, "www": {}, "net": {}, "org": {},
+}
+
+var (
+    transactionalTerms = []string{"buy", "price", "prices", "pricing", "cheap", "deal", "deals", "discount", "coupon", "coupons", "promo", "sale", "order", "shop", "store", "shipping", "cost", "subscription", "trial", "offer"}
+    commercialTerms    = []string{"best", "top", "review", "reviews", "compare", "comparison", "vs", "alternative", "alternatives", "rating", "ratings", "recommended"}
+    informationalTerms = []string{"how", "what", "why", "when", "guide", "tutorial", "tips", "ideas", "learn", "meaning", "definition", "examples"}
+    navigationalTerms  = []string{"login", "official", "website", "site", "account", "app", "download", "contact", "support", "signin"}
+)
+
+// buildKeywordPlan runs the keyword pipeline for a seed: extract -> enrich -> tag intent -> score.
+func (s *Server) buildKeywordPlan(ctx context.Context, userID, seed, brand string, domTokens []string, ps *PageSignals, country string, enrich bool) []keywordCandidate {
+    cands := extractKeywordCandidates(brand, domTokens, ps, country)
+    if enrich { cands = s.enrichKeywords(ctx, userID, seed, brand, cands) }
+    for i := range cands {
+        cands[i].Intent = tagIntent(cands[i].Keyword, brand)
+        cands[i].Score = scoreKeyword(cands[i])
+    }
+    sort.SliceStable(cands, func(i, j int) bool { return cands[i].Score > cands[j].Score })
+    return cands
+}
+
+// extractKeywordCandidates mines 1-3 word n-grams from title, headings, meta tags and schema.org products.
+// Domain/title token suggestions are always included so the pipeline degrades to the previous behaviour.
+func extractKeywordCandidates(brand string, domTokens []string, ps *PageSignals, country string) []keywordCandidate {
+    byKey := map[string]*keywordCandidate{}
+    order := []string{}
+    hits := map[string]int{}
+    add := func(kw, source string, weight float64) {
+        kw = strings.Join(strings.Fields(strings.ToLower(kw)), " ")
+        if kw == "" || len(kw) > 80 { return }
+        hits[kw]++
+        if c, ok := byKey[kw]; ok {
+            if weight > c.Weight { c.Weight, c.Source = weight, source }
+            return
+        }
+        byKey[kw] = &keywordCandidate{Keyword: kw, Source: source, Weight: weight}
+        order = append(order, kw)
+    }
+    addPhrase := func(phrase, source string, weight float64) {
+        for _, g := range phraseNgrams(phrase, 3) {
+            n := strings.Count(g, " ") + 1
+            factor := 1.0
+            switch n {
+            case 1:
+                factor = 0.7
+            case 3:
+                factor = 0.9
+            }
+            add(g, source, weight*factor)
+        }
+    }
+    if ps != nil {
+        addPhrase(ps.Title, "title", 0.8)
+        addPhrase(ps.SiteName, "title", 0.6)
+        for _, h := range ps.Headings {
+            w := 0.6
+            switch h.Level {
+            case 1:
+                w = 0.9
+            case 2:
+                w = 0.75
+            }
+            addPhrase(h.Text, "heading", w)
+        }
+        addPhrase(ps.MetaDescription, "meta", 0.5)
+        for _, k := range ps.MetaKeywords {
+            if n := len(strings.Fields(k)); n >= 1 && n <= 4 { add(strings.Join(phraseTokens(k), " "), "meta", 0.7) }
+        }
+        for _, p := range ps.Products {
+            addPhrase(p.Name, "product", 0.9)
+            if p.Category != "" {
+                segs := strings.Split(p.Category, ">")
+                addPhrase(segs[len(segs)-1], "product", 0.8)
+            }
+        }
+    }
+    titleTokens := []string{}
+    if ps != nil { titleTokens = append(tokenizeText(ps.Title), tokenizeText(ps.SiteName)...) }
+    for _, sg := range suggestFromSignals(brand, domTokens, titleTokens, country) {
+        src := "domain"
+        if strings.Contains(sg.Reason, "标题") { src = "title" }
+        add(sg.Keyword, src, sg.Score*0.9)
+    }
+    out := make([]keywordCandidate, 0, len(order))
+    for _, k := range order {
+        c := *byKey[k]
+        // repeated across page sections = more central to the page
+        c.Weight = clamp01(c.Weight + 0.05*float64(hits[k]-1))
+        out = append(out, c)
+    }
+    sort.SliceStable(out, func(i, j int) bool { return out[i].Weight > out[j].Weight })
+    if len(out) > maxKeywordCandidates { out = out[:maxKeywordCandidates] }
+    return out
+}
+
+// phraseTokens lowercases and splits on non-alphanumerics, keeping order and stop words.
+func phraseTokens(s string) []string {
+    b := strings.Builder{}
+    for _, r := range strings.ToLower(s) {
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') { b.WriteRune(r) } else { b.WriteRune(' ') }
+    }
+    return strings.Fields(b.String())
+}
+
+// phraseNgrams returns contiguous n-grams (1..maxN) that do not cross stop words.
+func phraseNgrams(phrase string, maxN int) []string {
+    out := []string{}
+    seg := []string{}
+    flush := func() {
+        for n := 1; n <= maxN; n++ {
+            for i := 0; i+n <= len(seg); i++ {
+                g := seg[i : i+n]
+                if n == 1 && (len(g[0]) < 3 || isStopToken(g[0])) { continue }
+                out = append(out, strings.Join(g, " "))
+            }
+        }
+        seg = seg[:0]
+    }
+    for _, t := range phraseTokens(phrase) {
+        if _, stop := phraseStopWords[t]; stop || len(t) > 20 { flush(); continue }
+        seg = append(seg, t)
+    }
+    flush()
+    return out
+}
+
+type keywordIdeasResp struct {
+    Items []struct {
+        Keyword     string `json:"keyword"`
+        Avg         int    `json:"avgMonthlySearches"`
+        Competition string `json:"competition"`
+    } `json:"items"`
+    // Live is false when adscenter answered from its stub (no live Ads access); those volumes are
+    // made up and must not be scored.
+    Live bool `json:"live"`
+}
+
+// enrichKeywords attaches volume/competition from adscenter keyword ideas (best-effort, ADSCENTER_URL).
+// Ideas not yet in the set are added when they share a token with the page vocabulary. Stub
+// answers (live=false) are ignored.
+func (s *Server) enrichKeywords(ctx context.Context, userID, seed, brand string, cands []keywordCandidate) []keywordCandidate {
+    base := strings.TrimRight(os.Getenv("ADSCENTER_URL"), "/")
+    if base == "" || userID == "" || len(cands) == 0 { return cands }
+    seeds := make([]string, 0, 20)
+    for _, c := range cands {
+        if len(seeds) >= 20 { break }
+        seeds = append(seeds, c.Keyword)
+    }
+    cctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+    defer cancel()
+    var resp keywordIdeasResp
+    if err := s.httpClient.DoJSON(cctx, http.MethodPost, base+"/api/v1/adscenter/keywords/ideas", map[string]any{
+        "seedDomain": seed, "seedKeywords": seeds,
+    }, map[string]string{"Content-Type": "application/json", "X-User-Id": userID}, 1, &resp); err != nil || !resp.Live {
+        return cands
+    }
+    idx := map[string]int{}
+    vocab := map[string]struct{}{}
+    for i, c := range cands {
+        idx[c.Keyword] = i
+        for _, t := range strings.Fields(c.Keyword) { if t != brand { vocab[t] = struct{}{} } }
+    }
+    for _, it := range resp.Items {
+        kw := strings.Join(phraseTokens(it.Keyword), " ")
+        if kw == "" { continue }
+        if i, ok := idx[kw]; ok {
+            cands[i].Volume, cands[i].Competition, cands[i].Enriched = it.Avg, strings.ToUpper(it.Competition), true
+            continue
+        }
+        related := false
+        for _, t := range strings.Fields(kw) { if _, ok := vocab[t]; ok { related = true; break } }
+        if !related { continue }
+        idx[kw] = len(cands)
+        cands = append(cands, keywordCandidate{Keyword: kw, Source: "ideas", Weight: 0.5, Volume: it.Avg, Competition: strings.ToUpper(it.Competition), Enriched: true})
+    }
+    return cands
+}
+
+// tagIntent classifies a keyword by modifier word lists; brand-only or brand+navigation terms are navigational.
+func tagIntent(kw, brand string) api.KeywordIntent {
+    toks := strings.Fields(kw)
+    has := func(list []string) bool {
+        for _, t := range toks { if contains(list, t) { return true } }
+        return false
+    }
+    switch {
+    case has(transactionalTerms):
+        return api.Transactional
+    case has(commercialTerms):
+        return api.Commercial
+    case has(informationalTerms):
+        return api.Informational
+    }
+    if brand != "" && contains(toks, brand) {
+        nav := true
+        for _, t := range toks { if t != brand && !contains(navigationalTerms, t) { nav = false; break } }
+        if nav { return api.Navigational }
+    }
+    if has(navigationalTerms) { return api.Navigational }
+    // product/category phrases without modifiers still carry purchase intent for ads
+    return api.Commercial
+}
+
+// scoreKeyword blends page relevance, search volume (log scale), competition and intent into 0..1.
+func scoreKeyword(c keywordCandidate) float64 {
+    bonus := 0.0
+    switch c.Intent {
+    case api.Transactional:
+        bonus = 0.1
+    case api.Commercial:
+        bonus = 0.05
+    case api.Informational:
+        bonus = -0.05
+    }
+    if !c.Enriched { return clamp01(c.Weight*0.85 + bonus) }
+    vol := clamp01(math.Log10(float64(c.Volume)+1) / 6)
+    comp := 0.5
+    switch c.Competition {
+    case "LOW":
+        comp = 1
+    case "MEDIUM":
+        comp = 0.6
+    case "HIGH":
+        comp = 0.3
+    }
+    return clamp01(0.5*c.Weight + 0.3*vol + 0.2*comp + bonus)
+}
+
+// clusterKeywords groups keywords by their most shared head n-gram (document frequency >= 2, longer preferred),
+// excluding brand and intent modifiers. Keywords without a shared head go to the brand/general group.
+func clusterKeywords(cands []keywordCandidate, brand string, maxClusters int) []api.KeywordCluster {
+    if len(cands) == 0 { return []api.KeywordCluster{} }
+    heads := func(kw string) []string {
+        toks := []string{}
+        for _, t := range strings.Fields(kw) {
+            if t == brand || contains(transactionalTerms, t) || contains(commercialTerms, t) || contains(informationalTerms, t) || contains(navigationalTerms, t) { continue }
+            if len(t) < 3 || isStopToken(t) { continue }
+            toks = append(toks, t)
+        }
+        out := append([]string{}, toks...)
+        for i := 0; i+1 < len(toks); i++ { out = append(out, toks[i]+" "+toks[i+1]) }
+        return unique(out)
+    }
+    df := map[string]int{}
+    for _, c := range cands { for _, h := range heads(c.Keyword) { df[h]++ } }
+
+    general := brand
+    if general == "" { general = "general" }
+    groups := map[string][]keywordCandidate{}
+    order := []string{}
+    for _, c := range cands {
+        theme, best := general, 0.0
+        for _, h := range heads(c.Keyword) {
+            if df[h] < 2 { continue }
+            sc := float64(df[h]) * (1 + 0.5*float64(strings.Count(h, " ")))
+            if sc > best || (sc == best && h < theme) { theme, best = h, sc }
+        }
+        if _, ok := groups[theme]; !ok { order = append(order, theme) }
+        groups[theme] = append(groups[theme], c)
+    }
+
+    out := make([]api.KeywordCluster, 0, len(order))
+    for _, theme := range order {
+        members := groups[theme]
+        if len(members) > maxClusterKeywords { members = members[:maxClusterKeywords] }
+        total := 0
+        intentWeight := map[api.KeywordIntent]float64{}
+        kws := make([]api.KeywordSuggestion, 0, len(members))
+        for _, m := range members {
+            total += m.Volume
+            intentWeight[m.Intent] += m.Score
+            kws = append(kws, toKeywordSuggestion(m))
+        }
+        intent, bestW := api.Commercial, -1.0
+        for _, in := range []api.KeywordIntent{api.Transactional, api.Commercial, api.Informational, api.Navigational} {
+            if w, ok := intentWeight[in]; ok && w > bestW { intent, bestW = in, w }
+        }
+        out = append(out, api.KeywordCluster{AdGroupName: adGroupName(brand, theme), Theme: theme, Intent: intent, TotalVolume: total, Keywords: kws})
+    }
+    sort.SliceStable(out, func(i, j int) bool {
+        if out[i].TotalVolume != out[j].TotalVolume { return out[i].TotalVolume > out[j].TotalVolume }
+        return len(out[i].Keywords) > len(out[j].Keywords)
+    })
+    if maxClusters > 0 && len(out) > maxClusters { out = out[:maxClusters] }
+    return out
+}
+
+// adGroupName renders "Brand - Theme" in title case; brand-only themes use the brand alone.
+func adGroupName(brand, theme string) string {
+    title := func(s string) string {
+        ws := strings.Fields(s)
+        for i, w := range ws { ws[i] = strings.ToUpper(w[:1]) + w[1:] }
+        return strings.Join(ws, " ")
+    }
+    if brand == "" || theme == brand { return title(theme) }
+    return title(brand) + " - " + title(theme)
+}
+
+func toKeywordSuggestion(c keywordCandidate) api.KeywordSuggestion {
+    it := api.KeywordSuggestion{Keyword: c.Keyword, Score: float32(c.Score)}
+    src, intent := c.Source, c.Intent
+    it.Source, it.Intent = &src, &intent
+    if rs, ok := keywordReasons[c.Source]; ok { it.Reason = &rs }
+    if c.Enriched {
+        vol, comp := c.Volume, c.Competition
+        it.AvgMonthlySearches = &vol
+        if comp != "" { it.Competition = &comp }
+    }
+    return it
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	httpx "github.com/xxrenzhe/autoads/pkg/http"
+	api "github.com/xxrenzhe/autoads/services/siterank/internal/oapi"
+)
+
+func TestPhraseNgrams(t *testing.T) {
+	cases := []struct {
+		phrase string
+		maxN   int
+		want   []string
+	}{
+		{"Buy the Best Running Shoes", 3, []string{"buy", "running", "shoes", "best running", "running shoes", "best running shoes"}},
+		{"XYZ-123 Widgets!", 2, []string{"xyz", "123", "widgets", "xyz 123", "123 widgets"}},
+		{"Go to a B&B", 3, []string{"b b"}},
+		{"", 3, []string{}},
+	}
+	for _, c := range cases {
+		if got := phraseNgrams(c.phrase, c.maxN); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("phraseNgrams(%q, %d) = %v, want %v", c.phrase, c.maxN, got, c.want)
+		}
+	}
+}
+
+func TestExtractKeywordCandidates(t *testing.T) {
+	ps := &PageSignals{
+		Title:        "Acme Trail Running Shoes",
+		Headings:     []PageHeading{{Level: 1, Text: "Trail Running Shoes"}},
+		MetaKeywords: []string{"Waterproof Boots"},
+		Products:     []PageProduct{{Name: "Acme Glide", Category: "Shoes > Running Shoes"}},
+	}
+	cands := extractKeywordCandidates("acme", []string{"acme"}, ps, "US")
+	byKey := map[string]keywordCandidate{}
+	for _, c := range cands {
+		if _, dup := byKey[c.Keyword]; dup {
+			t.Errorf("duplicate candidate %q", c.Keyword)
+		}
+		byKey[c.Keyword] = c
+	}
+	if !sort.SliceIsSorted(cands, func(i, j int) bool { return cands[i].Weight > cands[j].Weight }) {
+		t.Error("candidates are not sorted by weight")
+	}
+	want := []struct {
+		kw     string
+		source string
+		weight float64
+	}{
+		// title and H1: the stronger source wins, the repeat adds 0.05
+		{"trail running shoes", "heading", 0.86},
+		{"waterproof boots", "meta", 0.7},
+		{"acme glide", "product", 0.9},
+	}
+	for _, w := range want {
+		c, ok := byKey[w.kw]
+		if !ok {
+			t.Errorf("missing candidate %q", w.kw)
+			continue
+		}
+		if c.Source != w.source || math.Abs(c.Weight-w.weight) > 1e-9 {
+			t.Errorf("%q: source=%s weight=%v, want %s %v", w.kw, c.Source, c.Weight, w.source, w.weight)
+		}
+	}
+}
+
+func TestExtractKeywordCandidatesWithoutPage(t *testing.T) {
+	cands := extractKeywordCandidates("acme", []string{"acme", "shoes"}, nil, "")
+	got := make([]string, 0, len(cands))
+	for _, c := range cands {
+		got = append(got, c.Keyword)
+		if c.Source != "domain" {
+			t.Errorf("%q: source = %s, want domain", c.Keyword, c.Source)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"acme shoes", "acme", "shoes"}) {
+		t.Errorf("keywords = %v", got)
+	}
+}
+
+func TestTagIntent(t *testing.T) {
+	cases := []struct {
+		kw, brand string
+		want      api.KeywordIntent
+	}{
+		{"buy acme shoes", "acme", api.Transactional},
+		{"buy how", "", api.Transactional},
+		{"best running shoes", "acme", api.Commercial},
+		{"shoes review guide", "", api.Commercial},
+		{"how to clean shoes", "acme", api.Informational},
+		{"acme", "acme", api.Navigational},
+		{"acme login", "acme", api.Navigational},
+		{"download manager", "", api.Navigational},
+		{"acme shoes", "acme", api.Commercial},
+	}
+	for _, c := range cases {
+		if got := tagIntent(c.kw, c.brand); got != c.want {
+			t.Errorf("tagIntent(%q, %q) = %s, want %s", c.kw, c.brand, got, c.want)
+		}
+	}
+}
+
+func TestScoreKeyword(t *testing.T) {
+	cases := []struct {
+		name string
+		c    keywordCandidate
+		want float64
+	}{
+		{"page only transactional", keywordCandidate{Weight: 0.8, Intent: api.Transactional}, 0.78},
+		{"page only informational", keywordCandidate{Weight: 0.5, Intent: api.Informational}, 0.375},
+		{"high volume low competition", keywordCandidate{Weight: 0.6, Enriched: true, Volume: 999999, Competition: "LOW", Intent: api.Commercial}, 0.85},
+		{"no volume high competition", keywordCandidate{Weight: 1, Enriched: true, Competition: "HIGH", Intent: api.Transactional}, 0.66},
+		{"unknown competition", keywordCandidate{Enriched: true, Volume: 9, Intent: api.Navigational}, 0.15},
+		{"clamped", keywordCandidate{Weight: 1, Enriched: true, Volume: 999999, Competition: "LOW", Intent: api.Transactional}, 1},
+	}
+	for _, c := range cases {
+		if got := scoreKeyword(c.c); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s: scoreKeyword = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestClusterKeywords(t *testing.T) {
+	cands := []keywordCandidate{
+		{Keyword: "acme running shoes", Volume: 100, Intent: api.Transactional, Score: 0.9},
+		{Keyword: "buy running shoes", Volume: 200, Intent: api.Transactional, Score: 0.8},
+		{Keyword: "running shoes review", Volume: 50, Intent: api.Commercial, Score: 0.7},
+		{Keyword: "acme login", Volume: 10, Intent: api.Navigational, Score: 0.5},
+		{Keyword: "trail boots", Volume: 5, Intent: api.Commercial, Score: 0.4},
+	}
+	got := clusterKeywords(cands, "acme", 0)
+	want := []struct {
+		theme, adGroup string
+		intent         api.KeywordIntent
+		volume, n      int
+	}{
+		{"running shoes", "Acme - Running Shoes", api.Transactional, 350, 3},
+		{"acme", "Acme", api.Navigational, 15, 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("clusters = %+v, want %d", got, len(want))
+	}
+	for i, w := range want {
+		c := got[i]
+		if c.Theme != w.theme || c.AdGroupName != w.adGroup || c.Intent != w.intent || c.TotalVolume != w.volume || len(c.Keywords) != w.n {
+			t.Errorf("cluster %d = {%s %s %s %d %d}, want %+v", i, c.Theme, c.AdGroupName, c.Intent, c.TotalVolume, len(c.Keywords), w)
+		}
+	}
+	if got := clusterKeywords(cands, "acme", 1); len(got) != 1 || got[0].Theme != "running shoes" {
+		t.Errorf("maxClusters=1: %+v", got)
+	}
+	if got := clusterKeywords(nil, "acme", 5); got == nil || len(got) != 0 {
+		t.Errorf("no candidates: %#v", got)
+	}
+}
+
+func TestAdGroupName(t *testing.T) {
+	cases := []struct{ brand, theme, want string }{
+		{"acme", "running shoes", "Acme - Running Shoes"},
+		{"", "running shoes", "Running Shoes"},
+		{"acme", "acme", "Acme"},
+	}
+	for _, c := range cases {
+		if got := adGroupName(c.brand, c.theme); got != c.want {
+			t.Errorf("adGroupName(%q, %q) = %q, want %q", c.brand, c.theme, got, c.want)
+		}
+	}
+}
+
+func TestEnrichKeywordsIgnoresStubIdeas(t *testing.T) {
+	live := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"items": []map[string]any{
+				{"keyword": "running shoes", "avgMonthlySearches": 1200, "competition": "low"},
+				{"keyword": "running shoes cheap", "avgMonthlySearches": 1900, "competition": "high"},
+			},
+			"live": live,
+		})
+	}))
+	defer srv.Close()
+	t.Setenv("ADSCENTER_URL", srv.URL)
+	s := &Server{httpClient: httpx.New(5 * time.Second)}
+	cands := func() []keywordCandidate { return []keywordCandidate{{Keyword: "running shoes", Weight: 0.8}} }
+
+	got := s.enrichKeywords(context.Background(), "u1", "example.com", "", cands())
+	if len(got) != 1 || got[0].Enriched {
+		t.Fatalf("Expected stub ideas to leave the candidates unenriched, but got %+v", got)
+	}
+
+	live = true
+	got = s.enrichKeywords(context.Background(), "u1", "example.com", "", cands())
+	if len(got) != 2 || !got[0].Enriched || got[0].Volume != 1200 || got[0].Competition != "LOW" || got[1].Source != "ideas" {
+		t.Fatalf("Expected live ideas to enrich and extend the candidates, but got %+v", got)
+	}
+}
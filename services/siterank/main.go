@@ -11,7 +11,6 @@ import (
     "net/url"
     "os"
     "sort"
-    "sync"
     "strings"
     "strconv"
     "time"
@@ -30,7 +29,10 @@ import (
     ev "github.com/xxrenzhe/autoads/pkg/events"
     estore "github.com/xxrenzhe/autoads/pkg/eventstore"
     api "github.com/xxrenzhe/autoads/services/siterank/internal/oapi"
+    rcache "github.com/xxrenzhe/autoads/services/siterank/internal/cache"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
     "github.com/xxrenzhe/autoads/pkg/middleware"
+    "github.com/xxrenzhe/autoads/pkg/saga"
 )
 
 // --- Data Structures ---
@@ -55,6 +57,7 @@ type SimilarWebResponse struct {
     CountryRank int `json:"country_rank"`
     CategoryRank int `json:"category_rank"`
     TotalVisits float64 `json:"total_visits"`
+    Category string `json:"category,omitempty"`
     // Optional fields if available from endpoint or alternate sources
     TopCountries []string `json:"top_countries,omitempty"`
     CountryShares []struct{
@@ -64,26 +67,13 @@ type SimilarWebResponse struct {
 }
 
 // ResolveOfferResult is returned by browser-exec /resolve-offer
-type ResolveOfferResult struct {
-    Ok             bool    `json:"ok"`
-    Status         int     `json:"status"`
-    FinalUrl       string  `json:"finalUrl"`
-    FinalUrlSuffix string  `json:"finalUrlSuffix"`
-    Domain         string  `json:"domain"`
-    Brand          string  `json:"brand"`
-    Via            string  `json:"via"`
-    ChainLength    int     `json:"chainLength"`
-    Timings        *struct {
-        NavMs       int `json:"navMs"`
-        StabilizeMs int `json:"stabilizeMs"`
-    } `json:"timings,omitempty"`
-}
-
-type PageSignals struct {
-    Status  int    `json:"status"`
-    Title   string `json:"title"`
-    SiteName string `json:"siteName"`
-}
+// browser-exec response types (shared client in pkg/browserexec)
+type (
+    ResolveOfferResult = browserexec.ResolveOfferResult
+    PageSignals        = browserexec.PageSignals
+    PageHeading        = browserexec.PageHeading
+    PageProduct        = browserexec.PageProduct
+)
 
 type AIScoreResp struct {
     Score      float64                `json:"score"`
@@ -101,13 +91,12 @@ type KeywordSuggestion struct {
 type Server struct {
     db          *sql.DB
     httpClient  *httpx.Client
-    publisher   *ev.Publisher
-    cacheMu     sync.RWMutex
-    cache       map[string]cacheEntry
+    rc          *rcache.Cache
+    be          *browserexec.Client
+    // sagas runs analysis billing (see billing.go)
+    sagas       *saga.Orchestrator
 }
 
-type cacheEntry struct{ val string; exp time.Time }
-
 // --- Service-level SLO metrics (H1.0: 阶段性指标) ---
 var (
     metricResolveNavMs = prometheus.NewHistogram(prometheus.HistogramOpts{
@@ -191,40 +180,47 @@ func (s *Server) createAnalysisHandler(w http.ResponseWriter, r *http.Request) {
         }
     }
 
+    // Hold tokens before accepting the run. The analysis row is reused per (offer,user), so each
+    // run settles under its own charge id.
+    chargeID := uuid.New().String()
+    if !s.reserveOrReject(w, r, userID, chargeID, estimateAnalysisItems()) { return }
+
     // Try insert; if exists, return existing row via ON CONFLICT ... RETURNING
     analysis := SiterankAnalysis{ID: uuid.New().String(), UserID: userID, OfferID: req.OfferID, Status: "pending", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+    // SiterankRequested is recorded in the same transaction
     var result sql.NullString
-    err := s.db.QueryRowContext(r.Context(), `
-        INSERT INTO "SiterankAnalysis"(id, user_id, offer_id, status, created_at, updated_at)
-        VALUES ($1,$2,$3,$4,$5,$6)
-        ON CONFLICT (offer_id, user_id)
-        DO UPDATE SET updated_at = GREATEST("SiterankAnalysis".updated_at, EXCLUDED.updated_at)
-        RETURNING id, user_id, offer_id, status, result, created_at, updated_at
-    `, analysis.ID, analysis.UserID, analysis.OfferID, analysis.Status, analysis.CreatedAt, analysis.UpdatedAt).Scan(
-        &analysis.ID, &analysis.UserID, &analysis.OfferID, &analysis.Status, &result, &analysis.CreatedAt, &analysis.UpdatedAt,
-    )
+    err := s.inTx(r.Context(), func(tx *sql.Tx) ([]ev.OutboxEvent, error) {
+        err := tx.QueryRowContext(r.Context(), `
+            INSERT INTO "SiterankAnalysis"(id, user_id, offer_id, status, created_at, updated_at)
+            VALUES ($1,$2,$3,$4,$5,$6)
+            ON CONFLICT (offer_id, user_id)
+            DO UPDATE SET updated_at = GREATEST("SiterankAnalysis".updated_at, EXCLUDED.updated_at)
+            RETURNING id, user_id, offer_id, status, result, created_at, updated_at
+        `, analysis.ID, analysis.UserID, analysis.OfferID, analysis.Status, analysis.CreatedAt, analysis.UpdatedAt).Scan(
+            &analysis.ID, &analysis.UserID, &analysis.OfferID, &analysis.Status, &result, &analysis.CreatedAt, &analysis.UpdatedAt,
+        )
+        if err != nil { return nil, err }
+        return []ev.OutboxEvent{{Type: ev.EventSiterankRequested, Subject: analysis.OfferID, Data: map[string]any{
+            "analysisId": analysis.ID,
+            "offerId":    analysis.OfferID,
+            "userId":     analysis.UserID,
+            "requestedAt": time.Now().UTC().Format(time.RFC3339),
+        }}}, nil
+    })
     if err != nil {
         log.Printf("Error upserting siterank analysis: %v", err)
+        s.settleCharge(r.Context(), chargeID, analysisCharge{})
         errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil)
         return
     }
     if result.Valid { analysis.Result = &result.String }
 
-    // Publish requested event (best-effort)
-    if s.publisher != nil {
-        _ = s.publisher.Publish(r.Context(), ev.EventSiterankRequested, map[string]any{
-            "analysisId": analysis.ID,
-            "offerId":    analysis.OfferID,
-            "userId":     analysis.UserID,
-            "requestedAt": time.Now().UTC().Format(time.RFC3339),
-        }, ev.WithSource("siterank"), ev.WithSubject(analysis.OfferID))
-    }
-
     // Persist idempotency map (best-effort)
     if idemKey != "" { _ = s.upsertIdempotency(r.Context(), idemKey, userID, "siterank.analyze", analysis.ID, 24*time.Hour) }
 
-    // Launch the analysis in the background
-    go s.performAnalysis(context.Background(), analysis.ID)
+    // Launch the analysis in the background; commits the stages that ran or releases the hold when done
+    analysisID := analysis.ID
+    s.runBilled(chargeID, func(ctx context.Context) analysisCharge { return s.performAnalysis(ctx, analysisID) })
 
 	log.Printf("Accepted siterank analysis request %s for offer %s", analysis.ID, analysis.OfferID)
 	w.Header().Set("Content-Type", "application/json")
@@ -306,14 +302,14 @@ func (s *Server) getLatestAnalysisByOfferHandler(w http.ResponseWriter, r *http.
     json.NewEncoder(w).Encode(analysis)
 }
 
-func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
+func (s *Server) performAnalysis(ctx context.Context, analysisID string) analysisCharge {
     log.Printf("Starting analysis for %s...", analysisID)
 
 	// 1. Set status to "running"
 	_, err := s.db.ExecContext(ctx, `UPDATE "SiterankAnalysis" SET status = 'running', updated_at = $1 WHERE id = $2`, time.Now(), analysisID)
 	if err != nil {
 		log.Printf("Failed to update analysis %s to running: %v", analysisID, err)
-		return
+		return analysisCharge{}
 	}
 
     // 2. Get the offer URL from the database
@@ -347,7 +343,7 @@ func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
         }
         if originalUrl == "" {
             s.updateAnalysisStatus(ctx, analysisID, "failed", fmt.Sprintf(`{"error": "offer URL not found: %v"}`, err))
-            return
+            return analysisCharge{}
         }
     }
 
@@ -355,7 +351,7 @@ func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
 	if err != nil {
 		log.Printf("Failed to parse offer URL for analysis %s: %v", analysisID, err)
 		s.updateAnalysisStatus(ctx, analysisID, "failed", fmt.Sprintf(`{"error": "invalid offer URL: %v"}`, err))
-		return
+		return analysisCharge{}
 	}
 
     host := domain.Hostname()
@@ -363,27 +359,51 @@ func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
 
     // New flow: resolve final landing + compute AI评分（可超过10s）。受开关控制 ANALYZE_WITH_RESOLVE=1
     if strings.TrimSpace(os.Getenv("ANALYZE_WITH_RESOLVE")) == "1" {
-        s.analyzeWithResolveAndAI(ctx, analysisID, originalUrl, country)
-        return
+        return s.analyzeWithResolveAndAI(ctx, analysisID, originalUrl, country)
     }
 
-    // 4. Call SimilarWeb API (configurable base URL) with hedged parallel fetch (direct + browser)
+    // 4. Call SimilarWeb API with hedged parallel fetch (direct + browser), through the result cache
+    // (memory -> Postgres; stale entries are served immediately and refreshed in the background)
+    viaCh := make(chan string, 1)
+    entry, cst, ferr := s.rc.Fetch(ctx, cacheNsAnalysis, rcache.Key(host, country), cachePolicy(cacheNsAnalysis), func(fctx context.Context) (string, bool, error) {
+        result, via, err := s.fetchSimilarWebHedged(fctx, host)
+        if err != nil {
+            log.Printf("Failed to get data from SimilarWeb for %s: %v", host, err)
+            return mustJSON(map[string]string{"error": "SimilarWeb API failed: " + err.Error()}), false, nil
+        }
+        select { case viaCh <- via: default: }
+        return result, true, nil
+    })
+    if ferr != nil || !entry.Ok {
+        failPayload := entry.Payload
+        if ferr != nil { failPayload = mustJSON(map[string]string{"error": ferr.Error()}) }
+        s.updateAnalysisStatus(ctx, analysisID, "failed", failPayload)
+        return analysisCharge{}
+    }
+    via := "cache"
+    if cst == rcache.Miss { select { case via = <-viaCh: default: via = "direct" } }
+    result := entry.Payload
+    var offID, uid string
+    _ = s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offID, &uid)
+    s.updateAnalysisStatus(ctx, analysisID, "completed", result, ev.OutboxEvent{Type: ev.EventSiterankCompleted, Data: map[string]any{"analysisId": analysisID, "offerId": offID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "via": via, "country": country, "cacheStatus": string(cst), "queryAction": queryActionFor(cst)}})
+    _ = s.maybeWriteFirestoreUI(ctx, analysisID, result)
+    _ = s.projectHistory(ctx, analysisID, normalizeDomain(host), result)
+    // best-effort event store write
+    _ = s.writeEventStore(ctx, analysisID, "SiterankCompleted", host, result, map[string]any{"via": via, "country": country, "cacheStatus": string(cst)})
+    log.Printf("Successfully completed analysis for %s via %s (cache=%s)", analysisID, via, cst)
+    charge := analysisCharge{Completed: true, Stages: []string{queryStageFor(cst)}}
+    charge.add(queryActionFor(cst))
+    return charge
+}
+
+// fetchSimilarWebHedged fetches raw SimilarWeb JSON for host: direct HTTP first, browser-exec hedge after 300ms.
+// Returns the JSON text and which path won.
+func (s *Server) fetchSimilarWebHedged(ctx context.Context, host string) (string, string, error) {
     base := os.Getenv("SIMILARWEB_BASE_URL")
     if base == "" {
         // Default to public endpoint, no API key required per environment note
         base = "https://data.similarweb.com/api/v1/data?domain=%s"
     }
-    // cache lookup by host(+country) (5 min TTL)
-    localKey := host + "|" + country
-    s.cacheMu.RLock()
-    if ce, ok := s.cache[localKey]; ok && time.Now().Before(ce.exp) {
-        s.cacheMu.RUnlock()
-        s.updateAnalysisStatus(ctx, analysisID, "completed", ce.val)
-        log.Printf("Siterank cache hit for %s", host)
-        return
-    }
-    s.cacheMu.RUnlock()
-
     apiURL := fmt.Sprintf(base, host)
 
     // Build headers and retries for SimilarWeb
@@ -405,8 +425,7 @@ func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
         resCh <- fetchRes{ok: true, result: string(b), via: "direct"}
     }()
     // browser hedge
-    beURL := strings.TrimSpace(os.Getenv("BROWSER_EXEC_URL"))
-    if beURL != "" {
+    if s.be.Configured() {
         go func() {
             time.Sleep(300 * time.Millisecond)
             if j, ok := s.fetchBrowserJSON(ctxAll, apiURL, headers); ok { resCh <- fetchRes{ok: true, result: j, via: "browser"}; return }
@@ -414,53 +433,11 @@ func (s *Server) performAnalysis(ctx context.Context, analysisID string) {
         }()
     }
     first := <-resCh
-    if first.ok {
-        s.updateAnalysisStatus(ctx, analysisID, "completed", first.result)
-        _ = s.maybeWriteFirestoreUI(ctx, analysisID, first.result)
-        _ = s.projectHistory(ctx, analysisID, first.result)
-        _ = s.upsertDomainCountryCache(ctx, host, country, first.result, true, 7*24*time.Hour)
-        // best-effort event store write
-        _ = s.writeEventStore(ctx, analysisID, "SiterankCompleted", host, first.result, map[string]any{"via": first.via, "country": country})
-        // fill local in-memory cache (short TTL) with country in key
-        key := host + "|" + country
-        s.cacheMu.Lock(); if s.cache == nil { s.cache = map[string]cacheEntry{} }; s.cache[key] = cacheEntry{val: first.result, exp: time.Now().Add(5 * time.Minute)}; s.cacheMu.Unlock()
-        if s.publisher != nil {
-            var offID, uid string
-            _ = s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offID, &uid)
-            _ = s.publisher.Publish(ctx, ev.EventSiterankCompleted, map[string]any{"analysisId": analysisID, "offerId": offID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "via": first.via, "country": country}, ev.WithSource("siterank"))
-        }
-        log.Printf("Successfully completed analysis for %s via %s", analysisID, first.via)
-        return
-    }
-    if beURL == "" {
-        failPayload := fmt.Sprintf(`{"error": "SimilarWeb API failed: %v"}`, first.err)
-        _ = s.upsertDomainCountryCache(ctx, host, country, failPayload, false, 24*time.Hour)
-        s.updateAnalysisStatus(ctx, analysisID, "failed", failPayload)
-        return
-    }
+    if first.ok { return first.result, first.via, nil }
+    if !s.be.Configured() { return "", "", first.err }
     second := <-resCh
-    if second.ok {
-        s.updateAnalysisStatus(ctx, analysisID, "completed", second.result)
-        _ = s.maybeWriteFirestoreUI(ctx, analysisID, second.result)
-        _ = s.projectHistory(ctx, analysisID, second.result)
-        _ = s.upsertDomainCountryCache(ctx, host, country, second.result, true, 7*24*time.Hour)
-        _ = s.writeEventStore(ctx, analysisID, "SiterankCompleted", host, second.result, map[string]any{"via": second.via, "country": country})
-        key := host + "|" + country
-        s.cacheMu.Lock(); if s.cache == nil { s.cache = map[string]cacheEntry{} }; s.cache[key] = cacheEntry{val: second.result, exp: time.Now().Add(5 * time.Minute)}; s.cacheMu.Unlock()
-        if s.publisher != nil {
-            var offID, uid string
-            _ = s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offID, &uid)
-            _ = s.publisher.Publish(ctx, ev.EventSiterankCompleted, map[string]any{"analysisId": analysisID, "offerId": offID, "userId": uid, "completedAt": time.Now().UTC().Format(time.RFC3339), "via": second.via, "country": country}, ev.WithSource("siterank"))
-        }
-        log.Printf("Successfully completed analysis for %s via %s", analysisID, second.via)
-        return
-    }
-    // both failed
-    log.Printf("Failed to get data from SimilarWeb for analysis %s: %v | %v", analysisID, first.err, second.err)
-    failPayload := fmt.Sprintf(`{"error": "SimilarWeb API failed: %v; %v"}`, first.err, second.err)
-    _ = s.upsertDomainCountryCache(ctx, host, country, failPayload, false, 24*time.Hour)
-    s.updateAnalysisStatus(ctx, analysisID, "failed", failPayload)
-    return
+    if second.ok { return second.result, second.via, nil }
+    return "", "", fmt.Errorf("%v; %v", first.err, second.err)
 }
 
 // analyze-url: ad-hoc endpoint to analyze a raw Offer URL without requiring an Offer record. For preview/smoke use.
@@ -485,55 +462,41 @@ func (s *Server) analyzeURLHandler(w http.ResponseWriter, r *http.Request) {
         errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "insert failed", map[string]string{"error": err.Error()}); return
     }
     // async analysis based on provided URL
+    // preview/smoke path: not billed
     go s.analyzeWithResolveAndAI(context.Background(), analysis.ID, body.URL, strings.TrimSpace(body.Country))
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusAccepted)
     _ = json.NewEncoder(w).Encode(analysis)
 }
 // analyzeWithResolveAndAI resolves landing, fetches SimilarWeb by final domain, gets page signals, and computes a 0-100 score using AI (fallback: rule-based).
-func (s *Server) analyzeWithResolveAndAI(ctx context.Context, analysisID, offerURL, country string) {
+func (s *Server) analyzeWithResolveAndAI(ctx context.Context, analysisID, offerURL, country string) analysisCharge {
     // basic context: resolve offerId & userId for event enrichment
     var offID, uid string
     _ = s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offID, &uid)
-    if s.publisher != nil && offID != "" && uid != "" {
-        _ = s.publisher.Publish(ctx, ev.EventWorkflowStarted, map[string]any{
+    if offID != "" && uid != "" {
+        s.emit(ctx, ev.OutboxEvent{Type: ev.EventWorkflowStarted, Data: map[string]any{
             "analysisId": analysisID,
             "offerId":    offID,
             "userId":     uid,
             "time":       time.Now().UTC().Format(time.RFC3339),
             "name":       "siterank",
-        }, ev.WithSource("siterank"))
+        }})
     }
     // Resolve landing via browser-exec
-    be := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
     var rr ResolveOfferResult
-    var resolveErr error
-    if be != "" {
-        ctxRes, cancel := context.WithTimeout(ctx, 65*time.Second)
-        defer cancel()
-        body := map[string]any{
-            "url": offerURL,
-            "waitUntil": "domcontentloaded",
-            "timeoutMs": 60000,
-            "stabilizeMs": 1200,
-        }
-        if err := s.httpClient.DoJSON(ctxRes, http.MethodPost, be+"/api/v1/browser/resolve-offer", body, map[string]string{"Content-Type": "application/json"}, 1, &rr); err != nil {
-            resolveErr = err
-        }
-    } else {
-        resolveErr = fmt.Errorf("BROWSER_EXEC_URL not configured")
-    }
-    if s.publisher != nil && offID != "" && uid != "" {
+    res, resolveErr := s.be.ResolveOffer(ctx, browserexec.ResolveOfferRequest{URL: offerURL, WaitUntil: "domcontentloaded", TimeoutMs: 60000, StabilizeMs: 1200})
+    if resolveErr == nil { rr = *res }
+    if offID != "" && uid != "" {
         status := "ok"
         if resolveErr != nil || (!rr.Ok && rr.Status >= 400) { status = "failed" }
-        _ = s.publisher.Publish(ctx, ev.EventWorkflowStepCompleted, map[string]any{
+        s.emit(ctx, ev.OutboxEvent{Type: ev.EventWorkflowStepCompleted, Data: map[string]any{
             "analysisId": analysisID,
             "offerId":    offID,
             "userId":     uid,
             "time":       time.Now().UTC().Format(time.RFC3339),
             "name":       "resolve",
             "status":     status,
-        }, ev.WithSource("siterank"))
+        }})
     }
 
     // Determine target domain/brand/final url
@@ -550,26 +513,25 @@ func (s *Server) analyzeWithResolveAndAI(ctx context.Context, analysisID, offerU
 
     // Fetch SimilarWeb metrics by finalDomain (measure duration)
     tSw := time.Now()
-    sw, _ := s.fetchSimilarWebMetricsRelaxed(ctx, finalDomain, country)
+    sw, swCache := s.similarWebCached(ctx, finalDomain, country, s.fetchSimilarWebMetricsRelaxedLive)
     swMs := int(time.Since(tSw).Milliseconds())
     metricSwFetchMs.Observe(float64(swMs))
-    if s.publisher != nil && offID != "" && uid != "" {
-        _ = s.publisher.Publish(ctx, ev.EventWorkflowStepCompleted, map[string]any{
+    if offID != "" && uid != "" {
+        s.emit(ctx, ev.OutboxEvent{Type: ev.EventWorkflowStepCompleted, Data: map[string]any{
             "analysisId": analysisID,
             "offerId":    offID,
             "userId":     uid,
             "time":       time.Now().UTC().Format(time.RFC3339),
             "name":       "similarweb",
             "status":     func() string { if sw == nil { return "failed" }; return "ok" }(),
-        }, ev.WithSource("siterank"))
+        }})
     }
     // Page signals (best-effort)
     var ps PageSignals
-    if be != "" && finalUrl != "" {
+    if s.be.Configured() && finalUrl != "" {
         ctxPg, cancel := context.WithTimeout(ctx, 12*time.Second)
         defer cancel()
-        body := map[string]any{"url": finalUrl, "timeoutMs": 8000}
-        _ = s.httpClient.DoJSON(ctxPg, http.MethodPost, be+"/api/v1/browser/page-signals", body, map[string]string{"Content-Type": "application/json"}, 1, &ps)
+        if sig, err := s.be.PageSignals(ctxPg, browserexec.PageSignalsRequest{URL: finalUrl, TimeoutMs: 8000}); err == nil { ps = *sig }
     }
 
     // Score with AI
@@ -597,6 +559,17 @@ func (s *Server) analyzeWithResolveAndAI(ctx context.Context, analysisID, offerU
         if rr.Timings.StabilizeMs > 0 { metricResolveStabilizeMs.Observe(float64(rr.Timings.StabilizeMs)) }
     }
 
+    // Billable stages: SimilarWeb only when metrics were obtained (cached vs realtime), AI when it scored
+    charge := analysisCharge{Completed: true}
+    if sw != nil {
+        charge.add(queryActionFor(swCache))
+        charge.Stages = append(charge.Stages, queryStageFor(swCache))
+    }
+    if usedAI {
+        charge.add(actionAIEvaluation)
+        charge.Stages = append(charge.Stages, "ai")
+    }
+
     // Build result payload
     payload := map[string]any{
         "offerUrl": offerURL,
@@ -619,54 +592,61 @@ func (s *Server) analyzeWithResolveAndAI(ctx context.Context, analysisID, offerU
         "usedAI": usedAI,
         "ai": aiResp,
         "stageTimings": map[string]any{ "swFetchMs": swMs, "aiScoreMs": aiMs },
+        "cache": map[string]any{ "similarweb": swCache, "queryAction": queryActionFor(swCache) },
+        "billing": map[string]any{ "items": charge.Items, "stages": charge.Stages },
         "country": country,
         "createdAt": time.Now().UTC().Format(time.RFC3339),
     }
     bres, _ := json.Marshal(payload)
     result := string(bres)
 
-    // Persist
-    s.updateAnalysisStatus(ctx, analysisID, "completed", result)
-    _ = s.maybeWriteFirestoreUI(ctx, analysisID, result)
-    if sw == nil {
-        _ = s.maybeWriteDegradedNotification(ctx, analysisID, finalDomain, finalUrl)
-        _ = s.maybePublishDegradedNotification(ctx, analysisID, finalDomain, finalUrl)
-    }
-    _ = s.projectHistory(ctx, analysisID, result)
-    if s.publisher != nil {
-        if offID != "" && uid != "" {
-            _ = s.publisher.Publish(ctx, ev.EventWorkflowStepCompleted, map[string]any{
-                "analysisId": analysisID,
-                "offerId":    offID,
-                "userId":     uid,
-                "time":       time.Now().UTC().Format(time.RFC3339),
-                "name":       "ai",
-                "status":     "ok",
-                "score":      score,
-            }, ev.WithSource("siterank"))
-        }
-        // enrich event with basic fields for notifications
-        _ = s.publisher.Publish(ctx, ev.EventSiterankCompleted, map[string]any{
+    // Persist together with the completion events
+    var events []ev.OutboxEvent
+    if offID != "" && uid != "" {
+        events = append(events, ev.OutboxEvent{Type: ev.EventWorkflowStepCompleted, Data: map[string]any{
             "analysisId": analysisID,
             "offerId":    offID,
             "userId":     uid,
-            "completedAt": time.Now().UTC().Format(time.RFC3339),
-            "via":        "resolve+ai",
-            "degraded":   sw == nil,
+            "time":       time.Now().UTC().Format(time.RFC3339),
+            "name":       "ai",
+            "status":     "ok",
             "score":      score,
-            "domain":     finalDomain,
-            "finalUrl":   finalUrl,
-        }, ev.WithSource("siterank"))
+        }})
+    }
+    // enrich event with basic fields for notifications
+    events = append(events, ev.OutboxEvent{Type: ev.EventSiterankCompleted, Data: map[string]any{
+        "analysisId": analysisID,
+        "offerId":    offID,
+        "userId":     uid,
+        "completedAt": time.Now().UTC().Format(time.RFC3339),
+        "via":        "resolve+ai",
+        "degraded":   sw == nil,
+        "score":      score,
+        "domain":     finalDomain,
+        "finalUrl":   finalUrl,
+        "cacheStatus": string(swCache),
+        "queryAction": queryActionFor(swCache),
+        "billing":    charge.Items,
+    }})
+    s.updateAnalysisStatus(ctx, analysisID, "completed", result, events...)
+    _ = s.maybeWriteFirestoreUI(ctx, analysisID, result)
+    if sw == nil {
+        _ = s.maybeWriteDegradedNotification(ctx, analysisID, finalDomain, finalUrl)
+        _ = s.maybePublishDegradedNotification(ctx, analysisID, finalDomain, finalUrl)
     }
+    _ = s.projectHistory(ctx, analysisID, normalizeDomain(finalDomain), result)
+    return charge
 }
 
-// fetchSimilarWebMetricsRelaxed increases time budgets and adds stronger browser-exec fallback.
+// fetchSimilarWebMetricsRelaxed is the cached variant of fetchSimilarWebMetricsRelaxedLive.
 func (s *Server) fetchSimilarWebMetricsRelaxed(ctx context.Context, host, country string) (*SimilarWebResponse, bool) {
+    sw, _ := s.similarWebCached(ctx, host, country, s.fetchSimilarWebMetricsRelaxedLive)
+    return sw, sw != nil
+}
+
+// fetchSimilarWebMetricsRelaxedLive increases time budgets and adds stronger browser-exec fallback.
+func (s *Server) fetchSimilarWebMetricsRelaxedLive(ctx context.Context, host, country string) (*SimilarWebResponse, bool) {
     if strings.TrimSpace(host) == "" { return nil, false }
-    // country-aware cache first
-    if payload, ok, found := s.lookupDomainCountryCache(ctx, host, country); found {
-        if ok { var sw SimilarWebResponse; if json.Unmarshal([]byte(payload), &sw) == nil { return &sw, true } }
-    }
     base := os.Getenv("SIMILARWEB_BASE_URL")
     if base == "" { base = "https://data.similarweb.com/api/v1/data?domain=%s" }
     apiURL := fmt.Sprintf(base, host)
@@ -686,25 +666,21 @@ func (s *Server) fetchSimilarWebMetricsRelaxed(ctx context.Context, host, countr
         ch <- res{ok: true, via: "direct", sw: &sw}
     }()
     // browser-exec fallback with generous timeout and networkidle
-    beURL := strings.TrimSpace(os.Getenv("BROWSER_EXEC_URL"))
-    if beURL != "" {
+    if s.be.Configured() {
         go func() {
             time.Sleep(200 * time.Millisecond)
-            body := map[string]any{"url": apiURL, "headers": headers, "waitUntil": "networkidle", "timeoutMs": 30000}
             sub, c := context.WithTimeout(ctxAll, 32*time.Second); defer c()
-            var out struct{ Status int `json:"status"`; Json map[string]any `json:"json"` }
-            if s.httpClient.DoJSON(sub, http.MethodPost, strings.TrimRight(beURL, "/")+"/api/v1/browser/json-fetch", body, map[string]string{"Content-Type": "application/json"}, 1, &out) == nil && out.Status >= 200 && out.Json != nil {
+            out, err := s.be.JSONFetch(sub, browserexec.JSONFetchRequest{URL: apiURL, Headers: headers, WaitUntil: "networkidle", TimeoutMs: 30000})
+            if err == nil && out.OK() {
                 var sw SimilarWebResponse
-                if b, err := json.Marshal(out.Json); err == nil && json.Unmarshal(b, &sw) == nil {
-                    ch <- res{ok: true, via: "browser", sw: &sw}; return
-                }
+                if json.Unmarshal(out.JSON, &sw) == nil { ch <- res{ok: true, via: "browser", sw: &sw}; return }
             }
             ch <- res{ok: false}
         }()
     }
     r1 := <-ch
     if r1.ok && r1.sw != nil { return r1.sw, true }
-    if beURL == "" { return nil, false }
+    if !s.be.Configured() { return nil, false }
     r2 := <-ch
     if r2.ok && r2.sw != nil { return r2.sw, true }
     return nil, false
@@ -764,8 +740,11 @@ func (s *Server) computeScoreManual(domain string, sw *SimilarWebResponse, ps *P
     return total
 }
 
-func (s *Server) updateAnalysisStatus(ctx context.Context, analysisID, status, result string) {
-    _, err := s.db.ExecContext(ctx, `UPDATE "SiterankAnalysis" SET status = $1, result = $2, updated_at = $3 WHERE id = $4`, status, result, time.Now(), analysisID)
+func (s *Server) updateAnalysisStatus(ctx context.Context, analysisID, status, result string, events ...ev.OutboxEvent) {
+    err := s.inTx(ctx, func(tx *sql.Tx) ([]ev.OutboxEvent, error) {
+        _, err := tx.ExecContext(ctx, `UPDATE "SiterankAnalysis" SET status = $1, result = $2, updated_at = $3 WHERE id = $4`, status, result, time.Now(), analysisID)
+        return events, err
+    })
     if err != nil {
         log.Printf("Failed to update analysis %s to %s: %v", analysisID, status, err)
     }
@@ -788,35 +767,25 @@ func (s *Server) writeEventStore(ctx context.Context, analysisID, name, aggregat
 
 // tryBrowserJSON calls browser-exec /json-fetch with optional proxy provider to fetch SimilarWeb JSON.
 func tryBrowserJSON(ctx context.Context, s *Server, apiURL string, headers map[string]string, host, analysisID string) bool {
-    beURL := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
-    if beURL == "" { return false }
+    if !s.be.Configured() { return false }
     provider := os.Getenv("PROXY_URL_US")
-    if s.publisher != nil {
-        _ = s.publisher.Publish(ctx, ev.EventBrowserExecRequested, map[string]any{
-            "analysisId": analysisID,
-            "url": apiURL,
-            "host": host,
-            "requestedAt": time.Now().UTC().Format(time.RFC3339),
-        }, ev.WithSource("siterank"))
-    }
-    body := map[string]any{
+    s.emit(ctx, ev.OutboxEvent{Type: ev.EventBrowserExecRequested, Data: map[string]any{
+        "analysisId": analysisID,
         "url": apiURL,
-        "headers": headers,
-    }
-    if provider != "" { body["proxyProviderURL"] = provider }
-    var out struct{ Status int `json:"status"`; Json map[string]any `json:"json"`; Text string `json:"text"` }
-    if err := s.httpClient.DoJSON(ctx, http.MethodPost, beURL+"/api/v1/browser/json-fetch", body, nil, 1, &out); err != nil { return false }
-    if out.Status >= 200 && out.Status < 300 && out.Json != nil {
+        "host": host,
+        "requestedAt": time.Now().UTC().Format(time.RFC3339),
+    }})
+    out, err := s.be.JSONFetch(ctx, browserexec.JSONFetchRequest{URL: apiURL, Headers: headers, ProxyProviderURL: provider})
+    if err != nil { return false }
+    if out.OK() {
         // success: write completed and cache 7 days
-        resultBytes, _ := json.Marshal(out.Json)
-        result := string(resultBytes)
-        s.updateAnalysisStatus(ctx, analysisID, "completed", result)
+        result := string(out.JSON)
+        now := time.Now().UTC().Format(time.RFC3339)
+        s.updateAnalysisStatus(ctx, analysisID, "completed", result,
+            ev.OutboxEvent{Type: ev.EventBrowserExecCompleted, Data: map[string]any{"analysisId": analysisID, "completedAt": now, "via": "browser-exec"}},
+            ev.OutboxEvent{Type: ev.EventSiterankCompleted, Data: map[string]any{"analysisId": analysisID, "completedAt": now, "via": "browser-exec"}})
         _ = s.maybeWriteFirestoreUI(ctx, analysisID, result)
-        _ = s.upsertDomainCache(ctx, host, result, true, 7*24*time.Hour)
-        if s.publisher != nil {
-            _ = s.publisher.Publish(ctx, ev.EventBrowserExecCompleted, map[string]any{"analysisId": analysisID, "completedAt": time.Now().UTC().Format(time.RFC3339), "via": "browser-exec"}, ev.WithSource("siterank"))
-            _ = s.publisher.Publish(ctx, ev.EventSiterankCompleted, map[string]any{"analysisId": analysisID, "completedAt": time.Now().UTC().Format(time.RFC3339), "via": "browser-exec"}, ev.WithSource("siterank"))
-        }
+        _ = s.rc.Set(ctx, cacheNsSW, rcache.Key(host, ""), result, true, cachePolicy(cacheNsSW))
         log.Printf("SimilarWeb fetched via browser-exec: %s", apiURL)
         return true
     }
@@ -867,90 +836,22 @@ func (s *Server) getLatestAnalysisByOffer(ctx context.Context, offerID, userID s
     return &a, true
 }
 
-// lookupDomainCache tries to get a non-expired cache entry for host from DB.
-// returns (payload, okFlag, found)
-func (s *Server) lookupDomainCache(ctx context.Context, host string) (string, bool, bool) {
-    var payload sql.NullString
-    var ok sql.NullBool
-    err := s.db.QueryRowContext(ctx, `SELECT payload::text, ok FROM domain_cache WHERE host=$1 AND expires_at > NOW()`, host).Scan(&payload, &ok)
-    if err != nil {
-        if err == sql.ErrNoRows { return "", false, false }
-        log.Printf("domain cache query failed for %s: %v", host, err)
-        return "", false, false
-    }
-    if !payload.Valid || !ok.Valid { return "", false, false }
-    return payload.String, ok.Bool, true
-}
-
-// upsertDomainCache writes cache for host with TTL; payload must be JSON string.
-func (s *Server) upsertDomainCache(ctx context.Context, host, payload string, ok bool, ttl time.Duration) error {
-    expires := time.Now().Add(ttl)
-    _, err := s.db.ExecContext(ctx, `
-        INSERT INTO domain_cache (host, payload, ok, updated_at, expires_at)
-        VALUES ($1, $2::jsonb, $3, NOW(), $4)
-        ON CONFLICT (host) DO UPDATE SET payload=EXCLUDED.payload, ok=EXCLUDED.ok, updated_at=NOW(), expires_at=EXCLUDED.expires_at
-    `, host, payload, ok, expires)
-    if err != nil {
-        log.Printf("domain cache upsert failed for %s: %v", host, err)
-    }
-    return err
-}
-
-// lookupDomainCountryCache tries country-aware table first, falling back to host-only cache for compatibility.
-func (s *Server) lookupDomainCountryCache(ctx context.Context, host, country string) (string, bool, bool) {
-    var payload sql.NullString
-    var ok sql.NullBool
-    err := s.db.QueryRowContext(ctx, `SELECT payload::text, ok FROM domain_country_cache WHERE host=$1 AND country=$2 AND expires_at > NOW()`, host, country).Scan(&payload, &ok)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            return s.lookupDomainCache(ctx, host)
-        }
-        log.Printf("domain country cache query failed for %s/%s: %v", host, country, err)
-        return "", false, false
-    }
-    if !payload.Valid || !ok.Valid { return "", false, false }
-    return payload.String, ok.Bool, true
-}
-
-// upsertDomainCountryCache writes cache keyed by (host,country) with TTL.
-func (s *Server) upsertDomainCountryCache(ctx context.Context, host, country, payload string, ok bool, ttl time.Duration) error {
-    expires := time.Now().Add(ttl)
-    _, err := s.db.ExecContext(ctx, `
-        INSERT INTO domain_country_cache (host, country, payload, ok, updated_at, expires_at)
-        VALUES ($1, $2, $3::jsonb, $4, NOW(), $5)
-        ON CONFLICT (host, country) DO UPDATE SET payload=EXCLUDED.payload, ok=EXCLUDED.ok, updated_at=NOW(), expires_at=EXCLUDED.expires_at
-    `, host, country, payload, ok, expires)
-    if err != nil {
-        log.Printf("domain country cache upsert failed for %s/%s: %v", host, country, err)
-    }
-    return err
-}
-
 // fetchBrowserJSON performs a browser-exec json-fetch without side effects; returns JSON text and ok flag.
 func (s *Server) fetchBrowserJSON(ctx context.Context, apiURL string, headers map[string]string) (string, bool) {
-    beURL := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
-    if beURL == "" { return "", false }
-    provider := os.Getenv("PROXY_URL_US")
-    body := map[string]any{"url": apiURL, "headers": headers}
-    if provider != "" { body["proxyProviderURL"] = provider }
-    var out struct{ Status int `json:"status"`; Json map[string]any `json:"json"`; Text string `json:"text"` }
-    if err := s.httpClient.DoJSON(ctx, http.MethodPost, beURL+"/api/v1/browser/json-fetch", body, map[string]string{"Content-Type": "application/json"}, 1, &out); err != nil { return "", false }
-    if out.Status >= 200 && out.Status < 300 && out.Json != nil {
-        resultBytes, _ := json.Marshal(out.Json)
-        return string(resultBytes), true
-    }
-    return "", false
+    if !s.be.Configured() { return "", false }
+    out, err := s.be.JSONFetch(ctx, browserexec.JSONFetchRequest{URL: apiURL, Headers: headers, ProxyProviderURL: os.Getenv("PROXY_URL_US")})
+    if err != nil || !out.OK() { return "", false }
+    return string(out.JSON), true
 }
 
-// fetchSimilarWebMetrics returns SimilarWebResponse by host, using cache then hedged fetch.
+// fetchSimilarWebMetrics returns SimilarWebResponse by host through the result cache.
 func (s *Server) fetchSimilarWebMetrics(ctx context.Context, host, country string) (*SimilarWebResponse, bool) {
-    // cache: country-aware first
-    if payload, ok, found := s.lookupDomainCountryCache(ctx, host, country); found {
-        if ok {
-            var sw SimilarWebResponse
-            if json.Unmarshal([]byte(payload), &sw) == nil { return &sw, true }
-        }
-    }
+    sw, _ := s.similarWebCached(ctx, host, country, s.fetchSimilarWebMetricsLive)
+    return sw, sw != nil
+}
+
+// fetchSimilarWebMetricsLive performs the hedged fetch (direct + browser) without touching the cache.
+func (s *Server) fetchSimilarWebMetricsLive(ctx context.Context, host, country string) (*SimilarWebResponse, bool) {
     base := os.Getenv("SIMILARWEB_BASE_URL")
     if base == "" { base = "https://data.similarweb.com/api/v1/data?domain=%s" }
     apiURL := fmt.Sprintf(base, host)
@@ -968,8 +869,7 @@ func (s *Server) fetchSimilarWebMetrics(ctx context.Context, host, country strin
         if err != nil { ch <- res{ok: false} ; return }
         ch <- res{ok: true, via: "direct", sw: &sw}
     }()
-    beURL := strings.TrimSpace(os.Getenv("BROWSER_EXEC_URL"))
-    if beURL != "" {
+    if s.be.Configured() {
         go func() {
             time.Sleep(200 * time.Millisecond)
             if txt, ok := s.fetchBrowserJSON(ctxAll, apiURL, headers); ok {
@@ -984,7 +884,7 @@ func (s *Server) fetchSimilarWebMetrics(ctx context.Context, host, country strin
         s.tryAugmentCountry(ctx, host, r1.sw)
         return r1.sw, true
     }
-    if beURL == "" { return nil, false }
+    if !s.be.Configured() { return nil, false }
     r2 := <-ch
     if r2.ok && r2.sw != nil {
         s.tryAugmentCountry(ctx, host, r2.sw)
@@ -1012,7 +912,7 @@ func (s *Server) tryAugmentCountry(ctx context.Context, host string, sw *Similar
     // direct
     if err := s.httpClient.DoJSON(ctx2, http.MethodGet, geoURL, nil, headers, 1, &tmp); err == nil {
         body = mustJSON(tmp); ok = true
-    } else if strings.TrimSpace(os.Getenv("BROWSER_EXEC_URL")) != "" {
+    } else if s.be.Configured() {
         if txt, good := s.fetchBrowserJSON(ctx2, geoURL, headers); good { body = txt; ok = true }
     }
     if !ok || strings.TrimSpace(body) == "" { return }
@@ -1212,16 +1112,28 @@ func main() {
         log.Printf("WARN: siterank publisher init failed: %v", err)
     } else { pub = p; defer pub.Close() }
 
-    // Ensure domain cache table exists (idempotent)
-    if err := ensureDomainCacheDDL(db); err != nil {
-        log.Printf("WARN: ensure domain_cache ddl failed: %v", err)
+    // Unified result cache table (schemas/sql/016_siterank_cache.sql); without it only the memory tier works
+    if err := rcache.Check(context.Background(), db); err != nil {
+        log.Printf("WARN: siterank_cache unavailable: %v", err)
+    }
+    rc := rcache.New(db)
+    rc.StartJanitor(context.Background(), 30*time.Minute)
+
+    // Events leave through the event_outbox (see outbox.go); the relay publishes them with retries
+    if err := ev.EnsureOutbox(context.Background(), db); err != nil {
+        log.Printf("WARN: ensure event_outbox ddl failed: %v", err)
     }
-    // Country-aware cache table (host+country composite key)
-    if err := ensureDomainCountryCacheDDL(db); err != nil {
-        log.Printf("WARN: ensure domain_country_cache ddl failed: %v", err)
+    if pub != nil {
+        relay := &ev.Relay{DB: db, Pub: pub, Source: outboxSource, Interval: time.Second}
+        go relay.Run(context.Background())
     }
 
-    server := &Server{db: db, httpClient: httpClient, publisher: pub, cache: map[string]cacheEntry{}}
+    server := &Server{db: db, httpClient: httpClient, rc: rc, be: browserexec.FromEnv()}
+    server.sagas = server.newBillingSagas(db)
+    if err := server.sagas.EnsureSchema(context.Background()); err != nil {
+        log.Printf("WARN: ensure saga ddl failed: %v", err)
+    }
+    go server.sagas.Run(context.Background(), 5*time.Second)
 
     // --- Router (chi) + OAS routes ---
     r := chi.NewRouter()
@@ -1234,6 +1146,23 @@ func main() {
     r.Handle("/metrics", telemetry.MetricsHandler())
     // smoke endpoint for direct URL analysis (preview only)
     r.Post("/api/v1/siterank/analyze-url", server.analyzeURLHandler)
+    // multi-geo analysis (non-OAS), behind auth
+    r.Group(func(rch chi.Router) {
+        rch.Use(middleware.AuthMiddleware)
+        rch.Post("/api/v1/siterank/analyze-geo", server.analyzeGeoHandler)
+        rch.Get("/api/v1/siterank/analyze-geo/{id}", server.getGeoAnalysisHandler)
+    })
+    // result cache admin: explicit invalidation + counters (non-OAS)
+    r.Group(func(rch chi.Router) {
+        rch.Use(middleware.AuthMiddleware)
+        rch.Use(middleware.AdminOnly)
+        rch.Post("/api/v1/siterank/cache/invalidate", server.cacheInvalidateHandler)
+        rch.Get("/api/v1/siterank/cache/stats", server.cacheStatsHandler)
+        // billing sagas: inspect and manually compensate stuck ones
+        sagaAdmin := server.sagas.AdminHandler("/api/v1/siterank/admin/sagas")
+        rch.Handle("/api/v1/siterank/admin/sagas", sagaAdmin)
+        rch.Handle("/api/v1/siterank/admin/sagas/*", sagaAdmin)
+    })
 
     // Bind OpenAPI routes under /api/v1 via generated chi server
     // Wrap with auth middleware to enforce Firebase/Gateway identity
@@ -1341,24 +1270,30 @@ func (h *oasImpl) ComputeSimilarOffers(w http.ResponseWriter, r *http.Request) {
     if userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized: User ID is missing", nil); return }
     var body api.ComputeSimilarOffersJSONRequestBody
     if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid body", nil); return }
-    seed := strings.TrimSpace(body.SeedDomain)
-    if seed == "" || len(body.Candidates) == 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "seedDomain and candidates are required", nil); return }
+    seed := normalizeDomain(body.SeedDomain)
+    if seed == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "seedDomain is required", nil); return }
     country := ""
     if body.Country != nil { country = strings.TrimSpace(*body.Country) }
+    offerID := ""
+    if body.OfferId != nil { offerID = strings.TrimSpace(*body.OfferId) }
+    limit := 50
+    if body.Limit != nil && *body.Limit > 0 && *body.Limit < limit { limit = *body.Limit }
     // fetch seed metrics
     seedSW, _ := h.srv.fetchSimilarWebMetrics(r.Context(), seed, country)
-    // compute for each candidate
-    out := make([]api.SimilarityItem, 0, len(body.Candidates))
-    for _, c := range body.Candidates {
-        cand := strings.TrimSpace(c)
-        if cand == "" || strings.EqualFold(cand, seed) { continue }
-        sw, _ := h.srv.fetchSimilarWebMetrics(r.Context(), cand, country)
-        score, factors := computeSimilarity(seed, cand, seedSW, sw, country)
-        out = append(out, api.SimilarityItem{Domain: cand, Score: float32(score), Factors: &factors})
+    // candidate set: provided + discovered (when no candidates given or discover=true)
+    cands := newCandidateSet(seed)
+    if body.Candidates != nil {
+        for _, c := range *body.Candidates { cands.add(c, string(api.Provided)) }
+    }
+    if cands.len() == 0 || (body.Discover != nil && *body.Discover) {
+        h.srv.discoverCandidates(r.Context(), cands, userID, offerID, seed, seedSW)
     }
+    if cands.len() == 0 { errors.Write(w, r, http.StatusUnprocessableEntity, "NO_CANDIDATES", "no candidates provided or discovered", nil); return }
+    // compute for each candidate
+    out := h.srv.rankCandidates(r.Context(), seed, seedSW, cands, country)
     // sort desc by score
     sort.Slice(out, func(i, j int) bool { return out[i].Score > out[j].Score })
-    if len(out) > 50 { out = out[:50] }
+    if len(out) > limit { out = out[:limit] }
     w.Header().Set("Content-Type", "application/json")
     _ = json.NewEncoder(w).Encode(struct{ Items []api.SimilarityItem `json:"items"` }{Items: out})
 }
@@ -1378,54 +1313,41 @@ func (h *oasImpl) SuggestKeywords(w http.ResponseWriter, r *http.Request) {
     minScore := 0.4
     if body.MinScore != nil { if v := float64(*body.MinScore); v >= 0 && v <= 1 { minScore = v } }
 
-    // Collect signals: domain tokens + optional page title/site name via browser-exec
-    brand, domTokens := tokenizeDomain(seed)
-    titleTokens := []string{}
-    // Try resolve + page-signals best-effort within 8s budget
-    be := strings.TrimRight(os.Getenv("BROWSER_EXEC_URL"), "/")
-    finalURL := "https://" + seed
-    if be != "" {
-        // resolve final URL (6s)
-        ctxRes, cancel := context.WithTimeout(r.Context(), 6*time.Second)
-        defer cancel()
-        var rr ResolveOfferResult
-        _ = h.srv.httpClient.DoJSON(ctxRes, http.MethodPost, be+"/api/v1/browser/resolve-offer", map[string]any{
-            "url": finalURL, "waitUntil": "domcontentloaded", "timeoutMs": 5000, "stabilizeMs": 800,
-        }, map[string]string{"Content-Type": "application/json"}, 1, &rr)
-        if rr.FinalUrl != "" { finalURL = rr.FinalUrl }
-        // page-signals (3s)
-        ctxPg, cancel2 := context.WithTimeout(r.Context(), 3*time.Second)
+    enrich := body.Enrich == nil || *body.Enrich
+    maxClusters := 10
+    if body.MaxClusters != nil && *body.MaxClusters > 0 && *body.MaxClusters <= 50 { maxClusters = *body.MaxClusters }
+
+    // Collect signals: domain tokens + page content (title, headings, meta, schema.org products) via browser-exec,
+    // both from the resolved landing page so that redirecting trackers yield the merchant's keywords
+    // (resolve + page-signals best-effort within ~12s budget)
+    finalURL, landing := h.srv.resolveLanding(r.Context(), seed, 6*time.Second)
+    brand, domTokens := tokenizeDomain(landing)
+    var ps *PageSignals
+    if h.srv.be.Configured() {
+        // page-signals with content (6s)
+        ctxPg, cancel2 := context.WithTimeout(r.Context(), 6*time.Second)
         defer cancel2()
-        var ps PageSignals
-        _ = h.srv.httpClient.DoJSON(ctxPg, http.MethodPost, be+"/api/v1/browser/page-signals", map[string]any{
-            "url": finalURL, "timeoutMs": 2500,
-        }, map[string]string{"Content-Type": "application/json"}, 1, &ps)
-        if strings.TrimSpace(ps.Title) != "" { titleTokens = append(titleTokens, tokenizeText(ps.Title)... ) }
-        if strings.TrimSpace(ps.SiteName) != "" { titleTokens = append(titleTokens, tokenizeText(ps.SiteName)... ) }
-    }
-
-    // Build candidate suggestions
-    cands := suggestFromSignals(brand, domTokens, titleTokens, country)
-    // Rank + filter
-    // Deduplicate by keyword lowercased
-    uniq := map[string]KeywordSuggestion{}
-    for _, s := range cands {
-        if s.Score < minScore { continue }
-        k := strings.ToLower(s.Keyword)
-        if prev, ok := uniq[k]; !ok || s.Score > prev.Score {
-            uniq[k] = s
+        if sig, err := h.srv.be.PageSignals(ctxPg, browserexec.PageSignalsRequest{URL: finalURL, TimeoutMs: 5000, Content: true}); err == nil {
+            ps = sig
         }
     }
-    out := make([]api.KeywordSuggestion, 0, len(uniq))
-    for _, v := range uniq { 
-        it := api.KeywordSuggestion{Keyword: v.Keyword, Score: float32(v.Score)}
-        if strings.TrimSpace(v.Reason) != "" { rs := v.Reason; it.Reason = &rs }
-        out = append(out, it)
+
+    // Extract -> enrich -> intent -> score
+    cands := h.srv.buildKeywordPlan(r.Context(), userID, landing, brand, domTokens, ps, country, enrich)
+    kept := make([]keywordCandidate, 0, len(cands))
+    for _, c := range cands {
+        if c.Score < minScore { continue }
+        kept = append(kept, c)
     }
-    sort.Slice(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+    out := make([]api.KeywordSuggestion, 0, len(kept))
+    for _, c := range kept { out = append(out, toKeywordSuggestion(c)) }
     if len(out) > topN { out = out[:topN] }
+    clusters := clusterKeywords(kept, brand, maxClusters)
     w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(struct{ Items []api.KeywordSuggestion `json:"items"` }{Items: out})
+    _ = json.NewEncoder(w).Encode(struct{
+        Items    []api.KeywordSuggestion `json:"items"`
+        Clusters []api.KeywordCluster    `json:"clusters"`
+    }{Items: out, Clusters: clusters})
 }
 
 // --- Keyword helpers ---
@@ -1499,40 +1421,6 @@ func suggestFromSignals(brand string, domTokens, titleTokens []string, country s
 
 func clamp01(v float64) float64 { if v < 0 { return 0 }; if v > 1 { return 1 }; return v }
 
-// ensureDomainCacheDDL creates domain_cache table/index if not exists.
-func ensureDomainCacheDDL(db *sql.DB) error {
-    ddl := `
-CREATE TABLE IF NOT EXISTS domain_cache (
-  host       TEXT PRIMARY KEY,
-  payload    JSONB NOT NULL,
-  ok         BOOLEAN NOT NULL,
-  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  expires_at TIMESTAMPTZ NOT NULL
-);
-CREATE INDEX IF NOT EXISTS ix_domain_cache_expires ON domain_cache(expires_at);
-`
-    _, err := db.Exec(ddl)
-    return err
-}
-
-// ensureDomainCountryCacheDDL creates domain_country_cache with composite PK (host,country).
-func ensureDomainCountryCacheDDL(db *sql.DB) error {
-    ddl := `
-CREATE TABLE IF NOT EXISTS domain_country_cache (
-  host       TEXT NOT NULL,
-  country    TEXT NOT NULL DEFAULT '',
-  payload    JSONB NOT NULL,
-  ok         BOOLEAN NOT NULL,
-  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  expires_at TIMESTAMPTZ NOT NULL,
-  PRIMARY KEY (host, country)
-);
-CREATE INDEX IF NOT EXISTS ix_domain_country_cache_expires ON domain_country_cache(expires_at);
-`
-    _, err := db.Exec(ddl)
-    return err
-}
-
 // maybeWriteFirestoreUI writes the latest analysis result to Firestore as a UI cache layer.
 // Controlled by FIRESTORE_ENABLED=1; best-effort and non-blocking.
 func (s *Server) maybeWriteFirestoreUI(ctx context.Context, analysisID string, payload string) error {
@@ -1584,7 +1472,6 @@ func (s *Server) maybeWriteDegradedNotification(ctx context.Context, analysisID,
 
 // maybePublishDegradedNotification publishes a NotificationCreated event so that notifications service can store UI entries.
 func (s *Server) maybePublishDegradedNotification(ctx context.Context, analysisID, domain, finalUrl string) error {
-    if s.publisher == nil { return nil }
     var offerID, userID string
     if err := s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offerID, &userID); err != nil {
         return err
@@ -1597,31 +1484,28 @@ func (s *Server) maybePublishDegradedNotification(ctx context.Context, analysisI
         "data": map[string]any{"analysisId": analysisID, "offerId": offerID, "domain": domain, "finalUrl": finalUrl},
         "createdAt": time.Now().UTC().Format(time.RFC3339),
     }
-    return s.publisher.Publish(ctx, ev.EventNotificationCreated, payload, ev.WithSource("siterank"), ev.WithSubject(analysisID))
+    return ev.Enqueue(ctx, s.db, outboxSource, ev.OutboxEvent{Type: ev.EventNotificationCreated, Subject: analysisID, Data: payload})
 }
 
 // ensureUserRegistered creates a minimal User read model row if missing and publishes UserRegistered.
 func (s *Server) ensureUserRegistered(ctx context.Context, uid, email string) error {
     if strings.TrimSpace(uid) == "" { return nil }
     if err := ensureUserDDL(s.db); err != nil { return err }
-    // attempt insert with ON CONFLICT DO NOTHING
-    res, err := s.db.ExecContext(ctx, `
-        INSERT INTO "User"(id, email, name, role, "createdAt")
-        VALUES ($1, $2, '', 'USER', NOW())
-        ON CONFLICT (id) DO NOTHING
-    `, uid, email)
-    if err != nil { return err }
-    // publish event only when actually inserted
-    if s.publisher != nil {
-        if rows, _ := res.RowsAffected(); rows > 0 {
-            _ = s.publisher.Publish(ctx, ev.EventUserRegistered, map[string]any{
-                "userId": uid,
-                "email":  email,
-                "time":   time.Now().UTC().Format(time.RFC3339),
-            }, ev.WithSource("siterank"), ev.WithSubject(uid))
-        }
-    }
-    return nil
+    // attempt insert with ON CONFLICT DO NOTHING; the event is recorded only when actually inserted
+    return s.inTx(ctx, func(tx *sql.Tx) ([]ev.OutboxEvent, error) {
+        res, err := tx.ExecContext(ctx, `
+            INSERT INTO "User"(id, email, name, role, "createdAt")
+            VALUES ($1, $2, '', 'USER', NOW())
+            ON CONFLICT (id) DO NOTHING
+        `, uid, email)
+        if err != nil { return nil, err }
+        if rows, _ := res.RowsAffected(); rows == 0 { return nil, nil }
+        return []ev.OutboxEvent{{Type: ev.EventUserRegistered, Subject: uid, Data: map[string]any{
+            "userId": uid,
+            "email":  email,
+            "time":   time.Now().UTC().Format(time.RFC3339),
+        }}}, nil
+    })
 }
 
 func ensureUserDDL(db *sql.DB) error {
@@ -1638,8 +1522,9 @@ CREATE TABLE IF NOT EXISTS "User" (
     return err
 }
 
-// projectHistory persists a history snapshot and UI history cache (best-effort).
-func (s *Server) projectHistory(ctx context.Context, analysisID, payload string) error {
+// projectHistory persists a history snapshot and UI history cache (best-effort). The analysed domain
+// and its SimilarWeb category are kept in columns, since the payload's shape differs per analysis path.
+func (s *Server) projectHistory(ctx context.Context, analysisID, domain, payload string) error {
     var offerID, userID string
     if err := s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankAnalysis" WHERE id=$1`, analysisID).Scan(&offerID, &userID); err != nil {
         return err
@@ -1647,10 +1532,10 @@ func (s *Server) projectHistory(ctx context.Context, analysisID, payload string)
     score := computeScore(payload)
     if err := ensureSiterankHistoryDDL(s.db); err != nil { log.Printf("history ddl: %v", err) }
     _, err := s.db.ExecContext(ctx, `
-        INSERT INTO "SiterankHistory"(analysis_id, user_id, offer_id, score, result, created_at)
-        VALUES ($1,$2,$3,$4,$5::jsonb, NOW())
+        INSERT INTO "SiterankHistory"(analysis_id, user_id, offer_id, score, result, domain, category, created_at)
+        VALUES ($1,$2,$3,$4,$5::jsonb,$6,$7, NOW())
         ON CONFLICT (analysis_id) DO NOTHING
-    `, analysisID, userID, offerID, score, payload)
+    `, analysisID, userID, offerID, score, payload, domain, historyCategory(payload))
     if err != nil { log.Printf("history insert failed: %v", err) }
     if strings.TrimSpace(os.Getenv("FIRESTORE_ENABLED")) == "1" {
         pid := strings.TrimSpace(os.Getenv("GOOGLE_CLOUD_PROJECT"))
@@ -1667,6 +1552,19 @@ func (s *Server) projectHistory(ctx context.Context, analysisID, payload string)
     return nil
 }
 
+// historyCategory returns the SimilarWeb category of an analysis payload: top-level for the default
+// path (stored as "category", or "Category" when the raw SimilarWeb JSON was kept), under
+// "similarweb" for resolve+AI analyses.
+func historyCategory(payload string) string {
+    var d struct {
+        Category   string `json:"category"`
+        SimilarWeb *struct{ Category string `json:"category"` } `json:"similarweb"`
+    }
+    if json.Unmarshal([]byte(payload), &d) != nil { return "" }
+    if d.SimilarWeb != nil && strings.TrimSpace(d.SimilarWeb.Category) != "" { return strings.TrimSpace(d.SimilarWeb.Category) }
+    return strings.TrimSpace(d.Category)
+}
+
 func computeScore(payload string) int {
     type sw struct { GlobalRank int `json:"global_rank"`; CountryRank int `json:"country_rank"`; CategoryRank int `json:"category_rank"`; TotalVisits float64 `json:"total_visits"` }
     var d sw
@@ -1692,6 +1590,9 @@ CREATE TABLE IF NOT EXISTS "SiterankHistory" (
   created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 CREATE INDEX IF NOT EXISTS ix_siterank_history_offer_user ON "SiterankHistory"(offer_id, user_id, created_at DESC);
+ALTER TABLE "SiterankHistory" ADD COLUMN IF NOT EXISTS domain TEXT NOT NULL DEFAULT '';
+ALTER TABLE "SiterankHistory" ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS ix_siterank_history_user_category ON "SiterankHistory"(user_id, lower(category));
 `
     _, err := db.Exec(ddl)
     return err
@@ -0,0 +1,372 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/google/uuid"
+    "github.com/xxrenzhe/autoads/pkg/auth"
+    "github.com/xxrenzhe/autoads/pkg/browserexec"
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+    rcache "github.com/xxrenzhe/autoads/services/siterank/internal/cache"
+)
+
+// GeoAnalysisRequest asks for one offer to be analyzed across several target countries.
+type GeoAnalysisRequest struct {
+    OfferID   string   `json:"offerId"`
+    URL       string   `json:"url,omitempty"`
+    Countries []string `json:"countries"`
+}
+
+// GeoCell is one row of the per-country score matrix.
+type GeoCell struct {
+    Country          string  `json:"country"`
+    Available        bool    `json:"available"`
+    Status           int     `json:"status"`
+    FinalUrl         string  `json:"finalUrl,omitempty"`
+    FinalDomain      string  `json:"finalDomain,omitempty"`
+    ChainLength      int     `json:"chainLength"`
+    Via              string  `json:"via,omitempty"`
+    // Proxied is false when no proxy of the country was used (no PROXY_URL_<CC>): the redirects
+    // were followed from the service's own network, so the cell's landing is not geo-verified.
+    Proxied          bool    `json:"proxied"`
+    TrafficShare     float64 `json:"trafficShare"`
+    ShareKnown       bool    `json:"shareKnown"`
+    BaseScore        float64 `json:"baseScore"`
+    Score            float64 `json:"score"`
+    RedirectDiverges bool    `json:"redirectDiverges"`
+    Cached           bool    `json:"cached"`
+    Error            string  `json:"error,omitempty"`
+}
+
+const (
+    maxGeoCountries = 10
+    geoCellOkTTL    = 6 * time.Hour
+    geoCellFailTTL  = 30 * time.Minute
+)
+
+// analyzeGeoHandler accepts a multi-geo analysis request and runs it asynchronously.
+// POST /api/v1/siterank/analyze-geo
+func (s *Server) analyzeGeoHandler(w http.ResponseWriter, r *http.Request) {
+    userID, _ := auth.ExtractUserID(r)
+    if userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized: User ID is missing", nil); return }
+    var req GeoAnalysisRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid request body", nil); return }
+    countries := normalizeCountries(req.Countries)
+    if len(countries) == 0 { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "countries is required", nil); return }
+    if len(countries) > maxGeoCountries {
+        errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", fmt.Sprintf("at most %d countries per run", maxGeoCountries), nil); return
+    }
+    offerURL := strings.TrimSpace(req.URL)
+    if offerURL == "" && strings.TrimSpace(req.OfferID) != "" {
+        _ = s.db.QueryRowContext(r.Context(), `SELECT "originalUrl" FROM "Offer" WHERE id=$1 AND "userId"=$2`, req.OfferID, userID).Scan(&offerURL)
+    }
+    if offerURL == "" { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "url or a known offerId is required", nil); return }
+    if strings.TrimSpace(req.OfferID) == "" { req.OfferID = "adhoc-" + uuid.New().String() }
+    // Hold a realtime query per country; cells served from cache settle at the cached rate
+    chargeID := uuid.New().String()
+    if !s.reserveOrReject(w, r, userID, chargeID, []billingItem{{Action: actionRealtimeQuery, Quantity: len(countries)}}) { return }
+
+    // every run is its own "SiterankGeoAnalysis" row (schemas/sql/027); the offer's regular analysis is left alone
+    analysis := SiterankAnalysis{ID: uuid.New().String(), UserID: userID, OfferID: req.OfferID, Status: "running", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+    err := s.inTx(r.Context(), func(tx *sql.Tx) ([]ev.OutboxEvent, error) {
+        _, err := tx.ExecContext(r.Context(), `
+            INSERT INTO "SiterankGeoAnalysis"(id, user_id, offer_id, countries, status, created_at, updated_at)
+            VALUES ($1,$2,$3,$4::jsonb,$5,$6,$7)
+        `, analysis.ID, analysis.UserID, analysis.OfferID, mustJSON(countries), analysis.Status, analysis.CreatedAt, analysis.UpdatedAt)
+        if err != nil { return nil, err }
+        return []ev.OutboxEvent{{Type: ev.EventSiterankRequested, Subject: analysis.OfferID, Data: map[string]any{
+            "analysisId":  analysis.ID,
+            "offerId":     analysis.OfferID,
+            "userId":      analysis.UserID,
+            "countries":   countries,
+            "mode":        "multi-geo",
+            "requestedAt": time.Now().UTC().Format(time.RFC3339),
+        }}}, nil
+    })
+    if err != nil {
+        log.Printf("Error upserting geo analysis: %v", err)
+        s.settleCharge(r.Context(), chargeID, analysisCharge{})
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil)
+        return
+    }
+    analysisID := analysis.ID
+    s.runBilled(chargeID, func(ctx context.Context) analysisCharge { return s.analyzeMultiGeo(ctx, analysisID, offerURL, countries) })
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    _ = json.NewEncoder(w).Encode(analysis)
+}
+
+// getGeoAnalysisHandler returns one multi-geo run of the current user.
+// GET /api/v1/siterank/analyze-geo/{id}
+func (s *Server) getGeoAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+    userID, _ := auth.ExtractUserID(r)
+    if userID == "" { errors.Write(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized: User ID is missing", nil); return }
+    var analysis SiterankAnalysis
+    var result sql.NullString
+    err := s.db.QueryRowContext(r.Context(), `SELECT id, user_id, offer_id, status, result::text, created_at, updated_at FROM "SiterankGeoAnalysis" WHERE id = $1 AND user_id = $2`, chi.URLParam(r, "id"), userID).Scan(
+        &analysis.ID, &analysis.UserID, &analysis.OfferID, &analysis.Status, &result, &analysis.CreatedAt, &analysis.UpdatedAt,
+    )
+    if err == sql.ErrNoRows { errors.Write(w, r, http.StatusNotFound, "NOT_FOUND", "Geo analysis not found", nil); return }
+    if err != nil {
+        log.Printf("Error getting geo analysis: %v", err)
+        errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "Internal server error", nil)
+        return
+    }
+    if result.Valid { analysis.Result = &result.String }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(analysis)
+}
+
+// analyzeMultiGeo resolves the offer once per country (with a country proxy hint), fetches
+// country-specific traffic share for each final domain, and stores a score matrix plus recommended geos.
+func (s *Server) analyzeMultiGeo(ctx context.Context, analysisID, offerURL string, countries []string) analysisCharge {
+    var offID, uid string
+    _ = s.db.QueryRowContext(ctx, `SELECT offer_id, user_id FROM "SiterankGeoAnalysis" WHERE id=$1`, analysisID).Scan(&offID, &uid)
+    if offID != "" && uid != "" {
+        s.emit(ctx, ev.OutboxEvent{Type: ev.EventWorkflowStarted, Data: map[string]any{
+            "analysisId": analysisID, "offerId": offID, "userId": uid,
+            "time": time.Now().UTC().Format(time.RFC3339), "name": "siterank.geo",
+        }})
+    }
+    offerHost := ""
+    if u, err := url.Parse(offerURL); err == nil { offerHost = strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") }
+
+    cells := make([]GeoCell, len(countries))
+    sem := make(chan struct{}, geoConcurrency())
+    var wg sync.WaitGroup
+    for i, cc := range countries {
+        wg.Add(1)
+        go func(i int, cc string) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            cells[i] = s.analyzeGeoCell(ctx, offerURL, offerHost, cc)
+            if offID != "" && uid != "" {
+                status := "ok"
+                if !cells[i].Available { status = "failed" }
+                s.emit(ctx, ev.OutboxEvent{Type: ev.EventWorkflowStepCompleted, Data: map[string]any{
+                    "analysisId": analysisID, "offerId": offID, "userId": uid,
+                    "time": time.Now().UTC().Format(time.RFC3339), "name": "geo:" + cc, "status": status, "score": cells[i].Score,
+                }})
+            }
+        }(i, cc)
+    }
+    wg.Wait()
+
+    markRedirectDivergence(cells)
+    recommended := recommendGeos(cells)
+    matrix := make(map[string]GeoCell, len(cells))
+    best := 0.0
+    for _, c := range cells {
+        matrix[c.Country] = c
+        if c.Score > best { best = c.Score }
+    }
+    payload := map[string]any{
+        "mode":        "multi-geo",
+        "offerUrl":    offerURL,
+        "countries":   countries,
+        "cells":       cells,
+        "matrix":      matrix,
+        "recommended": recommended,
+        "score":       best,
+        "createdAt":   time.Now().UTC().Format(time.RFC3339),
+    }
+    bres, _ := json.Marshal(payload)
+    result := string(bres)
+    // the run's own row only: the offer's analysis, UI cache and score history stay with the regular analysis
+    err := s.inTx(ctx, func(tx *sql.Tx) ([]ev.OutboxEvent, error) {
+        _, err := tx.ExecContext(ctx, `UPDATE "SiterankGeoAnalysis" SET status = 'completed', result = $1::jsonb, updated_at = $2 WHERE id = $3`, result, time.Now(), analysisID)
+        return []ev.OutboxEvent{{Type: ev.EventSiterankCompleted, Data: map[string]any{
+            "analysisId":  analysisID,
+            "offerId":     offID,
+            "userId":      uid,
+            "completedAt": time.Now().UTC().Format(time.RFC3339),
+            "via":         "multi-geo",
+            "mode":        "multi-geo",
+            "score":       best,
+            "recommended": recommended,
+        }}}, err
+    })
+    if err != nil { log.Printf("Failed to complete geo analysis %s: %v", analysisID, err) }
+    log.Printf("Completed multi-geo analysis %s for %d countries (recommended=%v)", analysisID, len(countries), recommended)
+    // only cells that resolved are billable
+    charge := analysisCharge{Completed: true}
+    for _, c := range cells {
+        if !c.Available { continue }
+        st := rcache.Miss
+        if c.Cached { st = rcache.Hit }
+        charge.add(queryActionFor(st))
+        charge.Stages = append(charge.Stages, c.Country+":"+queryStageFor(st))
+    }
+    return charge
+}
+
+// analyzeGeoCell computes one country's cell through the result cache ("geo" namespace, keyed by
+// the normalized offer URL and country: offers sharing a tracker host redirect differently).
+func (s *Server) analyzeGeoCell(ctx context.Context, offerURL, offerHost, country string) GeoCell {
+    key := geoCellKey(offerURL)
+    if key == "" { return s.computeGeoCell(ctx, offerURL, offerHost, country) }
+    e, st, err := s.rc.Fetch(ctx, cacheNsGeo, rcache.Key(key, country), cachePolicy(cacheNsGeo), func(fctx context.Context) (string, bool, error) {
+        cell := s.computeGeoCell(fctx, offerURL, offerHost, country)
+        return mustJSON(cell), cell.Available, nil
+    })
+    var cell GeoCell
+    if err != nil || json.Unmarshal([]byte(e.Payload), &cell) != nil || cell.Country == "" {
+        return GeoCell{Country: country, Error: "geo cell unavailable"}
+    }
+    cell.Cached = st == rcache.Hit || st == rcache.Stale
+    return cell
+}
+
+// computeGeoCell resolves the offer from country and scores the landing domain's traffic there.
+func (s *Server) computeGeoCell(ctx context.Context, offerURL, offerHost, country string) GeoCell {
+    cell := GeoCell{Country: country}
+    rr, err := s.resolveOfferForCountry(ctx, offerURL, country)
+    if err != nil {
+        cell.Error = err.Error()
+    }
+    cell.Status = rr.Status
+    cell.Via = rr.Via
+    cell.Proxied = rr.Via == "proxy"
+    cell.ChainLength = rr.ChainLength
+    cell.FinalUrl = rr.FinalUrl
+    cell.FinalDomain = strings.TrimPrefix(strings.ToLower(rr.Domain), "www.")
+    cell.Available = err == nil && (rr.Ok || (rr.Status >= 200 && rr.Status < 400))
+    if cell.FinalDomain == "" { cell.FinalDomain = offerHost }
+
+    if cell.Available && cell.FinalDomain != "" {
+        sw, _ := s.fetchSimilarWebMetrics(ctx, cell.FinalDomain, country)
+        cell.TrafficShare, cell.ShareKnown = countryShare(sw, country)
+        ps := PageSignals{Status: rr.Status}
+        cell.BaseScore = s.computeScoreManual(cell.FinalDomain, sw, &ps)
+        cell.Score = geoScore(cell.BaseScore, cell.TrafficShare, cell.ShareKnown, sw, country)
+    }
+    return cell
+}
+
+// resolveOfferForCountry calls browser-exec /resolve-offer with a country hint and,
+// when configured, the country's proxy provider (PROXY_URL_<CC>).
+func (s *Server) resolveOfferForCountry(ctx context.Context, offerURL, country string) (ResolveOfferResult, error) {
+    cctx, cancel := context.WithTimeout(ctx, 50*time.Second)
+    defer cancel()
+    rr, err := s.be.ResolveOffer(cctx, browserexec.ResolveOfferRequest{
+        URL:              offerURL,
+        WaitUntil:        "domcontentloaded",
+        TimeoutMs:        45000,
+        StabilizeMs:      1200,
+        Country:          country,
+        ProxyProviderURL: proxyProviderFor(country),
+    })
+    if err != nil { return ResolveOfferResult{}, err }
+    return *rr, nil
+}
+
+// proxyProviderFor returns the country's proxy provider URL (PROXY_URL_<CC>). Other countries'
+// providers are never substituted, and browser-exec applies no US fallback when a country is given.
+func proxyProviderFor(country string) string {
+    cc := strings.ToUpper(strings.TrimSpace(country))
+    if cc == "" { return "" }
+    return strings.TrimSpace(os.Getenv("PROXY_URL_" + cc))
+}
+
+// countryShare returns the country's traffic share (0..1) from SimilarWeb metrics and whether it was known.
+func countryShare(sw *SimilarWebResponse, country string) (float64, bool) {
+    if sw == nil { return 0, false }
+    cc := strings.ToUpper(country)
+    for _, kv := range sw.CountryShares {
+        if strings.EqualFold(kv.Country, cc) { return kv.Share, true }
+    }
+    if len(sw.CountryShares) > 0 { return 0, true }
+    return 0, false
+}
+
+// geoScore blends the landing/traffic base score (75%) with the country's traffic share (25%).
+// Without explicit shares, presence in TopCountries earns a partial share bonus.
+func geoScore(base, share float64, shareKnown bool, sw *SimilarWebResponse, country string) float64 {
+    shareScore := 0.0
+    switch {
+    case shareKnown:
+        shareScore = clamp01(share/0.25) * 25.0
+    case sw != nil && contains(upperAll(sw.TopCountries), strings.ToUpper(country)):
+        shareScore = 15.0
+    default:
+        shareScore = 8.0 // unknown distribution: neutral
+    }
+    score := base*0.75 + shareScore
+    if score < 0 { score = 0 }
+    if score > 100 { score = 100 }
+    return round2(score)
+}
+
+// markRedirectDivergence flags cells whose final domain differs from the most common final domain.
+func markRedirectDivergence(cells []GeoCell) {
+    counts := map[string]int{}
+    for _, c := range cells { if c.Available && c.FinalDomain != "" { counts[c.FinalDomain]++ } }
+    major, n := "", 0
+    for d, k := range counts { if k > n || (k == n && d < major) { major, n = d, k } }
+    for i := range cells {
+        cells[i].RedirectDiverges = false
+        if major != "" && cells[i].Available && cells[i].FinalDomain != "" && cells[i].FinalDomain != major { cells[i].RedirectDiverges = true }
+    }
+}
+
+// recommendGeos returns available countries scoring at or above SITERANK_GEO_MIN_SCORE (default 50),
+// best first, capped at SITERANK_GEO_TOP (default 3).
+func recommendGeos(cells []GeoCell) []string {
+    minScore := 50.0
+    if v := strings.TrimSpace(os.Getenv("SITERANK_GEO_MIN_SCORE")); v != "" { if f, err := strconv.ParseFloat(v, 64); err == nil { minScore = f } }
+    top := 3
+    if v := strings.TrimSpace(os.Getenv("SITERANK_GEO_TOP")); v != "" { if n, err := strconv.Atoi(v); err == nil && n > 0 { top = n } }
+    ranked := make([]GeoCell, 0, len(cells))
+    for _, c := range cells { if c.Available && c.Score >= minScore { ranked = append(ranked, c) } }
+    sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+    out := make([]string, 0, top)
+    for i := 0; i < len(ranked) && i < top; i++ { out = append(out, ranked[i].Country) }
+    return out
+}
+
+// geoCellKey normalizes an offer URL for the geo cache: lower-case host without www., no fragment,
+// no trailing slash; path and query are kept since they select the offer on a tracker.
+func geoCellKey(raw string) string {
+    u, err := url.Parse(strings.TrimSpace(raw))
+    if err != nil || u.Hostname() == "" { return "" }
+    host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+    if p := u.Port(); p != "" { host += ":" + p }
+    key := host + strings.TrimRight(u.EscapedPath(), "/")
+    if u.RawQuery != "" { key += "?" + u.RawQuery }
+    return key
+}
+
+func normalizeCountries(in []string) []string {
+    out := make([]string, 0, len(in))
+    for _, c := range in {
+        c = strings.ToUpper(strings.TrimSpace(c))
+        if len(c) != 2 { continue }
+        out = append(out, c)
+    }
+    return unique(out)
+}
+
+func geoConcurrency() int {
+    if v := strings.TrimSpace(os.Getenv("SITERANK_GEO_CONCURRENCY")); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 10 { return n }
+    }
+    return 3
+}
+
+func upperAll(arr []string) []string { out := make([]string, 0, len(arr)); for _, x := range arr { out = append(out, strings.ToUpper(x)) }; return out }
+func round2(v float64) float64 { return float64(int(v*100+0.5)) / 100 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCountries(t *testing.T) {
+	cases := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"us", " de ", "US"}, []string{"US", "DE"}},
+		{[]string{"usa", "", "g", "fr"}, []string{"FR"}},
+	}
+	for _, c := range cases {
+		if got := normalizeCountries(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("normalizeCountries(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestGeoScore(t *testing.T) {
+	withTop := &SimilarWebResponse{TopCountries: []string{"us", "de"}}
+	cases := []struct {
+		name       string
+		base       float64
+		share      float64
+		shareKnown bool
+		sw         *SimilarWebResponse
+		country    string
+		want       float64
+	}{
+		{"full share bonus", 80, 0.25, true, nil, "US", 85},
+		{"partial share", 80, 0.1, true, nil, "US", 70},
+		{"known zero share", 80, 0, true, nil, "US", 60},
+		{"top country", 80, 0, false, withTop, "DE", 75},
+		{"unknown distribution", 80, 0, false, nil, "DE", 68},
+		{"clamped", 200, 1, true, nil, "US", 100},
+	}
+	for _, c := range cases {
+		if got := geoScore(c.base, c.share, c.shareKnown, c.sw, c.country); got != c.want {
+			t.Errorf("%s: geoScore = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMarkRedirectDivergence(t *testing.T) {
+	cells := []GeoCell{
+		{Country: "US", Available: true, FinalDomain: "shop.com"},
+		{Country: "DE", Available: true, FinalDomain: "shop.com"},
+		{Country: "FR", Available: true, FinalDomain: "shop.fr"},
+		{Country: "JP", Available: false, FinalDomain: "other.jp", RedirectDiverges: true},
+	}
+	markRedirectDivergence(cells)
+	want := []bool{false, false, true, false}
+	for i, c := range cells {
+		if c.RedirectDiverges != want[i] {
+			t.Errorf("%s: RedirectDiverges = %v, want %v", c.Country, c.RedirectDiverges, want[i])
+		}
+	}
+}
+
+func TestRecommendGeos(t *testing.T) {
+	cells := []GeoCell{
+		{Country: "US", Available: true, Score: 70},
+		{Country: "DE", Available: true, Score: 90},
+		{Country: "FR", Available: true, Score: 40},
+		{Country: "JP", Available: false, Score: 99},
+		{Country: "GB", Available: true, Score: 60},
+		{Country: "CA", Available: true, Score: 55},
+	}
+	if got := recommendGeos(cells); !reflect.DeepEqual(got, []string{"DE", "US", "GB"}) {
+		t.Errorf("recommendGeos = %v", got)
+	}
+	t.Setenv("SITERANK_GEO_MIN_SCORE", "65")
+	t.Setenv("SITERANK_GEO_TOP", "5")
+	if got := recommendGeos(cells); !reflect.DeepEqual(got, []string{"DE", "US"}) {
+		t.Errorf("recommendGeos with env = %v", got)
+	}
+}
+
+func TestGeoCellKey(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"https://WWW.Track.example.com/go?id=1#x", "track.example.com/go?id=1"},
+		{"https://track.example.com/go/?id=2", "track.example.com/go?id=2"},
+		{"http://track.example.com:8080/", "track.example.com:8080"},
+		{"not a url", ""},
+	}
+	for _, c := range cases {
+		if got := geoCellKey(c.in); got != c.want {
+			t.Errorf("geoCellKey(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+	if geoCellKey("https://track.example.com/go?id=1") == geoCellKey("https://track.example.com/go?id=2") {
+		t.Error("offers on one tracker host share a geo cache key")
+	}
+}
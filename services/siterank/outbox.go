@@ -0,0 +1,35 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "log"
+
+    ev "github.com/xxrenzhe/autoads/pkg/events"
+)
+
+// Siterank events leave through the event_outbox (pkg/events): events that belong to a write are
+// recorded in its transaction (inTx), the others on their own (emit). The relay started in main
+// publishes them with retries, so an event is never published for a change that rolled back.
+
+// outboxSource names siterank's rows in event_outbox and is the source of its events.
+const outboxSource = "siterank"
+
+// inTx runs fn in a transaction and records the events it returns before committing.
+func (s *Server) inTx(ctx context.Context, fn func(tx *sql.Tx) ([]ev.OutboxEvent, error)) error {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    events, err := fn(tx)
+    if err != nil { return err }
+    if err := ev.Enqueue(ctx, tx, outboxSource, events...); err != nil { return err }
+    return tx.Commit()
+}
+
+// emit records events that are not tied to a write (progress, notifications).
+func (s *Server) emit(ctx context.Context, events ...ev.OutboxEvent) {
+    if s.db == nil || len(events) == 0 { return }
+    if err := ev.Enqueue(ctx, s.db, outboxSource, events...); err != nil {
+        log.Printf("WARN: siterank enqueue %s failed: %v", events[0].Type, err)
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/xxrenzhe/autoads/pkg/errors"
+    rcache "github.com/xxrenzhe/autoads/services/siterank/internal/cache"
+)
+
+// Result cache namespaces. Keys are rcache.Key(host, country) unless noted.
+const (
+    cacheNsSW       = "sw"       // SimilarWeb metrics per domain
+    cacheNsAnalysis = "analysis" // legacy (non-resolve) analysis result per offer host
+    cacheNsSimilar  = "similar"  // similar-sites list per domain (key: host)
+    cacheNsGeo      = "geo"      // multi-geo cell per offer host
+)
+
+var defaultCachePolicies = map[string]rcache.Policy{
+    cacheNsSW:       {OkTTL: 7 * 24 * time.Hour, FailTTL: 30 * time.Minute, StaleTTL: 7 * 24 * time.Hour, MemTTL: 5 * time.Minute},
+    cacheNsAnalysis: {OkTTL: 24 * time.Hour, FailTTL: 30 * time.Minute, StaleTTL: 6 * 24 * time.Hour, MemTTL: 5 * time.Minute},
+    cacheNsSimilar:  {OkTTL: 7 * 24 * time.Hour, FailTTL: time.Hour, StaleTTL: 7 * 24 * time.Hour, MemTTL: 10 * time.Minute},
+    cacheNsGeo:      {OkTTL: geoCellOkTTL, FailTTL: geoCellFailTTL, StaleTTL: 18 * time.Hour, MemTTL: 5 * time.Minute},
+}
+
+// cachePolicy returns the namespace policy; SITERANK_CACHE_<NS>="ok,fail,stale" (Go durations) overrides it.
+func cachePolicy(ns string) rcache.Policy {
+    p := defaultCachePolicies[ns]
+    raw := strings.TrimSpace(os.Getenv("SITERANK_CACHE_" + strings.ToUpper(ns)))
+    if raw == "" { return p }
+    parts := strings.Split(raw, ",")
+    set := func(i int, dst *time.Duration) {
+        if i >= len(parts) { return }
+        if d, err := time.ParseDuration(strings.TrimSpace(parts[i])); err == nil && d >= 0 { *dst = d }
+    }
+    set(0, &p.OkTTL)
+    set(1, &p.FailTTL)
+    set(2, &p.StaleTTL)
+    return p
+}
+
+// similarWebCached reads SimilarWeb metrics through the result cache using live to fill misses
+// and revalidate stale entries. Returns nil metrics when the (possibly cached) fetch failed.
+func (s *Server) similarWebCached(ctx context.Context, host, country string, live func(context.Context, string, string) (*SimilarWebResponse, bool)) (*SimilarWebResponse, rcache.Status) {
+    if strings.TrimSpace(host) == "" { return nil, rcache.Miss }
+    e, st, err := s.rc.Fetch(ctx, cacheNsSW, rcache.Key(host, country), cachePolicy(cacheNsSW), func(fctx context.Context) (string, bool, error) {
+        sw, ok := live(fctx, host, country)
+        if !ok || sw == nil {
+            if fctx.Err() != nil { return "", false, fctx.Err() }
+            return `{"error":"similarweb unavailable"}`, false, nil
+        }
+        return mustJSON(sw), true, nil
+    })
+    if err != nil || !e.Ok { return nil, st }
+    var sw SimilarWebResponse
+    if json.Unmarshal([]byte(e.Payload), &sw) != nil { return nil, st }
+    return &sw, st
+}
+
+// POST /api/v1/siterank/cache/invalidate
+// body: { namespace?: "sw"|"analysis"|"similar"|"geo", host?: string, country?: string, key?: string }
+// Without namespace the host (or key) is invalidated in every namespace.
+func (s *Server) cacheInvalidateHandler(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Namespace string `json:"namespace"`
+        Host      string `json:"host"`
+        Country   string `json:"country"`
+        Key       string `json:"key"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid body", nil); return }
+    nss := []string{cacheNsSW, cacheNsAnalysis, cacheNsSimilar, cacheNsGeo}
+    if ns := strings.TrimSpace(body.Namespace); ns != "" {
+        if _, ok := defaultCachePolicies[ns]; !ok { errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "unknown namespace", map[string]any{"namespace": ns}); return }
+        nss = []string{ns}
+    }
+    prefix := strings.TrimSpace(body.Key)
+    if prefix == "" {
+        host := normalizeDomain(body.Host)
+        if host == "" && strings.TrimSpace(body.Namespace) == "" {
+            errors.Write(w, r, http.StatusBadRequest, "INVALID_ARGUMENT", "namespace, host or key required", nil); return
+        }
+        if host != "" {
+            prefix = host
+            if c := strings.ToUpper(strings.TrimSpace(body.Country)); c != "" { prefix = rcache.Key(host, c) }
+        }
+    }
+    removed := map[string]any{}
+    for _, ns := range nss {
+        p := prefix
+        // similar-sites keys are bare hosts; others are host|country
+        if ns != cacheNsSimilar && body.Key == "" && p != "" && !strings.Contains(p, "|") { p += "|" }
+        mem, pg, err := s.rc.Invalidate(r.Context(), ns, p)
+        if err != nil { errors.Write(w, r, http.StatusInternalServerError, "INTERNAL", "invalidate failed", map[string]any{"namespace": ns, "error": err.Error()}); return }
+        removed[ns] = map[string]any{"memory": mem, "postgres": pg}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{"invalidated": removed, "prefix": prefix})
+}
+
+// GET /api/v1/siterank/cache/stats
+func (s *Server) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(s.rc.Stats())
+}
@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/xxrenzhe/autoads/services/workflow/internal/events"
 	"github.com/xxrenzhe/autoads/pkg/config"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 	"github.com/xxrenzhe/autoads/pkg/logger"
 	"github.com/xxrenzhe/autoads/pkg/middleware"
 )
@@ -60,8 +62,15 @@ func main() {
 	}
 	defer publisher.Close()
 
-	// Initialize the Pub/Sub subscriber, passing the publisher to it.
-	subscriber, err := events.NewSubscriber(ctx, db, publisher)
+	// Events are recorded in event_outbox inside their transactions; the relay publishes them.
+	if err := ev.EnsureOutbox(ctx, db); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create event outbox")
+	}
+	relay := &ev.Relay{DB: db, Pub: publisher, Source: events.OutboxSource, Interval: time.Second}
+	go relay.Run(ctx)
+
+	// Initialize the Pub/Sub subscriber.
+	subscriber, err := events.NewSubscriber(ctx, db)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create event subscriber")
 	}
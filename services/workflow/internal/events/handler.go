@@ -10,8 +10,13 @@ import (
 	"log"
 
 	"github.com/google/uuid"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
+// OutboxSource names the workflow service's rows in the shared event_outbox (pkg/events); the
+// relay started in cmd/server publishes them.
+const OutboxSource = "workflow"
+
 // OfferCreatedPayload defines the structure for the "OfferCreated" event.
 type OfferCreatedPayload struct {
 	ID          string `json:"id"`
@@ -29,8 +34,8 @@ type WorkflowStepStartedPayload struct {
 }
 
 
-// HandleOfferCreated starts a new workflow and publishes an event to trigger the first step.
-func HandleOfferCreated(ctx context.Context, db *sql.DB, publisher *Publisher, payload []byte) error {
+// HandleOfferCreated starts a new workflow and records an event to trigger the first step.
+func HandleOfferCreated(ctx context.Context, db *sql.DB, payload []byte) error {
 	var data OfferCreatedPayload
 	if err := json.Unmarshal(payload, &data); err != nil {
 		return fmt.Errorf("failed to unmarshal OfferCreated payload: %w", err)
@@ -52,7 +57,7 @@ func HandleOfferCreated(ctx context.Context, db *sql.DB, publisher *Publisher, p
 
 	workflowProgressID := uuid.New().String()
 
-	// Using a transaction to ensure we only publish if the workflow is created.
+	// The trigger is recorded in the outbox in the same transaction, so it is published only if the workflow is created.
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -69,7 +74,7 @@ func HandleOfferCreated(ctx context.Context, db *sql.DB, publisher *Publisher, p
 		return fmt.Errorf("failed to create workflow progress record: %w", err)
 	}
 
-	// Now, publish the event to trigger the first step.
+	// Now, record the event that triggers the first step.
 	stepStartedPayload := WorkflowStepStartedPayload{
 		WorkflowProgressID: workflowProgressID,
 		UserID:             data.UserID,
@@ -77,14 +82,14 @@ func HandleOfferCreated(ctx context.Context, db *sql.DB, publisher *Publisher, p
 		Context:            workflowContext,
 	}
 
-	if err := publisher.Publish(ctx, "WorkflowStepStarted", stepStartedPayload); err != nil {
-		return fmt.Errorf("failed to publish WorkflowStepStarted event: %w", err)
+	if err := ev.Enqueue(ctx, tx, OutboxSource, ev.OutboxEvent{Type: "WorkflowStepStarted", Subject: workflowProgressID, Data: stepStartedPayload}); err != nil {
+		return fmt.Errorf("failed to record WorkflowStepStarted event: %w", err)
 	}
-	
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	log.Printf("Successfully started workflow and published Step 1 trigger for offerID: %s", data.ID)
+	log.Printf("Successfully started workflow and recorded Step 1 trigger for offerID: %s", data.ID)
 	return nil
 }
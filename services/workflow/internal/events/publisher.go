@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"cloud.google.com/go/pubsub"
+	ev "github.com/xxrenzhe/autoads/pkg/events"
 )
 
 // Publisher sends domain events to Google Cloud Pub/Sub.
@@ -49,8 +50,9 @@ func NewPublisher(ctx context.Context) (*Publisher, error) {
 	}, nil
 }
 
-// Publish sends an event to the topic.
-func (p *Publisher) Publish(ctx context.Context, eventType string, payload interface{}) error {
+// Publish sends an event to the topic. It implements ev.OutboxPublisher, so the outbox relay can
+// publish through it; options are not used.
+func (p *Publisher) Publish(ctx context.Context, eventType string, payload interface{}, _ ...ev.Option) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event payload: %w", err)
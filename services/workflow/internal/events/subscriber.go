@@ -14,13 +14,12 @@ import (
 
 // Subscriber listens for domain events from Google Cloud Pub/Sub.
 type Subscriber struct {
-	client    *pubsub.Client
-	db        *sql.DB
-	publisher *Publisher // Add publisher to the subscriber struct
+	client *pubsub.Client
+	db     *sql.DB
 }
 
 // NewSubscriber creates a new event subscriber.
-func NewSubscriber(ctx context.Context, db *sql.DB, publisher *Publisher) (*Subscriber, error) {
+func NewSubscriber(ctx context.Context, db *sql.DB) (*Subscriber, error) {
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
 		return nil, fmt.Errorf("GOOGLE_CLOUD_PROJECT environment variable must be set")
@@ -32,9 +31,8 @@ func NewSubscriber(ctx context.Context, db *sql.DB, publisher *Publisher) (*Subs
 	}
 
 	return &Subscriber{
-		client:    client,
-		db:        db,
-		publisher: publisher,
+		client: client,
+		db:     db,
 	}, nil
 }
 
@@ -55,7 +53,7 @@ func (s *Subscriber) StartListening(ctx context.Context) {
 		var err error
 		switch eventType {
 		case "OfferCreated":
-			err = HandleOfferCreated(cctx, s.db, s.publisher, msg.Data)
+			err = HandleOfferCreated(cctx, s.db, msg.Data)
 		default:
 			log.Printf("Workflow service is not subscribed to event type: %s. Acknowledging.", eventType)
 			msg.Ack()